@@ -0,0 +1,121 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package akamai
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// defaultTimeDimension is the time dimension reports are grouped by, unless configured.
+const defaultTimeDimension = "time5minutes"
+
+// resolutions are the intervals of the supported time dimensions.
+var resolutions = map[string]time.Duration{
+	"time5minutes": 5 * time.Minute,
+	"time1hour":    time.Hour,
+	"time1day":     24 * time.Hour,
+}
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Akamai.
+type MetricConfig struct {
+	// Report is the name and version of a Reporting API report, e.g. delivery/traffic/current.
+	Report string `validate:"nonzero"`
+	// Metric is the report metric that is imported, e.g. edgeHitsSum.
+	Metric string `validate:"nonzero"`
+	// TimeDimension is the dimension points are grouped by: time5minutes, time1hour or time1day.
+	TimeDimension string `yaml:"time_dimension" validate:"regexp=^(time5minutes|time1hour|time1day)?$"`
+	// Dimensions are further report dimensions imported as labels, e.g. cpcode or responseCode.
+	Dimensions []string
+	// CPCodes limits the report to these CP codes.
+	CPCodes []string `yaml:"cp_codes"`
+
+	// EdgeGrid is the API client used to authenticate requests.
+	EdgeGrid EdgeGridConfig `yaml:"edgegrid"`
+
+	HTTP httpclient.Config `yaml:"http"`
+}
+
+// EdgeGridConfig defines the credentials of an API client, using the same parameters as the .edgerc file.
+type EdgeGridConfig struct {
+	// Host is the API host of the client, e.g. akab-xxxx.luna.akamaiapis.net, or a URL including the scheme.
+	Host         string `validate:"nonzero"`
+	ClientToken  string `yaml:"client_token" validate:"nonzero"`
+	ClientSecret string `yaml:"client_secret"`
+	AccessToken  string `yaml:"access_token" validate:"nonzero"`
+
+	// The client secret can also be read from a file, e.g. from a mounted Kubernetes secret.
+	ClientSecretFile string `yaml:"client_secret_file"`
+}
+
+// ReadSecretFiles sets the client secret from the contents of the configured secret file. Relative paths are
+// resolved relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.EdgeGrid.ClientSecretFile == "" {
+		return nil
+	}
+	if c.EdgeGrid.ClientSecret != "" {
+		return fmt.Errorf("client_secret and client_secret_file cannot both be set")
+	}
+	secret, err := env.ReadSecretFile(dir, c.EdgeGrid.ClientSecretFile)
+	if err != nil {
+		return fmt.Errorf("cannot read client_secret_file: %v", err)
+	}
+	c.EdgeGrid.ClientSecret = secret
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if c.EdgeGrid.ClientSecret == "" {
+		return fmt.Errorf("client_secret or client_secret_file needs to be set")
+	}
+	seen := make(map[string]bool)
+	for _, d := range c.Dimensions {
+		if _, ok := resolutions[d]; ok || d == "" {
+			return fmt.Errorf("invalid dimension %q", d)
+		}
+		if seen[labelKey(d)] {
+			return fmt.Errorf("dimension %q conflicts with another dimension", d)
+		}
+		seen[labelKey(d)] = true
+	}
+	return nil
+}
+
+// baseURL returns the URL of the API host.
+func (c *EdgeGridConfig) baseURL() string {
+	if strings.Contains(c.Host, "://") {
+		return strings.TrimSuffix(c.Host, "/")
+	}
+	return "https://" + strings.TrimSuffix(c.Host, "/")
+}
+
+// timeDimension returns the dimension points are grouped by.
+func (c *MetricConfig) timeDimension() string {
+	if c.TimeDimension != "" {
+		return c.TimeDimension
+	}
+	return defaultTimeDimension
+}
+
+// resolution returns the interval of the time dimension.
+func (c *MetricConfig) resolution() time.Duration {
+	return resolutions[c.timeDimension()]
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package akamai
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxSignedBody is the maximum number of bytes of a request body included in its signature.
+const maxSignedBody = 131072
+
+// edgeGridTimeFormat is the format of timestamps in the Authorization header.
+const edgeGridTimeFormat = "20060102T15:04:05-0700"
+
+// sign adds an EdgeGrid Authorization header for the request with the given body to `req`.
+// See https://techdocs.akamai.com/developer/docs/authenticate-with-edgegrid
+func (c *EdgeGridConfig) sign(req *http.Request, body []byte, now time.Time) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("cannot generate nonce: %v", err)
+	}
+	timestamp := now.UTC().Format(edgeGridTimeFormat)
+	auth := fmt.Sprintf("EG1-HMAC-SHA256 client_token=%s;access_token=%s;timestamp=%s;nonce=%s;",
+		c.ClientToken, c.AccessToken, timestamp, hex.EncodeToString(nonce))
+
+	var contentHash string
+	if req.Method == http.MethodPost && len(body) > 0 {
+		if len(body) > maxSignedBody {
+			body = body[:maxSignedBody]
+		}
+		hash := sha256.Sum256(body)
+		contentHash = base64.StdEncoding.EncodeToString(hash[:])
+	}
+	data := strings.Join([]string{
+		req.Method,
+		req.URL.Scheme,
+		req.URL.Host,
+		req.URL.RequestURI(),
+		"", // no headers are signed.
+		contentHash,
+		auth,
+	}, "\t")
+	key := hmacSHA256([]byte(c.ClientSecret), timestamp)
+	req.Header.Set("Authorization", auth+"signature="+hmacSHA256([]byte(key), data))
+	return nil
+}
+
+// hmacSHA256 returns the base64-encoded HMAC-SHA256 of `data`.
+func hmacSHA256(key []byte, data string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
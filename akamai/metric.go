@@ -0,0 +1,306 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package akamai imports traffic and error reports of Akamai CP codes from the Reporting API.
+package akamai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a metric imported from Akamai. It implements the SourceMetric interface.
+type Metric struct {
+	Name        string
+	config      *MetricConfig
+	httpClient  *http.Client
+	minPointAge time.Duration
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig, minPointAge time.Duration) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:        name,
+		config:      config,
+		httpClient:  httpClient,
+		minPointAge: minPointAge,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/akamai/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "akamai"
+}
+
+// SourceHost returns the API host of the client. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.EdgeGrid.baseURL())
+	if err != nil || u.Host == "" {
+		return m.config.EdgeGrid.Host
+	}
+	return u.Host
+}
+
+// Query returns the report and metric of this metric.
+func (m *Metric) Query() string {
+	return fmt.Sprintf("%s: %s", m.config.Report, m.config.Metric)
+}
+
+// StackdriverData queries the Reporting API, returning metric descriptor and time series data with points after the
+// given lastPoint timestamp.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	return m.StackdriverDataUntil(ctx, lastPoint, time.Time{}, rec)
+}
+
+// Windowed returns whether the metric can be queried in windows, which is always the case for Akamai metrics.
+func (m *Metric) Windowed() bool {
+	return true
+}
+
+// reportRequest is the body of a request for report data.
+type reportRequest struct {
+	Dimensions []string `json:"dimensions"`
+	Metrics    []string `json:"metrics"`
+	Filters    []filter `json:"filters,omitempty"`
+}
+
+type filter struct {
+	DimensionName string   `json:"dimensionName"`
+	Operator      string   `json:"operator"`
+	Expressions   []string `json:"expressions"`
+}
+
+// StackdriverDataUntil works like StackdriverData, but only queries points up to `until`, unless it's zero.
+// Each row of the report aggregates an interval of the time dimension, and is imported at the end of it once the
+// interval has passed.
+func (m *Metric) StackdriverDataUntil(ctx context.Context, lastPoint, until time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	resolution := m.config.resolution()
+	end := timeNow().Add(-m.minPointAge)
+	if !until.IsZero() && until.Before(end) {
+		end = until
+	}
+	start := lastPoint.Truncate(resolution)
+	end = end.Truncate(resolution)
+	if !end.After(start) {
+		return nil, nil, nil
+	}
+	rows, err := m.report(ctx, start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.WithContext(ctx).Debugf("Got %d Akamai report rows for %s", len(rows), m.Query())
+
+	var ts []*monitoringpb.TimeSeries
+	for _, row := range rows {
+		t, err := parseTime(row[m.config.timeDimension()])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s of Akamai report row: %v", m.config.timeDimension(), err)
+		}
+		t = t.Add(resolution)
+		if !t.After(lastPoint) || t.After(end) {
+			continue
+		}
+		value, ok := number(row[m.config.Metric])
+		if !ok {
+			continue
+		}
+		labels := make(map[string]string)
+		for _, d := range m.config.Dimensions {
+			labels[labelKey(d)] = ""
+			if v := row[d]; v != nil {
+				labels[labelKey(d)] = fmt.Sprint(v)
+			}
+		}
+		et, err := ptypes.TimestampProto(t)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", t, err)
+		}
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: et},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+			}},
+		})
+	}
+	return m.metricDescriptor(), ts, nil
+}
+
+// report requests the rows of the report for intervals starting in [start, end).
+func (m *Metric) report(ctx context.Context, start, end time.Time) ([]map[string]interface{}, error) {
+	body := reportRequest{
+		Dimensions: append([]string{m.config.timeDimension()}, m.config.Dimensions...),
+		Metrics:    []string{m.config.Metric},
+	}
+	if len(m.config.CPCodes) > 0 {
+		body.Filters = []filter{{DimensionName: "cpcode", Operator: "IN_LIST", Expressions: m.config.CPCodes}}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	params := url.Values{
+		"start": {start.UTC().Format(time.RFC3339)},
+		"end":   {end.UTC().Format(time.RFC3339)},
+	}
+	u := fmt.Sprintf("%s/reporting-api/v2/reports/%s/data?%s", m.config.EdgeGrid.baseURL(), strings.Trim(m.config.Report, "/"), params.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+	if err := m.config.EdgeGrid.sign(req, data, timeNow()); err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("Akamai report request failed: %w", err))
+	}
+	defer resp.Body.Close()
+	respData, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("cannot read Akamai response: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Errors are returned as problem details, e.g. `{"title": "Bad Request", "detail": "Unknown metric"}`.
+		return nil, tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("Akamai report request returned HTTP status code %d: %s", resp.StatusCode, respData))
+	}
+	var result struct {
+		Data []map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(respData, &result); err != nil {
+		return nil, fmt.Errorf("cannot parse Akamai response: %v", err)
+	}
+	return result.Data, nil
+}
+
+// parseTime parses a value of the time dimension, which is either an ISO 8601 timestamp or seconds since the epoch.
+func parseTime(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case string:
+		if sec, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return time.Unix(sec, 0), nil
+		}
+		return time.Parse(time.RFC3339, t)
+	case float64:
+		return time.Unix(int64(t), 0), nil
+	}
+	return time.Time{}, fmt.Errorf("unexpected value %v", v)
+}
+
+// number returns the value of a report metric, which can be returned as a number or a string.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric, with a label for each dimension.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Akamai report %s", m.Query()),
+		DisplayName: m.Name,
+	}
+	if strings.Contains(strings.ToLower(m.config.Metric), "bytes") {
+		d.Unit = "By"
+	}
+	keys := make([]string, 0, len(m.config.Dimensions))
+	for _, dim := range m.config.Dimensions {
+		keys = append(keys, labelKey(dim))
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		d.Labels = append(d.Labels, &label.LabelDescriptor{
+			Key:         k,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "Akamai report dimension",
+		})
+	}
+	return d
+}
+
+// labelKey converts a report dimension name (e.g. "responseCode") into a Stackdriver label key in snake case
+// (e.g. "response_code").
+func labelKey(dimension string) string {
+	runes := []rune(dimension)
+	var b strings.Builder
+	for i, r := range runes {
+		switch {
+		case unicode.IsUpper(r):
+			// Start a new word before an upper-case letter that follows a lower-case letter or digit, or that starts
+			// a word after an acronym (like the C of Code in HTTPCode).
+			if i > 0 && (!unicode.IsUpper(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
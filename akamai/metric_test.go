@@ -0,0 +1,219 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package akamai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+var authHeader = regexp.MustCompile(`^(EG1-HMAC-SHA256 client_token=ct;access_token=at;timestamp=(\d{8}T\d\d:\d\d:\d\d\+0000);nonce=[0-9a-f]{32};)signature=(.+)$`)
+
+// verifySignature checks the EdgeGrid signature of a request received by a test server.
+func verifySignature(r *http.Request, body []byte) error {
+	m := authHeader.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return fmt.Errorf("invalid Authorization header %q", r.Header.Get("Authorization"))
+	}
+	hash := sha256.Sum256(body)
+	data := strings.Join([]string{r.Method, "http", r.Host, r.URL.RequestURI(), "", base64.StdEncoding.EncodeToString(hash[:]), m[1]}, "\t")
+	key := hmacSHA256([]byte("secret"), m[2])
+	if want := hmacSHA256([]byte(key), data); m[3] != want {
+		return fmt.Errorf("expected signature %s; got %s", want, m[3])
+	}
+	return nil
+}
+
+// testEdgeGrid returns the credentials of a client for a test server.
+func testEdgeGrid(server *httptest.Server) EdgeGridConfig {
+	return EdgeGridConfig{Host: server.URL, ClientToken: "ct", ClientSecret: "secret", AccessToken: "at"}
+}
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	labels map[string]string
+	offset time.Duration // relative to the start of a test.
+	value  float64
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, testPoint{s.Metric.Labels, end.Sub(start), s.Points[0].Value.GetDoubleValue()})
+	}
+	return points
+}
+
+func TestStackdriverData(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Hour)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(12 * time.Minute) }
+
+	var body reportRequest
+	var path string
+	var params url.Values
+	var requestID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := verifySignature(r, data); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, `{"title": "Unauthorized", "detail": "%v"}`, err)
+			return
+		}
+		json.Unmarshal(data, &body)
+		path, params, requestID = r.URL.Path, r.URL.Query(), r.Header.Get(requestid.Header)
+		ts := func(d time.Duration) string { return start.Add(d).UTC().Format(time.RFC3339) }
+		fmt.Fprintf(w, `{"metadata": {}, "data": [
+			{"time5minutes": "%s", "cpcode": "123", "responseCode": "503", "edgeHitsSum": 10},
+			{"time5minutes": "%s", "cpcode": "123", "responseCode": "503", "edgeHitsSum": "12"},
+			{"time5minutes": "%s", "cpcode": 456, "responseCode": "404", "edgeHitsSum": 3},
+			{"time5minutes": "%s", "cpcode": "456", "responseCode": "404", "edgeHitsSum": null}
+		]}`, ts(0), ts(5*time.Minute), ts(0), ts(5*time.Minute))
+	}))
+	defer server.Close()
+
+	m, err := NewSourceMetric("errors", &MetricConfig{
+		Report:     "delivery/traffic/current",
+		Metric:     "edgeHitsSum",
+		Dimensions: []string{"cpcode", "responseCode"},
+		CPCodes:    []string{"123", "456"},
+		EdgeGrid:   testEdgeGrid(server),
+	}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if path != "/reporting-api/v2/reports/delivery/traffic/current/data" || requestID != "req-1" {
+		t.Errorf("unexpected request to %s with request ID %s", path, requestID)
+	}
+	wantParams := url.Values{"start": {start.UTC().Format(time.RFC3339)}, "end": {start.Add(10 * time.Minute).UTC().Format(time.RFC3339)}}
+	if !reflect.DeepEqual(params, wantParams) {
+		t.Errorf("expected query parameters %v; got %v", wantParams, params)
+	}
+	wantBody := reportRequest{
+		Dimensions: []string{"time5minutes", "cpcode", "responseCode"},
+		Metrics:    []string{"edgeHitsSum"},
+		Filters:    []filter{{"cpcode", "IN_LIST", []string{"123", "456"}}},
+	}
+	if !reflect.DeepEqual(body, wantBody) {
+		t.Errorf("expected report request %+v; got %+v", wantBody, body)
+	}
+	if desc.Type != "custom.googleapis.com/akamai/errors" || len(desc.Labels) != 2 || desc.Labels[0].Key != "cpcode" || desc.Labels[1].Key != "response_code" {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// Points are at the end of each interval, and rows without a value are skipped.
+	want := []testPoint{
+		{map[string]string{"cpcode": "123", "response_code": "503"}, 5 * time.Minute, 10},
+		{map[string]string{"cpcode": "123", "response_code": "503"}, 10 * time.Minute, 12},
+		{map[string]string{"cpcode": "456", "response_code": "404"}, 5 * time.Minute, 3},
+	}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		status    int
+		wantClass error
+	}{
+		{"unauthorized", http.StatusUnauthorized, tserrors.ErrSourcePermanent},
+		{"unknown metric", http.StatusBadRequest, tserrors.ErrSourcePermanent},
+		{"throttled", http.StatusTooManyRequests, tserrors.ErrSourceTransient},
+		{"unavailable", http.StatusServiceUnavailable, tserrors.ErrSourceTransient},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, `{"title": "Error", "detail": "error"}`)
+			}))
+			defer server.Close()
+
+			m, err := NewSourceMetric("errors", &MetricConfig{Report: "r", Metric: "m", EdgeGrid: testEdgeGrid(server)}, 0)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	edgeGrid := EdgeGridConfig{Host: "akab-x.luna.akamaiapis.net", ClientToken: "ct", ClientSecret: "secret", AccessToken: "at"}
+	for _, config := range []*MetricConfig{
+		{Report: "r", Metric: "m", EdgeGrid: EdgeGridConfig{Host: "akab-x.luna.akamaiapis.net", ClientToken: "ct", AccessToken: "at"}},
+		{Report: "r", Metric: "m", Dimensions: []string{"time1hour"}, EdgeGrid: edgeGrid},
+		{Report: "r", Metric: "m", Dimensions: []string{"cpCode", "cp_code"}, EdgeGrid: edgeGrid},
+	} {
+		if _, err := NewSourceMetric("invalid", config, 0); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
+
+func TestSourceHost(t *testing.T) {
+	m, err := NewSourceMetric("host", &MetricConfig{Report: "r", Metric: "m", EdgeGrid: EdgeGridConfig{
+		Host: "akab-x.luna.akamaiapis.net", ClientToken: "ct", ClientSecret: "secret", AccessToken: "at"}}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	if m.SourceHost() != "akab-x.luna.akamaiapis.net" {
+		t.Errorf("unexpected source host %s", m.SourceHost())
+	}
+}
+
+func TestLabelKey(t *testing.T) {
+	for in, want := range map[string]string{
+		"cpcode":       "cpcode",
+		"responseCode": "response_code",
+		"HTTPCode":     "http_code",
+		"cp-code":      "cp_code",
+	} {
+		if got := labelKey(in); got != want {
+			t.Errorf("labelKey(%s) = %s; want %s", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package alerting provisions Cloud Monitoring alert policies that fire when imported metrics become stale, using
+// the internal stats reported by ts-bridge.
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// Metric types of the internal stats that policies are based on.
+const (
+	oldestAgeType  = "custom.googleapis.com/opencensus/ts_bridge/oldest_metric_age"
+	heartbeatsType = "custom.googleapis.com/opencensus/ts_bridge/heartbeats"
+)
+
+// Policies created by ts-bridge are found using a user label, so that their display name can be changed in the
+// Cloud Console without creating a second policy.
+const (
+	managedLabel = "ts_bridge"
+	managedValue = "staleness"
+)
+
+// alignmentPeriod is the alignment period of all conditions. Internal stats are written once per sync.
+const alignmentPeriod = "60s"
+
+const documentation = `Metrics imported by ts-bridge into project %s are stale: either the oldest time since the last
+successful import of a metric exceeds %v, or no syncs of metrics written to this project have been reported for %v.
+
+Check the ts-bridge status page and logs for failing imports, and make sure that syncs are still scheduled.`
+
+// New returns a policy for a destination project that fires when the oldest time since the last successful import
+// across all metrics (ts_bridge/oldest_metric_age) exceeds a threshold, or when no heartbeats have been reported
+// for metrics of the project for as long. Only notification channels of the project are used, since policies
+// cannot notify channels of other projects.
+func New(project string, threshold time.Duration, channels []string) *monitoring.AlertPolicy {
+	// Absence durations need to be whole minutes.
+	absence := (threshold + time.Minute - 1) / time.Minute * time.Minute
+	p := &monitoring.AlertPolicy{
+		DisplayName: "ts-bridge: stale metrics",
+		Combiner:    "OR",
+		Enabled:     true,
+		UserLabels:  map[string]string{managedLabel: managedValue},
+		Documentation: &monitoring.Documentation{
+			Content:  fmt.Sprintf(documentation, project, threshold, absence),
+			MimeType: "text/markdown",
+		},
+		Conditions: []*monitoring.Condition{
+			{
+				DisplayName: fmt.Sprintf("Oldest metric age above %v", threshold),
+				ConditionThreshold: &monitoring.MetricThreshold{
+					Filter: fmt.Sprintf(`metric.type="%s"`, oldestAgeType),
+					Aggregations: []*monitoring.Aggregation{{
+						AlignmentPeriod:    alignmentPeriod,
+						PerSeriesAligner:   "ALIGN_MAX",
+						CrossSeriesReducer: "REDUCE_MAX",
+					}},
+					Comparison:     "COMPARISON_GT",
+					ThresholdValue: float64(threshold / time.Millisecond),
+					Duration:       "0s",
+					Trigger:        &monitoring.Trigger{Count: 1},
+				},
+			},
+			{
+				DisplayName: fmt.Sprintf("No heartbeats for %v", absence),
+				ConditionAbsent: &monitoring.MetricAbsence{
+					Filter: fmt.Sprintf(`metric.type="%s" AND metric.label.destination_project="%s"`, heartbeatsType, project),
+					Aggregations: []*monitoring.Aggregation{{
+						AlignmentPeriod:    alignmentPeriod,
+						PerSeriesAligner:   "ALIGN_DELTA",
+						CrossSeriesReducer: "REDUCE_SUM",
+					}},
+					Duration: fmt.Sprintf("%ds", absence/time.Second),
+					Trigger:  &monitoring.Trigger{Count: 1},
+				},
+			},
+		},
+	}
+	prefix := "projects/" + project + "/"
+	for _, c := range channels {
+		if strings.HasPrefix(c, prefix) {
+			p.NotificationChannels = append(p.NotificationChannels, c)
+		}
+	}
+	return p
+}
+
+// Apply creates the policy of a project, or replaces the policy previously created by ts-bridge.
+func Apply(ctx context.Context, svc *monitoring.Service, project string, p *monitoring.AlertPolicy) (*monitoring.AlertPolicy, error) {
+	name := "projects/" + project
+	filter := fmt.Sprintf(`user_labels.%s="%s"`, managedLabel, managedValue)
+	existing, err := svc.Projects.AlertPolicies.List(name).Filter(filter).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list alert policies of project %s: %v", project, err)
+	}
+	if len(existing.AlertPolicies) == 0 {
+		created, err := svc.Projects.AlertPolicies.Create(name, p).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("cannot create alert policy in project %s: %v", project, err)
+		}
+		return created, nil
+	}
+	p.Name = existing.AlertPolicies[0].Name
+	updated, err := svc.Projects.AlertPolicies.Patch(p.Name, p).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("cannot update alert policy %s: %v", p.Name, err)
+	}
+	return updated, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	monitoring "google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+)
+
+func TestNew(t *testing.T) {
+	channels := []string{"projects/p1/notificationChannels/1", "projects/p2/notificationChannels/2", "projects/p1/notificationChannels/3"}
+	p := New("p1", 90*time.Second, channels)
+	if want := []string{"projects/p1/notificationChannels/1", "projects/p1/notificationChannels/3"}; !reflect.DeepEqual(p.NotificationChannels, want) {
+		t.Errorf("expected channels %v; got %v", want, p.NotificationChannels)
+	}
+	if p.UserLabels[managedLabel] != managedValue || p.Combiner != "OR" || !p.Enabled {
+		t.Errorf("unexpected policy %+v", p)
+	}
+	if len(p.Conditions) != 2 {
+		t.Fatalf("expected 2 conditions; got %d", len(p.Conditions))
+	}
+	age := p.Conditions[0].ConditionThreshold
+	if age.ThresholdValue != 90000 || age.Filter != `metric.type="custom.googleapis.com/opencensus/ts_bridge/oldest_metric_age"` {
+		t.Errorf("unexpected age condition %+v", age)
+	}
+	absent := p.Conditions[1].ConditionAbsent
+	if absent.Duration != "120s" {
+		t.Errorf("expected absence duration rounded up to 120s; got %s", absent.Duration)
+	}
+	if want := `metric.type="custom.googleapis.com/opencensus/ts_bridge/heartbeats" AND metric.label.destination_project="p1"`; absent.Filter != want {
+		t.Errorf("expected heartbeat filter %s; got %s", want, absent.Filter)
+	}
+}
+
+func TestApply(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		list       string
+		wantMethod string
+		wantPath   string
+	}{
+		{"create", `{}`, http.MethodPost, "/v3/projects/p1/alertPolicies"},
+		{"replace", `{"alertPolicies": [{"name": "projects/p1/alertPolicies/123"}]}`, http.MethodPatch, "/v3/projects/p1/alertPolicies/123"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, path, filter string
+			var sent monitoring.AlertPolicy
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					filter = r.URL.Query().Get("filter")
+					w.Write([]byte(tt.list))
+					return
+				}
+				method, path = r.Method, r.URL.Path
+				body, _ := ioutil.ReadAll(r.Body)
+				if err := json.Unmarshal(body, &sent); err != nil {
+					t.Errorf("invalid request body %s: %v", body, err)
+				}
+				w.Write(body)
+			}))
+			defer srv.Close()
+
+			ctx := context.Background()
+			svc, err := monitoring.NewService(ctx, option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := Apply(ctx, svc, "p1", New("p1", time.Hour, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := `user_labels.ts_bridge="staleness"`; filter != want {
+				t.Errorf("expected policies to be listed with filter %s; got %s", want, filter)
+			}
+			if method != tt.wantMethod || path != tt.wantPath {
+				t.Errorf("expected %s %s; got %s %s", tt.wantMethod, tt.wantPath, method, path)
+			}
+			if len(sent.Conditions) != 2 || len(p.Conditions) != 2 {
+				t.Errorf("expected the policy to be sent and returned; sent %+v, got %+v", sent, p)
+			}
+		})
+	}
+}
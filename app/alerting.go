@@ -0,0 +1,89 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/alerting"
+
+	log "github.com/sirupsen/logrus"
+	monitoring "google.golang.org/api/monitoring/v3"
+	"google.golang.org/api/option"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	stalenessAlertThreshold = kingpin.Flag(
+		"staleness-alert-threshold", "create or update an alert policy in each destination project at startup, firing when the oldest metric age exceeds this threshold or syncs stop (0 disables it, otherwise at least 2m).",
+	).Envar("STALENESS_ALERT_THRESHOLD").Default("0").Duration()
+
+	stalenessAlertChannels = kingpin.Flag(
+		"staleness-alert-channels", "comma-separated list of notification channels of staleness alert policies, e.g. 'projects/my-project/notificationChannels/123'",
+	).Envar("STALENESS_ALERT_CHANNELS").String()
+)
+
+// alertPolicyTimeout limits the time spent provisioning alert policies at startup.
+const alertPolicyTimeout = 2 * time.Minute
+
+// provisionAlertPolicies creates or updates the staleness alert policy of each project that metrics are written to.
+// Failures are logged, since they should not prevent ts-bridge from importing metrics.
+func provisionAlertPolicies() {
+	ctx, cancel := context.WithTimeout(context.Background(), alertPolicyTimeout)
+	defer cancel()
+
+	config, err := loadScopedConfig(ctx, "")
+	if err != nil {
+		log.Errorf("Cannot provision staleness alert policies: %v", err)
+		return
+	}
+	seen := make(map[string]bool)
+	var projects []string
+	for _, m := range config.Metrics() {
+		if !seen[m.SDProject] {
+			seen[m.SDProject] = true
+			projects = append(projects, m.SDProject)
+		}
+	}
+	sort.Strings(projects)
+
+	opts, err := sdClientOptions()
+	if err != nil {
+		log.Errorf("Cannot provision staleness alert policies: cannot read Stackdriver credentials: %v", err)
+		return
+	}
+	svc, err := monitoring.NewService(ctx, append(opts, option.WithScopes(monitoring.MonitoringScope))...)
+	if err != nil {
+		log.Errorf("Cannot provision staleness alert policies: cannot create Monitoring API client: %v", err)
+		return
+	}
+	var channels []string
+	for _, c := range strings.Split(*stalenessAlertChannels, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			channels = append(channels, c)
+		}
+	}
+	for _, project := range projects {
+		p, err := alerting.Apply(ctx, svc, project, alerting.New(project, *stalenessAlertThreshold, channels))
+		if err != nil {
+			log.Errorf("Cannot provision staleness alert policy: %v", err)
+			continue
+		}
+		log.Infof("Provisioned staleness alert policy %s", p.Name)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/tsbridge"
+	"github.com/google/ts-bridge/usage"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// Exit codes of the check command, following the Nagios plugin convention.
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+)
+
+var (
+	checkCmd = kingpin.Command("check", "check how recently metrics have been imported, exiting with 0 (OK), 1 (warning) or 2 (critical)")
+
+	checkStatusURL = checkCmd.Flag(
+		"status-url", "URL of the /status.json page of a running ts-bridge server (defaults to the local server)",
+	).String()
+
+	checkFromStorage = checkCmd.Flag(
+		"from-storage", "read metric status from the storage engine directly instead of querying a running server",
+	).Default("false").Bool()
+
+	checkTenant = checkCmd.Flag("tenant", "only check metrics of a given tenant").String()
+
+	checkWarningAge = checkCmd.Flag(
+		"warning-age", "time since the last successful import of a metric after which the check returns a warning",
+	).Default("10m").Duration()
+
+	checkCriticalAge = checkCmd.Flag(
+		"critical-age", "time since the last successful import of a metric after which the check is critical",
+	).Default("30m").Duration()
+
+	checkTimeout = checkCmd.Flag("timeout", "how long the check is allowed to take").Default("30s").Duration()
+)
+
+// metricStatus is the import status of a single metric, as reported by /status.json.
+type metricStatus struct {
+	Name          string    `json:"name"`
+	Tenant        string    `json:"tenant,omitempty"`
+	LastUpdate    time.Time `json:"last_update"`
+	LastAttempt   time.Time `json:"last_attempt"`
+	Status        string    `json:"status"`
+	MissingPoints int       `json:"missing_points,omitempty"`
+	// AgeSeconds is the time since the last import, only counting time when the metric was expected to have data.
+	// It is nil in reports of servers that predate expected-data schedules.
+	AgeSeconds *int64 `json:"age_seconds,omitempty"`
+	// UsageToday covers updates run by the server since the start of the day in UTC.
+	UsageToday usage.Counts `json:"usage_today"`
+}
+
+// statusReport is the document served by /status.json.
+type statusReport struct {
+	Metrics []*metricStatus `json:"metrics"`
+}
+
+// newStatusReport returns the import status of all metrics in a configuration.
+func newStatusReport(config *tsbridge.Config) *statusReport {
+	report := &statusReport{Metrics: []*metricStatus{}}
+	now := time.Now()
+	for _, m := range config.Metrics() {
+		var age *int64
+		if !m.Record.GetLastUpdate().IsZero() {
+			seconds := int64(m.DataAge(now) / time.Second)
+			age = &seconds
+		}
+		report.Metrics = append(report.Metrics, &metricStatus{
+			Name:          m.Name,
+			Tenant:        m.Tenant,
+			LastUpdate:    m.Record.GetLastUpdate(),
+			LastAttempt:   m.Record.GetLastAttempt(),
+			Status:        m.Record.GetLastStatus(),
+			MissingPoints: m.Record.GetMissingPoints(),
+			AgeSeconds:    age,
+			UsageToday:    m.UsageToday(),
+		})
+	}
+	return report
+}
+
+// statusJSON serves import status of all metrics as JSON. Like the status page, it needs to be enabled explicitly.
+func statusJSON(w http.ResponseWriter, r *http.Request) {
+	if *enableStatusPage != true {
+		http.Error(w, "Status page is disabled. Please set ENABLE_STATUS_PAGE or --enable-status-page flag to to enable it.",
+			http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+
+	storage, err := loadStorageEngine(ctx)
+	if err != nil {
+		logAndReturnError(ctx, w, err)
+		return
+	}
+	defer storage.Close()
+
+	config, err := newRuntimeConfig(ctx, storage)
+	if err != nil {
+		logAndReturnError(ctx, w, err)
+		return
+	}
+	config, err = scopeToTenant(r, config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(newStatusReport(config)); err != nil {
+		logAndReturnError(ctx, w, err)
+	}
+}
+
+// check runs the check command, printing a single line summary and returning the exit code.
+func check() int {
+	if *checkCriticalAge < *checkWarningAge {
+		fmt.Printf("CRITICAL: --critical-age (%v) cannot be shorter than --warning-age (%v)\n", *checkCriticalAge, *checkWarningAge)
+		return checkCritical
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *checkTimeout)
+	defer cancel()
+
+	var report *statusReport
+	var err error
+	if *checkFromStorage {
+		report, err = storageStatus(ctx)
+	} else {
+		report, err = serverStatus(ctx)
+	}
+	if err != nil {
+		fmt.Printf("CRITICAL: cannot get metric status: %v\n", err)
+		return checkCritical
+	}
+
+	code, summary := evaluateStatus(report, time.Now(), *checkWarningAge, *checkCriticalAge)
+	fmt.Println(summary)
+	return code
+}
+
+// storageStatus reads import status of metrics from the storage engine.
+func storageStatus(ctx context.Context) (*statusReport, error) {
+	storage, err := loadStorageEngine(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+
+	config, err := newRuntimeConfig(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	if *checkTenant != "" {
+		if config, err = config.ForTenant(*checkTenant); err != nil {
+			return nil, err
+		}
+	}
+	return newStatusReport(config), nil
+}
+
+// serverStatus queries import status of metrics from /status.json of a running server.
+func serverStatus(ctx context.Context) (*statusReport, error) {
+	u := *checkStatusURL
+	if u == "" {
+		u = (&url.URL{Scheme: "http", Host: net.JoinHostPort("localhost", strconv.Itoa(*port)), Path: "/status.json"}).String()
+	}
+	if *checkTenant != "" {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		q := parsed.Query()
+		q.Set("tenant", *checkTenant)
+		parsed.RawQuery = q.Encode()
+		u = parsed.String()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	report := &statusReport{}
+	if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+		return nil, fmt.Errorf("cannot parse response of %s: %v", u, err)
+	}
+	return report, nil
+}
+
+// evaluateStatus returns the exit code and a summary based on how long ago each metric was last imported, which
+// excludes time when no data was expected if the server reports it. Metrics that have never been imported are
+// considered critical.
+func evaluateStatus(report *statusReport, now time.Time, warningAge, criticalAge time.Duration) (int, string) {
+	var warning, critical []string
+	for _, m := range report.Metrics {
+		if m.LastUpdate.IsZero() {
+			critical = append(critical, fmt.Sprintf("%s (never imported)", m.Name))
+			continue
+		}
+		age := now.Sub(m.LastUpdate).Truncate(time.Second)
+		if m.AgeSeconds != nil {
+			age = time.Duration(*m.AgeSeconds) * time.Second
+		}
+		switch {
+		case age >= criticalAge:
+			critical = append(critical, fmt.Sprintf("%s (%v)", m.Name, age))
+		case age >= warningAge:
+			warning = append(warning, fmt.Sprintf("%s (%v)", m.Name, age))
+		}
+	}
+
+	total := len(report.Metrics)
+	switch {
+	case len(critical) > 0:
+		return checkCritical, fmt.Sprintf("CRITICAL: %d of %d metrics not imported within %v: %s", len(critical), total,
+			criticalAge, strings.Join(critical, ", "))
+	case len(warning) > 0:
+		return checkWarning, fmt.Sprintf("WARNING: %d of %d metrics not imported within %v: %s", len(warning), total,
+			warningAge, strings.Join(warning, ", "))
+	}
+	return checkOK, fmt.Sprintf("OK: %d metrics imported within %v", total, warningAge)
+}
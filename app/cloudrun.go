@@ -0,0 +1,151 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/ts-bridge/env"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/idtoken"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	schedulerAudience = kingpin.Flag(
+		"scheduler-oidc-audience", "audience of OIDC tokens that /sync and /cleanup requests need to have, e.g. the URL of the Cloud Run service (not checked if empty)",
+	).Envar("SCHEDULER_OIDC_AUDIENCE").String()
+
+	schedulerServiceAccount = kingpin.Flag(
+		"scheduler-service-account", "email of the service account that OIDC tokens of /sync and /cleanup requests need to be issued for, e.g. the one used by Cloud Scheduler",
+	).Envar("SCHEDULER_SERVICE_ACCOUNT").String()
+
+	adminToken = kingpin.Flag(
+		"admin-token", "shared secret that /sync, /cleanup and /boltdb/maintenance requests need to send as a bearer token (not checked if empty)",
+	).Envar("ADMIN_TOKEN").String()
+
+	adminTokenFile = kingpin.Flag(
+		"admin-token-file", "file or sm:// Secret Manager reference containing the admin token, used instead of --admin-token",
+	).Envar("ADMIN_TOKEN_FILE").String()
+
+	logFormat = kingpin.Flag(
+		"log-format", "log format: text, or json for structured logs understood by Cloud Logging (defaults to json on Cloud Run)",
+	).Envar("LOG_FORMAT").Enum("", "text", "json")
+)
+
+// configureLogging sets the log format. Cloud Logging parses JSON log lines written to stdout, and reads their
+// severity from the `severity` field.
+func configureLogging() {
+	format := *logFormat
+	if format == "" && env.IsCloudRun() {
+		format = "json"
+	}
+	if format == "json" {
+		log.SetFormatter(&log.JSONFormatter{
+			FieldMap: log.FieldMap{
+				log.FieldKeyLevel: "severity",
+				log.FieldKeyMsg:   "message",
+				log.FieldKeyTime:  "time",
+			},
+		})
+	}
+}
+
+// authorizeScheduled checks that a request to an endpoint that is triggered regularly (/sync or /cleanup) comes
+// from App Engine Cron when running on App Engine, and that it's authorized by authorizeAdmin. It writes an error
+// response and returns false otherwise.
+func authorizeScheduled(w http.ResponseWriter, r *http.Request) bool {
+	if env.IsAppEngine() && r.Header.Get("X-Appengine-Cron") != "true" {
+		http.Error(w, "Only cron requests are allowed here", http.StatusUnauthorized)
+		return false
+	}
+	return authorizeAdmin(w, r)
+}
+
+// authorizeAdmin checks that a request to an endpoint that updates metrics or storage has the configured admin token
+// or a valid OIDC token (such as the one sent by Cloud Scheduler) if an audience is configured. Either token is
+// accepted if both are configured, and all requests are allowed if neither is. It writes an error response and
+// returns false otherwise.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token, err := configuredAdminToken()
+	if err != nil {
+		logAndReturnError(r.Context(), w, fmt.Errorf("cannot read admin token: %v", err))
+		return false
+	}
+	if token == "" && *schedulerAudience == "" {
+		return true
+	}
+	if token != "" {
+		if validAdminToken(r, token) {
+			return true
+		}
+		err = fmt.Errorf("invalid admin token")
+	}
+	if *schedulerAudience != "" {
+		if err = validateOIDCToken(r); err == nil {
+			return true
+		}
+	}
+	log.WithContext(r.Context()).Warningf("Rejecting %s request: %v", r.URL.Path, err)
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	if token == "" {
+		http.Error(w, "A valid OIDC token is required", http.StatusUnauthorized)
+	} else {
+		http.Error(w, "A valid token is required", http.StatusUnauthorized)
+	}
+	return false
+}
+
+// configuredAdminToken returns the static admin token, or an empty string if it's not configured. The token file is
+// read during each request, so that the token can be rotated without a restart.
+func configuredAdminToken() (string, error) {
+	if *adminTokenFile == "" {
+		return *adminToken, nil
+	}
+	return env.ReadSecretFile("", *adminTokenFile)
+}
+
+// validAdminToken checks whether the bearer token of a request matches the admin token. Tokens are compared in
+// constant time to avoid leaking how much of a guessed token is correct.
+func validAdminToken(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// validateOIDCToken validates the bearer token of a request against the configured audience and service account.
+func validateOIDCToken(r *http.Request) error {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return fmt.Errorf("no bearer token")
+	}
+	payload, err := idtoken.Validate(r.Context(), strings.TrimPrefix(auth, "Bearer "), *schedulerAudience)
+	if err != nil {
+		return fmt.Errorf("invalid token: %v", err)
+	}
+	if *schedulerServiceAccount == "" {
+		return nil
+	}
+	if email, _ := payload.Claims["email"].(string); email != *schedulerServiceAccount {
+		return fmt.Errorf("token issued for %q instead of %q", email, *schedulerServiceAccount)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/google/ts-bridge/tsbridge"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	configCmd = kingpin.Command("config", "print the effective metric configuration with secrets redacted, as served by /config")
+
+	configTenant  = configCmd.Flag("tenant", "only print the configuration of a given tenant").String()
+	configTimeout = configCmd.Flag("timeout", "how long loading the configuration is allowed to take").Default("1m").Duration()
+)
+
+// effectiveConfig is the document served by /config.
+type effectiveConfig struct {
+	// Settings are global settings that affect how metrics are imported.
+	Settings                 yaml.MapSlice `yaml:"settings"`
+	tsbridge.EffectiveConfig `yaml:",inline"`
+}
+
+// newEffectiveConfig returns the effective configuration along with global settings.
+func newEffectiveConfig(config *tsbridge.Config) ([]byte, error) {
+	e, err := config.Effective()
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(&effectiveConfig{
+		Settings: yaml.MapSlice{
+			{Key: "config_file", Value: *metricConfig},
+			{Key: "update_timeout", Value: *updateTimeout},
+			{Key: "update_parallelism", Value: *updateParallelism},
+			{Key: "source_parallelism", Value: sourceParallelism},
+			{Key: "warm_start_ramp", Value: *warmStartRamp},
+			{Key: "min_point_age", Value: *minPointAge},
+			{Key: "query_chunk", Value: *queryChunk},
+			{Key: "counter_reset_interval", Value: *counterResetInterval},
+			{Key: "allow_unknown_fields", Value: *allowUnknownFields},
+			{Key: "storage_engine", Value: *storageEngine},
+			{Key: "kubernetes_controller", Value: *kubernetesController},
+		},
+		EffectiveConfig: *e,
+	})
+}
+
+// configYAML serves the effective configuration as YAML. Like the status page, it needs to be enabled explicitly.
+func configYAML(w http.ResponseWriter, r *http.Request) {
+	if *enableStatusPage != true {
+		http.Error(w, "Status page is disabled. Please set ENABLE_STATUS_PAGE or --enable-status-page flag to to enable it.",
+			http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+
+	storage, err := loadStorageEngine(ctx)
+	if err != nil {
+		logAndReturnError(ctx, w, err)
+		return
+	}
+	defer storage.Close()
+
+	config, err := newRuntimeConfig(ctx, storage)
+	if err != nil {
+		logAndReturnError(ctx, w, err)
+		return
+	}
+	config, err = scopeToTenant(r, config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	data, err := newEffectiveConfig(config)
+	if err != nil {
+		logAndReturnError(ctx, w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(data)
+}
+
+// printConfig runs the config command, printing the effective configuration and returning the exit code.
+func printConfig() int {
+	ctx, cancel := context.WithTimeout(context.Background(), *configTimeout)
+	defer cancel()
+
+	data, err := loadEffectiveConfig(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load configuration: %v\n", err)
+		return 1
+	}
+	os.Stdout.Write(data)
+	return 0
+}
+
+// loadEffectiveConfig reads the effective configuration, optionally scoped to a tenant.
+func loadEffectiveConfig(ctx context.Context) ([]byte, error) {
+	config, err := loadScopedConfig(ctx, *configTenant)
+	if err != nil {
+		return nil, err
+	}
+	return newEffectiveConfig(config)
+}
+
+// loadScopedConfig reads the configuration using the storage engine, since metric records are loaded along with it,
+// and scopes it to a tenant unless the tenant is empty. Records cannot be used once the configuration is returned.
+func loadScopedConfig(ctx context.Context, tenant string) (*tsbridge.Config, error) {
+	storage, err := loadStorageEngine(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.Close()
+
+	config, err := newRuntimeConfig(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+	if tenant == "" {
+		return config, nil
+	}
+	return config.ForTenant(tenant)
+}
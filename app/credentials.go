@@ -0,0 +1,63 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/google/ts-bridge/env"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	sdCredentialsFile = kingpin.Flag(
+		"sd-credentials-file", "service account key used to write to Stackdriver, as a file or an sm:// Secret Manager reference (defaults to application default credentials)",
+	).Envar("SD_CREDENTIALS_FILE").String()
+
+	secretRefreshInterval = kingpin.Flag(
+		"secret-refresh-interval", "how long secrets read from Secret Manager are cached before being accessed again.",
+	).Envar("SECRET_REFRESH_INTERVAL").Default("5m").Duration()
+)
+
+// sdClientOptions returns the options of the Stackdriver client used during a sync. The key file is read again for
+// each sync, so that a rotated key is used by the next sync without a restart, while running syncs keep their client.
+func sdClientOptions() ([]option.ClientOption, error) {
+	if *sdCredentialsFile == "" {
+		return nil, nil
+	}
+	key, err := env.ReadSecretFile("", *sdCredentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	return []option.ClientOption{option.WithCredentialsJSON([]byte(key))}, nil
+}
+
+// reloadSecretsOnHangup drops cached Secret Manager secrets whenever the process receives SIGHUP, so that rotated
+// credentials are picked up by the next sync instead of after the refresh interval.
+func reloadSecretsOnHangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			env.FlushSecrets()
+			log.Info("Received SIGHUP, secrets will be read again during the next sync")
+		}
+	}()
+}
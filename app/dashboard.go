@@ -0,0 +1,102 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/ts-bridge/dashboard"
+
+	monitoring "google.golang.org/api/monitoring/v1"
+	"google.golang.org/api/option"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	dashboardCmd = kingpin.Command("dashboard", "generate a Cloud Monitoring dashboard with a chart for every imported metric, grouped by tenant and source")
+
+	dashboardProject = dashboardCmd.Flag(
+		"project", "destination project whose metrics are charted (defaults to the only project metrics are written to)",
+	).String()
+	dashboardID          = dashboardCmd.Flag("id", "ID of the dashboard within the project").Default("ts-bridge").String()
+	dashboardDisplayName = dashboardCmd.Flag("display-name", "name of the dashboard shown in the Cloud Console").Default("ts-bridge").String()
+	dashboardTenant      = dashboardCmd.Flag("tenant", "only chart metrics of a given tenant").String()
+	dashboardApply       = dashboardCmd.Flag(
+		"apply", "create or replace the dashboard using the Dashboards API instead of printing it as JSON",
+	).Default("false").Bool()
+	dashboardTimeout = dashboardCmd.Flag("timeout", "how long generating the dashboard is allowed to take").Default("1m").Duration()
+)
+
+// generateDashboard runs the dashboard command, returning the exit code.
+func generateDashboard() int {
+	ctx, cancel := context.WithTimeout(context.Background(), *dashboardTimeout)
+	defer cancel()
+
+	if err := runDashboard(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot generate dashboard: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func runDashboard(ctx context.Context) error {
+	config, err := loadScopedConfig(ctx, *dashboardTenant)
+	if err != nil {
+		return err
+	}
+	e, err := config.Effective()
+	if err != nil {
+		return err
+	}
+	projects := dashboard.Projects(e.Metrics)
+	project := *dashboardProject
+	switch {
+	case project == "" && len(projects) == 1:
+		project = projects[0]
+	case project == "":
+		return fmt.Errorf("metrics are written to %d projects (%s); use --project to choose one", len(projects), strings.Join(projects, ", "))
+	}
+	d := dashboard.New(project, *dashboardID, *dashboardDisplayName, e.Metrics)
+	if len(d.RowLayout.Rows) == 0 {
+		return fmt.Errorf("no metrics are written to project %s", project)
+	}
+
+	if !*dashboardApply {
+		data, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	opts, err := sdClientOptions()
+	if err != nil {
+		return err
+	}
+	svc, err := monitoring.NewService(ctx, append(opts, option.WithScopes(monitoring.MonitoringScope))...)
+	if err != nil {
+		return fmt.Errorf("cannot create Dashboards API client: %v", err)
+	}
+	applied, err := dashboard.Apply(ctx, svc, d)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Applied dashboard %s with %d rows\n", applied.Name, len(applied.RowLayout.Rows))
+	return nil
+}
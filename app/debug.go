@@ -0,0 +1,64 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/google/ts-bridge/tsbridge"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var debugAddress = kingpin.Flag(
+	"debug-address", "address to serve /debug/pprof and /debug/vars on, e.g. localhost:6060 (disabled if empty)",
+).Envar("DEBUG_ADDRESS").String()
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	expvar.Publish("in_flight_updates", expvar.Func(func() interface{} { return tsbridge.InFlightUpdates() }))
+}
+
+// serveDebug serves runtime debug endpoints on a separate listener, so that they are never exposed on the main
+// server port. Like other admin endpoints, they require the admin token or an OIDC token if either is configured,
+// since profiles and the command line can reveal secrets.
+func serveDebug(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", adminOnly(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", adminOnly(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", adminOnly(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", adminOnly(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", adminOnly(pprof.Trace))
+	mux.HandleFunc("/debug/vars", adminOnly(expvar.Handler().ServeHTTP))
+
+	log.Infof("Serving debug endpoints on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatalf("unable to serve debug endpoints: %v", err)
+	}
+}
+
+// adminOnly wraps a handler so that it only serves requests allowed by authorizeAdmin.
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeAdmin(w, r) {
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,389 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/ts-bridge/memory"
+	"github.com/google/ts-bridge/tserrors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxConfigSize limits the size of configuration files submitted to the editor.
+const maxConfigSize = 10 << 20
+
+// editorPage is rendered by editor.html.
+type editorPage struct {
+	Filename string
+	// Content is shown in the editor, and Base is the hash of the file it was based on, which is used to detect
+	// concurrent edits.
+	Content string
+	Base    string
+	// Errors are validation errors of the edited configuration.
+	Errors string
+	// Diff lists changes of the edited configuration compared to the file.
+	Diff    []diffLine
+	Message string
+}
+
+// editConfig serves a page to edit the metric configuration file. Edits are validated like the file itself before
+// they can be written, and the diff with the current file is shown before it's replaced. Since the file contains
+// secrets that are not redacted, the editor needs to be enabled explicitly and is protected by the admin token.
+func editConfig(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if !*enableConfigEditor {
+		http.Error(w, "Config editor is disabled. Please set ENABLE_CONFIG_EDITOR or --enable-config-editor flag to enable it.",
+			http.StatusNotFound)
+		return
+	}
+	if !authorizeEditor(w, r) {
+		return
+	}
+
+	current, err := ioutil.ReadFile(*metricConfig)
+	if err != nil {
+		logAndReturnError(ctx, w, fmt.Errorf("cannot read configuration file: %v", err))
+		return
+	}
+	page := &editorPage{Filename: *metricConfig, Content: string(current), Base: contentHash(current)}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !sameOrigin(r) {
+			http.Error(w, "Cross-origin requests are not allowed", http.StatusForbidden)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxConfigSize)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid form: %v", err), http.StatusBadRequest)
+			return
+		}
+		// Browsers submit text areas with CRLF line endings.
+		edited := []byte(strings.Replace(r.PostForm.Get("content"), "\r\n", "\n", -1))
+		page.Content = string(edited)
+		page.Diff = diffLines(string(current), string(edited))
+		if len(page.Diff) == 0 {
+			page.Message = "No changes."
+			break
+		}
+		if r.PostForm.Get("base") != page.Base {
+			// The file has changed since the editor was loaded, so the diff needs to be reviewed again.
+			w.WriteHeader(http.StatusConflict)
+			page.Message = "The configuration file has changed since it was loaded. Review the changes again before applying them."
+			break
+		}
+		page.Errors, err = validateConfigEdit(ctx, edited)
+		if err != nil {
+			logAndReturnError(ctx, w, err)
+			return
+		}
+		if page.Errors != "" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			break
+		}
+		if r.PostForm.Get("action") != "apply" {
+			page.Message = "The configuration is valid. Review the changes below before applying them."
+			break
+		}
+		if err := writeConfigFile(*metricConfig, edited); err != nil {
+			logAndReturnError(ctx, w, fmt.Errorf("cannot write configuration file: %v", err))
+			return
+		}
+		log.WithContext(ctx).Infof("Configuration file %s edited (%d changed lines)", *metricConfig, changedLines(page.Diff))
+		page.Base = contentHash(edited)
+		page.Diff = nil
+		page.Message = "The configuration has been applied, and will be used from the next sync."
+	default:
+		http.Error(w, "Only GET and POST requests are allowed here", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t, err := template.ParseFiles("app/editor.html")
+	if err != nil {
+		logAndReturnError(ctx, w, err)
+		return
+	}
+	if err := t.Execute(w, page); err != nil {
+		logAndReturnError(ctx, w, err)
+	}
+}
+
+// authorizeEditor checks that a request to the config editor is allowed. Besides requests allowed by
+// authorizeAdmin, browsers can authenticate using basic authentication with the admin token as password. Unlike
+// other admin endpoints, the editor is never open to all requests, since it exposes secrets and can replace the file.
+func authorizeEditor(w http.ResponseWriter, r *http.Request) bool {
+	token, err := configuredAdminToken()
+	if err != nil {
+		logAndReturnError(r.Context(), w, fmt.Errorf("cannot read admin token: %v", err))
+		return false
+	}
+	if token == "" {
+		if *schedulerAudience == "" {
+			log.WithContext(r.Context()).Warningf("Rejecting %s request: no admin token or OIDC audience configured", r.URL.Path)
+			http.Error(w, "Config editor requires an admin token or OIDC audience", http.StatusForbidden)
+			return false
+		}
+		return authorizeAdmin(w, r)
+	}
+	if _, password, ok := r.BasicAuth(); ok && subtle.ConstantTimeCompare([]byte(password), []byte(token)) == 1 {
+		return true
+	}
+	if validAdminToken(r, token) || (*schedulerAudience != "" && validateOIDCToken(r) == nil) {
+		return true
+	}
+	log.WithContext(r.Context()).Warningf("Rejecting %s request: invalid admin token", r.URL.Path)
+	w.Header().Set("WWW-Authenticate", `Basic realm="ts-bridge"`)
+	http.Error(w, "A valid token is required", http.StatusUnauthorized)
+	return false
+}
+
+// sameOrigin checks that a request has not been sent by a page of another site, since browsers keep sending basic
+// authentication credentials with such requests.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// contentHash identifies a version of the configuration file.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validateConfigEdit loads an edited configuration file the same way as during syncs, returning validation errors.
+// Other errors, e.g. when BridgedMetric resources cannot be listed, are returned as errors.
+func validateConfigEdit(ctx context.Context, data []byte) (string, error) {
+	extra, err := extraMetrics(ctx)
+	if err != nil {
+		return "", err
+	}
+	// Metric records are created in a throwaway in-memory storage, so that validating an edit never writes to the
+	// storage engine. The edited file is parsed in place of the current one, so that secret files are resolved the
+	// same way.
+	if _, err := loadConfigData(ctx, *metricConfig, data, memory.New(), extra, nil); err != nil {
+		if errors.Is(err, tserrors.ErrConfigInvalid) {
+			return err.Error(), nil
+		}
+		return "", err
+	}
+	return "", nil
+}
+
+// writeConfigFile replaces a configuration file atomically, so that a sync never reads a partially written file.
+func writeConfigFile(filename string, data []byte) error {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// diffContext is the number of unchanged lines shown around changes.
+const diffContext = 3
+
+// maxDiffCells limits the size of the table used to find the longest common subsequence of changed lines. Larger
+// changes are shown as removing all changed lines and adding the new ones.
+const maxDiffCells = 1 << 22
+
+// diffLine is a line of a unified diff. Op is "-" for removed lines, "+" for added lines, "@@" for hunk headers and
+// empty for unchanged lines.
+type diffLine struct {
+	Op   string
+	Text string
+}
+
+// diffLines returns a unified diff of two texts, or nil if they are the same.
+func diffLines(a, b string) []diffLine {
+	if a == b {
+		return nil
+	}
+	x, y := splitLines(a), splitLines(b)
+	ops := lineOps(x, y)
+	// Lines are shown if they are changed or close enough to a change, and consecutive shown lines form a hunk.
+	shown := make([]bool, len(ops))
+	for k, op := range ops {
+		if op == "" {
+			continue
+		}
+		for c := k - diffContext; c <= k+diffContext; c++ {
+			if c >= 0 && c < len(ops) {
+				shown[c] = true
+			}
+		}
+	}
+
+	var diff, hunk []diffLine
+	// i and j are the numbers of lines of x and y before the current operation, and hi and hj before the current hunk.
+	i, j, hi, hj := 0, 0, 0, 0
+	for k, op := range ops {
+		if shown[k] {
+			if hunk == nil {
+				hi, hj = i, j
+			}
+			switch op {
+			case "-":
+				hunk = append(hunk, diffLine{Op: "-", Text: x[i]})
+			case "+":
+				hunk = append(hunk, diffLine{Op: "+", Text: y[j]})
+			default:
+				hunk = append(hunk, diffLine{Text: x[i]})
+			}
+		}
+		if op != "+" {
+			i++
+		}
+		if op != "-" {
+			j++
+		}
+		if hunk != nil && (k == len(ops)-1 || !shown[k+1]) {
+			diff = append(diff, diffLine{Op: "@@", Text: fmt.Sprintf("@@ -%s +%s @@", hunkRange(hi, i-hi), hunkRange(hj, j-hj))})
+			diff = append(diff, hunk...)
+			hunk = nil
+		}
+	}
+	return diff
+}
+
+// splitLines splits a text into lines, ignoring a trailing newline.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// lineOps returns the edit operations turning x into y: "" keeps a line of both, "-" removes a line of x and "+" adds
+// a line of y. Lines are matched using their longest common subsequence.
+func lineOps(x, y []string) []string {
+	// Common prefixes and suffixes are trimmed, so that small edits of large files are cheap.
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && x[prefix] == y[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && x[len(x)-1-suffix] == y[len(y)-1-suffix] {
+		suffix++
+	}
+	mx, my := x[prefix:len(x)-suffix], y[prefix:len(y)-suffix]
+
+	var ops []string
+	for n := 0; n < prefix; n++ {
+		ops = append(ops, "")
+	}
+	if len(mx)*len(my) > maxDiffCells {
+		for range mx {
+			ops = append(ops, "-")
+		}
+		for range my {
+			ops = append(ops, "+")
+		}
+	} else {
+		// lcs[i][j] is the length of the longest common subsequence of mx[i:] and my[j:].
+		lcs := make([][]int, len(mx)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(my)+1)
+		}
+		for i := len(mx) - 1; i >= 0; i-- {
+			for j := len(my) - 1; j >= 0; j-- {
+				if mx[i] == my[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else if lcs[i+1][j] >= lcs[i][j+1] {
+					lcs[i][j] = lcs[i+1][j]
+				} else {
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < len(mx) || j < len(my) {
+			switch {
+			case i < len(mx) && j < len(my) && mx[i] == my[j]:
+				ops = append(ops, "")
+				i, j = i+1, j+1
+			case j == len(my) || (i < len(mx) && lcs[i+1][j] >= lcs[i][j+1]):
+				ops = append(ops, "-")
+				i++
+			default:
+				ops = append(ops, "+")
+				j++
+			}
+		}
+	}
+	for n := 0; n < suffix; n++ {
+		ops = append(ops, "")
+	}
+	return ops
+}
+
+// hunkRange formats the range of lines of a hunk header, where start is zero-based.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// changedLines returns the number of removed and added lines of a diff.
+func changedLines(diff []diffLine) int {
+	n := 0
+	for _, l := range diff {
+		if l.Op == "-" || l.Op == "+" {
+			n++
+		}
+	}
+	return n
+}
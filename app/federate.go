@@ -0,0 +1,41 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/google/ts-bridge/tsbridge"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var enableFederation = kingpin.Flag(
+	"enable-federation", "serve the latest imported point of every time series at /federate, so that Prometheus can scrape them",
+).Envar("ENABLE_FEDERATION").Default("false").Bool()
+
+// federate serves the latest points imported by this process in the Prometheus text format. It needs to be enabled
+// explicitly, since it exposes metric values.
+func federate(w http.ResponseWriter, r *http.Request) {
+	if !*enableFederation {
+		http.Error(w, "Federation is disabled. Please set ENABLE_FEDERATION or --enable-federation flag to enable it.",
+			http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := tsbridge.WriteFederation(w); err != nil {
+		logAndReturnError(r.Context(), w, err)
+	}
+}
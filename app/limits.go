@@ -0,0 +1,77 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	gosync "sync"
+	"time"
+
+	"github.com/google/ts-bridge/tsbridge"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var apiRateLimit = kingpin.Flag(
+	"api-rate-limit", "maximum number of requests per minute to each of /status.json, /config, /cleanup, /boltdb/maintenance and /webhook/ (0 disables rate limiting)",
+).Envar("API_RATE_LIMIT").Default("0").Int()
+
+// Syncs in progress are tracked per process by tenant, with an empty tenant for syncs of all metrics. The sync
+// package is renamed, since the /sync handler is called sync.
+var (
+	runningSyncsMu gosync.Mutex
+	runningSyncs   = make(map[string]bool)
+)
+
+// startSync marks a sync of a tenant as running, and reports whether it can run, so that overlapping requests (e.g.
+// a scheduler triggering a sync while the previous one is still running) don't import the same metrics twice. A sync of all metrics can only run
+// while no other sync is running, and a sync of a tenant can only run while neither the same tenant nor all metrics
+// are synced.
+func startSync(tenant string) bool {
+	runningSyncsMu.Lock()
+	defer runningSyncsMu.Unlock()
+	if runningSyncs[""] || runningSyncs[tenant] || (tenant == "" && len(runningSyncs) > 0) {
+		return false
+	}
+	runningSyncs[tenant] = true
+	return true
+}
+
+// finishSync marks a sync of a tenant as finished.
+func finishSync(tenant string) {
+	runningSyncsMu.Lock()
+	defer runningSyncsMu.Unlock()
+	delete(runningSyncs, tenant)
+}
+
+// rateLimited wraps a handler so that requests exceeding API_RATE_LIMIT per minute are rejected. Each wrapped
+// handler has its own limit.
+func rateLimited(h http.HandlerFunc) http.HandlerFunc {
+	if *apiRateLimit == 0 {
+		return h
+	}
+	l := tsbridge.NewRateLimiter(*apiRateLimit, time.Minute)
+	retryAfter := fmt.Sprint(math.Ceil(time.Minute.Seconds() / float64(*apiRateLimit)))
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !l.Allow() {
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
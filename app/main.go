@@ -21,15 +21,23 @@ import (
 	"html/template"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/ts-bridge/boltdb"
 	"github.com/google/ts-bridge/datastore"
 	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/kubernetes"
+	"github.com/google/ts-bridge/memory"
+	"github.com/google/ts-bridge/requestid"
 	"github.com/google/ts-bridge/stackdriver"
 	"github.com/google/ts-bridge/storage"
 	"github.com/google/ts-bridge/tsbridge"
+	"github.com/google/ts-bridge/webhook"
 
 	"github.com/dustin/go-humanize"
 	log "github.com/sirupsen/logrus"
@@ -37,6 +45,8 @@ import (
 )
 
 var (
+	serveCmd = kingpin.Command("serve", "run the ts-bridge server (default)").Default()
+
 	debug = kingpin.Flag("debug", "enable debug mode").Envar("DEBUG").Default("false").Bool()
 	port  = kingpin.Flag("port", "ts-bridge server port").Envar("PORT").Default("8080").Int()
 
@@ -44,10 +54,22 @@ var (
 		"metric-config", "metric configuration file path",
 	).Envar("CONFIG_FILE").Default("metrics.yaml").String()
 
+	allowUnknownFields = kingpin.Flag(
+		"allow-unknown-fields", "log and ignore unknown keys of the metric configuration instead of rejecting the configuration (e.g. while rolling back to a release that does not support newer keys)",
+	).Envar("ALLOW_UNKNOWN_FIELDS").Default("false").Bool()
+
 	enableStatusPage = kingpin.Flag(
 		"enable-status-page", "enable ts-bridge server status page",
 	).Envar("ENABLE_STATUS_PAGE").Default("false").Bool()
 
+	enableConfigEditor = kingpin.Flag(
+		"enable-config-editor", "serve a page at /config/edit to edit the metric configuration file, validating edits before writing them",
+	).Envar("ENABLE_CONFIG_EDITOR").Default("false").Bool()
+
+	readOnly = kingpin.Flag(
+		"read-only", "disable syncs, cleanup, maintenance and webhooks, only serving the status page and status APIs",
+	).Envar("READ_ONLY").Default("false").Bool()
+
 	updateTimeout = kingpin.Flag(
 		"update-timeout", "total timeout for updating all metrics.",
 	).Envar("UPDATE_TIMEOUT").Default("5m").Duration()
@@ -56,6 +78,16 @@ var (
 		"update-parallelism", "number of metrics to update in parallel",
 	).Envar("UPDATE_PARALLELISM").Default("1").Int()
 
+	sourceParallelismFlag = kingpin.Flag(
+		"source-parallelism", "comma-separated number of metrics to update in parallel per source type, e.g. 'datadog=10,graphite=2'; these metrics are updated separately from --update-parallelism",
+	).Envar("SOURCE_PARALLELISM").String()
+	// sourceParallelism is parsed from sourceParallelismFlag by validateFlags.
+	sourceParallelism map[string]int
+
+	warmStartRamp = kingpin.Flag(
+		"warm-start-ramp", "maximum number of metrics imported for the first time during each sync, to spread the initial backfill over several syncs (0 imports all metrics at once).",
+	).Envar("WARM_START_RAMP").Default("0").Int()
+
 	minPointAge = kingpin.Flag(
 		"min-point-age", "minimum age of points to be imported (allows data to settle before import).",
 	).Envar("MIN_POINT_AGE").Default("2m").Duration()
@@ -64,46 +96,200 @@ var (
 		"sd-lookback-interval", "How far to look back while searching for recent data in Stackdriver.",
 	).Envar("SD_LOOKBACK_INTERVAL").Default("1h").Duration()
 
+	queryChunk = kingpin.Flag(
+		"query-chunk", "longest time range queried from a source at once; longer ranges are imported in several chunks (0 disables chunking).",
+	).Envar("QUERY_CHUNK").Default("4h").Duration()
+
 	counterResetInterval = kingpin.Flag(
 		"counter-reset-interval", "how often to reset 'start time' to keep the query time window small enough to avoid aggregation.",
 	).Envar("COUNTER_RESET_INTERVAL").Default("30m").Duration()
 
+	circuitBreakerThreshold = kingpin.Flag(
+		"circuit-breaker-threshold", "number of consecutive failures of a source host after which its metrics are skipped (0 disables the circuit breaker).",
+	).Envar("CIRCUIT_BREAKER_THRESHOLD").Default("0").Int()
+
+	circuitBreakerCooldown = kingpin.Flag(
+		"circuit-breaker-cooldown", "how long metrics of a failing source host are skipped before being attempted again.",
+	).Envar("CIRCUIT_BREAKER_COOLDOWN").Default("5m").Duration()
+
+	descriptorCacheTTL = kingpin.Flag(
+		"descriptor-cache-ttl", "how long metric descriptors are cached between syncs (0 disables caching).",
+	).Envar("DESCRIPTOR_CACHE_TTL").Default("1h").Duration()
+
+	timestampCacheTTL = kingpin.Flag(
+		"timestamp-cache-ttl", "how long latest timestamps of metrics sharing a metric type prefix are cached between syncs (0 disables caching).",
+	).Envar("TIMESTAMP_CACHE_TTL").Default("0").Duration()
+
 	sdInternalMetricsProject = kingpin.Flag(
 		"stats-sd-project", "Stackdriver project for internal ts-bridge metrics",
 	).Envar("SD_PROJECT_FOR_INTERNAL_METRICS").String()
 
+	statsExporter = kingpin.Flag(
+		"stats-exporter", "how internal ts-bridge metrics are written: 'opencensus' uses the OpenCensus Stackdriver exporter, 'adapter' writes them along with imported metrics",
+	).Envar("STATS_EXPORTER").Default("opencensus").Enum("opencensus", "adapter")
+
+	metricImportLatencyBuckets = kingpin.Flag(
+		"metric-import-latency-buckets", "comma-separated bucket boundaries of the metric_import_latencies distribution, e.g. '50ms,100ms,250ms,1s' (defaults to buckets between 100ms and 10m)",
+	).Envar("METRIC_IMPORT_LATENCY_BUCKETS").String()
+
+	importLatencyBuckets = kingpin.Flag(
+		"import-latency-buckets", "comma-separated bucket boundaries of the import_latencies distribution, e.g. '1m,5m,15m,1h,2h' (defaults to buckets between 100ms and 10m)",
+	).Envar("IMPORT_LATENCY_BUCKETS").String()
+
+	staleMetricThresholds = kingpin.Flag(
+		"stale-metric-thresholds", "comma-separated metric ages after which metrics are counted as stale in the metrics_stale_total metric, with a count for each threshold",
+	).Envar("STALE_METRIC_THRESHOLDS").Default("5m,15m,1h").String()
+
 	// Storage options
 	storageEngine = kingpin.Flag(
 		"storage-engine", "storage engine to keep the metrics metadata in",
-	).Envar("STORAGE_ENGINE").Default("datastore").String()
+	).Envar("STORAGE_ENGINE").Default("datastore").Enum("datastore", "boltdb", "memory")
 
 	datastoreProject = kingpin.Flag(
 		"datastore-project", "GCP Project to use for communicating with Datastore",
 	).Envar("DATASTORE_PROJECT").String()
 
-	boltdbPath = kingpin.Flag("boltdb-path", "path to BoltDB store, e.g. /data/bolt.db").Envar("BOLTDB_PATH").String()
+	datastoreEmulatorHost = kingpin.Flag(
+		"datastore-emulator-host", "address of a local Datastore emulator to use instead of Datastore, e.g. localhost:8081",
+	).Envar("DATASTORE_EMULATOR_HOST").String()
+
+	datastoreNamespace = kingpin.Flag(
+		"datastore-namespace", "Datastore namespace to keep metric records in",
+	).Envar("DATASTORE_NAMESPACE").String()
+
+	importClaims = kingpin.Flag(
+		"import-claims", "claim each metric import in Datastore, so that several instances sharing it can import the same metrics without writing overlapping points",
+	).Envar("IMPORT_CLAIMS").Default("false").Bool()
+
+	boltdbPath      = kingpin.Flag("boltdb-path", "path to BoltDB store, e.g. /data/bolt.db").Envar("BOLTDB_PATH").String()
+	boltdbBackupDir = kingpin.Flag(
+		"boltdb-backup-dir", "directory that /boltdb/maintenance writes BoltDB backups to; backups are not taken if empty",
+	).Envar("BOLTDB_BACKUP_DIR").String()
+
+	// Kubernetes controller mode
+	kubernetesController = kingpin.Flag(
+		"kubernetes-controller", "import metrics defined as BridgedMetric Kubernetes resources in addition to the metric configuration file",
+	).Envar("KUBERNETES_CONTROLLER").Default("false").Bool()
+
+	kubernetesNamespace = kingpin.Flag(
+		"kubernetes-namespace", "namespace to read BridgedMetric resources from (defaults to the namespace of the pod)",
+	).Envar("KUBERNETES_NAMESPACE").String()
 )
 
+// sourceBreaker is shared across sync operations to keep track of failing source hosts. It stays nil if the circuit
+// breaker is disabled.
+var sourceBreaker *tsbridge.CircuitBreaker
+
+// descriptorCache is shared across sync operations to avoid fetching metric descriptors of unchanged metrics during
+// every sync. It stays nil if descriptor caching is disabled.
+var descriptorCache *stackdriver.DescriptorCache
+
+// timestampCache is shared across sync operations to look up latest timestamps of sibling metrics with a single
+// query. It stays nil if timestamp caching is disabled.
+var timestampCache *stackdriver.TimestampCache
+
+// instanceID identifies this process in import claims.
+var instanceID = newInstanceID()
+
+// memoryStorage keeps metric records in memory if the memory storage engine is used. It's shared by all requests,
+// since records would otherwise be lost after each of them.
+var memoryStorage = memory.New()
+
+// kubeClient is used to read BridgedMetric resources and update their status. It stays nil unless the Kubernetes
+// controller mode is enabled.
+var kubeClient *kubernetes.Client
+
 func main() {
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	if *debug {
 		log.SetLevel(log.DebugLevel)
 		log.Debug("Debug logging enabled...")
 	}
 
+	configureLogging()
+	log.AddHook(requestid.LogHook{})
+
 	if err := validateFlags(); err != nil {
 		log.Fatalf("Invalid flags: %v", err)
 	}
 
-	http.HandleFunc("/", index)
-	http.HandleFunc("/sync", sync)
-	http.HandleFunc("/cleanup", cleanup)
+	env.SecretRefreshInterval = *secretRefreshInterval
+
+	if command == checkCmd.FullCommand() {
+		os.Exit(check())
+	}
+
+	reloadSecretsOnHangup()
+
+	if *circuitBreakerThreshold > 0 {
+		sourceBreaker = tsbridge.NewCircuitBreaker(*circuitBreakerThreshold, *circuitBreakerCooldown)
+	}
+
+	if *descriptorCacheTTL > 0 {
+		descriptorCache = stackdriver.NewDescriptorCache(*descriptorCacheTTL)
+	}
+
+	if *timestampCacheTTL > 0 {
+		timestampCache = stackdriver.NewTimestampCache(*timestampCacheTTL)
+	}
+
+	if *canaryConfig != "" {
+		configRollout = tsbridge.NewRollout(*canaryPercent, *canaryCycles, *canaryMaxFailureIncrease)
+	}
+
+	if *kubernetesController {
+		var err error
+		if kubeClient, err = kubernetes.NewInClusterClient(*kubernetesNamespace); err != nil {
+			log.Fatalf("Cannot initialize Kubernetes client: %v", err)
+		}
+	}
+
+	if command == configCmd.FullCommand() {
+		os.Exit(printConfig())
+	}
+
+	if command == dashboardCmd.FullCommand() {
+		os.Exit(generateDashboard())
+	}
+
+	if command == snapshotCmd.FullCommand() {
+		os.Exit(takeSnapshot())
+	}
+
+	if command == restoreCmd.FullCommand() {
+		os.Exit(restoreSnapshot())
+	}
+
+	if *debugAddress != "" {
+		go serveDebug(*debugAddress)
+	}
+
+	if *readOnly {
+		log.Info("Running in read-only mode, metrics are not imported")
+		if *stalenessAlertThreshold > 0 {
+			log.Info("Not provisioning staleness alert policies in read-only mode")
+		}
+	} else if *stalenessAlertThreshold > 0 {
+		go provisionAlertPolicies()
+	}
+
+	// A separate mux is used, since debug packages register their handlers with the default one.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", index)
+	mux.HandleFunc("/status.json", rateLimited(statusJSON))
+	mux.HandleFunc("/config", rateLimited(configYAML))
+	mux.HandleFunc("/config/edit", writable(rateLimited(editConfig)))
+	mux.HandleFunc("/federate", federate)
+	mux.HandleFunc("/sync", writable(sync))
+	mux.HandleFunc("/cleanup", writable(rateLimited(cleanup)))
+	mux.HandleFunc("/boltdb/maintenance", writable(rateLimited(boltdbMaintenance)))
+	mux.HandleFunc("/webhook/", writable(rateLimited(receiveWebhook)))
 
 	// Build a connection string, e.g. ":8080"
 	conn := net.JoinHostPort("", strconv.Itoa(*port))
 	log.Debugf("Connection string: %v", conn)
-	if err := http.ListenAndServe(conn, nil); err != nil {
+	if err := http.ListenAndServe(conn, mux); err != nil {
 		log.Fatalf("unable to start serving: %v", err)
 	}
 
@@ -115,20 +301,141 @@ func validateFlags() error {
 	if *updateParallelism < 1 || *updateParallelism > 100 {
 		return fmt.Errorf("expected --update-parallelism|UPDATE_PARALLELISM between 1 and 100; got %d", *updateParallelism)
 	}
-	return nil
+	limits, err := parseSourceParallelism(*sourceParallelismFlag)
+	if err != nil {
+		return fmt.Errorf("invalid --source-parallelism|SOURCE_PARALLELISM: %v", err)
+	}
+	sourceParallelism = limits
+	if tsbridge.MetricImportLatencyBuckets, err = parseLatencyBuckets(*metricImportLatencyBuckets); err != nil {
+		return fmt.Errorf("invalid --metric-import-latency-buckets|METRIC_IMPORT_LATENCY_BUCKETS: %v", err)
+	}
+	if tsbridge.TotalImportLatencyBuckets, err = parseLatencyBuckets(*importLatencyBuckets); err != nil {
+		return fmt.Errorf("invalid --import-latency-buckets|IMPORT_LATENCY_BUCKETS: %v", err)
+	}
+	if tsbridge.StaleMetricThresholds, err = parseDurations(*staleMetricThresholds); err != nil {
+		return fmt.Errorf("invalid --stale-metric-thresholds|STALE_METRIC_THRESHOLDS: %v", err)
+	}
+	if *warmStartRamp < 0 {
+		return fmt.Errorf("expected --warm-start-ramp|WARM_START_RAMP to be non-negative; got %d", *warmStartRamp)
+	}
+	if *circuitBreakerThreshold < 0 {
+		return fmt.Errorf("expected --circuit-breaker-threshold|CIRCUIT_BREAKER_THRESHOLD to be non-negative; got %d", *circuitBreakerThreshold)
+	}
+	if *apiRateLimit < 0 {
+		return fmt.Errorf("expected --api-rate-limit|API_RATE_LIMIT to be non-negative; got %d", *apiRateLimit)
+	}
+	if *stalenessAlertThreshold != 0 && *stalenessAlertThreshold < 2*time.Minute {
+		return fmt.Errorf("expected --staleness-alert-threshold|STALENESS_ALERT_THRESHOLD to be 0 or at least 2m; got %v", *stalenessAlertThreshold)
+	}
+	if *importClaims && *storageEngine != "datastore" {
+		return fmt.Errorf("--import-claims|IMPORT_CLAIMS requires the datastore storage engine, since other engines cannot be shared by several instances")
+	}
+	if *adminToken != "" && *adminTokenFile != "" {
+		return fmt.Errorf("only one of --admin-token|ADMIN_TOKEN and --admin-token-file|ADMIN_TOKEN_FILE can be set")
+	}
+	if *enableConfigEditor && *adminToken == "" && *adminTokenFile == "" && *schedulerAudience == "" {
+		return fmt.Errorf("--enable-config-editor|ENABLE_CONFIG_EDITOR requires --admin-token|ADMIN_TOKEN, --admin-token-file|ADMIN_TOKEN_FILE or --scheduler-oidc-audience|SCHEDULER_OIDC_AUDIENCE, since the editor exposes secrets")
+	}
+	return validateCanaryFlags()
+}
+
+// parseLatencyBuckets parses a comma-separated list of increasing durations, e.g. '100ms,1s,1m', into bucket
+// boundaries in milliseconds. An empty list returns nil, which keeps the default buckets.
+func parseLatencyBuckets(value string) ([]float64, error) {
+	durations, err := parseDurations(value)
+	if err != nil {
+		return nil, err
+	}
+	var buckets []float64
+	for _, d := range durations {
+		buckets = append(buckets, float64(d)/float64(time.Millisecond))
+	}
+	return buckets, nil
 }
 
-// sync updates all configured metrics. It's triggered by App Engine Cron.
+// parseDurations parses a comma-separated list of positive, increasing durations, e.g. '5m,15m,1h'.
+func parseDurations(value string) ([]time.Duration, error) {
+	var durations []time.Duration
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		d, err := time.ParseDuration(entry)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("expected positive durations; got %s", entry)
+		}
+		if n := len(durations); n > 0 && d <= durations[n-1] {
+			return nil, fmt.Errorf("expected increasing durations; got %s after %v", entry, durations[n-1])
+		}
+		durations = append(durations, d)
+	}
+	return durations, nil
+}
+
+// parseSourceParallelism parses a comma-separated list of source types and their parallelism, e.g.
+// 'datadog=10,graphite=2'.
+func parseSourceParallelism(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("expected <source type>=<parallelism>; got '%s'", entry)
+		}
+		name := strings.TrimSpace(kv[0])
+		limit, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid parallelism of source type %s: %v", name, err)
+		}
+		if limit < 1 || limit > 100 {
+			return nil, fmt.Errorf("expected parallelism of source type %s between 1 and 100; got %d", name, limit)
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+// writable wraps a handler that writes to Stackdriver or storage, so that it's disabled in read-only mode. This
+// allows running a standby instance, or one that only serves the status page, without importing metrics twice.
+func writable(h http.HandlerFunc) http.HandlerFunc {
+	if !*readOnly {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "ts-bridge is running in read-only mode", http.StatusServiceUnavailable)
+	}
+}
+
+// sync updates all configured metrics. It's triggered by App Engine Cron or Cloud Scheduler.
 func sync(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	ctx, cancel := context.WithTimeout(ctx, *updateTimeout)
 	defer cancel()
 
-	if env.IsAppEngine() && r.Header.Get("X-Appengine-Cron") != "true" {
-		http.Error(w, "Only cron requests are allowed here", http.StatusUnauthorized)
+	if !authorizeScheduled(w, r) {
+		return
+	}
+	tenant := r.URL.Query().Get("tenant")
+	if !startSync(tenant) {
+		log.WithContext(ctx).Warningf("Rejecting %s request: a sync is already in progress", r.URL)
+		http.Error(w, "A sync is already in progress", http.StatusConflict)
 		return
 	}
+	defer finishSync(tenant)
+
+	// Each sync gets a run ID (reused from the incoming request if set), and each metric update gets an ID derived
+	// from it. They are added to log lines, metric status and requests sent to sources and to Stackdriver.
+	runID := requestid.FromRequest(r)
+	ctx = requestid.NewContext(ctx, runID)
+	w.Header().Set(requestid.Header, runID)
 
 	storage, err := loadStorageEngine(ctx)
 	if err != nil {
@@ -142,34 +449,51 @@ func sync(w http.ResponseWriter, r *http.Request) {
 		logAndReturnError(ctx, w, err)
 		return
 	}
+	config, err = scopeToTenant(r, config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 
-	sd, err := stackdriver.NewAdapter(ctx, *sdLookBackInterval)
+	sdOpts, err := sdClientOptions()
+	if err != nil {
+		logAndReturnError(ctx, w, fmt.Errorf("cannot read Stackdriver credentials: %v", err))
+		return
+	}
+	sd, err := stackdriver.NewAdapter(ctx, *sdLookBackInterval, descriptorCache, sdOpts...)
 	if err != nil {
 		logAndReturnError(ctx, w, err)
 		return
 	}
 	defer sd.Close()
+	sd.SetTimestampCache(timestampCache)
 
-	stats, err := tsbridge.NewCollector(ctx, *sdInternalMetricsProject)
+	stats, err := newStatsCollector(ctx, sd)
 	if err != nil {
 		logAndReturnError(ctx, w, err)
 		return
 	}
 	defer stats.Close()
-
-	if errs := tsbridge.UpdateAllMetrics(ctx, config, sd, *updateParallelism, stats); errs != nil {
-		msg := strings.Join(errs, "; ")
-		logAndReturnError(ctx, w, errors.New(msg))
-		return
+	sd.SetWriteObserver(stats.RecordWrite)
+
+	start := time.Now()
+	results := tsbridge.UpdateAllMetrics(ctx, config, sd, *updateParallelism, stats)
+	summary := newSyncSummary(runID, tenant, results, time.Since(start))
+	if configRollout != nil {
+		configRollout.Record(ctx, results)
+		summary.Rollout = configRollout.Status()
+	}
+	if err := updateResourceStatus(ctx, config, results); err != nil {
+		summary.Errors = append(summary.Errors, err.Error())
 	}
+	summary.write(ctx, w)
 }
 
-// cleanup removes obsolete metric records. It is triggered by App Engine Cron.
+// cleanup removes obsolete metric records. It is triggered by App Engine Cron or Cloud Scheduler.
 func cleanup(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	if env.IsAppEngine() && r.Header.Get("X-Appengine-Cron") != "true" {
-		http.Error(w, "Only cron requests are allowed here", http.StatusUnauthorized)
+	if !authorizeScheduled(w, r) {
 		return
 	}
 
@@ -196,6 +520,76 @@ func cleanup(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// boltdbMaintenance takes a backup of the BoltDB store (if a backup directory is configured) and compacts it.
+func boltdbMaintenance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if *storageEngine != "boltdb" {
+		http.Error(w, "BoltDB maintenance is only available with the boltdb storage engine", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests are allowed here", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	storage, err := loadStorageEngine(ctx)
+	if err != nil {
+		logAndReturnError(ctx, w, err)
+		return
+	}
+	defer storage.Close()
+	manager := storage.(*boltdb.Manager)
+
+	if *boltdbBackupDir != "" {
+		dest := filepath.Join(*boltdbBackupDir, fmt.Sprintf("bolt-%s.db", time.Now().UTC().Format("20060102T150405Z")))
+		if err := manager.Backup(dest); err != nil {
+			logAndReturnError(ctx, w, err)
+			return
+		}
+		log.WithContext(ctx).Infof("BoltDB backup written to %s", dest)
+		fmt.Fprintf(w, "Backup written to %s\n", dest)
+	}
+
+	before, after, err := manager.Compact()
+	if err != nil {
+		logAndReturnError(ctx, w, err)
+		return
+	}
+	log.WithContext(ctx).Infof("BoltDB compacted from %d to %d bytes", before, after)
+	fmt.Fprintf(w, "Compacted from %s to %s\n", humanize.Bytes(uint64(before)), humanize.Bytes(uint64(after)))
+}
+
+// receiveWebhook buffers a batch of points posted to /webhook/<metric name> by an external job. Requests are
+// authenticated by the metric itself, using its bearer token.
+func receiveWebhook(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := strings.TrimPrefix(r.URL.Path, "/webhook/")
+
+	storage, err := loadStorageEngine(ctx)
+	if err != nil {
+		logAndReturnError(ctx, w, err)
+		return
+	}
+	defer storage.Close()
+
+	config, err := newRuntimeConfig(ctx, storage)
+	if err != nil {
+		logAndReturnError(ctx, w, err)
+		return
+	}
+	for _, m := range config.Metrics() {
+		if wm, ok := m.Source.(*webhook.Metric); ok && m.Name == name {
+			wm.ServeHTTP(w, r)
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("webhook metric '%s' not found", name), http.StatusNotFound)
+}
+
 // index shows a web page with metric import status.
 func index(w http.ResponseWriter, r *http.Request) {
 	if *enableStatusPage != true {
@@ -218,8 +612,13 @@ func index(w http.ResponseWriter, r *http.Request) {
 		logAndReturnError(ctx, w, err)
 		return
 	}
+	config, err = scopeToTenant(r, config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 
-	funcMap := template.FuncMap{"humantime": humanize.Time}
+	funcMap := template.FuncMap{"humantime": humanize.Time, "now": time.Now}
 	t, err := template.New("index.html").Funcs(funcMap).ParseFiles("app/index.html")
 	if err != nil {
 		logAndReturnError(ctx, w, err)
@@ -230,16 +629,154 @@ func index(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// scopeToTenant limits the configuration to metrics of a single tenant if one is requested using the `tenant`
+// query parameter, so that each tenant can trigger imports and see the status of its own metrics only.
+func scopeToTenant(r *http.Request, config *tsbridge.Config) (*tsbridge.Config, error) {
+	tenant := r.URL.Query().Get("tenant")
+	if tenant == "" {
+		return config, nil
+	}
+	return config.ForTenant(tenant)
+}
+
 // newConfig initializes and returns tsbridge config.
 func newRuntimeConfig(ctx context.Context, storage storage.Manager) (*tsbridge.Config, error) {
+	extra, err := extraMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var claims *tsbridge.ImportClaims
+	if *importClaims {
+		// Claims are held for as long as a sync can take, so that other instances never take over a running import.
+		if claims, err = tsbridge.NewImportClaims(storage, instanceID, *updateTimeout); err != nil {
+			return nil, err
+		}
+	}
+	config, err := loadConfigFile(ctx, *metricConfig, storage, extra, claims)
+	if err != nil {
+		return nil, err
+	}
+	if configRollout != nil {
+		config = applyCanaryConfig(ctx, config, storage, extra, claims)
+	}
+	return config, nil
+}
+
+// extraMetrics returns metrics defined outside of the configuration file, i.e. BridgedMetric resources.
+func extraMetrics(ctx context.Context) ([]*tsbridge.MetricDefinition, error) {
+	resources, err := bridgedMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Resources are sorted by name so that metrics are always listed in the same order.
+	var names []string
+	for name := range resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var extra []*tsbridge.MetricDefinition
+	for _, name := range names {
+		r := resources[name]
+		params, err := r.Params()
+		if err != nil {
+			return nil, fmt.Errorf("invalid spec of BridgedMetric %s: %v", r.Metadata.Name, err)
+		}
+		extra = append(extra, &tsbridge.MetricDefinition{Name: name, Source: r.Source(), Params: params})
+	}
+	return extra, nil
+}
+
+// loadConfigFile reads a metric configuration file, adding metrics defined outside of it.
+func loadConfigFile(ctx context.Context, filename string, storage storage.Manager, extra []*tsbridge.MetricDefinition, claims *tsbridge.ImportClaims) (*tsbridge.Config, error) {
+	return loadConfigData(ctx, filename, nil, storage, extra, claims)
+}
+
+// loadConfigData parses the contents of a metric configuration file like loadConfigFile. The file is read if data is
+// nil.
+func loadConfigData(ctx context.Context, filename string, data []byte, storage storage.Manager, extra []*tsbridge.MetricDefinition, claims *tsbridge.ImportClaims) (*tsbridge.Config, error) {
 	return tsbridge.NewConfig(ctx, &tsbridge.ConfigOptions{
-		Filename:             *metricConfig,
+		Filename:             filename,
+		Data:                 data,
 		MinPointAge:          *minPointAge,
 		CounterResetInterval: *counterResetInterval,
 		Storage:              storage,
+		CircuitBreaker:       sourceBreaker,
+		ImportClaims:         claims,
+		QueryChunk:           *queryChunk,
+		SourceParallelism:    sourceParallelism,
+		WarmStartRamp:        *warmStartRamp,
+		AllowUnknownFields:   *allowUnknownFields,
+		ExtraMetrics:         extra,
 	})
 }
 
+// newInstanceID returns an ID of this process that is unique across instances, which starts with the host name to
+// make it easy to tell instances apart in logs.
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "ts-bridge"
+	}
+	return host + "-" + requestid.New()
+}
+
+// bridgedMetrics returns BridgedMetric resources keyed by metric name. It returns nil unless the Kubernetes controller
+// mode is enabled.
+func bridgedMetrics(ctx context.Context) (map[string]*kubernetes.BridgedMetric, error) {
+	if kubeClient == nil {
+		return nil, nil
+	}
+	resources, err := kubeClient.ListBridgedMetrics(ctx)
+	if err != nil {
+		return nil, err
+	}
+	metrics := make(map[string]*kubernetes.BridgedMetric, len(resources))
+	for _, r := range resources {
+		metrics[r.MetricName()] = r
+	}
+	return metrics, nil
+}
+
+// updateResourceStatus writes results of a sync operation into the status of BridgedMetric resources.
+func updateResourceStatus(ctx context.Context, config *tsbridge.Config, results []*tsbridge.UpdateResult) error {
+	resources, err := bridgedMetrics(ctx)
+	if err != nil || resources == nil {
+		return err
+	}
+	lastUpdate := make(map[string]time.Time)
+	for _, m := range config.Metrics() {
+		lastUpdate[m.Name] = m.Record.GetLastUpdate()
+	}
+
+	var errs []string
+	for _, r := range results {
+		res, ok := resources[r.Name]
+		if !ok {
+			continue
+		}
+		status := &kubernetes.BridgedMetricStatus{
+			ObservedGeneration: res.Metadata.Generation,
+			LastSync:           time.Now(),
+			Points:             r.Points,
+		}
+		if t := lastUpdate[r.Name]; !t.IsZero() {
+			status.LastImport = &t
+		}
+		if r.Err != nil {
+			status.Error = r.Err.Error()
+		} else if r.RecordErr != nil {
+			status.Error = r.RecordErr.Error()
+		}
+		if err := kubeClient.UpdateStatus(ctx, res.Metadata.Name, status); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if errs != nil {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
 // Since some URLs are triggered by App Engine cron, error messages returned in HTTP response
 // might not be visible to humans. We need to log them as well, and this helper function does that.
 func logAndReturnError(ctx context.Context, w http.ResponseWriter, err error) {
@@ -247,11 +784,24 @@ func logAndReturnError(ctx context.Context, w http.ResponseWriter, err error) {
 	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
+// newStatsCollector creates a collector for internal metrics using the configured exporter. Stats written through
+// the adapter are flushed when the collector is closed, so `sd` needs to be closed after the collector.
+func newStatsCollector(ctx context.Context, sd *stackdriver.Adapter) (*tsbridge.StatsCollector, error) {
+	if *statsExporter == "adapter" {
+		return tsbridge.NewAdapterCollector(ctx, *sdInternalMetricsProject, sd)
+	}
+	return tsbridge.NewCollector(ctx, *sdInternalMetricsProject)
+}
+
 // Helper function to load the correct storage manager depending on settings
 func loadStorageEngine(ctx context.Context) (storage.Manager, error) {
 	switch *storageEngine {
 	case "datastore":
-		datastoreManager := datastore.New(ctx, &datastore.Options{Project: *datastoreProject})
+		datastoreManager := datastore.New(ctx, &datastore.Options{
+			Project:      *datastoreProject,
+			EmulatorHost: *datastoreEmulatorHost,
+			Namespace:    *datastoreNamespace,
+		})
 		return datastoreManager, nil
 	case "boltdb":
 		if env.IsAppEngine() {
@@ -260,6 +810,8 @@ func loadStorageEngine(ctx context.Context) (storage.Manager, error) {
 		opts := &boltdb.Options{DBPath: *boltdbPath}
 
 		return boltdb.New(opts), nil
+	case "memory":
+		return memoryStorage, nil
 	default:
 		return nil, fmt.Errorf("unknown storage engine selected: %s", *storageEngine)
 	}
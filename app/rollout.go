@@ -0,0 +1,83 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tsbridge"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	canaryConfig = kingpin.Flag(
+		"canary-config", "path of a new version of the metric configuration file, which is applied to canary metrics first and to all metrics once it has been updating them successfully for --canary-cycles syncs",
+	).Envar("CANARY_CONFIG_FILE").String()
+
+	canaryPercent = kingpin.Flag(
+		"canary-percent", "percentage of metrics the canary configuration is applied to first, unless some of its metrics are tagged with 'canary: true'",
+	).Envar("CANARY_PERCENT").Default("10").Int()
+
+	canaryCycles = kingpin.Flag(
+		"canary-cycles", "number of syncs updating canary metrics before the canary configuration is applied to all metrics",
+	).Envar("CANARY_CYCLES").Default("5").Int()
+
+	canaryMaxFailureIncrease = kingpin.Flag(
+		"canary-max-failure-increase", "how much higher (between 0 and 1) the failure rate of canary metrics can be than that of other metrics before the canary configuration is rolled back",
+	).Envar("CANARY_MAX_FAILURE_INCREASE").Default("0.2").Float64()
+)
+
+// configRollout keeps the state of the canary configuration across syncs. It stays nil unless a canary configuration
+// is set.
+var configRollout *tsbridge.Rollout
+
+// validateCanaryFlags checks flags of the canary rollout.
+func validateCanaryFlags() error {
+	if *canaryPercent < 0 || *canaryPercent > 100 {
+		return fmt.Errorf("expected --canary-percent|CANARY_PERCENT between 0 and 100; got %d", *canaryPercent)
+	}
+	if *canaryCycles < 1 {
+		return fmt.Errorf("expected --canary-cycles|CANARY_CYCLES to be positive; got %d", *canaryCycles)
+	}
+	if *canaryMaxFailureIncrease < 0 || *canaryMaxFailureIncrease > 1 {
+		return fmt.Errorf("expected --canary-max-failure-increase|CANARY_MAX_FAILURE_INCREASE between 0 and 1; got %v", *canaryMaxFailureIncrease)
+	}
+	return nil
+}
+
+// applyCanaryConfig returns the configuration that metrics are updated with while a canary configuration is rolled
+// out. The current configuration is used if the canary configuration cannot be loaded, so that a broken file does not
+// stop any imports.
+func applyCanaryConfig(ctx context.Context, current *tsbridge.Config, storage storage.Manager, extra []*tsbridge.MetricDefinition, claims *tsbridge.ImportClaims) *tsbridge.Config {
+	data, err := ioutil.ReadFile(*canaryConfig)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Cannot read canary configuration, using the current configuration: %v", err)
+		return current
+	}
+	canary, err := loadConfigFile(ctx, *canaryConfig, storage, extra, claims)
+	if err != nil {
+		log.WithContext(ctx).Errorf("Cannot load canary configuration, using the current configuration: %v", err)
+		return current
+	}
+	sum := sha256.Sum256(data)
+	return configRollout.Apply(ctx, current, canary, hex.EncodeToString(sum[:])[:12])
+}
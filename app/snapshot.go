@@ -0,0 +1,150 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/google/ts-bridge/snapshot"
+	"github.com/google/ts-bridge/storage"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	snapshotCmd = kingpin.Command("snapshot", "export the metric records of all configured metrics and the effective configuration to an archive")
+
+	snapshotOutput  = snapshotCmd.Flag("output", "path of the archive to write, or - for standard output").Short('o').Required().String()
+	snapshotTimeout = snapshotCmd.Flag("timeout", "how long taking the snapshot is allowed to take").Default("5m").Duration()
+
+	restoreCmd = kingpin.Command("restore", "write metric records of a snapshot archive into the configured storage engine")
+
+	restoreInput        = restoreCmd.Flag("input", "path of the archive to read, or - for standard input").Short('i').Required().String()
+	restoreForce        = restoreCmd.Flag("force", "also restore records that have been updated since the snapshot was taken").Bool()
+	restoreConfigOutput = restoreCmd.Flag("config-output", "path to write the effective configuration of the snapshot to, with secrets redacted").String()
+	restoreTimeout      = restoreCmd.Flag("timeout", "how long restoring the snapshot is allowed to take").Default("5m").Duration()
+)
+
+// takeSnapshot runs the snapshot command, returning the exit code.
+func takeSnapshot() int {
+	ctx, cancel := context.WithTimeout(context.Background(), *snapshotTimeout)
+	defer cancel()
+
+	s, err := newSnapshot(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot take snapshot: %v\n", err)
+		return 1
+	}
+	out := io.Writer(os.Stdout)
+	if *snapshotOutput != "-" {
+		f, err := os.OpenFile(*snapshotOutput, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write snapshot: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := snapshot.Write(out, s); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot write snapshot: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d metric records\n", len(s.Records))
+	return 0
+}
+
+// newSnapshot reads metric records of all configured metrics, along with the effective configuration.
+func newSnapshot(ctx context.Context) (*snapshot.Snapshot, error) {
+	manager, err := loadStorageEngine(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer manager.Close()
+
+	// The snapshot is timestamped before records are read, so that records updated meanwhile count as newer than it.
+	created := time.Now()
+	config, err := newRuntimeConfig(ctx, manager)
+	if err != nil {
+		return nil, err
+	}
+	var records []storage.MetricRecord
+	for _, m := range config.Metrics() {
+		records = append(records, m.Record)
+	}
+	states, err := snapshot.Take(records)
+	if err != nil {
+		return nil, err
+	}
+	data, err := newEffectiveConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot.Snapshot{
+		Manifest: snapshot.Manifest{Created: created, StorageEngine: *storageEngine},
+		Config:   data,
+		Records:  states,
+	}, nil
+}
+
+// restoreSnapshot runs the restore command, returning the exit code.
+func restoreSnapshot() int {
+	ctx, cancel := context.WithTimeout(context.Background(), *restoreTimeout)
+	defer cancel()
+
+	in := io.Reader(os.Stdin)
+	if *restoreInput != "-" {
+		f, err := os.Open(*restoreInput)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read snapshot: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	s, err := snapshot.Read(in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read snapshot: %v\n", err)
+		return 1
+	}
+	if *restoreConfigOutput != "" {
+		if err := ioutil.WriteFile(*restoreConfigOutput, s.Config, 0600); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot write configuration: %v\n", err)
+			return 1
+		}
+	}
+
+	storage, err := loadStorageEngine(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load storage engine: %v\n", err)
+		return 1
+	}
+	defer storage.Close()
+	restored, skipped, err := snapshot.Restore(ctx, storage, s, *restoreForce)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot restore snapshot: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Restored %d metric records of a snapshot taken %v (%s storage engine)", restored, s.Created.Format(time.RFC3339), s.StorageEngine)
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "; skipped %d records updated since then (use --force to restore them)", skipped)
+	}
+	fmt.Fprintln(os.Stderr)
+	return 0
+}
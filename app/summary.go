@@ -0,0 +1,119 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/ts-bridge/tsbridge"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syncSummary describes the outcome of a sync. It's returned by /sync and logged at the end of each sync, so that
+// log-based metrics and scheduler alerts can tell how many metrics failed.
+type syncSummary struct {
+	RunID     string  `json:"run_id"`
+	Tenant    string  `json:"tenant,omitempty"`
+	Attempted int     `json:"attempted"`
+	Succeeded int     `json:"succeeded"`
+	Skipped   int     `json:"skipped"`
+	Deferred  int     `json:"deferred"`
+	Failed    int     `json:"failed"`
+	Points    int     `json:"points"`
+	Duration  float64 `json:"duration_seconds"`
+	// Failures lists the error of each failed metric by name.
+	Failures map[string]string `json:"failures,omitempty"`
+	// DeferredMetrics lists metrics that were left for a later sync, because of the warm start ramp or to meet the
+	// update timeout.
+	DeferredMetrics []string `json:"deferred_metrics,omitempty"`
+	// Rollout is the state of the canary configuration, if one is set.
+	Rollout string `json:"config_rollout,omitempty"`
+	// Errors are failures of the sync itself, e.g. metric records or resource status that could not be updated.
+	// The response has status 500 if there are any.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// newSyncSummary summarizes the results of metric updates.
+func newSyncSummary(runID, tenant string, results []*tsbridge.UpdateResult, duration time.Duration) *syncSummary {
+	s := &syncSummary{RunID: runID, Tenant: tenant, Attempted: len(results), Duration: duration.Seconds()}
+	for _, r := range results {
+		s.Points += r.Points
+		switch {
+		case r.Err != nil:
+			s.fail(r.Name, r.Err)
+		case r.RecordErr != nil:
+			s.fail(r.Name, r.RecordErr)
+		case r.Skipped:
+			s.Skipped++
+		case r.Deferred:
+			s.Deferred++
+			s.DeferredMetrics = append(s.DeferredMetrics, r.Name)
+		default:
+			s.Succeeded++
+		}
+		if r.RecordErr != nil {
+			s.Errors = append(s.Errors, r.RecordErr.Error())
+		}
+	}
+	return s
+}
+
+// fail records a failed metric update.
+func (s *syncSummary) fail(name string, err error) {
+	s.Failed++
+	if s.Failures == nil {
+		s.Failures = make(map[string]string)
+	}
+	s.Failures[name] = err.Error()
+}
+
+// write logs the summary and writes it as the response to a /sync request.
+func (s *syncSummary) write(ctx context.Context, w http.ResponseWriter) {
+	entry := log.WithContext(ctx).WithFields(log.Fields{
+		"attempted":        s.Attempted,
+		"succeeded":        s.Succeeded,
+		"skipped":          s.Skipped,
+		"deferred":         s.Deferred,
+		"failed":           s.Failed,
+		"points":           s.Points,
+		"duration_seconds": s.Duration,
+	})
+	if s.Tenant != "" {
+		entry = entry.WithField("tenant", s.Tenant)
+	}
+	if len(s.DeferredMetrics) > 0 {
+		entry = entry.WithField("deferred_metrics", s.DeferredMetrics)
+	}
+	if s.Rollout != "" {
+		entry = entry.WithField("config_rollout", s.Rollout)
+	}
+	status := http.StatusOK
+	if len(s.Errors) > 0 {
+		status = http.StatusInternalServerError
+		entry.WithField("errors", s.Errors).Error("Sync failed")
+	} else {
+		entry.Info("Sync finished")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		log.WithContext(ctx).Warningf("Cannot write sync summary: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appdynamics
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// tierPathPrefix is the metric path prefix of tier-level metrics.
+const tierPathPrefix = "Overall Application Performance"
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from AppDynamics.
+type MetricConfig struct {
+	// Controller is the base URL of the AppDynamics controller, e.g. https://acme.saas.appdynamics.com.
+	Controller  string `validate:"nonzero"`
+	Application string `validate:"nonzero"`
+	// Tier is optional; if set, MetricPath is relative to the metrics of the tier.
+	Tier       string
+	MetricPath string `yaml:"metric_path" validate:"nonzero"`
+	// Value is the field of rollup values that is imported.
+	Value string `validate:"regexp=^(|value|min|max|sum|count|current)$"`
+
+	// Either a user (as user@account) and password, or an API client (as name@account) and its secret are used
+	// to authenticate.
+	Username     string
+	Password     string
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// Secrets can also be read from files, e.g. from a mounted Kubernetes secret.
+	PasswordFile     string `yaml:"password_file"`
+	ClientSecretFile string `yaml:"client_secret_file"`
+}
+
+// ReadSecretFiles sets the password and client secret from the contents of the configured files. Relative paths
+// are resolved relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	for _, s := range []struct {
+		name, file string
+		value      *string
+	}{
+		{"password", c.PasswordFile, &c.Password},
+		{"client_secret", c.ClientSecretFile, &c.ClientSecret},
+	} {
+		if s.file == "" {
+			continue
+		}
+		if *s.value != "" {
+			return fmt.Errorf("%s and %s_file cannot both be set", s.name, s.name)
+		}
+		v, err := env.ReadSecretFile(dir, s.file)
+		if err != nil {
+			return fmt.Errorf("cannot read %s_file: %v", s.name, err)
+		}
+		*s.value = v
+	}
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if (c.Username == "") == (c.ClientID == "") {
+		return fmt.Errorf("either username or client_id needs to be set")
+	}
+	for _, id := range []struct{ name, value string }{{"username", c.Username}, {"client_id", c.ClientID}} {
+		if id.value != "" && !strings.Contains(id.value, "@") {
+			return fmt.Errorf("%s needs to include the account name, e.g. name@account", id.name)
+		}
+	}
+	return nil
+}
+
+// metricPath returns the full path of imported metrics.
+func (c *MetricConfig) metricPath() string {
+	if c.Tier == "" {
+		return c.MetricPath
+	}
+	return strings.Join([]string{tierPathPrefix, c.Tier, c.MetricPath}, "|")
+}
+
+// value returns the field of rollup values that is imported.
+func (c *MetricConfig) value() string {
+	if c.Value != "" {
+		return c.Value
+	}
+	return "value"
+}
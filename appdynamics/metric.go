@@ -0,0 +1,324 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package appdynamics imports metrics from the AppDynamics metric-data REST API.
+package appdynamics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// metricPathLabel is the label that has the path of each metric, for metric paths with wildcards.
+const metricPathLabel = "metric_path"
+
+// maxRollupPeriod is the longest period AppDynamics rolls metric values up to. Queries start this much before the
+// last imported point, so that rollups ending after it are returned.
+const maxRollupPeriod = time.Hour
+
+// noData is the metric name the API returns for metric paths that do not have any data.
+const noData = "METRIC DATA NOT FOUND"
+
+// rollupPeriods maps the frequency of metric values to the period they have been rolled up over.
+var rollupPeriods = map[string]time.Duration{
+	"ONE_MIN":   time.Minute,
+	"TEN_MIN":   10 * time.Minute,
+	"SIXTY_MIN": time.Hour,
+}
+
+// Metric defines an AppDynamics-based metric. It implements the SourceMetric interface.
+type Metric struct {
+	Name        string
+	config      *MetricConfig
+	httpClient  *http.Client
+	minPointAge time.Duration
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig, minPointAge time.Duration) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:        name,
+		config:      config,
+		httpClient:  httpClient,
+		minPointAge: minPointAge,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/appdynamics/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "appdynamics"
+}
+
+// SourceHost returns the host of the AppDynamics controller. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.Controller)
+	if err != nil || u.Host == "" {
+		return m.config.Controller
+	}
+	return u.Host
+}
+
+// Query returns the application and metric path imported by this metric.
+func (m *Metric) Query() string {
+	return fmt.Sprintf("%s: %s (%s)", m.config.Application, m.config.metricPath(), m.config.value())
+}
+
+// StackdriverData queries AppDynamics, returning metric descriptor and time series data with points after the
+// given lastPoint timestamp.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	return m.StackdriverDataUntil(ctx, lastPoint, time.Time{}, rec)
+}
+
+// Windowed returns whether the metric can be queried in windows, which is always the case for AppDynamics metrics.
+func (m *Metric) Windowed() bool {
+	return true
+}
+
+// metricData is a single metric returned by the metric-data API.
+type metricData struct {
+	MetricName   string        `json:"metricName"`
+	MetricPath   string        `json:"metricPath"`
+	Frequency    string        `json:"frequency"`
+	MetricValues []rollupValue `json:"metricValues"`
+}
+
+// rollupValue is a metric value rolled up over the period given by the frequency of the metric.
+type rollupValue struct {
+	StartTimeInMillis int64 `json:"startTimeInMillis"`
+	Value             int64 `json:"value"`
+	Min               int64 `json:"min"`
+	Max               int64 `json:"max"`
+	Sum               int64 `json:"sum"`
+	Count             int64 `json:"count"`
+	Current           int64 `json:"current"`
+}
+
+// get returns the configured field of a rollup value.
+func (v rollupValue) get(field string) int64 {
+	switch field {
+	case "min":
+		return v.Min
+	case "max":
+		return v.Max
+	case "sum":
+		return v.Sum
+	case "count":
+		return v.Count
+	case "current":
+		return v.Current
+	}
+	return v.Value
+}
+
+// StackdriverDataUntil works like StackdriverData, but only queries points up to `until`, unless it's zero.
+func (m *Metric) StackdriverDataUntil(ctx context.Context, lastPoint, until time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	// Rollups are only written once their period has ended, and a while after that, since agents report metric
+	// values with a delay.
+	end := timeNow().Add(-m.minPointAge)
+	if !until.IsZero() && until.Before(end) {
+		end = until
+	}
+	if !end.After(lastPoint) {
+		return nil, nil, nil
+	}
+
+	auth, err := m.authorization(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	q := url.Values{}
+	q.Set("metric-path", m.config.metricPath())
+	q.Set("time-range-type", "BETWEEN_TIMES")
+	q.Set("start-time", strconv.FormatInt(millis(lastPoint.Add(-maxRollupPeriod)), 10))
+	q.Set("end-time", strconv.FormatInt(millis(end), 10))
+	q.Set("rollup", "false")
+	q.Set("output", "JSON")
+	u := fmt.Sprintf("%s/controller/rest/applications/%s/metric-data?%s",
+		strings.TrimSuffix(m.config.Controller, "/"), url.PathEscape(m.config.Application), q.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Authorization", auth)
+
+	var metrics []metricData
+	if err := m.do(ctx, req, &metrics); err != nil {
+		return nil, nil, fmt.Errorf("cannot get AppDynamics metric data: %w", err)
+	}
+	log.WithContext(ctx).Debugf("Got %d AppDynamics metrics (%s)", len(metrics), m.Query())
+
+	ts, err := m.convertMetrics(metrics, lastPoint, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m.metricDescriptor(), ts, nil
+}
+
+// authorization returns the Authorization header of requests: basic authentication for users, and a bearer token
+// requested for API clients.
+func (m *Metric) authorization(ctx context.Context) (string, error) {
+	if m.config.Username != "" {
+		req := &http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(m.config.Username, m.config.Password)
+		return req.Header.Get("Authorization"), nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", m.config.ClientID)
+	form.Set("client_secret", m.config.ClientSecret)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(m.config.Controller, "/")+"/controller/api/oauth/access_token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/vnd.appd.cntrl+protobuf;v=1")
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := m.do(ctx, req, &token); err != nil {
+		return "", fmt.Errorf("cannot get AppDynamics access token: %w", err)
+	}
+	return "Bearer " + token.AccessToken, nil
+}
+
+// do sends a request to the controller, and decodes its JSON response into `result`.
+func (m *Metric) do(ctx context.Context, req *http.Request, result interface{}) error {
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return tserrors.ClassifySource(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return tserrors.ClassifySource(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("received HTTP status code %d: %s", resp.StatusCode, data))
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("cannot parse response: %v", err)
+	}
+	return nil
+}
+
+// wildcard returns whether the metric path matches several metrics, which are imported as separate time series.
+func (m *Metric) wildcard() bool {
+	return strings.Contains(m.config.metricPath(), "*")
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	desc := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_INT64,
+		Description: fmt.Sprintf("AppDynamics %s", m.Query()),
+		DisplayName: m.Name,
+	}
+	if m.wildcard() {
+		desc.Labels = []*label.LabelDescriptor{{
+			Key:         metricPathLabel,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "AppDynamics metric path",
+		}}
+	}
+	return desc
+}
+
+// convertMetrics converts rollup values into Stackdriver time series with a single point each. Points are written
+// at the end of the period they have been rolled up over, and only points after `lastPoint` and up to `end` are
+// returned.
+func (m *Metric) convertMetrics(metrics []metricData, lastPoint, end time.Time) ([]*monitoringpb.TimeSeries, error) {
+	var ts []*monitoringpb.TimeSeries
+	for _, md := range metrics {
+		if md.MetricName == noData {
+			continue
+		}
+		period, ok := rollupPeriods[md.Frequency]
+		if !ok {
+			return nil, fmt.Errorf("AppDynamics metric %s has unknown frequency %s", md.MetricPath, md.Frequency)
+		}
+		var labels map[string]string
+		if m.wildcard() {
+			labels = map[string]string{metricPathLabel: md.MetricPath}
+		}
+		for _, v := range md.MetricValues {
+			t := time.Unix(0, v.StartTimeInMillis*int64(time.Millisecond)).Add(period)
+			if !t.After(lastPoint) || t.After(end) {
+				continue
+			}
+			et, err := ptypes.TimestampProto(t)
+			if err != nil {
+				return nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", t, err)
+			}
+			ts = append(ts, &monitoringpb.TimeSeries{
+				Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels},
+				Resource:   &monitoredres.MonitoredResource{Type: "global"},
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_INT64,
+				Points: []*monitoringpb.Point{{
+					Interval: &monitoringpb.TimeInterval{EndTime: et},
+					Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: v.get(m.config.value())}},
+				}},
+			})
+		}
+	}
+	sort.SliceStable(ts, func(i, j int) bool {
+		return ts[i].Points[0].Interval.EndTime.Seconds < ts[j].Points[0].Interval.EndTime.Seconds
+	})
+	return ts, nil
+}
+
+// millis returns a timestamp in milliseconds, as used by the AppDynamics API.
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
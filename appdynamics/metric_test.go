@@ -0,0 +1,241 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package appdynamics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	path   string
+	offset time.Duration // relative to the start of a test.
+	value  int64
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, testPoint{s.Metric.Labels[metricPathLabel], end.Sub(start), s.Points[0].Value.GetInt64Value()})
+	}
+	return points
+}
+
+func TestStackdriverDataBasicAuth(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(5 * time.Minute) }
+
+	var query, path, requestID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "bridge@acme" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		path, query, requestID = r.URL.EscapedPath(), r.URL.RawQuery, r.Header.Get(requestid.Header)
+		json.NewEncoder(w).Encode([]metricData{{
+			MetricName: "BTM|Application Summary|Component:1|Calls per Minute",
+			MetricPath: "Overall Application Performance|web|Calls per Minute",
+			Frequency:  "ONE_MIN",
+			MetricValues: []rollupValue{
+				{StartTimeInMillis: millis(start.Add(-time.Minute)), Value: 10, Sum: 100},
+				{StartTimeInMillis: millis(start), Value: 20, Sum: 200},
+				{StartTimeInMillis: millis(start.Add(time.Minute)), Value: 30, Sum: 300},
+				// This rollup ends after the minimum point age.
+				{StartTimeInMillis: millis(start.Add(4 * time.Minute)), Value: 40, Sum: 400},
+			},
+		}})
+	}))
+	defer server.Close()
+
+	m, err := NewSourceMetric("web_calls", &MetricConfig{
+		Controller:  server.URL + "/",
+		Application: "checkout app",
+		Tier:        "web",
+		MetricPath:  "Calls per Minute",
+		Value:       "sum",
+		Username:    "bridge@acme",
+		Password:    "secret",
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if want := "/controller/rest/applications/checkout%20app/metric-data"; path != want {
+		t.Errorf("expected request path %s; got %s", want, path)
+	}
+	for k, want := range map[string]string{
+		"metric-path":     "Overall Application Performance|web|Calls per Minute",
+		"time-range-type": "BETWEEN_TIMES",
+		"start-time":      strconv.FormatInt(millis(start.Add(-time.Hour)), 10),
+		"end-time":        strconv.FormatInt(millis(start.Add(4*time.Minute)), 10),
+		"rollup":          "false",
+	} {
+		if got := mustParseQuery(t, query).Get(k); got != want {
+			t.Errorf("expected query parameter %s=%s; got %s", k, want, got)
+		}
+	}
+	if requestID != "req-1" {
+		t.Errorf("expected request ID req-1 to be sent; got %s", requestID)
+	}
+	if desc.Type != "custom.googleapis.com/appdynamics/web_calls" || len(desc.Labels) != 0 {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	want := []testPoint{{"", time.Minute, 200}, {"", 2 * time.Minute, 300}}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataClientAuth(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Hour)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/controller/api/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		// The body is form-encoded, although AppDynamics expects a different content type.
+		body, _ := ioutil.ReadAll(r.Body)
+		form := mustParseQuery(t, string(body))
+		if form.Get("client_id") != "bridge@acme" || form.Get("client_secret") != "secret" || form.Get("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"access_token": "token", "expires_in": 300}`))
+	})
+	mux.HandleFunc("/controller/rest/applications/shop/metric-data", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode([]metricData{
+			{MetricPath: "Business Transaction Performance|Business Transactions|web|/cart|Errors per Minute", Frequency: "TEN_MIN",
+				MetricValues: []rollupValue{{StartTimeInMillis: millis(start), Value: 3}}},
+			{MetricPath: "Business Transaction Performance|Business Transactions|web|/pay|Errors per Minute", Frequency: "TEN_MIN",
+				MetricValues: []rollupValue{{StartTimeInMillis: millis(start), Value: 1}}},
+			{MetricName: noData, MetricPath: "Business Transaction Performance|Business Transactions|web|*|Errors per Minute"},
+		})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	m, err := NewSourceMetric("errors", &MetricConfig{
+		Controller:   server.URL,
+		Application:  "shop",
+		MetricPath:   "Business Transaction Performance|Business Transactions|web|*|Errors per Minute",
+		ClientID:     "bridge@acme",
+		ClientSecret: "secret",
+	}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	desc, ts, err := m.StackdriverData(context.Background(), start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if len(desc.Labels) != 1 || desc.Labels[0].Key != metricPathLabel {
+		t.Errorf("expected metrics with a wildcard path to have a metric path label; got %v", desc.Labels)
+	}
+	want := []testPoint{
+		{"Business Transaction Performance|Business Transactions|web|/cart|Errors per Minute", 10 * time.Minute, 3},
+		{"Business Transaction Performance|Business Transactions|web|/pay|Errors per Minute", 10 * time.Minute, 1},
+	}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		status    int
+		body      string
+		wantClass error
+	}{
+		{"invalid credentials", http.StatusUnauthorized, "", tserrors.ErrSourcePermanent},
+		{"controller unavailable", http.StatusServiceUnavailable, "", tserrors.ErrSourceTransient},
+		{"unknown frequency", http.StatusOK, `[{"metricPath": "p", "frequency": "ONE_WEEK", "metricValues": [{}]}]`, nil},
+		{"invalid response", http.StatusOK, `<html>`, nil},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			m, err := NewSourceMetric("errors", &MetricConfig{Controller: server.URL, Application: "shop", MetricPath: "p", Username: "u@acme"}, 0)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+			if err == nil {
+				t.Fatalf("expected StackdriverData to fail")
+			}
+			if tt.wantClass != nil && !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestMetricConfig(t *testing.T) {
+	for _, tt := range []struct {
+		desc    string
+		config  MetricConfig
+		wantErr bool
+	}{
+		{"user", MetricConfig{Username: "u@acme"}, false},
+		{"API client", MetricConfig{ClientID: "c@acme"}, false},
+		{"no credentials", MetricConfig{}, true},
+		{"user and API client", MetricConfig{Username: "u@acme", ClientID: "c@acme"}, true},
+		{"no account", MetricConfig{Username: "u"}, true},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() returned %v; want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func mustParseQuery(t *testing.T, query string) url.Values {
+	v, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
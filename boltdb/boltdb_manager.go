@@ -18,11 +18,15 @@ import (
 	"context"
 	"fmt"
 	"github.com/google/ts-bridge/storage"
+	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
 )
 
 // Options holds storage settings specific to BoltDB.
@@ -30,9 +34,20 @@ type Options struct {
 	DBPath string
 }
 
-// Manager struct implementing the storage.Manager interface
+// openMu makes sure that only a single Manager has the database open within the process. BoltDB would block a second
+// open of the same file anyway, but waiting on this lock instead of the file lock makes sure that a Manager opened
+// while the database is being compacted uses the compacted file. It's taken by New and released by Close.
+var openMu = &sync.Mutex{}
+
+// Manager struct implementing the storage.Manager and storage.Batcher interfaces
 type Manager struct {
 	Store *bolthold.Store
+	path  string
+
+	// batches is the number of batches in progress, and pending the records written while there are any.
+	mu      sync.Mutex
+	batches int
+	pending map[string]*StoredMetricRecord
 }
 
 // New initializes the Manager struct implementing a generic storage.Manager interface
@@ -46,13 +61,14 @@ func New(options *Options) *Manager {
 		}
 		boltPath = path.Join(pwd, "bolt.db")
 	}
+	openMu.Lock()
 	store, err := bolthold.Open(boltPath, 0664, nil)
 	if err != nil {
 		log.Fatalf("Unable to Open BoltDB at %v:%v", boltPath, err)
 	}
 	log.Debug("Opened BoltDB")
 
-	return &Manager{Store: store}
+	return &Manager{Store: store, path: boltPath}
 }
 
 // NewMetricRecord returns a BoltDB-based metric record for a given metric name
@@ -84,11 +100,178 @@ func (d *Manager) CleanupRecords(ctx context.Context, keep []string) error {
 	return nil
 }
 
+// StartBatch defers writes of metric records until FlushBatch is called.
+func (d *Manager) StartBatch() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.batches++
+}
+
+// FlushBatch writes all metric records changed since StartBatch in a single transaction.
+func (d *Manager) FlushBatch(_ context.Context) error {
+	d.mu.Lock()
+	if d.batches > 0 {
+		d.batches--
+	}
+	pending := d.pending
+	d.pending = nil
+	d.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+	err := d.Store.Bolt().Update(func(tx *bolt.Tx) error {
+		for name, r := range pending {
+			if err := d.Store.TxUpsert(tx, name, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not write %d metric records: %v", len(pending), err)
+	}
+	return nil
+}
+
+// deferWrite keeps a record to be written by FlushBatch, and returns false if no batch is in progress.
+func (d *Manager) deferWrite(r *StoredMetricRecord) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.batches == 0 {
+		return false
+	}
+	if d.pending == nil {
+		d.pending = make(map[string]*StoredMetricRecord)
+	}
+	d.pending[r.Name] = r
+	return true
+}
+
 // Close properly closes the BoltDB file and removes the lock
 func (d *Manager) Close() error {
+	defer openMu.Unlock()
 	if err := d.Store.Close(); err != nil {
 		// explicitly returning an error here since BoltDB file/lock errors can be cryptic without context
 		return fmt.Errorf("could not close BoltDB store: %v", err)
 	}
 	return nil
 }
+
+// Backup writes a consistent snapshot of the database to a file. The snapshot is taken within a read-only
+// transaction, so updates can continue while it's being written. The file is written under a temporary name first,
+// so that a failed backup never leaves a partial file at `dest`.
+func (d *Manager) Backup(dest string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), filepath.Base(dest)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not create BoltDB backup file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	err = d.Store.Bolt().View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(tmp)
+		return err
+	})
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write BoltDB backup: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write BoltDB backup: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("could not write BoltDB backup: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return fmt.Errorf("could not write BoltDB backup: %v", err)
+	}
+	return nil
+}
+
+// Compact rewrites the database into a new file without free pages and replaces the database file with it, since
+// BoltDB never shrinks its file by itself. It returns file sizes before and after compaction. The store is reopened,
+// so it must not be used concurrently with Compact.
+func (d *Manager) Compact() (int64, int64, error) {
+	before, err := fileSize(d.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	tmp := d.path + ".compact"
+	defer os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0664, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not create compacted BoltDB file: %v", err)
+	}
+	if err := compact(dst, d.Store.Bolt()); err != nil {
+		dst.Close()
+		return 0, 0, fmt.Errorf("could not compact BoltDB: %v", err)
+	}
+	if err := dst.Close(); err != nil {
+		return 0, 0, fmt.Errorf("could not close compacted BoltDB file: %v", err)
+	}
+
+	// The store is closed directly rather than using Close, so that other managers can't open the database until
+	// the compacted file replaces it.
+	if err := d.Store.Close(); err != nil {
+		return 0, 0, fmt.Errorf("could not close BoltDB store: %v", err)
+	}
+	renameErr := os.Rename(tmp, d.path)
+	// The store is reopened even if the file could not be replaced, so that the manager remains usable.
+	store, err := bolthold.Open(d.path, 0664, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to reopen BoltDB at %v: %v", d.path, err)
+	}
+	d.Store = store
+	if renameErr != nil {
+		return 0, 0, fmt.Errorf("could not replace BoltDB file with the compacted one: %v", renameErr)
+	}
+	after, err := fileSize(d.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	return before, after, nil
+}
+
+// compact copies all buckets of `src` into an empty database `dst`, filling its pages completely.
+func compact(dst, src *bolt.DB) error {
+	return src.View(func(stx *bolt.Tx) error {
+		return dst.Update(func(dtx *bolt.Tx) error {
+			return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := dtx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(nb, b)
+			})
+		})
+	})
+}
+
+// copyBucket recursively copies all keys and nested buckets of `src` into `dst`.
+func copyBucket(dst, src *bolt.Bucket) error {
+	dst.FillPercent = 1.0
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		// Nested buckets have a nil value.
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nb, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(nb, src.Bucket(k))
+	})
+}
+
+// fileSize returns the size of a file in bytes.
+func fileSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, fmt.Errorf("could not stat BoltDB file: %v", err)
+	}
+	return fi.Size(), nil
+}
@@ -15,11 +15,15 @@
 package boltdb
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/timshannon/bolthold"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestBoltdbManager(t *testing.T) {
@@ -80,3 +84,110 @@ func TestBoltdbManager(t *testing.T) {
 		t.Errorf("expected metric1 to be kept, got %v", records)
 	}
 }
+
+func TestBoltdbManagerBatch(t *testing.T) {
+	tempFile, err := ioutil.TempFile("", "boltdb")
+	if err != nil {
+		t.Fatalf("Unable to create a temporary file for BoltDB: %v", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	manager := New(&Options{DBPath: tempFile.Name()})
+	defer manager.Close()
+
+	manager.StartBatch()
+	for _, name := range []string{"metric1", "metric2"} {
+		record, err := manager.NewMetricRecord(nil, name, "test-query")
+		if err != nil {
+			t.Fatalf("Error creating a new metric record: %v", err)
+		}
+		record.UpdateSuccess(nil, 0, "0 points written")
+	}
+
+	// Records are only written once the batch is flushed.
+	var records []StoredMetricRecord
+	manager.Store.Find(&records, nil)
+	if len(records) != 0 {
+		t.Errorf("expected no records to be written before the batch is flushed; got %d", len(records))
+	}
+	if err := manager.FlushBatch(nil); err != nil {
+		t.Fatalf("FlushBatch() returned error: %v", err)
+	}
+	manager.Store.Find(&records, nil)
+	if len(records) != 2 {
+		t.Errorf("expected 2 records to be written by FlushBatch; got %d", len(records))
+	}
+
+	// Writes are no longer deferred once the batch is flushed.
+	record, err := manager.NewMetricRecord(nil, "metric3", "test-query")
+	if err != nil {
+		t.Fatalf("Error creating a new metric record: %v", err)
+	}
+	record.UpdateSuccess(nil, 0, "0 points written")
+	records = nil
+	manager.Store.Find(&records, nil)
+	if len(records) != 3 {
+		t.Errorf("expected 3 records after writing one outside of a batch; got %d", len(records))
+	}
+}
+
+func TestBoltdbManagerBackupAndCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltdb")
+	if err != nil {
+		t.Fatalf("Unable to create a temporary directory for BoltDB: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	manager := New(&Options{DBPath: filepath.Join(dir, "bolt.db")})
+	defer manager.Close()
+
+	// Write and remove a lot of records to leave free pages in the database file.
+	var keep []string
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("metric%d", i)
+		record, err := manager.NewMetricRecord(nil, name, strings.Repeat("q", 1000))
+		if err != nil {
+			t.Fatalf("Error creating a new metric record: %v", err)
+		}
+		record.UpdateSuccess(nil, 0, "0 points written")
+		if i%100 == 0 {
+			keep = append(keep, name)
+		}
+	}
+	if err := manager.CleanupRecords(nil, keep); err != nil {
+		t.Fatalf("Error cleaning up records: %v", err)
+	}
+
+	backup := filepath.Join(dir, "backup.db")
+	if err := manager.Backup(backup); err != nil {
+		t.Fatalf("Backup() returned error: %v", err)
+	}
+	before, after, err := manager.Compact()
+	if err != nil {
+		t.Fatalf("Compact() returned error: %v", err)
+	}
+	if after >= before {
+		t.Errorf("expected compaction to shrink the database; got %d bytes before and %d after", before, after)
+	}
+
+	// Both the compacted database and the backup should contain remaining records.
+	var records []StoredMetricRecord
+	if err := manager.Store.Find(&records, nil); err != nil {
+		t.Fatalf("Error reading records after compaction: %v", err)
+	}
+	if len(records) != len(keep) {
+		t.Errorf("expected %d records after compaction; got %d", len(keep), len(records))
+	}
+	b, err := bolthold.Open(backup, 0664, &bolthold.Options{Options: &bolt.Options{ReadOnly: true}})
+	if err != nil {
+		t.Fatalf("Unable to open backup: %v", err)
+	}
+	defer b.Close()
+	records = nil
+	if err := b.Find(&records, nil); err != nil {
+		t.Fatalf("Error reading records from backup: %v", err)
+	}
+	if len(records) != len(keep) {
+		t.Errorf("expected %d records in backup; got %d", len(keep), len(records))
+	}
+}
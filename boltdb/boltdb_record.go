@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/google/ts-bridge/storage"
 	log "github.com/sirupsen/logrus"
 	"github.com/timshannon/bolthold"
 )
@@ -34,11 +35,37 @@ type StoredMetricRecord struct {
 	// CounterStartTime is used to keep start timestamp for cumulative metrics.
 	CounterStartTime time.Time
 
+	// MissingPoints is the number of points missing in gaps detected during the last update.
+	MissingPoints int
+
+	// DetectorState is the state of the anomaly detector, if it's enabled for the metric.
+	DetectorState storage.DetectorState
+
+	// ThresholdStreaks is the number of consecutive points that breached each threshold rule of the metric.
+	ThresholdStreaks []int
+
+	// ResumeTime is the timestamp of the latest point written by an update that failed part way, up to which all
+	// points have been written. The next update resumes after it.
+	ResumeTime time.Time
+
+	// PendingWrites are encoded points that could not be written to Stackdriver, which are retried by the next update.
+	PendingWrites []byte
+
+	// DailyPoints is the number of points written during the current day, which counts towards daily budgets.
+	DailyPoints storage.DailyPoints
+
+	// ExpressionState is the encoded state of stateful functions of the metric's expression, e.g. previous values
+	// used to calculate rates.
+	ExpressionState []byte
+
 	storage *Manager
 }
 
-// Write metric data back to BoltDB.
+// Write metric data back to BoltDB, or keep it for the current batch.
 func (m *StoredMetricRecord) write() error {
+	if m.storage.deferWrite(m) {
+		return nil
+	}
 	return m.storage.Store.Upsert(m.Name, m)
 }
 
@@ -55,6 +82,16 @@ func (m *StoredMetricRecord) GetLastUpdate() time.Time {
 	return m.LastUpdate
 }
 
+// GetLastAttempt returns LastAttempt timestamp.
+func (m *StoredMetricRecord) GetLastAttempt() time.Time {
+	return m.LastAttempt
+}
+
+// GetLastStatus returns LastStatus.
+func (m *StoredMetricRecord) GetLastStatus() string {
+	return m.LastStatus
+}
+
 // GetCounterStartTime returns CounterStartTime.
 func (m *StoredMetricRecord) GetCounterStartTime() time.Time {
 	return m.CounterStartTime
@@ -66,6 +103,119 @@ func (m *StoredMetricRecord) SetCounterStartTime(_ context.Context, start time.T
 	return m.write()
 }
 
+// GetMissingPoints returns MissingPoints.
+func (m *StoredMetricRecord) GetMissingPoints() int {
+	return m.MissingPoints
+}
+
+// SetMissingPoints sets MissingPoints and persists metric data.
+func (m *StoredMetricRecord) SetMissingPoints(_ context.Context, missing int) error {
+	m.MissingPoints = missing
+	return m.write()
+}
+
+// GetDetectorState returns DetectorState.
+func (m *StoredMetricRecord) GetDetectorState() storage.DetectorState {
+	return m.DetectorState
+}
+
+// SetDetectorState sets DetectorState and persists metric data.
+func (m *StoredMetricRecord) SetDetectorState(_ context.Context, state storage.DetectorState) error {
+	m.DetectorState = state
+	return m.write()
+}
+
+// GetThresholdStreaks returns ThresholdStreaks.
+func (m *StoredMetricRecord) GetThresholdStreaks() []int {
+	return m.ThresholdStreaks
+}
+
+// SetThresholdStreaks sets ThresholdStreaks and persists metric data.
+func (m *StoredMetricRecord) SetThresholdStreaks(_ context.Context, streaks []int) error {
+	m.ThresholdStreaks = streaks
+	return m.write()
+}
+
+// GetResumeTime returns ResumeTime.
+func (m *StoredMetricRecord) GetResumeTime() time.Time {
+	return m.ResumeTime
+}
+
+// SetResumeTime sets ResumeTime and persists metric data.
+func (m *StoredMetricRecord) SetResumeTime(_ context.Context, resume time.Time) error {
+	m.ResumeTime = resume
+	return m.write()
+}
+
+// GetPendingWrites returns PendingWrites.
+func (m *StoredMetricRecord) GetPendingWrites() []byte {
+	return m.PendingWrites
+}
+
+// SetPendingWrites sets PendingWrites and persists metric data.
+func (m *StoredMetricRecord) SetPendingWrites(_ context.Context, pending []byte) error {
+	m.PendingWrites = pending
+	return m.write()
+}
+
+// GetDailyPoints returns DailyPoints.
+func (m *StoredMetricRecord) GetDailyPoints() storage.DailyPoints {
+	return m.DailyPoints
+}
+
+// SetDailyPoints sets DailyPoints and persists metric data.
+func (m *StoredMetricRecord) SetDailyPoints(_ context.Context, points storage.DailyPoints) error {
+	m.DailyPoints = points
+	return m.write()
+}
+
+// GetExpressionState returns ExpressionState.
+func (m *StoredMetricRecord) GetExpressionState() []byte {
+	return m.ExpressionState
+}
+
+// SetExpressionState sets ExpressionState and persists metric data.
+func (m *StoredMetricRecord) SetExpressionState(_ context.Context, state []byte) error {
+	m.ExpressionState = state
+	return m.write()
+}
+
+// State returns the current state of the record.
+func (m *StoredMetricRecord) State() storage.RecordState {
+	return storage.RecordState{
+		Name:             m.Name,
+		Query:            m.Query,
+		LastUpdate:       m.LastUpdate,
+		LastAttempt:      m.LastAttempt,
+		LastStatus:       m.LastStatus,
+		CounterStartTime: m.CounterStartTime,
+		MissingPoints:    m.MissingPoints,
+		DetectorState:    m.DetectorState,
+		ThresholdStreaks: m.ThresholdStreaks,
+		ResumeTime:       m.ResumeTime,
+		PendingWrites:    m.PendingWrites,
+		DailyPoints:      m.DailyPoints,
+		ExpressionState:  m.ExpressionState,
+	}
+}
+
+// Restore replaces the state of the record in BoltDB, e.g. from a snapshot.
+func (m *StoredMetricRecord) Restore(_ context.Context, state storage.RecordState) error {
+	m.Query = state.Query
+	m.LastUpdate = state.LastUpdate
+	m.LastAttempt = state.LastAttempt
+	m.LastStatus = state.LastStatus
+	m.CounterStartTime = state.CounterStartTime
+	m.MissingPoints = state.MissingPoints
+	m.DetectorState = state.DetectorState
+	m.ThresholdStreaks = state.ThresholdStreaks
+	m.ResumeTime = state.ResumeTime
+	m.PendingWrites = state.PendingWrites
+	m.DailyPoints = state.DailyPoints
+	m.ExpressionState = state.ExpressionState
+	return m.write()
+}
+
 // UpdateError updates metric status in BoltDB with a given error message.
 func (m *StoredMetricRecord) UpdateError(_ context.Context, e error) error {
 	log.Errorf("%s: %s", m.Name, e)
@@ -0,0 +1,98 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudflare
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// defaultEndpoint is the URL of the GraphQL Analytics API, unless configured.
+const defaultEndpoint = "https://api.cloudflare.com/client/v4/graphql"
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Cloudflare.
+type MetricConfig struct {
+	// Endpoint overrides the URL of the GraphQL Analytics API.
+	Endpoint string
+	// Zones are the tags (IDs) of the queried zones, as shown on the overview page of a zone.
+	Zones []string `validate:"nonzero"`
+	// Metric is the imported value: requests, cached_requests, cache_hit_ratio, bytes, cached_bytes, threats or
+	// firewall_events.
+	Metric string `validate:"regexp=^(requests|cached_requests|cache_hit_ratio|bytes|cached_bytes|threats|firewall_events)$"`
+	// GroupBy lists dimensions of firewall events that are imported as labels, e.g. action or clientCountryName.
+	GroupBy []string `yaml:"group_by"`
+
+	// APIToken is a Cloudflare API token with the Analytics Read permission for the zones.
+	APIToken string `yaml:"api_token"`
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// The API token can also be read from a file, e.g. from a mounted Kubernetes secret.
+	APITokenFile string `yaml:"api_token_file"`
+}
+
+// dimension matches names of dimensions of the GraphQL schema other than the time dimensions, which are always
+// queried.
+var dimension = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9]*$`)
+
+// ReadSecretFiles sets the API token from the contents of the configured token file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.APITokenFile == "" {
+		return nil
+	}
+	if c.APIToken != "" {
+		return fmt.Errorf("api_token and api_token_file cannot both be set")
+	}
+	token, err := env.ReadSecretFile(dir, c.APITokenFile)
+	if err != nil {
+		return fmt.Errorf("cannot read api_token_file: %v", err)
+	}
+	c.APIToken = token
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if c.APIToken == "" {
+		return fmt.Errorf("api_token or api_token_file needs to be set")
+	}
+	if len(c.GroupBy) > 0 && c.Metric != "firewall_events" {
+		return fmt.Errorf("group_by is only supported for firewall_events")
+	}
+	seen := make(map[string]bool)
+	for _, d := range c.GroupBy {
+		if !dimension.MatchString(d) || d == "datetimeMinute" {
+			return fmt.Errorf("invalid group_by dimension %q", d)
+		}
+		key := labelKey(d)
+		if key == "zone" || seen[key] {
+			return fmt.Errorf("group_by dimension %q conflicts with another label", d)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// endpoint returns the URL of the GraphQL Analytics API.
+func (c *MetricConfig) endpoint() string {
+	if c.Endpoint != "" {
+		return c.Endpoint
+	}
+	return defaultEndpoint
+}
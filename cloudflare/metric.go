@@ -0,0 +1,365 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloudflare imports edge traffic and firewall analytics of Cloudflare zones from the GraphQL Analytics API.
+package cloudflare
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// maxGroups is the maximum number of groups returned per zone, which is the highest limit the API accepts.
+var maxGroups = 10000
+
+// sumFields are the fields of httpRequests1mGroups summed for each metric. The cache hit ratio is computed from
+// the number of cached and total requests.
+var sumFields = map[string][]string{
+	"requests":        {"requests"},
+	"cached_requests": {"cachedRequests"},
+	"cache_hit_ratio": {"requests", "cachedRequests"},
+	"bytes":           {"bytes"},
+	"cached_bytes":    {"cachedBytes"},
+	"threats":         {"threats"},
+}
+
+// Metric defines a metric imported from Cloudflare. It implements the SourceMetric interface.
+type Metric struct {
+	Name        string
+	config      *MetricConfig
+	httpClient  *http.Client
+	minPointAge time.Duration
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig, minPointAge time.Duration) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:        name,
+		config:      config,
+		httpClient:  httpClient,
+		minPointAge: minPointAge,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/cloudflare/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "cloudflare"
+}
+
+// SourceHost returns the host of the GraphQL API. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.endpoint())
+	if err != nil || u.Host == "" {
+		return m.config.endpoint()
+	}
+	return u.Host
+}
+
+// Query returns the imported value and the zones it's queried for.
+func (m *Metric) Query() string {
+	return fmt.Sprintf("%s of zones %s", m.config.Metric, strings.Join(m.config.Zones, ", "))
+}
+
+// StackdriverData queries Cloudflare, returning metric descriptor and time series data with points after the given
+// lastPoint timestamp.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	return m.StackdriverDataUntil(ctx, lastPoint, time.Time{}, rec)
+}
+
+// Windowed returns whether the metric can be queried in windows, which is always the case for Cloudflare metrics.
+func (m *Metric) Windowed() bool {
+	return true
+}
+
+// group is a group of requests or firewall events within a minute.
+type group struct {
+	Dimensions map[string]interface{} `json:"dimensions"`
+	Count      float64                `json:"count"`
+	Sum        map[string]float64     `json:"sum"`
+}
+
+// zoneGroups are the groups of a zone.
+type zoneGroups struct {
+	ZoneTag string  `json:"zoneTag"`
+	Groups  []group `json:"groups"`
+}
+
+// graphQLResponse is the response to a GraphQL query. Errors are returned with status 200.
+type graphQLResponse struct {
+	Data struct {
+		Viewer struct {
+			Zones []zoneGroups `json:"zones"`
+		} `json:"viewer"`
+	} `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// StackdriverDataUntil works like StackdriverData, but only queries points up to `until`, unless it's zero.
+// Groups are per minute, and each point is imported at the end of its minute once the minute has passed.
+func (m *Metric) StackdriverDataUntil(ctx context.Context, lastPoint, until time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	end := timeNow().Add(-m.minPointAge)
+	if !until.IsZero() && until.Before(end) {
+		end = until
+	}
+	start := lastPoint.Truncate(time.Minute)
+	end = end.Truncate(time.Minute)
+	if !end.After(start) {
+		return nil, nil, nil
+	}
+	zones, err := m.query(ctx, start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Groups are returned in chronological order. If the limit is reached for a zone, later points of all zones
+	// are skipped, so that they are imported during the next sync instead of being skipped after points of other
+	// zones have been written.
+	var cutoff time.Time
+	parsed := make([][]time.Time, len(zones))
+	for i, z := range zones {
+		for _, g := range z.Groups {
+			minute, _ := g.Dimensions["datetimeMinute"].(string)
+			t, err := time.Parse(time.RFC3339, minute)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid time %q of Cloudflare group: %v", minute, err)
+			}
+			parsed[i] = append(parsed[i], t.Add(time.Minute))
+		}
+		if n := len(parsed[i]); n >= maxGroups && (cutoff.IsZero() || parsed[i][n-1].Before(cutoff)) {
+			cutoff = parsed[i][n-1]
+		}
+	}
+	if !cutoff.IsZero() {
+		log.WithContext(ctx).Warnf("Cloudflare returned %d groups for %s; importing points before %v", maxGroups, m.Query(), cutoff)
+	}
+
+	var ts []*monitoringpb.TimeSeries
+	for i, z := range zones {
+		log.WithContext(ctx).Debugf("Got %d Cloudflare groups of zone %s for %s", len(z.Groups), z.ZoneTag, m.Name)
+		for j, g := range z.Groups {
+			t := parsed[i][j]
+			if !t.After(lastPoint) || t.After(end) || (!cutoff.IsZero() && !t.Before(cutoff)) {
+				continue
+			}
+			value, ok := m.value(g)
+			if !ok {
+				continue
+			}
+			labels := map[string]string{"zone": z.ZoneTag}
+			for _, d := range m.config.GroupBy {
+				labels[labelKey(d)] = ""
+				if v, ok := g.Dimensions[d]; ok && v != nil {
+					labels[labelKey(d)] = fmt.Sprint(v)
+				}
+			}
+			et, err := ptypes.TimestampProto(t)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", t, err)
+			}
+			ts = append(ts, &monitoringpb.TimeSeries{
+				Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels},
+				Resource:   &monitoredres.MonitoredResource{Type: "global"},
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+				Points: []*monitoringpb.Point{{
+					Interval: &monitoringpb.TimeInterval{EndTime: et},
+					Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+				}},
+			})
+		}
+	}
+	return m.metricDescriptor(), ts, nil
+}
+
+// value returns the value of the configured metric for a group. The cache hit ratio is undefined for minutes
+// without requests.
+func (m *Metric) value(g group) (float64, bool) {
+	switch m.config.Metric {
+	case "firewall_events":
+		return g.Count, true
+	case "cache_hit_ratio":
+		if g.Sum["requests"] == 0 {
+			return 0, false
+		}
+		return g.Sum["cachedRequests"] / g.Sum["requests"], true
+	}
+	return g.Sum[sumFields[m.config.Metric][0]], true
+}
+
+// graphQL returns the GraphQL query of groups in a time range, whose bounds are passed as variables.
+func (m *Metric) graphQL() string {
+	var dataset, fields string
+	if m.config.Metric == "firewall_events" {
+		dataset = "firewallEventsAdaptiveGroups"
+		fields = fmt.Sprintf("count dimensions { %s }", strings.Join(append([]string{"datetimeMinute"}, m.config.GroupBy...), " "))
+	} else {
+		dataset = "httpRequests1mGroups"
+		fields = fmt.Sprintf("dimensions { datetimeMinute } sum { %s }", strings.Join(sumFields[m.config.Metric], " "))
+	}
+	return fmt.Sprintf(`query ($zones: [string!], $start: Time!, $end: Time!, $limit: uint64!) {
+  viewer {
+    zones(filter: {zoneTag_in: $zones}) {
+      zoneTag
+      groups: %s(limit: $limit, filter: {datetime_geq: $start, datetime_lt: $end}, orderBy: [datetimeMinute_ASC]) {
+        %s
+      }
+    }
+  }
+}`, dataset, fields)
+}
+
+// query returns the groups of all zones with minutes in [start, end).
+func (m *Metric) query(ctx context.Context, start, end time.Time) ([]zoneGroups, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"query": m.graphQL(),
+		"variables": map[string]interface{}{
+			"zones": m.config.Zones,
+			"start": start.UTC().Format(time.RFC3339),
+			"end":   end.UTC().Format(time.RFC3339),
+			"limit": maxGroups,
+		},
+	})
+	if err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.config.endpoint(), bytes.NewReader(body))
+	if err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+m.config.APIToken)
+	req.Header.Set("Content-Type", "application/json")
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("Cloudflare query failed: %w", err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("cannot read Cloudflare response: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("Cloudflare query returned HTTP status code %d: %s", resp.StatusCode, data))
+	}
+	var result graphQLResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("cannot parse Cloudflare response: %v", err)
+	}
+	if len(result.Errors) > 0 {
+		// Errors include invalid dimensions, missing permissions and time ranges beyond the retention of the plan.
+		var messages []string
+		for _, e := range result.Errors {
+			messages = append(messages, e.Message)
+		}
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("Cloudflare query failed: %s", strings.Join(messages, "; ")))
+	}
+	return result.Data.Viewer.Zones, nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric, with a zone label and a label for each
+// group_by dimension.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Cloudflare %s per minute", m.config.Metric),
+		DisplayName: m.Name,
+		Labels: []*label.LabelDescriptor{{
+			Key:         "zone",
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "Zone tag",
+		}},
+	}
+	switch m.config.Metric {
+	case "bytes", "cached_bytes":
+		d.Unit = "By"
+	case "cache_hit_ratio":
+		d.Description = "Cloudflare ratio of cached requests per minute"
+		d.Unit = "1"
+	}
+	keys := make([]string, 0, len(m.config.GroupBy))
+	for _, g := range m.config.GroupBy {
+		keys = append(keys, labelKey(g))
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		d.Labels = append(d.Labels, &label.LabelDescriptor{
+			Key:         k,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "Cloudflare firewall event dimension",
+		})
+	}
+	return d
+}
+
+// labelKey converts a GraphQL dimension name (e.g. "clientRequestHTTPHost") into a Stackdriver label key in snake
+// case (e.g. "client_request_http_host").
+func labelKey(dimension string) string {
+	runes := []rune(dimension)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			// Start a new word before an upper-case letter that follows a lower-case letter or digit, or that starts
+			// a word after an acronym (like the H of Host in HTTPHost).
+			if i > 0 && (!unicode.IsUpper(runes[i-1]) || (i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,240 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudflare
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	labels map[string]string
+	offset time.Duration // relative to the start of a test.
+	value  float64
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, testPoint{s.Metric.Labels, end.Sub(start), s.Points[0].Value.GetDoubleValue()})
+	}
+	return points
+}
+
+// testRequest records a GraphQL request sent to a test server.
+type testRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+	token     string
+	requestID string
+}
+
+// newTestServer returns a GraphQL API that responds with `body`, in which %[n]s is replaced with the start of the
+// minute n minutes after `start`.
+func newTestServer(start time.Time, body string, req *testRequest) *httptest.Server {
+	minutes := make([]interface{}, 10)
+	for i := range minutes {
+		minutes[i] = start.Add(time.Duration(i) * time.Minute).UTC().Format(time.RFC3339)
+	}
+	body = fmt.Sprintf(body, minutes...)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(req)
+		req.token, req.requestID = r.Header.Get("Authorization"), r.Header.Get(requestid.Header)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestStackdriverDataRequests(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(5*time.Minute + 30*time.Second) }
+
+	var req testRequest
+	server := newTestServer(start, `{"data": {"viewer": {"zones": [
+		{"zoneTag": "z1", "groups": [
+			{"dimensions": {"datetimeMinute": "%[1]s"}, "sum": {"requests": 10, "cachedRequests": 4}},
+			{"dimensions": {"datetimeMinute": "%[2]s"}, "sum": {"requests": 0, "cachedRequests": 0}},
+			{"dimensions": {"datetimeMinute": "%[3]s"}, "sum": {"requests": 8, "cachedRequests": 6}}
+		]},
+		{"zoneTag": "z2", "groups": [{"dimensions": {"datetimeMinute": "%[2]s"}, "sum": {"requests": 5, "cachedRequests": 5}}]}
+	]}}, "errors": null}`, &req)
+	defer server.Close()
+
+	m, err := NewSourceMetric("cache_hit_ratio", &MetricConfig{Endpoint: server.URL, Zones: []string{"z1", "z2"}, Metric: "cache_hit_ratio", APIToken: "token"}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if req.token != "Bearer token" || req.requestID != "req-1" {
+		t.Errorf("expected token and request ID to be sent; got %q and %q", req.token, req.requestID)
+	}
+	if !strings.Contains(req.Query, "groups: httpRequests1mGroups(") || !strings.Contains(req.Query, "sum { requests cachedRequests }") {
+		t.Errorf("unexpected GraphQL query %s", req.Query)
+	}
+	wantVariables := map[string]interface{}{
+		"zones": []interface{}{"z1", "z2"},
+		"start": start.UTC().Format(time.RFC3339),
+		"end":   start.Add(5 * time.Minute).UTC().Format(time.RFC3339),
+		"limit": float64(maxGroups),
+	}
+	if !reflect.DeepEqual(req.Variables, wantVariables) {
+		t.Errorf("expected variables %v; got %v", wantVariables, req.Variables)
+	}
+	if desc.Type != "custom.googleapis.com/cloudflare/cache_hit_ratio" || desc.Unit != "1" || len(desc.Labels) != 1 || desc.Labels[0].Key != "zone" {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// Points are at the end of each minute, and minutes without requests have no cache hit ratio.
+	want := []testPoint{
+		{map[string]string{"zone": "z1"}, time.Minute, 0.4},
+		{map[string]string{"zone": "z1"}, 3 * time.Minute, 0.75},
+		{map[string]string{"zone": "z2"}, 2 * time.Minute, 1},
+	}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataFirewallEvents(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	defer func(limit int) { timeNow, maxGroups = time.Now, limit }(maxGroups)
+	timeNow, maxGroups = func() time.Time { return start.Add(10 * time.Minute) }, 3
+
+	var req testRequest
+	// Zone z1 reaches the limit, so points from the minute of its last group onwards are imported later.
+	server := newTestServer(start, `{"data": {"viewer": {"zones": [
+		{"zoneTag": "z1", "groups": [
+			{"count": 3, "dimensions": {"datetimeMinute": "%[1]s", "action": "block", "clientCountryName": "NL"}},
+			{"count": 1, "dimensions": {"datetimeMinute": "%[1]s", "action": "challenge", "clientCountryName": "US"}},
+			{"count": 2, "dimensions": {"datetimeMinute": "%[2]s", "action": "block", "clientCountryName": null}}
+		]},
+		{"zoneTag": "z2", "groups": [
+			{"count": 7, "dimensions": {"datetimeMinute": "%[1]s", "action": "block", "clientCountryName": "DE"}},
+			{"count": 9, "dimensions": {"datetimeMinute": "%[5]s", "action": "block", "clientCountryName": "DE"}}
+		]}
+	]}}}`, &req)
+	defer server.Close()
+
+	m, err := NewSourceMetric("firewall", &MetricConfig{
+		Endpoint: server.URL,
+		Zones:    []string{"z1", "z2"},
+		Metric:   "firewall_events",
+		GroupBy:  []string{"clientCountryName", "action"},
+		APIToken: "token",
+	}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	desc, ts, err := m.StackdriverData(context.Background(), start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if !strings.Contains(req.Query, "groups: firewallEventsAdaptiveGroups(") || !strings.Contains(req.Query, "count dimensions { datetimeMinute clientCountryName action }") {
+		t.Errorf("unexpected GraphQL query %s", req.Query)
+	}
+	if len(desc.Labels) != 3 || desc.Labels[1].Key != "action" || desc.Labels[2].Key != "client_country_name" {
+		t.Errorf("unexpected metric descriptor labels %v", desc.Labels)
+	}
+	want := []testPoint{
+		{map[string]string{"zone": "z1", "action": "block", "client_country_name": "NL"}, time.Minute, 3},
+		{map[string]string{"zone": "z1", "action": "challenge", "client_country_name": "US"}, time.Minute, 1},
+		{map[string]string{"zone": "z2", "action": "block", "client_country_name": "DE"}, time.Minute, 7},
+	}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		status    int
+		body      string
+		wantClass error
+	}{
+		{"unauthorized", http.StatusForbidden, `{}`, tserrors.ErrSourcePermanent},
+		{"GraphQL error", http.StatusOK, `{"data": null, "errors": [{"message": "unknown field \"foo\""}]}`, tserrors.ErrSourcePermanent},
+		{"throttled", http.StatusTooManyRequests, `{}`, tserrors.ErrSourceTransient},
+		{"unavailable", http.StatusBadGateway, `{}`, tserrors.ErrSourceTransient},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			m, err := NewSourceMetric("errors", &MetricConfig{Endpoint: server.URL, Zones: []string{"z"}, Metric: "requests", APIToken: "t"}, 0)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, config := range []*MetricConfig{
+		{Zones: []string{"z"}, Metric: "requests"},
+		{Zones: []string{"z"}, Metric: "requests", APIToken: "t", GroupBy: []string{"action"}},
+		{Zones: []string{"z"}, Metric: "firewall_events", APIToken: "t", GroupBy: []string{"action { count }"}},
+		{Zones: []string{"z"}, Metric: "firewall_events", APIToken: "t", GroupBy: []string{"datetimeMinute"}},
+		{Zones: []string{"z"}, Metric: "firewall_events", APIToken: "t", GroupBy: []string{"ruleId", "ruleID"}},
+	} {
+		if _, err := NewSourceMetric("invalid", config, 0); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
+
+func TestLabelKey(t *testing.T) {
+	for in, want := range map[string]string{
+		"action":                "action",
+		"ruleId":                "rule_id",
+		"clientCountryName":     "client_country_name",
+		"clientRequestHTTPHost": "client_request_http_host",
+		"clientASNDescription":  "client_asn_description",
+		"edgeColoName":          "edge_colo_name",
+	} {
+		if got := labelKey(in); got != want {
+			t.Errorf("labelKey(%s) = %s; want %s", in, got, want)
+		}
+	}
+}
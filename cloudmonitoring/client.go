@@ -0,0 +1,79 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudmonitoring
+
+import (
+	"context"
+	"sync"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3"
+	"google.golang.org/api/iterator"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// listClient defines the Cloud Monitoring function used to read time series.
+type listClient interface {
+	ListTimeSeries(context.Context, *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error)
+}
+
+// All metrics share a single client, which is only created once a metric is queried, so that loading the
+// configuration file does not require credentials.
+var (
+	clientMu     sync.Mutex
+	sharedClient listClient
+	// newClient can be replaced in tests.
+	newClient = func() (listClient, error) {
+		sd, err := monitoring.NewMetricClient(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		return &client{sd}, nil
+	}
+)
+
+// getClient returns the shared client, creating it if necessary.
+func getClient() (listClient, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	if sharedClient == nil {
+		c, err := newClient()
+		if err != nil {
+			return nil, err
+		}
+		sharedClient = c
+	}
+	return sharedClient, nil
+}
+
+// client wraps the Cloud Monitoring metric client, implementing the listClient interface.
+type client struct {
+	sd *monitoring.MetricClient
+}
+
+func (c *client) ListTimeSeries(ctx context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+	it := c.sd.ListTimeSeries(ctx, req)
+	var series []*monitoringpb.TimeSeries
+	for {
+		t, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, t)
+	}
+	return series, nil
+}
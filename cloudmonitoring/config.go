@@ -0,0 +1,89 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudmonitoring
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// defaultAlignmentPeriod is used for aligned queries, unless configured.
+const defaultAlignmentPeriod = time.Minute
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Cloud Monitoring.
+type MetricConfig struct {
+	// Projects are the GCP projects that time series are read from. Each imported series gets a `project` label.
+	Projects []string `validate:"nonzero"`
+	// Filter is a monitoring filter selecting time series, e.g. `metric.type = "compute.googleapis.com/instance/cpu/utilization"`.
+	Filter string `validate:"nonzero"`
+
+	// Aligner, AlignmentPeriod, Reducer and GroupBy define an optional aggregation of the selected time series.
+	// See https://cloud.google.com/monitoring/api/v3/aggregation
+	Aligner         string        // e.g. ALIGN_RATE
+	AlignmentPeriod time.Duration `yaml:"alignment_period"`
+	Reducer         string        // e.g. REDUCE_SUM
+	GroupBy         []string      `yaml:"group_by"` // e.g. [resource.label.zone]
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if !strings.Contains(c.Filter, "metric.type") {
+		return fmt.Errorf("filter needs to select a metric type, e.g. metric.type = \"...\"")
+	}
+	if c.Aligner != "" {
+		if _, ok := monitoringpb.Aggregation_Aligner_value[c.Aligner]; !ok {
+			return fmt.Errorf("unknown aligner %s", c.Aligner)
+		}
+	}
+	if c.Reducer != "" {
+		if _, ok := monitoringpb.Aggregation_Reducer_value[c.Reducer]; !ok {
+			return fmt.Errorf("unknown reducer %s", c.Reducer)
+		}
+		if c.Aligner == "" || c.Aligner == "ALIGN_NONE" {
+			return fmt.Errorf("reducer %s requires an aligner", c.Reducer)
+		}
+	}
+	if len(c.GroupBy) > 0 && c.Reducer == "" {
+		return fmt.Errorf("group_by requires a reducer")
+	}
+	if c.AlignmentPeriod < 0 || c.AlignmentPeriod%time.Second != 0 {
+		return fmt.Errorf("alignment_period needs to be a positive number of seconds")
+	}
+	return nil
+}
+
+// aggregation returns the aggregation of queried time series, or nil if they are read as they are.
+func (c *MetricConfig) aggregation() *monitoringpb.Aggregation {
+	if c.Aligner == "" {
+		return nil
+	}
+	period := c.AlignmentPeriod
+	if period == 0 {
+		period = defaultAlignmentPeriod
+	}
+	a := &monitoringpb.Aggregation{
+		AlignmentPeriod:  ptypes.DurationProto(period),
+		PerSeriesAligner: monitoringpb.Aggregation_Aligner(monitoringpb.Aggregation_Aligner_value[c.Aligner]),
+		GroupByFields:    c.GroupBy,
+	}
+	if c.Reducer != "" {
+		a.CrossSeriesReducer = monitoringpb.Aggregation_Reducer(monitoringpb.Aggregation_Reducer_value[c.Reducer])
+	}
+	return a
+}
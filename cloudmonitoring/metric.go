@@ -0,0 +1,247 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cloudmonitoring imports time series from Cloud Monitoring (Stackdriver) itself, so that metrics can be
+// bridged between GCP projects, or built-in metrics can be aggregated into custom metrics.
+package cloudmonitoring
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// projectLabel is added to each imported series, with the project it has been read from.
+const projectLabel = "project"
+
+// resourceLabelPrefix is prepended to keys of monitored resource labels, which become metric labels since imported
+// series are written to the global resource.
+const resourceLabelPrefix = "resource_"
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a metric imported from Cloud Monitoring. It implements the SourceMetric interface.
+type Metric struct {
+	Name        string
+	config      *MetricConfig
+	minPointAge time.Duration
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig, minPointAge time.Duration) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:        name,
+		config:      config,
+		minPointAge: minPointAge,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/cloudmonitoring/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "cloudmonitoring"
+}
+
+// SourceHost returns the host of the Cloud Monitoring API. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	return "monitoring.googleapis.com"
+}
+
+// Query returns the filter and aggregation of this metric.
+func (m *Metric) Query() string {
+	q := m.config.Filter
+	if m.config.Aligner != "" {
+		q += fmt.Sprintf(" | %s", m.config.Aligner)
+	}
+	if m.config.Reducer != "" {
+		q += fmt.Sprintf(" | %s", m.config.Reducer)
+		if len(m.config.GroupBy) > 0 {
+			q += fmt.Sprintf(" by %s", strings.Join(m.config.GroupBy, ", "))
+		}
+	}
+	return q
+}
+
+// StackdriverData queries Cloud Monitoring, returning metric descriptor and time series data with points after the
+// given lastPoint timestamp.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	return m.StackdriverDataUntil(ctx, lastPoint, time.Time{}, rec)
+}
+
+// Windowed returns whether the metric can be queried in windows, which is always the case for Cloud Monitoring
+// metrics: cumulative points keep the start time they have been written with.
+func (m *Metric) Windowed() bool {
+	return true
+}
+
+// StackdriverDataUntil works like StackdriverData, but only queries points up to `until`, unless it's zero.
+func (m *Metric) StackdriverDataUntil(ctx context.Context, lastPoint, until time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	end := timeNow().Add(-m.minPointAge)
+	if !until.IsZero() && until.Before(end) {
+		end = until
+	}
+	if !end.After(lastPoint) {
+		return nil, nil, nil
+	}
+	c, err := getClient()
+	if err != nil {
+		return nil, nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("cannot create Cloud Monitoring client: %v", err))
+	}
+	startTs, err := ptypes.TimestampProto(lastPoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	endTs, err := ptypes.TimestampProto(end)
+	if err != nil {
+		return nil, nil, err
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(requestid.Header), id)
+	}
+
+	var ts []*monitoringpb.TimeSeries
+	var desc *metricpb.MetricDescriptor
+	keys := make(map[string]bool)
+	for _, project := range m.config.Projects {
+		series, err := c.ListTimeSeries(ctx, &monitoringpb.ListTimeSeriesRequest{
+			Name:        fmt.Sprintf("projects/%s", project),
+			Filter:      m.config.Filter,
+			Interval:    &monitoringpb.TimeInterval{StartTime: startTs, EndTime: endTs},
+			Aggregation: m.config.aggregation(),
+		})
+		if err != nil {
+			return nil, nil, classifyError(fmt.Errorf("cannot list time series of project %s: %w", project, err))
+		}
+		log.WithContext(ctx).Debugf("Got %d Cloud Monitoring series from project %s for %s", len(series), project, m.Query())
+		for _, s := range series {
+			if desc == nil {
+				if desc, err = m.metricDescriptor(s); err != nil {
+					return nil, nil, err
+				}
+			} else if s.MetricKind != desc.MetricKind || s.ValueType != desc.ValueType {
+				return nil, nil, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("filter selects series of different kinds (%v %v and %v %v); please narrow it down or use an aligner",
+					desc.MetricKind, desc.ValueType, s.MetricKind, s.ValueType))
+			}
+			converted, err := m.convertSeries(project, s, lastPoint, end)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, cs := range converted {
+				for k := range cs.Metric.Labels {
+					keys[k] = true
+				}
+			}
+			ts = append(ts, converted...)
+		}
+	}
+	if desc == nil {
+		return nil, nil, nil
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		desc.Labels = append(desc.Labels, &label.LabelDescriptor{Key: k, ValueType: label.LabelDescriptor_STRING})
+	}
+	return desc, ts, nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric, based on the kind of a returned series.
+// Labels are filled in by the caller. Custom metrics cannot be delta metrics, so delta series need to be aligned.
+func (m *Metric) metricDescriptor(s *monitoringpb.TimeSeries) (*metricpb.MetricDescriptor, error) {
+	if s.MetricKind == metricpb.MetricDescriptor_DELTA {
+		return nil, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("delta metrics cannot be written as custom metrics; please configure an aligner, e.g. ALIGN_RATE"))
+	}
+	return &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  s.MetricKind,
+		ValueType:   s.ValueType,
+		Description: fmt.Sprintf("Cloud Monitoring query: %s", m.Query()),
+		DisplayName: m.Name,
+	}, nil
+}
+
+// convertSeries converts a series read from Cloud Monitoring into time series with a single point each, keeping
+// points that end after `lastPoint` and up to `end`. Metric and resource labels are kept as metric labels of the
+// global resource, since custom metrics cannot be written to most resource types.
+func (m *Metric) convertSeries(project string, s *monitoringpb.TimeSeries, lastPoint, end time.Time) ([]*monitoringpb.TimeSeries, error) {
+	labels := map[string]string{projectLabel: project}
+	for k, v := range s.GetMetric().GetLabels() {
+		labels[k] = v
+	}
+	for k, v := range s.GetResource().GetLabels() {
+		if k == "project_id" {
+			continue
+		}
+		labels[resourceLabelPrefix+k] = v
+	}
+	var ts []*monitoringpb.TimeSeries
+	for _, p := range s.Points {
+		t, err := ptypes.Timestamp(p.GetInterval().GetEndTime())
+		if err != nil {
+			return nil, fmt.Errorf("invalid point end time: %v", err)
+		}
+		if !t.After(lastPoint) || t.After(end) {
+			continue
+		}
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: s.MetricKind,
+			ValueType:  s.ValueType,
+			Points:     []*monitoringpb.Point{p},
+		})
+	}
+	return ts, nil
+}
+
+// classifyError attaches an error class to an error returned by the Cloud Monitoring API, based on its gRPC status
+// code.
+func classifyError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return tserrors.Wrap(tserrors.ErrSourceTransient, err)
+	}
+	switch status.Code(errors.Unwrap(err)) {
+	case codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.Internal:
+		return tserrors.Wrap(tserrors.ErrSourceTransient, err)
+	}
+	return tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+}
@@ -0,0 +1,241 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudmonitoring
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeClient returns configured series for each project, and records requests.
+type fakeClient struct {
+	series     map[string][]*monitoringpb.TimeSeries
+	err        error
+	requests   []*monitoringpb.ListTimeSeriesRequest
+	requestIDs []string
+}
+
+func (f *fakeClient) ListTimeSeries(ctx context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+	f.requests = append(f.requests, req)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	f.requestIDs = append(f.requestIDs, md.Get("x-request-id")...)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.series[req.Name], nil
+}
+
+// useFakeClient makes metrics use `f`, returning a function that resets the shared client.
+func useFakeClient(f *fakeClient) func() {
+	sharedClient = f
+	return func() { sharedClient = nil }
+}
+
+func gaugePoint(t *testing.T, end time.Time, v float64) *monitoringpb.Point {
+	t.Helper()
+	ts, err := ptypes.TimestampProto(end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &monitoringpb.Point{
+		Interval: &monitoringpb.TimeInterval{EndTime: ts},
+		Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: v}},
+	}
+}
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	labels map[string]string
+	offset time.Duration // relative to the start of a test.
+	value  float64
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		if len(s.Points) != 1 {
+			t.Fatalf("expected a single point per series; got %v", s.Points)
+		}
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, testPoint{s.Metric.Labels, end.Sub(start), s.Points[0].Value.GetDoubleValue()})
+	}
+	return points
+}
+
+func TestStackdriverData(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(10 * time.Minute) }
+
+	f := &fakeClient{series: map[string][]*monitoringpb.TimeSeries{
+		"projects/a": {{
+			Metric:     &metricpb.Metric{Type: "compute.googleapis.com/instance/cpu/utilization", Labels: map[string]string{"instance_name": "web-1"}},
+			Resource:   &monitoredres.MonitoredResource{Type: "gce_instance", Labels: map[string]string{"project_id": "a", "zone": "us-east1-b"}},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			// Points are returned newest first.
+			Points: []*monitoringpb.Point{gaugePoint(t, start.Add(2*time.Minute), 0.2), gaugePoint(t, start.Add(time.Minute), 0.1), gaugePoint(t, start, 0.5)},
+		}},
+		"projects/b": {{
+			Metric:     &metricpb.Metric{Type: "compute.googleapis.com/instance/cpu/utilization"},
+			Resource:   &monitoredres.MonitoredResource{Type: "gce_instance", Labels: map[string]string{"project_id": "b", "zone": "europe-west1-c"}},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points:     []*monitoringpb.Point{gaugePoint(t, start.Add(time.Minute), 0.7)},
+		}},
+	}}
+	defer useFakeClient(f)()
+
+	m, err := NewSourceMetric("cpu", &MetricConfig{
+		Projects:        []string{"a", "b"},
+		Filter:          `metric.type = "compute.googleapis.com/instance/cpu/utilization"`,
+		Aligner:         "ALIGN_MEAN",
+		AlignmentPeriod: 5 * time.Minute,
+		Reducer:         "REDUCE_MEAN",
+		GroupBy:         []string{"resource.label.zone"},
+	}, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+
+	if len(f.requests) != 2 || f.requests[0].Name != "projects/a" || f.requests[1].Name != "projects/b" {
+		t.Fatalf("expected both projects to be queried; got %v", f.requests)
+	}
+	req := f.requests[0]
+	if end, _ := ptypes.Timestamp(req.Interval.EndTime); !end.Equal(start.Add(5 * time.Minute)) {
+		t.Errorf("expected points older than the minimum point age to be queried; got end time %v", end)
+	}
+	wantAgg := &monitoringpb.Aggregation{
+		AlignmentPeriod:    ptypes.DurationProto(5 * time.Minute),
+		PerSeriesAligner:   monitoringpb.Aggregation_ALIGN_MEAN,
+		CrossSeriesReducer: monitoringpb.Aggregation_REDUCE_MEAN,
+		GroupByFields:      []string{"resource.label.zone"},
+	}
+	if req.Aggregation.String() != wantAgg.String() {
+		t.Errorf("expected aggregation %v; got %v", wantAgg, req.Aggregation)
+	}
+	if !reflect.DeepEqual(f.requestIDs, []string{"req-1", "req-1"}) {
+		t.Errorf("expected request ID to be sent as metadata; got %v", f.requestIDs)
+	}
+
+	if desc.Type != "custom.googleapis.com/cloudmonitoring/cpu" || desc.MetricKind != metricpb.MetricDescriptor_GAUGE || desc.ValueType != metricpb.MetricDescriptor_DOUBLE {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	var keys []string
+	for _, l := range desc.Labels {
+		keys = append(keys, l.Key)
+	}
+	if want := []string{"instance_name", "project", "resource_zone"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("expected labels %v; got %v", want, keys)
+	}
+	a := map[string]string{"project": "a", "instance_name": "web-1", "resource_zone": "us-east1-b"}
+	b := map[string]string{"project": "b", "resource_zone": "europe-west1-c"}
+	// The point at the start has already been imported.
+	want := []testPoint{
+		{a, 2 * time.Minute, 0.2},
+		{a, time.Minute, 0.1},
+		{b, time.Minute, 0.7},
+	}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+	for _, s := range ts {
+		if s.Metric.Type != desc.Type || s.Resource.Type != "global" {
+			t.Errorf("expected series to be written to %s of the global resource; got %v", desc.Type, s)
+		}
+	}
+}
+
+func TestStackdriverDataNoSeries(t *testing.T) {
+	defer useFakeClient(&fakeClient{})()
+	m, err := NewSourceMetric("empty", &MetricConfig{Projects: []string{"a"}, Filter: `metric.type = "x"`}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	desc, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+	if err != nil || desc != nil || ts != nil {
+		t.Errorf("expected no data; got %v, %v, %v", desc, ts, err)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	series := func(kind metricpb.MetricDescriptor_MetricKind, valueType metricpb.MetricDescriptor_ValueType) *monitoringpb.TimeSeries {
+		return &monitoringpb.TimeSeries{Metric: &metricpb.Metric{}, MetricKind: kind, ValueType: valueType}
+	}
+	for _, tt := range []struct {
+		desc      string
+		client    *fakeClient
+		wantClass error
+	}{
+		{"permission denied", &fakeClient{err: status.Error(codes.PermissionDenied, "denied")}, tserrors.ErrSourcePermanent},
+		{"invalid filter", &fakeClient{err: status.Error(codes.InvalidArgument, "invalid filter")}, tserrors.ErrSourcePermanent},
+		{"quota", &fakeClient{err: status.Error(codes.ResourceExhausted, "quota")}, tserrors.ErrSourceTransient},
+		{"unavailable", &fakeClient{err: status.Error(codes.Unavailable, "unavailable")}, tserrors.ErrSourceTransient},
+		{"delta metric", &fakeClient{series: map[string][]*monitoringpb.TimeSeries{
+			"projects/a": {series(metricpb.MetricDescriptor_DELTA, metricpb.MetricDescriptor_INT64)},
+		}}, tserrors.ErrConfigInvalid},
+		{"mixed kinds", &fakeClient{series: map[string][]*monitoringpb.TimeSeries{
+			"projects/a": {series(metricpb.MetricDescriptor_GAUGE, metricpb.MetricDescriptor_DOUBLE), series(metricpb.MetricDescriptor_GAUGE, metricpb.MetricDescriptor_INT64)},
+		}}, tserrors.ErrConfigInvalid},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			defer useFakeClient(tt.client)()
+			m, err := NewSourceMetric("errors", &MetricConfig{Projects: []string{"a"}, Filter: `metric.type = "x"`}, 0)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, config := range []*MetricConfig{
+		{Filter: `resource.type = "gce_instance"`},
+		{Filter: `metric.type = "x"`, Aligner: "ALIGN_FASTEST"},
+		{Filter: `metric.type = "x"`, Reducer: "REDUCE_SUM"},
+		{Filter: `metric.type = "x"`, Aligner: "ALIGN_RATE", GroupBy: []string{"resource.label.zone"}},
+		{Filter: `metric.type = "x"`, Aligner: "ALIGN_RATE", AlignmentPeriod: 1500 * time.Millisecond},
+	} {
+		if _, err := NewSourceMetric("invalid", config, 0); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dashboard generates Cloud Monitoring dashboards with a chart for every imported metric, grouped by tenant
+// and source, and applies them using the Dashboards API.
+package dashboard
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/ts-bridge/tsbridge"
+
+	"google.golang.org/api/googleapi"
+	monitoring "google.golang.org/api/monitoring/v1"
+)
+
+// chartsPerRow is the number of charts in each row of a dashboard.
+const chartsPerRow = 3
+
+// Rows of charts are taller than headings of groups.
+const (
+	headingWeight = 1
+	chartWeight   = 4
+)
+
+// group is a set of metrics of the same tenant and source.
+type group struct {
+	tenant, source string
+	metrics        []*tsbridge.EffectiveMetric
+}
+
+// Projects returns the sorted list of projects that metrics are written to. Dashboards can only chart metrics of
+// their own project, so each project needs a dashboard of its own.
+func Projects(metrics []*tsbridge.EffectiveMetric) []string {
+	seen := make(map[string]bool)
+	var projects []string
+	for _, m := range metrics {
+		if !seen[m.Project] {
+			seen[m.Project] = true
+			projects = append(projects, m.Project)
+		}
+	}
+	sort.Strings(projects)
+	return projects
+}
+
+// New returns a dashboard with the given ID that charts all metrics written to a project. Each group of metrics of
+// the same tenant and source starts with a heading, followed by rows of charts. Groups are sorted by tenant and
+// source, and metrics of a group keep their order.
+func New(project, id, displayName string, metrics []*tsbridge.EffectiveMetric) *monitoring.Dashboard {
+	var groups []*group
+	index := make(map[string]*group)
+	for _, m := range metrics {
+		if m.Project != project {
+			continue
+		}
+		key := m.Tenant + "/" + m.Source
+		g, ok := index[key]
+		if !ok {
+			g = &group{tenant: m.Tenant, source: m.Source}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.metrics = append(g.metrics, m)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].tenant != groups[j].tenant {
+			return groups[i].tenant < groups[j].tenant
+		}
+		return groups[i].source < groups[j].source
+	})
+
+	layout := &monitoring.RowLayout{}
+	for _, g := range groups {
+		layout.Rows = append(layout.Rows, &monitoring.Row{Weight: headingWeight, Widgets: []*monitoring.Widget{heading(g)}})
+		for i := 0; i < len(g.metrics); i += chartsPerRow {
+			row := &monitoring.Row{Weight: chartWeight}
+			for _, m := range g.metrics[i:min(i+chartsPerRow, len(g.metrics))] {
+				row.Widgets = append(row.Widgets, chart(m))
+			}
+			layout.Rows = append(layout.Rows, row)
+		}
+	}
+	return &monitoring.Dashboard{
+		Name:        fmt.Sprintf("projects/%s/dashboards/%s", project, id),
+		DisplayName: displayName,
+		RowLayout:   layout,
+	}
+}
+
+// heading returns a text widget naming the tenant and source of a group.
+func heading(g *group) *monitoring.Widget {
+	title := g.source
+	if g.tenant != "" {
+		title = fmt.Sprintf("%s: %s", g.tenant, g.source)
+	}
+	s := "s"
+	if len(g.metrics) == 1 {
+		s = ""
+	}
+	return &monitoring.Widget{
+		Title: title,
+		Text:  &monitoring.Text{Format: "MARKDOWN", Content: fmt.Sprintf("%d %s metric%s imported by ts-bridge.", len(g.metrics), g.source, s)},
+	}
+}
+
+// chart returns a line chart of all time series of a metric. Points are not aligned, since the kind of a metric is
+// only known once it has been imported, and aligners depend on it.
+func chart(m *tsbridge.EffectiveMetric) *monitoring.Widget {
+	return &monitoring.Widget{
+		Title: m.Name,
+		XyChart: &monitoring.XyChart{
+			DataSets: []*monitoring.DataSet{{
+				PlotType: "LINE",
+				TimeSeriesQuery: &monitoring.TimeSeriesQuery{
+					TimeSeriesFilter: &monitoring.TimeSeriesFilter{Filter: fmt.Sprintf("metric.type=%q", m.MetricType)},
+				},
+			}},
+		},
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Apply creates a dashboard, or replaces the dashboard with the same name if it exists already, and returns it.
+func Apply(ctx context.Context, svc *monitoring.Service, d *monitoring.Dashboard) (*monitoring.Dashboard, error) {
+	existing, err := svc.Projects.Dashboards.Get(d.Name).Context(ctx).Do()
+	if err == nil {
+		// The etag makes sure that changes made since the dashboard has been read are not overwritten.
+		d.Etag = existing.Etag
+		updated, err := svc.Projects.Dashboards.Patch(d.Name, d).Context(ctx).Do()
+		if err != nil {
+			return nil, fmt.Errorf("cannot update dashboard %s: %v", d.Name, err)
+		}
+		return updated, nil
+	}
+	if e, ok := err.(*googleapi.Error); !ok || e.Code != http.StatusNotFound {
+		return nil, fmt.Errorf("cannot get dashboard %s: %v", d.Name, err)
+	}
+	parent := d.Name[:strings.Index(d.Name, "/dashboards/")]
+	created, err := svc.Projects.Dashboards.Create(parent, d).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("cannot create dashboard %s: %v", d.Name, err)
+	}
+	return created, nil
+}
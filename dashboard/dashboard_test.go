@@ -0,0 +1,140 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dashboard
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/google/ts-bridge/tsbridge"
+
+	monitoring "google.golang.org/api/monitoring/v1"
+	"google.golang.org/api/option"
+)
+
+var testMetrics = []*tsbridge.EffectiveMetric{
+	{Name: "requests", Source: "datadog", MetricType: "custom.googleapis.com/datadog/requests", Project: "shared"},
+	{Name: "team_b/queue", Source: "influxdb", Tenant: "team_b", MetricType: "custom.googleapis.com/influxdb/queue", Project: "shared"},
+	{Name: "errors", Source: "datadog", MetricType: "custom.googleapis.com/datadog/errors", Project: "shared"},
+	{Name: "team_a/cpu", Source: "graphite", Tenant: "team_a", MetricType: "custom.googleapis.com/graphite/cpu", Project: "team-a"},
+	{Name: "latency", Source: "datadog", MetricType: "custom.googleapis.com/datadog/latency", Project: "shared"},
+	{Name: "load", Source: "datadog", MetricType: "custom.googleapis.com/datadog/load", Project: "shared"},
+}
+
+// layout returns the titles of widgets in each row of a dashboard.
+func layout(d *monitoring.Dashboard) [][]string {
+	var rows [][]string
+	for _, r := range d.RowLayout.Rows {
+		var titles []string
+		for _, w := range r.Widgets {
+			titles = append(titles, w.Title)
+		}
+		rows = append(rows, titles)
+	}
+	return rows
+}
+
+func TestNew(t *testing.T) {
+	d := New("shared", "ts-bridge", "Bridged metrics", testMetrics)
+	if d.Name != "projects/shared/dashboards/ts-bridge" || d.DisplayName != "Bridged metrics" {
+		t.Errorf("unexpected name %s and display name %s", d.Name, d.DisplayName)
+	}
+	want := [][]string{
+		{"datadog"},
+		{"requests", "errors", "latency"},
+		{"load"},
+		{"team_b: influxdb"},
+		{"team_b/queue"},
+	}
+	if got := layout(d); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected rows %v; got %v", want, got)
+	}
+	if got := d.RowLayout.Rows[0].Widgets[0].Text.Content; got != "4 datadog metrics imported by ts-bridge." {
+		t.Errorf("unexpected heading: %s", got)
+	}
+	filter := d.RowLayout.Rows[4].Widgets[0].XyChart.DataSets[0].TimeSeriesQuery.TimeSeriesFilter.Filter
+	if want := `metric.type="custom.googleapis.com/influxdb/queue"`; filter != want {
+		t.Errorf("expected filter %s; got %s", want, filter)
+	}
+
+	if got := layout(New("team-a", "ts-bridge", "", testMetrics)); !reflect.DeepEqual(got, [][]string{{"team_a: graphite"}, {"team_a/cpu"}}) {
+		t.Errorf("expected only metrics of project team-a; got %v", got)
+	}
+}
+
+func TestProjects(t *testing.T) {
+	if got, want := Projects(testMetrics), []string{"shared", "team-a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected projects %v; got %v", want, got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		exists     bool
+		wantMethod string
+		wantPath   string
+		wantEtag   string
+	}{
+		{"create", false, http.MethodPost, "/v1/projects/shared/dashboards", ""},
+		{"replace", true, http.MethodPatch, "/v1/projects/shared/dashboards/ts-bridge", "etag-1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, path string
+			var sent monitoring.Dashboard
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					if !tt.exists {
+						http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+						return
+					}
+					w.Write([]byte(`{"name": "projects/shared/dashboards/ts-bridge", "etag": "etag-1"}`))
+					return
+				}
+				method, path = r.Method, r.URL.Path
+				body, _ := ioutil.ReadAll(r.Body)
+				if err := json.Unmarshal(body, &sent); err != nil {
+					t.Errorf("invalid request body %s: %v", body, err)
+				}
+				w.Write(body)
+			}))
+			defer srv.Close()
+
+			ctx := context.Background()
+			svc, err := monitoring.NewService(ctx, option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := Apply(ctx, svc, New("shared", "ts-bridge", "ts-bridge", testMetrics))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if method != tt.wantMethod || path != tt.wantPath {
+				t.Errorf("expected %s %s; got %s %s", tt.wantMethod, tt.wantPath, method, path)
+			}
+			if sent.Etag != tt.wantEtag || sent.Name != "projects/shared/dashboards/ts-bridge" {
+				t.Errorf("unexpected dashboard sent: name %s, etag '%s'", sent.Name, sent.Etag)
+			}
+			if len(d.RowLayout.Rows) != 5 {
+				t.Errorf("expected the applied dashboard to be returned; got %+v", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datadog
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/httpclient"
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/usage"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	ddapi "github.com/zorkian/go-datadog-api"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// defaultMarkerDuration is how long the series of an event type stays at 1 after an event, unless configured.
+const defaultMarkerDuration = time.Minute
+
+// eventTypeLabel is the Stackdriver label that has the type of imported events.
+const eventTypeLabel = "event_type"
+
+// noEventType is the event type of events that do not have the field or tag events are grouped by.
+const noEventType = "none"
+
+// EventMetric defines a metric based on Datadog events (e.g. deploys or monitor transitions). Each event type gets a
+// time series that is set to 1 when an event happens and back to 0 once the marker duration has passed, so that
+// events can be shown on Stackdriver dashboards. It implements the SourceMetric interface.
+type EventMetric struct {
+	Name        string
+	config      *EventConfig
+	client      *ddapi.Client
+	minPointAge time.Duration
+}
+
+// EventConfig defines configuration file parameters for Datadog events imported as a metric.
+type EventConfig struct {
+	APIKey         string `yaml:"api_key" validate:"nonzero"`
+	ApplicationKey string `yaml:"application_key" validate:"nonzero"`
+
+	// Sources, Tags and Priority filter events, as in the Datadog event stream API.
+	Sources  string
+	Tags     string
+	Priority string `validate:"regexp=^(|normal|low)$"`
+
+	// GroupBy defines the event type: "source" (the default), "alert_type", or "tag:<name>" for the value of a tag.
+	GroupBy string `yaml:"group_by" validate:"regexp=^(|source|alert_type|tag:.+)$"`
+	// MarkerDuration is how long the series of an event type stays at 1 after an event.
+	MarkerDuration time.Duration `yaml:"marker_duration"`
+
+	// Site is the Datadog site of the organization, e.g. datadoghq.eu. Defaults to datadoghq.com.
+	Site string
+	HTTP httpclient.Config `yaml:"http"`
+
+	// Keys can also be read from files, e.g. from a mounted Kubernetes secret.
+	APIKeyFile         string `yaml:"api_key_file"`
+	ApplicationKeyFile string `yaml:"application_key_file"`
+}
+
+// ReadSecretFiles sets API and application keys from the contents of the configured key files. Relative paths are
+// resolved relative to `dir`.
+func (c *EventConfig) ReadSecretFiles(dir string) error {
+	return readKeyFiles(dir, &c.APIKey, c.APIKeyFile, &c.ApplicationKey, c.ApplicationKeyFile)
+}
+
+// NewEventMetric creates a new SourceMetric importing Datadog events from a metric name and configuration parameters.
+func NewEventMetric(name string, config *EventConfig, minPointAge time.Duration) (*EventMetric, error) {
+	if config.MarkerDuration < 0 {
+		return nil, fmt.Errorf("marker_duration of metric %s cannot be negative", name)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &EventMetric{
+		Name:        name,
+		config:      config,
+		client:      newClient(config.APIKey, config.ApplicationKey, config.Site, httpClient),
+		minPointAge: minPointAge,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *EventMetric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/datadog/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *EventMetric) SourceType() string {
+	return "datadog"
+}
+
+// SourceHost returns the host of the Datadog API. It's used by the circuit breaker.
+func (m *EventMetric) SourceHost() string {
+	u, err := url.Parse(m.client.GetBaseUrl())
+	if err != nil {
+		return m.client.GetBaseUrl()
+	}
+	return u.Host
+}
+
+// Query returns a description of events being imported from Datadog.
+func (m *EventMetric) Query() string {
+	var filters []string
+	for _, f := range []struct{ name, value string }{
+		{"sources", m.config.Sources},
+		{"tags", m.config.Tags},
+		{"priority", m.config.Priority},
+	} {
+		if f.value != "" {
+			filters = append(filters, fmt.Sprintf("%s=%s", f.name, f.value))
+		}
+	}
+	if len(filters) == 0 {
+		return "all events"
+	}
+	return "events with " + strings.Join(filters, ", ")
+}
+
+// markerDuration returns how long the series of an event type stays at 1 after an event.
+func (m *EventMetric) markerDuration() time.Duration {
+	if m.config.MarkerDuration > 0 {
+		return m.config.MarkerDuration
+	}
+	return defaultMarkerDuration
+}
+
+// StackdriverData queries Datadog events, returning metric descriptor and time series data with points after the
+// given lastPoint timestamp. Events are queried starting one marker duration before lastPoint, so that markers of
+// events that were imported by the previous update can be reset to 0.
+func (m *EventMetric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	// Events are indexed by Datadog with a delay, so recent events are only imported once they are old enough.
+	end := time.Now().Add(-m.minPointAge)
+	if !end.After(lastPoint) {
+		return nil, nil, nil
+	}
+
+	// The Datadog client library does not accept a context, so the request ID is sent as an extra header.
+	if id := requestid.FromContext(ctx); id != "" {
+		m.client.ExtraHeader = map[string]string{requestid.Header: id}
+	}
+	usage.AddSourceCalls(ctx, 1)
+	events, err := m.client.GetEvents(int(lastPoint.Add(-m.markerDuration()).Unix()), int(end.Unix()),
+		m.config.Priority, m.config.Sources, m.config.Tags)
+	if err != nil {
+		return nil, nil, classifyError(err)
+	}
+	log.WithContext(ctx).Debugf("Got %d Datadog events (%s)", len(events), m.Query())
+
+	ts, err := m.convertEvents(events, lastPoint, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m.metricDescriptor(), ts, nil
+}
+
+// convertEvents generates Stackdriver time series from Datadog events: a point with value 1 at the time of each
+// event, and a point with value 0 after the marker duration unless another event of the same type happens before
+// then. Only points after `lastPoint` and up to `end` are returned.
+func (m *EventMetric) convertEvents(events []ddapi.Event, lastPoint, end time.Time) ([]*monitoringpb.TimeSeries, error) {
+	times := make(map[string][]time.Time)
+	for _, e := range events {
+		t, ok := e.GetTimeOk()
+		if !ok {
+			continue
+		}
+		typ := m.eventType(e)
+		times[typ] = append(times[typ], time.Unix(int64(t), 0))
+	}
+	types := make([]string, 0, len(times))
+	for typ := range times {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	var ts []*monitoringpb.TimeSeries
+	for _, typ := range types {
+		eventTimes := times[typ]
+		sort.Slice(eventTimes, func(i, j int) bool { return eventTimes[i].Before(eventTimes[j]) })
+		for i, t := range eventTimes {
+			if i > 0 && t.Equal(eventTimes[i-1]) {
+				continue
+			}
+			if t.After(lastPoint) {
+				p, err := eventSeries(m.StackdriverName(), typ, t, 1)
+				if err != nil {
+					return nil, err
+				}
+				ts = append(ts, p)
+			}
+			reset := t.Add(m.markerDuration())
+			if i+1 < len(eventTimes) && !eventTimes[i+1].After(reset) {
+				continue
+			}
+			if reset.After(lastPoint) && !reset.After(end) {
+				p, err := eventSeries(m.StackdriverName(), typ, reset, 0)
+				if err != nil {
+					return nil, err
+				}
+				ts = append(ts, p)
+			}
+		}
+	}
+	return ts, nil
+}
+
+// eventType returns the type of a Datadog event, based on the configured grouping.
+func (m *EventMetric) eventType(e ddapi.Event) string {
+	var typ string
+	switch {
+	case m.config.GroupBy == "alert_type":
+		typ = e.GetAlertType()
+	case strings.HasPrefix(m.config.GroupBy, "tag:"):
+		prefix := strings.TrimPrefix(m.config.GroupBy, "tag:") + ":"
+		for _, t := range e.Tags {
+			if strings.HasPrefix(t, prefix) {
+				typ = strings.TrimPrefix(t, prefix)
+				break
+			}
+		}
+	default:
+		typ = e.GetSourceType()
+	}
+	if typ == "" {
+		return noEventType
+	}
+	return typ
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for imported events.
+func (m *EventMetric) metricDescriptor() *metricpb.MetricDescriptor {
+	return &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_INT64,
+		Description: fmt.Sprintf("Datadog %s", m.Query()),
+		DisplayName: m.Name,
+		Labels: []*label.LabelDescriptor{{
+			Key:         eventTypeLabel,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "Type of Datadog events",
+		}},
+	}
+}
+
+// eventSeries returns a time series with a single point of an event type.
+func eventSeries(metricType, eventType string, t time.Time, value int64) (*monitoringpb.TimeSeries, error) {
+	end, err := ptypes.TimestampProto(t)
+	if err != nil {
+		return nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", t, err)
+	}
+	return &monitoringpb.TimeSeries{
+		Metric:     &metricpb.Metric{Type: metricType, Labels: map[string]string{eventTypeLabel: eventType}},
+		Resource:   &monitoredres.MonitoredResource{Type: "global"},
+		MetricKind: metricpb.MetricDescriptor_GAUGE,
+		ValueType:  metricpb.MetricDescriptor_INT64,
+		Points: []*monitoringpb.Point{{
+			Interval: &monitoringpb.TimeInterval{EndTime: end},
+			Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: value}},
+		}},
+	}, nil
+}
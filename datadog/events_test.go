@@ -0,0 +1,156 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datadog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	ddapi "github.com/zorkian/go-datadog-api"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// eventPoint is a simplified representation of a point written for an event type.
+type eventPoint struct {
+	eventType string
+	offset    time.Duration // relative to the start of a test.
+	value     int64
+}
+
+func event(start time.Time, offset time.Duration, source, alertType string, tags ...string) ddapi.Event {
+	t := int(start.Add(offset).Unix())
+	return ddapi.Event{Time: &t, SourceType: &source, AlertType: &alertType, Tags: tags}
+}
+
+func eventPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []eventPoint {
+	var points []eventPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, eventPoint{s.Metric.Labels[eventTypeLabel], end.Sub(start), s.Points[0].Value.GetInt64Value()})
+	}
+	return points
+}
+
+func TestConvertEvents(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	end := start.Add(10 * time.Minute)
+
+	for _, tt := range []struct {
+		desc      string
+		config    *EventConfig
+		events    []ddapi.Event
+		lastPoint time.Duration
+		want      []eventPoint
+	}{
+		{"markers are reset after marker duration", &EventConfig{}, []ddapi.Event{
+			event(start, time.Minute, "jenkins", "info"),
+			event(start, 5*time.Minute, "jenkins", "info"),
+		}, 0, []eventPoint{
+			{"jenkins", time.Minute, 1}, {"jenkins", 2 * time.Minute, 0},
+			{"jenkins", 5 * time.Minute, 1}, {"jenkins", 6 * time.Minute, 0},
+		}},
+		{"marker is not reset before the next event", &EventConfig{MarkerDuration: 3 * time.Minute}, []ddapi.Event{
+			event(start, 2*time.Minute, "jenkins", "info"),
+			event(start, time.Minute, "jenkins", "info"),
+			event(start, time.Minute, "jenkins", "info"),
+		}, 0, []eventPoint{
+			{"jenkins", time.Minute, 1}, {"jenkins", 2 * time.Minute, 1}, {"jenkins", 5 * time.Minute, 0},
+		}},
+		{"marker is reset after the last point", &EventConfig{}, []ddapi.Event{
+			event(start, 30*time.Second, "jenkins", "info"),
+		}, time.Minute, []eventPoint{{"jenkins", 90 * time.Second, 0}}},
+		{"marker is not reset in the future", &EventConfig{}, []ddapi.Event{
+			event(start, 9*time.Minute+30*time.Second, "jenkins", "info"),
+		}, 0, []eventPoint{{"jenkins", 9*time.Minute + 30*time.Second, 1}}},
+		{"events are grouped by alert type", &EventConfig{GroupBy: "alert_type"}, []ddapi.Event{
+			event(start, time.Minute, "monitor", "error"),
+			event(start, time.Minute, "monitor", "success"),
+		}, 0, []eventPoint{
+			{"error", time.Minute, 1}, {"error", 2 * time.Minute, 0},
+			{"success", time.Minute, 1}, {"success", 2 * time.Minute, 0},
+		}},
+		{"events are grouped by tag", &EventConfig{GroupBy: "tag:service"}, []ddapi.Event{
+			event(start, time.Minute, "jenkins", "info", "env:prod", "service:checkout"),
+			event(start, time.Minute, "jenkins", "info", "env:prod"),
+		}, 0, []eventPoint{
+			{"checkout", time.Minute, 1}, {"checkout", 2 * time.Minute, 0},
+			{"none", time.Minute, 1}, {"none", 2 * time.Minute, 0},
+		}},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			m, err := NewEventMetric("deploys", tt.config, time.Second)
+			if err != nil {
+				t.Fatalf("unexpected error from NewEventMetric: %v", err)
+			}
+			ts, err := m.convertEvents(tt.events, start.Add(tt.lastPoint), end)
+			if err != nil {
+				t.Fatalf("unexpected error from convertEvents: %v", err)
+			}
+			if got := eventPoints(t, start, ts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected points %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestEventStackdriverData(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/events" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		query = r.URL.RawQuery
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"events": [{"date_happened": %d, "source_type_name": "jenkins"}]}`, start.Add(time.Minute).Unix())
+	}))
+	defer server.Close()
+
+	m, err := NewEventMetric("deploys", &EventConfig{Sources: "jenkins", Tags: "env:prod"}, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error from NewEventMetric: %v", err)
+	}
+	m.client.SetBaseUrl(server.URL)
+
+	desc, ts, err := m.StackdriverData(ctx, start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	for _, want := range []string{"sources=jenkins", "tags=env%3Aprod", fmt.Sprintf("start=%d", start.Add(-time.Minute).Unix())} {
+		if !strings.Contains(query, want) {
+			t.Errorf("expected events query to contain %s; got %s", want, query)
+		}
+	}
+	if desc.Type != "custom.googleapis.com/datadog/deploys" || len(desc.Labels) != 1 || desc.Labels[0].Key != eventTypeLabel {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	want := []eventPoint{{"jenkins", time.Minute, 1}, {"jenkins", 2 * time.Minute, 0}}
+	if got := eventPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
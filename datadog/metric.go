@@ -17,14 +17,25 @@ package datadog
 import (
 	"context"
 	"fmt"
-	"github.com/google/ts-bridge/storage"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+	"github.com/google/ts-bridge/usage"
+
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/timestamp"
 	log "github.com/sirupsen/logrus"
 	ddapi "github.com/zorkian/go-datadog-api"
+	"google.golang.org/genproto/googleapis/api/label"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	"google.golang.org/genproto/googleapis/api/monitoredres"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
@@ -45,6 +56,53 @@ type MetricConfig struct {
 	ApplicationKey string `yaml:"application_key" validate:"nonzero"`
 	Query          string `validate:"nonzero"`
 	Cumulative     bool
+	// Site is the Datadog site of the organization, e.g. datadoghq.eu. Defaults to datadoghq.com.
+	Site string
+	HTTP httpclient.Config `yaml:"http"`
+
+	// Keys can also be read from files, e.g. from a mounted Kubernetes secret.
+	APIKeyFile         string `yaml:"api_key_file"`
+	ApplicationKeyFile string `yaml:"application_key_file"`
+}
+
+// ReadSecretFiles sets API and application keys from the contents of the configured key files. Relative paths are
+// resolved relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	return readKeyFiles(dir, &c.APIKey, c.APIKeyFile, &c.ApplicationKey, c.ApplicationKeyFile)
+}
+
+// readKeyFiles sets API and application keys from the contents of key files, if configured.
+func readKeyFiles(dir string, apiKey *string, apiKeyFile string, appKey *string, appKeyFile string) error {
+	for _, k := range []struct {
+		name, file string
+		value      *string
+	}{
+		{"api_key", apiKeyFile, apiKey},
+		{"application_key", appKeyFile, appKey},
+	} {
+		if k.file == "" {
+			continue
+		}
+		if *k.value != "" {
+			return fmt.Errorf("%s and %s_file cannot both be set", k.name, k.name)
+		}
+		v, err := env.ReadSecretFile(dir, k.file)
+		if err != nil {
+			return fmt.Errorf("cannot read %s_file: %v", k.name, err)
+		}
+		*k.value = v
+	}
+	return nil
+}
+
+// newClient creates a Datadog API client for a site, using the default site if it's empty.
+func newClient(apiKey, appKey, site string, httpClient *http.Client) *ddapi.Client {
+	client := ddapi.NewClient(apiKey, appKey)
+	client.HttpClient = httpClient
+	if site != "" {
+		client.SetBaseUrl("https://api." + site)
+	}
+	return client
 }
 
 // NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
@@ -53,11 +111,14 @@ func NewSourceMetric(name string, config *MetricConfig, minPointAge, counterRese
 		return nil, fmt.Errorf("Query for the cumulative metric %s does not contain the cumsum Datadog function", name)
 	}
 
-	client := ddapi.NewClient(config.APIKey, config.ApplicationKey)
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
 	return &Metric{
 		Name:                 name,
 		config:               config,
-		client:               client,
+		client:               newClient(config.APIKey, config.ApplicationKey, config.Site, httpClient),
 		minPointAge:          minPointAge,
 		counterResetInterval: counterResetInterval,
 	}, nil
@@ -68,6 +129,20 @@ func (m *Metric) StackdriverName() string {
 	return fmt.Sprintf("custom.googleapis.com/datadog/%s", m.Name)
 }
 
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "datadog"
+}
+
+// SourceHost returns the host of the Datadog API. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.client.GetBaseUrl())
+	if err != nil {
+		return m.client.GetBaseUrl()
+	}
+	return u.Host
+}
+
 // Query returns the query being imported from Datadog.
 func (m *Metric) Query() string {
 	return m.config.Query
@@ -76,6 +151,17 @@ func (m *Metric) Query() string {
 // StackdriverData issues a Datadog query, returning metric descriptor and time series data.
 // Time series data will include points after the given lastPoint timestamp.
 func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	return m.StackdriverDataUntil(ctx, lastPoint, time.Now(), rec)
+}
+
+// Windowed returns whether the metric can be queried in windows. Cumulative metrics are always queried from the
+// start time of the counter.
+func (m *Metric) Windowed() bool {
+	return !m.config.Cumulative
+}
+
+// StackdriverDataUntil works like StackdriverData, but only queries points up to `until`.
+func (m *Metric) StackdriverDataUntil(ctx context.Context, lastPoint, until time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
 	// Datadog's `from` parameter is inclusive, so we set it to 1 second after the latest point we've got.
 	from := lastPoint.Add(time.Second)
 	if m.config.Cumulative {
@@ -86,25 +172,37 @@ func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec s
 		}
 	}
 
-	series, err := m.client.QueryMetrics(from.Unix(), time.Now().Unix(), m.config.Query)
+	// The Datadog client library does not accept a context, so the request ID is sent as an extra header.
+	if id := requestid.FromContext(ctx); id != "" {
+		m.client.ExtraHeader = map[string]string{requestid.Header: id}
+	}
+	usage.AddSourceCalls(ctx, 1)
+	series, err := m.client.QueryMetrics(from.Unix(), until.Unix(), m.config.Query)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, classifyError(err)
 	}
+	tags := groupTags(m.config.Query)
 	if len(series) == 0 {
 		log.WithContext(ctx).Infof("Datadog query %q returned no time series", m.config.Query)
 		return nil, nil, nil
-	} else if len(series) > 1 {
-		return nil, nil, fmt.Errorf("Datadog query %q returned %d time series", m.config.Query, len(series))
+	} else if len(series) > 1 && len(tags) == 0 {
+		return nil, nil, fmt.Errorf("Datadog query %q returned %d time series; only queries grouped by tags can return several time series", m.config.Query, len(series))
 	}
 
-	points, err := m.filterPoints(lastPoint, series[0].Points)
-	log.WithContext(ctx).Debugf("Got %d points (%d after filtering) in response to the Datadog query %q", len(series[0].Points), len(points), m.config.Query)
-
 	startTime, err := ptypes.TimestampProto(from)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Count not convert timestamp %v to proto: %v", from, err)
 	}
-	return m.metricDescriptor(series[0]), m.convertTimeSeries(startTime, points), nil
+	var ts []*monitoringpb.TimeSeries
+	for _, s := range series {
+		points, err := m.filterPoints(lastPoint, s.Points)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.WithContext(ctx).Debugf("Got %d points (%d after filtering) in response to the Datadog query %q (scope %q)", len(s.Points), len(points), m.config.Query, s.GetScope())
+		ts = append(ts, m.convertTimeSeries(startTime, seriesLabels(s, tags), points)...)
+	}
+	return m.metricDescriptor(series[0], tags), ts, nil
 }
 
 // counterStartTime returns the start time for a cumulative metric. It's used as
@@ -174,8 +272,9 @@ func (m *Metric) metricKind() metricpb.MetricDescriptor_MetricKind {
 	return metricpb.MetricDescriptor_GAUGE
 }
 
-// metricDescriptor creates a Stackdriver MetricDescriptor based on a Datadog series.
-func (m *Metric) metricDescriptor(series ddapi.Series) *metricpb.MetricDescriptor {
+// metricDescriptor creates a Stackdriver MetricDescriptor based on a Datadog series. A label is declared for each
+// tag the query is grouped by.
+func (m *Metric) metricDescriptor(series ddapi.Series, tags []string) *metricpb.MetricDescriptor {
 	d := &metricpb.MetricDescriptor{
 		// Name does not need to be set here; it will be set by Stackdriver Adapter based on the Stackdriver
 		// project that this metric is written to.
@@ -195,18 +294,82 @@ func (m *Metric) metricDescriptor(series ddapi.Series) *metricpb.MetricDescripto
 			d.Unit = u[0].ShortName
 		}
 	}
+	for _, tag := range tags {
+		d.Labels = append(d.Labels, &label.LabelDescriptor{
+			Key:         labelKey(tag),
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: fmt.Sprintf("Datadog tag: %s", tag),
+		})
+	}
 	return d
 }
 
-// convertTimeSeries generates a slice of Stackdriver TimeSeries protos based on a Datadog Series.
+// groupByRE matches the `by {tag1,tag2}` clauses of a Datadog query.
+var groupByRE = regexp.MustCompile(`\bby\s*\{([^}]*)\}`)
+
+// groupTags returns a sorted list of tags that a Datadog query groups results by.
+func groupTags(query string) []string {
+	seen := make(map[string]bool)
+	var tags []string
+	for _, m := range groupByRE.FindAllStringSubmatch(query, -1) {
+		for _, tag := range strings.Split(m[1], ",") {
+			tag = strings.TrimSpace(tag)
+			if tag != "" && !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// invalidLabelChars matches characters that are not allowed in Stackdriver label keys.
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9_]`)
+
+// labelKey converts a Datadog tag name into a valid Stackdriver label key.
+// See https://cloud.google.com/monitoring/api/v3/naming-conventions
+func labelKey(tag string) string {
+	key := invalidLabelChars.ReplaceAllString(strings.ToLower(tag), "_")
+	if key == "" || key[0] < 'a' || key[0] > 'z' {
+		key = "tag_" + key
+	}
+	if len(key) > 100 {
+		key = key[:100]
+	}
+	return key
+}
+
+// seriesLabels returns Stackdriver metric labels for a Datadog series, based on the values of grouping tags in the
+// series scope (e.g. "host:web-1,env:prod").
+func seriesLabels(series ddapi.Series, tags []string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	values := make(map[string]string)
+	for _, kv := range strings.Split(series.GetScope(), ",") {
+		if i := strings.Index(kv, ":"); i > 0 {
+			values[kv[:i]] = kv[i+1:]
+		}
+	}
+	labels := make(map[string]string)
+	for _, tag := range tags {
+		if v, ok := values[tag]; ok {
+			labels[labelKey(tag)] = v
+		}
+	}
+	return labels
+}
+
+// convertTimeSeries generates a slice of Stackdriver TimeSeries protos based on points of a Datadog Series.
 // A separate TimeSeries message is created for each point because Stackdriver only allows sending a single
 // point in a given request for each time series, so multiple points will need to be sent as separate requests.
 // See https://cloud.google.com/monitoring/custom-metrics/creating-metrics#writing-ts
-func (m *Metric) convertTimeSeries(start *timestamp.Timestamp, points []ddapi.DataPoint) []*monitoringpb.TimeSeries {
+func (m *Metric) convertTimeSeries(start *timestamp.Timestamp, labels map[string]string, points []ddapi.DataPoint) []*monitoringpb.TimeSeries {
 	ts := make([]*monitoringpb.TimeSeries, 0, len(points))
 	for _, p := range points {
 		ts = append(ts, &monitoringpb.TimeSeries{
-			Metric:     &metricpb.Metric{Type: m.StackdriverName()},
+			Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels},
 			Resource:   &monitoredres.MonitoredResource{Type: "global"},
 			MetricKind: m.metricKind(),
 			ValueType:  metricpb.MetricDescriptor_DOUBLE,
@@ -239,3 +402,15 @@ func pointTimestamp(p ddapi.DataPoint) *timestamp.Timestamp {
 		Nanos:   int32(int64(*p[0]*1e6) % 1e9),
 	}
 }
+
+// classifyError attaches an error class to errors returned by the Datadog client library, which only exposes the
+// HTTP status code of failed requests as part of the error message.
+func classifyError(err error) error {
+	var code int
+	for _, format := range []string{"API error %d", "Received HTTP status code %d"} {
+		if _, scanErr := fmt.Sscanf(err.Error(), format, &code); scanErr == nil {
+			return tserrors.FromHTTPStatus(code, err)
+		}
+	}
+	return tserrors.ClassifySource(err)
+}
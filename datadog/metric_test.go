@@ -16,18 +16,22 @@ package datadog
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/ts-bridge/datastore"
 	"github.com/google/ts-bridge/mocks"
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
 
 	"github.com/golang/mock/gomock"
 	"github.com/golang/protobuf/proto"
@@ -60,10 +64,12 @@ func mustUnmarshalText(s string, pb proto.Message) {
 
 // fixtureHandler implements http.Handler
 type fixtureHandler struct {
-	filename string
+	filename  string
+	requestID string // X-Request-ID header of the last request.
 }
 
 func (h *fixtureHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.requestID = r.Header.Get("X-Request-ID")
 	if h.filename == "" {
 		w.WriteHeader(http.StatusNotFound)
 		return
@@ -79,7 +85,7 @@ func (h *fixtureHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func makeTestServer(filename string) (*fixtureHandler, *httptest.Server) {
 	mux := http.NewServeMux()
-	handler := &fixtureHandler{filename}
+	handler := &fixtureHandler{filename: filename}
 	mux.Handle("/api/v1/query", handler)
 	server := httptest.NewServer(mux)
 	return handler, server
@@ -97,6 +103,8 @@ func TestStackdriverDataErrors(t *testing.T) {
 	// At this point HTTP server returns 404 to all requests, so we might as well test error handling.
 	if _, _, err := m.StackdriverData(ctx, time.Now().Add(-time.Minute), &datastore.StoredMetricRecord{Storage: storage}); err == nil {
 		t.Error("expected an error when server returns 404")
+	} else if !errors.Is(err, tserrors.ErrSourcePermanent) {
+		t.Errorf("expected a permanent error when server returns 404; got %v", err)
 	}
 
 	// A query needs to return a single time series.
@@ -177,6 +185,34 @@ func TestStackdriverDataResponses(t *testing.T) {
 				>
 			`,
 		},
+		{
+			"multiple_ts.json",
+			&MetricConfig{Query: "system.net.bytes_rcvd{*}by{device}"},
+			`
+				type: "custom.googleapis.com/datadog/metricname"
+				metric_kind: GAUGE
+				value_type: DOUBLE
+				unit: "B/s"
+				description: "Datadog query: system.net.bytes_rcvd{*}by{device}"
+				display_name: "system.net.bytes_rcvd"
+				labels: < key: "device" value_type: STRING description: "Datadog tag: device" >`,
+			12,
+			`
+				metric: <
+					type: "custom.googleapis.com/datadog/metricname"
+					labels: < key: "device" value: "eth0" >
+				>
+				resource: < type: "global" >
+				metric_kind: GAUGE
+				value_type: DOUBLE
+				points: <
+					interval: <
+						end_time: < seconds: 1531324308 >
+					>
+					value: < double_value: 26491.05078125 >
+				>
+			`,
+		},
 	} {
 		t.Run(tt.filename, func(t *testing.T) {
 			_, server := makeTestServer(tt.filename)
@@ -263,6 +299,34 @@ func TestFilterPoints(t *testing.T) {
 	}
 }
 
+func TestGroupTags(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{"avg:system.load.1{*}", nil},
+		{"avg:system.load.1{env:prod}", nil},
+		{"avg:system.load.1{*} by {host}", []string{"host"}},
+		{"sum:requests{*}by{service,env}.as_count() / sum:total{*}by{env, service}.as_count()", []string{"env", "service"}},
+	} {
+		if got := groupTags(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("groupTags(%q) returned %v; want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSeriesLabels(t *testing.T) {
+	scope := "host:web-1,availability-zone:us-east1-b,url:http://example.com"
+	got := seriesLabels(ddapi.Series{Scope: &scope}, []string{"availability-zone", "host", "url", "missing"})
+	want := map[string]string{"availability_zone": "us-east1-b", "host": "web-1", "url": "http://example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("seriesLabels() returned %v; want %v", got, want)
+	}
+	if got := labelKey("1st-Tag"); got != "tag_1st_tag" {
+		t.Errorf("labelKey() returned %q; want \"tag_1st_tag\"", got)
+	}
+}
+
 func TestStackdriverDataUnits(t *testing.T) {
 	ctx := context.Background()
 	storage := datastore.New(ctx, &datastore.Options{})
@@ -304,6 +368,14 @@ func TestMetricConfig(t *testing.T) {
 	if err == nil {
 		t.Errorf("expected NewSourceMetric to return error for a cumulative metric without cumsum() function")
 	}
+
+	if host := m.SourceHost(); host != "api.datadoghq.com" {
+		t.Errorf("expected the default site to be used; got %s", host)
+	}
+	m, _ = NewSourceMetric("metric3", &MetricConfig{Query: "foo", Site: "datadoghq.eu"}, time.Second, time.Hour)
+	if host := m.SourceHost(); host != "api.datadoghq.eu" {
+		t.Errorf("expected the API host of the configured site; got %s", host)
+	}
 }
 
 func TestCounterStartTime(t *testing.T) {
@@ -351,3 +423,20 @@ func TestCounterStartTime(t *testing.T) {
 		})
 	}
 }
+
+func TestStackdriverDataRequestID(t *testing.T) {
+	ctx := requestid.NewContext(context.Background(), "run-1")
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	handler, server := makeTestServer("no_ts.json")
+	defer server.Close()
+	m, _ := NewSourceMetric("metricname", &MetricConfig{Query: "metricquery"}, time.Second, time.Hour)
+	m.client.SetBaseUrl(server.URL)
+
+	if _, _, err := m.StackdriverData(ctx, time.Now().Add(-time.Minute), &datastore.StoredMetricRecord{Storage: storage}); err != nil {
+		t.Fatalf("StackdriverData() returned error: %v", err)
+	}
+	if handler.requestID != "run-1" {
+		t.Errorf("expected request ID 'run-1' to be sent to Datadog; got %q", handler.requestID)
+	}
+}
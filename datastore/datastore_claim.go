@@ -0,0 +1,95 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/google/ts-bridge/storage"
+)
+
+// Name of the Datastore kind where import claims are stored.
+const claimKindName = "MetricClaims"
+
+// importClaim defines a Datastore entity that holds the import claim and cursor of a metric.
+type importClaim struct {
+	Owner   string
+	Expires time.Time
+	Cursor  time.Time
+}
+
+// claimKey returns the Datastore key of the import claim of a metric, in the namespace of the storage manager.
+func (d *Manager) claimKey(name string) *datastore.Key {
+	k := datastore.NameKey(claimKindName, name, nil)
+	k.Namespace = d.Namespace
+	return k
+}
+
+// ClaimImport claims importing points of a metric in a transaction, so that only one of several instances racing
+// for an expired claim gets it.
+func (d *Manager) ClaimImport(ctx context.Context, name, owner string, expires time.Time) (time.Time, error) {
+	var cursor time.Time
+	_, err := d.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var c importClaim
+		if err := tx.Get(d.claimKey(name), &c); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if c.Owner != "" && c.Owner != owner && c.Expires.After(time.Now()) {
+			return fmt.Errorf("claimed by %s until %v: %w", c.Owner, c.Expires, storage.ErrClaimed)
+		}
+		cursor = c.Cursor
+		c.Owner = owner
+		c.Expires = expires
+		_, err := tx.Put(d.claimKey(name), &c)
+		return err
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot claim import of %s: %w", name, err)
+	}
+	return cursor, nil
+}
+
+// ReleaseImport releases the import claim of a metric and advances its cursor in a transaction.
+func (d *Manager) ReleaseImport(ctx context.Context, name, owner string, cursor time.Time) error {
+	var lost error
+	_, err := d.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var c importClaim
+		if err := tx.Get(d.claimKey(name), &c); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		lost = nil
+		if c.Owner == owner {
+			c.Owner = ""
+			c.Expires = time.Time{}
+		} else {
+			lost = fmt.Errorf("claim has been taken over by %s: %w", c.Owner, storage.ErrClaimed)
+		}
+		if cursor.After(c.Cursor) {
+			c.Cursor = cursor
+		}
+		_, err := tx.Put(d.claimKey(name), &c)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot release import claim of %s: %v", name, err)
+	}
+	if lost != nil {
+		return fmt.Errorf("cannot release import claim of %s: %w", name, lost)
+	}
+	return nil
+}
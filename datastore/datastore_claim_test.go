@@ -0,0 +1,58 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/storage"
+)
+
+func TestImportClaims(t *testing.T) {
+	ctx := context.Background()
+	manager := New(ctx, &Options{})
+	now := time.Now().Truncate(time.Second)
+
+	if _, err := manager.ClaimImport(ctx, "shared_metric", "a", now.Add(time.Minute)); err != nil {
+		t.Fatalf("ClaimImport() returned error: %v", err)
+	}
+	if _, err := manager.ClaimImport(ctx, "shared_metric", "b", now.Add(time.Minute)); !errors.Is(err, storage.ErrClaimed) {
+		t.Errorf("expected a claimed metric to be rejected; got %v", err)
+	}
+	// Claims can be renewed by their owner.
+	if _, err := manager.ClaimImport(ctx, "shared_metric", "a", now.Add(-time.Second)); err != nil {
+		t.Errorf("expected claim to be renewed; got %v", err)
+	}
+	// Expired claims can be taken over, and releasing a lost claim still advances the cursor.
+	if _, err := manager.ClaimImport(ctx, "shared_metric", "b", now.Add(time.Minute)); err != nil {
+		t.Errorf("expected an expired claim to be taken over; got %v", err)
+	}
+	if err := manager.ReleaseImport(ctx, "shared_metric", "a", now); !errors.Is(err, storage.ErrClaimed) {
+		t.Errorf("expected releasing a lost claim to fail; got %v", err)
+	}
+	if err := manager.ReleaseImport(ctx, "shared_metric", "b", now.Add(-time.Hour)); err != nil {
+		t.Errorf("ReleaseImport() returned error: %v", err)
+	}
+	cursor, err := manager.ClaimImport(ctx, "shared_metric", "c", now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("expected a released claim to be available; got %v", err)
+	}
+	if !cursor.Equal(now) {
+		t.Errorf("expected cursor %v not to move backwards; got %v", now, cursor)
+	}
+}
@@ -18,6 +18,8 @@ import (
 	"context"
 	"fmt"
 	"github.com/google/ts-bridge/env"
+	"os"
+	"sync"
 
 	"cloud.google.com/go/datastore"
 	"github.com/google/ts-bridge/storage"
@@ -28,14 +30,40 @@ import (
 type Options struct {
 	// Project sets the GCP project to use for communicating to datastore.
 	Project string
+	// EmulatorHost is the address of a local Datastore emulator (e.g. localhost:8081). If it's not set, the
+	// DATASTORE_EMULATOR_HOST environment variable set by `gcloud beta emulators datastore env-init` is used.
+	EmulatorHost string
+	// Namespace is the Datastore namespace metric records are kept in. Defaults to the default namespace.
+	Namespace string
 }
 
+// emulatorProject is the project used with the Datastore emulator if no project is configured. The emulator accepts
+// any project ID.
+const emulatorProject = "ts-bridge-local"
+
 // New initializes the Manager struct implementing a generic storage.Manager interface
 func New(ctx context.Context, options *Options) *Manager {
+	if options.EmulatorHost != "" {
+		// The Datastore client only reads the emulator address from the environment.
+		if err := os.Setenv("DATASTORE_EMULATOR_HOST", options.EmulatorHost); err != nil {
+			log.Fatalf("couldn't set env DATASTORE_EMULATOR_HOST: %v", err)
+		}
+	}
+	emulator := os.Getenv("DATASTORE_EMULATOR_HOST")
+	if emulator != "" {
+		log.Infof("Using Datastore emulator at %v", emulator)
+	}
+
 	if options.Project == "" {
 		if env.IsAppEngine() {
 			options.Project = env.AppEngineProject()
 			log.Infof("No datastore project specified, defaulting to GAE project: %v", options.Project)
+		} else if project := env.Project(); env.IsCloudRun() && project != "" {
+			options.Project = project
+			log.Infof("No datastore project specified, defaulting to Cloud Run project: %v", options.Project)
+		} else if emulator != "" {
+			options.Project = emulatorProject
+			log.Infof("No datastore project specified, defaulting to %v for the emulator", options.Project)
 		} else {
 			log.Fatalf("Could not determine project to use for Datastore, please set DATASTORE_PROJECT or --datastore-project flag")
 		}
@@ -45,14 +73,23 @@ func New(ctx context.Context, options *Options) *Manager {
 	if err != nil {
 		log.Fatalf("could not create datastore client: %v", err)
 	}
-	return &Manager{Client: dsClient}
+	return &Manager{Client: dsClient, Namespace: options.Namespace}
 }
 
-// Manager struct implementing the storage.Manager interface
+// Manager struct implementing the storage.Manager and storage.Batcher interfaces
 type Manager struct {
-	Client *datastore.Client
+	Client    *datastore.Client
+	Namespace string
+
+	// batches is the number of batches in progress, and pending the records written while there are any.
+	mu      sync.Mutex
+	batches int
+	pending map[string]*StoredMetricRecord
 }
 
+// maxBatchPut is the maximum number of entities Datastore accepts in a single batch write.
+const maxBatchPut = 500
+
 // NewMetricRecord returns a Datastore-based metric record for a given metric name.
 func (d *Manager) NewMetricRecord(ctx context.Context, name, query string) (storage.MetricRecord, error) {
 	r := &StoredMetricRecord{Name: name, Storage: d}
@@ -70,7 +107,7 @@ func (d *Manager) CleanupRecords(ctx context.Context, keep []string) error {
 	for _, m := range keep {
 		existing[m] = true
 	}
-	q := datastore.NewQuery(kindName)
+	q := datastore.NewQuery(kindName).Namespace(d.Namespace)
 	var records []*StoredMetricRecord
 	if _, err := d.Client.GetAll(ctx, q, &records); err != nil {
 		return fmt.Errorf("could not list metric records: %v", err)
@@ -83,11 +120,63 @@ func (d *Manager) CleanupRecords(ctx context.Context, keep []string) error {
 			if err != nil {
 				return fmt.Errorf("could not delete metric record %v: %v", r.Name, err)
 			}
+			if err := d.Client.Delete(ctx, d.claimKey(r.Name)); err != nil {
+				return fmt.Errorf("could not delete import claim of %v: %v", r.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// StartBatch defers writes of metric records until FlushBatch is called.
+func (d *Manager) StartBatch() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.batches++
+}
+
+// FlushBatch writes all metric records changed since StartBatch using batch writes.
+func (d *Manager) FlushBatch(ctx context.Context) error {
+	d.mu.Lock()
+	if d.batches > 0 {
+		d.batches--
+	}
+	pending := d.pending
+	d.pending = nil
+	d.mu.Unlock()
+
+	var keys []*datastore.Key
+	var records []*StoredMetricRecord
+	for _, r := range pending {
+		keys = append(keys, r.key(ctx))
+		records = append(records, r)
+	}
+	for start := 0; start < len(keys); start += maxBatchPut {
+		end := start + maxBatchPut
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if _, err := d.Client.PutMulti(ctx, keys[start:end], records[start:end]); err != nil {
+			return fmt.Errorf("could not write %d metric records: %v", end-start, err)
 		}
 	}
 	return nil
 }
 
+// deferWrite keeps a record to be written by FlushBatch, and returns false if no batch is in progress.
+func (d *Manager) deferWrite(r *StoredMetricRecord) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.batches == 0 {
+		return false
+	}
+	if d.pending == nil {
+		d.pending = make(map[string]*StoredMetricRecord)
+	}
+	d.pending[r.Name] = r
+	return true
+}
+
 // Close function exists here for compatibility as Datastore doesn't need to be closed
 func (d *Manager) Close() error {
 	return nil
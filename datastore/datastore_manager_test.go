@@ -16,6 +16,7 @@ package datastore
 
 import (
 	"context"
+	"os"
 	"testing"
 	"time"
 
@@ -58,3 +59,77 @@ func TestCleanupDatastoreMetricRecords(t *testing.T) {
 		t.Errorf("expected metric record for metric1; got %v", records[0])
 	}
 }
+
+func TestDatastoreNamespace(t *testing.T) {
+	ctx := context.Background()
+	defaultManager := New(ctx, &Options{})
+	nsManager := New(ctx, &Options{EmulatorHost: os.Getenv("DATASTORE_EMULATOR_HOST"), Namespace: "integration"})
+
+	for _, m := range []*Manager{defaultManager, nsManager} {
+		r, err := m.NewMetricRecord(ctx, "namespaced_metric", "query")
+		if err != nil {
+			t.Fatalf("error while creating metric record: %v", err)
+		}
+		if err := r.UpdateSuccess(ctx, 1, "OK"); err != nil {
+			t.Fatalf("error while writing metric record: %v", err)
+		}
+	}
+
+	// Cleaning up records in one namespace should not affect records in other namespaces.
+	if err := nsManager.CleanupRecords(ctx, nil); err != nil {
+		t.Errorf("unexpected error from CleanupRecords: %v", err)
+	}
+	for _, tt := range []struct {
+		namespace string
+		want      int
+	}{
+		{"", 1},
+		{"integration", 0},
+	} {
+		q := datastore.NewQuery(kindName).Namespace(tt.namespace).Filter("Name =", "namespaced_metric")
+		var records []*StoredMetricRecord
+		if _, err := defaultManager.Client.GetAll(ctx, q, &records); err != nil {
+			t.Fatalf("error while reading metric records: %v", err)
+		}
+		if len(records) != tt.want {
+			t.Errorf("expected %d records in namespace '%s'; got %d", tt.want, tt.namespace, len(records))
+		}
+	}
+}
+
+func TestDatastoreBatch(t *testing.T) {
+	ctx := context.Background()
+	m := New(ctx, &Options{EmulatorHost: os.Getenv("DATASTORE_EMULATOR_HOST"), Namespace: "batch"})
+
+	m.StartBatch()
+	for _, name := range []string{"batch_metric1", "batch_metric2"} {
+		r, err := m.NewMetricRecord(ctx, name, "query")
+		if err != nil {
+			t.Fatalf("error while creating metric record: %v", err)
+		}
+		if err := r.UpdateSuccess(ctx, 1, "OK"); err != nil {
+			t.Fatalf("error while writing metric record: %v", err)
+		}
+	}
+	count := func() int {
+		n, err := m.Client.Count(ctx, datastore.NewQuery(kindName).Namespace("batch"))
+		if err != nil {
+			t.Fatalf("error while counting metric records: %v", err)
+		}
+		return n
+	}
+
+	// Records are only written once the batch is flushed.
+	if n := count(); n != 0 {
+		t.Errorf("expected no records to be written before the batch is flushed; got %d", n)
+	}
+	if err := m.FlushBatch(ctx); err != nil {
+		t.Fatalf("FlushBatch() returned error: %v", err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("expected 2 records to be written by FlushBatch; got %d", n)
+	}
+	if err := m.CleanupRecords(ctx, nil); err != nil {
+		t.Errorf("unexpected error from CleanupRecords: %v", err)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"cloud.google.com/go/datastore"
 	"context"
 	"fmt"
+	"github.com/google/ts-bridge/storage"
 	log "github.com/sirupsen/logrus"
 	"time"
 )
@@ -36,12 +37,38 @@ type StoredMetricRecord struct {
 	// CounterStartTime is used to keep start timestamp for cumulative metrics.
 	CounterStartTime time.Time
 
+	// MissingPoints is the number of points missing in gaps detected during the last update.
+	MissingPoints int
+
+	// DetectorState is the state of the anomaly detector, if it's enabled for the metric.
+	DetectorState storage.DetectorState
+
+	// ThresholdStreaks is the number of consecutive points that breached each threshold rule of the metric.
+	ThresholdStreaks []int
+
+	// ResumeTime is the timestamp of the latest point written by an update that failed part way, up to which all
+	// points have been written. The next update resumes after it.
+	ResumeTime time.Time
+
+	// PendingWrites are encoded points that could not be written to Stackdriver, which are retried by the next update.
+	PendingWrites []byte `datastore:",noindex"`
+
+	// DailyPoints is the number of points written during the current day, which counts towards daily budgets.
+	DailyPoints storage.DailyPoints
+
+	// ExpressionState is the encoded state of stateful functions of the metric's expression, e.g. previous values
+	// used to calculate rates.
+	ExpressionState []byte `datastore:",noindex"`
+
 	// Storage provides access to
 	Storage *Manager
 }
 
-// Write metric data back to Datastore.
+// Write metric data back to Datastore, or keep it for the current batch.
 func (m *StoredMetricRecord) write(ctx context.Context) error {
+	if m.Storage.deferWrite(m) {
+		return nil
+	}
 	_, err := m.Storage.Client.Put(ctx, m.key(ctx), m)
 	return err
 }
@@ -55,9 +82,11 @@ func (m *StoredMetricRecord) load(ctx context.Context) error {
 	return nil
 }
 
-// key returns the Datastore key for a given metric record.
+// key returns the Datastore key for a given metric record, in the namespace of the storage manager.
 func (m *StoredMetricRecord) key(ctx context.Context) *datastore.Key {
-	return datastore.NameKey(kindName, m.Name, nil)
+	k := datastore.NameKey(kindName, m.Name, nil)
+	k.Namespace = m.Storage.Namespace
+	return k
 }
 
 // GetLastUpdate returns LastUpdate timestamp.
@@ -65,6 +94,16 @@ func (m *StoredMetricRecord) GetLastUpdate() time.Time {
 	return m.LastUpdate
 }
 
+// GetLastAttempt returns LastAttempt timestamp.
+func (m *StoredMetricRecord) GetLastAttempt() time.Time {
+	return m.LastAttempt
+}
+
+// GetLastStatus returns LastStatus.
+func (m *StoredMetricRecord) GetLastStatus() string {
+	return m.LastStatus
+}
+
 // GetCounterStartTime returns CounterStartTime.
 func (m *StoredMetricRecord) GetCounterStartTime() time.Time {
 	return m.CounterStartTime
@@ -76,6 +115,119 @@ func (m *StoredMetricRecord) SetCounterStartTime(ctx context.Context, start time
 	return m.write(ctx)
 }
 
+// GetMissingPoints returns MissingPoints.
+func (m *StoredMetricRecord) GetMissingPoints() int {
+	return m.MissingPoints
+}
+
+// SetMissingPoints sets MissingPoints and persists metric data.
+func (m *StoredMetricRecord) SetMissingPoints(ctx context.Context, missing int) error {
+	m.MissingPoints = missing
+	return m.write(ctx)
+}
+
+// GetDetectorState returns DetectorState.
+func (m *StoredMetricRecord) GetDetectorState() storage.DetectorState {
+	return m.DetectorState
+}
+
+// SetDetectorState sets DetectorState and persists metric data.
+func (m *StoredMetricRecord) SetDetectorState(ctx context.Context, state storage.DetectorState) error {
+	m.DetectorState = state
+	return m.write(ctx)
+}
+
+// GetThresholdStreaks returns ThresholdStreaks.
+func (m *StoredMetricRecord) GetThresholdStreaks() []int {
+	return m.ThresholdStreaks
+}
+
+// SetThresholdStreaks sets ThresholdStreaks and persists metric data.
+func (m *StoredMetricRecord) SetThresholdStreaks(ctx context.Context, streaks []int) error {
+	m.ThresholdStreaks = streaks
+	return m.write(ctx)
+}
+
+// GetResumeTime returns ResumeTime.
+func (m *StoredMetricRecord) GetResumeTime() time.Time {
+	return m.ResumeTime
+}
+
+// SetResumeTime sets ResumeTime and persists metric data.
+func (m *StoredMetricRecord) SetResumeTime(ctx context.Context, resume time.Time) error {
+	m.ResumeTime = resume
+	return m.write(ctx)
+}
+
+// GetPendingWrites returns PendingWrites.
+func (m *StoredMetricRecord) GetPendingWrites() []byte {
+	return m.PendingWrites
+}
+
+// SetPendingWrites sets PendingWrites and persists metric data.
+func (m *StoredMetricRecord) SetPendingWrites(ctx context.Context, pending []byte) error {
+	m.PendingWrites = pending
+	return m.write(ctx)
+}
+
+// GetDailyPoints returns DailyPoints.
+func (m *StoredMetricRecord) GetDailyPoints() storage.DailyPoints {
+	return m.DailyPoints
+}
+
+// SetDailyPoints sets DailyPoints and persists metric data.
+func (m *StoredMetricRecord) SetDailyPoints(ctx context.Context, points storage.DailyPoints) error {
+	m.DailyPoints = points
+	return m.write(ctx)
+}
+
+// GetExpressionState returns ExpressionState.
+func (m *StoredMetricRecord) GetExpressionState() []byte {
+	return m.ExpressionState
+}
+
+// SetExpressionState sets ExpressionState and persists metric data.
+func (m *StoredMetricRecord) SetExpressionState(ctx context.Context, state []byte) error {
+	m.ExpressionState = state
+	return m.write(ctx)
+}
+
+// State returns the current state of the record.
+func (m *StoredMetricRecord) State() storage.RecordState {
+	return storage.RecordState{
+		Name:             m.Name,
+		Query:            m.Query,
+		LastUpdate:       m.LastUpdate,
+		LastAttempt:      m.LastAttempt,
+		LastStatus:       m.LastStatus,
+		CounterStartTime: m.CounterStartTime,
+		MissingPoints:    m.MissingPoints,
+		DetectorState:    m.DetectorState,
+		ThresholdStreaks: m.ThresholdStreaks,
+		ResumeTime:       m.ResumeTime,
+		PendingWrites:    m.PendingWrites,
+		DailyPoints:      m.DailyPoints,
+		ExpressionState:  m.ExpressionState,
+	}
+}
+
+// Restore replaces the state of the record in Datastore, e.g. from a snapshot.
+func (m *StoredMetricRecord) Restore(ctx context.Context, state storage.RecordState) error {
+	m.Query = state.Query
+	m.LastUpdate = state.LastUpdate
+	m.LastAttempt = state.LastAttempt
+	m.LastStatus = state.LastStatus
+	m.CounterStartTime = state.CounterStartTime
+	m.MissingPoints = state.MissingPoints
+	m.DetectorState = state.DetectorState
+	m.ThresholdStreaks = state.ThresholdStreaks
+	m.ResumeTime = state.ResumeTime
+	m.PendingWrites = state.PendingWrites
+	m.DailyPoints = state.DailyPoints
+	m.ExpressionState = state.ExpressionState
+	return m.write(ctx)
+}
+
 // UpdateError updates metric status in Datastore with a given error message.
 func (m *StoredMetricRecord) UpdateError(ctx context.Context, e error) error {
 	log.WithContext(ctx).Errorf("%s: %s", m.Name, e)
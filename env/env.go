@@ -1,6 +1,13 @@
 package env
 
-import "os"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+)
 
 // TODO(temikus): this should really be a standalone lib, something similar to https://github.com/googleapis/google-cloud-ruby/tree/master/google-cloud-env
 
@@ -15,3 +22,49 @@ func IsAppEngine() bool {
 func AppEngineProject() string {
 	return os.Getenv("GOOGLE_CLOUD_PROJECT")
 }
+
+// IsCloudRun checks if the code is running in Cloud Run by checking K_SERVICE variable
+func IsCloudRun() bool {
+	_, set := os.LookupEnv("K_SERVICE")
+	return set
+}
+
+// Project returns the cloud project the app is running in when running in App Engine or Cloud Run, or an empty
+// string otherwise.
+// 	 Note: Cloud Run does not set GOOGLE_CLOUD_PROJECT, so the project is read from the metadata server.
+func Project() string {
+	if p := os.Getenv("GOOGLE_CLOUD_PROJECT"); p != "" {
+		return p
+	}
+	if !IsCloudRun() {
+		return ""
+	}
+	p, err := metadata.ProjectID()
+	if err != nil {
+		return ""
+	}
+	return p
+}
+
+// IsKubernetes checks if the code is running in a Kubernetes pod by checking KUBERNETES_SERVICE_HOST variable
+func IsKubernetes() bool {
+	_, set := os.LookupEnv("KUBERNETES_SERVICE_HOST")
+	return set
+}
+
+// ReadSecretFile returns the contents of a file holding a secret (e.g. a key from a mounted Kubernetes secret),
+// without trailing newlines. Relative paths are resolved relative to `dir`. Paths starting with SecretManagerPrefix
+// are read from Secret Manager instead.
+func ReadSecretFile(dir, path string) (string, error) {
+	if strings.HasPrefix(path, SecretManagerPrefix) {
+		return readSecretManager(path)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
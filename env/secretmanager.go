@@ -0,0 +1,146 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// SecretManagerPrefix marks secret file paths that refer to a Secret Manager secret instead of a local file, e.g.
+// `sm://projects/my-project/secrets/datadog-api-key/versions/latest` or `sm://datadog-api-key`.
+const SecretManagerPrefix = "sm://"
+
+// SecretRefreshInterval is how long secrets read from Secret Manager are cached before being accessed again.
+var SecretRefreshInterval = 5 * time.Minute
+
+// secretTimeout limits the time spent accessing a single secret version.
+const secretTimeout = 30 * time.Second
+
+type cachedSecret struct {
+	value   string
+	fetched time.Time
+}
+
+// Secrets are cached across configuration reloads, since the configuration file is read (and secret files resolved)
+// during each sync. The Secret Manager client is only created once a secret is accessed, so that configurations
+// without Secret Manager references do not require credentials.
+var (
+	secretsMu     sync.Mutex
+	secrets       = make(map[string]cachedSecret)
+	secretService *secretmanager.Service
+	// newSecretService can be replaced in tests.
+	newSecretService = func() (*secretmanager.Service, error) {
+		return secretmanager.NewService(context.Background(), option.WithScopes(secretmanager.CloudPlatformScope))
+	}
+	// secretTimeNow can be replaced in tests.
+	secretTimeNow = time.Now
+)
+
+// FlushSecrets drops all cached Secret Manager secrets, so that they are accessed again when they are next read.
+// It's used to pick up rotated secrets immediately, e.g. after receiving SIGHUP.
+func FlushSecrets() {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	secrets = make(map[string]cachedSecret)
+}
+
+// secretVersionName returns the full resource name of the secret version referenced by a path starting with
+// SecretManagerPrefix. Versions default to `latest`, and secrets given by name only belong to the current project.
+func secretVersionName(path string) (string, error) {
+	name := strings.TrimPrefix(path, SecretManagerPrefix)
+	if name == "" {
+		return "", fmt.Errorf("empty Secret Manager reference %q", path)
+	}
+	if !strings.HasPrefix(name, "projects/") {
+		if strings.Contains(name, "/") {
+			return "", fmt.Errorf("invalid Secret Manager reference %q", path)
+		}
+		project := Project()
+		if project == "" {
+			return "", fmt.Errorf("cannot determine the project of secret %q; use %sprojects/<project>/secrets/%s", name, SecretManagerPrefix, name)
+		}
+		name = fmt.Sprintf("projects/%s/secrets/%s", project, name)
+	}
+	parts := strings.Split(name, "/")
+	switch {
+	case len(parts) == 4 && parts[2] == "secrets":
+		name += "/versions/latest"
+	case len(parts) == 6 && parts[2] == "secrets" && parts[4] == "versions":
+	default:
+		return "", fmt.Errorf("invalid Secret Manager reference %q", path)
+	}
+	return name, nil
+}
+
+// readSecretManager returns the payload of a Secret Manager secret version, without trailing newlines. Payloads are
+// cached for SecretRefreshInterval, and the last known payload keeps being used if accessing the secret fails.
+func readSecretManager(path string) (string, error) {
+	name, err := secretVersionName(path)
+	if err != nil {
+		return "", err
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	cached, ok := secrets[name]
+	if ok && secretTimeNow().Sub(cached.fetched) < SecretRefreshInterval {
+		return cached.value, nil
+	}
+
+	value, err := accessSecret(name)
+	if err != nil {
+		if ok {
+			log.Warnf("Cannot refresh secret %s, using the cached version: %v", name, err)
+			return cached.value, nil
+		}
+		return "", err
+	}
+	secrets[name] = cachedSecret{value: value, fetched: secretTimeNow()}
+	return value, nil
+}
+
+// accessSecret reads a secret version from Secret Manager. It needs to be called with secretsMu held.
+func accessSecret(name string) (string, error) {
+	if secretService == nil {
+		s, err := newSecretService()
+		if err != nil {
+			return "", fmt.Errorf("cannot create Secret Manager client: %v", err)
+		}
+		secretService = s
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	resp, err := secretService.Projects.Secrets.Versions.Access(name).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("cannot access secret %s: %v", name, err)
+	}
+	if resp.Payload == nil {
+		return "", fmt.Errorf("secret %s has no payload", name)
+	}
+	data, err := base64.StdEncoding.DecodeString(resp.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("invalid payload of secret %s: %v", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
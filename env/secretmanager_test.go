@@ -0,0 +1,131 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package env
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+func TestSecretVersionName(t *testing.T) {
+	defer os.Setenv("GOOGLE_CLOUD_PROJECT", os.Getenv("GOOGLE_CLOUD_PROJECT"))
+	os.Setenv("GOOGLE_CLOUD_PROJECT", "my-project")
+
+	for _, tt := range []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "sm://api-key", want: "projects/my-project/secrets/api-key/versions/latest"},
+		{path: "sm://projects/other/secrets/api-key", want: "projects/other/secrets/api-key/versions/latest"},
+		{path: "sm://projects/other/secrets/api-key/versions/3", want: "projects/other/secrets/api-key/versions/3"},
+		{path: "sm://", wantErr: true},
+		{path: "sm://secrets/api-key", wantErr: true},
+		{path: "sm://projects/other/api-key", wantErr: true},
+		{path: "sm://projects/other/secrets/api-key/3", wantErr: true},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := secretVersionName(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("secretVersionName(%q) returned error %v; want error: %v", tt.path, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("secretVersionName(%q) = %q; want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadSecretManager(t *testing.T) {
+	var value atomic.Value
+	value.Store("key-1\n")
+	var fail int32
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/v1/projects/p/secrets/api-key/versions/latest:access" {
+			http.NotFound(w, r)
+			return
+		}
+		if atomic.LoadInt32(&fail) != 0 {
+			http.Error(w, `{"error": {"code": 503, "message": "unavailable"}}`, http.StatusServiceUnavailable)
+			return
+		}
+		data := base64.StdEncoding.EncodeToString([]byte(value.Load().(string)))
+		fmt.Fprintf(w, `{"name": "projects/p/secrets/api-key/versions/2", "payload": {"data": %q}}`, data)
+	}))
+	defer srv.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer func(f func() (*secretmanager.Service, error), g func() time.Time) {
+		newSecretService, secretTimeNow = f, g
+		secretService = nil
+		FlushSecrets()
+	}(newSecretService, secretTimeNow)
+	newSecretService = func() (*secretmanager.Service, error) {
+		return secretmanager.NewService(context.Background(), option.WithEndpoint(srv.URL), option.WithoutAuthentication())
+	}
+	secretTimeNow = func() time.Time { return now }
+	secretService = nil
+	FlushSecrets()
+
+	read := func(want string) {
+		t.Helper()
+		got, err := ReadSecretFile("/ignored", "sm://projects/p/secrets/api-key")
+		if err != nil {
+			t.Fatalf("ReadSecretFile() returned error: %v", err)
+		}
+		if got != want {
+			t.Errorf("ReadSecretFile() = %q; want %q", got, want)
+		}
+	}
+
+	read("key-1")
+	value.Store("key-2")
+	read("key-1")
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("expected cached secret to be used; got %d requests", got)
+	}
+
+	now = now.Add(SecretRefreshInterval)
+	read("key-2")
+
+	value.Store("key-3")
+	FlushSecrets()
+	read("key-3")
+
+	// The cached secret is used if it cannot be refreshed, but not once it's been flushed.
+	atomic.StoreInt32(&fail, 1)
+	now = now.Add(SecretRefreshInterval)
+	read("key-3")
+	FlushSecrets()
+	if _, err := ReadSecretFile("", "sm://projects/p/secrets/api-key"); err == nil {
+		t.Error("expected an error when the secret cannot be accessed")
+	}
+
+	if _, err := ReadSecretFile("", "sm://projects/p/secrets/missing"); err == nil {
+		t.Error("expected an error for a missing secret")
+	}
+}
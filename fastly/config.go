@@ -0,0 +1,110 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fastly
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// Default URLs of the historical stats and real-time analytics APIs, and the default interval of points imported
+// from real-time analytics.
+const (
+	defaultEndpoint         = "https://api.fastly.com"
+	defaultRealtimeEndpoint = "https://rt.fastly.com"
+	defaultInterval         = time.Minute
+)
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Fastly.
+type MetricConfig struct {
+	// Services are the IDs of the queried services.
+	Services []string `validate:"nonzero"`
+	// Metric is the imported value: hit_ratio, requests, hits, misses, errors, status_4xx, status_5xx or bandwidth.
+	Metric string `validate:"regexp=^(hit_ratio|requests|hits|misses|errors|status_4xx|status_5xx|bandwidth)$"`
+	// API selects the historical stats API (the default), which returns stats per minute, or the real-time analytics
+	// API, which returns stats per second for the last two minutes.
+	API string `validate:"regexp=^(historical|realtime)?$"`
+	// Interval is the interval between points imported from real-time analytics, which are aggregated over it.
+	Interval time.Duration
+	// Endpoint overrides the URL of the queried API.
+	Endpoint string
+
+	// APIToken is a Fastly API token with the global:read scope.
+	APIToken string `yaml:"api_token"`
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// The API token can also be read from a file, e.g. from a mounted Kubernetes secret.
+	APITokenFile string `yaml:"api_token_file"`
+}
+
+// ReadSecretFiles sets the API token from the contents of the configured token file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.APITokenFile == "" {
+		return nil
+	}
+	if c.APIToken != "" {
+		return fmt.Errorf("api_token and api_token_file cannot both be set")
+	}
+	token, err := env.ReadSecretFile(dir, c.APITokenFile)
+	if err != nil {
+		return fmt.Errorf("cannot read api_token_file: %v", err)
+	}
+	c.APIToken = token
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if c.APIToken == "" {
+		return fmt.Errorf("api_token or api_token_file needs to be set")
+	}
+	if c.Interval != 0 && !c.realtime() {
+		return fmt.Errorf("interval is only supported for the realtime API")
+	}
+	if c.Interval < 0 || c.Interval%time.Second != 0 || time.Minute%c.interval() != 0 || c.interval() < 10*time.Second {
+		return fmt.Errorf("interval needs to be a number of seconds between 10s and 1m that divides a minute")
+	}
+	return nil
+}
+
+// realtime returns whether the metric is imported from real-time analytics.
+func (c *MetricConfig) realtime() bool {
+	return c.API == "realtime"
+}
+
+// endpoint returns the URL of the queried API.
+func (c *MetricConfig) endpoint() string {
+	switch {
+	case c.Endpoint != "":
+		return strings.TrimSuffix(c.Endpoint, "/")
+	case c.realtime():
+		return defaultRealtimeEndpoint
+	}
+	return defaultEndpoint
+}
+
+// interval returns the interval between points imported from real-time analytics.
+func (c *MetricConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return defaultInterval
+}
@@ -0,0 +1,330 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fastly imports CDN stats of Fastly services from the historical stats and real-time analytics APIs.
+package fastly
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// fields maps metrics to the stats fields they are read from. Both APIs use the same field names.
+var fields = map[string]string{
+	"requests":   "requests",
+	"hits":       "hits",
+	"misses":     "miss",
+	"errors":     "errors",
+	"status_4xx": "status_4xx",
+	"status_5xx": "status_5xx",
+	"bandwidth":  "bandwidth",
+}
+
+// Metric defines a metric imported from Fastly. It implements the SourceMetric interface.
+type Metric struct {
+	Name        string
+	config      *MetricConfig
+	httpClient  *http.Client
+	minPointAge time.Duration
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig, minPointAge time.Duration) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:        name,
+		config:      config,
+		httpClient:  httpClient,
+		minPointAge: minPointAge,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/fastly/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "fastly"
+}
+
+// SourceHost returns the host of the queried API. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.endpoint())
+	if err != nil || u.Host == "" {
+		return m.config.endpoint()
+	}
+	return u.Host
+}
+
+// Query returns the imported value and the services it's queried for.
+func (m *Metric) Query() string {
+	return fmt.Sprintf("%s of services %s", m.config.Metric, strings.Join(m.config.Services, ", "))
+}
+
+// StackdriverData queries Fastly, returning metric descriptor and time series data with points after the given
+// lastPoint timestamp.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	return m.StackdriverDataUntil(ctx, lastPoint, time.Time{}, rec)
+}
+
+// Windowed returns whether the metric can be queried in windows, which is the case for the historical stats API.
+// Real-time analytics only cover the last two minutes.
+func (m *Metric) Windowed() bool {
+	return !m.config.realtime()
+}
+
+// stats are the numeric fields of a stats record.
+type stats map[string]float64
+
+// UnmarshalJSON parses a record, ignoring fields that are not numbers (e.g. the service ID, or histograms).
+func (s *stats) UnmarshalJSON(data []byte) error {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*s = make(stats)
+	for k, v := range fields {
+		if f, ok := v.(float64); ok {
+			(*s)[k] = f
+		}
+	}
+	return nil
+}
+
+// point is a value of a service at the end of an interval.
+type point struct {
+	end   time.Time
+	stats stats
+}
+
+// StackdriverDataUntil works like StackdriverData, but only queries points up to `until`, unless it's zero.
+// Each point is imported at the end of the minute (or, for real-time analytics, the interval) it aggregates.
+func (m *Metric) StackdriverDataUntil(ctx context.Context, lastPoint, until time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	end := timeNow().Add(-m.minPointAge)
+	if !until.IsZero() && until.Before(end) {
+		end = until
+	}
+	if !end.After(lastPoint) {
+		return nil, nil, nil
+	}
+
+	var ts []*monitoringpb.TimeSeries
+	for _, service := range m.config.Services {
+		var points []point
+		var err error
+		if m.config.realtime() {
+			points, err = m.realtime(ctx, service)
+		} else {
+			points, err = m.historical(ctx, service, lastPoint, end)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		log.WithContext(ctx).Debugf("Got %d Fastly points of service %s for %s", len(points), service, m.Name)
+		for _, p := range points {
+			if !p.end.After(lastPoint) || p.end.After(end) {
+				continue
+			}
+			value, ok := m.value(p.stats)
+			if !ok {
+				continue
+			}
+			et, err := ptypes.TimestampProto(p.end)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", p.end, err)
+			}
+			ts = append(ts, &monitoringpb.TimeSeries{
+				Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: map[string]string{"service": service}},
+				Resource:   &monitoredres.MonitoredResource{Type: "global"},
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+				Points: []*monitoringpb.Point{{
+					Interval: &monitoringpb.TimeInterval{EndTime: et},
+					Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+				}},
+			})
+		}
+	}
+	return m.metricDescriptor(), ts, nil
+}
+
+// value returns the value of the configured metric. The hit ratio is computed from hits and misses, so that it's
+// the same for both APIs, and is undefined for intervals without cacheable requests.
+func (m *Metric) value(s stats) (float64, bool) {
+	if m.config.Metric == "hit_ratio" {
+		if s["hits"]+s["miss"] == 0 {
+			return 0, false
+		}
+		return s["hits"] / (s["hits"] + s["miss"]), true
+	}
+	return s[fields[m.config.Metric]], true
+}
+
+// historical returns the stats of a service per minute, for minutes ending in (start, end].
+func (m *Metric) historical(ctx context.Context, service string, start, end time.Time) ([]point, error) {
+	params := url.Values{
+		"from": {fmt.Sprint(start.Truncate(time.Minute).Unix())},
+		"to":   {fmt.Sprint(end.Truncate(time.Minute).Unix())},
+		"by":   {"minute"},
+	}
+	var result struct {
+		Status string  `json:"status"`
+		Data   []stats `json:"data"`
+	}
+	if err := m.get(ctx, fmt.Sprintf("/stats/service/%s?%s", url.PathEscape(service), params.Encode()), &result); err != nil {
+		return nil, err
+	}
+	points := make([]point, 0, len(result.Data))
+	for _, s := range result.Data {
+		points = append(points, point{time.Unix(int64(s["start_time"]), 0).Add(time.Minute), s})
+	}
+	return points, nil
+}
+
+// realtime returns the stats of a service aggregated over intervals, for the intervals of the last two minutes that
+// are covered by real-time analytics.
+func (m *Metric) realtime(ctx context.Context, service string) ([]point, error) {
+	var result struct {
+		Data []struct {
+			Recorded   int64 `json:"recorded"`
+			Aggregated stats `json:"aggregated"`
+		} `json:"Data"`
+		AggregateDelay int64 `json:"AggregateDelay"`
+	}
+	if err := m.get(ctx, fmt.Sprintf("/v1/channel/%s/ts/h", url.PathEscape(service)), &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) == 0 {
+		return nil, nil
+	}
+
+	// Stats of the most recent seconds are incomplete until the aggregate delay has passed.
+	complete := timeNow().Add(-time.Duration(result.AggregateDelay) * time.Second).Unix()
+	first, last := result.Data[0].Recorded, int64(0)
+	buckets := make(map[int64]stats)
+	interval := int64(m.config.interval() / time.Second)
+	for _, d := range result.Data {
+		if d.Recorded >= complete {
+			continue
+		}
+		if d.Recorded < first {
+			first = d.Recorded
+		}
+		if d.Recorded > last {
+			last = d.Recorded
+		}
+		b := d.Recorded - d.Recorded%interval
+		if buckets[b] == nil {
+			buckets[b] = make(stats)
+		}
+		for k, v := range d.Aggregated {
+			buckets[b][k] += v
+		}
+	}
+
+	// Only intervals covered from their first to their last second are imported.
+	var points []point
+	for b, s := range buckets {
+		if b >= first && b+interval-1 <= last {
+			points = append(points, point{time.Unix(b+interval, 0), s})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].end.Before(points[j].end) })
+	return points, nil
+}
+
+// get sends a request to the queried API and parses its JSON response into `result`.
+func (m *Metric) get(ctx context.Context, path string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.config.endpoint()+path, nil)
+	if err != nil {
+		return tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Fastly-Key", m.config.APIToken)
+	req.Header.Set("Accept", "application/json")
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return tserrors.ClassifySource(fmt.Errorf("Fastly query failed: %w", err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return tserrors.ClassifySource(fmt.Errorf("cannot read Fastly response: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("Fastly query returned HTTP status code %d: %s", resp.StatusCode, data))
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("cannot parse Fastly response: %v", err)
+	}
+	return nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric, with a service label.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Fastly %s per minute", m.config.Metric),
+		DisplayName: m.Name,
+		Labels: []*label.LabelDescriptor{{
+			Key:         "service",
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "Fastly service ID",
+		}},
+	}
+	if m.config.realtime() {
+		d.Description = fmt.Sprintf("Fastly %s per %d seconds (real-time analytics)", m.config.Metric, m.config.interval()/time.Second)
+	}
+	switch m.config.Metric {
+	case "bandwidth":
+		d.Unit = "By"
+	case "hit_ratio":
+		d.Unit = "1"
+	}
+	return d
+}
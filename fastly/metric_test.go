@@ -0,0 +1,210 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fastly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	labels map[string]string
+	offset time.Duration // relative to the start of a test.
+	value  float64
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, testPoint{s.Metric.Labels, end.Sub(start), s.Points[0].Value.GetDoubleValue()})
+	}
+	return points
+}
+
+// newTestServer returns an API that responds with the body for the requested path, in which %[n]d is replaced with
+// the Unix time n seconds after `start`. Requested URLs are recorded in `requests`.
+func newTestServer(start time.Time, bodies map[string]string, requests *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Fastly-Key") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"msg": "Provided credentials are missing or invalid"}`)
+			return
+		}
+		*requests = append(*requests, r.URL.RequestURI()+" "+r.Header.Get(requestid.Header))
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		offsets := make([]interface{}, 200)
+		for i := range offsets {
+			offsets[i] = start.Unix() + int64(i)
+		}
+		fmt.Fprintf(w, body, offsets...)
+	}))
+}
+
+func TestStackdriverDataHistorical(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(3*time.Minute + 30*time.Second) }
+
+	var requests []string
+	server := newTestServer(start, map[string]string{
+		"/stats/service/s1": `{"status": "success", "msg": null, "data": [
+			{"service_id": "s1", "start_time": %[1]d, "hits": 3, "miss": 1, "requests": 5},
+			{"service_id": "s1", "start_time": %[61]d, "hits": 0, "miss": 0, "requests": 1},
+			{"service_id": "s1", "start_time": %[121]d, "hits": 9, "miss": 1, "requests": 10}
+		]}`,
+		"/stats/service/s2": `{"status": "success", "msg": null, "data": [{"service_id": "s2", "start_time": %[1]d, "hits": 1, "miss": 1}]}`,
+	}, &requests)
+	defer server.Close()
+
+	m, err := NewSourceMetric("hit_ratio", &MetricConfig{Endpoint: server.URL, Services: []string{"s1", "s2"}, Metric: "hit_ratio", APIToken: "token"}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	params := fmt.Sprintf("?by=minute&from=%d&to=%d req-1", start.Unix(), start.Add(3*time.Minute).Unix())
+	if want := []string{"/stats/service/s1" + params, "/stats/service/s2" + params}; !reflect.DeepEqual(requests, want) {
+		t.Errorf("expected requests %v; got %v", want, requests)
+	}
+	if desc.Type != "custom.googleapis.com/fastly/hit_ratio" || desc.Unit != "1" || len(desc.Labels) != 1 || desc.Labels[0].Key != "service" {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// Points are at the end of each minute, and minutes without hits or misses have no hit ratio.
+	want := []testPoint{
+		{map[string]string{"service": "s1"}, time.Minute, 0.75},
+		{map[string]string{"service": "s1"}, 3 * time.Minute, 0.9},
+		{map[string]string{"service": "s2"}, time.Minute, 0.5},
+	}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataRealtime(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(45 * time.Second) }
+
+	// Seconds 5 to 44 are recorded, and the aggregate delay makes seconds from 40 onwards incomplete.
+	var records []string
+	for i := 5; i < 45; i++ {
+		records = append(records, fmt.Sprintf(`{"recorded": %%[%d]d, "aggregated": {"status_5xx": 1, "miss_histogram": {"10": 1}}}`, i+1))
+	}
+	var requests []string
+	server := newTestServer(start, map[string]string{
+		"/v1/channel/s1/ts/h": fmt.Sprintf(`{"Data": [%s], "Timestamp": %%[46]d, "AggregateDelay": 5}`, strings.Join(records, ",")),
+	}, &requests)
+	defer server.Close()
+
+	m, err := NewSourceMetric("errors", &MetricConfig{
+		Endpoint: server.URL,
+		Services: []string{"s1"},
+		Metric:   "status_5xx",
+		API:      "realtime",
+		Interval: 10 * time.Second,
+		APIToken: "token",
+	}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	if m.Windowed() {
+		t.Errorf("expected real-time metrics not to be windowed")
+	}
+	desc, ts, err := m.StackdriverData(context.Background(), start.Add(-time.Hour), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if len(requests) != 1 || requests[0] != "/v1/channel/s1/ts/h " {
+		t.Errorf("unexpected requests %v", requests)
+	}
+	if !strings.Contains(desc.Description, "per 10 seconds") {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// Partially covered intervals are skipped.
+	s1 := map[string]string{"service": "s1"}
+	want := []testPoint{{s1, 20 * time.Second, 10}, {s1, 30 * time.Second, 10}, {s1, 40 * time.Second, 10}}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		status    int
+		wantClass error
+	}{
+		{"unauthorized", http.StatusUnauthorized, tserrors.ErrSourcePermanent},
+		{"unknown service", http.StatusNotFound, tserrors.ErrSourcePermanent},
+		{"throttled", http.StatusTooManyRequests, tserrors.ErrSourceTransient},
+		{"unavailable", http.StatusServiceUnavailable, tserrors.ErrSourceTransient},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, `{"msg": "error"}`)
+			}))
+			defer server.Close()
+
+			m, err := NewSourceMetric("errors", &MetricConfig{Endpoint: server.URL, Services: []string{"s"}, Metric: "requests", APIToken: "t"}, 0)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, config := range []*MetricConfig{
+		{Services: []string{"s"}, Metric: "requests"},
+		{Services: []string{"s"}, Metric: "requests", APIToken: "t", Interval: 10 * time.Second},
+		{Services: []string{"s"}, Metric: "requests", APIToken: "t", API: "realtime", Interval: 5 * time.Second},
+		{Services: []string{"s"}, Metric: "requests", APIToken: "t", API: "realtime", Interval: 25 * time.Second},
+		{Services: []string{"s"}, Metric: "requests", APIToken: "t", API: "realtime", Interval: 2 * time.Minute},
+	} {
+		if _, err := NewSourceMetric("invalid", config, 0); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+)
+
+const (
+	defaultTimeout = 30 * time.Second
+	defaultRegion  = "us-east-1"
+)
+
+// MetricConfig defines the configuration file parameters for a specific metric checking files in buckets or on
+// FTP or SFTP servers.
+type MetricConfig struct {
+	// Paths lists gs://, s3://, ftp:// or sftp:// URLs of checked files, or of directories if they end with a slash.
+	Paths []string `validate:"nonzero"`
+	// Pattern is an optional shell pattern (e.g. `export-*.csv`) that names of files in directories need to match.
+	Pattern string
+	// Value is `age` (the default), the time since the newest file was modified in seconds, `size`, the size of
+	// the newest file in bytes, or `count`, the number of files.
+	Value string `validate:"regexp=^(|age|size|count)$"`
+	// Timeout limits the time taken to check each path.
+	Timeout time.Duration
+
+	// Region and Endpoint of S3 buckets. The endpoint can point to S3-compatible storage, e.g. MinIO.
+	Region   string
+	Endpoint string
+	// AccessKeyID and SecretAccessKey are credentials of S3 buckets. By default, credentials are read from the
+	// environment, shared credentials files or the instance role.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+
+	// Username and Password of FTP and SFTP servers. FTP servers are logged into anonymously by default, and SFTP
+	// servers as the user running ts-bridge.
+	Username string
+	Password string
+	// TLS enables explicit FTPS, trusting certificates signed by the CAs in CAFile in addition to system CAs.
+	TLS    bool
+	CAFile string `yaml:"ca_file"`
+	// KnownHostsFile lists host keys of SFTP servers in the OpenSSH known_hosts format, ~/.ssh/known_hosts by
+	// default. Servers whose host key is not listed are not connected to.
+	KnownHostsFile string `yaml:"known_hosts_file"`
+	// IdentityFile is a private key logging into SFTP servers, which is used instead of the password.
+	IdentityFile string `yaml:"identity_file"`
+
+	// Secrets can also be read from files, e.g. from a mounted Kubernetes secret.
+	SecretAccessKeyFile string `yaml:"secret_access_key_file"`
+	PasswordFile        string `yaml:"password_file"`
+}
+
+// ReadSecretFiles sets the S3 secret access key and the FTP or SFTP password from the contents of the configured files.
+// Relative paths are resolved relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.SecretAccessKeyFile != "" {
+		if c.SecretAccessKey != "" {
+			return fmt.Errorf("secret_access_key and secret_access_key_file cannot both be set")
+		}
+		key, err := env.ReadSecretFile(dir, c.SecretAccessKeyFile)
+		if err != nil {
+			return fmt.Errorf("cannot read secret_access_key_file: %v", err)
+		}
+		c.SecretAccessKey = key
+	}
+	if c.PasswordFile != "" {
+		if c.Password != "" {
+			return fmt.Errorf("password and password_file cannot both be set")
+		}
+		password, err := env.ReadSecretFile(dir, c.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("cannot read password_file: %v", err)
+		}
+		c.Password = password
+	}
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	schemes := map[string]bool{}
+	for _, p := range c.Paths {
+		u, err := url.Parse(p)
+		if err != nil {
+			return fmt.Errorf("invalid path %q: %v", p, err)
+		}
+		switch u.Scheme {
+		case "gs", "s3":
+			if u.Host == "" || u.Path == "" {
+				return fmt.Errorf("path %q needs to include a bucket and an object name or directory", p)
+			}
+		case "ftp", "sftp":
+			if u.Host == "" || u.Path == "" {
+				return fmt.Errorf("path %q needs to include a host and a path", p)
+			}
+			if u.User != nil {
+				return fmt.Errorf("path %q cannot include credentials, which are set using username and password", p)
+			}
+			if strings.HasPrefix(u.Host, "-") {
+				return fmt.Errorf("path %q has an invalid host", p)
+			}
+		default:
+			return fmt.Errorf("path %q is not a gs://, s3://, ftp:// or sftp:// URL", p)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("path %q cannot have a query or fragment", p)
+		}
+		schemes[u.Scheme] = true
+	}
+	if _, err := path.Match(c.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", c.Pattern, err)
+	}
+	if c.Pattern != "" {
+		for _, p := range c.Paths {
+			if !strings.HasSuffix(p, "/") {
+				return fmt.Errorf("pattern requires directory paths ending with a slash, not %q", p)
+			}
+		}
+	}
+	if !schemes["s3"] && (c.Region != "" || c.Endpoint != "" || c.AccessKeyID != "" || c.SecretAccessKey != "") {
+		return fmt.Errorf("region, endpoint, access_key_id and secret_access_key are only supported for s3:// paths")
+	}
+	if (c.AccessKeyID == "") != (c.SecretAccessKey == "") {
+		return fmt.Errorf("access_key_id and secret_access_key need to be set together")
+	}
+	if !schemes["ftp"] && !schemes["sftp"] && (c.Username != "" || c.Password != "") {
+		return fmt.Errorf("username and password are only supported for ftp:// and sftp:// paths")
+	}
+	if !schemes["ftp"] && (c.TLS || c.CAFile != "") {
+		return fmt.Errorf("tls and ca_file are only supported for ftp:// paths")
+	}
+	if !schemes["sftp"] && (c.KnownHostsFile != "" || c.IdentityFile != "") {
+		return fmt.Errorf("known_hosts_file and identity_file are only supported for sftp:// paths")
+	}
+	if c.CAFile != "" && !c.TLS {
+		return fmt.Errorf("ca_file requires `tls: true`")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout cannot be negative")
+	}
+	return nil
+}
+
+func (c *MetricConfig) value() string {
+	if c.Value == "" {
+		return "age"
+	}
+	return c.Value
+}
+
+func (c *MetricConfig) region() string {
+	if c.Region == "" {
+		return defaultRegion
+	}
+	return c.Region
+}
+
+func (c *MetricConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
@@ -0,0 +1,395 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+// Only the subset of FTP needed to read modification times and sizes of files is implemented, which avoids
+// depending on a client library for a single source: explicit TLS (RFC 4217), extended passive mode (RFC 2428),
+// and MLSD, MDTM and SIZE (RFC 3659). See https://www.rfc-editor.org/rfc/rfc959 and
+// https://www.rfc-editor.org/rfc/rfc3659.
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/tserrors"
+)
+
+// ftpTimeLayout is the layout of modification times of MDTM and MLSD, which are in UTC and may be followed by
+// fractions of a second.
+const ftpTimeLayout = "20060102150405"
+
+// ftpError is a negative reply of an FTP server.
+type ftpError struct {
+	code int
+	msg  string
+}
+
+func (e *ftpError) Error() string {
+	return fmt.Sprintf("%d %s", e.code, e.msg)
+}
+
+// classify classifies a reply: transient negative replies (4xx) are worth retrying, and permanent ones (5xx) such
+// as a failed login or a missing file are not.
+func (e *ftpError) classify() error {
+	if e.code < 500 {
+		return tserrors.Wrap(tserrors.ErrSourceTransient, e)
+	}
+	return tserrors.Wrap(tserrors.ErrSourcePermanent, e)
+}
+
+// ftpConn is a logged in control connection to an FTP server.
+type ftpConn struct {
+	ctx  context.Context
+	conn net.Conn
+	r    *bufio.Reader
+	host string
+	// tlsConfig is used for data connections of FTPS, sharing a session cache with the control connection as
+	// many servers require data connections to resume its TLS session.
+	tlsConfig *tls.Config
+}
+
+// listFTP returns the file at a path of an FTP server, or the files in a directory whose names are matched by
+// `match`. Sizes and modification times of files are listed using MLSD, or read using MDTM and SIZE from servers
+// that do not support MLSD.
+func listFTP(ctx context.Context, config *MetricConfig, tlsConfig *tls.Config, hostPort, p string, match func(string) bool) ([]file, error) {
+	files, err := func() ([]file, error) {
+		c, err := dialFTP(ctx, config, tlsConfig, hostPort)
+		if err != nil {
+			return nil, err
+		}
+		defer c.close()
+		if !strings.HasSuffix(p, "/") {
+			f, err := c.stat(p)
+			if err != nil {
+				return nil, err
+			}
+			return []file{f}, nil
+		}
+		files, err := c.mlsd(p)
+		var fe *ftpError
+		if errors.As(err, &fe) && fe.code >= 500 && fe.code <= 502 {
+			// MLSD is not implemented, e.g. by vsftpd.
+			files, err = c.statDir(p, match)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var matched []file
+		for _, f := range files {
+			if match(f.name) {
+				matched = append(matched, f)
+			}
+		}
+		return matched, nil
+	}()
+	if err != nil {
+		var fe *ftpError
+		if errors.As(err, &fe) {
+			return nil, fmt.Errorf("listing %s on FTP server %s failed: %w", p, hostPort, fe.classify())
+		}
+		return nil, tserrors.ClassifySource(fmt.Errorf("listing %s on FTP server %s failed: %w", p, hostPort, err))
+	}
+	return files, nil
+}
+
+// dialFTP connects to an FTP server, upgrading the control connection to TLS if configured, and logs in.
+func dialFTP(ctx context.Context, config *MetricConfig, tlsConfig *tls.Config, hostPort string) (*ftpConn, error) {
+	if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(hostPort, "21")
+	}
+	host, _, _ := net.SplitHostPort(hostPort)
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	c := &ftpConn{ctx: ctx, conn: nc, r: bufio.NewReader(nc), host: host}
+	if err := c.expect(220, ""); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		if err := c.expect(234, "AUTH TLS"); err != nil {
+			c.close()
+			return nil, err
+		}
+		c.tlsConfig = tlsConfig.Clone()
+		c.tlsConfig.ServerName = host
+		c.tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+		tc := tls.Client(nc, c.tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		c.conn, c.r = tc, bufio.NewReader(tc)
+		if err := c.expect(200, "PBSZ 0"); err != nil {
+			c.close()
+			return nil, err
+		}
+		if err := c.expect(200, "PROT P"); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	username, password := config.Username, config.Password
+	if username == "" {
+		username, password = "anonymous", "anonymous@"
+	}
+	code, _, err := c.cmd("USER " + username)
+	if err == nil && code == 331 {
+		err = c.expect(230, "PASS "+password)
+	} else if err == nil && code != 230 {
+		err = fmt.Errorf("unexpected reply %d to USER", code)
+	}
+	if err == nil {
+		// Sizes of files are only defined in binary mode.
+		err = c.expect(200, "TYPE I")
+	}
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// cmd sends a command and reads the reply to it, returning negative replies as errors. Without a command, only a
+// reply is read.
+func (c *ftpConn) cmd(command string) (int, string, error) {
+	if command != "" {
+		if _, err := fmt.Fprintf(c.conn, "%s\r\n", command); err != nil {
+			return 0, "", err
+		}
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return 0, "", err
+	}
+	if len(line) < 4 {
+		return 0, "", fmt.Errorf("invalid reply %q", line)
+	}
+	code, err := strconv.Atoi(line[:3])
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid reply %q", line)
+	}
+	msg := strings.TrimRight(line[4:], "\r\n")
+	// Lines of multi-line replies follow until a line starting with the code and a space.
+	last := line[:3] + " "
+	for line[3] == '-' {
+		if line, err = c.r.ReadString('\n'); err != nil {
+			return 0, "", err
+		}
+		if strings.HasPrefix(line, last) {
+			break
+		}
+		msg += "\n" + strings.TrimRight(line, "\r\n")
+	}
+	if code >= 400 {
+		return code, msg, &ftpError{code: code, msg: msg}
+	}
+	return code, msg, nil
+}
+
+// expect sends a command, returning an error unless the reply has the expected code.
+func (c *ftpConn) expect(want int, command string) error {
+	code, msg, err := c.cmd(command)
+	if err != nil {
+		return err
+	}
+	if code != want {
+		// Commands are not included in errors, as they may include passwords.
+		return fmt.Errorf("unexpected reply %d %s", code, msg)
+	}
+	return nil
+}
+
+// stat reads the modification time and size of a file.
+func (c *ftpConn) stat(name string) (file, error) {
+	f := file{name: name}
+	code, msg, err := c.cmd("MDTM " + name)
+	if err != nil {
+		return f, err
+	}
+	if code != 213 {
+		return f, fmt.Errorf("unexpected reply %d %s to MDTM", code, msg)
+	}
+	if f.modified, err = parseFTPTime(msg); err != nil {
+		return f, err
+	}
+	code, msg, err = c.cmd("SIZE " + name)
+	if err != nil {
+		return f, err
+	}
+	if code != 213 {
+		return f, fmt.Errorf("unexpected reply %d %s to SIZE", code, msg)
+	}
+	if f.size, err = strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err != nil {
+		return f, fmt.Errorf("invalid size %q of %s", msg, name)
+	}
+	return f, nil
+}
+
+// mlsd lists the files in a directory with their modification times and sizes, skipping other entries such as
+// subdirectories.
+func (c *ftpConn) mlsd(dir string) ([]file, error) {
+	lines, err := c.transfer("MLSD " + dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []file
+	for _, line := range lines {
+		// Each line has facts such as `type=file;size=1024;modify=20240101020304;`, a space, and the name.
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid MLSD entry %q", line)
+		}
+		f := file{name: path.Join(dir, line[i+1:])}
+		facts := map[string]string{}
+		for _, fact := range strings.Split(line[:i], ";") {
+			if kv := strings.SplitN(fact, "=", 2); len(kv) == 2 {
+				facts[strings.ToLower(kv[0])] = kv[1]
+			}
+		}
+		if strings.ToLower(facts["type"]) != "file" {
+			continue
+		}
+		if f.modified, err = parseFTPTime(facts["modify"]); err != nil {
+			return nil, err
+		}
+		if f.size, err = strconv.ParseInt(facts["size"], 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid size %q of %s", facts["size"], f.name)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// statDir reads modification times and sizes of the files in a directory whose names are matched by `match`,
+// using NLST to list the names of entries of the directory.
+func (c *ftpConn) statDir(dir string, match func(string) bool) ([]file, error) {
+	names, err := c.transfer("NLST " + dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []file
+	for _, name := range names {
+		// Names are listed relative to the directory, or as paths by some servers.
+		name = path.Join(dir, path.Base(name))
+		if !match(name) {
+			continue
+		}
+		f, err := c.stat(name)
+		var fe *ftpError
+		if errors.As(err, &fe) && fe.code == 550 {
+			// Subdirectories have no modification time or size.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// transfer runs a command whose response is sent over a passive data connection, returning its lines.
+func (c *ftpConn) transfer(command string) ([]string, error) {
+	data, err := c.passive()
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	code, msg, err := c.cmd(command)
+	if err != nil {
+		return nil, err
+	}
+	if code != 125 && code != 150 {
+		return nil, fmt.Errorf("unexpected reply %d %s", code, msg)
+	}
+	var lines []string
+	s := bufio.NewScanner(data)
+	for s.Scan() {
+		if line := strings.TrimRight(s.Text(), "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if code, msg, err = c.cmd(""); err != nil {
+		return nil, err
+	}
+	if code != 226 && code != 250 {
+		return nil, fmt.Errorf("unexpected reply %d %s", code, msg)
+	}
+	return lines, nil
+}
+
+// passive opens a data connection using extended passive mode, which works through NAT and with IPv6.
+func (c *ftpConn) passive() (net.Conn, error) {
+	code, msg, err := c.cmd("EPSV")
+	if err != nil {
+		return nil, err
+	}
+	// The reply is e.g. `229 Entering Extended Passive Mode (|||6446|)`.
+	start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+	if code != 229 || start < 0 || end < start+4 {
+		return nil, fmt.Errorf("unexpected reply %d %s to EPSV", code, msg)
+	}
+	port := msg[start+4 : end]
+	var d net.Dialer
+	nc, err := d.DialContext(c.ctx, "tcp", net.JoinHostPort(c.host, port))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := c.ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	if c.tlsConfig != nil {
+		return tls.Client(nc, c.tlsConfig), nil
+	}
+	return nc, nil
+}
+
+// close logs out and closes the control connection.
+func (c *ftpConn) close() {
+	c.cmd("QUIT")
+	c.conn.Close()
+}
+
+// parseFTPTime parses a modification time of MDTM or MLSD.
+func parseFTPTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		s = s[:i]
+	}
+	t, err := time.Parse(ftpTimeLayout, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid modification time %q", s)
+	}
+	return t, nil
+}
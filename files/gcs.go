@@ -0,0 +1,87 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/ts-bridge/tserrors"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	gcs "google.golang.org/api/storage/v1"
+)
+
+// All metrics share a single Cloud Storage client, which is only created once a bucket is listed, so that loading
+// the configuration file does not require credentials.
+var (
+	gcsMu      sync.Mutex
+	gcsService *gcs.Service
+	// newGCSService can be replaced in tests.
+	newGCSService = func() (*gcs.Service, error) {
+		return gcs.NewService(context.Background(), option.WithScopes(gcs.DevstorageReadOnlyScope))
+	}
+)
+
+// getGCSService returns the shared client, creating it if necessary.
+func getGCSService() (*gcs.Service, error) {
+	gcsMu.Lock()
+	defer gcsMu.Unlock()
+	if gcsService == nil {
+		s, err := newGCSService()
+		if err != nil {
+			return nil, err
+		}
+		gcsService = s
+	}
+	return gcsService, nil
+}
+
+// listGCS lists objects of a Cloud Storage bucket whose names start with a prefix. With `dir`, objects in
+// subdirectories of the prefix are not listed.
+func listGCS(ctx context.Context, bucket, prefix string, dir bool) ([]file, error) {
+	s, err := getGCSService()
+	if err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("cannot create Cloud Storage client: %v", err))
+	}
+	call := s.Objects.List(bucket).Prefix(prefix).Fields("nextPageToken", "items(name,size,updated)")
+	if dir {
+		call = call.Delimiter("/")
+	}
+	var files []file
+	err = call.Pages(ctx, func(objects *gcs.Objects) error {
+		for _, o := range objects.Items {
+			updated, err := time.Parse(time.RFC3339, o.Updated)
+			if err != nil {
+				return fmt.Errorf("invalid update time of object %s: %v", o.Name, err)
+			}
+			files = append(files, file{name: o.Name, modified: updated, size: int64(o.Size)})
+		}
+		return nil
+	})
+	if err != nil {
+		err = fmt.Errorf("listing objects of bucket %s failed: %w", bucket, err)
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) {
+			return nil, tserrors.FromHTTPStatus(apiErr.Code, err)
+		}
+		return nil, tserrors.ClassifySource(err)
+	}
+	return files, nil
+}
@@ -0,0 +1,273 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package files checks the age, size or number of files in Cloud Storage buckets, S3 buckets or on FTP or SFTP
+// servers, e.g. to detect that a nightly batch file has not arrived.
+package files
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/ts-bridge/httpclient"
+	"github.com/google/ts-bridge/storage"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a metric checking files. It implements the SourceMetric interface.
+type Metric struct {
+	Name   string
+	config *MetricConfig
+	// s3Client is only set with s3:// paths, and tlsConfig only with FTPS.
+	s3Client  *s3.S3
+	tlsConfig *tls.Config
+}
+
+// file is a file found at a checked path.
+type file struct {
+	name     string
+	modified time.Time
+	size     int64
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	m := &Metric{Name: name, config: config}
+	for _, p := range config.Paths {
+		if strings.HasPrefix(p, "s3://") {
+			c, err := newS3Client(config)
+			if err != nil {
+				return nil, fmt.Errorf("invalid S3 settings for metric %s: %v", name, err)
+			}
+			m.s3Client = c
+			break
+		}
+	}
+	if config.TLS {
+		tlsConfig, err := (&httpclient.Config{CAFile: config.CAFile}).TLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS settings for metric %s: %v", name, err)
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		m.tlsConfig = tlsConfig
+	}
+	return m, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/files/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "files"
+}
+
+// SourceHost returns the bucket or server of the first path. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.Paths[0])
+	if err != nil {
+		return m.config.Paths[0]
+	}
+	return u.Host
+}
+
+// Query returns the checked paths, and the pattern if configured.
+func (m *Metric) Query() string {
+	q := strings.Join(m.config.Paths, ", ")
+	if m.config.Pattern != "" {
+		q += " matching " + m.config.Pattern
+	}
+	return q
+}
+
+// StackdriverData checks all paths concurrently, returning metric descriptor and a time series per path with the
+// current age, size or number of files. A single point is imported per sync. Paths that cannot be checked are
+// skipped, unless all of them fail.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	now := timeNow().Truncate(time.Second)
+	if !now.After(lastPoint) {
+		return nil, nil, nil
+	}
+	end, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", now, err)
+	}
+
+	files := make([][]file, len(m.config.Paths))
+	errs := make([]error, len(m.config.Paths))
+	var wg sync.WaitGroup
+	for i, p := range m.config.Paths {
+		wg.Add(1)
+		go func(i int, p string) {
+			defer wg.Done()
+			files[i], errs[i] = m.list(ctx, p)
+		}(i, p)
+	}
+	wg.Wait()
+
+	var ts []*monitoringpb.TimeSeries
+	var failed int
+	for i, p := range m.config.Paths {
+		if errs[i] != nil {
+			log.WithContext(ctx).Warningf("Skipping path %s of metric %s: %v", p, m.Name, errs[i])
+			failed++
+			continue
+		}
+		value, ok := m.value(files[i], now)
+		if !ok {
+			log.WithContext(ctx).Infof("No files found at %s for metric %s", p, m.Name)
+			continue
+		}
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: map[string]string{"path": p}},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: end},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+			}},
+		})
+	}
+	if failed == len(m.config.Paths) {
+		return nil, nil, fmt.Errorf("all %d paths failed, e.g. %s: %w", failed, m.config.Paths[0], errs[0])
+	}
+	log.WithContext(ctx).Debugf("Checked files at %s (%d paths failed)", m.Query(), failed)
+	return m.metricDescriptor(), ts, nil
+}
+
+// list returns the files at a path: the file itself, or the files in a directory (not including subdirectories)
+// whose names match the pattern.
+func (m *Metric) list(ctx context.Context, p string) ([]file, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.config.timeout())
+	defer cancel()
+	u, err := url.Parse(p)
+	if err != nil {
+		return nil, err
+	}
+	dir := strings.HasSuffix(u.Path, "/")
+	match := func(name string) bool {
+		if !dir || m.config.Pattern == "" {
+			return true
+		}
+		ok, _ := path.Match(m.config.Pattern, path.Base(name))
+		return ok
+	}
+
+	var files []file
+	switch u.Scheme {
+	case "gs", "s3":
+		prefix := strings.TrimPrefix(u.Path, "/")
+		var objects []file
+		if u.Scheme == "gs" {
+			objects, err = listGCS(ctx, u.Host, prefix, dir)
+		} else {
+			objects, err = listS3(ctx, m.s3Client, u.Host, prefix, dir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Listings return all objects whose names start with the prefix, including placeholders of directories,
+		// whose names end with a slash.
+		for _, o := range objects {
+			if dir && !strings.HasSuffix(o.name, "/") && match(o.name) || !dir && o.name == prefix {
+				files = append(files, o)
+			}
+		}
+	case "ftp":
+		files, err = listFTP(ctx, m.config, m.tlsConfig, u.Host, u.Path, match)
+		if err != nil {
+			return nil, err
+		}
+	case "sftp":
+		files, err = listSFTP(ctx, m.config, u.Host, u.Path, match)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// value returns the imported value for the files at a path, or false if there is no value, e.g. the age of the
+// newest file of an empty directory.
+func (m *Metric) value(files []file, now time.Time) (float64, bool) {
+	if m.config.value() == "count" {
+		return float64(len(files)), true
+	}
+	if len(files) == 0 {
+		return 0, false
+	}
+	newest := files[0]
+	for _, f := range files[1:] {
+		if f.modified.After(newest.modified) {
+			newest = f
+		}
+	}
+	if m.config.value() == "size" {
+		return float64(newest.size), true
+	}
+	// Clocks of file servers can be ahead, but files are not modified in the future.
+	age := now.Sub(newest.modified).Seconds()
+	if age < 0 {
+		age = 0
+	}
+	return age, true
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		DisplayName: m.Name,
+		Labels: []*label.LabelDescriptor{
+			{Key: "path", ValueType: label.LabelDescriptor_STRING, Description: "Checked file or directory"},
+		},
+	}
+	switch m.config.value() {
+	case "age":
+		d.Description = fmt.Sprintf("Time since the newest file at %s was modified", m.Query())
+		d.Unit = "s"
+	case "size":
+		d.Description = fmt.Sprintf("Size of the newest file at %s", m.Query())
+		d.Unit = "By"
+	case "count":
+		d.Description = fmt.Sprintf("Number of files at %s", m.Query())
+	}
+	return d
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// newS3Client creates an S3 client for the configured region and endpoint. Without configured credentials, the
+// default credential chain of the AWS SDK is used when a bucket is listed.
+func newS3Client(c *MetricConfig) (*s3.S3, error) {
+	config := aws.NewConfig().WithRegion(c.region())
+	if c.Endpoint != "" {
+		// S3-compatible storage usually does not support virtual-hosted buckets.
+		config = config.WithEndpoint(c.Endpoint).WithS3ForcePathStyle(true)
+	}
+	if c.AccessKeyID != "" {
+		config = config.WithCredentials(credentials.NewStaticCredentials(c.AccessKeyID, c.SecretAccessKey, ""))
+	}
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+// listS3 lists objects of an S3 bucket whose names start with a prefix. With `dir`, objects in subdirectories of
+// the prefix are not listed.
+func listS3(ctx context.Context, client *s3.S3, bucket, prefix string, dir bool) ([]file, error) {
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket), Prefix: aws.String(prefix)}
+	if dir {
+		input.Delimiter = aws.String("/")
+	}
+	var files []file
+	err := client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, o := range page.Contents {
+			files = append(files, file{name: aws.StringValue(o.Key), modified: aws.TimeValue(o.LastModified), size: aws.Int64Value(o.Size)})
+		}
+		return true
+	})
+	if err != nil {
+		err = fmt.Errorf("listing objects of bucket %s failed: %w", bucket, err)
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) && reqErr.StatusCode() != 0 {
+			return nil, tserrors.FromHTTPStatus(reqErr.StatusCode(), err)
+		}
+		// Errors of the SDK do not unwrap their cause, e.g. a network error.
+		var sdkErr awserr.Error
+		if errors.As(err, &sdkErr) && sdkErr.OrigErr() != nil {
+			return nil, tserrors.ClassifySource(fmt.Errorf("listing objects of bucket %s failed: %w", bucket, sdkErr.OrigErr()))
+		}
+		return nil, tserrors.ClassifySource(err)
+	}
+	return files, nil
+}
@@ -0,0 +1,503 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package files
+
+// SSH connections to SFTP servers are made by the OpenSSH client, like sftp(1) does, so that host keys are checked
+// against known hosts and logins use keys or passwords without ts-bridge implementing SSH. Only the subset of SFTP
+// version 3 needed to read modification times and sizes of files is implemented on top of it: STAT, OPENDIR, READDIR
+// and CLOSE. See https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/ts-bridge/tserrors"
+)
+
+// Types of SFTP packets.
+const (
+	sftpInit    = 1
+	sftpVersion = 2
+	sftpClose   = 4
+	sftpOpenDir = 11
+	sftpReadDir = 12
+	sftpStat    = 17
+	sftpStatus  = 101
+	sftpHandle  = 102
+	sftpName    = 104
+	sftpAttrs   = 105
+)
+
+// Status codes of SFTP replies.
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpOpUnsupported    = 8
+)
+
+// sftpStatusMessages describe status codes in errors if servers do not.
+var sftpStatusMessages = map[uint32]string{
+	sftpEOF:              "end of file",
+	sftpNoSuchFile:       "no such file",
+	sftpPermissionDenied: "permission denied",
+	sftpOpUnsupported:    "operation unsupported",
+}
+
+// Flags of attributes present in SFTP replies.
+const (
+	sftpAttrSize        = 0x1
+	sftpAttrUIDGID      = 0x2
+	sftpAttrPermissions = 0x4
+	sftpAttrModTime     = 0x8
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	// sftpMaxPacket limits the size of replies, which are much smaller for the requests sent. OpenSSH servers send
+	// up to 256KiB.
+	sftpMaxPacket = 1 << 20
+	// modeType masks the type of a file in permissions, and modeRegular is the type of regular files.
+	modeType    = 0170000
+	modeRegular = 0100000
+	// sshPasswordEnv is the environment variable passing the password to the askpass script.
+	sshPasswordEnv = "TS_BRIDGE_SFTP_PASSWORD"
+)
+
+// sshCommand creates the command running the OpenSSH client. It's replaced by a fake SFTP server in tests.
+var sshCommand = func(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, "ssh", args...)
+}
+
+// askpass is a script printing the password passed in its environment, which the OpenSSH client runs instead of
+// prompting for a password. It's written once, on the first login with a password.
+var askpass struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+// sshPermanentErrors are messages of the OpenSSH client about failures that need intervention, e.g. an unknown host
+// key or wrong credentials. Other failures, e.g. refused connections, are likely to go away on their own.
+var sshPermanentErrors = []string{"Permission denied", "Host key verification failed", "subsystem request failed"}
+
+// sftpError is a status replied by an SFTP server.
+type sftpError struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftpError) Error() string {
+	if e.msg == "" {
+		if msg, ok := sftpStatusMessages[e.code]; ok {
+			return msg
+		}
+	}
+	return fmt.Sprintf("status %d %s", e.code, e.msg)
+}
+
+// classify classifies a status: missing files, denied access and unsupported operations are not worth retrying.
+func (e *sftpError) classify() error {
+	switch e.code {
+	case sftpNoSuchFile, sftpPermissionDenied, sftpOpUnsupported:
+		return tserrors.Wrap(tserrors.ErrSourcePermanent, e)
+	}
+	return tserrors.Wrap(tserrors.ErrSourceTransient, e)
+}
+
+// sftpConn is an SFTP session over the standard input and output of the OpenSSH client.
+type sftpConn struct {
+	cmd    *exec.Cmd
+	w      io.WriteCloser
+	r      *bufio.Reader
+	stderr bytes.Buffer
+	id     uint32
+}
+
+// listSFTP returns the file at a path of an SFTP server, or the files in a directory whose names are matched by
+// `match`.
+func listSFTP(ctx context.Context, config *MetricConfig, hostPort, p string, match func(string) bool) ([]file, error) {
+	c, err := dialSFTP(ctx, config, hostPort)
+	if err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("cannot connect to SFTP server %s: %v", hostPort, err))
+	}
+	files, err := func() ([]file, error) {
+		if err := c.init(); err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(p, "/") {
+			f, err := c.stat(p)
+			if err != nil {
+				return nil, err
+			}
+			return []file{f}, nil
+		}
+		return c.readDir(p, match)
+	}()
+	stderr := c.close()
+	if err != nil {
+		var se *sftpError
+		if errors.As(err, &se) {
+			return nil, fmt.Errorf("listing %s on SFTP server %s failed: %w", p, hostPort, se.classify())
+		}
+		if ctx.Err() != nil {
+			return nil, tserrors.ClassifySource(fmt.Errorf("listing %s on SFTP server %s failed: %w", p, hostPort, ctx.Err()))
+		}
+		// Failures of the SSH connection are only explained by messages of the OpenSSH client, while reading its
+		// output just fails.
+		if stderr != "" {
+			err = errors.New(strings.Replace(stderr, "\n", "; ", -1))
+		}
+		err = fmt.Errorf("listing %s on SFTP server %s failed: %w", p, hostPort, err)
+		for _, msg := range sshPermanentErrors {
+			if strings.Contains(stderr, msg) {
+				return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+			}
+		}
+		return nil, tserrors.Wrap(tserrors.ErrSourceTransient, err)
+	}
+	return files, nil
+}
+
+// dialSFTP starts the OpenSSH client, which connects to the SFTP server and logs in. Host keys are always checked,
+// so servers need to be listed in known hosts. The private key is used to log in if configured, and the password
+// otherwise. Without either of them, default keys of the OpenSSH client and the SSH agent are used.
+func dialSFTP(ctx context.Context, config *MetricConfig, hostPort string) (*sftpConn, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, port = hostPort, ""
+	}
+	timeout := int((config.timeout() + time.Second - 1) / time.Second)
+	args := []string{"-s", "-x", "-T", "-o", "StrictHostKeyChecking=yes", "-o", "ConnectTimeout=" + strconv.Itoa(timeout)}
+	if config.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+config.KnownHostsFile)
+	}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	if config.Username != "" {
+		args = append(args, "-l", config.Username)
+	}
+	env := os.Environ()
+	switch {
+	case config.IdentityFile != "":
+		args = append(args, "-o", "BatchMode=yes", "-o", "IdentitiesOnly=yes", "-o", "PreferredAuthentications=publickey", "-i", config.IdentityFile)
+	case config.Password != "":
+		script, err := askpassScript()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "-o", "PreferredAuthentications=password,keyboard-interactive", "-o", "NumberOfPasswordPrompts=1")
+		// The password is passed in the environment, since command lines of processes can be read by other users.
+		env = append(env, "SSH_ASKPASS="+script, "SSH_ASKPASS_REQUIRE=force", sshPasswordEnv+"="+config.Password)
+		if os.Getenv("DISPLAY") == "" {
+			// Versions of OpenSSH before 8.4 only run the askpass script with a display.
+			env = append(env, "DISPLAY=none")
+		}
+	default:
+		args = append(args, "-o", "BatchMode=yes")
+	}
+	args = append(args, "--", host, "sftp")
+
+	c := &sftpConn{cmd: sshCommand(ctx, args...)}
+	c.cmd.Env = env
+	c.cmd.Stderr = &c.stderr
+	if c.w, err = c.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stdout, err := c.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.r = bufio.NewReader(stdout)
+	if err := c.cmd.Start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// askpassScript returns the path of the askpass script, writing it if needed.
+func askpassScript() (string, error) {
+	askpass.once.Do(func() {
+		f, err := ioutil.TempFile("", "ts-bridge-askpass")
+		if err != nil {
+			askpass.err = fmt.Errorf("cannot write askpass script: %v", err)
+			return
+		}
+		defer f.Close()
+		script := fmt.Sprintf("#!/bin/sh\nprintf '%%s\\n' \"$%s\"\n", sshPasswordEnv)
+		if _, err := f.WriteString(script); err != nil {
+			askpass.err = fmt.Errorf("cannot write askpass script: %v", err)
+			return
+		}
+		if err := f.Chmod(0700); err != nil {
+			askpass.err = fmt.Errorf("cannot make askpass script executable: %v", err)
+			return
+		}
+		askpass.path = f.Name()
+	})
+	return askpass.path, askpass.err
+}
+
+// init negotiates version 3 of the protocol, which is supported by all common servers.
+func (c *sftpConn) init() error {
+	if err := c.send(sftpInit, uint32(3)); err != nil {
+		return err
+	}
+	typ, _, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if typ != sftpVersion {
+		return fmt.Errorf("unexpected reply %d to INIT", typ)
+	}
+	return nil
+}
+
+// stat reads the modification time and size of a file.
+func (c *sftpConn) stat(name string) (file, error) {
+	f := file{name: name}
+	typ, r, err := c.request(sftpStat, name)
+	if err != nil {
+		return f, err
+	}
+	if typ != sftpAttrs {
+		return f, fmt.Errorf("unexpected reply %d to STAT", typ)
+	}
+	modified, size, regular, err := r.attrs()
+	if err != nil {
+		return f, err
+	}
+	if !regular {
+		return f, &sftpError{code: sftpNoSuchFile, msg: fmt.Sprintf("%s is not a file", name)}
+	}
+	f.modified, f.size = modified, size
+	return f, nil
+}
+
+// readDir lists the files in a directory whose names are matched by `match` with their modification times and
+// sizes, skipping other entries such as subdirectories.
+func (c *sftpConn) readDir(dir string, match func(string) bool) ([]file, error) {
+	typ, r, err := c.request(sftpOpenDir, dir)
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpHandle {
+		return nil, fmt.Errorf("unexpected reply %d to OPENDIR", typ)
+	}
+	handle := r.string()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	var files []file
+	for {
+		typ, r, err := c.request(sftpReadDir, handle)
+		var se *sftpError
+		if errors.As(err, &se) && se.code == sftpEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if typ != sftpName {
+			return nil, fmt.Errorf("unexpected reply %d to READDIR", typ)
+		}
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			// Each entry has a name, a line like in the output of `ls -l`, and attributes.
+			name := r.string()
+			r.string()
+			modified, size, regular, err := r.attrs()
+			if err != nil {
+				return nil, err
+			}
+			name = path.Join(dir, name)
+			if regular && match(name) {
+				files = append(files, file{name: name, modified: modified, size: size})
+			}
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+	if _, _, err := c.request(sftpClose, handle); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// request sends a request with the next ID, and returns the type of its reply and a reader of the rest of it.
+// Statuses other than OK are returned as errors.
+func (c *sftpConn) request(typ byte, fields ...interface{}) (byte, *sftpReader, error) {
+	c.id++
+	if err := c.send(typ, append([]interface{}{c.id}, fields...)...); err != nil {
+		return 0, nil, err
+	}
+	replyType, r, err := c.receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	if id := r.uint32(); r.err == nil && id != c.id {
+		return 0, nil, fmt.Errorf("reply to request %d instead of %d", id, c.id)
+	}
+	if replyType == sftpStatus {
+		code, msg := r.uint32(), r.string()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		if code != sftpOK {
+			return 0, nil, &sftpError{code: code, msg: msg}
+		}
+	}
+	return replyType, r, r.err
+}
+
+// send writes a packet with uint32 and string fields.
+func (c *sftpConn) send(typ byte, fields ...interface{}) error {
+	b := []byte{0, 0, 0, 0, typ}
+	for _, f := range fields {
+		switch f := f.(type) {
+		case uint32:
+			b = appendUint32(b, f)
+		case string:
+			b = appendUint32(b, uint32(len(f)))
+			b = append(b, f...)
+		}
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	_, err := c.w.Write(b)
+	return err
+}
+
+// receive reads a packet, returning its type and a reader of the rest of it.
+func (c *sftpConn) receive() (byte, *sftpReader, error) {
+	var length uint32
+	if err := binary.Read(c.r, binary.BigEndian, &length); err != nil {
+		return 0, nil, err
+	}
+	if length == 0 || length > sftpMaxPacket {
+		return 0, nil, fmt.Errorf("invalid packet length %d", length)
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return 0, nil, err
+	}
+	return b[0], &sftpReader{b: b[1:]}, nil
+}
+
+// close ends the session and waits for the OpenSSH client to exit, returning the messages it logged.
+func (c *sftpConn) close() string {
+	c.w.Close()
+	c.cmd.Wait()
+	return strings.TrimSpace(c.stderr.String())
+}
+
+// sftpReader reads fields of a packet. The first error is kept, and the following reads return zero values.
+type sftpReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sftpReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = errors.New("truncated SFTP packet")
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *sftpReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *sftpReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *sftpReader) string() string {
+	n := r.uint32()
+	if n > sftpMaxPacket {
+		r.err = errors.New("truncated SFTP packet")
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+// attrs reads file attributes, returning the modification time and size, and whether the entry is a regular file.
+// Entries without permissions are assumed to be files.
+func (r *sftpReader) attrs() (time.Time, int64, bool, error) {
+	var size uint64
+	var modified time.Time
+	mode := uint32(modeRegular)
+	flags := r.uint32()
+	if flags&sftpAttrSize != 0 {
+		size = r.uint64()
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		r.uint32()
+		r.uint32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		mode = r.uint32()
+	}
+	if flags&sftpAttrModTime != 0 {
+		r.uint32()
+		modified = time.Unix(int64(r.uint32()), 0).UTC()
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := r.uint32(); n > 0 && r.err == nil; n-- {
+			r.string()
+			r.string()
+		}
+	}
+	if r.err != nil {
+		return modified, 0, false, r.err
+	}
+	regular := mode&modeType == modeRegular
+	if regular && (flags&sftpAttrSize == 0 || flags&sftpAttrModTime == 0) {
+		return modified, 0, false, errors.New("server did not return the size and modification time of a file")
+	}
+	return modified, int64(size), regular, nil
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
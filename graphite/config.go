@@ -0,0 +1,123 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// Ways of combining targets that return several series.
+const (
+	// combineNone requires targets to return a single series.
+	combineNone = "none"
+	// combineSum wraps targets in sumSeries().
+	combineSum = "sum"
+	// combineGroupByNode wraps targets in groupByNode(), keeping a series per value of a path node.
+	combineGroupByNode = "group_by_node"
+)
+
+// defaultGroupLabel is the label that holds the path node of series combined using groupByNode().
+const defaultGroupLabel = "node"
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Graphite.
+type MetricConfig struct {
+	// Endpoint is the base URL of Graphite-web or a compatible render API, e.g. http://graphite.corp:8080.
+	Endpoint string `validate:"nonzero"`
+	// Target is a Graphite target, e.g. `web.*.requests.count`.
+	Target string `validate:"nonzero"`
+
+	// Combine defines how targets returning several series are imported: "none" (the default) fails with an error
+	// listing the series, "sum" adds them up, and "group_by_node" sums them per value of the `node` path element.
+	Combine string `validate:"regexp=^(|none|sum|group_by_node)$"`
+	// Node is the (zero-based) index of the path element series are grouped by, e.g. 1 for `web.*.requests.count`.
+	Node int
+	// GroupLabel is the label holding the path element of grouped series. Defaults to "node".
+	GroupLabel string `yaml:"group_label"`
+
+	// Resolution is the interval between points stored by Graphite, e.g. 1m. It's used to request enough data
+	// points for Graphite not to consolidate several of them into one.
+	Resolution time.Duration
+
+	// Username and Password are used for basic authentication.
+	Username string
+	Password string
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// The password can also be read from a file, e.g. from a mounted Kubernetes secret.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// ReadSecretFiles sets the password from the contents of the configured password file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.PasswordFile == "" {
+		return nil
+	}
+	if c.Password != "" {
+		return fmt.Errorf("password and password_file cannot both be set")
+	}
+	password, err := env.ReadSecretFile(dir, c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read password_file: %v", err)
+	}
+	c.Password = password
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if c.combine() != combineGroupByNode && (c.Node != 0 || c.GroupLabel != "") {
+		return fmt.Errorf("node and group_label can only be set if combine is %s", combineGroupByNode)
+	}
+	if c.Node < 0 {
+		return fmt.Errorf("node needs to be a path element index, starting at 0")
+	}
+	if c.Resolution < 0 || c.Resolution%time.Second != 0 {
+		return fmt.Errorf("resolution needs to be a positive number of seconds")
+	}
+	return nil
+}
+
+// combine returns how targets returning several series are imported.
+func (c *MetricConfig) combine() string {
+	if c.Combine != "" {
+		return c.Combine
+	}
+	return combineNone
+}
+
+// groupLabel returns the label holding the path element of grouped series.
+func (c *MetricConfig) groupLabel() string {
+	if c.GroupLabel != "" {
+		return c.GroupLabel
+	}
+	return defaultGroupLabel
+}
+
+// target returns the Graphite target that is queried, wrapped according to `combine`.
+func (c *MetricConfig) target() string {
+	switch c.combine() {
+	case combineSum:
+		return fmt.Sprintf("sumSeries(%s)", c.Target)
+	case combineGroupByNode:
+		return fmt.Sprintf("groupByNode(%s,%d,'sumSeries')", c.Target, c.Node)
+	}
+	return c.Target
+}
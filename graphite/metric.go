@@ -0,0 +1,234 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package graphite imports metrics from the Graphite render API.
+package graphite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// maxListedSeries is the number of series names included in the error about a target returning several series.
+const maxListedSeries = 5
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a Graphite-based metric. It implements the SourceMetric interface.
+type Metric struct {
+	Name        string
+	config      *MetricConfig
+	httpClient  *http.Client
+	minPointAge time.Duration
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig, minPointAge time.Duration) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:        name,
+		config:      config,
+		httpClient:  httpClient,
+		minPointAge: minPointAge,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/graphite/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "graphite"
+}
+
+// SourceHost returns the host of the Graphite endpoint. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.Endpoint)
+	if err != nil || u.Host == "" {
+		return m.config.Endpoint
+	}
+	return u.Host
+}
+
+// Query returns the queried target, including the function combining its series (if any).
+func (m *Metric) Query() string {
+	return m.config.target()
+}
+
+// StackdriverData queries Graphite, returning metric descriptor and time series data with points after the given
+// lastPoint timestamp.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	return m.StackdriverDataUntil(ctx, lastPoint, time.Time{}, rec)
+}
+
+// Windowed returns whether the metric can be queried in windows, which is always the case for Graphite metrics.
+func (m *Metric) Windowed() bool {
+	return true
+}
+
+// series is a series returned by the render API. Data points are `[value, timestamp]` pairs, where values are null
+// if nothing has been stored for an interval.
+type series struct {
+	Target     string        `json:"target"`
+	Datapoints [][2]*float64 `json:"datapoints"`
+}
+
+// StackdriverDataUntil works like StackdriverData, but only queries points up to `until`, unless it's zero.
+func (m *Metric) StackdriverDataUntil(ctx context.Context, lastPoint, until time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	end := timeNow().Add(-m.minPointAge)
+	if !until.IsZero() && until.Before(end) {
+		end = until
+	}
+	if end.Unix() <= lastPoint.Unix() {
+		return nil, nil, nil
+	}
+	series, err := m.render(ctx, lastPoint, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.WithContext(ctx).Debugf("Got %d Graphite series for target %s", len(series), m.Query())
+	if len(series) > 1 && m.config.combine() == combineNone {
+		var names []string
+		for i, s := range series {
+			if i == maxListedSeries {
+				names = append(names, "...")
+				break
+			}
+			names = append(names, s.Target)
+		}
+		return nil, nil, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("target %s returned %d series (%s) instead of one; please set combine to %s or %s",
+			m.config.Target, len(series), strings.Join(names, ", "), combineSum, combineGroupByNode))
+	}
+
+	var ts []*monitoringpb.TimeSeries
+	for _, s := range series {
+		labels := map[string]string{}
+		if m.config.combine() == combineGroupByNode {
+			labels[m.config.groupLabel()] = s.Target
+		}
+		for _, p := range s.Datapoints {
+			if p[0] == nil || p[1] == nil {
+				continue
+			}
+			t := time.Unix(int64(*p[1]), 0)
+			if !t.After(lastPoint) || t.After(end) {
+				continue
+			}
+			et, err := ptypes.TimestampProto(t)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", t, err)
+			}
+			ts = append(ts, &monitoringpb.TimeSeries{
+				Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels},
+				Resource:   &monitoredres.MonitoredResource{Type: "global"},
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+				Points: []*monitoringpb.Point{{
+					Interval: &monitoringpb.TimeInterval{EndTime: et},
+					Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: *p[0]}},
+				}},
+			})
+		}
+	}
+	return m.metricDescriptor(), ts, nil
+}
+
+// render queries the render API for points between `start` and `end`. If the resolution of stored points is known,
+// maxDataPoints is set to the number of points in the time range, so that Graphite (or a Graphite-compatible API
+// with a lower default) does not consolidate points.
+func (m *Metric) render(ctx context.Context, start, end time.Time) ([]series, error) {
+	params := url.Values{}
+	params.Set("target", m.config.target())
+	params.Set("from", strconv.FormatInt(start.Unix(), 10))
+	params.Set("until", strconv.FormatInt(end.Unix(), 10))
+	params.Set("format", "json")
+	if r := m.config.Resolution; r > 0 {
+		params.Set("maxDataPoints", strconv.FormatInt(int64(end.Sub(start)/r)+1, 10))
+	}
+	u := fmt.Sprintf("%s/render?%s", strings.TrimSuffix(m.config.Endpoint, "/"), params.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	if m.config.Username != "" {
+		req.SetBasicAuth(m.config.Username, m.config.Password)
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("Graphite query failed: %w", err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("cannot read Graphite response: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("Graphite query returned HTTP status code %d: %s", resp.StatusCode, strings.TrimSpace(string(data))))
+	}
+	var result []series
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("cannot parse Graphite response: %v", err)
+	}
+	return result, nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Graphite target: %s", m.Query()),
+		DisplayName: m.Name,
+	}
+	if m.config.combine() == combineGroupByNode {
+		d.Labels = []*label.LabelDescriptor{{
+			Key:         m.config.groupLabel(),
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: fmt.Sprintf("Path element %d of the Graphite series", m.config.Node),
+		}}
+	}
+	return d
+}
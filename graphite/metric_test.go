@@ -0,0 +1,238 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	labels map[string]string
+	offset time.Duration // relative to the start of a test.
+	value  float64
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, testPoint{s.Metric.Labels, end.Sub(start), s.Points[0].Value.GetDoubleValue()})
+	}
+	return points
+}
+
+// timestamps matches timestamps relative to the start of a test in response bodies, e.g. START+60.
+var timestamps = regexp.MustCompile(`START(\+\d+)?`)
+
+// testRequest records a request sent to a test server.
+type testRequest struct {
+	params    url.Values
+	requestID string
+}
+
+// newTestServer returns a render API that responds with `body`, with timestamps relative to `start`.
+func newTestServer(start time.Time, body string, req *testRequest) *httptest.Server {
+	body = timestamps.ReplaceAllStringFunc(body, func(ts string) string {
+		offset, _ := strconv.ParseInt(strings.TrimPrefix(ts, "START"), 10, 64)
+		return strconv.FormatInt(start.Unix()+offset, 10)
+	})
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/render" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		*req = testRequest{r.URL.Query(), r.Header.Get(requestid.Header)}
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestStackdriverDataSingleSeries(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(6 * time.Minute) }
+
+	var req testRequest
+	server := newTestServer(start, `[{"target": "web.requests", "datapoints": [[1, START], [null, START+60], [3, START+120], [4, START+360]]}]`, &req)
+	defer server.Close()
+
+	m, err := NewSourceMetric("requests", &MetricConfig{Endpoint: server.URL + "/", Target: "web.requests", Resolution: time.Minute}, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	wantParams := url.Values{
+		"target":        {"web.requests"},
+		"from":          {strconv.FormatInt(start.Unix(), 10)},
+		"until":         {strconv.FormatInt(start.Add(5*time.Minute).Unix(), 10)},
+		"format":        {"json"},
+		"maxDataPoints": {"6"},
+	}
+	if !reflect.DeepEqual(req.params, wantParams) {
+		t.Errorf("expected query parameters %v; got %v", wantParams, req.params)
+	}
+	if req.requestID != "req-1" {
+		t.Errorf("expected request ID req-1 to be sent; got %s", req.requestID)
+	}
+	if desc.Type != "custom.googleapis.com/graphite/requests" || len(desc.Labels) != 0 {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// Points that have already been imported, null points and points newer than the minimum age are skipped.
+	want := []testPoint{{map[string]string{}, 2 * time.Minute, 3}}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataMultipleSeries(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	var req testRequest
+	server := newTestServer(start, `[
+		{"target": "web-1.requests", "datapoints": [[1, START+60]]},
+		{"target": "web-2.requests", "datapoints": [[2, START+60]]}
+	]`, &req)
+	defer server.Close()
+
+	m, err := NewSourceMetric("requests", &MetricConfig{Endpoint: server.URL, Target: "*.requests"}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	_, _, err = m.StackdriverData(context.Background(), start, nil)
+	if !errors.Is(err, tserrors.ErrConfigInvalid) || !strings.Contains(err.Error(), "2 series (web-1.requests, web-2.requests)") {
+		t.Errorf("expected an error listing the returned series; got %v", err)
+	}
+	if _, ok := req.params["maxDataPoints"]; ok {
+		t.Errorf("expected maxDataPoints not to be set without a resolution; got %v", req.params)
+	}
+}
+
+func TestStackdriverDataCombine(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	for _, tt := range []struct {
+		config     MetricConfig
+		body       string
+		wantTarget string
+		want       []testPoint
+	}{
+		{
+			MetricConfig{Target: "*.requests", Combine: "sum"},
+			`[{"target": "sumSeries(*.requests)", "datapoints": [[3, START+60]]}]`,
+			"sumSeries(*.requests)",
+			[]testPoint{{map[string]string{}, time.Minute, 3}},
+		},
+		{
+			MetricConfig{Target: "dc.*.web-*.requests", Combine: "group_by_node", Node: 1},
+			`[{"target": "us", "datapoints": [[3, START+60]]}, {"target": "eu", "datapoints": [[5, START+60]]}]`,
+			"groupByNode(dc.*.web-*.requests,1,'sumSeries')",
+			[]testPoint{{map[string]string{"node": "us"}, time.Minute, 3}, {map[string]string{"node": "eu"}, time.Minute, 5}},
+		},
+		{
+			MetricConfig{Target: "dc.*.requests", Combine: "group_by_node", Node: 1, GroupLabel: "datacenter"},
+			`[{"target": "us", "datapoints": [[3, START+60]]}]`,
+			"groupByNode(dc.*.requests,1,'sumSeries')",
+			[]testPoint{{map[string]string{"datacenter": "us"}, time.Minute, 3}},
+		},
+	} {
+		t.Run(tt.wantTarget, func(t *testing.T) {
+			var req testRequest
+			server := newTestServer(start, tt.body, &req)
+			defer server.Close()
+
+			tt.config.Endpoint = server.URL
+			m, err := NewSourceMetric("requests", &tt.config, 0)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			desc, ts, err := m.StackdriverData(context.Background(), start, nil)
+			if err != nil {
+				t.Fatalf("unexpected error from StackdriverData: %v", err)
+			}
+			if got := req.params.Get("target"); got != tt.wantTarget {
+				t.Errorf("expected target %s to be queried; got %s", tt.wantTarget, got)
+			}
+			if got := testPoints(t, start, ts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected points %v; got %v", tt.want, got)
+			}
+			if tt.config.Combine == "group_by_node" && (len(desc.Labels) != 1 || desc.Labels[0].Key != m.config.groupLabel()) {
+				t.Errorf("expected a %s label; got %v", m.config.groupLabel(), desc.Labels)
+			}
+		})
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		status    int
+		wantClass error
+	}{
+		{"unauthorized", http.StatusUnauthorized, tserrors.ErrSourcePermanent},
+		{"invalid target", http.StatusBadRequest, tserrors.ErrSourcePermanent},
+		{"server error", http.StatusInternalServerError, tserrors.ErrSourceTransient},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			m, err := NewSourceMetric("errors", &MetricConfig{Endpoint: server.URL, Target: "t"}, 0)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, config := range []*MetricConfig{
+		{Target: "t", Node: 1},
+		{Target: "t", Combine: "sum", GroupLabel: "dc"},
+		{Target: "t", Combine: "group_by_node", Node: -1},
+		{Target: "t", Resolution: 1500 * time.Millisecond},
+	} {
+		if _, err := NewSourceMetric("invalid", config, 0); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package httpclient provides configurable HTTP clients used by metric sources to send their queries.
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Config defines settings of the HTTP client used to query a metric source. All settings are optional, and
+// defaults of the Go HTTP client are used for settings that are not specified.
+type Config struct {
+	// Timeout limits the time taken by a single request, including reading the response body.
+	Timeout time.Duration
+	// KeepAlive is the interval between TCP keep-alive probes. Negative value disables keep-alive probes.
+	KeepAlive time.Duration `yaml:"keep_alive"`
+	// MaxIdleConns is the maximum number of idle connections kept open to (any) source host.
+	MaxIdleConns int `yaml:"max_idle_conns" validate:"min=0"`
+	// ProxyURL is the URL of an HTTP proxy to use. If not set, proxy is determined by environment variables.
+	ProxyURL string `yaml:"proxy_url"`
+	// CAFile is the path to a PEM file with additional CA certificates trusted while connecting to the source.
+	CAFile string `yaml:"ca_file"`
+	// DisableCompression prevents requesting gzip-compressed responses.
+	DisableCompression bool `yaml:"disable_compression"`
+}
+
+// TLSConfig returns TLS configuration for connecting to the source, or nil if default configuration is sufficient.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if c.CAFile == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read CA file: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificates found in CA file %s", c.CAFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// Proxy returns a proxy function for the configured proxy URL, or nil if it's not set.
+func (c *Config) Proxy() (func(*http.Request) (*url.URL, error), error) {
+	if c.ProxyURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(c.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %s: %v", c.ProxyURL, err)
+	}
+	return http.ProxyURL(u), nil
+}
+
+// Client returns a new HTTP client based on configured settings.
+func (c *Config) Client() (*http.Client, error) {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+
+	tlsConfig, err := c.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		tr.TLSClientConfig = tlsConfig
+	}
+
+	proxy, err := c.Proxy()
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		tr.Proxy = proxy
+	}
+
+	if c.KeepAlive != 0 {
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: c.KeepAlive}
+		tr.DialContext = dialer.DialContext
+	}
+	if c.MaxIdleConns > 0 {
+		tr.MaxIdleConns = c.MaxIdleConns
+		tr.MaxIdleConnsPerHost = c.MaxIdleConns
+	}
+	tr.DisableCompression = c.DisableCompression
+
+	return &http.Client{Timeout: c.Timeout, Transport: tr}, nil
+}
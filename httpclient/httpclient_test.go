@@ -0,0 +1,101 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpclient
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientDefaults(t *testing.T) {
+	c, err := (&Config{}).Client()
+	if err != nil {
+		t.Fatalf("Client() returned error: %v", err)
+	}
+	tr := c.Transport.(*http.Transport)
+	if c.Timeout != 0 {
+		t.Errorf("expected no timeout by default; got %v", c.Timeout)
+	}
+	if tr.Proxy == nil {
+		t.Errorf("expected proxy to be configured from environment by default")
+	}
+	if tr.DisableCompression {
+		t.Errorf("expected compression to be enabled by default")
+	}
+}
+
+func TestClientSettings(t *testing.T) {
+	c, err := (&Config{
+		Timeout:            time.Minute,
+		KeepAlive:          time.Hour,
+		MaxIdleConns:       3,
+		ProxyURL:           "http://proxy.example.com:3128",
+		DisableCompression: true,
+	}).Client()
+	if err != nil {
+		t.Fatalf("Client() returned error: %v", err)
+	}
+	tr := c.Transport.(*http.Transport)
+	if c.Timeout != time.Minute {
+		t.Errorf("expected timeout to be 1m; got %v", c.Timeout)
+	}
+	if tr.MaxIdleConns != 3 || tr.MaxIdleConnsPerHost != 3 {
+		t.Errorf("expected 3 max idle connections; got %d/%d", tr.MaxIdleConns, tr.MaxIdleConnsPerHost)
+	}
+	if !tr.DisableCompression {
+		t.Errorf("expected compression to be disabled")
+	}
+	req, _ := http.NewRequest("GET", "https://source.example.com/", nil)
+	if u, err := tr.Proxy(req); err != nil || u.Host != "proxy.example.com:3128" {
+		t.Errorf("expected proxy.example.com:3128 to be used as a proxy; got %v (%v)", u, err)
+	}
+}
+
+func TestClientCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatalf("unable to create a temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	f.Close()
+
+	c, err := (&Config{CAFile: f.Name()}).Client()
+	if err != nil {
+		t.Fatalf("Client() returned error: %v", err)
+	}
+	if _, err := c.Get(server.URL); err != nil {
+		t.Errorf("expected request to a server with a trusted certificate to succeed; got %v", err)
+	}
+
+	// The certificate is not trusted without the CA file.
+	c, _ = (&Config{}).Client()
+	if _, err := c.Get(server.URL); err == nil {
+		t.Errorf("expected request to a server with an unknown certificate to fail")
+	}
+
+	if _, err := (&Config{CAFile: "nonexistent.pem"}).Client(); err == nil || !strings.Contains(err.Error(), "could not read CA file") {
+		t.Errorf("expected an error for a nonexistent CA file; got %v", err)
+	}
+}
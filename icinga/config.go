@@ -0,0 +1,67 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package icinga
+
+import (
+	"fmt"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Icinga check results.
+type MetricConfig struct {
+	// Endpoint is the base URL of the Icinga 2 API, e.g. https://icinga.corp:5665.
+	Endpoint string `validate:"nonzero"`
+	Username string `validate:"nonzero"`
+	Password string
+
+	// Type is the type of checked objects: "service" (the default) or "host".
+	Type string `validate:"regexp=^(|service|host)$"`
+	// Filter is an Icinga filter expression selecting checked objects, e.g. `service.name == "ping4"`.
+	Filter string
+	// Perfdata lists the performance data labels that are imported. All labels are imported if it's empty.
+	Perfdata []string
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// The password can also be read from a file, e.g. from a mounted Kubernetes secret.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// ReadSecretFiles sets the password from the contents of the configured password file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.PasswordFile == "" {
+		return nil
+	}
+	if c.Password != "" {
+		return fmt.Errorf("password and password_file cannot both be set")
+	}
+	password, err := env.ReadSecretFile(dir, c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read password_file: %v", err)
+	}
+	c.Password = password
+	return nil
+}
+
+// objectType returns the type of checked objects.
+func (c *MetricConfig) objectType() string {
+	if c.Type != "" {
+		return c.Type
+	}
+	return "service"
+}
@@ -0,0 +1,256 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package icinga imports performance data of check results from the Icinga 2 API, so that checks written for
+// Nagios-compatible systems can be graphed in Stackdriver.
+package icinga
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// Labels of imported time series.
+const (
+	hostLabel     = "host"
+	serviceLabel  = "service"
+	perfdataLabel = "perfdata"
+)
+
+// Metric defines a metric based on performance data of Icinga check results. It implements the SourceMetric
+// interface.
+type Metric struct {
+	Name       string
+	config     *MetricConfig
+	httpClient *http.Client
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig) (*Metric, error) {
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:       name,
+		config:     config,
+		httpClient: httpClient,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/icinga/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "icinga"
+}
+
+// SourceHost returns the host of the Icinga API endpoint. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.Endpoint)
+	if err != nil || u.Host == "" {
+		return m.config.Endpoint
+	}
+	return u.Host
+}
+
+// Query returns a description of the check results imported by this metric.
+func (m *Metric) Query() string {
+	q := fmt.Sprintf("%s checks", m.config.objectType())
+	if m.config.Filter != "" {
+		q += fmt.Sprintf(" matching %s", m.config.Filter)
+	}
+	if len(m.config.Perfdata) > 0 {
+		q += fmt.Sprintf(" (%s)", strings.Join(m.config.Perfdata, ", "))
+	}
+	return q
+}
+
+// checkedObject is a host or service returned by the Icinga objects API.
+type checkedObject struct {
+	Attrs struct {
+		Name            string `json:"name"`
+		HostName        string `json:"host_name"`
+		LastCheckResult *struct {
+			ExecutionEnd    float64           `json:"execution_end"`
+			PerformanceData []json.RawMessage `json:"performance_data"`
+		} `json:"last_check_result"`
+	} `json:"attrs"`
+}
+
+// StackdriverData queries Icinga, returning metric descriptor and time series with performance data of check
+// results that have finished after the given lastPoint timestamp. The API only returns the last result of each
+// check, so results of checks that run more often than ts-bridge syncs are not all imported.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	objects, err := m.objects(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.WithContext(ctx).Debugf("Got %d Icinga %s objects (%s)", len(objects), m.config.objectType(), m.Query())
+
+	ts, err := m.convertResults(objects, lastPoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m.metricDescriptor(), ts, nil
+}
+
+// objects queries checked objects along with their last check result. Filters are sent in the request body, using
+// a POST request that overrides the method, as recommended by the Icinga documentation.
+func (m *Metric) objects(ctx context.Context) ([]checkedObject, error) {
+	body := map[string]interface{}{"attrs": []string{"name", "host_name", "last_check_result"}}
+	if m.config.Filter != "" {
+		body["filter"] = m.config.Filter
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("%s/v1/objects/%ss", strings.TrimSuffix(m.config.Endpoint, "/"), m.config.objectType())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-HTTP-Method-Override", http.MethodGet)
+	req.SetBasicAuth(m.config.Username, m.config.Password)
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("Icinga API request failed: %w", err))
+	}
+	defer resp.Body.Close()
+	data, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("cannot read Icinga API response: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("Icinga API returned HTTP status code %d: %s", resp.StatusCode, data))
+	}
+	var result struct {
+		Results []checkedObject `json:"results"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("cannot parse Icinga API response: %v", err)
+	}
+	return result.Results, nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for performance data.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	labels := []*label.LabelDescriptor{{
+		Key:         hostLabel,
+		ValueType:   label.LabelDescriptor_STRING,
+		Description: "Icinga host",
+	}}
+	if m.config.objectType() == "service" {
+		labels = append(labels, &label.LabelDescriptor{
+			Key:         serviceLabel,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "Icinga service",
+		})
+	}
+	labels = append(labels, &label.LabelDescriptor{
+		Key:         perfdataLabel,
+		ValueType:   label.LabelDescriptor_STRING,
+		Description: "Performance data label",
+	})
+	return &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Icinga %s", m.Query()),
+		DisplayName: m.Name,
+		Labels:      labels,
+	}
+}
+
+// convertResults converts performance data of check results that finished after `lastPoint` into Stackdriver time
+// series with a single point each.
+func (m *Metric) convertResults(objects []checkedObject, lastPoint time.Time) ([]*monitoringpb.TimeSeries, error) {
+	wanted := make(map[string]bool)
+	for _, p := range m.config.Perfdata {
+		wanted[p] = true
+	}
+	var ts []*monitoringpb.TimeSeries
+	for _, o := range objects {
+		r := o.Attrs.LastCheckResult
+		if r == nil {
+			// The check has not run yet.
+			continue
+		}
+		sec, frac := math.Modf(r.ExecutionEnd)
+		t := time.Unix(int64(sec), int64(frac*1e9)).Truncate(time.Millisecond)
+		if !t.After(lastPoint) {
+			continue
+		}
+		values, err := parsePerfdata(r.PerformanceData)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse performance data of %s: %v", o.Attrs.Name, err)
+		}
+		end, err := ptypes.TimestampProto(t)
+		if err != nil {
+			return nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", t, err)
+		}
+		for _, v := range values {
+			if len(wanted) > 0 && !wanted[v.label] {
+				continue
+			}
+			ts = append(ts, &monitoringpb.TimeSeries{
+				Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: m.metricLabels(o, v.label)},
+				Resource:   &monitoredres.MonitoredResource{Type: "global"},
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+				Points: []*monitoringpb.Point{{
+					Interval: &monitoringpb.TimeInterval{EndTime: end},
+					Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: v.value}},
+				}},
+			})
+		}
+	}
+	return ts, nil
+}
+
+// metricLabels returns Stackdriver labels of a performance data value of a checked object.
+func (m *Metric) metricLabels(o checkedObject, perfdata string) map[string]string {
+	if m.config.objectType() == "host" {
+		return map[string]string{hostLabel: o.Attrs.Name, perfdataLabel: perfdata}
+	}
+	return map[string]string{hostLabel: o.Attrs.HostName, serviceLabel: o.Attrs.Name, perfdataLabel: perfdata}
+}
@@ -0,0 +1,202 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package icinga
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	labels map[string]string
+	offset time.Duration // relative to the start of a test.
+	value  float64
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, testPoint{s.Metric.Labels, end.Sub(start), s.Points[0].Value.GetDoubleValue()})
+	}
+	return points
+}
+
+func TestStackdriverDataServices(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	end := float64(start.Add(90*time.Second).UnixNano()) / 1e9
+
+	var method, path, requestID string
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "bridge" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		method, path, requestID = r.Header.Get("X-HTTP-Method-Override"), r.URL.Path, r.Header.Get(requestid.Header)
+		json.NewDecoder(r.Body).Decode(&body)
+		fmt.Fprintf(w, `{"results": [
+			{"attrs": {"name": "ping4", "host_name": "web-1", "last_check_result": {"execution_end": %f, "performance_data": ["rta=1.5ms;3000;5000;0", "pl=0%%;80;100;0"]}}},
+			{"attrs": {"name": "ping4", "host_name": "web-2", "last_check_result": {"execution_end": %f, "performance_data": [{"label": "rta", "value": 2, "unit": "ms"}]}}},
+			{"attrs": {"name": "ping4", "host_name": "web-3", "last_check_result": {"execution_end": %d, "performance_data": ["rta=3ms"]}}},
+			{"attrs": {"name": "ping4", "host_name": "web-4"}}
+		]}`, end, end, start.Unix())
+	}))
+	defer server.Close()
+
+	m, err := NewSourceMetric("ping", &MetricConfig{
+		Endpoint: server.URL,
+		Username: "bridge",
+		Password: "secret",
+		Filter:   `service.name == "ping4"`,
+		Perfdata: []string{"rta"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if method != http.MethodGet || path != "/v1/objects/services" || body["filter"] != `service.name == "ping4"` {
+		t.Errorf("unexpected request %s %s with body %v", method, path, body)
+	}
+	if requestID != "req-1" {
+		t.Errorf("expected request ID req-1 to be sent; got %s", requestID)
+	}
+	if desc.Type != "custom.googleapis.com/icinga/ping" || len(desc.Labels) != 3 {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// Results that finished before the last point have already been imported.
+	want := []testPoint{
+		{map[string]string{"host": "web-1", "service": "ping4", "perfdata": "rta"}, 90 * time.Second, 0.0015},
+		{map[string]string{"host": "web-2", "service": "ping4", "perfdata": "rta"}, 90 * time.Second, 0.002},
+	}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataHosts(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		fmt.Fprintf(w, `{"results": [{"attrs": {"name": "web-1", "last_check_result": {"execution_end": %d, "performance_data": ["'load 1m'=0.5"]}}}]}`,
+			start.Add(time.Minute).Unix())
+	}))
+	defer server.Close()
+
+	m, err := NewSourceMetric("host_load", &MetricConfig{Endpoint: server.URL + "/", Username: "bridge", Type: "host"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	desc, ts, err := m.StackdriverData(context.Background(), start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if path != "/v1/objects/hosts" {
+		t.Errorf("expected hosts to be queried; got %s", path)
+	}
+	if len(desc.Labels) != 2 {
+		t.Errorf("expected host metrics to have no service label; got %v", desc.Labels)
+	}
+	want := []testPoint{{map[string]string{"host": "web-1", "perfdata": "load 1m"}, time.Minute, 0.5}}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		status    int
+		body      string
+		wantClass error
+	}{
+		{"invalid credentials", http.StatusUnauthorized, "", tserrors.ErrSourcePermanent},
+		{"invalid filter", http.StatusBadRequest, `{"error": 400, "status": "Invalid filter"}`, tserrors.ErrSourcePermanent},
+		{"server unavailable", http.StatusServiceUnavailable, "", tserrors.ErrSourceTransient},
+		{"invalid perfdata", http.StatusOK, fmt.Sprintf(`{"results": [{"attrs": {"last_check_result": {"execution_end": %d, "performance_data": ["rta"]}}}]}`, time.Now().Unix()), nil},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			m, err := NewSourceMetric("errors", &MetricConfig{Endpoint: server.URL, Username: "bridge"})
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+			if err == nil {
+				t.Fatalf("expected StackdriverData to fail")
+			}
+			if tt.wantClass != nil && !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestParsePerfdataString(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    perfdataValue
+		wantOK  bool
+		wantErr bool
+	}{
+		{"time=0.25s;1;2;0;10", perfdataValue{"time", 0.25}, true, false},
+		{"size=2KB", perfdataValue{"size", 2048}, true, false},
+		{"users=-3", perfdataValue{"users", -3}, true, false},
+		{"requests=120c", perfdataValue{"requests", 120}, true, false},
+		{"'disk /var=used'=80%;90;95", perfdataValue{"disk /var=used", 80}, true, false},
+		{"'it''s'=1", perfdataValue{"it's", 1}, true, false},
+		{"rta=U;3000;5000", perfdataValue{}, false, false},
+		{"rta", perfdataValue{}, false, true},
+		{"'rta=1", perfdataValue{}, false, true},
+		{"rta=fast", perfdataValue{}, false, true},
+	} {
+		t.Run(tt.in, func(t *testing.T) {
+			got, ok, err := parsePerfdataString(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePerfdataString(%s) returned error %v; want error: %v", tt.in, err, tt.wantErr)
+			}
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("parsePerfdataString(%s) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
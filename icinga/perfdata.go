@@ -0,0 +1,131 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package icinga
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// unitScales converts values of performance data units (as defined by the Monitoring Plugins guidelines) into
+// seconds and bytes, so that values of different checks can be compared.
+var unitScales = map[string]float64{
+	"us": 1e-6,
+	"ms": 1e-3,
+	"s":  1,
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// perfdataValue is a single value of check performance data.
+type perfdataValue struct {
+	label string
+	value float64
+}
+
+// parsePerfdata parses performance data returned by the Icinga API. Values are usually strings such as
+// `'label'=1.5ms;warn;crit;min;max`, but can also be objects if check results have been submitted through the API.
+// Values that are unknown (`U`) are skipped.
+func parsePerfdata(raw []json.RawMessage) ([]perfdataValue, error) {
+	var values []perfdataValue
+	for _, r := range raw {
+		var s string
+		if err := json.Unmarshal(r, &s); err == nil {
+			v, ok, err := parsePerfdataString(s)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				values = append(values, v)
+			}
+			continue
+		}
+		var obj struct {
+			Label string  `json:"label"`
+			Value float64 `json:"value"`
+			Unit  string  `json:"unit"`
+		}
+		if err := json.Unmarshal(r, &obj); err != nil {
+			return nil, fmt.Errorf("invalid performance data %s: %v", r, err)
+		}
+		values = append(values, perfdataValue{obj.Label, scale(obj.Value, obj.Unit)})
+	}
+	return values, nil
+}
+
+// parsePerfdataString parses a single performance data value in the Monitoring Plugins format. It returns false if
+// the value is unknown.
+func parsePerfdataString(s string) (perfdataValue, bool, error) {
+	s = strings.TrimSpace(s)
+	var label, rest string
+	if strings.HasPrefix(s, "'") {
+		// Quoted labels can contain spaces and equal signs, and quotes are escaped by doubling them.
+		end := -1
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				continue
+			}
+			if i+1 < len(s) && s[i+1] == '\'' {
+				i++
+				continue
+			}
+			end = i
+			break
+		}
+		if end < 0 || end+1 >= len(s) || s[end+1] != '=' {
+			return perfdataValue{}, false, fmt.Errorf("invalid performance data '%s'", s)
+		}
+		label = strings.ReplaceAll(s[1:end], "''", "'")
+		rest = s[end+2:]
+	} else {
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return perfdataValue{}, false, fmt.Errorf("invalid performance data '%s'", s)
+		}
+		label, rest = s[:i], s[i+1:]
+	}
+
+	if i := strings.Index(rest, ";"); i >= 0 {
+		rest = rest[:i]
+	}
+	if rest == "U" {
+		return perfdataValue{}, false, nil
+	}
+	n := strings.IndexFunc(rest, func(r rune) bool {
+		return !strings.ContainsRune("0123456789.-+eE", r)
+	})
+	number, unit := rest, ""
+	if n >= 0 {
+		number, unit = rest[:n], rest[n:]
+	}
+	v, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return perfdataValue{}, false, fmt.Errorf("invalid performance data value '%s' of %s: %v", rest, label, err)
+	}
+	return perfdataValue{label, scale(v, unit)}, true, nil
+}
+
+// scale converts a value into seconds or bytes. Values of other units (e.g. percentages and counters) are kept.
+func scale(v float64, unit string) float64 {
+	if s, ok := unitScales[unit]; ok {
+		return v * s
+	}
+	return v
+}
@@ -19,6 +19,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
 	"github.com/influxdata/influxql"
 )
 
@@ -32,6 +34,35 @@ type MetricConfig struct {
 	Password       string
 	TimeAggregated bool `yaml:"time_aggregated"`
 	Cumulative     bool
+	HTTP           httpclient.Config `yaml:"http"`
+
+	// The password can also be read from a file, e.g. from a mounted Kubernetes secret.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// ReadSecretFiles sets the password from the contents of the configured password file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.PasswordFile == "" {
+		return nil
+	}
+	if c.Password != "" {
+		return fmt.Errorf("password and password_file cannot both be set")
+	}
+	password, err := env.ReadSecretFile(dir, c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read password_file: %v", err)
+	}
+	c.Password = password
+	return nil
+}
+
+// validateHTTP checks that only HTTP settings supported by the InfluxDB client library are configured.
+func (c *MetricConfig) validateHTTP() error {
+	if c.HTTP.KeepAlive != 0 || c.HTTP.MaxIdleConns != 0 || c.HTTP.DisableCompression {
+		return fmt.Errorf("keep_alive, max_idle_conns and disable_compression HTTP settings are not supported for InfluxDB metrics")
+	}
+	return nil
 }
 
 func (c *MetricConfig) validateQuery() error {
@@ -17,6 +17,8 @@ package influxdb
 import (
 	"testing"
 	"time"
+
+	"github.com/google/ts-bridge/httpclient"
 )
 
 func TestQueryValidation(t *testing.T) {
@@ -146,3 +148,37 @@ func TestParsingQueryInterval(t *testing.T) {
 		})
 	}
 }
+
+func TestHTTPValidation(t *testing.T) {
+	for _, tt := range []struct {
+		description string
+		http        httpclient.Config
+		wantErr     bool
+	}{
+		{
+			description: "ok for supported settings",
+			http:        httpclient.Config{Timeout: time.Minute, ProxyURL: "http://proxy:3128"},
+		},
+		{
+			description: "error for keep-alive settings",
+			http:        httpclient.Config{KeepAlive: time.Minute},
+			wantErr:     true,
+		},
+		{
+			description: "error when disabling compression",
+			http:        httpclient.Config{DisableCompression: true},
+			wantErr:     true,
+		},
+	} {
+		t.Run(tt.description, func(t *testing.T) {
+			c := &MetricConfig{Query: "SELECT * FROM foo", HTTP: tt.http}
+			err := c.validateHTTP()
+			if err != nil && !tt.wantErr {
+				t.Errorf("expected no errors, got %v", err)
+			}
+			if err == nil && tt.wantErr {
+				t.Error("expected error, got nil")
+			}
+		})
+	}
+}
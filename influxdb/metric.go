@@ -16,11 +16,18 @@ package influxdb
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"github.com/google/ts-bridge/storage"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"time"
 
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
 	"github.com/golang/protobuf/ptypes"
 	"github.com/influxdata/influxdb1-client/models"
 	client "github.com/influxdata/influxdb1-client/v2"
@@ -40,18 +47,33 @@ type Metric struct {
 	config               *MetricConfig
 	offsetDuration       time.Duration
 	counterResetInterval time.Duration
+	tlsConfig            *tls.Config
+	proxy                func(*http.Request) (*url.URL, error)
 }
 
 func NewSourceMetric(name string, config *MetricConfig, offsetDuration, counterResetInterval time.Duration) (*Metric, error) {
 	if err := config.validateQuery(); err != nil {
 		return nil, err
 	}
+	if err := config.validateHTTP(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := config.HTTP.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := config.HTTP.Proxy()
+	if err != nil {
+		return nil, err
+	}
 
 	return &Metric{
 		Name:                 name,
 		config:               config,
 		offsetDuration:       offsetDuration,
 		counterResetInterval: counterResetInterval,
+		tlsConfig:            tlsConfig,
+		proxy:                proxy,
 	}, nil
 }
 
@@ -59,15 +81,43 @@ func (m *Metric) StackdriverName() string {
 	return fmt.Sprintf("custom.googleapis.com/influxdb/%s", m.Name)
 }
 
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "influxdb"
+}
+
+// SourceHost returns the host of the InfluxDB endpoint. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.Endpoint)
+	if err != nil || u.Host == "" {
+		return m.config.Endpoint
+	}
+	return u.Host
+}
+
 func (m *Metric) Query() string {
 	return m.config.Query
 }
 
 func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	return m.StackdriverDataUntil(ctx, lastPoint, time.Time{}, rec)
+}
+
+// Windowed returns whether the metric can be queried in windows. Cumulative metrics are always queried from the
+// start time of the counter.
+func (m *Metric) Windowed() bool {
+	return !m.config.Cumulative
+}
+
+// StackdriverDataUntil works like StackdriverData, but only queries points up to `until`, unless it's zero.
+func (m *Metric) StackdriverDataUntil(ctx context.Context, lastPoint, until time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
 	c, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:     m.config.Endpoint,
-		Username: m.config.Username,
-		Password: m.config.Password,
+		Addr:      m.config.Endpoint,
+		Username:  m.config.Username,
+		Password:  m.config.Password,
+		Timeout:   m.config.HTTP.Timeout,
+		TLSConfig: m.tlsConfig,
+		Proxy:     m.proxy,
 	})
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create InfluxDB client: %v", err)
@@ -93,11 +143,15 @@ func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec s
 	}
 
 	endTime := timeNow().Add(-m.offsetDuration)
+	if !until.IsZero() && until.Before(endTime) {
+		endTime = until
+	}
 	resp, err := c.Query(m.buildQuery(startTime, endTime))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, classifyError(err)
 	} else if err = resp.Error(); err != nil {
-		return nil, nil, err
+		// Errors reported by InfluxDB itself mean that the query could not be executed.
+		return nil, nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
 	}
 
 	if len(resp.Results) != 1 {
@@ -251,7 +305,7 @@ func (m *Metric) convertTimeSeries(startTime time.Time, points []point) ([]*moni
 			Metric:     &metricpb.Metric{Type: m.StackdriverName()},
 			Resource:   &monitoredres.MonitoredResource{Type: "global"},
 			MetricKind: m.metricKind(),
-			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			ValueType:  p.valueType(),
 			Points:     []*monitoringpb.Point{sdPoint},
 		})
 	}
@@ -277,17 +331,26 @@ func (m *Metric) convertPoint(startTime time.Time, p point) (*monitoringpb.Point
 
 	return &monitoringpb.Point{
 		Interval: interval,
-		Value: &monitoringpb.TypedValue{
-			Value: &monitoringpb.TypedValue_DoubleValue{
-				DoubleValue: p.value,
-			},
-		},
+		Value:    p.value,
 	}, nil
 }
 
 type point struct {
 	timestamp time.Time
-	value     float64
+	// Numeric values are parsed as doubles. String and boolean field values are kept as they are, so that they
+	// can be converted using the value mapping of the metric.
+	value *monitoringpb.TypedValue
+}
+
+// valueType returns the Stackdriver value type of a point.
+func (p point) valueType() metricpb.MetricDescriptor_ValueType {
+	switch p.value.GetValue().(type) {
+	case *monitoringpb.TypedValue_StringValue:
+		return metricpb.MetricDescriptor_STRING
+	case *monitoringpb.TypedValue_BoolValue:
+		return metricpb.MetricDescriptor_BOOL
+	}
+	return metricpb.MetricDescriptor_DOUBLE
 }
 
 // parseSeriesPoints parses points from an InfluxDB series into a slice of
@@ -310,14 +373,21 @@ func parseSeriesPoints(series models.Row) ([]point, error) {
 			return nil, err
 		}
 
-		v, ok := p[1].(json.Number)
-		if !ok {
-			return nil, fmt.Errorf("failed to cast %v to json.Number", p[1])
-		}
-		// Since the column types are not specified, we can only assume float64.
-		val, err := v.Float64()
-		if err != nil {
-			return nil, err
+		var val *monitoringpb.TypedValue
+		switch v := p[1].(type) {
+		case json.Number:
+			// Since the column types are not specified, we can only assume float64.
+			f, err := v.Float64()
+			if err != nil {
+				return nil, err
+			}
+			val = &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: f}}
+		case string:
+			val = &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_StringValue{StringValue: v}}
+		case bool:
+			val = &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_BoolValue{BoolValue: v}}
+		default:
+			return nil, fmt.Errorf("failed to cast %v to json.Number, string or bool", p[1])
 		}
 
 		points = append(points, point{time.Unix(0, unixNano), val})
@@ -325,3 +395,17 @@ func parseSeriesPoints(series models.Row) ([]point, error) {
 
 	return points, nil
 }
+
+// statusCodeRE matches HTTP status codes in errors returned by the InfluxDB client library.
+var statusCodeRE = regexp.MustCompile(`status(?: code)?:? (\d+)`)
+
+// classifyError attaches an error class to errors returned by the InfluxDB client library, which only exposes the
+// HTTP status code of failed requests as part of the error message.
+func classifyError(err error) error {
+	if m := statusCodeRE.FindStringSubmatch(err.Error()); m != nil {
+		if code, convErr := strconv.Atoi(m[1]); convErr == nil {
+			return tserrors.FromHTTPStatus(code, err)
+		}
+	}
+	return tserrors.ClassifySource(err)
+}
@@ -16,6 +16,8 @@ package influxdb
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -28,9 +30,11 @@ import (
 
 	"github.com/google/ts-bridge/datastore"
 	"github.com/google/ts-bridge/mocks"
+	"github.com/google/ts-bridge/tserrors"
 
 	"github.com/golang/mock/gomock"
 	"github.com/golang/protobuf/proto"
+	"github.com/influxdata/influxdb1-client/models"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
@@ -653,3 +657,45 @@ func TestStackdriverDataTimeAggCumulativeResponse(t *testing.T) {
 	expectedDesc, expectedTS = mustUnmarshalTimeSeries(expectedDescRaw, expectedTSRaw...)
 	compareTimeSeries(t, desc, expectedDesc, ts, expectedTS)
 }
+
+func TestClassifyError(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want error
+	}{
+		{errors.New("received status code 503 from downstream server"), tserrors.ErrSourceTransient},
+		{errors.New("received status code 429 from server"), tserrors.ErrSourceTransient},
+		{errors.New("expected json response, got empty body, with status: 404"), tserrors.ErrSourcePermanent},
+		{&url.Error{Op: "Get", URL: "http://influx", Err: context.DeadlineExceeded}, tserrors.ErrSourceTransient},
+		{errors.New("something else"), nil},
+	} {
+		if got := tserrors.Class(classifyError(tt.err)); got != tt.want {
+			t.Errorf("classifyError(%v) returned error of class '%v'; want '%v'", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseSeriesPointsValueTypes(t *testing.T) {
+	series := models.Row{
+		Columns: []string{"time", "status"},
+		Values:  [][]interface{}{{json.Number("1000"), json.Number("1.5")}, {json.Number("2000"), "critical"}, {json.Number("3000"), true}},
+	}
+	points, err := parseSeriesPoints(series)
+	if err != nil {
+		t.Fatalf("parseSeriesPoints() returned error: %v", err)
+	}
+	want := []metricpb.MetricDescriptor_ValueType{metricpb.MetricDescriptor_DOUBLE, metricpb.MetricDescriptor_STRING, metricpb.MetricDescriptor_BOOL}
+	for i, p := range points {
+		if p.valueType() != want[i] {
+			t.Errorf("expected point %d to have value type %v; got %v", i, want[i], p.valueType())
+		}
+	}
+	if got := points[1].value.GetStringValue(); got != "critical" {
+		t.Errorf("expected string value 'critical'; got '%s'", got)
+	}
+
+	series.Values = append(series.Values, []interface{}{json.Number("4000"), []interface{}{}})
+	if _, err := parseSeriesPoints(series); err == nil {
+		t.Error("expected parseSeriesPoints() to reject an unsupported value")
+	}
+}
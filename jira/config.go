@@ -0,0 +1,75 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jira
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from JIRA.
+type MetricConfig struct {
+	// URL is the base URL of the JIRA site, e.g. https://acme.atlassian.net.
+	URL string `validate:"nonzero"`
+	// JQL selects the counted issues, e.g. `project = OPS AND type = Incident AND resolution IS EMPTY`.
+	JQL string `validate:"nonzero"`
+	// SumField is an optional numeric field (e.g. customfield_10016) whose values are summed instead of counting
+	// issues.
+	SumField string `yaml:"sum_field"`
+
+	// Username and APIToken are the email address and API token of a JIRA Cloud user. Without a username, the
+	// token is sent as a personal access token of JIRA Server or Data Center.
+	Username string
+	APIToken string `yaml:"api_token"`
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// The API token can also be read from a file, e.g. from a mounted Kubernetes secret.
+	APITokenFile string `yaml:"api_token_file"`
+}
+
+// ReadSecretFiles sets the API token from the contents of the configured token file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.APITokenFile == "" {
+		return nil
+	}
+	if c.APIToken != "" {
+		return fmt.Errorf("api_token and api_token_file cannot both be set")
+	}
+	token, err := env.ReadSecretFile(dir, c.APITokenFile)
+	if err != nil {
+		return fmt.Errorf("cannot read api_token_file: %v", err)
+	}
+	c.APIToken = token
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if c.APIToken == "" {
+		return fmt.Errorf("api_token or api_token_file needs to be set")
+	}
+	if !strings.HasPrefix(c.URL, "https://") && !strings.HasPrefix(c.URL, "http://") {
+		return fmt.Errorf("url needs to be an HTTP(S) URL")
+	}
+	if strings.ContainsAny(c.SumField, ", ") {
+		return fmt.Errorf("sum_field needs to be a single field ID")
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package jira imports the number of issues matching JQL queries (or the sum of a numeric field) from JIRA.
+package jira
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// pageSize is the number of issues requested per page when summing a field.
+var pageSize = 100
+
+// Metric defines a metric imported from JIRA. It implements the SourceMetric interface.
+type Metric struct {
+	Name       string
+	config     *MetricConfig
+	httpClient *http.Client
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:       name,
+		config:     config,
+		httpClient: httpClient,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/jira/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "jira"
+}
+
+// SourceHost returns the host of the JIRA site. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.URL)
+	if err != nil || u.Host == "" {
+		return m.config.URL
+	}
+	return u.Host
+}
+
+// Query returns the JQL query of this metric, and the summed field if configured.
+func (m *Metric) Query() string {
+	if m.config.SumField != "" {
+		return fmt.Sprintf("sum(%s) of %s", m.config.SumField, m.config.JQL)
+	}
+	return m.config.JQL
+}
+
+// searchResult is a page of issues returned by the search resource.
+type searchResult struct {
+	StartAt int `json:"startAt"`
+	Total   int `json:"total"`
+	Issues  []struct {
+		Key    string                     `json:"key"`
+		Fields map[string]json.RawMessage `json:"fields"`
+	} `json:"issues"`
+}
+
+// StackdriverData runs the JQL query, returning metric descriptor and a time series with the current number of
+// matching issues (or the sum of the configured field). A single point is imported per sync.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	now := timeNow().Truncate(time.Second)
+	if !now.After(lastPoint) {
+		return nil, nil, nil
+	}
+	end, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", now, err)
+	}
+	var value float64
+	if m.config.SumField == "" {
+		// Only the total is needed, so no issues are returned.
+		result, err := m.search(ctx, 0, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		value = float64(result.Total)
+	} else if value, err = m.sum(ctx); err != nil {
+		return nil, nil, err
+	}
+	log.WithContext(ctx).Debugf("Got value %v from JIRA for %s", value, m.Query())
+
+	ts := []*monitoringpb.TimeSeries{{
+		Metric:     &metricpb.Metric{Type: m.StackdriverName()},
+		Resource:   &monitoredres.MonitoredResource{Type: "global"},
+		MetricKind: metricpb.MetricDescriptor_GAUGE,
+		ValueType:  metricpb.MetricDescriptor_DOUBLE,
+		Points: []*monitoringpb.Point{{
+			Interval: &monitoringpb.TimeInterval{EndTime: end},
+			Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+		}},
+	}}
+	return m.metricDescriptor(), ts, nil
+}
+
+// sum pages through all matching issues, summing the configured field. Issues without a value are skipped.
+func (m *Metric) sum(ctx context.Context) (float64, error) {
+	var sum float64
+	for startAt := 0; ; {
+		result, err := m.search(ctx, startAt, pageSize)
+		if err != nil {
+			return 0, err
+		}
+		for _, issue := range result.Issues {
+			raw, ok := issue.Fields[m.config.SumField]
+			if !ok || string(raw) == "null" {
+				continue
+			}
+			var v float64
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return 0, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("field %s of issue %s is not a number: %s", m.config.SumField, issue.Key, raw))
+			}
+			sum += v
+		}
+		startAt += len(result.Issues)
+		if len(result.Issues) == 0 || startAt >= result.Total {
+			return sum, nil
+		}
+	}
+}
+
+// search returns a page of issues matching the JQL query, with only the summed field.
+func (m *Metric) search(ctx context.Context, startAt, maxResults int) (*searchResult, error) {
+	params := url.Values{
+		"jql":        {m.config.JQL},
+		"startAt":    {strconv.Itoa(startAt)},
+		"maxResults": {strconv.Itoa(maxResults)},
+		"fields":     {m.config.SumField},
+	}
+	if m.config.SumField == "" {
+		params.Set("fields", "-all")
+	}
+	u := fmt.Sprintf("%s/rest/api/2/search?%s", strings.TrimSuffix(m.config.URL, "/"), params.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	if m.config.Username != "" {
+		req.SetBasicAuth(m.config.Username, m.config.APIToken)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+m.config.APIToken)
+	}
+	req.Header.Set("Accept", "application/json")
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("JIRA search failed: %w", err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("cannot read JIRA response: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Invalid queries are reported with status 400 and `{"errorMessages": [...]}`.
+		return nil, tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("JIRA search returned HTTP status code %d: %s", resp.StatusCode, data))
+	}
+	var result searchResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("cannot parse JIRA response: %v", err)
+	}
+	return &result, nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	return &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("JIRA issues matching %s", m.Query()),
+		DisplayName: m.Name,
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jira
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+)
+
+// newTestServer returns a JIRA site that accepts the given authorization header and responds to searches with the
+// given issues. Search parameters are recorded in `searches`.
+func newTestServer(auth string, total int, issues []string, searches *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rest/api/2/search" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != auth {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		*searches = append(*searches, fmt.Sprintf("%s %s %s %s %s", q.Get("jql"), q.Get("fields"), q.Get("startAt"), q.Get("maxResults"), r.Header.Get(requestid.Header)))
+		startAt, _ := strconv.Atoi(q.Get("startAt"))
+		maxResults, _ := strconv.Atoi(q.Get("maxResults"))
+		end := startAt + maxResults
+		if end > len(issues) {
+			end = len(issues)
+		}
+		page := "["
+		for i, issue := range issues[startAt:end] {
+			if i > 0 {
+				page += ","
+			}
+			page += issue
+		}
+		fmt.Fprintf(w, `{"startAt": %d, "maxResults": %d, "total": %d, "issues": %s]}`, startAt, maxResults, total, page)
+	}))
+}
+
+func TestStackdriverDataCount(t *testing.T) {
+	var searches []string
+	server := newTestServer("Basic b3BzQGFjbWUuY29tOnRva2Vu", 42, nil, &searches)
+	defer server.Close()
+
+	jql := "project = OPS AND resolution IS EMPTY"
+	m, err := NewSourceMetric("open_incidents", &MetricConfig{URL: server.URL + "/", JQL: jql, Username: "ops@acme.com", APIToken: "token"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, time.Now().Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if want := []string{jql + " -all 0 0 req-1"}; !reflect.DeepEqual(searches, want) {
+		t.Errorf("expected searches %v; got %v", want, searches)
+	}
+	if desc.Type != "custom.googleapis.com/jira/open_incidents" || len(desc.Labels) != 0 {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	if len(ts) != 1 || ts[0].Points[0].Value.GetDoubleValue() != 42 {
+		t.Errorf("expected a single point with value 42; got %v", ts)
+	}
+
+	// Points are only written once per second.
+	timeNow = func() time.Time { return time.Now().Truncate(time.Second) }
+	defer func() { timeNow = time.Now }()
+	if _, ts, err := m.StackdriverData(ctx, timeNow(), nil); err != nil || len(ts) != 0 {
+		t.Errorf("expected no points to be returned again; got %v, %v", ts, err)
+	}
+}
+
+func TestStackdriverDataSum(t *testing.T) {
+	pageSize = 2
+	defer func() { pageSize = 100 }()
+	var searches []string
+	server := newTestServer("Bearer token", 3, []string{
+		`{"key": "OPS-1", "fields": {"customfield_10016": 3}}`,
+		`{"key": "OPS-2", "fields": {"customfield_10016": null}}`,
+		`{"key": "OPS-3", "fields": {"customfield_10016": 0.5}}`,
+	}, &searches)
+	defer server.Close()
+
+	m, err := NewSourceMetric("story_points", &MetricConfig{URL: server.URL, JQL: "sprint in openSprints()", SumField: "customfield_10016", APIToken: "token"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	_, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if want := []string{
+		"sprint in openSprints() customfield_10016 0 2 ",
+		"sprint in openSprints() customfield_10016 2 2 ",
+	}; !reflect.DeepEqual(searches, want) {
+		t.Errorf("expected searches %v; got %v", want, searches)
+	}
+	if len(ts) != 1 || ts[0].Points[0].Value.GetDoubleValue() != 3.5 {
+		t.Errorf("expected a single point with value 3.5; got %v", ts)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		status    int
+		body      string
+		wantClass error
+	}{
+		{"invalid query", http.StatusBadRequest, `{"errorMessages": ["Field 'foo' does not exist."]}`, tserrors.ErrSourcePermanent},
+		{"unauthorized", http.StatusUnauthorized, ``, tserrors.ErrSourcePermanent},
+		{"rate limited", http.StatusTooManyRequests, ``, tserrors.ErrSourceTransient},
+		{"unavailable", http.StatusServiceUnavailable, ``, tserrors.ErrSourceTransient},
+		{"field not a number", http.StatusOK, `{"total": 1, "issues": [{"key": "OPS-1", "fields": {"customfield_10016": {"value": "a"}}}]}`, tserrors.ErrConfigInvalid},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+
+			m, err := NewSourceMetric("errors", &MetricConfig{URL: server.URL, JQL: "project = OPS", SumField: "customfield_10016", APIToken: "token"})
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, config := range []*MetricConfig{
+		{URL: "https://acme.atlassian.net", JQL: "project = OPS"},
+		{URL: "acme.atlassian.net", JQL: "project = OPS", APIToken: "token"},
+		{URL: "https://acme.atlassian.net", JQL: "project = OPS", SumField: "timeestimate, timespent", APIToken: "token"},
+	} {
+		if _, err := NewSourceMetric("invalid", config); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
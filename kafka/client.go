@@ -0,0 +1,432 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/ts-bridge/httpclient"
+	"github.com/google/ts-bridge/tserrors"
+)
+
+// Only the subset of the Kafka protocol needed to read offsets is implemented, using request versions supported by
+// brokers since Kafka 0.10.2, which avoids depending on a client library for a single source. See
+// https://kafka.apache.org/protocol.html.
+const (
+	apiListOffsets      = 2
+	apiMetadata         = 3
+	apiOffsetFetch      = 9
+	apiFindCoordinator  = 10
+	apiSASLHandshake    = 17
+	apiSASLAuthenticate = 36
+
+	clientID = "ts-bridge"
+
+	// maxResponseSize limits the size of received responses, so that a misbehaving broker cannot exhaust memory.
+	maxResponseSize = 16 << 20
+)
+
+// brokerError is an error code returned by a broker.
+type brokerError int16
+
+// Names of error codes returned while reading offsets. See the Kafka protocol guide for other codes.
+var errorNames = map[brokerError]string{
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_OR_FOLLOWER",
+	7:  "REQUEST_TIMED_OUT",
+	14: "COORDINATOR_LOAD_IN_PROGRESS",
+	15: "COORDINATOR_NOT_AVAILABLE",
+	16: "NOT_COORDINATOR",
+	29: "TOPIC_AUTHORIZATION_FAILED",
+	30: "GROUP_AUTHORIZATION_FAILED",
+	31: "CLUSTER_AUTHORIZATION_FAILED",
+	33: "UNSUPPORTED_SASL_MECHANISM",
+	35: "UNSUPPORTED_VERSION",
+	58: "SASL_AUTHENTICATION_FAILED",
+}
+
+func (e brokerError) Error() string {
+	if name, ok := errorNames[e]; ok {
+		return fmt.Sprintf("Kafka error %s (%d)", name, int16(e))
+	}
+	return fmt.Sprintf("Kafka error %d", int16(e))
+}
+
+// classify returns the error with a class: errors caused by leader elections and coordinator changes are
+// transient, while other errors (e.g. authorization failures) are permanent.
+func (e brokerError) classify(context string) error {
+	err := fmt.Errorf("%s: %w", context, e)
+	switch e {
+	case 3, 5, 6, 7, 14, 15, 16:
+		return tserrors.Wrap(tserrors.ErrSourceTransient, err)
+	}
+	return tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+}
+
+// conn is a connection to a Kafka broker.
+type conn struct {
+	nc            net.Conn
+	addr          string
+	correlationID int32
+}
+
+// dial connects to a broker and authenticates if SASL is configured. Reads and writes of the connection fail once
+// the deadline has passed.
+func dial(ctx context.Context, config *MetricConfig, addr string, deadline time.Time) (*conn, error) {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	nc, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("cannot connect to Kafka broker %s: %w", addr, err))
+	}
+	nc.SetDeadline(deadline)
+	if config.TLS {
+		tlsConfig, err := (&httpclient.Config{CAFile: config.CAFile}).TLSConfig()
+		if err != nil {
+			nc.Close()
+			return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConfig.ServerName = host
+		tc := tls.Client(nc, tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("TLS handshake with Kafka broker %s failed: %v", addr, err))
+		}
+		nc = tc
+	}
+	c := &conn{nc: nc, addr: addr}
+	if config.SASLUsername != "" {
+		if err := c.authenticate(config.SASLUsername, config.SASLPassword); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// authenticate performs SASL/PLAIN authentication.
+func (c *conn) authenticate(username, password string) error {
+	resp, err := c.request(apiSASLHandshake, 1, appendString(nil, "PLAIN"))
+	if err != nil {
+		return err
+	}
+	if code := brokerError(resp.int16()); code != 0 {
+		return code.classify(fmt.Sprintf("SASL handshake with %s failed", c.addr))
+	}
+	token := []byte("\x00" + username + "\x00" + password)
+	resp, err = c.request(apiSASLAuthenticate, 0, append(appendInt32(nil, int32(len(token))), token...))
+	if err != nil {
+		return err
+	}
+	if code := brokerError(resp.int16()); code != 0 {
+		return code.classify(fmt.Sprintf("SASL authentication with %s failed (%s)", c.addr, resp.nullableString()))
+	}
+	return resp.err
+}
+
+// request sends a request and returns a decoder of the response body.
+func (c *conn) request(apiKey, version int16, body []byte) (*decoder, error) {
+	c.correlationID++
+	header := appendInt16(nil, apiKey)
+	header = appendInt16(header, version)
+	header = appendInt32(header, c.correlationID)
+	header = appendString(header, clientID)
+	msg := appendInt32(nil, int32(len(header)+len(body)))
+	msg = append(append(msg, header...), body...)
+	if _, err := c.nc.Write(msg); err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("Kafka request to %s failed: %w", c.addr, err))
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(c.nc, size[:]); err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("Kafka request to %s failed: %w", c.addr, err))
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > maxResponseSize {
+		return nil, fmt.Errorf("invalid Kafka response size %d from %s", n, c.addr)
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(c.nc, resp); err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("Kafka request to %s failed: %w", c.addr, err))
+	}
+	d := &decoder{b: resp}
+	if id := d.int32(); id != c.correlationID {
+		return nil, fmt.Errorf("unexpected Kafka correlation ID %d from %s", id, c.addr)
+	}
+	return d, nil
+}
+
+func (c *conn) close() error {
+	return c.nc.Close()
+}
+
+// broker is a broker of the cluster.
+type broker struct {
+	id   int32
+	addr string
+}
+
+// partitionMetadata describes a partition of a topic.
+type partitionMetadata struct {
+	partition int32
+	leader    int32
+}
+
+// metadata returns the brokers of the cluster, and the partitions of the given topics. Topics that don't exist (e.g.
+// deleted topics whose committed offsets have not expired yet) are omitted.
+func (c *conn) metadata(topics []string) (map[int32]string, map[string][]partitionMetadata, error) {
+	body := appendInt32(nil, int32(len(topics)))
+	for _, t := range topics {
+		body = appendString(body, t)
+	}
+	d, err := c.request(apiMetadata, 1, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	brokers := make(map[int32]string)
+	for n := d.arrayLen(); n > 0; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.nullableString() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.int32() // controller ID
+	partitions := make(map[string][]partitionMetadata)
+	for n := d.arrayLen(); n > 0; n-- {
+		code := brokerError(d.int16())
+		topic := d.string()
+		d.int8() // is_internal
+		if code != 0 && code != 3 {
+			return nil, nil, code.classify(fmt.Sprintf("cannot read metadata of topic %s", topic))
+		}
+		for m := d.arrayLen(); m > 0; m-- {
+			d.int16() // partition error code, e.g. if there is no leader; checked when listing offsets.
+			p := partitionMetadata{partition: d.int32(), leader: d.int32()}
+			d.skipInt32Array() // replicas
+			d.skipInt32Array() // in-sync replicas
+			if code == 0 {
+				partitions[topic] = append(partitions[topic], p)
+			}
+		}
+	}
+	return brokers, partitions, d.err
+}
+
+// findCoordinator returns the address of the coordinator of a consumer group.
+func (c *conn) findCoordinator(group string) (string, error) {
+	d, err := c.request(apiFindCoordinator, 0, appendString(nil, group))
+	if err != nil {
+		return "", err
+	}
+	if code := brokerError(d.int16()); code != 0 {
+		return "", code.classify(fmt.Sprintf("cannot find coordinator of group %s", group))
+	}
+	d.int32() // node ID
+	host := d.string()
+	port := d.int32()
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), d.err
+}
+
+// topicPartition identifies a partition.
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// offsetFetch returns the committed offsets of a consumer group. Partitions without committed offsets are omitted.
+// Offsets of all topics are returned if no topics are given.
+func (c *conn) offsetFetch(group string, topics map[string][]int32) (map[topicPartition]int64, error) {
+	body := appendString(nil, group)
+	if topics == nil {
+		body = appendInt32(body, -1)
+	} else {
+		body = appendInt32(body, int32(len(topics)))
+		for t, partitions := range topics {
+			body = appendString(body, t)
+			body = appendInt32(body, int32(len(partitions)))
+			for _, p := range partitions {
+				body = appendInt32(body, p)
+			}
+		}
+	}
+	d, err := c.request(apiOffsetFetch, 2, body)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[topicPartition]int64)
+	for n := d.arrayLen(); n > 0; n-- {
+		topic := d.string()
+		for m := d.arrayLen(); m > 0; m-- {
+			partition := d.int32()
+			offset := d.int64()
+			d.nullableString() // metadata
+			if code := brokerError(d.int16()); code != 0 {
+				return nil, code.classify(fmt.Sprintf("cannot fetch offsets of group %s", group))
+			}
+			if offset >= 0 {
+				offsets[topicPartition{topic, partition}] = offset
+			}
+		}
+	}
+	if code := brokerError(d.int16()); code != 0 {
+		return nil, code.classify(fmt.Sprintf("cannot fetch offsets of group %s", group))
+	}
+	return offsets, d.err
+}
+
+// latestOffsets returns the offsets of the next messages written to the given partitions, which the broker needs
+// to lead.
+func (c *conn) latestOffsets(partitions []topicPartition) (map[topicPartition]int64, error) {
+	byTopic := make(map[string][]int32)
+	var topics []string
+	for _, p := range partitions {
+		if _, ok := byTopic[p.topic]; !ok {
+			topics = append(topics, p.topic)
+		}
+		byTopic[p.topic] = append(byTopic[p.topic], p.partition)
+	}
+	body := appendInt32(nil, -1) // replica ID of consumers
+	body = appendInt32(body, int32(len(topics)))
+	for _, t := range topics {
+		body = appendString(body, t)
+		body = appendInt32(body, int32(len(byTopic[t])))
+		for _, p := range byTopic[t] {
+			body = appendInt32(body, p)
+			body = appendInt64(body, -1) // latest offset
+		}
+	}
+	d, err := c.request(apiListOffsets, 1, body)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[topicPartition]int64)
+	for n := d.arrayLen(); n > 0; n-- {
+		topic := d.string()
+		for m := d.arrayLen(); m > 0; m-- {
+			partition := d.int32()
+			if code := brokerError(d.int16()); code != 0 {
+				return nil, code.classify(fmt.Sprintf("cannot list offsets of %s/%d on %s", topic, partition, c.addr))
+			}
+			d.int64() // timestamp
+			offsets[topicPartition{topic, partition}] = d.int64()
+		}
+	}
+	return offsets, d.err
+}
+
+// decoder reads fields of a response. Reading past the end of the response sets err and returns zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if n < 0 || n > len(d.b) {
+		if d.err == nil {
+			d.err = errors.New("truncated Kafka response")
+		}
+		d.b = nil
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) int8() int8 {
+	if v := d.next(1); v != nil {
+		return int8(v[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if v := d.next(2); v != nil {
+		return int16(binary.BigEndian.Uint16(v))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if v := d.next(4); v != nil {
+		return int32(binary.BigEndian.Uint32(v))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if v := d.next(8); v != nil {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.int16())))
+}
+
+func (d *decoder) nullableString() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// arrayLen returns the length of an array, which is 0 for null arrays.
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 || int(n) > len(d.b) {
+		if n > 0 {
+			d.next(-1)
+		}
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) skipInt32Array() {
+	d.next(4 * d.arrayLen())
+}
+
+func appendInt16(b []byte, v int16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendInt32(b []byte, v int32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendInt64(b []byte, v int64) []byte {
+	return appendInt32(appendInt32(b, int32(v>>32)), int32(v))
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendInt16(b, int16(len(s))), s...)
+}
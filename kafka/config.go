@@ -0,0 +1,120 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+const defaultTimeout = 30 * time.Second
+
+// MetricConfig defines the configuration file parameters for a specific metric with the lag of Kafka consumer groups.
+type MetricConfig struct {
+	// Brokers lists host:port addresses of brokers that the cluster is discovered from. Lag is read from Burrow
+	// instead if BurrowURL is set.
+	Brokers []string
+	// Groups lists the consumer groups whose lag is imported.
+	Groups []string `validate:"nonzero"`
+	// Topics optionally limits the imported lag to some topics. All topics with committed offsets are imported by
+	// default.
+	Topics []string
+	// Aggregation is `partition` (the default) to import the lag of each partition, or `topic` to import the sum of
+	// per-partition lag of each topic.
+	Aggregation string `validate:"regexp=^(|partition|topic)$"`
+
+	// TLS enables TLS connections to brokers, trusting certificates signed by the CAs in CAFile in addition to
+	// system CAs.
+	TLS    bool
+	CAFile string `yaml:"ca_file"`
+	// SASLUsername and SASLPassword enable SASL/PLAIN authentication with brokers.
+	SASLUsername string `yaml:"sasl_username"`
+	SASLPassword string `yaml:"sasl_password"`
+	// Timeout limits the time taken to read offsets from brokers.
+	Timeout time.Duration
+
+	// BurrowURL is the base URL of a Burrow server, e.g. http://burrow.corp:8000, and BurrowCluster the name of
+	// the Kafka cluster in Burrow.
+	BurrowURL     string `yaml:"burrow_url"`
+	BurrowCluster string `yaml:"burrow_cluster"`
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// The SASL password can also be read from a file, e.g. from a mounted Kubernetes secret.
+	SASLPasswordFile string `yaml:"sasl_password_file"`
+}
+
+// ReadSecretFiles sets the SASL password from the contents of the configured password file. Relative paths are
+// resolved relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.SASLPasswordFile == "" {
+		return nil
+	}
+	if c.SASLPassword != "" {
+		return fmt.Errorf("sasl_password and sasl_password_file cannot both be set")
+	}
+	password, err := env.ReadSecretFile(dir, c.SASLPasswordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read sasl_password_file: %v", err)
+	}
+	c.SASLPassword = password
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if (len(c.Brokers) == 0) == (c.BurrowURL == "") {
+		return fmt.Errorf("either brokers or burrow_url needs to be set")
+	}
+	if c.BurrowURL != "" {
+		u, err := url.Parse(c.BurrowURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("burrow_url needs to be an HTTP(S) URL")
+		}
+		if c.BurrowCluster == "" {
+			return fmt.Errorf("burrow_url requires burrow_cluster")
+		}
+		if c.TLS || c.CAFile != "" || c.SASLUsername != "" || c.SASLPassword != "" {
+			return fmt.Errorf("broker connection settings cannot be used with burrow_url; please use `http` settings")
+		}
+	}
+	for _, b := range c.Brokers {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			return fmt.Errorf("invalid broker address %q: %v", b, err)
+		}
+	}
+	if c.CAFile != "" && !c.TLS {
+		return fmt.Errorf("ca_file requires `tls: true`")
+	}
+	if (c.SASLUsername == "") != (c.SASLPassword == "") {
+		return fmt.Errorf("sasl_username and sasl_password need to be set together")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout cannot be negative")
+	}
+	return nil
+}
+
+func (c *MetricConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
@@ -0,0 +1,379 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kafka imports the lag of Kafka consumer groups, either computed from offsets read from brokers or read
+// from Burrow.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a metric with the lag of Kafka consumer groups. It implements the SourceMetric interface.
+type Metric struct {
+	Name       string
+	config     *MetricConfig
+	httpClient *http.Client
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{Name: name, config: config, httpClient: httpClient}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/kafka/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "kafka"
+}
+
+// SourceHost returns the host of Burrow or the first broker. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	if m.config.BurrowURL == "" {
+		return m.config.Brokers[0]
+	}
+	u, err := url.Parse(m.config.BurrowURL)
+	if err != nil || u.Host == "" {
+		return m.config.BurrowURL
+	}
+	return u.Host
+}
+
+// Query returns the consumer groups and topics of this metric.
+func (m *Metric) Query() string {
+	q := "lag of " + strings.Join(m.config.Groups, ", ")
+	if len(m.config.Topics) > 0 {
+		q += " on " + strings.Join(m.config.Topics, ", ")
+	}
+	return q
+}
+
+// lagKey identifies a time series. The partition is -1 if lag is aggregated per topic.
+type lagKey struct {
+	group     string
+	topic     string
+	partition int32
+}
+
+// StackdriverData reads the current lag of each consumer group, returning metric descriptor and time series of
+// each partition (or topic) with committed offsets. Offsets only reflect the current state, so a single point is
+// imported per sync.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	now := timeNow().Truncate(time.Second)
+	if !now.After(lastPoint) {
+		return nil, nil, nil
+	}
+	end, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", now, err)
+	}
+
+	var lags map[lagKey]int64
+	if m.config.BurrowURL != "" {
+		lags, err = m.burrowLag(ctx)
+	} else {
+		lags, err = m.brokerLag(ctx)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.config.Aggregation == "topic" {
+		perTopic := make(map[lagKey]int64)
+		for k, lag := range lags {
+			perTopic[lagKey{k.group, k.topic, -1}] += lag
+		}
+		lags = perTopic
+	}
+	log.WithContext(ctx).Debugf("Got %d lag values of Kafka consumer groups %v", len(lags), m.config.Groups)
+
+	keys := make([]lagKey, 0, len(lags))
+	for k := range lags {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.group != b.group {
+			return a.group < b.group
+		}
+		if a.topic != b.topic {
+			return a.topic < b.topic
+		}
+		return a.partition < b.partition
+	})
+	var ts []*monitoringpb.TimeSeries
+	for _, k := range keys {
+		labels := map[string]string{"group": k.group, "topic": k.topic}
+		if k.partition >= 0 {
+			labels["partition"] = strconv.Itoa(int(k.partition))
+		}
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: end},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: float64(lags[k])}},
+			}},
+		})
+	}
+	return m.metricDescriptor(), ts, nil
+}
+
+// included returns true if lag of a topic is imported.
+func (m *Metric) included(topic string) bool {
+	if len(m.config.Topics) == 0 {
+		return true
+	}
+	for _, t := range m.config.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// brokerLag computes lag from offsets committed by each group and the latest offsets of their partitions, which are
+// read from the coordinators of groups and the leaders of partitions respectively.
+func (m *Metric) brokerLag(ctx context.Context) (map[lagKey]int64, error) {
+	deadline := time.Now().Add(m.config.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conns := make(map[string]*conn)
+	defer func() {
+		for _, c := range conns {
+			c.close()
+		}
+	}()
+	connect := func(addr string) (*conn, error) {
+		if c, ok := conns[addr]; ok {
+			return c, nil
+		}
+		c, err := dial(ctx, m.config, addr, deadline)
+		if err != nil {
+			return nil, err
+		}
+		conns[addr] = c
+		return c, nil
+	}
+
+	var bootstrap *conn
+	var errs []string
+	for _, addr := range m.config.Brokers {
+		c, err := connect(addr)
+		if err == nil {
+			bootstrap = c
+			break
+		}
+		if !tserrors.Transient(err) {
+			// e.g. failed authentication, which other brokers would reject as well.
+			return nil, err
+		}
+		errs = append(errs, err.Error())
+	}
+	if bootstrap == nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourceTransient, fmt.Errorf("no Kafka broker responded: %s", strings.Join(errs, "; ")))
+	}
+
+	committed := make(map[string]map[topicPartition]int64)
+	topicSet := make(map[string]bool)
+	for _, group := range m.config.Groups {
+		addr, err := bootstrap.findCoordinator(group)
+		if err != nil {
+			return nil, err
+		}
+		coordinator, err := connect(addr)
+		if err != nil {
+			return nil, err
+		}
+		offsets, err := coordinator.offsetFetch(group, nil)
+		if err != nil {
+			return nil, err
+		}
+		for p := range offsets {
+			if !m.included(p.topic) {
+				delete(offsets, p)
+				continue
+			}
+			topicSet[p.topic] = true
+		}
+		committed[group] = offsets
+	}
+	if len(topicSet) == 0 {
+		return nil, nil
+	}
+
+	topics := make([]string, 0, len(topicSet))
+	for t := range topicSet {
+		topics = append(topics, t)
+	}
+	sort.Strings(topics)
+	brokers, partitions, err := bootstrap.metadata(topics)
+	if err != nil {
+		return nil, err
+	}
+	byLeader := make(map[int32][]topicPartition)
+	for _, t := range topics {
+		for _, p := range partitions[t] {
+			if p.leader < 0 {
+				return nil, tserrors.Wrap(tserrors.ErrSourceTransient, fmt.Errorf("partition %s/%d has no leader", t, p.partition))
+			}
+			byLeader[p.leader] = append(byLeader[p.leader], topicPartition{t, p.partition})
+		}
+	}
+	latest := make(map[topicPartition]int64)
+	for id, tps := range byLeader {
+		addr, ok := brokers[id]
+		if !ok {
+			return nil, tserrors.Wrap(tserrors.ErrSourceTransient, fmt.Errorf("leader %d of partitions %v is not a known broker", id, tps))
+		}
+		leader, err := connect(addr)
+		if err != nil {
+			return nil, err
+		}
+		offsets, err := leader.latestOffsets(tps)
+		if err != nil {
+			return nil, err
+		}
+		for p, o := range offsets {
+			latest[p] = o
+		}
+	}
+
+	lags := make(map[lagKey]int64)
+	for group, offsets := range committed {
+		for p, offset := range offsets {
+			end, ok := latest[p]
+			if !ok {
+				continue
+			}
+			lag := end - offset
+			if lag < 0 {
+				// The committed offset can be ahead of the latest offset read a moment earlier.
+				lag = 0
+			}
+			lags[lagKey{group, p.topic, p.partition}] = lag
+		}
+	}
+	return lags, nil
+}
+
+// burrowResponse is the response of Burrow's consumer lag endpoint.
+type burrowResponse struct {
+	Error   bool   `json:"error"`
+	Message string `json:"message"`
+	Status  struct {
+		Partitions []struct {
+			Topic      string `json:"topic"`
+			Partition  int32  `json:"partition"`
+			CurrentLag int64  `json:"current_lag"`
+		} `json:"partitions"`
+	} `json:"status"`
+}
+
+// burrowLag reads the current lag of each partition consumed by the groups from Burrow.
+func (m *Metric) burrowLag(ctx context.Context) (map[lagKey]int64, error) {
+	lags := make(map[lagKey]int64)
+	for _, group := range m.config.Groups {
+		u := fmt.Sprintf("%s/v3/kafka/%s/consumer/%s/lag", strings.TrimSuffix(m.config.BurrowURL, "/"),
+			url.PathEscape(m.config.BurrowCluster), url.PathEscape(group))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+		}
+		if id := requestid.FromContext(ctx); id != "" {
+			req.Header.Set(requestid.Header, id)
+		}
+		resp, err := m.httpClient.Do(req)
+		if err != nil {
+			return nil, tserrors.ClassifySource(fmt.Errorf("Burrow request failed: %w", err))
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, tserrors.ClassifySource(fmt.Errorf("cannot read Burrow response: %w", err))
+		}
+		if resp.StatusCode != http.StatusOK {
+			// Unknown clusters and groups are reported with status 404.
+			return nil, tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("Burrow returned HTTP status code %d for group %s: %s", resp.StatusCode, group, data))
+		}
+		var result burrowResponse
+		if err := json.Unmarshal(data, &result); err != nil {
+			return nil, fmt.Errorf("cannot parse Burrow response: %v", err)
+		}
+		if result.Error {
+			return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("Burrow error for group %s: %s", group, result.Message))
+		}
+		for _, p := range result.Status.Partitions {
+			if m.included(p.Topic) {
+				lags[lagKey{group, p.Topic, p.Partition}] = p.CurrentLag
+			}
+		}
+	}
+	return lags, nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Kafka consumer %s, in messages", m.Query()),
+		DisplayName: m.Name,
+		Labels: []*label.LabelDescriptor{
+			{Key: "group", ValueType: label.LabelDescriptor_STRING, Description: "Consumer group"},
+		},
+	}
+	if m.config.Aggregation != "topic" {
+		d.Labels = append(d.Labels, &label.LabelDescriptor{Key: "partition", ValueType: label.LabelDescriptor_STRING, Description: "Partition of the topic"})
+	}
+	d.Labels = append(d.Labels, &label.LabelDescriptor{Key: "topic", ValueType: label.LabelDescriptor_STRING, Description: "Consumed topic"})
+	return d
+}
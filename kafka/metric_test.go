@@ -0,0 +1,409 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testCluster is a Kafka cluster of two brokers. The first broker coordinates all groups. If SASL is enabled,
+// brokers accept user `ts_bridge` with password `secret`.
+type testCluster struct {
+	listeners []net.Listener
+	sasl      bool
+	committed map[string]map[topicPartition]int64
+	latest    map[topicPartition]int64
+	// leaders maps partitions to the index of their leader.
+	leaders map[topicPartition]int
+	// errorCodes are returned for FindCoordinator, OffsetFetch and ListOffsets requests.
+	errorCodes map[int16]int16
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func newTestCluster(t *testing.T) *testCluster {
+	c := &testCluster{
+		committed: map[string]map[topicPartition]int64{
+			"orders": {{"orders", 0}: 90, {"orders", 1}: 200},
+			// Offsets of deleted topics are kept until they expire.
+			"billing": {{"payments", 0}: 5, {"deleted", 0}: 10},
+		},
+		latest:  map[topicPartition]int64{{"orders", 0}: 100, {"orders", 1}: 250, {"payments", 0}: 5, {"refunds", 0}: 30},
+		leaders: map[topicPartition]int{{"orders", 0}: 0, {"orders", 1}: 1, {"payments", 0}: 1, {"refunds", 0}: 0},
+	}
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.listeners = append(c.listeners, ln)
+	}
+	for i, ln := range c.listeners {
+		go func(i int, ln net.Listener) {
+			for {
+				nc, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go c.serve(i, nc)
+			}
+		}(i, ln)
+	}
+	return c
+}
+
+func (c *testCluster) close() {
+	for _, ln := range c.listeners {
+		ln.Close()
+	}
+}
+
+func (c *testCluster) addr(i int) string {
+	return c.listeners[i].Addr().String()
+}
+
+// appendBroker appends the ID, host and port of a broker.
+func (c *testCluster) appendBroker(b []byte, i int) []byte {
+	host, port, _ := net.SplitHostPort(c.addr(i))
+	p, _ := strconv.Atoi(port)
+	return appendInt32(appendString(appendInt32(b, int32(i+1)), host), int32(p))
+}
+
+func (c *testCluster) serve(i int, nc net.Conn) {
+	defer nc.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(nc, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(nc, req); err != nil {
+			return
+		}
+		d := &decoder{b: req}
+		apiKey, version, id, client := d.int16(), d.int16(), d.int32(), d.string()
+		c.mu.Lock()
+		c.requests = append(c.requests, fmt.Sprintf("%d:%d v%d %s", i, apiKey, version, client))
+		c.mu.Unlock()
+
+		resp := c.handle(i, apiKey, d)
+		msg := appendInt32(appendInt32(nil, int32(len(resp)+4)), id)
+		if _, err := nc.Write(append(msg, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+func (c *testCluster) handle(i int, apiKey int16, d *decoder) []byte {
+	var b []byte
+	switch apiKey {
+	case apiSASLHandshake:
+		return appendString(appendInt32(appendInt16(nil, 0), 1), "PLAIN")
+	case apiSASLAuthenticate:
+		token := d.next(int(d.int32()))
+		if string(token) != "\x00ts_bridge\x00secret" {
+			return appendInt32(appendString(appendInt16(nil, 58), "Authentication failed: Invalid username or password"), 0)
+		}
+		return appendInt32(appendInt16(appendInt16(nil, 0), -1), 0)
+	case apiMetadata:
+		b = appendInt32(nil, 2)
+		for j := range c.listeners {
+			b = appendInt16(c.appendBroker(b, j), -1)
+		}
+		b = appendInt32(b, 1)
+		n := d.arrayLen()
+		b = appendInt32(b, int32(n))
+		for ; n > 0; n-- {
+			topic := d.string()
+			var partitions []topicPartition
+			for p := range c.leaders {
+				if p.topic == topic {
+					partitions = append(partitions, p)
+				}
+			}
+			code := int16(0)
+			if len(partitions) == 0 {
+				code = 3
+			}
+			b = append(appendString(appendInt16(b, code), topic), 0)
+			b = appendInt32(b, int32(len(partitions)))
+			for _, p := range partitions {
+				leader := int32(c.leaders[p] + 1)
+				b = appendInt32(appendInt32(appendInt16(b, 0), p.partition), leader)
+				b = appendInt32(appendInt32(b, 1), leader)
+				b = appendInt32(appendInt32(b, 1), leader)
+			}
+		}
+	case apiFindCoordinator:
+		d.string()
+		b = c.appendBroker(appendInt16(nil, c.errorCodes[apiKey]), 0)
+	case apiOffsetFetch:
+		group := d.string()
+		if d.int32() != -1 {
+			panic("expected offsets of all topics to be fetched")
+		}
+		if code := c.errorCodes[apiKey]; code != 0 {
+			return appendInt16(appendInt32(nil, 0), code)
+		}
+		byTopic := make(map[string][]topicPartition)
+		for p := range c.committed[group] {
+			byTopic[p.topic] = append(byTopic[p.topic], p)
+		}
+		b = appendInt32(nil, int32(len(byTopic)))
+		for topic, partitions := range byTopic {
+			b = appendInt32(appendString(b, topic), int32(len(partitions)))
+			for _, p := range partitions {
+				b = appendInt64(appendInt32(b, p.partition), c.committed[group][p])
+				b = appendInt16(appendInt16(b, -1), 0)
+			}
+		}
+		b = appendInt16(b, 0)
+	case apiListOffsets:
+		d.int32()
+		n := d.arrayLen()
+		b = appendInt32(nil, int32(n))
+		for ; n > 0; n-- {
+			topic := d.string()
+			m := d.arrayLen()
+			b = appendInt32(appendString(b, topic), int32(m))
+			for ; m > 0; m-- {
+				p := topicPartition{topic, d.int32()}
+				if d.int64() != -1 {
+					panic("expected latest offsets to be listed")
+				}
+				code := c.errorCodes[apiKey]
+				if c.leaders[p] != i {
+					code = 6
+				}
+				b = appendInt64(appendInt64(appendInt16(appendInt32(b, p.partition), code), -1), c.latest[p])
+			}
+		}
+	}
+	return b
+}
+
+// testSeries is a simplified representation of a time series written to Stackdriver.
+type testSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+func testPoints(ts []*monitoringpb.TimeSeries) []testSeries {
+	var series []testSeries
+	for _, s := range ts {
+		series = append(series, testSeries{s.Metric.Labels, s.Points[0].Value.GetDoubleValue()})
+	}
+	return series
+}
+
+func TestStackdriverDataBrokers(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	m, err := NewSourceMetric("consumer_lag", &MetricConfig{
+		Brokers:      []string{down.Addr().String(), cluster.addr(0)},
+		Groups:       []string{"orders", "billing"},
+		SASLUsername: "ts_bridge",
+		SASLPassword: "secret",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	desc, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	// Partitions of deleted topics are skipped.
+	want := []testSeries{
+		{map[string]string{"group": "billing", "topic": "payments", "partition": "0"}, 0},
+		{map[string]string{"group": "orders", "topic": "orders", "partition": "0"}, 10},
+		{map[string]string{"group": "orders", "topic": "orders", "partition": "1"}, 50},
+	}
+	if got := testPoints(ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected series %v; got %v", want, got)
+	}
+	if len(desc.Labels) != 3 || desc.Labels[0].Key != "group" || desc.Labels[1].Key != "partition" || desc.Labels[2].Key != "topic" {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// Each broker is connected to once, and authenticated with SASL.
+	var handshakes int
+	for _, r := range cluster.requests {
+		if strings.Contains(r, ":17 v1 ts-bridge") {
+			handshakes++
+		}
+	}
+	if handshakes != 2 {
+		t.Errorf("expected a SASL handshake with each broker; got requests %v", cluster.requests)
+	}
+
+	// Points are only written once per second.
+	timeNow = func() time.Time { return time.Now().Truncate(time.Second) }
+	defer func() { timeNow = time.Now }()
+	if _, ts, err := m.StackdriverData(context.Background(), timeNow(), nil); err != nil || len(ts) != 0 {
+		t.Errorf("expected no points to be returned again; got %v, %v", ts, err)
+	}
+}
+
+func TestStackdriverDataAggregation(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.close()
+
+	m, err := NewSourceMetric("topic_lag", &MetricConfig{Brokers: []string{cluster.addr(1)}, Groups: []string{"orders", "billing"}, Topics: []string{"orders"}, Aggregation: "topic"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	desc, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if want := []testSeries{{map[string]string{"group": "orders", "topic": "orders"}, 60}}; !reflect.DeepEqual(testPoints(ts), want) {
+		t.Errorf("expected series %v; got %v", want, testPoints(ts))
+	}
+	if len(desc.Labels) != 2 {
+		t.Errorf("expected no partition label; got %v", desc.Labels)
+	}
+}
+
+func TestStackdriverDataBrokerErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc       string
+		errorCodes map[int16]int16
+		password   string
+		wantClass  error
+	}{
+		{"coordinator not available", map[int16]int16{apiFindCoordinator: 15}, "", tserrors.ErrSourceTransient},
+		{"group authorization failed", map[int16]int16{apiOffsetFetch: 30}, "", tserrors.ErrSourcePermanent},
+		{"not leader", map[int16]int16{apiListOffsets: 6}, "", tserrors.ErrSourceTransient},
+		{"wrong SASL password", nil, "wrong", tserrors.ErrSourcePermanent},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			cluster := newTestCluster(t)
+			cluster.errorCodes = tt.errorCodes
+			defer cluster.close()
+
+			config := &MetricConfig{Brokers: []string{cluster.addr(0)}, Groups: []string{"orders"}}
+			if tt.password != "" {
+				config.SASLUsername, config.SASLPassword = "ts_bridge", tt.password
+			}
+			m, err := NewSourceMetric("errors", config)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+	m, err := NewSourceMetric("unreachable", &MetricConfig{Brokers: []string{down.Addr().String()}, Groups: []string{"orders"}})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	if _, _, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil); !errors.Is(err, tserrors.ErrSourceTransient) {
+		t.Errorf("expected unreachable brokers to be a transient error; got %v", err)
+	}
+}
+
+func TestStackdriverDataBurrow(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path+" "+r.Header.Get(requestid.Header))
+		switch r.URL.Path {
+		case "/v3/kafka/prod/consumer/orders/lag":
+			fmt.Fprint(w, `{"error": false, "message": "consumer status returned", "status": {"cluster": "prod", "group": "orders", "status": "WARN",
+				"partitions": [
+					{"topic": "orders", "partition": 0, "status": "OK", "end": {"offset": 100, "lag": 10}, "current_lag": 12},
+					{"topic": "orders", "partition": 1, "status": "WARN", "end": {"offset": 250, "lag": 50}, "current_lag": 50},
+					{"topic": "refunds", "partition": 0, "status": "OK", "current_lag": 3}
+				], "maxlag": null, "totallag": 65}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error": true, "message": "cluster or consumer not found", "request": {}}`)
+		}
+	}))
+	defer server.Close()
+
+	config := &MetricConfig{BurrowURL: server.URL + "/", BurrowCluster: "prod", Groups: []string{"orders"}, Topics: []string{"orders"}}
+	m, err := NewSourceMetric("burrow_lag", config)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	_, ts, err := m.StackdriverData(requestid.NewContext(context.Background(), "req-1"), time.Now().Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if want := []string{"/v3/kafka/prod/consumer/orders/lag req-1"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected requests %v; got %v", want, paths)
+	}
+	want := []testSeries{
+		{map[string]string{"group": "orders", "topic": "orders", "partition": "0"}, 12},
+		{map[string]string{"group": "orders", "topic": "orders", "partition": "1"}, 50},
+	}
+	if got := testPoints(ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected series %v; got %v", want, got)
+	}
+
+	config.Groups = []string{"unknown"}
+	if _, _, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil); !errors.Is(err, tserrors.ErrSourcePermanent) {
+		t.Errorf("expected an unknown group to be a permanent error; got %v", err)
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, config := range []*MetricConfig{
+		{Groups: []string{"orders"}},
+		{Brokers: []string{"kafka.corp:9092"}, BurrowURL: "http://burrow.corp:8000", BurrowCluster: "prod", Groups: []string{"orders"}},
+		{BurrowURL: "http://burrow.corp:8000", Groups: []string{"orders"}},
+		{BurrowURL: "burrow.corp:8000", BurrowCluster: "prod", Groups: []string{"orders"}},
+		{BurrowURL: "http://burrow.corp:8000", BurrowCluster: "prod", Groups: []string{"orders"}, TLS: true},
+		{Brokers: []string{"kafka.corp"}, Groups: []string{"orders"}},
+		{Brokers: []string{"kafka.corp:9092"}, Groups: []string{"orders"}, SASLUsername: "ts_bridge"},
+		{Brokers: []string{"kafka.corp:9092"}, Groups: []string{"orders"}, CAFile: "ca.pem"},
+	} {
+		if _, err := NewSourceMetric("invalid", config); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
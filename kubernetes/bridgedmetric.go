@@ -0,0 +1,89 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BridgedMetric is a custom resource defining a single imported metric.
+type BridgedMetric struct {
+	Metadata struct {
+		Name       string `json:"name"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	// Spec has the same parameters as a metric in the configuration file, along with the `source` parameter
+	// that names the metric source (e.g. "datadog").
+	Spec map[string]interface{} `json:"spec"`
+}
+
+// BridgedMetricStatus is the status subresource of a BridgedMetric, updated after each sync.
+type BridgedMetricStatus struct {
+	ObservedGeneration int64      `json:"observedGeneration"`
+	LastSync           time.Time  `json:"lastSync"`
+	LastImport         *time.Time `json:"lastImport,omitempty"`
+	Points             int        `json:"points"`
+	Error              string     `json:"error"`
+}
+
+// MetricName returns the name of the imported metric. Kubernetes resource names can contain dashes and dots,
+// which are replaced with underscores.
+func (m *BridgedMetric) MetricName() string {
+	return strings.NewReplacer("-", "_", ".", "_").Replace(m.Metadata.Name)
+}
+
+// Source returns the name of the metric source configured in the spec.
+func (m *BridgedMetric) Source() string {
+	s, _ := m.Spec["source"].(string)
+	return s
+}
+
+// Params returns metric parameters from the spec (everything but `source`) as a JSON document.
+func (m *BridgedMetric) Params() ([]byte, error) {
+	params := make(map[string]interface{}, len(m.Spec))
+	for k, v := range m.Spec {
+		if k != "source" {
+			params[k] = v
+		}
+	}
+	return json.Marshal(params)
+}
+
+// ListBridgedMetrics returns all BridgedMetric resources in the namespace of the client.
+func (c *Client) ListBridgedMetrics(ctx context.Context) ([]*BridgedMetric, error) {
+	var list struct {
+		Items []*BridgedMetric `json:"items"`
+	}
+	if err := c.do(ctx, "GET", c.resourceURL(""), "", nil, &list); err != nil {
+		return nil, fmt.Errorf("cannot list BridgedMetric resources: %v", err)
+	}
+	return list.Items, nil
+}
+
+// UpdateStatus replaces the status of a BridgedMetric resource.
+func (c *Client) UpdateStatus(ctx context.Context, name string, status *BridgedMetricStatus) error {
+	patch, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	if err := c.do(ctx, "PATCH", c.resourceURL(name)+"/status", "application/merge-patch+json", patch, nil); err != nil {
+		return fmt.Errorf("cannot update status of BridgedMetric %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kubernetes
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const bridgedMetricList = `{
+  "apiVersion": "tsbridge.google.com/v1alpha1",
+  "kind": "BridgedMetricList",
+  "items": [{
+    "metadata": {"name": "system-load.avg", "generation": 3},
+    "spec": {"source": "datadog", "destination": "stackdriver", "query": "avg:system.load.1{*}"}
+  }]
+}`
+
+func TestListBridgedMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apis/tsbridge.google.com/v1alpha1/namespaces/ns/bridgedmetrics" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("expected bearer token to be sent; got '%s'", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(bridgedMetricList))
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL, "ns", "token", server.Client())
+	metrics, err := c.ListBridgedMetrics(context.Background())
+	if err != nil {
+		t.Fatalf("ListBridgedMetrics() returned error: %v", err)
+	}
+	if len(metrics) != 1 {
+		t.Fatalf("ListBridgedMetrics() returned %d metrics; want 1", len(metrics))
+	}
+	m := metrics[0]
+	if m.MetricName() != "system_load_avg" || m.Source() != "datadog" || m.Metadata.Generation != 3 {
+		t.Errorf("unexpected metric %s (source %s, generation %d)", m.MetricName(), m.Source(), m.Metadata.Generation)
+	}
+	params, err := m.Params()
+	if err != nil {
+		t.Fatalf("Params() returned error: %v", err)
+	}
+	if want := `{"destination":"stackdriver","query":"avg:system.load.1{*}"}`; string(params) != want {
+		t.Errorf("Params() returned %s; want %s", params, want)
+	}
+
+	c.Namespace = "other"
+	if _, err := c.ListBridgedMetrics(context.Background()); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected ListBridgedMetrics() to fail with 404; got %v", err)
+	}
+}
+
+func TestUpdateStatus(t *testing.T) {
+	var body map[string]*BridgedMetricStatus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PATCH" || r.URL.Path != "/apis/tsbridge.google.com/v1alpha1/namespaces/ns/bridgedmetrics/foo/status" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Content-Type"); got != "application/merge-patch+json" {
+			t.Errorf("expected a merge patch; got '%s'", got)
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Errorf("cannot parse request body: %v", err)
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL, "ns", "", server.Client())
+	now := time.Now().Truncate(time.Second)
+	if err := c.UpdateStatus(context.Background(), "foo", &BridgedMetricStatus{LastSync: now, Points: 5, Error: "oops"}); err != nil {
+		t.Fatalf("UpdateStatus() returned error: %v", err)
+	}
+	got := body["status"]
+	if got == nil || !got.LastSync.Equal(now) || got.Points != 5 || got.Error != "oops" || got.LastImport != nil {
+		t.Errorf("unexpected status sent: %+v", got)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kubernetes implements the controller mode of ts-bridge, in which imported metrics are defined as
+// BridgedMetric custom resources. It uses the Kubernetes REST API directly, and only supports running in a pod.
+package kubernetes
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Group, version and plural name of the BridgedMetric custom resource. See crd.yaml.
+const (
+	Group    = "tsbridge.google.com"
+	Version  = "v1alpha1"
+	Resource = "bridgedmetrics"
+)
+
+// serviceAccountDir is where Kubernetes mounts service account credentials in every pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// Client is a minimal Kubernetes API client for BridgedMetric resources in a single namespace.
+type Client struct {
+	BaseURL   string
+	Namespace string
+	token     string
+	http      *http.Client
+}
+
+// NewInClusterClient creates a client using the service account of the pod ts-bridge is running in. If `namespace`
+// is empty, the namespace of the pod is used.
+func NewInClusterClient(namespace string) (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT need to be set")
+	}
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read service account token: %v", err)
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read cluster CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in cluster CA certificate")
+	}
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine pod namespace: %v", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	return &Client{
+		BaseURL:   "https://" + host + ":" + port,
+		Namespace: namespace,
+		token:     strings.TrimSpace(string(token)),
+		http: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// NewClient creates a client for an API server at a given URL. It's mostly useful for tests.
+func NewClient(baseURL, namespace, token string, c *http.Client) *Client {
+	return &Client{BaseURL: baseURL, Namespace: namespace, token: token, http: c}
+}
+
+// resourceURL returns the URL of a BridgedMetric resource, or of the resource collection if `name` is empty.
+func (c *Client) resourceURL(name string) string {
+	u := fmt.Sprintf("%s/apis/%s/%s/namespaces/%s/%s", c.BaseURL, Group, Version, c.Namespace, Resource)
+	if name != "" {
+		u += "/" + name
+	}
+	return u
+}
+
+// do sends a request to the API server, and decodes the JSON response into `out` unless it's nil.
+func (c *Client) do(ctx context.Context, method, url, contentType string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: received status code %d: %s", method, url, resp.StatusCode, data)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
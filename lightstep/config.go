@@ -0,0 +1,80 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lightstep
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// defaultEndpoint is the base URL of the Lightstep public API.
+const defaultEndpoint = "https://api.lightstep.com"
+
+// defaultOutputPeriod is the interval between points returned by queries, unless configured.
+const defaultOutputPeriod = time.Minute
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Lightstep.
+type MetricConfig struct {
+	// Query is a UQL query, e.g. `spans latency | delta | filter service == "web" | group_by [], sum | point percentile(value, 99)`.
+	Query        string `validate:"nonzero"`
+	Organization string `validate:"nonzero"`
+	Project      string `validate:"nonzero"`
+	APIKey       string `yaml:"api_key" validate:"nonzero"`
+	// Endpoint overrides the base URL of the Lightstep API, e.g. for a different region.
+	Endpoint string
+	// OutputPeriod is the interval between points returned by the query.
+	OutputPeriod time.Duration `yaml:"output_period"`
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// The API key can also be read from a file, e.g. from a mounted Kubernetes secret.
+	APIKeyFile string `yaml:"api_key_file"`
+}
+
+// ReadSecretFiles sets the API key from the contents of the configured key file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.APIKeyFile == "" {
+		return nil
+	}
+	if c.APIKey != "" {
+		return fmt.Errorf("api_key and api_key_file cannot both be set")
+	}
+	key, err := env.ReadSecretFile(dir, c.APIKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read api_key_file: %v", err)
+	}
+	c.APIKey = key
+	return nil
+}
+
+// endpoint returns the base URL of the Lightstep API.
+func (c *MetricConfig) endpoint() string {
+	if c.Endpoint != "" {
+		return c.Endpoint
+	}
+	return defaultEndpoint
+}
+
+// outputPeriod returns the interval between points returned by the query.
+func (c *MetricConfig) outputPeriod() time.Duration {
+	if c.OutputPeriod > 0 {
+		return c.OutputPeriod
+	}
+	return defaultOutputPeriod
+}
@@ -0,0 +1,264 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lightstep imports the results of UQL queries from the Lightstep (ServiceNow Cloud Observability)
+// timeseries query API.
+package lightstep
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a Lightstep-based metric. It implements the SourceMetric interface.
+type Metric struct {
+	Name        string
+	config      *MetricConfig
+	httpClient  *http.Client
+	minPointAge time.Duration
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig, minPointAge time.Duration) (*Metric, error) {
+	if config.OutputPeriod < 0 || config.OutputPeriod%time.Second != 0 {
+		return nil, fmt.Errorf("output_period of metric %s needs to be a positive number of seconds", name)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:        name,
+		config:      config,
+		httpClient:  httpClient,
+		minPointAge: minPointAge,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/lightstep/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "lightstep"
+}
+
+// SourceHost returns the host of the Lightstep API. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.endpoint())
+	if err != nil || u.Host == "" {
+		return m.config.endpoint()
+	}
+	return u.Host
+}
+
+// Query returns the UQL query of this metric.
+func (m *Metric) Query() string {
+	return m.config.Query
+}
+
+// StackdriverData queries Lightstep, returning metric descriptor and time series data with points after the given
+// lastPoint timestamp.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	return m.StackdriverDataUntil(ctx, lastPoint, time.Time{}, rec)
+}
+
+// Windowed returns whether the metric can be queried in windows, which is always the case for Lightstep metrics.
+func (m *Metric) Windowed() bool {
+	return true
+}
+
+// series is a single time series returned by the timeseries query API. Group labels are formatted as `key=value`,
+// and points are pairs of a timestamp (in seconds) and a value, which is null if there is no data.
+type series struct {
+	GroupLabels []string      `json:"group-labels"`
+	Points      [][2]*float64 `json:"points"`
+}
+
+// StackdriverDataUntil works like StackdriverData, but only queries points up to `until`, unless it's zero.
+func (m *Metric) StackdriverDataUntil(ctx context.Context, lastPoint, until time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	// Spans are ingested with a delay, so the latest points are only imported once they are old enough.
+	end := timeNow().Add(-m.minPointAge)
+	if !until.IsZero() && until.Before(end) {
+		end = until
+	}
+	if !end.After(lastPoint) {
+		return nil, nil, nil
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"data": map[string]interface{}{
+			"attributes": map[string]interface{}{
+				"query":          m.config.Query,
+				"input-language": "uql",
+				"oldest-time":    lastPoint.UTC().Format(time.RFC3339),
+				"youngest-time":  end.UTC().Format(time.RFC3339),
+				"output-period":  int64(m.config.outputPeriod() / time.Second),
+			},
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	u := fmt.Sprintf("%s/public/v0.2/%s/projects/%s/telemetry/query_timeseries", strings.TrimSuffix(m.config.endpoint(), "/"),
+		url.PathEscape(m.config.Organization), url.PathEscape(m.config.Project))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+m.config.APIKey)
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, tserrors.ClassifySource(fmt.Errorf("Lightstep query failed: %w", err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, tserrors.ClassifySource(fmt.Errorf("cannot read Lightstep response: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("Lightstep query returned HTTP status code %d: %s", resp.StatusCode, data))
+	}
+	var result struct {
+		Data struct {
+			Attributes struct {
+				Series []series `json:"series"`
+			} `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse Lightstep response: %v", err)
+	}
+	s := result.Data.Attributes.Series
+	log.WithContext(ctx).Debugf("Got %d Lightstep series for query %s", len(s), m.config.Query)
+
+	ts, keys, err := m.convertSeries(s, lastPoint, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m.metricDescriptor(keys), ts, nil
+}
+
+// convertSeries converts Lightstep series into Stackdriver time series with a single point each, keeping points
+// after `lastPoint` and up to `end`. It also returns the sorted keys of labels of all series.
+func (m *Metric) convertSeries(series []series, lastPoint, end time.Time) ([]*monitoringpb.TimeSeries, []string, error) {
+	var ts []*monitoringpb.TimeSeries
+	keys := make(map[string]bool)
+	for _, s := range series {
+		labels := make(map[string]string)
+		for _, kv := range s.GroupLabels {
+			i := strings.Index(kv, "=")
+			if i <= 0 {
+				return nil, nil, fmt.Errorf("invalid Lightstep group label '%s'", kv)
+			}
+			key := labelKey(kv[:i])
+			labels[key] = kv[i+1:]
+			keys[key] = true
+		}
+		for _, p := range s.Points {
+			if p[0] == nil || p[1] == nil {
+				continue
+			}
+			t := time.Unix(int64(*p[0]), 0)
+			if !t.After(lastPoint) || t.After(end) {
+				continue
+			}
+			et, err := ptypes.TimestampProto(t)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", t, err)
+			}
+			ts = append(ts, &monitoringpb.TimeSeries{
+				Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels},
+				Resource:   &monitoredres.MonitoredResource{Type: "global"},
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+				Points: []*monitoringpb.Point{{
+					Interval: &monitoringpb.TimeInterval{EndTime: et},
+					Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: *p[1]}},
+				}},
+			})
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	return ts, sorted, nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric, with the given label keys.
+func (m *Metric) metricDescriptor(keys []string) *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Lightstep query: %s", m.config.Query),
+		DisplayName: m.Name,
+	}
+	for _, k := range keys {
+		d.Labels = append(d.Labels, &label.LabelDescriptor{
+			Key:         k,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "Lightstep group label",
+		})
+	}
+	return d
+}
+
+// invalidLabelChars matches characters that are not allowed in Stackdriver label keys.
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9_]`)
+
+// labelKey converts a Lightstep attribute name (e.g. "http.status_code") into a valid Stackdriver label key.
+// See https://cloud.google.com/monitoring/api/v3/naming-conventions
+func labelKey(attr string) string {
+	key := invalidLabelChars.ReplaceAllString(strings.ToLower(attr), "_")
+	if key == "" || key[0] < 'a' || key[0] > 'z' {
+		key = "label_" + key
+	}
+	if len(key) > 100 {
+		key = key[:100]
+	}
+	return key
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lightstep
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	labels map[string]string
+	offset time.Duration // relative to the start of a test.
+	value  float64
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, testPoint{s.Metric.Labels, end.Sub(start), s.Points[0].Value.GetDoubleValue()})
+	}
+	return points
+}
+
+func TestStackdriverData(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(5 * time.Minute) }
+
+	var path, auth, requestID string
+	var attrs map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path, auth, requestID = r.URL.Path, r.Header.Get("Authorization"), r.Header.Get(requestid.Header)
+		var body struct {
+			Data struct {
+				Attributes map[string]interface{} `json:"attributes"`
+			} `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		attrs = body.Data.Attributes
+		s := start.Unix()
+		fmt.Fprintf(w, `{"data": {"attributes": {"series": [
+			{"group-labels": ["service=web", "http.status_code=500"], "points": [[%d, 1], [%d, 2.5], [%d, null], [%d, 4]]},
+			{"group-labels": ["service=api", "http.status_code=500"], "points": [[%d, 7]]}
+		]}}}`, s, s+60, s+120, s+240, s+180)
+	}))
+	defer server.Close()
+
+	query := `spans count | delta | filter error == true | group_by [service, "http.status_code"], sum`
+	m, err := NewSourceMetric("errors", &MetricConfig{
+		Query:        query,
+		Organization: "corp",
+		Project:      "prod",
+		APIKey:       "secret",
+		Endpoint:     server.URL + "/",
+		OutputPeriod: 30 * time.Second,
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if path != "/public/v0.2/corp/projects/prod/telemetry/query_timeseries" {
+		t.Errorf("unexpected request path %s", path)
+	}
+	if auth != "Bearer secret" || requestID != "req-1" {
+		t.Errorf("unexpected Authorization header %q or request ID %q", auth, requestID)
+	}
+	wantAttrs := map[string]interface{}{
+		"query":          query,
+		"input-language": "uql",
+		"oldest-time":    start.UTC().Format(time.RFC3339),
+		"youngest-time":  start.Add(4 * time.Minute).UTC().Format(time.RFC3339),
+		"output-period":  float64(30),
+	}
+	if !reflect.DeepEqual(attrs, wantAttrs) {
+		t.Errorf("expected query attributes %v; got %v", wantAttrs, attrs)
+	}
+	if desc.Type != "custom.googleapis.com/lightstep/errors" || len(desc.Labels) != 2 ||
+		desc.Labels[0].Key != "http_status_code" || desc.Labels[1].Key != "service" {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// The point at the start has already been imported, and the null point is skipped.
+	web := map[string]string{"service": "web", "http_status_code": "500"}
+	api := map[string]string{"service": "api", "http_status_code": "500"}
+	want := []testPoint{
+		{web, time.Minute, 2.5},
+		{web, 4 * time.Minute, 4},
+		{api, 3 * time.Minute, 7},
+	}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataUntil(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	var youngest string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Data struct {
+				Attributes struct {
+					YoungestTime string `json:"youngest-time"`
+				} `json:"attributes"`
+			} `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		youngest = body.Data.Attributes.YoungestTime
+		fmt.Fprintf(w, `{"data": {"attributes": {"series": [{"points": [[%d, 1], [%d, 2]]}]}}}`,
+			start.Add(time.Minute).Unix(), start.Add(3*time.Minute).Unix())
+	}))
+	defer server.Close()
+
+	m, err := NewSourceMetric("latency", &MetricConfig{Query: "q", Organization: "corp", Project: "prod", APIKey: "secret", Endpoint: server.URL}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	until := start.Add(2 * time.Minute)
+	desc, ts, err := m.StackdriverDataUntil(context.Background(), start, until, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverDataUntil: %v", err)
+	}
+	if youngest != until.UTC().Format(time.RFC3339) {
+		t.Errorf("expected points to be queried until %v; got %s", until, youngest)
+	}
+	if len(desc.Labels) != 0 {
+		t.Errorf("expected no labels for an ungrouped query; got %v", desc.Labels)
+	}
+	want := []testPoint{{map[string]string{}, time.Minute, 1}}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		status    int
+		body      string
+		wantClass error
+	}{
+		{"invalid API key", http.StatusUnauthorized, "", tserrors.ErrSourcePermanent},
+		{"invalid query", http.StatusBadRequest, `{"errors": ["invalid UQL"]}`, tserrors.ErrSourcePermanent},
+		{"rate limited", http.StatusTooManyRequests, "", tserrors.ErrSourceTransient},
+		{"server unavailable", http.StatusServiceUnavailable, "", tserrors.ErrSourceTransient},
+		{"invalid group label", http.StatusOK, `{"data": {"attributes": {"series": [{"group-labels": ["service"]}]}}}`, nil},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			m, err := NewSourceMetric("errors", &MetricConfig{Query: "q", Organization: "corp", Project: "prod", APIKey: "secret", Endpoint: server.URL}, 0)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+			if err == nil {
+				t.Fatalf("expected StackdriverData to fail")
+			}
+			if tt.wantClass != nil && !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestNewSourceMetricOutputPeriod(t *testing.T) {
+	if _, err := NewSourceMetric("latency", &MetricConfig{OutputPeriod: 1500 * time.Millisecond}, 0); err == nil {
+		t.Errorf("expected NewSourceMetric to reject an output period that is not a whole number of seconds")
+	}
+}
+
+func TestLabelKey(t *testing.T) {
+	for in, want := range map[string]string{
+		"service":          "service",
+		"http.status_code": "http_status_code",
+		"Customer-ID":      "customer_id",
+		"1st":              "label_1st",
+	} {
+		if got := labelKey(in); got != want {
+			t.Errorf("labelKey(%s) = %s; want %s", in, got, want)
+		}
+	}
+}
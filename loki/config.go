@@ -0,0 +1,83 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loki
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// defaultStep is the interval between evaluations of a query, unless configured.
+const defaultStep = time.Minute
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Loki.
+type MetricConfig struct {
+	// Endpoint is the base URL of Loki, e.g. http://loki.monitoring:3100.
+	Endpoint string `validate:"nonzero"`
+	// Query is a LogQL metric query, e.g. `sum by (status) (rate({app="web"} |= "error" [5m]))`.
+	Query string `validate:"nonzero"`
+	// Step is the interval between evaluations of the query, and thus between imported points.
+	Step time.Duration
+	// Tenant is sent in the X-Scope-OrgID header to multi-tenant Loki installations.
+	Tenant string
+
+	// Username and Password are used for basic authentication, e.g. with Grafana Cloud.
+	Username string
+	Password string
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// The password can also be read from a file, e.g. from a mounted Kubernetes secret.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// ReadSecretFiles sets the password from the contents of the configured password file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.PasswordFile == "" {
+		return nil
+	}
+	if c.Password != "" {
+		return fmt.Errorf("password and password_file cannot both be set")
+	}
+	password, err := env.ReadSecretFile(dir, c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read password_file: %v", err)
+	}
+	c.Password = password
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if c.Step < 0 || c.Step%time.Second != 0 {
+		return fmt.Errorf("step needs to be a positive number of seconds")
+	}
+	if c.Password != "" && c.Username == "" {
+		return fmt.Errorf("password requires a username")
+	}
+	return nil
+}
+
+// step returns the interval between evaluations of the query.
+func (c *MetricConfig) step() time.Duration {
+	if c.Step > 0 {
+		return c.Step
+	}
+	return defaultStep
+}
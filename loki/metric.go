@@ -0,0 +1,255 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loki imports the results of LogQL metric queries from Grafana Loki, so that SLIs derived from logs can be
+// used in Stackdriver.
+package loki
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a Loki-based metric. It implements the SourceMetric interface.
+type Metric struct {
+	Name        string
+	config      *MetricConfig
+	httpClient  *http.Client
+	minPointAge time.Duration
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig, minPointAge time.Duration) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:        name,
+		config:      config,
+		httpClient:  httpClient,
+		minPointAge: minPointAge,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/loki/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "loki"
+}
+
+// SourceHost returns the host of the Loki endpoint. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.Endpoint)
+	if err != nil || u.Host == "" {
+		return m.config.Endpoint
+	}
+	return u.Host
+}
+
+// Query returns the LogQL query of this metric.
+func (m *Metric) Query() string {
+	return m.config.Query
+}
+
+// StackdriverData queries Loki, returning metric descriptor and time series data with points after the given
+// lastPoint timestamp.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	return m.StackdriverDataUntil(ctx, lastPoint, time.Time{}, rec)
+}
+
+// Windowed returns whether the metric can be queried in windows, which is always the case for Loki metrics.
+func (m *Metric) Windowed() bool {
+	return true
+}
+
+// queryResult is the result of a range query. Metric queries return a matrix of series with `[timestamp, "value"]`
+// pairs, where timestamps are in (fractional) seconds.
+type queryResult struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string    `json:"metric"`
+			Values [][2]json.RawMessage `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+	Error string `json:"error"`
+}
+
+// StackdriverDataUntil works like StackdriverData, but only queries points up to `until`, unless it's zero.
+// Queries are evaluated at multiples of the step, so that points are at the same timestamps regardless of the time
+// range they are queried in.
+func (m *Metric) StackdriverDataUntil(ctx context.Context, lastPoint, until time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	step := m.config.step()
+	end := timeNow().Add(-m.minPointAge)
+	if !until.IsZero() && until.Before(end) {
+		end = until
+	}
+	start := lastPoint.Truncate(step).Add(step)
+	end = end.Truncate(step)
+	if end.Before(start) {
+		return nil, nil, nil
+	}
+
+	params := url.Values{}
+	params.Set("query", m.config.Query)
+	params.Set("start", strconv.FormatInt(start.UnixNano(), 10))
+	params.Set("end", strconv.FormatInt(end.UnixNano(), 10))
+	params.Set("step", strconv.FormatInt(int64(step/time.Second), 10))
+	params.Set("direction", "forward")
+	u := fmt.Sprintf("%s/loki/api/v1/query_range?%s", strings.TrimSuffix(m.config.Endpoint, "/"), params.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	if m.config.Username != "" {
+		req.SetBasicAuth(m.config.Username, m.config.Password)
+	}
+	if m.config.Tenant != "" {
+		req.Header.Set("X-Scope-OrgID", m.config.Tenant)
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, tserrors.ClassifySource(fmt.Errorf("Loki query failed: %w", err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, tserrors.ClassifySource(fmt.Errorf("cannot read Loki response: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("Loki query returned HTTP status code %d: %s", resp.StatusCode, strings.TrimSpace(string(data))))
+	}
+	var result queryResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse Loki response: %v", err)
+	}
+	if result.Status != "success" {
+		return nil, nil, fmt.Errorf("Loki query failed: %s", result.Error)
+	}
+	if result.Data.ResultType != "matrix" {
+		return nil, nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("Loki query returned %s instead of a matrix; please use a metric query, e.g. rate() or count_over_time()", result.Data.ResultType))
+	}
+	log.WithContext(ctx).Debugf("Got %d Loki series for query %s", len(result.Data.Result), m.config.Query)
+
+	var ts []*monitoringpb.TimeSeries
+	keys := make(map[string]bool)
+	for _, s := range result.Data.Result {
+		for k := range s.Metric {
+			keys[k] = true
+		}
+		for _, v := range s.Values {
+			t, value, err := parseValue(v)
+			if err != nil {
+				return nil, nil, err
+			}
+			// Queries can return NaN, e.g. when dividing by a rate of zero.
+			if math.IsNaN(value) || math.IsInf(value, 0) || !t.After(lastPoint) || t.After(end) {
+				continue
+			}
+			et, err := ptypes.TimestampProto(t)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", t, err)
+			}
+			ts = append(ts, &monitoringpb.TimeSeries{
+				Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: s.Metric},
+				Resource:   &monitoredres.MonitoredResource{Type: "global"},
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+				Points: []*monitoringpb.Point{{
+					Interval: &monitoringpb.TimeInterval{EndTime: et},
+					Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+				}},
+			})
+		}
+	}
+	return m.metricDescriptor(keys), ts, nil
+}
+
+// parseValue parses a `[timestamp, "value"]` pair returned by Loki.
+func parseValue(v [2]json.RawMessage) (time.Time, float64, error) {
+	var sec float64
+	if err := json.Unmarshal(v[0], &sec); err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid Loki timestamp %s: %v", v[0], err)
+	}
+	var s string
+	if err := json.Unmarshal(v[1], &s); err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid Loki value %s: %v", v[1], err)
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid Loki value %s: %v", s, err)
+	}
+	whole, frac := math.Modf(sec)
+	return time.Unix(int64(whole), int64(frac*1e9)).Truncate(time.Millisecond), value, nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric, with the given label keys.
+func (m *Metric) metricDescriptor(keys map[string]bool) *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Loki query: %s", m.config.Query),
+		DisplayName: m.Name,
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		d.Labels = append(d.Labels, &label.LabelDescriptor{
+			Key:         k,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "Loki label",
+		})
+	}
+	return d
+}
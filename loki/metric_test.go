@@ -0,0 +1,175 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loki
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	labels map[string]string
+	offset time.Duration // relative to the start of a test.
+	value  float64
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, testPoint{s.Metric.Labels, end.Sub(start), s.Points[0].Value.GetDoubleValue()})
+	}
+	return points
+}
+
+func TestStackdriverData(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	defer func() { timeNow = time.Now }()
+	// The end of the queried range is aligned to the step.
+	timeNow = func() time.Time { return start.Add(5*time.Minute + 20*time.Second) }
+
+	var params url.Values
+	var tenant, requestID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "bridge" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/loki/api/v1/query_range" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		params, tenant, requestID = r.URL.Query(), r.Header.Get("X-Scope-OrgID"), r.Header.Get(requestid.Header)
+		s := start.Unix()
+		fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "matrix", "result": [
+			{"metric": {"status": "500"}, "values": [[%d, "0.5"], [%d.5, "1.25"], [%d, "NaN"]]},
+			{"metric": {"status": "503"}, "values": [[%d, "2"]]}
+		]}}`, s+60, s+120, s+180, s+240)
+	}))
+	defer server.Close()
+
+	query := `sum by (status) (rate({app="web"} |= "error" [5m]))`
+	m, err := NewSourceMetric("web_errors", &MetricConfig{
+		Endpoint: server.URL + "/",
+		Query:    query,
+		Step:     time.Minute,
+		Tenant:   "team-a",
+		Username: "bridge",
+		Password: "secret",
+	}, 20*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, start.Add(10*time.Second), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	wantParams := url.Values{
+		"query":     {query},
+		"start":     {strconv.FormatInt(start.Add(time.Minute).UnixNano(), 10)},
+		"end":       {strconv.FormatInt(start.Add(5*time.Minute).UnixNano(), 10)},
+		"step":      {"60"},
+		"direction": {"forward"},
+	}
+	if !reflect.DeepEqual(params, wantParams) {
+		t.Errorf("expected query parameters %v; got %v", wantParams, params)
+	}
+	if tenant != "team-a" || requestID != "req-1" {
+		t.Errorf("unexpected tenant %q or request ID %q", tenant, requestID)
+	}
+	if desc.Type != "custom.googleapis.com/loki/web_errors" || len(desc.Labels) != 1 || desc.Labels[0].Key != "status" {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// NaN values are skipped.
+	want := []testPoint{
+		{map[string]string{"status": "500"}, time.Minute, 0.5},
+		{map[string]string{"status": "500"}, 2*time.Minute + 500*time.Millisecond, 1.25},
+		{map[string]string{"status": "503"}, 4 * time.Minute, 2},
+	}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataUpToDate(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(30 * time.Second) }
+
+	m, err := NewSourceMetric("web_errors", &MetricConfig{Endpoint: "http://loki.invalid", Query: "q"}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	// The next evaluation is still in the future, so Loki is not queried.
+	desc, ts, err := m.StackdriverData(context.Background(), start, nil)
+	if err != nil || desc != nil || ts != nil {
+		t.Errorf("expected no data; got %v, %v, %v", desc, ts, err)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		status    int
+		body      string
+		wantClass error
+	}{
+		{"unauthorized", http.StatusUnauthorized, "no org id", tserrors.ErrSourcePermanent},
+		{"invalid query", http.StatusBadRequest, "parse error at line 1, col 1", tserrors.ErrSourcePermanent},
+		{"too many requests", http.StatusTooManyRequests, "", tserrors.ErrSourceTransient},
+		{"unavailable", http.StatusBadGateway, "", tserrors.ErrSourceTransient},
+		{"log query", http.StatusOK, `{"status": "success", "data": {"resultType": "streams", "result": []}}`, tserrors.ErrSourcePermanent},
+		{"invalid value", http.StatusOK, `{"status": "success", "data": {"resultType": "matrix", "result": [{"values": [[1, "x"]]}]}}`, nil},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			m, err := NewSourceMetric("errors", &MetricConfig{Endpoint: server.URL, Query: "q"}, 0)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Unix(0, 0), nil)
+			if err == nil {
+				t.Fatalf("expected StackdriverData to fail")
+			}
+			if tt.wantClass != nil && !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memory implements a storage engine that keeps metric records in memory, for stateless deployments (e.g.
+// on Cloud Run) where losing metric status on restart is acceptable.
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/ts-bridge/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Manager struct implementing the storage.Manager interface. Records are kept for the lifetime of the Manager, so a
+// single Manager needs to be shared by all requests served by the process.
+type Manager struct {
+	mu      sync.Mutex
+	records map[string]*StoredMetricRecord
+}
+
+// New initializes the Manager struct implementing a generic storage.Manager interface
+func New() *Manager {
+	return &Manager{records: make(map[string]*StoredMetricRecord)}
+}
+
+// NewMetricRecord returns an in-memory metric record for a given metric name. The same record is returned for a
+// given name until it is cleaned up.
+func (m *Manager) NewMetricRecord(_ context.Context, name, query string) (storage.MetricRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.records[name]
+	if !ok {
+		r = &StoredMetricRecord{Name: name}
+		m.records[name] = r
+	}
+	r.mu.Lock()
+	r.Query = query
+	r.mu.Unlock()
+	return r, nil
+}
+
+// CleanupRecords removes obsolete metric records.
+//   `keep` represents metrics to be kept, all others will be purged
+func (m *Manager) CleanupRecords(_ context.Context, keep []string) error {
+	keepMap := make(map[string]bool)
+	for _, k := range keep {
+		keepMap[k] = true
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name := range m.records {
+		if !keepMap[name] {
+			log.Infof("Deleting obsolete in-memory metric record %s", name)
+			delete(m.records, name)
+		}
+	}
+	return nil
+}
+
+// Close is a no-op, since records need to be kept for subsequent requests.
+func (m *Manager) Close() error {
+	return nil
+}
@@ -0,0 +1,267 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/ts-bridge/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StoredMetricRecord keeps status information about an imported metric in memory.
+type StoredMetricRecord struct {
+	mu sync.Mutex
+
+	Name        string
+	Query       string
+	LastUpdate  time.Time // last time we wrote any points to SD.
+	LastAttempt time.Time // last time we attempted an update.
+	LastStatus  string
+
+	// CounterStartTime is used to keep start timestamp for cumulative metrics.
+	CounterStartTime time.Time
+
+	// MissingPoints is the number of points missing in gaps detected during the last update.
+	MissingPoints int
+
+	// DetectorState is the state of the anomaly detector, if it's enabled for the metric.
+	DetectorState storage.DetectorState
+
+	// ThresholdStreaks is the number of consecutive points that breached each threshold rule of the metric.
+	ThresholdStreaks []int
+
+	// ResumeTime is the timestamp of the latest point written by an update that failed part way, up to which all
+	// points have been written. The next update resumes after it.
+	ResumeTime time.Time
+
+	// PendingWrites are encoded points that could not be written to Stackdriver, which are retried by the next update.
+	PendingWrites []byte
+
+	// DailyPoints is the number of points written during the current day, which counts towards daily budgets.
+	DailyPoints storage.DailyPoints
+
+	// ExpressionState is the encoded state of stateful functions of the metric's expression, e.g. previous values
+	// used to calculate rates.
+	ExpressionState []byte
+}
+
+// GetLastUpdate returns LastUpdate timestamp.
+func (m *StoredMetricRecord) GetLastUpdate() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.LastUpdate
+}
+
+// GetLastAttempt returns LastAttempt timestamp.
+func (m *StoredMetricRecord) GetLastAttempt() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.LastAttempt
+}
+
+// GetLastStatus returns LastStatus.
+func (m *StoredMetricRecord) GetLastStatus() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.LastStatus
+}
+
+// GetCounterStartTime returns CounterStartTime.
+func (m *StoredMetricRecord) GetCounterStartTime() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.CounterStartTime
+}
+
+// SetCounterStartTime sets CounterStartTime.
+func (m *StoredMetricRecord) SetCounterStartTime(_ context.Context, start time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.CounterStartTime = start
+	return nil
+}
+
+// GetMissingPoints returns MissingPoints.
+func (m *StoredMetricRecord) GetMissingPoints() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.MissingPoints
+}
+
+// SetMissingPoints sets MissingPoints.
+func (m *StoredMetricRecord) SetMissingPoints(_ context.Context, missing int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.MissingPoints = missing
+	return nil
+}
+
+// GetDetectorState returns DetectorState.
+func (m *StoredMetricRecord) GetDetectorState() storage.DetectorState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.DetectorState
+}
+
+// SetDetectorState sets DetectorState.
+func (m *StoredMetricRecord) SetDetectorState(_ context.Context, state storage.DetectorState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.DetectorState = state
+	return nil
+}
+
+// GetThresholdStreaks returns ThresholdStreaks.
+func (m *StoredMetricRecord) GetThresholdStreaks() []int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ThresholdStreaks
+}
+
+// SetThresholdStreaks sets ThresholdStreaks.
+func (m *StoredMetricRecord) SetThresholdStreaks(_ context.Context, streaks []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ThresholdStreaks = streaks
+	return nil
+}
+
+// GetResumeTime returns ResumeTime.
+func (m *StoredMetricRecord) GetResumeTime() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ResumeTime
+}
+
+// SetResumeTime sets ResumeTime.
+func (m *StoredMetricRecord) SetResumeTime(_ context.Context, resume time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ResumeTime = resume
+	return nil
+}
+
+// GetPendingWrites returns PendingWrites.
+func (m *StoredMetricRecord) GetPendingWrites() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.PendingWrites
+}
+
+// SetPendingWrites sets PendingWrites.
+func (m *StoredMetricRecord) SetPendingWrites(_ context.Context, pending []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.PendingWrites = pending
+	return nil
+}
+
+// GetDailyPoints returns DailyPoints.
+func (m *StoredMetricRecord) GetDailyPoints() storage.DailyPoints {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.DailyPoints
+}
+
+// SetDailyPoints sets DailyPoints.
+func (m *StoredMetricRecord) SetDailyPoints(_ context.Context, points storage.DailyPoints) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.DailyPoints = points
+	return nil
+}
+
+// GetExpressionState returns ExpressionState.
+func (m *StoredMetricRecord) GetExpressionState() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ExpressionState
+}
+
+// SetExpressionState sets ExpressionState.
+func (m *StoredMetricRecord) SetExpressionState(_ context.Context, state []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ExpressionState = state
+	return nil
+}
+
+// State returns the current state of the record.
+func (m *StoredMetricRecord) State() storage.RecordState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return storage.RecordState{
+		Name:             m.Name,
+		Query:            m.Query,
+		LastUpdate:       m.LastUpdate,
+		LastAttempt:      m.LastAttempt,
+		LastStatus:       m.LastStatus,
+		CounterStartTime: m.CounterStartTime,
+		MissingPoints:    m.MissingPoints,
+		DetectorState:    m.DetectorState,
+		ThresholdStreaks: m.ThresholdStreaks,
+		ResumeTime:       m.ResumeTime,
+		PendingWrites:    m.PendingWrites,
+		DailyPoints:      m.DailyPoints,
+		ExpressionState:  m.ExpressionState,
+	}
+}
+
+// Restore replaces the state of the record in memory, e.g. from a snapshot.
+func (m *StoredMetricRecord) Restore(_ context.Context, state storage.RecordState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Query = state.Query
+	m.LastUpdate = state.LastUpdate
+	m.LastAttempt = state.LastAttempt
+	m.LastStatus = state.LastStatus
+	m.CounterStartTime = state.CounterStartTime
+	m.MissingPoints = state.MissingPoints
+	m.DetectorState = state.DetectorState
+	m.ThresholdStreaks = state.ThresholdStreaks
+	m.ResumeTime = state.ResumeTime
+	m.PendingWrites = state.PendingWrites
+	m.DailyPoints = state.DailyPoints
+	m.ExpressionState = state.ExpressionState
+	return nil
+}
+
+// UpdateError updates metric status with a given error message.
+func (m *StoredMetricRecord) UpdateError(ctx context.Context, e error) error {
+	log.WithContext(ctx).Errorf("%s: %s", m.Name, e)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.LastStatus = fmt.Sprintf("ERROR: %s", e)
+	m.LastAttempt = time.Now()
+	return nil
+}
+
+// UpdateSuccess updates metric status with a given message.
+func (m *StoredMetricRecord) UpdateSuccess(ctx context.Context, points int, msg string) error {
+	log.WithContext(ctx).Infof("%s: %s", m.Name, msg)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.LastStatus = fmt.Sprintf("OK: %s", msg)
+	m.LastAttempt = time.Now()
+	if points > 0 {
+		m.LastUpdate = time.Now()
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryMetricRecords(t *testing.T) {
+	ctx := context.Background()
+	manager := New()
+
+	r, err := manager.NewMetricRecord(ctx, "metricname", "query")
+	if err != nil {
+		t.Fatalf("error while creating metric record: %v", err)
+	}
+	if err := r.UpdateSuccess(ctx, 5, "5 points written"); err != nil {
+		t.Fatalf("UpdateSuccess() returned error: %v", err)
+	}
+	start := time.Now().Add(-time.Hour)
+	if err := r.SetCounterStartTime(ctx, start); err != nil {
+		t.Fatalf("SetCounterStartTime() returned error: %v", err)
+	}
+	if err := r.UpdateError(ctx, fmt.Errorf("some error")); err != nil {
+		t.Fatalf("UpdateError() returned error: %v", err)
+	}
+
+	// Records are kept by the manager, so that they survive across requests.
+	manager.Close()
+	same, err := manager.NewMetricRecord(ctx, "metricname", "new query")
+	if err != nil {
+		t.Fatalf("error while getting metric record: %v", err)
+	}
+	if !strings.HasPrefix(same.GetLastStatus(), "ERROR: some error") {
+		t.Errorf("expected last status to be kept; got %q", same.GetLastStatus())
+	}
+	if time.Since(same.GetLastUpdate()) > time.Minute || !same.GetCounterStartTime().Equal(start) {
+		t.Errorf("expected last update and counter start time to be kept; got %v, %v", same.GetLastUpdate(), same.GetCounterStartTime())
+	}
+}
+
+func TestMemoryCleanupRecords(t *testing.T) {
+	ctx := context.Background()
+	manager := New()
+	for _, name := range []string{"keep", "purge"} {
+		r, err := manager.NewMetricRecord(ctx, name, "query")
+		if err != nil {
+			t.Fatalf("error while creating metric record: %v", err)
+		}
+		r.UpdateSuccess(ctx, 1, "1 point written")
+	}
+	if err := manager.CleanupRecords(ctx, []string{"keep"}); err != nil {
+		t.Fatalf("CleanupRecords() returned error: %v", err)
+	}
+	if _, ok := manager.records["keep"]; !ok {
+		t.Errorf("expected record 'keep' to be kept")
+	}
+	if _, ok := manager.records["purge"]; ok {
+		t.Errorf("expected record 'purge' to be removed")
+	}
+}
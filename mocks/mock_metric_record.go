@@ -7,6 +7,7 @@ package mocks
 import (
 	context "context"
 	gomock "github.com/golang/mock/gomock"
+	storage "github.com/google/ts-bridge/storage"
 	reflect "reflect"
 	time "time"
 )
@@ -48,6 +49,76 @@ func (mr *MockMetricRecordMockRecorder) GetCounterStartTime() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCounterStartTime", reflect.TypeOf((*MockMetricRecord)(nil).GetCounterStartTime))
 }
 
+// GetDailyPoints mocks base method
+func (m *MockMetricRecord) GetDailyPoints() storage.DailyPoints {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDailyPoints")
+	ret0, _ := ret[0].(storage.DailyPoints)
+	return ret0
+}
+
+// GetDailyPoints indicates an expected call of GetDailyPoints
+func (mr *MockMetricRecordMockRecorder) GetDailyPoints() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDailyPoints", reflect.TypeOf((*MockMetricRecord)(nil).GetDailyPoints))
+}
+
+// GetDetectorState mocks base method
+func (m *MockMetricRecord) GetDetectorState() storage.DetectorState {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetDetectorState")
+	ret0, _ := ret[0].(storage.DetectorState)
+	return ret0
+}
+
+// GetDetectorState indicates an expected call of GetDetectorState
+func (mr *MockMetricRecordMockRecorder) GetDetectorState() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDetectorState", reflect.TypeOf((*MockMetricRecord)(nil).GetDetectorState))
+}
+
+// GetExpressionState mocks base method
+func (m *MockMetricRecord) GetExpressionState() []byte {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetExpressionState")
+	ret0, _ := ret[0].([]byte)
+	return ret0
+}
+
+// GetExpressionState indicates an expected call of GetExpressionState
+func (mr *MockMetricRecordMockRecorder) GetExpressionState() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetExpressionState", reflect.TypeOf((*MockMetricRecord)(nil).GetExpressionState))
+}
+
+// GetLastAttempt mocks base method
+func (m *MockMetricRecord) GetLastAttempt() time.Time {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLastAttempt")
+	ret0, _ := ret[0].(time.Time)
+	return ret0
+}
+
+// GetLastAttempt indicates an expected call of GetLastAttempt
+func (mr *MockMetricRecordMockRecorder) GetLastAttempt() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLastAttempt", reflect.TypeOf((*MockMetricRecord)(nil).GetLastAttempt))
+}
+
+// GetLastStatus mocks base method
+func (m *MockMetricRecord) GetLastStatus() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetLastStatus")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// GetLastStatus indicates an expected call of GetLastStatus
+func (mr *MockMetricRecordMockRecorder) GetLastStatus() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLastStatus", reflect.TypeOf((*MockMetricRecord)(nil).GetLastStatus))
+}
+
 // GetLastUpdate mocks base method
 func (m *MockMetricRecord) GetLastUpdate() time.Time {
 	m.ctrl.T.Helper()
@@ -62,6 +133,62 @@ func (mr *MockMetricRecordMockRecorder) GetLastUpdate() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLastUpdate", reflect.TypeOf((*MockMetricRecord)(nil).GetLastUpdate))
 }
 
+// GetMissingPoints mocks base method
+func (m *MockMetricRecord) GetMissingPoints() int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetMissingPoints")
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// GetMissingPoints indicates an expected call of GetMissingPoints
+func (mr *MockMetricRecordMockRecorder) GetMissingPoints() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetMissingPoints", reflect.TypeOf((*MockMetricRecord)(nil).GetMissingPoints))
+}
+
+// GetPendingWrites mocks base method
+func (m *MockMetricRecord) GetPendingWrites() []byte {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPendingWrites")
+	ret0, _ := ret[0].([]byte)
+	return ret0
+}
+
+// GetPendingWrites indicates an expected call of GetPendingWrites
+func (mr *MockMetricRecordMockRecorder) GetPendingWrites() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPendingWrites", reflect.TypeOf((*MockMetricRecord)(nil).GetPendingWrites))
+}
+
+// GetResumeTime mocks base method
+func (m *MockMetricRecord) GetResumeTime() time.Time {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetResumeTime")
+	ret0, _ := ret[0].(time.Time)
+	return ret0
+}
+
+// GetResumeTime indicates an expected call of GetResumeTime
+func (mr *MockMetricRecordMockRecorder) GetResumeTime() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetResumeTime", reflect.TypeOf((*MockMetricRecord)(nil).GetResumeTime))
+}
+
+// GetThresholdStreaks mocks base method
+func (m *MockMetricRecord) GetThresholdStreaks() []int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetThresholdStreaks")
+	ret0, _ := ret[0].([]int)
+	return ret0
+}
+
+// GetThresholdStreaks indicates an expected call of GetThresholdStreaks
+func (mr *MockMetricRecordMockRecorder) GetThresholdStreaks() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetThresholdStreaks", reflect.TypeOf((*MockMetricRecord)(nil).GetThresholdStreaks))
+}
+
 // SetCounterStartTime mocks base method
 func (m *MockMetricRecord) SetCounterStartTime(arg0 context.Context, arg1 time.Time) error {
 	m.ctrl.T.Helper()
@@ -76,6 +203,104 @@ func (mr *MockMetricRecordMockRecorder) SetCounterStartTime(arg0, arg1 interface
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetCounterStartTime", reflect.TypeOf((*MockMetricRecord)(nil).SetCounterStartTime), arg0, arg1)
 }
 
+// SetDailyPoints mocks base method
+func (m *MockMetricRecord) SetDailyPoints(arg0 context.Context, arg1 storage.DailyPoints) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetDailyPoints", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetDailyPoints indicates an expected call of SetDailyPoints
+func (mr *MockMetricRecordMockRecorder) SetDailyPoints(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetDailyPoints", reflect.TypeOf((*MockMetricRecord)(nil).SetDailyPoints), arg0, arg1)
+}
+
+// SetDetectorState mocks base method
+func (m *MockMetricRecord) SetDetectorState(arg0 context.Context, arg1 storage.DetectorState) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetDetectorState", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetDetectorState indicates an expected call of SetDetectorState
+func (mr *MockMetricRecordMockRecorder) SetDetectorState(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetDetectorState", reflect.TypeOf((*MockMetricRecord)(nil).SetDetectorState), arg0, arg1)
+}
+
+// SetExpressionState mocks base method
+func (m *MockMetricRecord) SetExpressionState(arg0 context.Context, arg1 []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetExpressionState", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetExpressionState indicates an expected call of SetExpressionState
+func (mr *MockMetricRecordMockRecorder) SetExpressionState(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetExpressionState", reflect.TypeOf((*MockMetricRecord)(nil).SetExpressionState), arg0, arg1)
+}
+
+// SetMissingPoints mocks base method
+func (m *MockMetricRecord) SetMissingPoints(arg0 context.Context, arg1 int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetMissingPoints", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetMissingPoints indicates an expected call of SetMissingPoints
+func (mr *MockMetricRecordMockRecorder) SetMissingPoints(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetMissingPoints", reflect.TypeOf((*MockMetricRecord)(nil).SetMissingPoints), arg0, arg1)
+}
+
+// SetPendingWrites mocks base method
+func (m *MockMetricRecord) SetPendingWrites(arg0 context.Context, arg1 []byte) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetPendingWrites", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetPendingWrites indicates an expected call of SetPendingWrites
+func (mr *MockMetricRecordMockRecorder) SetPendingWrites(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetPendingWrites", reflect.TypeOf((*MockMetricRecord)(nil).SetPendingWrites), arg0, arg1)
+}
+
+// SetResumeTime mocks base method
+func (m *MockMetricRecord) SetResumeTime(arg0 context.Context, arg1 time.Time) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetResumeTime", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetResumeTime indicates an expected call of SetResumeTime
+func (mr *MockMetricRecordMockRecorder) SetResumeTime(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetResumeTime", reflect.TypeOf((*MockMetricRecord)(nil).SetResumeTime), arg0, arg1)
+}
+
+// SetThresholdStreaks mocks base method
+func (m *MockMetricRecord) SetThresholdStreaks(arg0 context.Context, arg1 []int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetThresholdStreaks", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetThresholdStreaks indicates an expected call of SetThresholdStreaks
+func (mr *MockMetricRecordMockRecorder) SetThresholdStreaks(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetThresholdStreaks", reflect.TypeOf((*MockMetricRecord)(nil).SetThresholdStreaks), arg0, arg1)
+}
+
 // UpdateError mocks base method
 func (m *MockMetricRecord) UpdateError(arg0 context.Context, arg1 error) error {
 	m.ctrl.T.Helper()
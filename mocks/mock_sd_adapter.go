@@ -78,3 +78,18 @@ func (mr *MockStackdriverAdapterMockRecorder) LatestTimestamp(arg0, arg1, arg2 i
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LatestTimestamp", reflect.TypeOf((*MockStackdriverAdapter)(nil).LatestTimestamp), arg0, arg1, arg2)
 }
+
+// SumOverWindow mocks base method
+func (m *MockStackdriverAdapter) SumOverWindow(arg0 context.Context, arg1, arg2 string, arg3 time.Duration) (float64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SumOverWindow", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(float64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SumOverWindow indicates an expected call of SumOverWindow
+func (mr *MockStackdriverAdapterMockRecorder) SumOverWindow(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SumOverWindow", reflect.TypeOf((*MockStackdriverAdapter)(nil).SumOverWindow), arg0, arg1, arg2, arg3)
+}
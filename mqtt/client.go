@@ -0,0 +1,313 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/ts-bridge/httpclient"
+	"github.com/google/ts-bridge/tserrors"
+)
+
+// Only the subset of MQTT 3.1.1 needed to subscribe to topics is implemented, which avoids depending on a client
+// library for a single source. See https://docs.oasis-open.org/mqtt/mqtt/v3.1.1/os/mqtt-v3.1.1-os.html.
+const (
+	packetConnect   = 1
+	packetConnack   = 2
+	packetPublish   = 3
+	packetPuback    = 4
+	packetSubscribe = 8
+	packetSuback    = 9
+	packetPingreq   = 12
+	packetPingresp  = 13
+
+	// maxPacketSize limits the size of received packets, so that a misbehaving broker cannot exhaust memory.
+	maxPacketSize = 1 << 20
+)
+
+// Connection settings.
+var (
+	dialTimeout = 30 * time.Second
+	keepAlive   = 60 * time.Second
+)
+
+// message is a message published to a subscribed topic.
+type message struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+// conn is a connection to an MQTT broker.
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	mu sync.Mutex // serializes writes.
+}
+
+// dial connects to the configured broker and subscribes to the configured topics.
+func dial(config *MetricConfig) (*conn, error) {
+	u, err := url.Parse(config.Broker)
+	if err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	addr := u.Host
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var nc net.Conn
+	switch u.Scheme {
+	case "ssl", "tls", "mqtts":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "8883")
+		}
+		tlsConfig, err := (&httpclient.Config{CAFile: config.CAFile}).TLSConfig()
+		if err != nil {
+			return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		nc, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	default:
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "1883")
+		}
+		nc, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("cannot connect to MQTT broker %s: %w", addr, err))
+	}
+	c := &conn{nc: nc, r: bufio.NewReader(nc)}
+	if err := c.connect(config); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if err := c.subscribe(config.Topics, byte(config.QoS)); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// connect sends a CONNECT packet and waits for the broker to accept the connection.
+func (c *conn) connect(config *MetricConfig) error {
+	var flags byte
+	if config.ClientID == "" {
+		flags |= 0x02 // clean session
+	}
+	if config.Username != "" {
+		flags |= 0x80
+	}
+	if config.Password != "" {
+		flags |= 0x40
+	}
+	body := appendString(nil, "MQTT")
+	body = append(body, 4, flags)
+	body = appendUint16(body, uint16(keepAlive/time.Second))
+	body = appendString(body, config.ClientID)
+	if config.Username != "" {
+		body = appendString(body, config.Username)
+	}
+	if config.Password != "" {
+		body = appendString(body, config.Password)
+	}
+	if err := c.write(packetConnect<<4, body); err != nil {
+		return err
+	}
+
+	c.nc.SetReadDeadline(time.Now().Add(dialTimeout))
+	typ, _, resp, err := c.read()
+	if err != nil {
+		return err
+	}
+	if typ != packetConnack || len(resp) != 2 {
+		return fmt.Errorf("unexpected MQTT packet type %d instead of CONNACK", typ)
+	}
+	switch code := resp[1]; code {
+	case 0:
+		return nil
+	case 4, 5:
+		return tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("MQTT broker refused connection: not authorized (code %d)", code))
+	default:
+		return fmt.Errorf("MQTT broker refused connection with code %d", code)
+	}
+}
+
+// subscribe sends a SUBSCRIBE packet for all topics. The SUBACK packet is handled by readLoop, as messages of a
+// persistent session can be received before it.
+func (c *conn) subscribe(topics []string, qos byte) error {
+	body := appendUint16(nil, 1)
+	for _, t := range topics {
+		body = appendString(body, t)
+		body = append(body, qos)
+	}
+	return c.write(packetSubscribe<<4|0x02, body)
+}
+
+// readLoop handles packets sent by the broker, sending keep-alive pings, until the connection fails or is closed.
+func (c *conn) readLoop(handle func(message)) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(keepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.write(packetPingreq<<4, nil)
+			}
+		}
+	}()
+
+	for {
+		// The broker responds to pings, so a connection without packets for longer than the keep-alive interval
+		// is broken.
+		c.nc.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		typ, flags, body, err := c.read()
+		if err != nil {
+			return tserrors.ClassifySource(fmt.Errorf("MQTT connection failed: %w", err))
+		}
+		switch typ {
+		case packetPublish:
+			msg, id, err := parsePublish(flags, body)
+			if err != nil {
+				return err
+			}
+			if id != 0 {
+				if err := c.write(packetPuback<<4, appendUint16(nil, id)); err != nil {
+					return tserrors.ClassifySource(fmt.Errorf("MQTT connection failed: %w", err))
+				}
+			}
+			handle(msg)
+		case packetSuback:
+			if len(body) < 2 {
+				return errors.New("invalid MQTT SUBACK packet")
+			}
+			for _, code := range body[2:] {
+				if code == 0x80 {
+					return tserrors.Wrap(tserrors.ErrSourcePermanent, errors.New("MQTT broker rejected subscription"))
+				}
+			}
+		case packetPingresp:
+		default:
+			return fmt.Errorf("unexpected MQTT packet type %d", typ)
+		}
+	}
+}
+
+// close closes the connection, which makes readLoop return.
+func (c *conn) close() error {
+	return c.nc.Close()
+}
+
+// write sends a packet with the given first header byte and body.
+func (c *conn) write(header byte, body []byte) error {
+	packet := append([]byte{header}, encodeLength(len(body))...)
+	packet = append(packet, body...)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(dialTimeout))
+	_, err := c.nc.Write(packet)
+	return err
+}
+
+// read receives a packet, returning its type, flags and body.
+func (c *conn) read() (byte, byte, []byte, error) {
+	header, err := c.r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var length int
+	for i := 0; ; i++ {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		length |= int(b&0x7f) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, 0, nil, errors.New("invalid MQTT packet length")
+		}
+	}
+	if length > maxPacketSize {
+		return 0, 0, nil, fmt.Errorf("MQTT packet of %d bytes exceeds maximum size of %d bytes", length, maxPacketSize)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	return header >> 4, header & 0x0f, body, nil
+}
+
+// parsePublish parses a PUBLISH packet, returning the message and its packet ID, which is 0 for QoS 0 messages.
+func parsePublish(flags byte, body []byte) (message, uint16, error) {
+	if len(body) < 2 {
+		return message{}, 0, errors.New("invalid MQTT PUBLISH packet")
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return message{}, 0, errors.New("invalid MQTT PUBLISH packet")
+	}
+	msg := message{topic: string(body[2 : 2+n]), retained: flags&0x01 != 0}
+	rest := body[2+n:]
+	var id uint16
+	if qos := (flags >> 1) & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return message{}, 0, errors.New("invalid MQTT PUBLISH packet")
+		}
+		id, rest = binary.BigEndian.Uint16(rest), rest[2:]
+	}
+	msg.payload = rest
+	return msg, id, nil
+}
+
+// appendUint16 appends a big-endian 16-bit integer.
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendString appends a length-prefixed UTF-8 string.
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// encodeLength encodes the remaining length of a packet.
+func encodeLength(n int) []byte {
+	var b []byte
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/google/ts-bridge/env"
+)
+
+// defaultBufferSize is the maximum number of points buffered between syncs, unless configured.
+const defaultBufferSize = 10000
+
+// Overflow policies, which define what happens to received messages once the buffer is full.
+const (
+	// overflowDropOldest drops the oldest buffered points.
+	overflowDropOldest = "drop-oldest"
+	// overflowDownsample removes every other buffered point of each time series, halving their resolution.
+	overflowDownsample = "downsample"
+	// overflowBlock stops reading messages until the next sync frees space, leaving them queued by the broker.
+	overflowBlock = "block"
+)
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from MQTT topics.
+type MetricConfig struct {
+	// Broker is the URL of the MQTT broker, e.g. tcp://mqtt.corp:1883 or ssl://mqtt.corp:8883.
+	Broker string `validate:"nonzero"`
+	// Topics lists subscribed topic filters, which can contain `+` and `#` wildcards, e.g. sensors/+/+/temperature.
+	Topics []string `validate:"nonzero"`
+	// TopicLabels names the metric labels that topic levels matched by wildcards are mapped to, in order.
+	TopicLabels []string `yaml:"topic_labels"`
+	// JSONField is the field of JSON object payloads that contains the value. Payloads are plain numbers if it's empty.
+	JSONField string `yaml:"json_field"`
+	// QoS is the quality of service level of subscriptions: 0 (the default) or 1.
+	QoS int `yaml:"qos" validate:"min=0,max=1"`
+	// IncludeRetained imports retained messages, which are sent by the broker when subscribing.
+	IncludeRetained bool `yaml:"include_retained"`
+	// BufferSize is the maximum number of points buffered between syncs, beyond which the overflow policy applies.
+	BufferSize int `yaml:"buffer_size" validate:"min=0"`
+	// Overflow is the overflow policy applied once the buffer is full, drop-oldest by default.
+	Overflow string `yaml:"overflow" validate:"regexp=^(|drop-oldest|downsample|block)$"`
+
+	// ClientID identifies the connection to the broker. If set, a persistent session is used, so that QoS 1
+	// messages published while ts-bridge is reconnecting are not lost.
+	ClientID string `yaml:"client_id"`
+	Username string
+	Password string
+	// CAFile is the path to a PEM file with additional CA certificates trusted while connecting to the broker.
+	CAFile string `yaml:"ca_file"`
+
+	// The password can also be read from a file, e.g. from a mounted Kubernetes secret.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// ReadSecretFiles sets the password from the contents of the configured password file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.PasswordFile == "" {
+		return nil
+	}
+	if c.Password != "" {
+		return fmt.Errorf("password and password_file cannot both be set")
+	}
+	password, err := env.ReadSecretFile(dir, c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read password_file: %v", err)
+	}
+	c.Password = password
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	u, err := url.Parse(c.Broker)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid broker URL %q", c.Broker)
+	}
+	switch u.Scheme {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts":
+	default:
+		return fmt.Errorf("unsupported broker URL scheme %q; please use tcp or ssl", u.Scheme)
+	}
+	for _, t := range c.Topics {
+		levels := strings.Split(t, "/")
+		var wildcards int
+		for i, l := range levels {
+			switch {
+			case l == "+":
+				wildcards++
+			case l == "#" && i == len(levels)-1:
+				wildcards++
+			case strings.ContainsAny(l, "+#"):
+				return fmt.Errorf("invalid wildcard in topic filter %s", t)
+			}
+		}
+		// Each wildcard is mapped to a label, so that messages of different topics are written to different series.
+		if wildcards != len(c.TopicLabels) {
+			return fmt.Errorf("topic filter %s has %d wildcards, but %d topic_labels are configured", t, wildcards, len(c.TopicLabels))
+		}
+	}
+	if c.Password != "" && c.Username == "" {
+		return fmt.Errorf("password requires a username")
+	}
+	return nil
+}
+
+// bufferSize returns the maximum number of points buffered between syncs.
+func (c *MetricConfig) bufferSize() int {
+	if c.BufferSize > 0 {
+		return c.BufferSize
+	}
+	return defaultBufferSize
+}
+
+// overflow returns the overflow policy of the buffer.
+func (c *MetricConfig) overflow() string {
+	if c.Overflow != "" {
+		return c.Overflow
+	}
+	return overflowDropOldest
+}
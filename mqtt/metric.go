@@ -0,0 +1,146 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mqtt imports numeric payloads of messages published to MQTT topics, e.g. by IoT devices. Messages are
+// received by a subscriber running in the background, and buffered until the next sync.
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a metric based on MQTT messages. It implements the SourceMetric interface.
+type Metric struct {
+	Name   string
+	config *MetricConfig
+	// dropped is the number of points dropped because the buffer was full, until they are reported.
+	dropped int
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters. The broker is only
+// connected to once the metric is synced for the first time.
+func NewSourceMetric(name string, config *MetricConfig) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	return &Metric{Name: name, config: config}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/mqtt/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "mqtt"
+}
+
+// SourceHost returns the host of the broker. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.Broker)
+	if err != nil || u.Host == "" {
+		return m.config.Broker
+	}
+	return u.Host
+}
+
+// Query returns the subscribed topic filters.
+func (m *Metric) Query() string {
+	return strings.Join(m.config.Topics, ", ")
+}
+
+// StackdriverData returns metric descriptor and time series with points of messages received after the given
+// lastPoint timestamp. The first sync of a metric starts its subscriber, so points are only returned from the next
+// sync on. Buffered points are returned even if the subscriber is currently disconnected.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	points, dropped, invalid, err := getSubscriber(m.Name, m.config).buffered(lastPoint)
+	if dropped > 0 {
+		m.dropped += dropped
+		log.WithContext(ctx).Warningf("Dropped %d points of MQTT metric %s (overflow policy %s), as more than %d points were buffered; please sync more often or increase buffer_size", dropped, m.Name, m.config.overflow(), m.config.bufferSize())
+	}
+	if invalid > 0 {
+		log.WithContext(ctx).Warningf("Skipped %d MQTT messages of metric %s with non-numeric payloads", invalid, m.Name)
+	}
+	if err != nil {
+		if len(points) == 0 {
+			return nil, nil, err
+		}
+		log.WithContext(ctx).Warningf("MQTT subscription of metric %s is disconnected, writing %d buffered points: %v", m.Name, len(points), err)
+	}
+	log.WithContext(ctx).Debugf("Got %d buffered MQTT points for %s", len(points), m.Query())
+
+	var ts []*monitoringpb.TimeSeries
+	for _, p := range points {
+		et, err := ptypes.TimestampProto(p.t)
+		if err != nil {
+			return nil, nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("Could not convert timestamp %v to proto: %v", p.t, err))
+		}
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: p.labels},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: et},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: p.value}},
+			}},
+		})
+	}
+	return m.metricDescriptor(), ts, nil
+}
+
+// DroppedPoints returns the number of points dropped since the last call because the buffer was full, along with the
+// overflow policy that dropped them. It's used to record stats.
+func (m *Metric) DroppedPoints() (int, string) {
+	dropped := m.dropped
+	m.dropped = 0
+	return dropped, m.config.overflow()
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("MQTT topics: %s", m.Query()),
+		DisplayName: m.Name,
+	}
+	for _, l := range m.config.TopicLabels {
+		d.Labels = append(d.Labels, &label.LabelDescriptor{
+			Key:         l,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "MQTT topic level",
+		})
+	}
+	return d
+}
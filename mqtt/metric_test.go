@@ -0,0 +1,339 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+)
+
+// fakeBroker accepts connections, subscribing them to all topics and sending them published messages.
+type fakeBroker struct {
+	l          net.Listener
+	returnCode byte
+	subscribed chan []string
+	messages   chan []byte // PUBLISH packets, without header.
+	acked      chan uint16
+}
+
+func newFakeBroker(t *testing.T, returnCode byte) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{l: l, returnCode: returnCode, subscribed: make(chan []string, 10), messages: make(chan []byte, 10), acked: make(chan uint16, 10)}
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(&conn{nc: nc, r: bufio.NewReader(nc)})
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(c *conn) {
+	defer c.close()
+	if typ, _, _, err := c.read(); err != nil || typ != packetConnect {
+		return
+	}
+	c.write(packetConnack<<4, []byte{0, b.returnCode})
+	if b.returnCode != 0 {
+		return
+	}
+	typ, _, body, err := c.read()
+	if err != nil || typ != packetSubscribe {
+		return
+	}
+	var topics []string
+	for rest := body[2:]; len(rest) > 0; {
+		n := int(rest[0])<<8 | int(rest[1])
+		topics = append(topics, string(rest[2:2+n]))
+		rest = rest[3+n:]
+	}
+	c.write(packetSuback<<4, append(body[:2:2], make([]byte, len(topics))...))
+	b.subscribed <- topics
+
+	go func() {
+		for {
+			typ, _, body, err := c.read()
+			if err != nil {
+				return
+			}
+			if typ == packetPuback {
+				b.acked <- uint16(body[0])<<8 | uint16(body[1])
+			}
+		}
+	}()
+	for msg := range b.messages {
+		c.write(msg[0], msg[1:])
+	}
+}
+
+// publish sends a message with the given QoS (using packet ID 7 for QoS 1) and retain flag.
+func (b *fakeBroker) publish(topic, payload string, qos byte, retained bool) {
+	header := byte(packetPublish<<4) | qos<<1
+	if retained {
+		header |= 0x01
+	}
+	body := appendString([]byte{header}, topic)
+	if qos > 0 {
+		body = appendUint16(body, 7)
+	}
+	b.messages <- append(body, payload...)
+}
+
+func (b *fakeBroker) close() {
+	b.l.Close()
+	close(b.messages)
+}
+
+// useFakeClock makes timeNow advance by a second each time it's called, and returns a function restoring it.
+func useFakeClock(start time.Time) func() {
+	var ticks int64
+	timeNow = func() time.Time { return start.Add(time.Duration(atomic.AddInt64(&ticks, 1)) * time.Second) }
+	return func() {
+		subscribersMu.Lock()
+		for n, s := range subscribers {
+			s.cancel()
+			<-s.done
+			delete(subscribers, n)
+		}
+		subscribersMu.Unlock()
+		timeNow = time.Now
+	}
+}
+
+// waitForPoints waits until the subscriber of a metric has buffered `n` points.
+func waitForPoints(t *testing.T, m *Metric, n int) {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s := getSubscriber(m.Name, m.config)
+		s.mu.Lock()
+		got := len(s.points)
+		s.mu.Unlock()
+		if got >= n {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %d points", n)
+}
+
+func TestStackdriverData(t *testing.T) {
+	defer useFakeClock(time.Now().Add(-time.Hour).Truncate(time.Second))()
+	b := newFakeBroker(t, 0)
+	defer b.close()
+
+	m, err := NewSourceMetric("temperature", &MetricConfig{
+		Broker:      "tcp://" + b.l.Addr().String(),
+		Topics:      []string{"sensors/+/+/temperature"},
+		TopicLabels: []string{"site", "device"},
+		JSONField:   "value",
+		ClientID:    "ts-bridge",
+		QoS:         1,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+
+	// The first sync starts the subscriber.
+	ctx := context.Background()
+	if _, ts, err := m.StackdriverData(ctx, time.Time{}, nil); err != nil || len(ts) != 0 {
+		t.Fatalf("expected no points before subscribing; got %v, %v", ts, err)
+	}
+	select {
+	case topics := <-b.subscribed:
+		if !reflect.DeepEqual(topics, m.config.Topics) {
+			t.Errorf("expected subscription to %v; got %v", m.config.Topics, topics)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for subscription")
+	}
+
+	b.publish("sensors/dc1/t1/temperature", `{"value": 21.5}`, 0, false)
+	b.publish("sensors/dc1/t2/temperature", `{"value": 30}`, 0, true)
+	b.publish("sensors/dc1/t2/temperature", `{"value": "hot"}`, 0, false)
+	b.publish("sensors/dc2/t1/temperature", `{"value": "22"}`, 1, false)
+	waitForPoints(t, m, 2)
+	select {
+	case id := <-b.acked:
+		if id != 7 {
+			t.Errorf("expected packet 7 to be acknowledged; got %d", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("timed out waiting for acknowledgement of QoS 1 message")
+	}
+
+	desc, ts, err := m.StackdriverData(ctx, time.Time{}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if desc.Type != "custom.googleapis.com/mqtt/temperature" || len(desc.Labels) != 2 || desc.Labels[0].Key != "site" {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// The retained message and the invalid payload are skipped.
+	if len(ts) != 2 {
+		t.Fatalf("expected 2 points; got %v", ts)
+	}
+	for i, want := range []map[string]string{{"site": "dc1", "device": "t1"}, {"site": "dc2", "device": "t1"}} {
+		if !reflect.DeepEqual(ts[i].Metric.Labels, want) {
+			t.Errorf("expected labels %v; got %v", want, ts[i].Metric.Labels)
+		}
+	}
+	if v := ts[1].Points[0].Value.GetDoubleValue(); v != 22 {
+		t.Errorf("expected value 22; got %v", v)
+	}
+
+	// Points are kept until a later point has been written.
+	first, err := ptypes.Timestamp(ts[0].Points[0].Interval.EndTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ts, err = m.StackdriverData(ctx, first, nil); err != nil || len(ts) != 1 {
+		t.Errorf("expected 1 point after %v; got %v, %v", first, ts, err)
+	}
+}
+
+func TestStackdriverDataNotAuthorized(t *testing.T) {
+	defer useFakeClock(time.Now().Add(-time.Hour))()
+	b := newFakeBroker(t, 5)
+	defer b.close()
+
+	m, err := NewSourceMetric("denied", &MetricConfig{Broker: "tcp://" + b.l.Addr().String(), Topics: []string{"t"}, Username: "u", Password: "p"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	m.StackdriverData(context.Background(), time.Time{}, nil)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, _, err = m.StackdriverData(context.Background(), time.Time{}, nil); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, tserrors.ErrSourcePermanent) {
+		t.Errorf("expected a refused connection to be a permanent error; got %v", err)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	defer useFakeClock(time.Now())()
+	s := &subscriber{config: &MetricConfig{Topics: []string{"t"}, BufferSize: 2}}
+	for _, payload := range []string{"1", "2", "3", "NaN"} {
+		s.receive(message{topic: "t", payload: []byte(payload)})
+	}
+	points, dropped, invalid, err := s.buffered(time.Time{})
+	if len(points) != 2 || points[0].value != 2 || dropped != 1 || invalid != 1 || err != nil {
+		t.Errorf("expected the oldest point to be dropped; got %v, %d dropped, %d invalid, %v", points, dropped, invalid, err)
+	}
+}
+
+func TestBufferOverflowDownsample(t *testing.T) {
+	defer useFakeClock(time.Now())()
+	s := &subscriber{config: &MetricConfig{Topics: []string{"+"}, TopicLabels: []string{"sensor"}, BufferSize: 4, Overflow: "downsample"}}
+	for _, msg := range []message{
+		{topic: "a", payload: []byte("1")},
+		{topic: "b", payload: []byte("2")},
+		{topic: "a", payload: []byte("3")},
+		{topic: "b", payload: []byte("4")},
+		{topic: "a", payload: []byte("5")},
+	} {
+		s.receive(msg)
+	}
+	points, dropped, _, _ := s.buffered(time.Time{})
+	var got []float64
+	for _, p := range points {
+		got = append(got, p.value)
+	}
+	// Every other point of each sensor is removed, keeping the newest ones.
+	if want := []float64{3, 4, 5}; !reflect.DeepEqual(got, want) || dropped != 2 {
+		t.Errorf("expected points %v with 2 dropped; got %v with %d dropped", want, got, dropped)
+	}
+}
+
+func TestBufferOverflowBlock(t *testing.T) {
+	defer useFakeClock(time.Now())()
+	s := &subscriber{config: &MetricConfig{Topics: []string{"t"}, BufferSize: 1, Overflow: "block"}}
+	s.receive(message{topic: "t", payload: []byte("1")})
+	received := make(chan struct{})
+	go func() {
+		s.receive(message{topic: "t", payload: []byte("2")})
+		close(received)
+	}()
+	select {
+	case <-received:
+		t.Fatal("expected receive to block while the buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Writing the buffered point frees space.
+	points, _, _, _ := s.buffered(time.Time{})
+	s.buffered(points[0].t)
+	select {
+	case <-received:
+	case <-time.After(time.Second):
+		t.Fatal("expected receive to be unblocked once space was freed")
+	}
+	points, dropped, _, _ := s.buffered(time.Time{})
+	if len(points) != 1 || points[0].value != 2 || dropped != 0 {
+		t.Errorf("expected the blocked point to be buffered; got %v with %d dropped", points, dropped)
+	}
+}
+
+func TestTopicLabels(t *testing.T) {
+	for _, tt := range []struct {
+		filter string
+		topic  string
+		want   map[string]string
+	}{
+		{"sensors/+/temperature", "sensors/t1/temperature", map[string]string{"a": "t1"}},
+		{"sensors/+/temperature", "sensors/t1/humidity", nil},
+		{"sensors/+/temperature", "sensors/t1/temperature/raw", nil},
+		{"sensors/#", "sensors/dc1/t1", map[string]string{"a": "dc1/t1"}},
+		{"sensors/#", "sensors", map[string]string{"a": ""}},
+		{"+/+", "dc1/t1", map[string]string{"a": "dc1", "b": "t1"}},
+		{"sensors/temperature", "sensors/temperature", map[string]string{}},
+	} {
+		c := &MetricConfig{Topics: []string{tt.filter}, TopicLabels: []string{"a", "b"}}
+		got, ok := c.topicLabels(tt.topic)
+		if ok != (tt.want != nil) || (ok && !reflect.DeepEqual(got, tt.want)) {
+			t.Errorf("topicLabels(%s) with filter %s = %v, %v; want %v", tt.topic, tt.filter, got, ok, tt.want)
+		}
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, config := range []*MetricConfig{
+		{Broker: "mqtt.corp:1883", Topics: []string{"t"}},
+		{Broker: "ws://mqtt.corp", Topics: []string{"t"}},
+		{Broker: "tcp://mqtt.corp", Topics: []string{"sensors/+"}},
+		{Broker: "tcp://mqtt.corp", Topics: []string{"sensors/#/temperature"}, TopicLabels: []string{"a"}},
+		{Broker: "tcp://mqtt.corp", Topics: []string{"sensors/t+"}},
+		{Broker: "tcp://mqtt.corp", Topics: []string{"t"}, Password: "p"},
+	} {
+		if _, err := NewSourceMetric("invalid", config); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Subscribers are shared by all configurations loaded during the lifetime of the process, so that messages are
+// buffered between syncs even though the configuration file is reloaded for each sync.
+var (
+	subscribersMu sync.Mutex
+	subscribers   = make(map[string]*subscriber)
+)
+
+// idleTimeout is the time after which subscribers of metrics that are no longer synced (e.g. because they have been
+// removed from the configuration file) are closed.
+var idleTimeout = time.Hour
+
+// Reconnection backoff.
+var (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// point is a buffered point.
+type point struct {
+	labels map[string]string
+	t      time.Time
+	value  float64
+}
+
+// subscriber keeps a connection to the broker, buffering points of received messages until they are written to
+// Stackdriver.
+type subscriber struct {
+	config *MetricConfig
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the subscriber has stopped.
+
+	mu       sync.Mutex
+	space    *sync.Cond // signalled when buffered points are discarded, or the subscriber stops.
+	points   []point
+	dropped  int // points dropped or removed by downsampling because the buffer was full.
+	invalid  int
+	lastUsed time.Time
+	err      error // last connection error, or nil while connected.
+	stopped  bool
+}
+
+// getSubscriber returns the running subscriber of a metric, starting it if necessary. Subscribers of metrics that
+// have been reconfigured or have not been synced for a while are closed.
+func getSubscriber(name string, config *MetricConfig) *subscriber {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	for n, s := range subscribers {
+		s.mu.Lock()
+		idle := timeNow().Sub(s.lastUsed) > idleTimeout
+		s.mu.Unlock()
+		if idle || (n == name && !reflect.DeepEqual(s.config, config)) {
+			s.cancel()
+			delete(subscribers, n)
+		}
+	}
+	s, ok := subscribers[name]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		s = &subscriber{config: config, cancel: cancel, done: make(chan struct{}), lastUsed: timeNow()}
+		subscribers[name] = s
+		go s.run(ctx, name)
+	}
+	return s
+}
+
+// run connects to the broker and receives messages, reconnecting with exponential backoff, until `ctx` is done.
+func (s *subscriber) run(ctx context.Context, name string) {
+	defer close(s.done)
+	go func() {
+		// Unblock receive, so that the connection can be closed.
+		<-ctx.Done()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.stopped = true
+		s.spaceCond().Broadcast()
+	}()
+	backoff := minBackoff
+	for {
+		c, err := dial(s.config)
+		if err == nil {
+			log.Infof("Subscribed to %s on MQTT broker %s for metric %s", strings.Join(s.config.Topics, ", "), s.config.Broker, name)
+			s.setErr(nil)
+			closed := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					c.close()
+				case <-closed:
+				}
+			}()
+			connected := timeNow()
+			err = c.readLoop(s.receive)
+			c.close()
+			close(closed)
+			if timeNow().Sub(connected) > maxBackoff {
+				backoff = minBackoff
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warningf("MQTT subscription of metric %s failed, retrying in %v: %v", name, backoff, err)
+		s.setErr(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// spaceCond returns the condition variable signalled when space is freed. It needs to be called with s.mu held.
+func (s *subscriber) spaceCond() *sync.Cond {
+	if s.space == nil {
+		s.space = sync.NewCond(&s.mu)
+	}
+	return s.space
+}
+
+func (s *subscriber) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// receive buffers the value of a received message, applying the overflow policy if the buffer is full. With the
+// block policy, it waits until the next sync frees space, which stops the connection from reading further messages.
+func (s *subscriber) receive(msg message) {
+	if msg.retained && !s.config.IncludeRetained {
+		// Retained messages were published before subscribing, possibly a long time ago.
+		return
+	}
+	t := timeNow().Truncate(time.Millisecond)
+	labels, ok := s.config.topicLabels(msg.topic)
+	value, err := s.config.parsePayload(msg.payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !ok || err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		s.invalid++
+		return
+	}
+	size := s.config.bufferSize()
+	switch s.config.overflow() {
+	case overflowBlock:
+		for len(s.points) >= size && !s.stopped {
+			s.spaceCond().Wait()
+		}
+	case overflowDownsample:
+		for len(s.points) >= size {
+			n := len(s.points)
+			if s.points = downsample(s.points); len(s.points) == n {
+				break
+			}
+			s.dropped += n - len(s.points)
+		}
+	}
+	if len(s.points) >= size {
+		s.points = s.points[1:]
+		s.dropped++
+	}
+	s.points = append(s.points, point{labels, t, value})
+}
+
+// downsample removes every other point of each time series, keeping the newest one.
+func downsample(points []point) []point {
+	newer := make(map[string]int)
+	for _, p := range points {
+		newer[fmt.Sprint(p.labels)]++
+	}
+	var kept []point
+	for _, p := range points {
+		key := fmt.Sprint(p.labels)
+		if newer[key]--; newer[key]%2 == 0 {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// buffered returns points received after `lastPoint`, and discards older points, which have already been written.
+// Points are kept until they are older than `lastPoint`, so that they are not lost if writing them fails. It also
+// returns the number of points dropped or skipped since the last call, as well as the last connection error.
+func (s *subscriber) buffered(lastPoint time.Time) (points []point, dropped, invalid int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUsed = timeNow()
+	i := 0
+	for i < len(s.points) && !s.points[i].t.After(lastPoint) {
+		i++
+	}
+	s.points = s.points[i:]
+	if i > 0 {
+		s.spaceCond().Broadcast()
+	}
+	points = append(points, s.points...)
+	dropped, invalid = s.dropped, s.invalid
+	s.dropped, s.invalid = 0, 0
+	return points, dropped, invalid, s.err
+}
+
+// topicLabels returns the labels of a topic, mapping levels matched by wildcards of the first matching topic filter
+// to the configured labels. It returns false if the topic does not match any filter.
+func (c *MetricConfig) topicLabels(topic string) (map[string]string, bool) {
+	levels := strings.Split(topic, "/")
+	for _, filter := range c.Topics {
+		labels := make(map[string]string)
+		if matchTopic(strings.Split(filter, "/"), levels, c.TopicLabels, labels) {
+			return labels, true
+		}
+	}
+	return nil, false
+}
+
+// matchTopic matches topic levels against the levels of a filter, setting labels for wildcards.
+func matchTopic(filter, levels, names []string, labels map[string]string) bool {
+	for i, f := range filter {
+		switch {
+		case f == "#":
+			labels[names[0]] = strings.Join(levels[i:], "/")
+			return true
+		case i >= len(levels):
+			return false
+		case f == "+":
+			labels[names[0]] = levels[i]
+			names = names[1:]
+		case f != levels[i]:
+			return false
+		}
+	}
+	return len(filter) == len(levels)
+}
+
+// parsePayload returns the numeric value of a message payload.
+func (c *MetricConfig) parsePayload(payload []byte) (float64, error) {
+	if c.JSONField == "" {
+		return strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &obj); err != nil {
+		return 0, err
+	}
+	raw, ok := obj[c.JSONField]
+	if !ok {
+		return 0, fmt.Errorf("missing field %s", c.JSONField)
+	}
+	// Values can be numbers or numeric strings.
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return strconv.ParseFloat(s, 64)
+	}
+	var v float64
+	err := json.Unmarshal(raw, &v)
+	return v, err
+}
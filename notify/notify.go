@@ -0,0 +1,146 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package notify sends notifications about imported metrics to external channels, such as chat webhooks.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+	"github.com/google/ts-bridge/tserrors"
+)
+
+// Notification describes a threshold rule of a metric that started or stopped firing.
+type Notification struct {
+	Metric    string    `json:"metric"`
+	Rule      string    `json:"rule"`
+	Value     float64   `json:"value"`
+	Timestamp time.Time `json:"timestamp"`
+	Resolved  bool      `json:"resolved"`
+	// Text is a human-readable message. It's sent in the `text` field, which is understood by most chat webhooks.
+	Text string `json:"text"`
+}
+
+// ImportNotification describes new points of a metric that have been imported successfully, so that downstream
+// systems can react to fresh data without polling Stackdriver.
+type ImportNotification struct {
+	Metric string `json:"metric"`
+	Points int    `json:"points"`
+	// MinTimestamp and MaxTimestamp are the end times of the oldest and newest imported points.
+	MinTimestamp time.Time `json:"min_timestamp"`
+	MaxTimestamp time.Time `json:"max_timestamp"`
+	Text         string    `json:"text"`
+}
+
+// Notifier is implemented by notification channels.
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+	NotifyImport(ctx context.Context, n *ImportNotification) error
+}
+
+// ChannelConfig defines the configuration file parameters of a notification channel.
+type ChannelConfig struct {
+	Name       string `validate:"nonzero"`
+	WebhookURL string `yaml:"webhook_url"`
+	// The webhook URL often embeds a secret token, so it can also be read from a file.
+	WebhookURLFile string            `yaml:"webhook_url_file"`
+	HTTP           httpclient.Config `yaml:"http"`
+}
+
+// ReadSecretFiles sets the webhook URL from the contents of the configured file. Relative paths are resolved
+// relative to `dir`.
+func (c *ChannelConfig) ReadSecretFiles(dir string) error {
+	if c.WebhookURLFile == "" {
+		return nil
+	}
+	if c.WebhookURL != "" {
+		return fmt.Errorf("webhook_url and webhook_url_file cannot both be set")
+	}
+	u, err := env.ReadSecretFile(dir, c.WebhookURLFile)
+	if err != nil {
+		return fmt.Errorf("cannot read webhook_url_file: %v", err)
+	}
+	c.WebhookURL = u
+	return nil
+}
+
+// Webhook is a notification channel that posts notifications as JSON to a URL.
+type Webhook struct {
+	URL    string
+	client *http.Client
+}
+
+// NewWebhook creates a webhook notification channel.
+func NewWebhook(c *ChannelConfig) (*Webhook, error) {
+	if c.WebhookURL == "" {
+		return nil, fmt.Errorf("webhook_url must be set for notification channel '%s'", c.Name)
+	}
+	client, err := c.HTTP.Client()
+	if err != nil {
+		return nil, err
+	}
+	return &Webhook{URL: c.WebhookURL, client: client}, nil
+}
+
+// Notify posts a notification to the webhook URL.
+func (w *Webhook) Notify(ctx context.Context, n *Notification) error {
+	return w.post(ctx, n)
+}
+
+// NotifyImport posts an import notification to the webhook URL.
+func (w *Webhook) NotifyImport(ctx context.Context, n *ImportNotification) error {
+	return w.post(ctx, n)
+}
+
+// post sends a JSON payload to the webhook URL.
+func (w *Webhook) post(ctx context.Context, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		// The URL is not included in the error since it might contain a secret token.
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return tserrors.Wrap(tserrors.ErrDestinationTransient, fmt.Errorf("cannot send notification: %v", err))
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	err = fmt.Errorf("notification webhook returned status %s", resp.Status)
+	switch code := resp.StatusCode; {
+	case code == http.StatusTooManyRequests || code >= http.StatusInternalServerError:
+		return tserrors.Wrap(tserrors.ErrDestinationTransient, err)
+	case code >= http.StatusMultipleChoices:
+		return tserrors.Wrap(tserrors.ErrDestinationPermanent, err)
+	}
+	return nil
+}
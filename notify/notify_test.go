@@ -0,0 +1,144 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/tserrors"
+)
+
+func TestWebhookNotify(t *testing.T) {
+	var got Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected JSON content type; got %s", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("cannot decode notification: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	w, err := NewWebhook(&ChannelConfig{Name: "chat", WebhookURL: server.URL})
+	if err != nil {
+		t.Fatalf("NewWebhook() returned error: %v", err)
+	}
+	n := &Notification{Metric: "foo", Rule: "high", Value: 42, Text: "foo is high"}
+	if err := w.Notify(context.Background(), n); err != nil {
+		t.Fatalf("Notify() returned error: %v", err)
+	}
+	if got.Metric != "foo" || got.Rule != "high" || got.Value != 42 || got.Text != "foo is high" {
+		t.Errorf("unexpected notification received: %+v", got)
+	}
+}
+
+func TestWebhookNotifyImport(t *testing.T) {
+	var got map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("cannot decode notification: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	w, err := NewWebhook(&ChannelConfig{Name: "cache", WebhookURL: server.URL})
+	if err != nil {
+		t.Fatalf("NewWebhook() returned error: %v", err)
+	}
+	min := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	n := &ImportNotification{Metric: "foo", Points: 3, MinTimestamp: min, MaxTimestamp: min.Add(2 * time.Minute)}
+	if err := w.NotifyImport(context.Background(), n); err != nil {
+		t.Fatalf("NotifyImport() returned error: %v", err)
+	}
+	want := map[string]interface{}{
+		"metric":        "foo",
+		"points":        float64(3),
+		"min_timestamp": "2020-05-01T10:00:00Z",
+		"max_timestamp": "2020-05-01T10:02:00Z",
+		"text":          "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected payload %v; got %v", want, got)
+	}
+}
+
+func TestWebhookNotifyErrors(t *testing.T) {
+	for _, tt := range []struct {
+		status    int
+		wantClass error
+	}{
+		{http.StatusTooManyRequests, tserrors.ErrDestinationTransient},
+		{http.StatusBadGateway, tserrors.ErrDestinationTransient},
+		{http.StatusNotFound, tserrors.ErrDestinationPermanent},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+		w, _ := NewWebhook(&ChannelConfig{Name: "chat", WebhookURL: server.URL + "/secret-token"})
+		err := w.Notify(context.Background(), &Notification{})
+		server.Close()
+		if !errors.Is(err, tt.wantClass) {
+			t.Errorf("expected error of class %v for status %d; got %v", tt.wantClass, tt.status, err)
+		}
+	}
+
+	// Connection errors should not reveal the webhook URL.
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	w, _ := NewWebhook(&ChannelConfig{Name: "chat", WebhookURL: server.URL + "/secret-token"})
+	err := w.Notify(context.Background(), &Notification{})
+	if !errors.Is(err, tserrors.ErrDestinationTransient) {
+		t.Errorf("expected a transient error for a closed server; got %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "secret-token") {
+		t.Errorf("expected error not to contain the webhook URL; got %v", err)
+	}
+}
+
+func TestChannelConfigReadSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "webhook"), []byte("https://example.com/hook\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &ChannelConfig{Name: "chat", WebhookURLFile: "webhook"}
+	if err := c.ReadSecretFiles(dir); err != nil {
+		t.Fatalf("ReadSecretFiles() returned error: %v", err)
+	}
+	if c.WebhookURL != "https://example.com/hook" {
+		t.Errorf("expected webhook URL to be read from file; got %q", c.WebhookURL)
+	}
+
+	c = &ChannelConfig{Name: "chat", WebhookURL: "https://example.com", WebhookURLFile: "webhook"}
+	if err := c.ReadSecretFiles(dir); err == nil {
+		t.Errorf("expected error when both webhook_url and webhook_url_file are set")
+	}
+}
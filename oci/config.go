@@ -0,0 +1,123 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// defaultResolution is the interval between returned data points, unless configured.
+const defaultResolution = time.Minute
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from OCI Monitoring.
+type MetricConfig struct {
+	// Region is the OCI region of the metrics, e.g. us-ashburn-1.
+	Region string `validate:"nonzero"`
+	// Endpoint overrides the URL of the Monitoring telemetry API, which is derived from the region by default.
+	Endpoint string
+	// CompartmentID is the OCID of the compartment the metrics belong to.
+	CompartmentID string `yaml:"compartment_id" validate:"nonzero"`
+	// Namespace is the metric namespace, e.g. oci_computeagent.
+	Namespace string `validate:"nonzero"`
+	// Query is an MQL expression, e.g. `CpuUtilization[1m]{availabilityDomain = "AD1"}.mean()`.
+	Query string `validate:"nonzero"`
+	// Resolution is the interval between returned data points.
+	Resolution time.Duration
+
+	Auth AuthConfig
+
+	HTTP httpclient.Config `yaml:"http"`
+}
+
+// AuthConfig defines the API signing key of an OCI user, using the same parameters as the OCI CLI configuration
+// file.
+type AuthConfig struct {
+	// Tenancy and User are OCIDs of the tenancy and the user the key belongs to.
+	Tenancy string `validate:"nonzero"`
+	User    string `validate:"nonzero"`
+	// Fingerprint is the fingerprint of the public key, e.g. 20:3b:97:13:55:1c:...
+	Fingerprint string `validate:"nonzero"`
+	// KeyFile is the path to the PEM-encoded private key.
+	KeyFile    string `yaml:"key_file" validate:"nonzero"`
+	Passphrase string
+
+	// The passphrase of an encrypted key can also be read from a file, e.g. from a mounted Kubernetes secret.
+	PassphraseFile string `yaml:"passphrase_file"`
+
+	key string
+}
+
+// ReadSecretFiles reads the private key and the passphrase (if configured from a file). Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.Auth.KeyFile == "" {
+		// Reported by validation.
+		return nil
+	}
+	key, err := env.ReadSecretFile(dir, c.Auth.KeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read key_file: %v", err)
+	}
+	c.Auth.key = key
+	if c.Auth.PassphraseFile == "" {
+		return nil
+	}
+	if c.Auth.Passphrase != "" {
+		return fmt.Errorf("passphrase and passphrase_file cannot both be set")
+	}
+	passphrase, err := env.ReadSecretFile(dir, c.Auth.PassphraseFile)
+	if err != nil {
+		return fmt.Errorf("cannot read passphrase_file: %v", err)
+	}
+	c.Auth.Passphrase = passphrase
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if c.Resolution < 0 || c.Resolution%time.Minute != 0 {
+		return fmt.Errorf("resolution needs to be a positive number of minutes")
+	}
+	return nil
+}
+
+// endpoint returns the URL of the Monitoring telemetry API.
+func (c *MetricConfig) endpoint() string {
+	if c.Endpoint != "" {
+		return c.Endpoint
+	}
+	return fmt.Sprintf("https://telemetry.%s.oraclecloud.com", c.Region)
+}
+
+// resolution returns the interval between returned data points.
+func (c *MetricConfig) resolution() time.Duration {
+	if c.Resolution > 0 {
+		return c.Resolution
+	}
+	return defaultResolution
+}
+
+// resolutionString formats the resolution the way the API expects it, e.g. 5m or 1h.
+func (c *MetricConfig) resolutionString() string {
+	r := c.resolution()
+	if r%time.Hour == 0 {
+		return fmt.Sprintf("%dh", r/time.Hour)
+	}
+	return fmt.Sprintf("%dm", r/time.Minute)
+}
@@ -0,0 +1,258 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package oci imports the results of MQL queries from Oracle Cloud Infrastructure (OCI) Monitoring.
+package oci
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a metric imported from OCI Monitoring. It implements the SourceMetric interface.
+type Metric struct {
+	Name        string
+	config      *MetricConfig
+	signer      *signer
+	httpClient  *http.Client
+	minPointAge time.Duration
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters. The private key needs
+// to have been read using ReadSecretFiles.
+func NewSourceMetric(name string, config *MetricConfig, minPointAge time.Duration) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	signer, err := newSigner(&config.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid API key of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:        name,
+		config:      config,
+		signer:      signer,
+		httpClient:  httpClient,
+		minPointAge: minPointAge,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/oci/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "oci"
+}
+
+// SourceHost returns the host of the telemetry API. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.endpoint())
+	if err != nil || u.Host == "" {
+		return m.config.endpoint()
+	}
+	return u.Host
+}
+
+// Query returns the namespace and MQL query of this metric.
+func (m *Metric) Query() string {
+	return fmt.Sprintf("%s: %s", m.config.Namespace, m.config.Query)
+}
+
+// StackdriverData queries OCI Monitoring, returning metric descriptor and time series data with points after the
+// given lastPoint timestamp.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	return m.StackdriverDataUntil(ctx, lastPoint, time.Time{}, rec)
+}
+
+// Windowed returns whether the metric can be queried in windows, which is always the case for OCI metrics.
+func (m *Metric) Windowed() bool {
+	return true
+}
+
+// metricData is a series returned by the SummarizeMetricsData API.
+type metricData struct {
+	Dimensions           map[string]string `json:"dimensions"`
+	AggregatedDatapoints []struct {
+		Timestamp time.Time `json:"timestamp"`
+		Value     float64   `json:"value"`
+	} `json:"aggregatedDatapoints"`
+}
+
+// StackdriverDataUntil works like StackdriverData, but only queries points up to `until`, unless it's zero.
+func (m *Metric) StackdriverDataUntil(ctx context.Context, lastPoint, until time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	end := timeNow().Add(-m.minPointAge)
+	if !until.IsZero() && until.Before(end) {
+		end = until
+	}
+	if !end.After(lastPoint) {
+		return nil, nil, nil
+	}
+	data, err := m.summarize(ctx, lastPoint, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.WithContext(ctx).Debugf("Got %d OCI series for %s", len(data), m.Query())
+
+	var ts []*monitoringpb.TimeSeries
+	keys := make(map[string]bool)
+	for _, d := range data {
+		labels := make(map[string]string)
+		for k, v := range d.Dimensions {
+			key := labelKey(k)
+			labels[key] = v
+			keys[key] = true
+		}
+		for _, p := range d.AggregatedDatapoints {
+			if !p.Timestamp.After(lastPoint) || p.Timestamp.After(end) {
+				continue
+			}
+			et, err := ptypes.TimestampProto(p.Timestamp)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", p.Timestamp, err)
+			}
+			ts = append(ts, &monitoringpb.TimeSeries{
+				Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels},
+				Resource:   &monitoredres.MonitoredResource{Type: "global"},
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+				Points: []*monitoringpb.Point{{
+					Interval: &monitoringpb.TimeInterval{EndTime: et},
+					Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: p.Value}},
+				}},
+			})
+		}
+	}
+	return m.metricDescriptor(keys), ts, nil
+}
+
+// summarize runs the MQL query using the SummarizeMetricsData API.
+func (m *Metric) summarize(ctx context.Context, start, end time.Time) ([]metricData, error) {
+	body, err := json.Marshal(map[string]string{
+		"namespace":  m.config.Namespace,
+		"query":      m.config.Query,
+		"startTime":  start.UTC().Format(time.RFC3339),
+		"endTime":    end.UTC().Format(time.RFC3339),
+		"resolution": m.config.resolutionString(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("%s/20180401/metrics/actions/summarizeMetricsData?compartmentId=%s", strings.TrimSuffix(m.config.endpoint(), "/"),
+		url.QueryEscape(m.config.CompartmentID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if id := requestid.FromContext(ctx); id != "" {
+		// OCI uses its own header name for request IDs.
+		req.Header.Set("opc-request-id", id)
+	}
+	if err := m.signer.sign(req, body); err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("OCI Monitoring query failed: %w", err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("cannot read OCI Monitoring response: %w", err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("OCI Monitoring query returned HTTP status code %d: %s", resp.StatusCode, data))
+	}
+	var result []metricData
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("cannot parse OCI Monitoring response: %v", err)
+	}
+	return result, nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric, with the given label keys.
+func (m *Metric) metricDescriptor(keys map[string]bool) *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("OCI Monitoring query %s", m.Query()),
+		DisplayName: m.Name,
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		d.Labels = append(d.Labels, &label.LabelDescriptor{
+			Key:         k,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "OCI metric dimension",
+		})
+	}
+	return d
+}
+
+// labelKey converts an OCI dimension name (e.g. "resourceDisplayName") into a Stackdriver label key in snake case
+// (e.g. "resource_display_name").
+func labelKey(dimension string) string {
+	var b strings.Builder
+	for i, r := range dimension {
+		switch {
+		case unicode.IsUpper(r):
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// signedHeaders are the headers included in the signature of requests with a body, in the order required by OCI.
+// See https://docs.oracle.com/en-us/iaas/Content/API/Concepts/signingrequests.htm
+var signedHeaders = []string{"date", "(request-target)", "host", "content-length", "content-type", "x-content-sha256"}
+
+// signer signs OCI API requests with the API key of a user.
+type signer struct {
+	keyID string
+	key   *rsa.PrivateKey
+}
+
+// newSigner parses the private key of `auth`.
+func newSigner(auth *AuthConfig) (*signer, error) {
+	block, _ := pem.Decode([]byte(auth.key))
+	if block == nil {
+		return nil, fmt.Errorf("key_file does not contain a PEM-encoded key")
+	}
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		if auth.Passphrase == "" {
+			return nil, fmt.Errorf("key is encrypted, but no passphrase is configured")
+		}
+		var err error
+		if der, err = x509.DecryptPEMBlock(block, []byte(auth.Passphrase)); err != nil {
+			return nil, fmt.Errorf("cannot decrypt key: %v", err)
+		}
+	}
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		rsaKey, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("key is not an RSA key")
+		}
+		key = rsaKey
+	} else {
+		return nil, fmt.Errorf("cannot parse key: %v", err)
+	}
+	return &signer{
+		keyID: strings.Join([]string{auth.Tenancy, auth.User, auth.Fingerprint}, "/"),
+		key:   key,
+	}, nil
+}
+
+// sign adds the headers required by OCI, and the signature of those headers, to a request with the given body.
+func (s *signer) sign(req *http.Request, body []byte) error {
+	hash := sha256.Sum256(body)
+	req.Header.Set("Date", timeNow().UTC().Format(http.TimeFormat))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	req.Header.Set("X-Content-Sha256", base64.StdEncoding.EncodeToString(hash[:]))
+
+	digest := sha256.Sum256([]byte(signingString(req)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return fmt.Errorf("cannot sign request: %v", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf(`Signature version="1",keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		s.keyID, strings.Join(signedHeaders, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// signingString returns the string that is signed for a request: the signed headers in `name: value` lines.
+func signingString(req *http.Request) string {
+	lines := make([]string, len(signedHeaders))
+	for i, h := range signedHeaders {
+		var v string
+		switch h {
+		case "(request-target)":
+			v = fmt.Sprintf("%s %s", strings.ToLower(req.Method), req.URL.RequestURI())
+		case "host":
+			v = req.URL.Host
+		default:
+			v = req.Header.Get(h)
+		}
+		lines[i] = fmt.Sprintf("%s: %s", h, v)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,499 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/httpclient"
+	"github.com/google/ts-bridge/tserrors"
+)
+
+// Only the subset of the PostgreSQL frontend/backend protocol needed to run simple queries is implemented, which
+// avoids depending on a driver for a single source. See https://www.postgresql.org/docs/current/protocol.html.
+const (
+	protocolVersion = 3 << 16
+	sslRequestCode  = 80877103
+
+	// maxMessageSize limits the size of received messages, so that a misbehaving server cannot exhaust memory.
+	maxMessageSize = 1 << 20
+)
+
+// Authentication request types of AuthenticationXXX messages.
+const (
+	authOK           = 0
+	authCleartext    = 3
+	authMD5          = 5
+	authSASL         = 10
+	authSASLContinue = 11
+	authSASLFinal    = 12
+)
+
+// serverError is an ErrorResponse message sent by the server.
+type serverError struct {
+	severity string
+	code     string
+	message  string
+}
+
+func (e *serverError) Error() string {
+	return fmt.Sprintf("PostgreSQL %s %s: %s", e.severity, e.code, e.message)
+}
+
+// classify returns the error with a class based on its SQLSTATE code: connection problems, exhausted resources
+// (e.g. too many connections) and shutdowns are transient, while other errors (e.g. invalid credentials or
+// insufficient privileges) are permanent.
+func (e *serverError) classify() error {
+	switch {
+	case strings.HasPrefix(e.code, "08"), strings.HasPrefix(e.code, "40"), strings.HasPrefix(e.code, "53"),
+		strings.HasPrefix(e.code, "57"), strings.HasPrefix(e.code, "58"):
+		return tserrors.Wrap(tserrors.ErrSourceTransient, e)
+	}
+	return tserrors.Wrap(tserrors.ErrSourcePermanent, e)
+}
+
+// conn is a connection to a PostgreSQL server.
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+// dial connects to the configured server and authenticates. Reads and writes of the connection fail once the
+// context is done or the configured timeout has passed.
+func dial(ctx context.Context, config *MetricConfig) (*conn, error) {
+	deadline := time.Now().Add(config.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	addr := config.addr()
+	nc, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("cannot connect to PostgreSQL server %s: %w", addr, err))
+	}
+	nc.SetDeadline(deadline)
+	c := &conn{nc: nc, r: bufio.NewReader(nc)}
+	if err := c.startTLS(config); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if err := c.startup(config); err != nil {
+		c.nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// startTLS upgrades the connection to TLS unless disabled by ssl_mode.
+func (c *conn) startTLS(config *MetricConfig) error {
+	mode := config.sslMode()
+	if mode == "disable" {
+		return nil
+	}
+	if err := c.send(0, appendUint32(nil, sslRequestCode)); err != nil {
+		return tserrors.ClassifySource(fmt.Errorf("PostgreSQL connection failed: %w", err))
+	}
+	resp, err := c.r.ReadByte()
+	if err != nil {
+		return tserrors.ClassifySource(fmt.Errorf("PostgreSQL connection failed: %w", err))
+	}
+	if resp != 'S' {
+		return tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("PostgreSQL server %s does not support SSL; please set `ssl_mode: disable`", config.addr()))
+	}
+	tlsConfig, err := (&httpclient.Config{CAFile: config.CAFile}).TLSConfig()
+	if err != nil {
+		return tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if mode == "require" {
+		// Like libpq, `require` encrypts the connection without verifying the server certificate.
+		tlsConfig.InsecureSkipVerify = true
+	} else {
+		tlsConfig.ServerName = config.hostname()
+	}
+	tc := tls.Client(c.nc, tlsConfig)
+	if err := tc.Handshake(); err != nil {
+		return tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("TLS handshake with PostgreSQL server %s failed: %v", config.addr(), err))
+	}
+	c.nc, c.r = tc, bufio.NewReader(tc)
+	return nil
+}
+
+// startup sends the startup message and authenticates, waiting until the server is ready for queries.
+func (c *conn) startup(config *MetricConfig) error {
+	body := appendUint32(nil, protocolVersion)
+	for _, p := range [][2]string{{"user", config.User}, {"database", config.Database}, {"application_name", "ts-bridge"}} {
+		body = appendCString(appendCString(body, p[0]), p[1])
+	}
+	if err := c.send(0, append(body, 0)); err != nil {
+		return tserrors.ClassifySource(fmt.Errorf("PostgreSQL connection failed: %w", err))
+	}
+
+	var s *scram
+	for {
+		typ, msg, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 'R':
+			if s, err = c.authenticate(config, msg, s); err != nil {
+				return err
+			}
+		case 'E':
+			return parseError(msg).classify()
+		case 'Z':
+			return nil
+		case 'S', 'K', 'N':
+			// Parameter status, cancellation key and notices are not needed.
+		default:
+			return fmt.Errorf("unexpected PostgreSQL message type %q during startup", typ)
+		}
+	}
+}
+
+// authenticate responds to an authentication request of the server. SCRAM authentication spans several requests,
+// so its state is passed between calls.
+func (c *conn) authenticate(config *MetricConfig, msg *buffer, s *scram) (*scram, error) {
+	typ := msg.uint32()
+	if typ != authOK && config.Password == "" {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("PostgreSQL server requires a password for user %s", config.User))
+	}
+	var err error
+	switch typ {
+	case authOK:
+		return s, nil
+	case authCleartext:
+		err = c.send('p', appendCString(nil, config.Password))
+	case authMD5:
+		inner := md5.Sum([]byte(config.Password + config.User))
+		outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), msg.next(4)...))
+		err = c.send('p', appendCString(nil, "md5"+hex.EncodeToString(outer[:])))
+	case authSASL:
+		var mechanisms []string
+		for m := msg.cstring(); m != ""; m = msg.cstring() {
+			mechanisms = append(mechanisms, m)
+		}
+		if !contains(mechanisms, "SCRAM-SHA-256") {
+			return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("unsupported PostgreSQL SASL mechanisms %v", mechanisms))
+		}
+		if s, err = newSCRAM(config.Password); err != nil {
+			return nil, err
+		}
+		first := s.clientFirst()
+		body := appendCString(nil, "SCRAM-SHA-256")
+		body = appendUint32(body, uint32(len(first)))
+		err = c.send('p', append(body, first...))
+	case authSASLContinue:
+		if s == nil {
+			return nil, fmt.Errorf("unexpected PostgreSQL SASL continue message")
+		}
+		final, serr := s.clientFinal(string(msg.rest()))
+		if serr != nil {
+			return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, serr)
+		}
+		err = c.send('p', []byte(final))
+	case authSASLFinal:
+		if s == nil {
+			return nil, fmt.Errorf("unexpected PostgreSQL SASL final message")
+		}
+		if err := s.verify(string(msg.rest())); err != nil {
+			return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+		}
+		return s, nil
+	default:
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("unsupported PostgreSQL authentication method %d", typ))
+	}
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("PostgreSQL connection failed: %w", err))
+	}
+	return s, msg.err
+}
+
+// query runs a query using the simple query protocol, returning column names and rows of text values. NULL values
+// are returned as nil.
+func (c *conn) query(sql string) ([]string, [][]*string, error) {
+	if err := c.send('Q', appendCString(nil, sql)); err != nil {
+		return nil, nil, tserrors.ClassifySource(fmt.Errorf("PostgreSQL query failed: %w", err))
+	}
+	var columns []string
+	var rows [][]*string
+	var queryErr error
+	for {
+		typ, msg, err := c.receive()
+		if err != nil {
+			return nil, nil, err
+		}
+		switch typ {
+		case 'T':
+			columns = nil
+			for n := msg.uint16(); n > 0; n-- {
+				columns = append(columns, msg.cstring())
+				// Table OID, column number, type OID, type size, type modifier and format code.
+				msg.next(18)
+			}
+		case 'D':
+			var row []*string
+			for n := msg.uint16(); n > 0; n-- {
+				size := int32(msg.uint32())
+				if size < 0 {
+					row = append(row, nil)
+					continue
+				}
+				v := string(msg.next(int(size)))
+				row = append(row, &v)
+			}
+			rows = append(rows, row)
+		case 'E':
+			queryErr = parseError(msg).classify()
+		case 'Z':
+			return columns, rows, queryErr
+		case 'C', 'I', 'N', 'S':
+			// Command completion, empty queries, notices and parameter status changes.
+		default:
+			return nil, nil, fmt.Errorf("unexpected PostgreSQL message type %q", typ)
+		}
+		if msg.err != nil {
+			return nil, nil, msg.err
+		}
+	}
+}
+
+// close terminates the session and closes the connection.
+func (c *conn) close() error {
+	c.send('X', nil)
+	return c.nc.Close()
+}
+
+// send writes a message of the given type. The startup message and SSL request have no type byte.
+func (c *conn) send(typ byte, body []byte) error {
+	var b []byte
+	if typ != 0 {
+		b = append(b, typ)
+	}
+	b = appendUint32(b, uint32(len(body)+4))
+	_, err := c.nc.Write(append(b, body...))
+	return err
+}
+
+// receive reads a message, returning its type and body.
+func (c *conn) receive() (byte, *buffer, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, tserrors.ClassifySource(fmt.Errorf("PostgreSQL connection failed: %w", err))
+	}
+	size := int(binary.BigEndian.Uint32(header[1:])) - 4
+	if size < 0 || size > maxMessageSize {
+		return 0, nil, fmt.Errorf("invalid PostgreSQL message size %d", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, tserrors.ClassifySource(fmt.Errorf("PostgreSQL connection failed: %w", err))
+	}
+	return header[0], &buffer{b: body}, nil
+}
+
+// parseError parses the fields of an ErrorResponse message.
+func parseError(msg *buffer) *serverError {
+	e := &serverError{}
+	for {
+		field := msg.next(1)
+		if len(field) == 0 || field[0] == 0 {
+			return e
+		}
+		v := msg.cstring()
+		switch field[0] {
+		case 'S':
+			e.severity = v
+		case 'C':
+			e.code = v
+		case 'M':
+			e.message = v
+		}
+	}
+}
+
+// buffer reads fields of a received message. Reading past the end of the message sets err and returns zero values.
+type buffer struct {
+	b   []byte
+	err error
+}
+
+func (b *buffer) next(n int) []byte {
+	if n > len(b.b) {
+		b.err = errors.New("truncated PostgreSQL message")
+		b.b = nil
+		return nil
+	}
+	v := b.b[:n]
+	b.b = b.b[n:]
+	return v
+}
+
+func (b *buffer) uint16() int {
+	v := b.next(2)
+	if v == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(v))
+}
+
+func (b *buffer) uint32() uint32 {
+	v := b.next(4)
+	if v == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v)
+}
+
+func (b *buffer) cstring() string {
+	i := strings.IndexByte(string(b.b), 0)
+	if i < 0 {
+		b.err = errors.New("truncated PostgreSQL message")
+		b.b = nil
+		return ""
+	}
+	return string(b.next(i + 1)[:i])
+}
+
+func (b *buffer) rest() []byte {
+	return b.next(len(b.b))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendCString(b []byte, s string) []byte {
+	return append(append(b, s...), 0)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// scram implements the client side of SCRAM-SHA-256 authentication without channel binding, see RFC 5802 and
+// RFC 7677. The user name is sent by the startup message, so PostgreSQL ignores the one in client messages.
+type scram struct {
+	user, password  string
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newSCRAM(password string) (*scram, error) {
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &scram{password: password, nonce: base64.StdEncoding.EncodeToString(nonce)}, nil
+}
+
+// clientFirst returns the client-first-message.
+func (s *scram) clientFirst() string {
+	s.clientFirstBare = fmt.Sprintf("n=%s,r=%s", s.user, s.nonce)
+	return "n,," + s.clientFirstBare
+}
+
+// clientFinal returns the client-final-message with the proof for a given server-first-message.
+func (s *scram) clientFinal(serverFirst string) (string, error) {
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(serverFirst, ",") {
+		switch {
+		case strings.HasPrefix(attr, "r="):
+			nonce = attr[2:]
+		case strings.HasPrefix(attr, "s="):
+			salt = attr[2:]
+		case strings.HasPrefix(attr, "i="):
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	if !strings.HasPrefix(nonce, s.nonce) || len(nonce) == len(s.nonce) || iterations <= 0 {
+		return "", fmt.Errorf("invalid SCRAM server-first-message %q", serverFirst)
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return "", fmt.Errorf("invalid SCRAM salt: %v", err)
+	}
+
+	finalWithoutProof := "c=biws,r=" + nonce
+	authMessage := []byte(s.clientFirstBare + "," + serverFirst + "," + finalWithoutProof)
+	salted := pbkdf2SHA256([]byte(s.password), saltBytes, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	s.serverSignature = hmacSHA256(hmacSHA256(salted, []byte("Server Key")), authMessage)
+	return finalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verify checks the server signature of the server-final-message, which proves that the server knows the password.
+func (s *scram) verify(serverFinal string) error {
+	if !strings.HasPrefix(serverFinal, "v=") {
+		return fmt.Errorf("SCRAM authentication failed: %s", serverFinal)
+	}
+	sig, err := base64.StdEncoding.DecodeString(serverFinal[2:])
+	if err != nil || s.serverSignature == nil || !hmac.Equal(sig, s.serverSignature) {
+		return fmt.Errorf("invalid SCRAM server signature")
+	}
+	return nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a key from a password as defined by RFC 8018, with a single block of HMAC-SHA-256 output.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	u := hmacSHA256(password, append(append([]byte(nil), salt...), 0, 0, 0, 1))
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		u = hmacSHA256(password, u)
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+)
+
+const (
+	defaultPort    = "5432"
+	defaultTimeout = 30 * time.Second
+)
+
+// MetricConfig defines the configuration file parameters of a PostgreSQL database, from which the metrics of each
+// configured preset are imported.
+type MetricConfig struct {
+	// Host is the address of the server, optionally with a port, e.g. db.corp or db.corp:5433.
+	Host     string `validate:"nonzero"`
+	Database string `validate:"nonzero"`
+	User     string `validate:"nonzero"`
+	Password string
+	// SSLMode is `require` (the default) to encrypt the connection without verifying the server certificate,
+	// `verify-full` to also verify it, or `disable`.
+	SSLMode string `yaml:"ssl_mode" validate:"regexp=^(|disable|require|verify-full)$"`
+	// CAFile is the path to a PEM file with additional CA certificates trusted with `verify-full`.
+	CAFile string `yaml:"ca_file"`
+	// Presets lists the imported sets of health metrics. All presets are imported by default.
+	Presets []string
+	// Timeout limits the time taken to connect and run the query of a preset.
+	Timeout time.Duration
+
+	// The password can also be read from a file, e.g. from a mounted Kubernetes secret.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// ReadSecretFiles sets the password from the contents of the configured password file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.PasswordFile == "" {
+		return nil
+	}
+	if c.Password != "" {
+		return fmt.Errorf("password and password_file cannot both be set")
+	}
+	password, err := env.ReadSecretFile(dir, c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read password_file: %v", err)
+	}
+	c.Password = password
+	return nil
+}
+
+// EnabledPresets returns the names of the imported presets, which are all presets unless configured.
+func (c *MetricConfig) EnabledPresets() []string {
+	if len(c.Presets) > 0 {
+		return c.Presets
+	}
+	var names []string
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate(preset string) error {
+	if _, ok := presets[preset]; !ok {
+		return fmt.Errorf("unknown preset %q; supported presets are %v", preset, (&MetricConfig{}).EnabledPresets())
+	}
+	if c.CAFile != "" && c.sslMode() != "verify-full" {
+		return fmt.Errorf("ca_file requires `ssl_mode: verify-full`")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout cannot be negative")
+	}
+	return nil
+}
+
+// addr returns the host and port of the server.
+func (c *MetricConfig) addr() string {
+	if _, _, err := net.SplitHostPort(c.Host); err == nil {
+		return c.Host
+	}
+	return net.JoinHostPort(c.Host, defaultPort)
+}
+
+// hostname returns the host name of the server without the port.
+func (c *MetricConfig) hostname() string {
+	host, _, err := net.SplitHostPort(c.addr())
+	if err != nil {
+		return c.Host
+	}
+	return host
+}
+
+func (c *MetricConfig) sslMode() string {
+	if c.SSLMode == "" {
+		return "require"
+	}
+	return c.SSLMode
+}
+
+func (c *MetricConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package postgresql imports curated health metrics of PostgreSQL databases, such as connections, replication lag
+// and the cache hit ratio, from statistics views.
+package postgresql
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// preset is a query returning a row per time series, with a column for each label followed by the value.
+type preset struct {
+	query       string
+	labels      []presetLabel
+	description string
+	unit        string
+}
+
+// presetLabel is a label of time series returned by a preset.
+type presetLabel struct {
+	key         string
+	description string
+}
+
+// presets maps preset names to their queries. Queries only read statistics views, which are readable by any user
+// (though other sessions' states in pg_stat_activity need the pg_monitor role).
+var presets = map[string]preset{
+	"connections": {
+		query:       "SELECT coalesce(state, '') AS state, count(*) FROM pg_stat_activity WHERE datname = current_database() GROUP BY 1",
+		labels:      []presetLabel{{"state", "State of the connection, e.g. active or idle"}},
+		description: "Connections to the database by state",
+		unit:        "1",
+	},
+	"replication_lag": {
+		// The replay lag of each standby is reported by the primary, and a standby reports the age of the last
+		// transaction it replayed.
+		query: "SELECT application_name, coalesce(extract(epoch FROM replay_lag), 0) FROM pg_stat_replication " +
+			"UNION ALL SELECT '', coalesce(extract(epoch FROM now() - pg_last_xact_replay_timestamp()), 0) WHERE pg_is_in_recovery()",
+		labels:      []presetLabel{{"replica", "Application name of the standby, or empty on a standby itself"}},
+		description: "Replication lag in seconds",
+		unit:        "s",
+	},
+	"cache_hit_ratio": {
+		query:       "SELECT blks_hit::float8 / nullif(blks_hit + blks_read, 0) FROM pg_stat_database WHERE datname = current_database()",
+		description: "Ratio of buffer cache hits to blocks read since statistics were last reset",
+		unit:        "1",
+	},
+}
+
+// Metric defines a preset metric imported from a PostgreSQL database. It implements the SourceMetric interface.
+type Metric struct {
+	Name   string
+	preset string
+	config *MetricConfig
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name, a preset and configuration parameters.
+func NewSourceMetric(name, preset string, config *MetricConfig) (*Metric, error) {
+	if err := config.validate(preset); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	return &Metric{Name: name, preset: preset, config: config}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/postgresql/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "postgresql"
+}
+
+// SourceHost returns the address of the server. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	return m.config.addr()
+}
+
+// Query returns the query of the preset.
+func (m *Metric) Query() string {
+	return presets[m.preset].query
+}
+
+// StackdriverData runs the query of the preset, returning metric descriptor and time series with the current values.
+// Statistics views only reflect the current state, so a single point is imported per sync.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	now := timeNow().Truncate(time.Second)
+	if !now.After(lastPoint) {
+		return nil, nil, nil
+	}
+	end, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", now, err)
+	}
+
+	c, err := dial(ctx, m.config)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.close()
+	_, rows, err := c.query(m.Query())
+	if err != nil {
+		return nil, nil, err
+	}
+	log.WithContext(ctx).Debugf("Got %d rows from PostgreSQL for %s", len(rows), m.Name)
+
+	p := presets[m.preset]
+	var ts []*monitoringpb.TimeSeries
+	for _, row := range rows {
+		if len(row) != len(p.labels)+1 {
+			return nil, nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("expected %d columns; got %d", len(p.labels)+1, len(row)))
+		}
+		v := row[len(p.labels)]
+		if v == nil {
+			// e.g. the cache hit ratio of a database that has not read any blocks yet.
+			continue
+		}
+		value, err := strconv.ParseFloat(*v, 64)
+		if err != nil {
+			return nil, nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("cannot parse value %q: %v", *v, err))
+		}
+		labels := make(map[string]string)
+		for i, l := range p.labels {
+			if row[i] != nil {
+				labels[l.key] = *row[i]
+			} else {
+				labels[l.key] = ""
+			}
+		}
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: end},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+			}},
+		})
+	}
+	return m.metricDescriptor(), ts, nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	p := presets[m.preset]
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("%s of PostgreSQL database %s on %s", p.description, m.config.Database, m.config.addr()),
+		DisplayName: m.Name,
+		Unit:        p.unit,
+	}
+	for _, l := range p.labels {
+		d.Labels = append(d.Labels, &label.LabelDescriptor{
+			Key:         l.key,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: l.description,
+		})
+	}
+	return d
+}
@@ -0,0 +1,380 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/tserrors"
+
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testResult is the response of the test server to a query: either rows of text values or an error code.
+type testResult struct {
+	rows [][]*string
+	code string
+}
+
+// testServer is a PostgreSQL server that authenticates user `ts_bridge` with password `secret` using the given
+// method (`trust`, `md5` or `scram`), and responds to queries with canned results.
+type testServer struct {
+	ln          net.Listener
+	auth        string
+	startupCode string
+	results     map[string]testResult
+}
+
+func newTestServer(t *testing.T, auth string, results map[string]testResult) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{ln: ln, auth: auth, results: results}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(nc)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) config() *MetricConfig {
+	return &MetricConfig{Host: s.ln.Addr().String(), Database: "orders", User: "ts_bridge", Password: "secret", SSLMode: "disable"}
+}
+
+func str(s string) *string { return &s }
+
+func (s *testServer) serve(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	write := func(typ byte, body []byte) {
+		nc.Write(append(appendUint32([]byte{typ}, uint32(len(body)+4)), body...))
+	}
+	writeError := func(code string) {
+		body := appendCString(append(appendCString([]byte{'S'}, "FATAL"), 'C'), code)
+		write('E', append(appendCString(append(body, 'M'), "test error"), 0))
+	}
+	read := func(startup bool) (byte, []byte) {
+		var typ [1]byte
+		if !startup {
+			if _, err := io.ReadFull(r, typ[:]); err != nil {
+				return 0, nil
+			}
+		}
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return 0, nil
+		}
+		body := make([]byte, binary.BigEndian.Uint32(size[:])-4)
+		io.ReadFull(r, body)
+		return typ[0], body
+	}
+
+	_, startup := read(true)
+	if binary.BigEndian.Uint32(startup) == sslRequestCode {
+		nc.Write([]byte{'N'})
+		_, startup = read(true)
+	}
+	if !strings.Contains(string(startup), "user\x00ts_bridge\x00database\x00orders\x00") {
+		writeError("28000")
+		return
+	}
+	if s.startupCode != "" {
+		writeError(s.startupCode)
+		return
+	}
+	switch s.auth {
+	case "md5":
+		write('R', []byte{0, 0, 0, authMD5, 1, 2, 3, 4})
+		_, password := read(false)
+		inner := md5.Sum([]byte("secretts_bridge"))
+		outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), 1, 2, 3, 4))
+		if string(password) != "md5"+hex.EncodeToString(outer[:])+"\x00" {
+			writeError("28P01")
+			return
+		}
+	case "scram":
+		write('R', append(appendUint32(nil, authSASL), "SCRAM-SHA-256-PLUS\x00SCRAM-SHA-256\x00\x00"...))
+		_, initial := read(false)
+		if len(initial) < len("SCRAM-SHA-256\x00")+4 {
+			return
+		}
+		clientFirst := string(initial[len("SCRAM-SHA-256\x00")+4:])
+		nonce := strings.TrimPrefix(clientFirst, "n,,n=,r=") + "server"
+		serverFirst := "r=" + nonce + ",s=" + base64.StdEncoding.EncodeToString([]byte("salt")) + ",i=4096"
+		write('R', append(appendUint32(nil, authSASLContinue), serverFirst...))
+		_, clientFinal := read(false)
+		finalWithoutProof := "c=biws,r=" + nonce
+		authMessage := []byte(strings.TrimPrefix(clientFirst, "n,,") + "," + serverFirst + "," + finalWithoutProof)
+		salted := pbkdf2SHA256([]byte("secret"), []byte("salt"), 4096)
+		clientKey := hmacSHA256(salted, []byte("Client Key"))
+		storedKey := sha256.Sum256(clientKey)
+		proof := hmacSHA256(storedKey[:], authMessage)
+		for i := range proof {
+			proof[i] ^= clientKey[i]
+		}
+		if string(clientFinal) != finalWithoutProof+",p="+base64.StdEncoding.EncodeToString(proof) {
+			writeError("28P01")
+			return
+		}
+		sig := hmacSHA256(hmacSHA256(salted, []byte("Server Key")), authMessage)
+		write('R', append(appendUint32(nil, authSASLFinal), "v="+base64.StdEncoding.EncodeToString(sig)...))
+	}
+	write('R', appendUint32(nil, authOK))
+	write('S', appendCString(appendCString(nil, "server_version"), "14.5"))
+	write('Z', []byte{'I'})
+
+	for {
+		typ, body := read(false)
+		if typ != 'Q' {
+			return
+		}
+		result, ok := s.results[strings.TrimSuffix(string(body), "\x00")]
+		switch {
+		case !ok:
+			writeError("42601")
+		case result.code != "":
+			writeError(result.code)
+		default:
+			desc := []byte{0, 2}
+			for _, name := range []string{"label", "value"} {
+				desc = append(appendCString(desc, name), make([]byte, 18)...)
+			}
+			write('T', desc)
+			for _, row := range result.rows {
+				data := []byte{0, byte(len(row))}
+				for _, v := range row {
+					if v == nil {
+						data = appendUint32(data, 0xffffffff)
+					} else {
+						data = append(appendUint32(data, uint32(len(*v))), *v...)
+					}
+				}
+				write('D', data)
+			}
+			write('C', appendCString(nil, "SELECT"))
+		}
+		write('Z', []byte{'I'})
+	}
+}
+
+// testSeries is a simplified representation of a time series written to Stackdriver.
+type testSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+func testPoints(ts []*monitoringpb.TimeSeries) []testSeries {
+	var series []testSeries
+	for _, s := range ts {
+		series = append(series, testSeries{s.Metric.Labels, s.Points[0].Value.GetDoubleValue()})
+	}
+	return series
+}
+
+func TestStackdriverDataConnections(t *testing.T) {
+	for _, auth := range []string{"trust", "md5", "scram"} {
+		t.Run(auth, func(t *testing.T) {
+			server := newTestServer(t, auth, map[string]testResult{
+				presets["connections"].query: {rows: [][]*string{{str("active"), str("3")}, {str("idle"), str("12")}, {str(""), str("1")}}},
+			})
+			defer server.ln.Close()
+
+			m, err := NewSourceMetric("orders_connections", "connections", server.config())
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			desc, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+			if err != nil {
+				t.Fatalf("unexpected error from StackdriverData: %v", err)
+			}
+			if desc.Type != "custom.googleapis.com/postgresql/orders_connections" || len(desc.Labels) != 1 || desc.Labels[0].Key != "state" {
+				t.Errorf("unexpected metric descriptor %v", desc)
+			}
+			want := []testSeries{
+				{map[string]string{"state": "active"}, 3},
+				{map[string]string{"state": "idle"}, 12},
+				{map[string]string{"state": ""}, 1},
+			}
+			if got := testPoints(ts); !reflect.DeepEqual(got, want) {
+				t.Errorf("expected series %v; got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestStackdriverDataPresets(t *testing.T) {
+	server := newTestServer(t, "scram", map[string]testResult{
+		presets["replication_lag"].query: {rows: [][]*string{{str("replica1"), str("0.25")}, {nil, str("3")}}},
+		presets["cache_hit_ratio"].query: {rows: [][]*string{{nil}}},
+	})
+	defer server.ln.Close()
+
+	m, err := NewSourceMetric("orders_replication_lag", "replication_lag", server.config())
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	desc, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	want := []testSeries{{map[string]string{"replica": "replica1"}, 0.25}, {map[string]string{"replica": ""}, 3}}
+	if got := testPoints(ts); !reflect.DeepEqual(got, want) || desc.Unit != "s" {
+		t.Errorf("expected series %v with unit s; got %v with unit %s", want, got, desc.Unit)
+	}
+
+	// The cache hit ratio is NULL until blocks are read.
+	m, err = NewSourceMetric("orders_cache_hit_ratio", "cache_hit_ratio", server.config())
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	if _, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil); err != nil || len(ts) != 0 {
+		t.Errorf("expected no points for a NULL cache hit ratio; got %v, %v", ts, err)
+	}
+
+	// Points are only written once per second.
+	timeNow = func() time.Time { return time.Now().Truncate(time.Second) }
+	defer func() { timeNow = time.Now }()
+	if _, ts, err := m.StackdriverData(context.Background(), timeNow(), nil); err != nil || len(ts) != 0 {
+		t.Errorf("expected no points to be returned again; got %v, %v", ts, err)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc        string
+		auth        string
+		startupCode string
+		queryCode   string
+		modify      func(*MetricConfig)
+		wantClass   error
+	}{
+		{"wrong password", "scram", "", "", func(c *MetricConfig) { c.Password = "wrong" }, tserrors.ErrSourcePermanent},
+		{"wrong md5 password", "md5", "", "", func(c *MetricConfig) { c.Password = "wrong" }, tserrors.ErrSourcePermanent},
+		{"missing password", "scram", "", "", func(c *MetricConfig) { c.Password = "" }, tserrors.ErrSourcePermanent},
+		{"unknown user", "trust", "", "", func(c *MetricConfig) { c.User = "admin" }, tserrors.ErrSourcePermanent},
+		{"too many connections", "trust", "53300", "", nil, tserrors.ErrSourceTransient},
+		{"shutting down", "trust", "57P03", "", nil, tserrors.ErrSourceTransient},
+		{"insufficient privilege", "trust", "", "42501", nil, tserrors.ErrSourcePermanent},
+		{"ssl not supported", "trust", "", "", func(c *MetricConfig) { c.SSLMode = "" }, tserrors.ErrSourcePermanent},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := newTestServer(t, tt.auth, map[string]testResult{
+				presets["connections"].query: {rows: [][]*string{{str("active"), str("1")}}, code: tt.queryCode},
+			})
+			server.startupCode = tt.startupCode
+			defer server.ln.Close()
+
+			config := server.config()
+			if tt.modify != nil {
+				tt.modify(config)
+			}
+			m, err := NewSourceMetric("errors", "connections", config)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestStackdriverDataConnectionRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &MetricConfig{Host: ln.Addr().String(), Database: "orders", User: "ts_bridge"}
+	ln.Close()
+
+	m, err := NewSourceMetric("refused", "connections", config)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	if _, _, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil); !errors.Is(err, tserrors.ErrSourceTransient) {
+		t.Errorf("expected error %v to be transient", err)
+	}
+}
+
+// TestSCRAM uses the example exchange of RFC 7677.
+func TestSCRAM(t *testing.T) {
+	s := &scram{user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	if got, want := s.clientFirst(), "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"; got != want {
+		t.Errorf("expected client-first-message %s; got %s", want, got)
+	}
+	final, err := s.clientFinal("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatalf("unexpected error from clientFinal: %v", err)
+	}
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; final != want {
+		t.Errorf("expected client-final-message %s; got %s", want, final)
+	}
+	if err := s.verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Errorf("unexpected error from verify: %v", err)
+	}
+	if err := s.verify("v=" + base64.StdEncoding.EncodeToString([]byte("forged"))); err == nil {
+		t.Errorf("expected a forged server signature to be rejected")
+	}
+	if _, err := s.clientFinal("r=other,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"); err == nil {
+		t.Errorf("expected a server nonce without the client nonce to be rejected")
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, tt := range []struct {
+		preset string
+		config *MetricConfig
+	}{
+		{"locks", &MetricConfig{Host: "db.corp", Database: "orders", User: "ts_bridge"}},
+		{"connections", &MetricConfig{Host: "db.corp", Database: "orders", User: "ts_bridge", CAFile: "ca.pem"}},
+		{"connections", &MetricConfig{Host: "db.corp", Database: "orders", User: "ts_bridge", Timeout: -time.Second}},
+	} {
+		if _, err := NewSourceMetric("invalid", tt.preset, tt.config); err == nil {
+			t.Errorf("expected NewSourceMetric to reject preset %s with configuration %+v", tt.preset, tt.config)
+		}
+	}
+}
+
+func TestEnabledPresets(t *testing.T) {
+	if got, want := (&MetricConfig{}).EnabledPresets(), []string{"cache_hit_ratio", "connections", "replication_lag"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected all presets %v by default; got %v", want, got)
+	}
+	if got, want := (&MetricConfig{Presets: []string{"connections"}}).EnabledPresets(), []string{"connections"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected configured presets %v; got %v", want, got)
+	}
+	if got, want := (&MetricConfig{Host: "db.corp"}).addr(), "db.corp:5432"; got != want {
+		t.Errorf("expected address %s; got %s", want, got)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/httpclient"
+)
+
+const (
+	defaultTimeout  = 10 * time.Second
+	defaultInterval = time.Second
+)
+
+// MetricConfig defines the configuration file parameters for a specific metric probing a list of targets.
+type MetricConfig struct {
+	// Type is `http` (the default) to request URLs, `tcp` to open connections to host:port addresses, `dns` to
+	// resolve hostnames, or `icmp` to send echo requests to hosts.
+	Type string `validate:"regexp=^(|http|tcp|dns|icmp)$"`
+	// Targets lists probed URLs, host:port addresses or hostnames, depending on the type.
+	Targets []string `validate:"nonzero"`
+	// Value is `success` (the default), 1 if any probe of a target succeeded and 0 otherwise, `duration`, the mean
+	// time taken by successful probes in seconds, `jitter`, the mean difference between durations of consecutive
+	// successful probes, `packet_loss`, the ratio of failed probes, or `cert_expiry`, the days until the first
+	// certificate of the verified chain of a TLS target expires.
+	Value string `validate:"regexp=^(|success|duration|jitter|packet_loss|cert_expiry)$"`
+	// Timeout limits the time taken by each probe.
+	Timeout time.Duration
+	// Count is the number of probes of each target during a sync, 1 by default.
+	Count int `validate:"min=0"`
+	// Interval is the time between probes of a target, 1s by default.
+	Interval time.Duration
+
+	// Method is the method of HTTP requests, GET by default.
+	Method string
+	// Headers are added to HTTP requests, e.g. a Host header for a virtual host served by the target.
+	Headers map[string]string
+	// ValidStatusCodes lists status codes of successful HTTP probes, any 2xx status code by default.
+	ValidStatusCodes []int `yaml:"valid_status_codes"`
+	// BodyRegexp needs to match the body of responses to successful HTTP probes if it's set.
+	BodyRegexp string `yaml:"body_regexp"`
+	// NoFollowRedirects makes HTTP probes check redirect responses rather than following them.
+	NoFollowRedirects bool `yaml:"no_follow_redirects"`
+
+	// TLS makes TCP probes complete a TLS handshake, verifying the certificate of the target.
+	TLS bool
+
+	// DNSServer is the host:port address of the DNS server used by DNS probes instead of the system resolver.
+	DNSServer string `yaml:"dns_server"`
+
+	// HTTP settings also apply to TCP probes, which trust the CAs in http.ca_file.
+	HTTP httpclient.Config `yaml:"http"`
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	for _, t := range c.Targets {
+		if c.probeType() == "http" {
+			u, err := url.Parse(t)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("target %q is not an http or https URL", t)
+			}
+		} else if c.probeType() == "dns" || c.probeType() == "icmp" {
+			if t == "" || strings.ContainsAny(t, ":/ ") {
+				return fmt.Errorf("target %q is not a hostname", t)
+			}
+		} else if _, _, err := net.SplitHostPort(t); err != nil {
+			return fmt.Errorf("invalid target %q: %v", t, err)
+		}
+	}
+	if c.DNSServer != "" {
+		if c.probeType() != "dns" {
+			return fmt.Errorf("dns_server is only supported by DNS probes")
+		}
+		if _, _, err := net.SplitHostPort(c.DNSServer); err != nil {
+			return fmt.Errorf("invalid dns_server %q: %v", c.DNSServer, err)
+		}
+	}
+	if c.value() == "cert_expiry" {
+		switch c.probeType() {
+		case "dns", "icmp":
+			return fmt.Errorf("%s probes have no certificates", strings.ToUpper(c.probeType()))
+		case "tcp":
+			if !c.TLS {
+				return fmt.Errorf("cert_expiry of TCP probes requires `tls: true`")
+			}
+		case "http":
+			for _, t := range c.Targets {
+				if u, _ := url.Parse(t); u.Scheme != "https" {
+					return fmt.Errorf("cert_expiry requires https targets, not %q", t)
+				}
+			}
+		}
+	}
+	if c.probeType() != "http" {
+		if c.Method != "" || len(c.Headers) > 0 || len(c.ValidStatusCodes) > 0 || c.BodyRegexp != "" || c.NoFollowRedirects {
+			return fmt.Errorf("method, headers, valid_status_codes, body_regexp and no_follow_redirects are only supported by HTTP probes")
+		}
+	}
+	if c.TLS && c.probeType() != "tcp" {
+		return fmt.Errorf("tls is only supported by TCP probes, HTTP probes use https URLs")
+	}
+	for _, code := range c.ValidStatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid status code %d", code)
+		}
+	}
+	if _, err := regexp.Compile(c.BodyRegexp); err != nil {
+		return fmt.Errorf("invalid body_regexp: %v", err)
+	}
+	if c.value() == "jitter" && c.count() < 2 {
+		return fmt.Errorf("jitter requires a count of at least 2")
+	}
+	if c.Timeout < 0 || c.Interval < 0 {
+		return fmt.Errorf("timeout and interval cannot be negative")
+	}
+	return nil
+}
+
+func (c *MetricConfig) probeType() string {
+	if c.Type == "" {
+		return "http"
+	}
+	return c.Type
+}
+
+func (c *MetricConfig) value() string {
+	if c.Value == "" {
+		return "success"
+	}
+	return c.Value
+}
+
+func (c *MetricConfig) method() string {
+	if c.Method == "" {
+		return http.MethodGet
+	}
+	return c.Method
+}
+
+func (c *MetricConfig) count() int {
+	if c.Count > 0 {
+		return c.Count
+	}
+	return 1
+}
+
+func (c *MetricConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return defaultInterval
+}
+
+func (c *MetricConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
+
+// validStatus reports whether a status code is one of the configured codes, or a 2xx code by default.
+func (c *MetricConfig) validStatus(code int) bool {
+	if len(c.ValidStatusCodes) == 0 {
+		return code >= 200 && code < 300
+	}
+	for _, valid := range c.ValidStatusCodes {
+		if valid == code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+// ICMP message types of echo requests and replies.
+const (
+	icmpv4EchoRequest = 8
+	icmpv4EchoReply   = 0
+	icmpv6EchoRequest = 128
+	icmpv6EchoReply   = 129
+)
+
+// icmpSeq is the sequence number of the last echo request. Requests are identified by the process ID, like those
+// of the ping utility, and by their sequence number.
+var icmpSeq uint32
+
+// probeICMP sends an echo request to the first address of a host, waiting for the matching echo reply. Raw sockets
+// are used, which require running as root or with the CAP_NET_RAW capability.
+func (m *Metric) probeICMP(ctx context.Context, target string) error {
+	addrs, err := m.resolver.LookupIPAddr(ctx, target)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("no addresses of %s", target)
+	}
+	ip := addrs[0].IP
+	network, request, reply := "ip4:icmp", byte(icmpv4EchoRequest), byte(icmpv4EchoReply)
+	if ip.To4() == nil {
+		network, request, reply = "ip6:ipv6-icmp", icmpv6EchoRequest, icmpv6EchoReply
+	}
+	conn, err := net.ListenPacket(network, "")
+	if err != nil {
+		return fmt.Errorf("cannot open ICMP socket: %v", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	id, seq := uint16(os.Getpid()), uint16(atomic.AddUint32(&icmpSeq, 1))
+	msg := []byte{request, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	msg = append(msg, "ts-bridge"...)
+	if ip.To4() != nil {
+		// The kernel computes checksums of ICMPv6 messages, which include a pseudo-header.
+		binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	}
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: ip}); err != nil {
+		return err
+	}
+
+	// The socket receives all ICMP messages of the host, so replies to other requests are skipped. The IPv4 header
+	// is removed from received messages.
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n < 8 || buf[0] != reply || binary.BigEndian.Uint16(buf[4:]) != id || binary.BigEndian.Uint16(buf[6:]) != seq {
+			continue
+		}
+		if a, ok := from.(*net.IPAddr); ok && a.IP.Equal(ip) {
+			return nil
+		}
+	}
+}
+
+// checksum computes the Internet checksum of a message, as defined by RFC 1071.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,387 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package probe checks the availability of HTTP(S) endpoints, TCP services, DNS names and hosts answering ICMP echo
+// requests, importing whether probes succeeded, how long they took, their jitter and loss, or when the certificate
+// of the target expires.
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/ts-bridge/storage"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// maxBodySize limits the part of response bodies matched against body_regexp.
+const maxBodySize = 1 << 20
+
+// Metric defines a metric probing a list of targets. It implements the SourceMetric interface.
+type Metric struct {
+	Name       string
+	config     *MetricConfig
+	httpClient *http.Client
+	tlsConfig  *tls.Config
+	bodyRegexp *regexp.Regexp
+	resolver   *net.Resolver
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	// Each probe opens a new connection, so that its duration includes connecting to the target.
+	httpClient.Transport.(*http.Transport).DisableKeepAlives = true
+	if config.NoFollowRedirects {
+		httpClient.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	}
+	tlsConfig, err := config.HTTP.TLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	m := &Metric{
+		Name:       name,
+		config:     config,
+		httpClient: httpClient,
+		tlsConfig:  tlsConfig,
+	}
+	if config.BodyRegexp != "" {
+		m.bodyRegexp = regexp.MustCompile(config.BodyRegexp)
+	}
+	m.resolver = net.DefaultResolver
+	if config.DNSServer != "" {
+		m.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, config.DNSServer)
+			},
+		}
+	}
+	return m, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/probe/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "probe"
+}
+
+// SourceHost returns the host of the first target. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	t := m.config.Targets[0]
+	if m.config.probeType() == "http" {
+		if u, err := url.Parse(t); err == nil {
+			return u.Host
+		}
+	}
+	return t
+}
+
+// Query returns the probe type and targets.
+func (m *Metric) Query() string {
+	return fmt.Sprintf("%s probe of %s", m.config.probeType(), strings.Join(m.config.Targets, ", "))
+}
+
+// result is the outcome of probing a target `count` times. The expiry is only set for TLS targets.
+type result struct {
+	target string
+	// durations are the times taken by successful probes, in the order they ran.
+	durations []time.Duration
+	failures  int
+	expiry    time.Time
+	// err is the error of the last failed probe.
+	err error
+}
+
+// StackdriverData probes all targets concurrently, returning metric descriptor and a time series per target with
+// the outcome of the probes. A single point is imported per sync, and failed probes are not errors of the source.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	now := timeNow().Truncate(time.Second)
+	if !now.After(lastPoint) {
+		return nil, nil, nil
+	}
+	end, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", now, err)
+	}
+
+	results := make([]result, len(m.config.Targets))
+	var wg sync.WaitGroup
+	for i, t := range m.config.Targets {
+		wg.Add(1)
+		go func(i int, t string) {
+			defer wg.Done()
+			results[i] = m.probe(ctx, t)
+		}(i, t)
+	}
+	wg.Wait()
+
+	var ts []*monitoringpb.TimeSeries
+	failed := 0
+	for _, r := range results {
+		if r.failures > 0 {
+			failed++
+			log.WithContext(ctx).Infof("%d of %d %s probes of %s failed, last error: %v", r.failures, m.config.count(), m.config.probeType(), r.target, r.err)
+		}
+		value, ok := m.value(r, now)
+		if !ok {
+			continue
+		}
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: map[string]string{"target": r.target}},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: end},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+			}},
+		})
+	}
+	log.WithContext(ctx).Debugf("Probed %d targets of metric %s, %d had failures", len(results), m.Name, failed)
+	return m.metricDescriptor(), ts, nil
+}
+
+// value returns the imported value of a result, or false if the target has no value, e.g. the duration of a
+// target without successful probes.
+func (m *Metric) value(r result, now time.Time) (float64, bool) {
+	switch m.config.value() {
+	case "duration":
+		if len(r.durations) == 0 {
+			return 0, false
+		}
+		var sum time.Duration
+		for _, d := range r.durations {
+			sum += d
+		}
+		return sum.Seconds() / float64(len(r.durations)), true
+	case "jitter":
+		// Jitter is the mean difference between durations of consecutive probes, as in RFC 3550.
+		if len(r.durations) < 2 {
+			return 0, false
+		}
+		var sum time.Duration
+		for i := 1; i < len(r.durations); i++ {
+			d := r.durations[i] - r.durations[i-1]
+			if d < 0 {
+				d = -d
+			}
+			sum += d
+		}
+		return sum.Seconds() / float64(len(r.durations)-1), true
+	case "packet_loss":
+		return float64(r.failures) / float64(m.config.count()), true
+	case "cert_expiry":
+		if r.expiry.IsZero() {
+			return 0, false
+		}
+		return r.expiry.Sub(now).Hours() / 24, true
+	}
+	if len(r.durations) == 0 {
+		return 0, true
+	}
+	return 1, true
+}
+
+// probe checks a target `count` times, waiting for `interval` between probes.
+func (m *Metric) probe(ctx context.Context, target string) result {
+	r := result{target: target}
+	for i := 0; i < m.config.count(); i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(m.config.interval()):
+			}
+		}
+		duration, expiry, err := m.probeOnce(ctx, target)
+		if err != nil {
+			r.failures++
+			r.err = err
+			continue
+		}
+		r.durations = append(r.durations, duration)
+		if r.expiry.IsZero() {
+			r.expiry = expiry
+		}
+	}
+	return r
+}
+
+// probeOnce checks a target, returning the time taken by the check and the expiry of the certificate of TLS
+// targets.
+func (m *Metric) probeOnce(ctx context.Context, target string) (time.Duration, time.Time, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.config.timeout())
+	defer cancel()
+	start := time.Now()
+	var state *tls.ConnectionState
+	var err error
+	switch m.config.probeType() {
+	case "tcp":
+		state, err = m.probeTCP(ctx, target)
+	case "dns":
+		err = m.probeDNS(ctx, target)
+	case "icmp":
+		err = m.probeICMP(ctx, target)
+	default:
+		state, err = m.probeHTTP(ctx, target)
+	}
+	duration := time.Since(start)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var expiry time.Time
+	if state != nil && len(state.VerifiedChains) > 0 {
+		for _, cert := range state.VerifiedChains[0] {
+			if expiry.IsZero() || cert.NotAfter.Before(expiry) {
+				expiry = cert.NotAfter
+			}
+		}
+	}
+	if m.config.value() == "cert_expiry" && expiry.IsZero() {
+		return 0, time.Time{}, fmt.Errorf("no verified certificate")
+	}
+	return duration, expiry, nil
+}
+
+// probeHTTP requests a URL, checking the status code and body of the response. The TLS connection state of the
+// response is returned for https targets.
+func (m *Metric) probeHTTP(ctx context.Context, target string) (*tls.ConnectionState, error) {
+	req, err := http.NewRequestWithContext(ctx, m.config.method(), target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range m.config.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+		} else {
+			req.Header.Set(k, v)
+		}
+	}
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// The body is read in full, so that the duration includes the transfer of the response.
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read response: %v", err)
+	}
+	if !m.config.validStatus(resp.StatusCode) {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if m.bodyRegexp != nil && !m.bodyRegexp.Match(body) {
+		return nil, fmt.Errorf("response does not match %s", m.config.BodyRegexp)
+	}
+	return resp.TLS, nil
+}
+
+// probeTCP opens a connection to a host:port address, completing a TLS handshake if configured. The TLS
+// connection state is returned after a handshake.
+func (m *Metric) probeTCP(ctx context.Context, target string) (*tls.ConnectionState, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if !m.config.TLS {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if m.tlsConfig != nil {
+		config = m.tlsConfig.Clone()
+	}
+	config.ServerName, _, _ = net.SplitHostPort(target)
+	tlsConn := tls.Client(conn, config)
+	if deadline, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(deadline)
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tlsConn.ConnectionState()
+	return &state, nil
+}
+
+// probeDNS resolves a hostname, which fails unless it has at least one address.
+func (m *Metric) probeDNS(ctx context.Context, target string) error {
+	addrs, err := m.resolver.LookupIPAddr(ctx, target)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("no addresses of %s", target)
+	}
+	return nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Success of %s probes", m.config.probeType()),
+		DisplayName: m.Name,
+		Labels: []*label.LabelDescriptor{
+			{Key: "target", ValueType: label.LabelDescriptor_STRING, Description: "Probed target"},
+		},
+	}
+	switch m.config.value() {
+	case "duration":
+		d.Description = fmt.Sprintf("Mean duration of successful %s probes", m.config.probeType())
+		d.Unit = "s"
+	case "jitter":
+		d.Description = fmt.Sprintf("Jitter of successful %s probes", m.config.probeType())
+		d.Unit = "s"
+	case "packet_loss":
+		d.Description = fmt.Sprintf("Ratio of failed %s probes", m.config.probeType())
+		d.Unit = "1"
+	case "cert_expiry":
+		d.Description = fmt.Sprintf("Days until the certificate of %s probes expires", m.config.probeType())
+		d.Unit = "d"
+	}
+	return d
+}
@@ -0,0 +1,419 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/httpclient"
+
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testSeries is a simplified representation of a time series written to Stackdriver.
+type testSeries struct {
+	target string
+	value  float64
+}
+
+func testPoints(ts []*monitoringpb.TimeSeries) []testSeries {
+	var series []testSeries
+	for _, s := range ts {
+		series = append(series, testSeries{s.Metric.Labels["target"], s.Points[0].Value.GetDoubleValue()})
+	}
+	return series
+}
+
+func newTestServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "status: ok, host: %s", r.Host)
+	})
+	mux.HandleFunc("/error", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "status: failing", http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	mux.Handle("/old", http.RedirectHandler("/healthz", http.StatusMovedPermanently))
+	// Every other request to /flaky fails.
+	var requests int32
+	mux.HandleFunc("/flaky", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1)%2 == 0 {
+			http.Error(w, "status: failing", http.StatusServiceUnavailable)
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+// writeCAFile writes the certificate of a TLS test server to a temporary file, returning its path.
+func writeCAFile(t *testing.T, s *httptest.Server) string {
+	f, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw}); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestStackdriverDataHTTP(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+
+	for _, tt := range []struct {
+		desc   string
+		config *MetricConfig
+		want   []testSeries
+	}{
+		{
+			desc:   "status codes",
+			config: &MetricConfig{Targets: []string{s.URL + "/healthz", s.URL + "/error", s.URL + "/old"}},
+			want:   []testSeries{{s.URL + "/healthz", 1}, {s.URL + "/error", 0}, {s.URL + "/old", 1}},
+		},
+		{
+			desc:   "valid status codes",
+			config: &MetricConfig{Targets: []string{s.URL + "/old", s.URL + "/healthz"}, ValidStatusCodes: []int{301}, NoFollowRedirects: true},
+			want:   []testSeries{{s.URL + "/old", 1}, {s.URL + "/healthz", 0}},
+		},
+		{
+			desc:   "body regexp",
+			config: &MetricConfig{Targets: []string{s.URL + "/healthz", s.URL + "/old"}, BodyRegexp: "host: www\\.example\\.com$", Headers: map[string]string{"Host": "www.example.com"}},
+			want:   []testSeries{{s.URL + "/healthz", 1}, {s.URL + "/old", 1}},
+		},
+		{
+			desc:   "body regexp mismatch",
+			config: &MetricConfig{Targets: []string{s.URL + "/healthz"}, BodyRegexp: "status: failing"},
+			want:   []testSeries{{s.URL + "/healthz", 0}},
+		},
+		{
+			desc:   "timeout",
+			config: &MetricConfig{Targets: []string{s.URL + "/slow"}, Timeout: 50 * time.Millisecond},
+			want:   []testSeries{{s.URL + "/slow", 0}},
+		},
+		{
+			desc:   "duration",
+			config: &MetricConfig{Targets: []string{s.URL + "/slow", s.URL + "/error"}, Value: "duration"},
+			want:   []testSeries{{s.URL + "/slow", 0.2}},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			m, err := NewSourceMetric("probe", tt.config)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			desc, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+			if err != nil {
+				t.Fatalf("unexpected error from StackdriverData: %v", err)
+			}
+			got := testPoints(ts)
+			if tt.config.Value == "duration" {
+				if desc.Unit != "s" || len(got) != 1 || got[0].value < 0.2 || got[0].value > 1 {
+					t.Fatalf("expected a single duration of about %v; got %v (descriptor %v)", tt.want, got, desc)
+				}
+				got[0].value = 0.2
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected series %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStackdriverDataTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	s := httptest.NewTLSServer(http.NotFoundHandler())
+	defer s.Close()
+	addr := s.Listener.Addr().String()
+
+	ca := writeCAFile(t, s)
+	defer os.Remove(ca)
+
+	for _, tt := range []struct {
+		desc   string
+		config *MetricConfig
+		want   []testSeries
+	}{
+		{
+			desc:   "connect",
+			config: &MetricConfig{Type: "tcp", Targets: []string{addr, closed}},
+			want:   []testSeries{{addr, 1}, {closed, 0}},
+		},
+		{
+			desc:   "untrusted certificate",
+			config: &MetricConfig{Type: "tcp", Targets: []string{addr}, TLS: true},
+			want:   []testSeries{{addr, 0}},
+		},
+		{
+			desc:   "trusted certificate",
+			config: &MetricConfig{Type: "tcp", Targets: []string{addr}, TLS: true, HTTP: httpclient.Config{CAFile: ca}},
+			want:   []testSeries{{addr, 1}},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			m, err := NewSourceMetric("probe", tt.config)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+			if err != nil {
+				t.Fatalf("unexpected error from StackdriverData: %v", err)
+			}
+			if got := testPoints(ts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected series %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// newDNSServer starts a DNS server that resolves www.example.com to 192.0.2.1 and returns NXDOMAIN for other names.
+func newDNSServer(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// The question follows the 12-byte header, and ends with its type and class.
+			question := buf[12:n]
+			var name []string
+			i := 0
+			for i < len(question) && question[i] != 0 {
+				name = append(name, string(question[i+1:i+1+int(question[i])]))
+				i += 1 + int(question[i])
+			}
+			qtype := binary.BigEndian.Uint16(question[i+1:])
+			question = question[:i+5]
+
+			resp := append([]byte{}, buf[:2]...)
+			var answers []byte
+			switch {
+			case strings.Join(name, ".") != "www.example.com":
+				resp = append(resp, 0x81, 0x83)
+			case qtype == 1:
+				resp = append(resp, 0x81, 0x80)
+				answers = []byte{0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, 1}
+			default:
+				resp = append(resp, 0x81, 0x80)
+			}
+			ancount := byte(0)
+			if answers != nil {
+				ancount = 1
+			}
+			resp = append(resp, 0, 1, 0, ancount, 0, 0, 0, 0)
+			resp = append(append(resp, question...), answers...)
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc
+}
+
+func TestStackdriverDataDNS(t *testing.T) {
+	pc := newDNSServer(t)
+	defer pc.Close()
+
+	m, err := NewSourceMetric("dns", &MetricConfig{Type: "dns", Targets: []string{"www.example.com", "missing.example.com"}, DNSServer: pc.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	_, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if want := []testSeries{{"www.example.com", 1}, {"missing.example.com", 0}}; !reflect.DeepEqual(testPoints(ts), want) {
+		t.Errorf("expected series %v; got %v", want, testPoints(ts))
+	}
+}
+
+func TestStackdriverDataCertExpiry(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	s := httptest.NewTLSServer(http.NotFoundHandler())
+	defer s.Close()
+	addr := s.Listener.Addr().String()
+	ca := writeCAFile(t, s)
+	defer os.Remove(ca)
+	days := s.Certificate().NotAfter.Sub(now).Hours() / 24
+
+	for _, tt := range []struct {
+		desc   string
+		config *MetricConfig
+		want   []testSeries
+	}{
+		{
+			desc:   "https",
+			config: &MetricConfig{Targets: []string{s.URL + "/"}, Value: "cert_expiry", ValidStatusCodes: []int{404}, HTTP: httpclient.Config{CAFile: ca}},
+			want:   []testSeries{{s.URL + "/", days}},
+		},
+		{
+			desc:   "tcp",
+			config: &MetricConfig{Type: "tcp", Targets: []string{addr}, TLS: true, Value: "cert_expiry", HTTP: httpclient.Config{CAFile: ca}},
+			want:   []testSeries{{addr, days}},
+		},
+		{
+			desc:   "untrusted certificate",
+			config: &MetricConfig{Type: "tcp", Targets: []string{addr}, TLS: true, Value: "cert_expiry"},
+		},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			m, err := NewSourceMetric("cert_expiry", tt.config)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			desc, ts, err := m.StackdriverData(context.Background(), now.Add(-time.Minute), nil)
+			if err != nil {
+				t.Fatalf("unexpected error from StackdriverData: %v", err)
+			}
+			if got := testPoints(ts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected series %v; got %v", tt.want, got)
+			}
+			if desc.Unit != "d" {
+				t.Errorf("expected unit d; got %q", desc.Unit)
+			}
+		})
+	}
+}
+
+func TestStackdriverDataRepeatedProbes(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+
+	for _, tt := range []struct {
+		value string
+		want  float64
+	}{
+		{"success", 1},
+		{"packet_loss", 0.5},
+		{"jitter", 0},
+	} {
+		t.Run(tt.value, func(t *testing.T) {
+			m, err := NewSourceMetric("flaky", &MetricConfig{Targets: []string{s.URL + "/flaky"}, Value: tt.value, Count: 4, Interval: 10 * time.Millisecond})
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+			if err != nil {
+				t.Fatalf("unexpected error from StackdriverData: %v", err)
+			}
+			got := testPoints(ts)
+			if len(got) != 1 {
+				t.Fatalf("expected a single series; got %v", got)
+			}
+			// The jitter of local requests varies, but it stays well below the interval.
+			if tt.value == "jitter" && got[0].value >= 0 && got[0].value < 0.01 {
+				got[0].value = 0
+			}
+			if got[0].value != tt.want {
+				t.Errorf("expected %s %v; got %v", tt.value, tt.want, got[0].value)
+			}
+		})
+	}
+}
+
+func TestStackdriverDataICMP(t *testing.T) {
+	if conn, err := net.ListenPacket("ip4:icmp", ""); err != nil {
+		t.Skipf("ICMP probes cannot run without raw sockets: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	m, err := NewSourceMetric("ping", &MetricConfig{Type: "icmp", Targets: []string{"127.0.0.1"}, Value: "packet_loss", Count: 3, Interval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	_, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if want := []testSeries{{"127.0.0.1", 0}}; !reflect.DeepEqual(testPoints(ts), want) {
+		t.Errorf("expected series %v; got %v", want, testPoints(ts))
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// An echo request with ID 1 and sequence number 1, as sent by ping.
+	if got := checksum([]byte{8, 0, 0, 0, 0, 1, 0, 1}); got != 0xf7fd {
+		t.Errorf("expected checksum 0xf7fd; got %#x", got)
+	}
+}
+
+func TestStackdriverDataOncePerSecond(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	m, err := NewSourceMetric("probe", &MetricConfig{Targets: []string{"http://localhost:1/"}})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	if desc, ts, err := m.StackdriverData(context.Background(), now, nil); desc != nil || ts != nil || err != nil {
+		t.Errorf("expected no data for a point at the current second; got %v, %v, %v", desc, ts, err)
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, config := range []*MetricConfig{
+		{Targets: []string{"www.example.com"}},
+		{Targets: []string{"ftp://www.example.com/"}},
+		{Type: "tcp", Targets: []string{"www.example.com"}},
+		{Type: "tcp", Targets: []string{"www.example.com:443"}, BodyRegexp: "ok"},
+		{Targets: []string{"https://www.example.com/"}, TLS: true},
+		{Targets: []string{"https://www.example.com/"}, ValidStatusCodes: []int{2000}},
+		{Targets: []string{"https://www.example.com/"}, BodyRegexp: "("},
+		{Targets: []string{"https://www.example.com/"}, Timeout: -time.Second},
+		{Type: "dns", Targets: []string{"www.example.com:53"}},
+		{Targets: []string{"https://www.example.com/"}, DNSServer: "8.8.8.8:53"},
+		{Type: "dns", Targets: []string{"www.example.com"}, DNSServer: "8.8.8.8"},
+		{Type: "dns", Targets: []string{"www.example.com"}, Value: "cert_expiry"},
+		{Type: "tcp", Targets: []string{"www.example.com:443"}, Value: "cert_expiry"},
+		{Targets: []string{"http://www.example.com/"}, Value: "cert_expiry"},
+		{Type: "icmp", Targets: []string{"www.example.com"}, Value: "cert_expiry"},
+		{Type: "icmp", Targets: []string{"www.example.com:7"}},
+		{Type: "icmp", Targets: []string{"www.example.com"}, Value: "jitter", Count: 1},
+		{Targets: []string{"https://www.example.com/"}, Interval: -time.Second},
+	} {
+		if _, err := NewSourceMetric("invalid", config); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
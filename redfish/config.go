@@ -0,0 +1,78 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redfish
+
+import (
+	"fmt"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// Types of sensor readings.
+const (
+	readingTemperature = "temperature"
+	readingFanSpeed    = "fan_speed"
+	readingPower       = "power"
+)
+
+// defaultParallelism is the number of BMCs that are queried concurrently, unless configured.
+const defaultParallelism = 10
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Redfish services.
+type MetricConfig struct {
+	// BMCs lists base URLs of the Redfish services of server BMCs, e.g. https://r1-01-bmc.dc1.corp.
+	BMCs []string `yaml:"bmcs" validate:"nonzero"`
+	// Reading is the type of imported sensor readings: "temperature", "fan_speed" or "power".
+	Reading string `validate:"regexp=^(temperature|fan_speed|power)$"`
+	// Sensors lists the names of imported sensors. All sensors are imported if it's empty.
+	Sensors []string
+	// Parallelism is the number of BMCs that are queried concurrently.
+	Parallelism int `validate:"min=0"`
+
+	// Username and Password are used for basic authentication. The same account is used for all BMCs.
+	Username string `validate:"nonzero"`
+	Password string
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// The password can also be read from a file, e.g. from a mounted Kubernetes secret.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// ReadSecretFiles sets the password from the contents of the configured password file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.PasswordFile == "" {
+		return nil
+	}
+	if c.Password != "" {
+		return fmt.Errorf("password and password_file cannot both be set")
+	}
+	password, err := env.ReadSecretFile(dir, c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read password_file: %v", err)
+	}
+	c.Password = password
+	return nil
+}
+
+// parallelism returns the number of BMCs that are queried concurrently.
+func (c *MetricConfig) parallelism() int {
+	if c.Parallelism > 0 {
+		return c.Parallelism
+	}
+	return defaultParallelism
+}
@@ -0,0 +1,326 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redfish imports sensor readings (temperatures, fan speeds and power draw) from the Redfish services of
+// server BMCs.
+package redfish
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// Labels of imported time series.
+const (
+	bmcLabel     = "bmc"
+	chassisLabel = "chassis"
+	sensorLabel  = "sensor"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a metric based on Redfish sensor readings. It implements the SourceMetric interface.
+type Metric struct {
+	Name       string
+	config     *MetricConfig
+	httpClient *http.Client
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig) (*Metric, error) {
+	for _, bmc := range config.BMCs {
+		if u, err := url.Parse(bmc); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid BMC URL %q of metric %s", bmc, name)
+		}
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:       name,
+		config:     config,
+		httpClient: httpClient,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/redfish/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "redfish"
+}
+
+// SourceHost returns the host of the first BMC. It's used by the circuit breaker; as BMCs are queried together and
+// unreachable BMCs are skipped, the circuit is only opened if all of them fail.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.BMCs[0])
+	if err != nil || u.Host == "" {
+		return m.config.BMCs[0]
+	}
+	return u.Host
+}
+
+// Query returns a description of the sensor readings imported by this metric.
+func (m *Metric) Query() string {
+	q := fmt.Sprintf("%s readings of %d BMCs", m.config.Reading, len(m.config.BMCs))
+	if len(m.config.Sensors) > 0 {
+		q += fmt.Sprintf(" (%s)", strings.Join(m.config.Sensors, ", "))
+	}
+	return q
+}
+
+// reading is the current value of a sensor.
+type reading struct {
+	chassis string
+	sensor  string
+	value   float64
+}
+
+// StackdriverData queries all BMCs, returning metric descriptor and time series with the current sensor readings.
+// Redfish only provides current readings, so a single point is imported per sensor and sync. BMCs that cannot be
+// queried are skipped with a warning, unless all of them fail.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	now := timeNow().Truncate(time.Second)
+	if !now.After(lastPoint) {
+		return nil, nil, nil
+	}
+	end, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", now, err)
+	}
+
+	readings := make([][]reading, len(m.config.BMCs))
+	errs := make([]error, len(m.config.BMCs))
+	sem := make(chan struct{}, m.config.parallelism())
+	var wg sync.WaitGroup
+	for i, bmc := range m.config.BMCs {
+		wg.Add(1)
+		go func(i int, bmc string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			readings[i], errs[i] = m.readings(ctx, bmc)
+		}(i, bmc)
+	}
+	wg.Wait()
+
+	var ts []*monitoringpb.TimeSeries
+	var failed int
+	for i, bmc := range m.config.BMCs {
+		if errs[i] != nil {
+			log.WithContext(ctx).Warningf("Skipping BMC %s of Redfish metric %s: %v", bmc, m.Name, errs[i])
+			failed++
+			continue
+		}
+		host := bmcHost(bmc)
+		for _, r := range readings[i] {
+			ts = append(ts, &monitoringpb.TimeSeries{
+				Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: map[string]string{bmcLabel: host, chassisLabel: r.chassis, sensorLabel: r.sensor}},
+				Resource:   &monitoredres.MonitoredResource{Type: "global"},
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+				Points: []*monitoringpb.Point{{
+					Interval: &monitoringpb.TimeInterval{EndTime: end},
+					Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: r.value}},
+				}},
+			})
+		}
+	}
+	if failed == len(m.config.BMCs) {
+		return nil, nil, fmt.Errorf("all %d BMCs failed, e.g. %s: %w", failed, m.config.BMCs[0], errs[0])
+	}
+	log.WithContext(ctx).Debugf("Got %d Redfish readings for %s (%d BMCs failed)", len(ts), m.Query(), failed)
+	return m.metricDescriptor(), ts, nil
+}
+
+// status is the status of a Redfish resource. Readings of sensors that are not enabled are skipped.
+type status struct {
+	State string `json:"State"`
+}
+
+// thermal is a Thermal resource of a chassis.
+type thermal struct {
+	Temperatures []struct {
+		Name           string   `json:"Name"`
+		ReadingCelsius *float64 `json:"ReadingCelsius"`
+		Status         status   `json:"Status"`
+	} `json:"Temperatures"`
+	Fans []struct {
+		Name    string   `json:"Name"`
+		FanName string   `json:"FanName"` // Used instead of Name by services implementing older schema versions.
+		Reading *float64 `json:"Reading"`
+		Status  status   `json:"Status"`
+	} `json:"Fans"`
+}
+
+// power is a Power resource of a chassis.
+type power struct {
+	PowerControl []struct {
+		Name               string   `json:"Name"`
+		PowerConsumedWatts *float64 `json:"PowerConsumedWatts"`
+		Status             status   `json:"Status"`
+	} `json:"PowerControl"`
+}
+
+// readings returns the configured type of sensor readings of all chassis of a BMC.
+func (m *Metric) readings(ctx context.Context, bmc string) ([]reading, error) {
+	var collection struct {
+		Members []struct {
+			ID string `json:"@odata.id"`
+		} `json:"Members"`
+	}
+	if _, err := m.get(ctx, bmc, "/redfish/v1/Chassis", &collection); err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, s := range m.config.Sensors {
+		wanted[s] = true
+	}
+	var readings []reading
+	add := func(chassis, sensor string, state string, value *float64) {
+		if value == nil || (state != "" && state != "Enabled") || (len(wanted) > 0 && !wanted[sensor]) {
+			return
+		}
+		readings = append(readings, reading{chassis, sensor, *value})
+	}
+	for _, c := range collection.Members {
+		chassis := path.Base(c.ID)
+		switch m.config.Reading {
+		case readingTemperature, readingFanSpeed:
+			var t thermal
+			// Not all chassis (e.g. drive enclosures) have thermal or power resources.
+			if found, err := m.get(ctx, bmc, c.ID+"/Thermal", &t); err != nil {
+				return nil, err
+			} else if !found {
+				continue
+			}
+			if m.config.Reading == readingTemperature {
+				for _, s := range t.Temperatures {
+					add(chassis, s.Name, s.Status.State, s.ReadingCelsius)
+				}
+				continue
+			}
+			for _, s := range t.Fans {
+				name := s.Name
+				if name == "" {
+					name = s.FanName
+				}
+				add(chassis, name, s.Status.State, s.Reading)
+			}
+		case readingPower:
+			var p power
+			if found, err := m.get(ctx, bmc, c.ID+"/Power", &p); err != nil {
+				return nil, err
+			} else if !found {
+				continue
+			}
+			for _, s := range p.PowerControl {
+				add(chassis, s.Name, s.Status.State, s.PowerConsumedWatts)
+			}
+		}
+	}
+	return readings, nil
+}
+
+// get reads a Redfish resource into `v`. It returns false if the resource does not exist.
+func (m *Metric) get(ctx context.Context, bmc, resource string, v interface{}) (bool, error) {
+	u := strings.TrimSuffix(bmc, "/") + resource
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("OData-Version", "4.0")
+	req.SetBasicAuth(m.config.Username, m.config.Password)
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return false, tserrors.ClassifySource(fmt.Errorf("Redfish request failed: %w", err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, tserrors.ClassifySource(fmt.Errorf("cannot read Redfish response: %w", err))
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("Redfish request for %s returned HTTP status code %d: %s", resource, resp.StatusCode, data))
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("cannot parse Redfish resource %s: %v", resource, err)
+	}
+	return true, nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for sensor readings.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Redfish %s", m.Query()),
+		DisplayName: m.Name,
+		Labels: []*label.LabelDescriptor{
+			{Key: bmcLabel, ValueType: label.LabelDescriptor_STRING, Description: "Host of the BMC"},
+			{Key: chassisLabel, ValueType: label.LabelDescriptor_STRING, Description: "Redfish chassis ID"},
+			{Key: sensorLabel, ValueType: label.LabelDescriptor_STRING, Description: "Sensor name"},
+		},
+	}
+	// Fan speeds are reported in RPM or percent, depending on the fan.
+	switch m.config.Reading {
+	case readingTemperature:
+		d.Unit = "Cel"
+	case readingPower:
+		d.Unit = "W"
+	}
+	return d
+}
+
+// bmcHost returns the host of a BMC URL, which is used as label value.
+func bmcHost(bmc string) string {
+	u, err := url.Parse(bmc)
+	if err != nil {
+		return bmc
+	}
+	return u.Host
+}
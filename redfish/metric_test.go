@@ -0,0 +1,213 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redfish
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	labels map[string]string
+	offset time.Duration // relative to the start of a test.
+	value  float64
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, testPoint{s.Metric.Labels, end.Sub(start), s.Points[0].Value.GetDoubleValue()})
+	}
+	sort.Slice(points, func(i, j int) bool { return fmt.Sprint(points[i].labels) < fmt.Sprint(points[j].labels) })
+	return points
+}
+
+// resources of a test BMC with a server chassis and a drive enclosure that has no sensors.
+var resources = map[string]string{
+	"/redfish/v1/Chassis": `{"Members": [{"@odata.id": "/redfish/v1/Chassis/1"}, {"@odata.id": "/redfish/v1/Chassis/Enclosure"}]}`,
+	"/redfish/v1/Chassis/1/Thermal": `{
+		"Temperatures": [
+			{"Name": "CPU1 Temp", "ReadingCelsius": 45, "Status": {"State": "Enabled"}},
+			{"Name": "CPU2 Temp", "ReadingCelsius": 47.5, "Status": {"State": "Enabled"}},
+			{"Name": "Inlet Temp", "ReadingCelsius": 22},
+			{"Name": "GPU Temp", "ReadingCelsius": null, "Status": {"State": "Absent"}}
+		],
+		"Fans": [
+			{"Name": "Fan 1", "Reading": 5400, "ReadingUnits": "RPM", "Status": {"State": "Enabled"}},
+			{"FanName": "Fan 2", "Reading": 5280, "ReadingUnits": "RPM"}
+		]
+	}`,
+	"/redfish/v1/Chassis/1/Power": `{"PowerControl": [{"Name": "System Power Control", "PowerConsumedWatts": 224}]}`,
+}
+
+// newTestBMC returns a Redfish service with the test resources, recording request IDs.
+func newTestBMC(requestIDs chan<- string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "monitor" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, ok := resources[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if requestIDs != nil {
+			requestIDs <- r.Header.Get(requestid.Header)
+		}
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestStackdriverData(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(90*time.Second + 300*time.Millisecond) }
+
+	requestIDs := make(chan string, 100)
+	bmc := newTestBMC(requestIDs)
+	defer bmc.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	host, _ := url.Parse(bmc.URL)
+
+	for _, tt := range []struct {
+		reading string
+		sensors []string
+		unit    string
+		want    []testPoint
+	}{
+		{"temperature", nil, "Cel", []testPoint{
+			{map[string]string{"bmc": host.Host, "chassis": "1", "sensor": "CPU1 Temp"}, 90 * time.Second, 45},
+			{map[string]string{"bmc": host.Host, "chassis": "1", "sensor": "CPU2 Temp"}, 90 * time.Second, 47.5},
+			{map[string]string{"bmc": host.Host, "chassis": "1", "sensor": "Inlet Temp"}, 90 * time.Second, 22},
+		}},
+		{"temperature", []string{"Inlet Temp"}, "Cel", []testPoint{
+			{map[string]string{"bmc": host.Host, "chassis": "1", "sensor": "Inlet Temp"}, 90 * time.Second, 22},
+		}},
+		{"fan_speed", nil, "", []testPoint{
+			{map[string]string{"bmc": host.Host, "chassis": "1", "sensor": "Fan 1"}, 90 * time.Second, 5400},
+			{map[string]string{"bmc": host.Host, "chassis": "1", "sensor": "Fan 2"}, 90 * time.Second, 5280},
+		}},
+		{"power", nil, "W", []testPoint{
+			{map[string]string{"bmc": host.Host, "chassis": "1", "sensor": "System Power Control"}, 90 * time.Second, 224},
+		}},
+	} {
+		t.Run(fmt.Sprintf("%s%v", tt.reading, tt.sensors), func(t *testing.T) {
+			m, err := NewSourceMetric("sensors", &MetricConfig{
+				BMCs:     []string{bmc.URL + "/", broken.URL},
+				Reading:  tt.reading,
+				Sensors:  tt.sensors,
+				Username: "monitor",
+				Password: "secret",
+			})
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			ctx := requestid.NewContext(context.Background(), "req-1")
+			desc, ts, err := m.StackdriverData(ctx, start, nil)
+			if err != nil {
+				t.Fatalf("unexpected error from StackdriverData: %v", err)
+			}
+			if desc.Type != "custom.googleapis.com/redfish/sensors" || desc.Unit != tt.unit || len(desc.Labels) != 3 {
+				t.Errorf("unexpected metric descriptor %v", desc)
+			}
+			// The broken BMC is skipped.
+			if got := testPoints(t, start, ts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected points %v; got %v", tt.want, got)
+			}
+		})
+	}
+	close(requestIDs)
+	for id := range requestIDs {
+		if id != "req-1" {
+			t.Errorf("expected request ID req-1 to be sent; got %q", id)
+		}
+	}
+}
+
+func TestStackdriverDataUpToDate(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(500 * time.Millisecond) }
+
+	m, err := NewSourceMetric("sensors", &MetricConfig{BMCs: []string{"https://bmc.invalid"}, Reading: "power", Username: "u"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	// A point has already been imported for the current second, so BMCs are not queried.
+	desc, ts, err := m.StackdriverData(context.Background(), start, nil)
+	if err != nil || desc != nil || ts != nil {
+		t.Errorf("expected no data; got %v, %v, %v", desc, ts, err)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	bmc := newTestBMC(nil)
+	defer bmc.Close()
+
+	for _, tt := range []struct {
+		desc      string
+		status    int
+		wantClass error
+	}{
+		{"unauthorized", http.StatusUnauthorized, tserrors.ErrSourcePermanent},
+		{"unavailable", http.StatusServiceUnavailable, tserrors.ErrSourceTransient},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			// All BMCs fail, as the working one is queried with invalid credentials.
+			m, err := NewSourceMetric("errors", &MetricConfig{BMCs: []string{server.URL, bmc.URL}, Reading: "power", Username: "u", Parallelism: 1})
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestNewSourceMetricInvalidBMC(t *testing.T) {
+	if _, err := NewSourceMetric("invalid", &MetricConfig{BMCs: []string{"bmc-1"}, Reading: "power", Username: "u"}); err == nil {
+		t.Errorf("expected NewSourceMetric to reject a BMC without scheme")
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/httpclient"
+	"github.com/google/ts-bridge/tserrors"
+)
+
+// Only the subset of RESP2 needed to run a few commands is implemented, which avoids depending on a client library
+// for a single source. See https://redis.io/docs/reference/protocol-spec/.
+const (
+	// maxBulkSize limits the size of received strings, so that a misbehaving server cannot exhaust memory.
+	maxBulkSize = 1 << 20
+	// maxArraySize limits the number of elements of received arrays.
+	maxArraySize = 1 << 16
+)
+
+// serverError is an error reply, e.g. `NOAUTH Authentication required.`.
+type serverError string
+
+func (e serverError) Error() string {
+	return fmt.Sprintf("Redis error: %s", string(e))
+}
+
+// classify returns the error with a class based on its prefix: servers that are loading their dataset, busy
+// running a script or without a reachable master are transient, while other errors (e.g. wrong passwords or
+// disabled commands) are permanent.
+func (e serverError) classify() error {
+	switch strings.SplitN(string(e), " ", 2)[0] {
+	case "LOADING", "BUSY", "MASTERDOWN", "TRYAGAIN", "CLUSTERDOWN":
+		return tserrors.Wrap(tserrors.ErrSourceTransient, e)
+	}
+	return tserrors.Wrap(tserrors.ErrSourcePermanent, e)
+}
+
+// conn is a connection to a Redis server or Sentinel.
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+}
+
+// dial connects to a server and authenticates if a password is configured. Reads and writes of the connection fail
+// once the context is done or the configured timeout has passed.
+func dial(ctx context.Context, config *MetricConfig, addr string, auth bool) (*conn, error) {
+	deadline := time.Now().Add(config.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	nc, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("cannot connect to Redis server %s: %w", addr, err))
+	}
+	nc.SetDeadline(deadline)
+	if config.TLS {
+		tlsConfig, err := (&httpclient.Config{CAFile: config.CAFile}).TLSConfig()
+		if err != nil {
+			nc.Close()
+			return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConfig.ServerName = host
+		tc := tls.Client(nc, tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("TLS handshake with Redis server %s failed: %v", addr, err))
+		}
+		nc = tc
+	}
+	c := &conn{nc: nc, r: bufio.NewReader(nc)}
+	if auth && config.Password != "" {
+		args := []string{"AUTH", config.Password}
+		if config.Username != "" {
+			args = []string{"AUTH", config.Username, config.Password}
+		}
+		if _, err := c.do(args...); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and returns its reply, which is a string, an integer, nil or a slice of replies. Error replies
+// are returned as classified errors.
+func (c *conn) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(c.nc, b.String()); err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("Redis connection failed: %w", err))
+	}
+	reply, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(serverError); ok {
+		return nil, e.classify()
+	}
+	return reply, nil
+}
+
+// read reads a reply. Error replies are returned as a serverError value.
+func (c *conn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, tserrors.ClassifySource(fmt.Errorf("Redis connection failed: %w", err))
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty Redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return serverError(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Redis integer reply %q", line)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxBulkSize {
+			return nil, fmt.Errorf("invalid Redis bulk string length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, tserrors.ClassifySource(fmt.Errorf("Redis connection failed: %w", err))
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n > maxArraySize {
+			return nil, fmt.Errorf("invalid Redis array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected Redis reply %q", line)
+}
+
+// close closes the connection without waiting for a reply to QUIT.
+func (c *conn) close() error {
+	return c.nc.Close()
+}
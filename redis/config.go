@@ -0,0 +1,120 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+)
+
+const defaultTimeout = 10 * time.Second
+
+// Fields that are not read from the INFO command as they are.
+const (
+	// fieldHitRatio is the ratio of keyspace hits to lookups, computed from keyspace_hits and keyspace_misses.
+	fieldHitRatio = "keyspace_hit_ratio"
+	// fieldSlowCommands is the number of commands added to the slow log since the last point.
+	fieldSlowCommands = "slow_commands"
+)
+
+// fieldRegexp matches names of INFO fields.
+var fieldRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Redis.
+type MetricConfig struct {
+	// Addresses lists host:port addresses of the server, of Sentinels or of cluster nodes, depending on the topology.
+	Addresses []string `validate:"nonzero"`
+	// Topology is `standalone` (the default), `sentinel` or `cluster`.
+	Topology string `validate:"regexp=^(|standalone|sentinel|cluster)$"`
+	// MasterName is the name of the master monitored by Sentinels.
+	MasterName string `yaml:"master_name"`
+	// Field is a numeric INFO field such as used_memory or connected_clients, keyspace_hit_ratio or slow_commands.
+	Field string `validate:"nonzero"`
+
+	// Username is only needed for ACL users of Redis 6 and later.
+	Username string
+	Password string
+	// TLS enables TLS connections, trusting certificates signed by the CAs in CAFile in addition to system CAs.
+	TLS    bool
+	CAFile string `yaml:"ca_file"`
+	// Timeout limits the time taken to query each node.
+	Timeout time.Duration
+
+	// The password can also be read from a file, e.g. from a mounted Kubernetes secret.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// ReadSecretFiles sets the password from the contents of the configured password file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.PasswordFile == "" {
+		return nil
+	}
+	if c.Password != "" {
+		return fmt.Errorf("password and password_file cannot both be set")
+	}
+	password, err := env.ReadSecretFile(dir, c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read password_file: %v", err)
+	}
+	c.Password = password
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	for _, a := range c.Addresses {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return fmt.Errorf("invalid address %q: %v", a, err)
+		}
+	}
+	if !fieldRegexp.MatchString(c.Field) {
+		return fmt.Errorf("invalid field %q", c.Field)
+	}
+	if (c.topology() == "sentinel") != (c.MasterName != "") {
+		return fmt.Errorf("master_name needs to be set with `topology: sentinel`, and only then")
+	}
+	if c.topology() == "standalone" && len(c.Addresses) > 1 {
+		return fmt.Errorf("a standalone server has a single address")
+	}
+	if c.CAFile != "" && !c.TLS {
+		return fmt.Errorf("ca_file requires `tls: true`")
+	}
+	if c.Username != "" && c.Password == "" {
+		return fmt.Errorf("username requires a password")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout cannot be negative")
+	}
+	return nil
+}
+
+func (c *MetricConfig) topology() string {
+	if c.Topology == "" {
+		return "standalone"
+	}
+	return c.Topology
+}
+
+func (c *MetricConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
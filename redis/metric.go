@@ -0,0 +1,336 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package redis imports fields reported by the INFO command of Redis servers, such as used memory or connected
+// clients, as well as keyspace hit ratios and slow commands. Standalone servers, Sentinel and Cluster topologies
+// are supported.
+package redis
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// slowlogEntries is the number of slow log entries read during each sync, which is the default slowlog-max-len.
+var slowlogEntries = 128
+
+// Metric defines a metric imported from Redis. It implements the SourceMetric interface.
+type Metric struct {
+	Name   string
+	config *MetricConfig
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	return &Metric{Name: name, config: config}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/redis/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "redis"
+}
+
+// SourceHost returns the first configured address. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	return m.config.Addresses[0]
+}
+
+// Query returns the imported field.
+func (m *Metric) Query() string {
+	if m.config.Field == fieldSlowCommands {
+		return fmt.Sprintf("SLOWLOG GET %d", slowlogEntries)
+	}
+	return "INFO " + m.config.Field
+}
+
+// node is a queried Redis server. The role is only set for cluster nodes.
+type node struct {
+	addr string
+	role string
+}
+
+// StackdriverData queries each node, returning metric descriptor and time series with the current value of the
+// field. Like INFO, the value reflects the current state, so a single point is imported per sync.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	now := timeNow().Truncate(time.Second)
+	if !now.After(lastPoint) {
+		return nil, nil, nil
+	}
+	end, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", now, err)
+	}
+
+	nodes, err := m.nodes(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ts []*monitoringpb.TimeSeries
+	var missing []string
+	for _, n := range nodes {
+		value, ok, err := m.value(ctx, n.addr, lastPoint, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			missing = append(missing, n.addr)
+			continue
+		}
+		labels := map[string]string{}
+		if m.config.topology() == "cluster" {
+			labels["node"], labels["role"] = n.addr, n.role
+		}
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: end},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+			}},
+		})
+	}
+	if len(missing) > 0 {
+		// A hit ratio is missing until keys are looked up, but other fields are missing when misspelled.
+		if len(missing) == len(nodes) && m.config.Field != fieldHitRatio {
+			return nil, nil, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("field %s is not reported by INFO of %v", m.config.Field, missing))
+		}
+		log.WithContext(ctx).Debugf("No value of Redis field %s on %v", m.config.Field, missing)
+	}
+	log.WithContext(ctx).Debugf("Got %d values of Redis field %s from %d nodes", len(ts), m.config.Field, len(nodes))
+	return m.metricDescriptor(), ts, nil
+}
+
+// nodes returns the queried servers: the configured server, the master of a Sentinel deployment, or all healthy
+// nodes of a cluster.
+func (m *Metric) nodes(ctx context.Context) ([]node, error) {
+	switch m.config.topology() {
+	case "sentinel":
+		return m.sentinelMaster(ctx)
+	case "cluster":
+		return m.clusterNodes(ctx)
+	}
+	return []node{{addr: m.config.Addresses[0]}}, nil
+}
+
+// sentinelMaster asks Sentinels for the address of the master, using the first Sentinel that responds.
+func (m *Metric) sentinelMaster(ctx context.Context) ([]node, error) {
+	var errs []string
+	for _, addr := range m.config.Addresses {
+		// Sentinels are queried without authentication, as they usually have a password of their own.
+		var reply interface{}
+		c, err := dial(ctx, m.config, addr, false)
+		if err == nil {
+			reply, err = c.do("SENTINEL", "get-master-addr-by-name", m.config.MasterName)
+			c.close()
+		}
+		if err != nil {
+			if !tserrors.Transient(err) {
+				// e.g. a disabled command, which other Sentinels would reject as well.
+				return nil, err
+			}
+			errs = append(errs, err.Error())
+			continue
+		}
+		if reply == nil {
+			return nil, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("Sentinel %s does not monitor master %s", addr, m.config.MasterName))
+		}
+		hostPort, ok := reply.([]interface{})
+		if !ok || len(hostPort) != 2 {
+			return nil, fmt.Errorf("unexpected reply of Sentinel %s: %v", addr, reply)
+		}
+		host, _ := hostPort[0].(string)
+		port, _ := hostPort[1].(string)
+		return []node{{addr: net.JoinHostPort(host, port)}}, nil
+	}
+	return nil, tserrors.Wrap(tserrors.ErrSourceTransient, fmt.Errorf("no Sentinel of master %s responded: %s", m.config.MasterName, strings.Join(errs, "; ")))
+}
+
+// clusterNodes returns the nodes of a cluster that are not failing, using the first seed node that responds.
+func (m *Metric) clusterNodes(ctx context.Context) ([]node, error) {
+	var errs []string
+	for _, addr := range m.config.Addresses {
+		var reply interface{}
+		c, err := dial(ctx, m.config, addr, true)
+		if err == nil {
+			reply, err = c.do("CLUSTER", "NODES")
+			c.close()
+		}
+		if err != nil {
+			if !tserrors.Transient(err) {
+				// e.g. a wrong password, which other nodes would reject as well.
+				return nil, err
+			}
+			errs = append(errs, err.Error())
+			continue
+		}
+		text, ok := reply.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected CLUSTER NODES reply of %s: %v", addr, reply)
+		}
+		return parseClusterNodes(text, addr), nil
+	}
+	return nil, tserrors.Wrap(tserrors.ErrSourceTransient, fmt.Errorf("no cluster node responded: %s", strings.Join(errs, "; ")))
+}
+
+// parseClusterNodes parses the output of CLUSTER NODES, skipping nodes that are failing, or that are still being
+// added to the cluster. Nodes that don't know their own IP address are reached at the address they were queried at.
+func parseClusterNodes(text, queried string) []node {
+	var nodes []node
+	for _, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		// Addresses have the form ip:port@cport[,hostname].
+		addr := strings.SplitN(strings.SplitN(fields[1], ",", 2)[0], "@", 2)[0]
+		flags := strings.Split(fields[2], ",")
+		n := node{addr: addr, role: "replica"}
+		skip := false
+		for _, f := range flags {
+			switch f {
+			case "master":
+				n.role = "master"
+			case "fail", "fail?", "handshake", "noaddr":
+				skip = true
+			case "myself":
+				if strings.HasPrefix(addr, ":") {
+					n.addr = queried
+				}
+			}
+		}
+		if !skip {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// value returns the value of the configured field on a node, or false if the node does not report the field.
+func (m *Metric) value(ctx context.Context, addr string, lastPoint, now time.Time) (float64, bool, error) {
+	c, err := dial(ctx, m.config, addr, true)
+	if err != nil {
+		return 0, false, err
+	}
+	defer c.close()
+
+	if m.config.Field == fieldSlowCommands {
+		reply, err := c.do("SLOWLOG", "GET", strconv.Itoa(slowlogEntries))
+		if err != nil {
+			return 0, false, err
+		}
+		entries, _ := reply.([]interface{})
+		var count float64
+		for _, e := range entries {
+			// Each entry starts with its ID and the Unix time of the command.
+			fields, ok := e.([]interface{})
+			if !ok || len(fields) < 2 {
+				return 0, false, fmt.Errorf("unexpected slow log entry of %s: %v", addr, e)
+			}
+			if t, ok := fields[1].(int64); ok && t > lastPoint.Unix() && t <= now.Unix() {
+				count++
+			}
+		}
+		return count, true, nil
+	}
+
+	reply, err := c.do("INFO")
+	if err != nil {
+		return 0, false, err
+	}
+	text, ok := reply.(string)
+	if !ok {
+		return 0, false, fmt.Errorf("unexpected INFO reply of %s: %v", addr, reply)
+	}
+	info := parseInfo(text)
+	if m.config.Field == fieldHitRatio {
+		hits, herr := strconv.ParseFloat(info["keyspace_hits"], 64)
+		misses, merr := strconv.ParseFloat(info["keyspace_misses"], 64)
+		if herr != nil || merr != nil || hits+misses == 0 {
+			return 0, false, nil
+		}
+		return hits / (hits + misses), true, nil
+	}
+	v, ok := info[m.config.Field]
+	if !ok {
+		return 0, false, nil
+	}
+	value, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, false, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("field %s of %s is not a number: %s", m.config.Field, addr, v))
+	}
+	return value, true, nil
+}
+
+// parseInfo parses the `field:value` lines of INFO output.
+func parseInfo(text string) map[string]string {
+	info := make(map[string]string)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if kv := strings.SplitN(line, ":", 2); len(kv) == 2 {
+			info[kv[0]] = kv[1]
+		}
+	}
+	return info
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Redis %s of %s", m.config.Field, strings.Join(m.config.Addresses, ", ")),
+		DisplayName: m.Name,
+	}
+	if strings.HasSuffix(m.config.Field, "_memory") || strings.HasSuffix(m.config.Field, "_bytes") {
+		d.Unit = "By"
+	}
+	if m.config.topology() == "cluster" {
+		d.Labels = []*label.LabelDescriptor{
+			{Key: "node", ValueType: label.LabelDescriptor_STRING, Description: "Address of the cluster node"},
+			{Key: "role", ValueType: label.LabelDescriptor_STRING, Description: "Role of the cluster node: master or replica"},
+		}
+	}
+	return d
+}
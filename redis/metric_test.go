@@ -0,0 +1,361 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/tserrors"
+
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// newTestServer starts a server that requires password `secret` if `auth` is set, and responds to other commands
+// with the raw RESP replies returned by `handle`.
+func newTestServer(t *testing.T, auth bool, handle func(args []string) string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer nc.Close()
+				r := bufio.NewReader(nc)
+				authenticated := !auth
+				for {
+					args, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					switch {
+					case args[0] == "AUTH":
+						if args[len(args)-1] != "secret" {
+							io.WriteString(nc, "-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+							continue
+						}
+						authenticated = true
+						io.WriteString(nc, "+OK\r\n")
+					case !authenticated:
+						io.WriteString(nc, "-NOAUTH Authentication required.\r\n")
+					default:
+						io.WriteString(nc, handle(args))
+					}
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	var args []string
+	for i := 0; i < n; i++ {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSuffix(arg, "\r\n"))
+	}
+	return args, nil
+}
+
+// bulk encodes a bulk string reply.
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// infoReply returns an INFO reply with the given fields.
+func infoReply(fields ...string) func([]string) string {
+	return func(args []string) string {
+		if args[0] != "INFO" {
+			return "-ERR unknown command\r\n"
+		}
+		return bulk("# Server\r\nredis_version:7.2.4\r\n\r\n# Stats\r\n" + strings.Join(fields, "\r\n") + "\r\n")
+	}
+}
+
+// testSeries is a simplified representation of a time series written to Stackdriver.
+type testSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+func testPoints(ts []*monitoringpb.TimeSeries) []testSeries {
+	var series []testSeries
+	for _, s := range ts {
+		series = append(series, testSeries{s.Metric.Labels, s.Points[0].Value.GetDoubleValue()})
+	}
+	return series
+}
+
+func TestStackdriverDataStandalone(t *testing.T) {
+	ln := newTestServer(t, true, infoReply("used_memory:1048576", "connected_clients:12", "keyspace_hits:3", "keyspace_misses:1"))
+	defer ln.Close()
+
+	for _, tt := range []struct {
+		field string
+		want  float64
+	}{
+		{"used_memory", 1048576},
+		{"connected_clients", 12},
+		{"keyspace_hit_ratio", 0.75},
+	} {
+		m, err := NewSourceMetric("cache_"+tt.field, &MetricConfig{Addresses: []string{ln.Addr().String()}, Field: tt.field, Password: "secret"})
+		if err != nil {
+			t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+		}
+		desc, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+		if err != nil {
+			t.Fatalf("unexpected error from StackdriverData for %s: %v", tt.field, err)
+		}
+		if want := []testSeries{{map[string]string{}, tt.want}}; !reflect.DeepEqual(testPoints(ts), want) {
+			t.Errorf("expected series %v for %s; got %v", want, tt.field, testPoints(ts))
+		}
+		if wantUnit := map[string]string{"used_memory": "By"}[tt.field]; desc.Unit != wantUnit || len(desc.Labels) != 0 {
+			t.Errorf("unexpected metric descriptor for %s: %v", tt.field, desc)
+		}
+	}
+}
+
+func TestStackdriverDataHitRatioWithoutLookups(t *testing.T) {
+	ln := newTestServer(t, false, infoReply("keyspace_hits:0", "keyspace_misses:0"))
+	defer ln.Close()
+
+	m, err := NewSourceMetric("hit_ratio", &MetricConfig{Addresses: []string{ln.Addr().String()}, Field: "keyspace_hit_ratio"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	if _, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil); err != nil || len(ts) != 0 {
+		t.Errorf("expected no points without lookups; got %v, %v", ts, err)
+	}
+}
+
+func TestStackdriverDataSlowCommands(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	var gotArgs []string
+	ln := newTestServer(t, false, func(args []string) string {
+		gotArgs = args
+		// Entries are returned newest first.
+		var reply string
+		for i, age := range []time.Duration{0, 10 * time.Second, 30 * time.Second, 2 * time.Minute} {
+			reply += fmt.Sprintf("*6\r\n:%d\r\n:%d\r\n:%d\r\n*1\r\n%s%s%s", 4-i, now.Add(-age).Unix(), 20000, bulk("KEYS"), bulk("127.0.0.1:5000"), bulk(""))
+		}
+		return "*4\r\n" + reply
+	})
+	defer ln.Close()
+
+	m, err := NewSourceMetric("slow_commands", &MetricConfig{Addresses: []string{ln.Addr().String()}, Field: "slow_commands"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	_, ts, err := m.StackdriverData(context.Background(), now.Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if want := []string{"SLOWLOG", "GET", "128"}; !reflect.DeepEqual(gotArgs, want) {
+		t.Errorf("expected command %v; got %v", want, gotArgs)
+	}
+	// Only entries logged since the last point are counted.
+	if want := []testSeries{{map[string]string{}, 3}}; !reflect.DeepEqual(testPoints(ts), want) {
+		t.Errorf("expected series %v; got %v", want, testPoints(ts))
+	}
+
+	// Points are only written once per second.
+	if _, ts, err := m.StackdriverData(context.Background(), now, nil); err != nil || len(ts) != 0 {
+		t.Errorf("expected no points to be returned again; got %v, %v", ts, err)
+	}
+}
+
+func TestStackdriverDataSentinel(t *testing.T) {
+	master := newTestServer(t, true, infoReply("connected_clients:7"))
+	defer master.Close()
+	host, port, _ := net.SplitHostPort(master.Addr().String())
+	var gotArgs []string
+	sentinel := newTestServer(t, false, func(args []string) string {
+		gotArgs = args
+		if args[2] != "mymaster" {
+			return "*-1\r\n"
+		}
+		return "*2\r\n" + bulk(host) + bulk(port)
+	})
+	defer sentinel.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+
+	config := &MetricConfig{
+		Addresses:  []string{down.Addr().String(), sentinel.Addr().String()},
+		Topology:   "sentinel",
+		MasterName: "mymaster",
+		Field:      "connected_clients",
+		Password:   "secret",
+	}
+	m, err := NewSourceMetric("clients", config)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	_, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if want := []string{"SENTINEL", "get-master-addr-by-name", "mymaster"}; !reflect.DeepEqual(gotArgs, want) {
+		t.Errorf("expected command %v; got %v", want, gotArgs)
+	}
+	if want := []testSeries{{map[string]string{}, 7}}; !reflect.DeepEqual(testPoints(ts), want) {
+		t.Errorf("expected series %v; got %v", want, testPoints(ts))
+	}
+
+	config.MasterName = "other"
+	if _, _, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil); !errors.Is(err, tserrors.ErrConfigInvalid) {
+		t.Errorf("expected an unknown master to be an invalid configuration; got %v", err)
+	}
+	config.Addresses = config.Addresses[:1]
+	if _, _, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil); !errors.Is(err, tserrors.ErrSourceTransient) {
+		t.Errorf("expected unreachable Sentinels to be a transient error; got %v", err)
+	}
+}
+
+func TestStackdriverDataCluster(t *testing.T) {
+	primary := newTestServer(t, false, infoReply("used_memory:100"))
+	defer primary.Close()
+	replica := newTestServer(t, false, infoReply("used_memory:90"))
+	defer replica.Close()
+	seed := newTestServer(t, false, func(args []string) string {
+		if args[0] != "CLUSTER" {
+			return "-ERR unknown command\r\n"
+		}
+		return bulk(fmt.Sprintf("07c37dfeb235213a872192d90877d0cd55635b91 %s@31004,redis-1 myself,master - 0 1426238317239 4 connected 0-16383\n"+
+			"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca %s@31005 slave 07c37dfeb235213a872192d90877d0cd55635b91 0 1426238316232 5 connected\n"+
+			"6ec23923021cf3ffec47632106199cb7f496ce01 127.0.0.1:1@31006 master,fail - 1426238316232 1426238315000 6 disconnected\n",
+			primary.Addr(), replica.Addr()))
+	})
+	defer seed.Close()
+
+	m, err := NewSourceMetric("memory", &MetricConfig{Addresses: []string{seed.Addr().String()}, Topology: "cluster", Field: "used_memory"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	desc, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	// Failing nodes are skipped.
+	want := []testSeries{
+		{map[string]string{"node": primary.Addr().String(), "role": "master"}, 100},
+		{map[string]string{"node": replica.Addr().String(), "role": "replica"}, 90},
+	}
+	if got := testPoints(ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected series %v; got %v", want, got)
+	}
+	if len(desc.Labels) != 2 || desc.Labels[0].Key != "node" || desc.Labels[1].Key != "role" {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+}
+
+func TestStackdriverDataClusterWrongPassword(t *testing.T) {
+	seed := newTestServer(t, true, func([]string) string { return bulk("") })
+	defer seed.Close()
+
+	m, err := NewSourceMetric("memory", &MetricConfig{Addresses: []string{seed.Addr().String()}, Topology: "cluster", Field: "used_memory", Password: "wrong"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	if _, _, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil); !errors.Is(err, tserrors.ErrSourcePermanent) {
+		t.Errorf("expected a wrong password to be a permanent error; got %v", err)
+	}
+}
+
+func TestParseClusterNodes(t *testing.T) {
+	got := parseClusterNodes("07c37dfeb235213a872192d90877d0cd55635b91 :0@0 myself,master - 0 0 0 connected\n", "10.0.0.1:6379")
+	if want := []node{{addr: "10.0.0.1:6379", role: "master"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected nodes %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		field     string
+		password  string
+		reply     string
+		wantClass error
+	}{
+		{"wrong password", "used_memory", "wrong", "", tserrors.ErrSourcePermanent},
+		{"missing password", "used_memory", "", "", tserrors.ErrSourcePermanent},
+		{"loading", "used_memory", "secret", "-LOADING Redis is loading the dataset in memory\r\n", tserrors.ErrSourceTransient},
+		{"disabled command", "used_memory", "secret", "-ERR unknown command 'INFO'\r\n", tserrors.ErrSourcePermanent},
+		{"unknown field", "used_memroy", "secret", bulk("used_memory:1\r\n"), tserrors.ErrConfigInvalid},
+		{"field not a number", "role", "secret", bulk("role:master\r\n"), tserrors.ErrConfigInvalid},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			ln := newTestServer(t, true, func([]string) string { return tt.reply })
+			defer ln.Close()
+
+			m, err := NewSourceMetric("errors", &MetricConfig{Addresses: []string{ln.Addr().String()}, Field: tt.field, Password: tt.password})
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, config := range []*MetricConfig{
+		{Addresses: []string{"redis.corp"}, Field: "used_memory"},
+		{Addresses: []string{"redis.corp:6379"}, Field: "Used Memory"},
+		{Addresses: []string{"redis.corp:6379", "redis2.corp:6379"}, Field: "used_memory"},
+		{Addresses: []string{"sentinel.corp:26379"}, Topology: "sentinel", Field: "used_memory"},
+		{Addresses: []string{"redis.corp:6379"}, MasterName: "mymaster", Field: "used_memory"},
+		{Addresses: []string{"redis.corp:6379"}, Field: "used_memory", CAFile: "ca.pem"},
+		{Addresses: []string{"redis.corp:6379"}, Field: "used_memory", Username: "ts_bridge"},
+	} {
+		if _, err := NewSourceMetric("invalid", config); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package requestid keeps track of request IDs that identify a sync and each metric update it runs. IDs are carried
+// in the context, attached to log lines, and sent to sources and to Stackdriver, so that a failed request can be
+// correlated with logs on the other side.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Header is the HTTP header (and gRPC metadata key) used to send request IDs.
+const Header = "X-Request-ID"
+
+// LogField is the name of the log entry field that has the request ID.
+const LogField = "request_id"
+
+type contextKey struct{}
+
+// New returns a new random request ID.
+func New() string {
+	return randomID(8)
+}
+
+// randomID returns `n` random bytes encoded as hex.
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// validID matches request IDs that are accepted from incoming requests.
+var validID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// FromRequest returns the request ID set by the client of an incoming HTTP request, or a new one if the request
+// does not have a valid ID.
+func FromRequest(r *http.Request) string {
+	if id := r.Header.Get(Header); validID.MatchString(id) {
+		return id
+	}
+	return New()
+}
+
+// NewContext returns a context that carries a request ID.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID carried by a context, or an empty string if there is none.
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// NewChildContext returns a context with a new request ID derived from the one carried by `ctx`, e.g. for a
+// single metric update within a sync.
+func NewChildContext(ctx context.Context) context.Context {
+	id := randomID(4)
+	if parent := FromContext(ctx); parent != "" {
+		id = parent + "-" + id
+	}
+	return NewContext(ctx, id)
+}
+
+// LogHook is a logrus hook that adds the request ID to entries logged with a context that carries one.
+type LogHook struct{}
+
+// Levels returns all log levels, since request IDs are useful irrespective of the level.
+func (LogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire adds the request ID field to a log entry.
+func (LogHook) Fire(e *log.Entry) error {
+	if e.Context == nil {
+		return nil
+	}
+	if id := FromContext(e.Context); id != "" {
+		e.Data[LogField] = id
+	}
+	return nil
+}
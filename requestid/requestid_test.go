@@ -0,0 +1,77 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package requestid
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestFromRequest(t *testing.T) {
+	for _, tt := range []struct {
+		header  string
+		wantNew bool
+	}{
+		{"", true},
+		{"abc-123.4_5", false},
+		{"bad id\nwith newline", true},
+		{strings.Repeat("a", 65), true},
+	} {
+		r := httptest.NewRequest("GET", "/sync", nil)
+		if tt.header != "" {
+			r.Header.Set(Header, tt.header)
+		}
+		got := FromRequest(r)
+		if tt.wantNew && (got == tt.header || len(got) != 16) {
+			t.Errorf("FromRequest() expected a new ID for header %q; got %q", tt.header, got)
+		}
+		if !tt.wantNew && got != tt.header {
+			t.Errorf("FromRequest() expected ID %q; got %q", tt.header, got)
+		}
+	}
+}
+
+func TestNewChildContext(t *testing.T) {
+	ctx := NewContext(context.Background(), "run")
+	child := FromContext(NewChildContext(ctx))
+	if !strings.HasPrefix(child, "run-") || len(child) != len("run-")+8 {
+		t.Errorf("expected child ID to be derived from 'run'; got %q", child)
+	}
+	if other := FromContext(NewChildContext(ctx)); other == child {
+		t.Errorf("expected child IDs to be unique; got %q twice", child)
+	}
+	if id := FromContext(NewChildContext(context.Background())); id == "" || strings.Contains(id, "-") {
+		t.Errorf("expected a new ID without a parent; got %q", id)
+	}
+}
+
+func TestLogHook(t *testing.T) {
+	entry := log.NewEntry(log.New()).WithContext(NewContext(context.Background(), "run"))
+	if err := (LogHook{}).Fire(entry); err != nil {
+		t.Fatalf("Fire() returned error: %v", err)
+	}
+	if entry.Data[LogField] != "run" {
+		t.Errorf("expected log entry to have field %s; got %v", LogField, entry.Data)
+	}
+
+	entry = log.NewEntry(log.New())
+	if err := (LogHook{}).Fire(entry); err != nil || len(entry.Data) != 0 {
+		t.Errorf("expected no fields to be added without a request ID; got %v, %v", entry.Data, err)
+	}
+}
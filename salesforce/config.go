@@ -0,0 +1,107 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package salesforce
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// Defaults of parameters that are not configured. expr0 is the field name Salesforce assigns to the first aggregate
+// of a query if it has no alias.
+const (
+	defaultAPIVersion = "59.0"
+	defaultValueField = "expr0"
+)
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Salesforce.
+type MetricConfig struct {
+	// InstanceURL is the My Domain URL of the org, e.g. https://acme.my.salesforce.com.
+	InstanceURL string `yaml:"instance_url" validate:"nonzero"`
+	// APIVersion is the version of the REST API, e.g. 59.0.
+	APIVersion string `yaml:"api_version" validate:"regexp=^([0-9]+\\.[0-9])?$"`
+	// Query is a SOQL query, e.g. `SELECT Priority, COUNT(Id) FROM Case WHERE IsClosed = false GROUP BY Priority`.
+	Query string `validate:"nonzero"`
+	// ValueField is the field of returned records that is imported as the value. Other fields are imported as labels.
+	ValueField string `yaml:"value_field"`
+
+	// ClientID and ClientSecret are the consumer key and secret of a connected app with the client credentials flow
+	// enabled.
+	ClientID     string `yaml:"client_id" validate:"nonzero"`
+	ClientSecret string `yaml:"client_secret"`
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// The client secret can also be read from a file, e.g. from a mounted Kubernetes secret.
+	ClientSecretFile string `yaml:"client_secret_file"`
+}
+
+// ReadSecretFiles sets the client secret from the contents of the configured secret file. Relative paths are
+// resolved relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.ClientSecretFile == "" {
+		return nil
+	}
+	if c.ClientSecret != "" {
+		return fmt.Errorf("client_secret and client_secret_file cannot both be set")
+	}
+	secret, err := env.ReadSecretFile(dir, c.ClientSecretFile)
+	if err != nil {
+		return fmt.Errorf("cannot read client_secret_file: %v", err)
+	}
+	c.ClientSecret = secret
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if c.ClientSecret == "" {
+		return fmt.Errorf("client_secret or client_secret_file needs to be set")
+	}
+	if !strings.HasPrefix(c.InstanceURL, "https://") && !strings.HasPrefix(c.InstanceURL, "http://") {
+		return fmt.Errorf("instance_url needs to be an HTTP(S) URL")
+	}
+	return nil
+}
+
+// instanceURL returns the URL of the org, without a trailing slash.
+func (c *MetricConfig) instanceURL() string {
+	return strings.TrimSuffix(c.InstanceURL, "/")
+}
+
+// apiVersion returns the version of the REST API.
+func (c *MetricConfig) apiVersion() string {
+	if c.APIVersion != "" {
+		return c.APIVersion
+	}
+	return defaultAPIVersion
+}
+
+// valueField returns the field of returned records that is imported as the value.
+func (c *MetricConfig) valueField() string {
+	if c.ValueField != "" {
+		return c.ValueField
+	}
+	return defaultValueField
+}
+
+// countQuery returns whether the query is a COUNT() query, which returns the number of matching records as the
+// total size of the result instead of returning records.
+func (c *MetricConfig) countQuery() bool {
+	return strings.Contains(strings.ToUpper(strings.Join(strings.Fields(c.Query), "")), "COUNT()")
+}
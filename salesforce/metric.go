@@ -0,0 +1,314 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package salesforce imports record counts and aggregate values of SOQL queries from Salesforce.
+package salesforce
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a metric imported from Salesforce. It implements the SourceMetric interface.
+type Metric struct {
+	Name       string
+	config     *MetricConfig
+	httpClient *http.Client
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:       name,
+		config:     config,
+		httpClient: httpClient,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/salesforce/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "salesforce"
+}
+
+// SourceHost returns the host of the org. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.instanceURL())
+	if err != nil || u.Host == "" {
+		return m.config.instanceURL()
+	}
+	return u.Host
+}
+
+// Query returns the SOQL query of this metric.
+func (m *Metric) Query() string {
+	return m.config.Query
+}
+
+// queryResult is a page of records returned by the query resource.
+type queryResult struct {
+	TotalSize      int                      `json:"totalSize"`
+	Done           bool                     `json:"done"`
+	NextRecordsURL string                   `json:"nextRecordsUrl"`
+	Records        []map[string]interface{} `json:"records"`
+}
+
+// StackdriverData runs the query, returning metric descriptor and time series with the current values. SOQL
+// queries return the current state of records, so a single point is imported per series and sync.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	now := timeNow().Truncate(time.Second)
+	if !now.After(lastPoint) {
+		return nil, nil, nil
+	}
+	end, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", now, err)
+	}
+	token, err := m.token(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	result, err := m.query(ctx, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.WithContext(ctx).Debugf("Got %d Salesforce records (total size %d) for %s", len(result.Records), result.TotalSize, m.Name)
+
+	values := make([]float64, 0, len(result.Records))
+	labels := make([]map[string]string, 0, len(result.Records))
+	keys := make(map[string]bool)
+	if m.config.countQuery() {
+		values = append(values, float64(result.TotalSize))
+		labels = append(labels, map[string]string{})
+	}
+	for _, r := range result.Records {
+		fields := make(map[string]interface{})
+		flatten("", r, fields)
+		var value interface{}
+		found := false
+		l := make(map[string]string)
+		for k, v := range fields {
+			if strings.EqualFold(k, m.config.valueField()) {
+				value, found = v, true
+				continue
+			}
+			key := labelKey(k)
+			keys[key] = true
+			l[key] = ""
+			if v != nil {
+				l[key] = fmt.Sprint(v)
+			}
+		}
+		if !found {
+			return nil, nil, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("records returned by the query have no field %s", m.config.valueField()))
+		}
+		if value == nil {
+			continue
+		}
+		f, ok := value.(float64)
+		if !ok {
+			return nil, nil, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("field %s is not a number: %v", m.config.valueField(), value))
+		}
+		values = append(values, f)
+		labels = append(labels, l)
+	}
+
+	// All series get the same labels, even if fields of related records are missing because a relationship is null.
+	for _, l := range labels {
+		for k := range keys {
+			if _, ok := l[k]; !ok {
+				l[k] = ""
+			}
+		}
+	}
+	ts := make([]*monitoringpb.TimeSeries, 0, len(values))
+	for i, v := range values {
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels[i]},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: end},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: v}},
+			}},
+		})
+	}
+	return m.metricDescriptor(keys), ts, nil
+}
+
+// flatten adds the fields of a record to `fields`, with fields of related records (e.g. Owner.Name) prefixed by the
+// relationship name. Record attributes (type and URL) are skipped.
+func flatten(prefix string, record map[string]interface{}, fields map[string]interface{}) {
+	for k, v := range record {
+		if k == "attributes" {
+			continue
+		}
+		if related, ok := v.(map[string]interface{}); ok {
+			flatten(prefix+k+".", related, fields)
+			continue
+		}
+		fields[prefix+k] = v
+	}
+}
+
+// token requests an access token using the OAuth 2.0 client credentials flow.
+func (m *Metric) token(ctx context.Context) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", m.config.ClientID)
+	form.Set("client_secret", m.config.ClientSecret)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.config.instanceURL()+"/services/oauth2/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := m.do(ctx, req, &token); err != nil {
+		return "", fmt.Errorf("cannot get Salesforce access token: %w", err)
+	}
+	return token.AccessToken, nil
+}
+
+// query runs the query, following nextRecordsUrl until all records have been returned.
+func (m *Metric) query(ctx context.Context, token string) (*queryResult, error) {
+	path := fmt.Sprintf("/services/data/v%s/query?%s", m.config.apiVersion(), url.Values{"q": {m.config.Query}}.Encode())
+	var result queryResult
+	for path != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.config.instanceURL()+path, nil)
+		if err != nil {
+			return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		var page queryResult
+		if err := m.do(ctx, req, &page); err != nil {
+			return nil, fmt.Errorf("Salesforce query failed: %w", err)
+		}
+		result.TotalSize = page.TotalSize
+		result.Records = append(result.Records, page.Records...)
+		path = ""
+		if !page.Done {
+			path = page.NextRecordsURL
+		}
+	}
+	return &result, nil
+}
+
+// do sends a request to the org, and decodes its JSON response into `result`.
+func (m *Metric) do(ctx context.Context, req *http.Request, result interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return tserrors.ClassifySource(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return tserrors.ClassifySource(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("received HTTP status code %d: %s", resp.StatusCode, data)
+		// API request limits are reported with status 403, but reset within 24 hours.
+		var errs []struct {
+			ErrorCode string `json:"errorCode"`
+		}
+		if json.Unmarshal(data, &errs) == nil && len(errs) > 0 && errs[0].ErrorCode == "REQUEST_LIMIT_EXCEEDED" {
+			return tserrors.Wrap(tserrors.ErrSourceTransient, err)
+		}
+		return tserrors.FromHTTPStatus(resp.StatusCode, err)
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("cannot parse response: %v", err)
+	}
+	return nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric, with the given label keys.
+func (m *Metric) metricDescriptor(keys map[string]bool) *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Salesforce query %s", m.Query()),
+		DisplayName: m.Name,
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		d.Labels = append(d.Labels, &label.LabelDescriptor{
+			Key:         k,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "Salesforce record field",
+		})
+	}
+	return d
+}
+
+// labelKey converts a field name (e.g. "Owner.Name" or "Severity__c") into a Stackdriver label key (e.g.
+// "owner_name" or "severity_c").
+func labelKey(field string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range field {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(unicode.ToLower(r))
+			underscore = false
+		} else if !underscore && b.Len() > 0 {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
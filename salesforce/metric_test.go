@@ -0,0 +1,215 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package salesforce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// newTestServer returns an org that issues a token for the test client and responds to queries with the given
+// pages of results. Queries are recorded in `queries`.
+func newTestServer(pages []string, queries *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/services/oauth2/token":
+			r.ParseForm()
+			if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_id") != "id" || r.Form.Get("client_secret") != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, `{"error": "invalid_client", "error_description": "invalid client credentials"}`)
+				return
+			}
+			fmt.Fprint(w, `{"access_token": "token", "token_type": "Bearer"}`)
+		case r.Header.Get("Authorization") != "Bearer token":
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `[{"message": "Session expired or invalid", "errorCode": "INVALID_SESSION_ID"}]`)
+		case r.URL.Path == "/services/data/v59.0/query":
+			*queries = append(*queries, r.URL.Query().Get("q")+" "+r.Header.Get(requestid.Header))
+			fmt.Fprint(w, pages[0])
+		case r.URL.Path == "/services/data/v59.0/query/01gD-2000":
+			*queries = append(*queries, "page 2")
+			fmt.Fprint(w, pages[1])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// testSeries is a simplified representation of a time series written to Stackdriver.
+type testSeries struct {
+	labels map[string]string
+	value  float64
+}
+
+func testPoints(ts []*monitoringpb.TimeSeries) []testSeries {
+	var series []testSeries
+	for _, s := range ts {
+		series = append(series, testSeries{s.Metric.Labels, s.Points[0].Value.GetDoubleValue()})
+	}
+	return series
+}
+
+func TestStackdriverDataAggregate(t *testing.T) {
+	var queries []string
+	server := newTestServer([]string{
+		`{"totalSize": 3, "done": false, "nextRecordsUrl": "/services/data/v59.0/query/01gD-2000", "records": [
+			{"attributes": {"type": "AggregateResult"}, "Priority": "High", "Owner": {"attributes": {"type": "User"}, "Name": "Ops"}, "expr0": 4},
+			{"attributes": {"type": "AggregateResult"}, "Priority": "Low", "Owner": {"attributes": {"type": "User"}, "Name": "Ops"}, "expr0": null}
+		]}`,
+		`{"totalSize": 3, "done": true, "records": [
+			{"attributes": {"type": "AggregateResult"}, "Priority": null, "Owner": null, "expr0": 1}
+		]}`,
+	}, &queries)
+	defer server.Close()
+
+	query := "SELECT Priority, Owner.Name, COUNT(Id) FROM Case WHERE IsClosed = false GROUP BY Priority, Owner.Name"
+	m, err := NewSourceMetric("open_cases", &MetricConfig{InstanceURL: server.URL + "/", Query: query, ClientID: "id", ClientSecret: "secret"})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, time.Now().Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if want := []string{query + " req-1", "page 2"}; !reflect.DeepEqual(queries, want) {
+		t.Errorf("expected queries %v; got %v", want, queries)
+	}
+	if desc.Type != "custom.googleapis.com/salesforce/open_cases" || len(desc.Labels) != 3 ||
+		desc.Labels[0].Key != "owner" || desc.Labels[1].Key != "owner_name" || desc.Labels[2].Key != "priority" {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// Records with a null value are skipped, and labels of null relationships are empty.
+	want := []testSeries{
+		{map[string]string{"priority": "High", "owner": "", "owner_name": "Ops"}, 4},
+		{map[string]string{"priority": "", "owner": "", "owner_name": ""}, 1},
+	}
+	if got := testPoints(ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected series %v; got %v", want, got)
+	}
+
+	// Points are only written once per second.
+	timeNow = func() time.Time { return time.Now().Truncate(time.Second) }
+	defer func() { timeNow = time.Now }()
+	if _, ts, err := m.StackdriverData(ctx, timeNow(), nil); err != nil || len(ts) != 0 {
+		t.Errorf("expected no points to be returned again; got %v, %v", ts, err)
+	}
+}
+
+func TestStackdriverDataCount(t *testing.T) {
+	var queries []string
+	server := newTestServer([]string{`{"totalSize": 42, "done": true, "records": []}`}, &queries)
+	defer server.Close()
+
+	m, err := NewSourceMetric("cases", &MetricConfig{
+		InstanceURL:  server.URL,
+		Query:        "SELECT COUNT() FROM Case WHERE IsClosed = false",
+		ClientID:     "id",
+		ClientSecret: "secret",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	desc, ts, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if want := []testSeries{{map[string]string{}, 42}}; !reflect.DeepEqual(testPoints(ts), want) || len(desc.Labels) != 0 {
+		t.Errorf("expected series %v without labels; got %v with %v", want, testPoints(ts), desc.Labels)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		config    MetricConfig
+		status    int
+		body      string
+		wantClass error
+	}{
+		{"invalid client", MetricConfig{ClientID: "id", ClientSecret: "wrong"}, http.StatusOK, ``, tserrors.ErrSourcePermanent},
+		{"malformed query", MetricConfig{}, http.StatusBadRequest, `[{"message": "unexpected token", "errorCode": "MALFORMED_QUERY"}]`, tserrors.ErrSourcePermanent},
+		{"request limit", MetricConfig{}, http.StatusForbidden, `[{"message": "TotalRequests Limit exceeded.", "errorCode": "REQUEST_LIMIT_EXCEEDED"}]`, tserrors.ErrSourceTransient},
+		{"unavailable", MetricConfig{}, http.StatusServiceUnavailable, ``, tserrors.ErrSourceTransient},
+		{"missing value field", MetricConfig{ValueField: "total"}, http.StatusOK, `{"totalSize": 1, "done": true, "records": [{"expr0": 1}]}`, tserrors.ErrConfigInvalid},
+		{"value not a number", MetricConfig{}, http.StatusOK, `{"totalSize": 1, "done": true, "records": [{"expr0": "a"}]}`, tserrors.ErrConfigInvalid},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			var queries []string
+			server := newTestServer([]string{tt.body}, &queries)
+			if tt.status != http.StatusOK {
+				server.Close()
+				server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					if r.URL.Path == "/services/oauth2/token" {
+						fmt.Fprint(w, `{"access_token": "token"}`)
+						return
+					}
+					w.WriteHeader(tt.status)
+					fmt.Fprint(w, tt.body)
+				}))
+			}
+			defer server.Close()
+
+			config := tt.config
+			config.InstanceURL, config.Query = server.URL, "SELECT COUNT(Id) FROM Case"
+			if config.ClientID == "" {
+				config.ClientID, config.ClientSecret = "id", "secret"
+			}
+			m, err := NewSourceMetric("errors", &config)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Minute), nil)
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, config := range []*MetricConfig{
+		{InstanceURL: "https://acme.my.salesforce.com", Query: "q", ClientID: "id"},
+		{InstanceURL: "acme.my.salesforce.com", Query: "q", ClientID: "id", ClientSecret: "secret"},
+	} {
+		if _, err := NewSourceMetric("invalid", config); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
+
+func TestLabelKey(t *testing.T) {
+	for in, want := range map[string]string{
+		"Priority":          "priority",
+		"Owner.Name":        "owner_name",
+		"Severity__c":       "severity_c",
+		"Account.Region__c": "account_region_c",
+	} {
+		if got := labelKey(in); got != want {
+			t.Errorf("labelKey(%s) = %s; want %s", in, got, want)
+		}
+	}
+}
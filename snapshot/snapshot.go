@@ -0,0 +1,190 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package snapshot writes and reads archives with the state of a ts-bridge deployment: the metric records of all
+// configured metrics and the effective configuration. Snapshots can be restored into another storage engine, e.g. for
+// disaster recovery or to clone an environment.
+package snapshot
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/google/ts-bridge/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Names of files in a snapshot archive.
+const (
+	manifestFile = "manifest.json"
+	configFile   = "config.yaml"
+	recordsFile  = "records.json"
+)
+
+// formatVersion is the version of the archive format, which is increased for incompatible changes.
+const formatVersion = 1
+
+// Snapshot is the state of a ts-bridge deployment.
+type Snapshot struct {
+	Manifest
+	// Config is the effective configuration with secrets redacted, as served by /config.
+	Config []byte
+	// Records are the states of metric records of all configured metrics.
+	Records []storage.RecordState
+}
+
+// Manifest describes a snapshot.
+type Manifest struct {
+	Version       int       `json:"version"`
+	Created       time.Time `json:"created"`
+	StorageEngine string    `json:"storage_engine"`
+	Records       int       `json:"records"`
+}
+
+// Write writes a snapshot as a gzipped tar archive.
+func Write(w io.Writer, s *Snapshot) error {
+	s.Manifest.Version = formatVersion
+	s.Manifest.Records = len(s.Records)
+	manifest, err := json.MarshalIndent(&s.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	records, err := json.MarshalIndent(s.Records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{manifestFile, manifest},
+		{configFile, s.Config},
+		{recordsFile, records},
+	} {
+		hdr := &tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.data)), ModTime: s.Created}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("cannot write %s: %v", f.name, err)
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return fmt.Errorf("cannot write %s: %v", f.name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Read reads a snapshot written by Write.
+func Read(r io.Reader) (*Snapshot, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a snapshot archive: %v", err)
+	}
+	defer gz.Close()
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read snapshot archive: %v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %v", hdr.Name, err)
+		}
+		files[hdr.Name] = data
+	}
+	for _, name := range []string{manifestFile, configFile, recordsFile} {
+		if _, ok := files[name]; !ok {
+			return nil, fmt.Errorf("snapshot archive has no %s", name)
+		}
+	}
+
+	s := &Snapshot{Config: files[configFile]}
+	if err := json.Unmarshal(files[manifestFile], &s.Manifest); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", manifestFile, err)
+	}
+	if s.Manifest.Version != formatVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d; expected %d", s.Manifest.Version, formatVersion)
+	}
+	if err := json.Unmarshal(files[recordsFile], &s.Records); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", recordsFile, err)
+	}
+	return s, nil
+}
+
+// Take returns the states of metric records, sorted by metric name.
+func Take(records []storage.MetricRecord) ([]storage.RecordState, error) {
+	var states []storage.RecordState
+	for _, r := range records {
+		restorer, ok := r.(storage.Restorer)
+		if !ok {
+			return nil, fmt.Errorf("metric records of the storage engine cannot be exported")
+		}
+		states = append(states, restorer.State())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states, nil
+}
+
+// Restore writes the states of metric records of a snapshot into a storage engine. Records that have been updated
+// since the snapshot was taken are skipped unless `force` is set, so that restoring an old snapshot by mistake does
+// not revert newer state. It returns the number of restored and skipped records.
+func Restore(ctx context.Context, m storage.Manager, s *Snapshot, force bool) (int, int, error) {
+	b, batched := m.(storage.Batcher)
+	if batched {
+		b.StartBatch()
+	}
+	restored, skipped := 0, 0
+	for _, state := range s.Records {
+		r, err := m.NewMetricRecord(ctx, state.Name, state.Query)
+		if err != nil {
+			return restored, skipped, fmt.Errorf("cannot read metric record %s: %v", state.Name, err)
+		}
+		restorer, ok := r.(storage.Restorer)
+		if !ok {
+			return restored, skipped, fmt.Errorf("metric records of the storage engine cannot be restored")
+		}
+		if !force && restorer.State().LastAttempt.After(s.Created) {
+			log.WithContext(ctx).Warningf("Skipping metric record %s, which has been updated since the snapshot was taken", state.Name)
+			skipped++
+			continue
+		}
+		if err := restorer.Restore(ctx, state); err != nil {
+			return restored, skipped, fmt.Errorf("cannot restore metric record %s: %v", state.Name, err)
+		}
+		restored++
+	}
+	if batched {
+		if err := b.FlushBatch(ctx); err != nil {
+			return 0, skipped, err
+		}
+	}
+	return restored, skipped, nil
+}
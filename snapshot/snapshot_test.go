@@ -0,0 +1,118 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/memory"
+	"github.com/google/ts-bridge/storage"
+)
+
+func TestWriteRead(t *testing.T) {
+	ctx := context.Background()
+	source := memory.New()
+	r, err := source.NewMetricRecord(ctx, "metric1", "query1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateSuccess(ctx, 5, "5 points written"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetThresholdStreaks(ctx, []int{2}); err != nil {
+		t.Fatal(err)
+	}
+	states, err := Take([]storage.MetricRecord{r})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &Snapshot{
+		Manifest: Manifest{Created: time.Now().Truncate(time.Second).UTC(), StorageEngine: "memory"},
+		Config:   []byte("settings: {}\n"),
+		Records:  states,
+	}
+	var buf bytes.Buffer
+	if err := Write(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Records[0].LastUpdate.Equal(states[0].LastUpdate) {
+		// Monotonic clock readings are not serialized.
+		got.Records[0].LastUpdate = states[0].LastUpdate
+		got.Records[0].LastAttempt = states[0].LastAttempt
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v; got %+v", want, got)
+	}
+	if got.Records[0].LastStatus != "OK: 5 points written" || got.Manifest.Records != 1 {
+		t.Errorf("unexpected records %+v", got)
+	}
+
+	if _, err := Read(bytes.NewBufferString("not an archive")); err == nil {
+		t.Error("expected an error reading an invalid archive")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	ctx := context.Background()
+	created := time.Now().Add(-time.Hour)
+	s := &Snapshot{
+		Manifest: Manifest{Created: created},
+		Records: []storage.RecordState{
+			{Name: "metric1", Query: "query1", LastUpdate: created, LastAttempt: created, LastStatus: "OK: 1 points written"},
+			{Name: "metric2", Query: "query2", LastAttempt: created, LastStatus: "ERROR: failed", ThresholdStreaks: []int{3}},
+		},
+	}
+	target := memory.New()
+	// metric2 has been updated since the snapshot was taken.
+	r, err := target.NewMetricRecord(ctx, "metric2", "query2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateError(ctx, fmt.Errorf("newer error")); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, skipped, err := Restore(ctx, target, s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 1 || skipped != 1 {
+		t.Errorf("expected 1 restored and 1 skipped record; got %d and %d", restored, skipped)
+	}
+	r1, _ := target.NewMetricRecord(ctx, "metric1", "query1")
+	if !r1.GetLastUpdate().Equal(created) || r1.GetLastStatus() != "OK: 1 points written" {
+		t.Errorf("expected metric1 to be restored; got %+v", r1)
+	}
+	if r.GetLastStatus() != "ERROR: newer error" {
+		t.Errorf("expected metric2 to be skipped; got %s", r.GetLastStatus())
+	}
+
+	if _, _, err := Restore(ctx, target, s, true); err != nil {
+		t.Fatal(err)
+	}
+	if r.GetLastStatus() != "ERROR: failed" || !reflect.DeepEqual(r.GetThresholdStreaks(), []int{3}) {
+		t.Errorf("expected metric2 to be restored with force; got %s %v", r.GetLastStatus(), r.GetThresholdStreaks())
+	}
+}
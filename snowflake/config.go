@@ -0,0 +1,139 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snowflake
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+	"github.com/google/ts-bridge/timezone"
+)
+
+// Default column names and statement timeout, unless configured.
+const (
+	defaultTimeColumn  = "time"
+	defaultValueColumn = "value"
+	defaultTimeout     = time.Minute
+)
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Snowflake.
+type MetricConfig struct {
+	// Account is the account identifier, e.g. myorg-myaccount or xy12345.us-east-1.
+	Account string `validate:"nonzero"`
+	// Endpoint overrides the URL of the account, which is derived from the account identifier by default.
+	Endpoint string
+	// User is the name of the user whose public key has been registered using ALTER USER ... SET RSA_PUBLIC_KEY.
+	User string `validate:"nonzero"`
+	// PrivateKeyFile is the path to the unencrypted PEM-encoded RSA private key of the user.
+	PrivateKeyFile string `yaml:"private_key_file" validate:"nonzero"`
+
+	// Warehouse runs the statement. Database, Schema and Role override the defaults of the user.
+	Warehouse string `validate:"nonzero"`
+	Database  string
+	Schema    string
+	Role      string
+
+	// Query is a SELECT statement returning a time column, a value column and any number of label columns.
+	Query       string `validate:"nonzero"`
+	TimeColumn  string `yaml:"time_column"`
+	ValueColumn string `yaml:"value_column"`
+	// Interval is the minimum time between two queries, e.g. to avoid resuming a warehouse on every sync.
+	Interval time.Duration
+	// Timeout is the maximum run time of the statement.
+	Timeout time.Duration
+	// TimeZone is the IANA time zone of the session, in which TIMESTAMP_NTZ and DATE values are interpreted. UTC by
+	// default.
+	TimeZone string `yaml:"time_zone"`
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	privateKey string
+}
+
+// identifier matches unquoted Snowflake identifiers, which are the only column names supported.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_$]*$`)
+
+// ReadSecretFiles reads the private key. Relative paths are resolved relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.PrivateKeyFile == "" {
+		// Reported by validation.
+		return nil
+	}
+	key, err := env.ReadSecretFile(dir, c.PrivateKeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read private_key_file: %v", err)
+	}
+	c.privateKey = key
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if c.TimeColumn != "" && !identifier.MatchString(c.TimeColumn) {
+		return fmt.Errorf("time_column %q is not a valid unquoted identifier", c.TimeColumn)
+	}
+	if c.ValueColumn != "" && !identifier.MatchString(c.ValueColumn) {
+		return fmt.Errorf("value_column %q is not a valid unquoted identifier", c.ValueColumn)
+	}
+	if strings.EqualFold(c.timeColumn(), c.valueColumn()) {
+		return fmt.Errorf("time_column and value_column need to be different")
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("interval cannot be negative")
+	}
+	if c.Timeout < 0 || c.Timeout%time.Second != 0 {
+		return fmt.Errorf("timeout needs to be a positive number of seconds")
+	}
+	if _, err := timezone.Load(c.TimeZone); err != nil {
+		return fmt.Errorf("invalid time_zone: %v", err)
+	}
+	return nil
+}
+
+// endpoint returns the URL of the account.
+func (c *MetricConfig) endpoint() string {
+	if c.Endpoint != "" {
+		return strings.TrimSuffix(c.Endpoint, "/")
+	}
+	return fmt.Sprintf("https://%s.snowflakecomputing.com", strings.ToLower(c.Account))
+}
+
+// timeColumn returns the name of the column containing the timestamps of points.
+func (c *MetricConfig) timeColumn() string {
+	if c.TimeColumn != "" {
+		return c.TimeColumn
+	}
+	return defaultTimeColumn
+}
+
+// valueColumn returns the name of the column containing the values of points.
+func (c *MetricConfig) valueColumn() string {
+	if c.ValueColumn != "" {
+		return c.ValueColumn
+	}
+	return defaultValueColumn
+}
+
+// timeout returns the maximum run time of the statement.
+func (c *MetricConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
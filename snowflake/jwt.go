@@ -0,0 +1,111 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package snowflake
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tokenLifetime is the validity of generated tokens. Snowflake rejects tokens that are valid for more than an hour.
+const tokenLifetime = 59 * time.Minute
+
+// keyPair generates JSON Web Tokens for key pair authentication.
+// See https://docs.snowflake.com/en/developer-guide/sql-api/authenticating
+type keyPair struct {
+	issuer  string
+	subject string
+	key     *rsa.PrivateKey
+}
+
+// newKeyPair parses the private key of the user configured in `c`.
+func newKeyPair(c *MetricConfig) (*keyPair, error) {
+	block, _ := pem.Decode([]byte(c.privateKey))
+	if block == nil {
+		return nil, fmt.Errorf("private_key_file does not contain a PEM-encoded key")
+	}
+	if block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block) {
+		return nil, fmt.Errorf("encrypted private keys are not supported")
+	}
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("private key is not an RSA key")
+		}
+		key = rsaKey
+	} else {
+		return nil, fmt.Errorf("cannot parse private key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode public key: %v", err)
+	}
+	fingerprint := sha256.Sum256(der)
+	subject := fmt.Sprintf("%s.%s", accountName(c.Account), strings.ToUpper(c.User))
+	return &keyPair{
+		issuer:  fmt.Sprintf("%s.SHA256:%s", subject, base64.StdEncoding.EncodeToString(fingerprint[:])),
+		subject: subject,
+		key:     key,
+	}, nil
+}
+
+// accountName returns the account name used in tokens: the account locator without region and cloud (xy12345 for
+// xy12345.us-east-1.aws), or the organization and account name joined by a hyphen (MYORG-MYACCOUNT).
+func accountName(account string) string {
+	account = strings.ToUpper(account)
+	if i := strings.Index(account, ".GLOBAL"); i >= 0 {
+		// Global URLs of accounts with client redirect, e.g. xy12345-abcdef.global.
+		if j := strings.LastIndex(account[:i], "-"); j > 0 {
+			return account[:j]
+		}
+	}
+	return strings.SplitN(account, ".", 2)[0]
+}
+
+// token returns a signed RS256 token issued at time `now`.
+func (k *keyPair) token(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": k.issuer,
+		"sub": k.subject,
+		"iat": now.Unix(),
+		"exp": now.Add(tokenLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("cannot sign token: %v", err)
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -0,0 +1,425 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package snowflake imports the results of SQL statements run in a Snowflake warehouse.
+package snowflake
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/timezone"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// pollInterval is the time between requests for the status of statements that are still running.
+var pollInterval = time.Second
+
+// Query times are shared by all configurations loaded during the lifetime of the process, since the configuration
+// file is reloaded for each sync.
+var (
+	lastQueriesMu sync.Mutex
+	lastQueries   = make(map[string]time.Time)
+)
+
+// Metric defines a metric imported from Snowflake. It implements the SourceMetric interface.
+type Metric struct {
+	Name        string
+	config      *MetricConfig
+	keyPair     *keyPair
+	httpClient  *http.Client
+	minPointAge time.Duration
+	location    *time.Location
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters. The private key needs
+// to have been read using ReadSecretFiles.
+func NewSourceMetric(name string, config *MetricConfig, minPointAge time.Duration) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	keyPair, err := newKeyPair(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	location, err := timezone.Load(config.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:        name,
+		config:      config,
+		keyPair:     keyPair,
+		httpClient:  httpClient,
+		minPointAge: minPointAge,
+		location:    location,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/snowflake/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "snowflake"
+}
+
+// SourceHost returns the host of the account. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.endpoint())
+	if err != nil || u.Host == "" {
+		return m.config.endpoint()
+	}
+	return u.Host
+}
+
+// Query returns the SQL statement of this metric.
+func (m *Metric) Query() string {
+	return m.config.Query
+}
+
+// statementRequest is the body of a request to run a statement.
+type statementRequest struct {
+	Statement  string             `json:"statement"`
+	Timeout    int64              `json:"timeout"`
+	Warehouse  string             `json:"warehouse"`
+	Database   string             `json:"database,omitempty"`
+	Schema     string             `json:"schema,omitempty"`
+	Role       string             `json:"role,omitempty"`
+	Bindings   map[string]binding `json:"bindings"`
+	Parameters map[string]string  `json:"parameters,omitempty"`
+}
+
+type binding struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// column describes a column of a result set.
+type column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// statementResponse is the status of a statement and, once it has completed, a partition of its result set. All
+// values are returned as strings, or null.
+type statementResponse struct {
+	Code              string `json:"code"`
+	Message           string `json:"message"`
+	StatementHandle   string `json:"statementHandle"`
+	ResultSetMetaData struct {
+		RowType       []column   `json:"rowType"`
+		PartitionInfo []struct{} `json:"partitionInfo"`
+	} `json:"resultSetMetaData"`
+	Data [][]*string `json:"data"`
+}
+
+// StackdriverData runs the statement in Snowflake, returning metric descriptor and time series data with points
+// after the given lastPoint timestamp. If an interval is configured, the statement is not run again until it has
+// passed since the last successful run.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	now := timeNow()
+	if m.config.Interval > 0 {
+		lastQueriesMu.Lock()
+		last, ok := lastQueries[m.Name]
+		lastQueriesMu.Unlock()
+		if ok && now.Sub(last) < m.config.Interval {
+			log.WithContext(ctx).Debugf("Not querying Snowflake for %s: last queried at %v", m.Name, last)
+			return nil, nil, nil
+		}
+	}
+	end := now.Add(-m.minPointAge)
+	if !end.After(lastPoint) {
+		return nil, nil, nil
+	}
+	result, err := m.execute(ctx, lastPoint, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	lastQueriesMu.Lock()
+	lastQueries[m.Name] = now
+	lastQueriesMu.Unlock()
+	log.WithContext(ctx).Debugf("Got %d Snowflake rows for %s", len(result.Data), m.Name)
+
+	columns := result.ResultSetMetaData.RowType
+	timeIndex, valueIndex := -1, -1
+	for i, c := range columns {
+		switch {
+		case strings.EqualFold(c.Name, m.config.timeColumn()):
+			timeIndex = i
+		case strings.EqualFold(c.Name, m.config.valueColumn()):
+			valueIndex = i
+		}
+	}
+	if timeIndex < 0 || valueIndex < 0 {
+		return nil, nil, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("statement needs to return columns named %s and %s",
+			m.config.timeColumn(), m.config.valueColumn()))
+	}
+
+	// Naive timestamps are converted per time series, since repeated wall clock times at the end of daylight saving
+	// time are resolved by their order.
+	converters := make(map[string]*timezone.Converter)
+	var ts []*monitoringpb.TimeSeries
+	for _, row := range result.Data {
+		if len(row) != len(columns) || row[timeIndex] == nil || row[valueIndex] == nil {
+			continue
+		}
+		labels := make(map[string]string)
+		for i, c := range columns {
+			if i == timeIndex || i == valueIndex {
+				continue
+			}
+			labels[labelKey(c.Name)] = ""
+			if row[i] != nil {
+				labels[labelKey(c.Name)] = *row[i]
+			}
+		}
+		t, naive, err := parseTime(columns[timeIndex].Type, *row[timeIndex])
+		if err != nil {
+			return nil, nil, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("invalid value of column %s: %v", columns[timeIndex].Name, err))
+		}
+		if naive {
+			key := fmt.Sprint(labels)
+			if converters[key] == nil {
+				converters[key] = timezone.NewConverter(m.location, lastPoint)
+			}
+			t = converters[key].Convert(t)
+		}
+		if !t.After(lastPoint) || t.After(end) {
+			continue
+		}
+		value, err := strconv.ParseFloat(*row[valueIndex], 64)
+		if err != nil {
+			return nil, nil, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("invalid value of column %s: %v", columns[valueIndex].Name, err))
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		et, err := ptypes.TimestampProto(t)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", t, err)
+		}
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: labels},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: et},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+			}},
+		})
+	}
+	return m.metricDescriptor(columns, timeIndex, valueIndex), ts, nil
+}
+
+// execute runs the statement for rows with timestamps in (start, end], waits for it to complete and returns all
+// partitions of its result set.
+func (m *Metric) execute(ctx context.Context, start, end time.Time) (*statementResponse, error) {
+	column := m.config.timeColumn()
+	statement := fmt.Sprintf("SELECT * FROM (%s) WHERE %s > TO_TIMESTAMP_LTZ(?, 3) AND %s <= TO_TIMESTAMP_LTZ(?, 3)",
+		strings.TrimSuffix(strings.TrimSpace(m.config.Query), ";"), column, column)
+	var parameters map[string]string
+	if m.config.TimeZone != "" {
+		// Rows are ordered to resolve repeated wall clock times, and the session time zone is used to compare
+		// TIMESTAMP_NTZ values with the bound timestamps.
+		statement += " ORDER BY " + column
+		parameters = map[string]string{"timezone": m.config.TimeZone}
+	}
+	body, err := json.Marshal(statementRequest{
+		Statement: statement,
+		Timeout:   int64(m.config.timeout() / time.Second),
+		Warehouse: m.config.Warehouse,
+		Database:  m.config.Database,
+		Schema:    m.config.Schema,
+		Role:      m.config.Role,
+		Bindings: map[string]binding{
+			"1": {"FIXED", strconv.FormatInt(start.UnixNano()/int64(time.Millisecond), 10)},
+			"2": {"FIXED", strconv.FormatInt(end.UnixNano()/int64(time.Millisecond), 10)},
+		},
+		Parameters: parameters,
+	})
+	if err != nil {
+		return nil, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	result, status, err := m.request(ctx, http.MethodPost, "/api/v2/statements", body)
+	for err == nil && status == http.StatusAccepted {
+		select {
+		case <-ctx.Done():
+			return nil, tserrors.ClassifySource(fmt.Errorf("Snowflake statement %s did not complete: %w", result.StatementHandle, ctx.Err()))
+		case <-time.After(pollInterval):
+		}
+		result, status, err = m.request(ctx, http.MethodGet, "/api/v2/statements/"+url.PathEscape(result.StatementHandle), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The first partition is returned with the metadata; others need to be requested separately.
+	for i := 1; i < len(result.ResultSetMetaData.PartitionInfo); i++ {
+		partition, _, err := m.request(ctx, http.MethodGet, fmt.Sprintf("/api/v2/statements/%s?partition=%d",
+			url.PathEscape(result.StatementHandle), i), nil)
+		if err != nil {
+			return nil, err
+		}
+		result.Data = append(result.Data, partition.Data...)
+	}
+	return result, nil
+}
+
+// request sends an authenticated request to the SQL API, returning the parsed response and its status code (200 for
+// completed statements, or 202 for statements that are still running).
+func (m *Metric) request(ctx context.Context, method, path string, body []byte) (*statementResponse, int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, m.config.endpoint()+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	token, err := m.keyPair.token(timeNow())
+	if err != nil {
+		return nil, 0, tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-Snowflake-Authorization-Token-Type", "KEYPAIR_JWT")
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, tserrors.ClassifySource(fmt.Errorf("Snowflake request failed: %w", err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, tserrors.ClassifySource(fmt.Errorf("cannot read Snowflake response: %w", err))
+	}
+	var result statementResponse
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		// Failed statements are reported with status 422 and a message describing the SQL error.
+		if json.Unmarshal(data, &result) == nil && result.Message != "" {
+			data = []byte(result.Message)
+		}
+		return nil, 0, tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("Snowflake request returned HTTP status code %d: %s", resp.StatusCode, data))
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, 0, fmt.Errorf("cannot parse Snowflake response: %v", err)
+	}
+	return &result, resp.StatusCode, nil
+}
+
+// Layouts of naive timestamps returned as text.
+var naiveLayouts = []string{"2006-01-02 15:04:05.999999999", "2006-01-02T15:04:05.999999999", "2006-01-02"}
+
+// parseTime parses a value of the time column, given its Snowflake type. The SQL API returns timestamps as seconds
+// since the epoch (followed by a time zone offset for TIMESTAMP_TZ), and dates as days since the epoch. It also
+// returns true for naive timestamps (TIMESTAMP_NTZ, DATE and text without offset), whose wall clock time is returned
+// in UTC and needs to be converted to the time zone of the metric.
+func parseTime(typ, value string) (time.Time, bool, error) {
+	switch strings.ToLower(typ) {
+	case "timestamp_ltz", "timestamp_ntz", "timestamp_tz", "fixed":
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			return time.Time{}, false, fmt.Errorf("empty timestamp")
+		}
+		parts := strings.SplitN(fields[0], ".", 2)
+		sec, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		var nsec int64
+		if len(parts) == 2 {
+			frac := (parts[1] + "000000000")[:9]
+			if nsec, err = strconv.ParseInt(frac, 10, 64); err != nil {
+				return time.Time{}, false, err
+			}
+		}
+		return time.Unix(sec, nsec).UTC(), strings.EqualFold(typ, "timestamp_ntz"), nil
+	case "date":
+		days, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return time.Time{}, false, err
+		}
+		return time.Unix(days*24*60*60, 0).UTC(), true, nil
+	case "text":
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t, false, nil
+		}
+		for _, layout := range naiveLayouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t, true, nil
+			}
+		}
+		return time.Time{}, false, fmt.Errorf("invalid timestamp %q", value)
+	}
+	return time.Time{}, false, fmt.Errorf("unsupported type %s", typ)
+}
+
+// labelKey converts a column name (returned in upper case for unquoted identifiers) into a Stackdriver label key.
+func labelKey(name string) string {
+	return strings.ToLower(strings.Replace(name, "$", "_", -1))
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric, with a label for each column other than
+// the time and value columns.
+func (m *Metric) metricDescriptor(columns []column, timeIndex, valueIndex int) *metricpb.MetricDescriptor {
+	d := &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Snowflake query %s", m.Query()),
+		DisplayName: m.Name,
+	}
+	for i, c := range columns {
+		if i == timeIndex || i == valueIndex {
+			continue
+		}
+		d.Labels = append(d.Labels, &label.LabelDescriptor{
+			Key:         labelKey(c.Name),
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "Snowflake column",
+		})
+	}
+	return d
+}
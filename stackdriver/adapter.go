@@ -16,16 +16,40 @@ package stackdriver
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/ptypes"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/option"
+	"google.golang.org/genproto/googleapis/api/label"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// LatestTimestamps queries time series of several metrics at once, since a query per metric dominates the duration
+// of a sync with many metrics.
+const (
+	latestTimestampBatchSize   = 20
+	latestTimestampParallelism = 4
+)
+
+// Writes that fail with a transient error are retried a few times before giving up.
+const (
+	writeAttempts     = 3
+	writeRetryBackoff = 500 * time.Millisecond
 )
 
 //go:generate mockgen -destination=../mocks/mock_sd_metric_client.go -package=mocks github.com/google/ts-bridge/stackdriver MetricClient
@@ -40,22 +64,42 @@ type MetricClient interface {
 	Close() error
 }
 
+// WriteObserver is called after each CreateTimeSeries API call with the number of points and the size of the request
+// in bytes. `err` is the classified error returned by the call, or nil if it succeeded.
+type WriteObserver func(ctx context.Context, project string, points, bytes int, err error)
+
 // Adapter allows querying and writing Stackdriver metrics.
 type Adapter struct {
 	c                MetricClient
 	lookBackInterval time.Duration
+	descriptors      *DescriptorCache
+	observer         WriteObserver
+	timestamps       *TimestampCache
 }
 
-// NewAdapter returns a new Stackdriver adapter.
-func NewAdapter(ctx context.Context, lookbackInterval time.Duration) (*Adapter, error) {
-	c, err := newClient(ctx)
+// NewAdapter returns a new Stackdriver adapter. Metric descriptors are kept in `descriptors`, which can be nil to
+// disable caching. Client options, e.g. credentials, are passed to the Stackdriver client.
+func NewAdapter(ctx context.Context, lookbackInterval time.Duration, descriptors *DescriptorCache, opts ...option.ClientOption) (*Adapter, error) {
+	c, err := newClient(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
 
 	log.Debugf("StackDriver client/lookback configured: %v/%v", c, lookbackInterval)
 
-	return &Adapter{c, lookbackInterval}, nil
+	return &Adapter{c, lookbackInterval, descriptors, nil, nil}, nil
+}
+
+// SetWriteObserver configures a function that gets called after each CreateTimeSeries API call, e.g. to collect
+// stats about writes. Retried calls are observed separately.
+func (a *Adapter) SetWriteObserver(o WriteObserver) {
+	a.observer = o
+}
+
+// SetTimestampCache configures a cache for latest timestamps of metrics, which makes LatestTimestamp query all metrics
+// sharing a metric type prefix at once. Nil disables caching.
+func (a *Adapter) SetTimestampCache(c *TimestampCache) {
+	a.timestamps = c
 }
 
 // Close closes the underlying metric client.
@@ -63,8 +107,8 @@ func (a *Adapter) Close() error {
 	return a.c.Close()
 }
 
-// listTimeSeries returns a list of SD TimeSeries for a given metric name.
-func (a *Adapter) listTimeSeries(ctx context.Context, project, name string) ([]*monitoringpb.TimeSeries, error) {
+// listTimeSeries returns a list of SD TimeSeries matching a given filter.
+func (a *Adapter) listTimeSeries(ctx context.Context, project, filter string) ([]*monitoringpb.TimeSeries, error) {
 	endTs, err := ptypes.TimestampProto(time.Now())
 	if err != nil {
 		return nil, err
@@ -75,7 +119,7 @@ func (a *Adapter) listTimeSeries(ctx context.Context, project, name string) ([]*
 	}
 	return a.c.ListTimeSeries(ctx, &monitoringpb.ListTimeSeriesRequest{
 		Name:   fmt.Sprintf("projects/%s", project),
-		Filter: fmt.Sprintf(`metric.type = "%s"`, name),
+		Filter: filter,
 		Interval: &monitoringpb.TimeInterval{
 			StartTime: startTs,
 			EndTime:   endTs,
@@ -92,51 +136,135 @@ func (a *Adapter) getDescriptor(ctx context.Context, project, name string) (*met
 		if ok && st.Code() == codes.NotFound {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("GetMetricDescriptor error: %s, name: %v", err, name)
+		return nil, classifyError(err, fmt.Errorf("GetMetricDescriptor error: %s, name: %v", err, name))
+	}
+	return desc, nil
+}
+
+// cachedDescriptor returns a metric descriptor for a given metric, using the descriptor cache if possible.
+func (a *Adapter) cachedDescriptor(ctx context.Context, project, name string) (*metricpb.MetricDescriptor, error) {
+	if desc := a.descriptors.get(project, name); desc != nil {
+		return desc, nil
+	}
+	desc, err := a.getDescriptor(ctx, project, name)
+	if err != nil {
+		return nil, err
 	}
+	a.descriptors.set(project, name, desc)
 	return desc, nil
 }
 
+// MetricDescriptor returns the current metric descriptor of a metric in SD, or nil if it does not exist.
+func (a *Adapter) MetricDescriptor(ctx context.Context, project, name string) (*metricpb.MetricDescriptor, error) {
+	return a.cachedDescriptor(withRequestID(ctx), project, name)
+}
+
 // setDescriptor installs a metric descriptor for a given metric. If there is an existing metric descriptor
 // that is different, it will be deleted first.
 func (a *Adapter) setDescriptor(ctx context.Context, project, name string, desc *metricpb.MetricDescriptor) error {
 	desc.Name = fmt.Sprintf("projects/%s/metricDescriptors/%s", project, desc.Type)
 
+	// A cached descriptor is only trusted if it does not need to be changed; otherwise the current descriptor is
+	// fetched again before deciding what to do with it.
+	if cached := a.descriptors.get(project, name); cached != nil && !descriptorChanged(cached, desc) {
+		return nil
+	}
 	current, err := a.getDescriptor(ctx, project, name)
 	if err != nil {
-		return fmt.Errorf("Error while getting descriptor for %s: %s", name, err)
+		return fmt.Errorf("Error while getting descriptor for %s: %w", name, err)
 	}
-	// Metric descriptors cannot be updated in-place, and deleting a descriptor requries the metric
-	// to not be used for alerts. This is why the descriptor is only deleted and recreated if absolutely
-	// necessary, i.e. when metric kind or value type is different.
-	if current.GetMetricKind() == desc.GetMetricKind() && current.GetValueType() == desc.GetValueType() {
+	if !descriptorChanged(current, desc) {
+		a.descriptors.set(project, name, current)
 		return nil
 	}
-	if current != nil {
+	// Descriptive fields (description, display name and unit) are updated, and new labels added, by creating the
+	// descriptor again, which does not require deleting it first.
+	if current != nil && needsRecreate(current, desc) {
 		log.WithContext(ctx).Infof("Deleting existing metric descriptor (%v) which is different from desired (%v)", current, desc)
+		a.descriptors.invalidate(project, name)
+		a.timestamps.invalidate(project, name)
 		err = a.c.DeleteMetricDescriptor(ctx, &monitoringpb.DeleteMetricDescriptorRequest{Name: current.Name})
 		if err != nil {
-			return fmt.Errorf("DeleteMetricDescriptor error: %s", err)
+			return classifyError(err, fmt.Errorf("DeleteMetricDescriptor error: %s", err))
 		}
+	} else if current != nil && missingLabels(current, desc) {
+		// Labels cannot be removed from an existing descriptor, so labels that are no longer used are kept.
+		desc = proto.Clone(desc).(*metricpb.MetricDescriptor)
+		desc.Labels = mergeLabels(current.GetLabels(), desc.GetLabels())
+		log.WithContext(ctx).Infof("Adding labels to metric descriptor %s: %v", desc.Name, desc.Labels)
 	}
 	log.WithContext(ctx).Infof("Creating a new metric descriptor: %v", desc.Name)
-	_, err = a.c.CreateMetricDescriptor(ctx, &monitoringpb.CreateMetricDescriptorRequest{
+	created, err := a.c.CreateMetricDescriptor(ctx, &monitoringpb.CreateMetricDescriptorRequest{
 		Name:             fmt.Sprintf("projects/%s", project),
 		MetricDescriptor: desc,
 	})
 	if err != nil {
-		return fmt.Errorf("CreateMetricDescriptor error: %s, descriptor: %v", err, desc)
+		return classifyError(err, fmt.Errorf("CreateMetricDescriptor error: %s, descriptor: %v", err, desc))
 	}
+	if created == nil {
+		created = desc
+	}
+	a.descriptors.set(project, name, created)
 	return nil
 }
 
+// descriptorChanged returns true if the current descriptor needs to be changed to match the desired one.
+func descriptorChanged(current, desired *metricpb.MetricDescriptor) bool {
+	return needsRecreate(current, desired) || missingLabels(current, desired) || metadataChanged(current, desired)
+}
+
+// needsRecreate returns true if the current descriptor needs to be deleted and recreated to match the desired one.
+// Metric kind and value type cannot be changed in-place, and deleting a descriptor deletes all of its points and
+// requires the metric to not be used for alerts. This is why the descriptor is only deleted and recreated if
+// absolutely necessary, i.e. when metric kind or value type is different. New labels are added in-place.
+func needsRecreate(current, desired *metricpb.MetricDescriptor) bool {
+	return current.GetMetricKind() != desired.GetMetricKind() || current.GetValueType() != desired.GetValueType()
+}
+
+// missingLabels returns true if the desired descriptor has labels that the current one does not declare.
+func missingLabels(current, desired *metricpb.MetricDescriptor) bool {
+	declared := make(map[string]bool)
+	for _, l := range current.GetLabels() {
+		declared[l.Key] = true
+	}
+	for _, l := range desired.GetLabels() {
+		if !declared[l.Key] {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeLabels returns current labels followed by desired labels that are not declared yet.
+func mergeLabels(current, desired []*label.LabelDescriptor) []*label.LabelDescriptor {
+	declared := make(map[string]bool)
+	merged := append([]*label.LabelDescriptor(nil), current...)
+	for _, l := range current {
+		declared[l.Key] = true
+	}
+	for _, l := range desired {
+		if !declared[l.Key] {
+			merged = append(merged, l)
+		}
+	}
+	return merged
+}
+
+// metadataChanged returns true if the description, display name or unit of the desired descriptor are different
+// from the current one.
+func metadataChanged(current, desired *metricpb.MetricDescriptor) bool {
+	return current.GetDescription() != desired.GetDescription() || current.GetDisplayName() != desired.GetDisplayName() ||
+		current.GetUnit() != desired.GetUnit()
+}
+
 // LatestTimestamp determines the timestamp of a latest point for a given metric in SD.
 // If metric does not exist, a timestamp which is `lookBackInterval` ago in the past is returned to backfill some data.
 func (a *Adapter) LatestTimestamp(ctx context.Context, project, name string) (time.Time, error) {
+	ctx = withRequestID(ctx)
 	logger := log.WithContext(ctx)
 	latest := time.Now().Add(-a.lookBackInterval)
 
-	desc, err := a.getDescriptor(ctx, project, name)
+	desc, err := a.cachedDescriptor(ctx, project, name)
 	if err != nil {
 		return latest, err
 	}
@@ -144,28 +272,178 @@ func (a *Adapter) LatestTimestamp(ctx context.Context, project, name string) (ti
 		logger.Debugf("No metric descriptor found for %s", name)
 		return latest, nil
 	}
+	if a.timestamps != nil {
+		return a.cachedLatestTimestamp(ctx, project, name, desc, latest)
+	}
+
+	series, err := a.listTimeSeries(ctx, project, fmt.Sprintf(`metric.type = "%s"`, name))
+	if err != nil {
+		return latest, classifyError(err, fmt.Errorf("ListTimeSeries error: %s, name: %v", err, name))
+	}
+	return latestPoint(ctx, name, desc, series, latest)
+}
+
+// LatestTimestamps determines timestamps of latest points for several metrics in SD, querying time series of up to
+// `latestTimestampBatchSize` metrics at once, with up to `latestTimestampParallelism` queries running in parallel.
+// It returns the same timestamps as LatestTimestamp would; metrics for which LatestTimestamp would return an error
+// are left out of the result.
+func (a *Adapter) LatestTimestamps(ctx context.Context, project string, names []string) (map[string]time.Time, error) {
+	ctx = withRequestID(ctx)
+	var mu sync.Mutex
+	result := make(map[string]time.Time)
+	if a.timestamps != nil {
+		// Cached lookups already share queries between sibling metrics.
+		for _, name := range names {
+			if ts, err := a.LatestTimestamp(ctx, project, name); err == nil {
+				result[name] = ts
+			}
+		}
+		return result, nil
+	}
+	sem := make(chan struct{}, latestTimestampParallelism)
+	g, gctx := errgroup.WithContext(ctx)
+	for start := 0; start < len(names); start += latestTimestampBatchSize {
+		end := start + latestTimestampBatchSize
+		if end > len(names) {
+			end = len(names)
+		}
+		batch := names[start:end]
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			latest, err := a.latestTimestampBatch(gctx, project, batch)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for name, ts := range latest {
+				result[name] = ts
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// latestTimestampBatch determines timestamps of latest points for a batch of metrics using a single query.
+func (a *Adapter) latestTimestampBatch(ctx context.Context, project string, names []string) (map[string]time.Time, error) {
+	latest := time.Now().Add(-a.lookBackInterval)
+	result := make(map[string]time.Time)
+	descs := make(map[string]*metricpb.MetricDescriptor)
+	var quoted []string
+	for _, name := range names {
+		desc, err := a.cachedDescriptor(ctx, project, name)
+		if err != nil {
+			return nil, err
+		}
+		if desc == nil {
+			result[name] = latest
+			continue
+		}
+		descs[name] = desc
+		quoted = append(quoted, strconv.Quote(name))
+	}
+	if len(descs) == 0 {
+		return result, nil
+	}
+
+	filter := fmt.Sprintf(`metric.type = one_of(%s)`, strings.Join(quoted, ", "))
+	all, err := a.listTimeSeries(ctx, project, filter)
+	if err != nil {
+		return nil, classifyError(err, fmt.Errorf("ListTimeSeries error: %s, filter: %v", err, filter))
+	}
+	series := make(map[string][]*monitoringpb.TimeSeries)
+	for _, ts := range all {
+		series[ts.GetMetric().GetType()] = append(series[ts.GetMetric().GetType()], ts)
+	}
+	for name, desc := range descs {
+		ts, err := latestPoint(ctx, name, desc, series[name], latest)
+		if err != nil {
+			continue
+		}
+		result[name] = ts
+	}
+	return result, nil
+}
 
-	series, err := a.listTimeSeries(ctx, project, name)
+// cachedLatestTimestamp determines the timestamp of a latest point for a given metric using the timestamp cache.
+// Time series of all metrics sharing the prefix of the metric are queried at once when the cache has no entry for it.
+func (a *Adapter) cachedLatestTimestamp(ctx context.Context, project, name string, desc *metricpb.MetricDescriptor, latest time.Time) (time.Time, error) {
+	loadPrefix := func(prefix string) (map[string]latestSeries, error) {
+		filter := fmt.Sprintf(`metric.type = starts_with(%s)`, strconv.Quote(prefix))
+		series, err := a.listTimeSeries(ctx, project, filter)
+		if err != nil {
+			return nil, classifyError(err, fmt.Errorf("ListTimeSeries error: %s, filter: %v", err, filter))
+		}
+		log.WithContext(ctx).Debugf("Cached %d time series of metrics with prefix %s", len(series), prefix)
+		return summarizeSeries(series), nil
+	}
+	loadMetric := func() (latestSeries, error) {
+		series, err := a.listTimeSeries(ctx, project, fmt.Sprintf(`metric.type = "%s"`, name))
+		if err != nil {
+			return latestSeries{}, classifyError(err, fmt.Errorf("ListTimeSeries error: %s, name: %v", err, name))
+		}
+		return summarizeSeries(series)[name], nil
+	}
+	l, err := a.timestamps.get(project, name, a.lookBackInterval, loadPrefix, loadMetric)
 	if err != nil {
 		return latest, err
 	}
+	// Metrics with labels have a time series per combination of label values; otherwise there should only be one.
+	if l.series > 1 && len(desc.GetLabels()) == 0 {
+		return latest, fmt.Errorf("Found %d time series with the same name: %v", l.series, name)
+	}
+	if l.latest.After(latest) {
+		latest = l.latest
+	}
+	log.WithContext(ctx).Debugf("Latest point found for %s is %v", name, latest)
+	return latest, nil
+}
+
+// summarizeSeries returns the number of time series of each metric type, and the end time of their newest point.
+func summarizeSeries(series []*monitoringpb.TimeSeries) map[string]latestSeries {
+	result := make(map[string]latestSeries)
+	for _, ts := range series {
+		l := result[ts.GetMetric().GetType()]
+		l.series++
+		for _, point := range ts.Points {
+			if t, err := ptypes.Timestamp(point.GetInterval().GetEndTime()); err == nil && t.After(l.latest) {
+				l.latest = t
+			}
+		}
+		result[ts.GetMetric().GetType()] = l
+	}
+	return result
+}
 
+// latestPoint returns the timestamp of the latest point across time series of a metric, or `latest` if there are no
+// points after it.
+func latestPoint(ctx context.Context, name string, desc *metricpb.MetricDescriptor, series []*monitoringpb.TimeSeries, latest time.Time) (time.Time, error) {
+	logger := log.WithContext(ctx)
 	if len(series) == 0 {
 		logger.Debugf("No timeseries found for %s", name)
 		return latest, nil
 	}
-	if len(series) > 1 {
+	// Metrics with labels have a time series per combination of label values; otherwise there should only be one.
+	if len(series) > 1 && len(desc.GetLabels()) == 0 {
 		logger.WithContext(ctx).Debugf("Several timeseries found for %s: %v", name, series)
 		return latest, fmt.Errorf("Found several time series with the same name: %v", series)
 	}
 
-	for _, point := range series[0].Points {
-		ts, err := ptypes.Timestamp(point.Interval.EndTime)
-		if err != nil {
-			return latest, nil
-		}
-		if ts.After(latest) {
-			latest = ts
+	// Points are written to all time series of a metric at once, so the latest point across all of them is used.
+	for _, ts := range series {
+		for _, point := range ts.Points {
+			ts, err := ptypes.Timestamp(point.Interval.EndTime)
+			if err != nil {
+				return latest, nil
+			}
+			if ts.After(latest) {
+				latest = ts
+			}
 		}
 	}
 
@@ -173,21 +451,172 @@ func (a *Adapter) LatestTimestamp(ctx context.Context, project, name string) (ti
 	return latest, nil
 }
 
+// SumOverWindow returns the sum of all points of a metric written during the last `window`, across all of its time
+// series. For cumulative metrics, the increase over the window is returned.
+func (a *Adapter) SumOverWindow(ctx context.Context, project, name string, window time.Duration) (float64, error) {
+	ctx = withRequestID(ctx)
+	desc, err := a.cachedDescriptor(ctx, project, name)
+	if err != nil {
+		return 0, err
+	}
+	if desc == nil {
+		return 0, fmt.Errorf("metric descriptor for %s not found", name)
+	}
+	aligner := monitoringpb.Aggregation_ALIGN_SUM
+	if desc.GetMetricKind() == metricpb.MetricDescriptor_CUMULATIVE {
+		aligner = monitoringpb.Aggregation_ALIGN_DELTA
+	}
+
+	now := time.Now()
+	endTs, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return 0, err
+	}
+	startTs, err := ptypes.TimestampProto(now.Add(-window))
+	if err != nil {
+		return 0, err
+	}
+	series, err := a.c.ListTimeSeries(ctx, &monitoringpb.ListTimeSeriesRequest{
+		Name:     fmt.Sprintf("projects/%s", project),
+		Filter:   fmt.Sprintf(`metric.type = "%s"`, name),
+		Interval: &monitoringpb.TimeInterval{StartTime: startTs, EndTime: endTs},
+		Aggregation: &monitoringpb.Aggregation{
+			AlignmentPeriod:    ptypes.DurationProto(window),
+			PerSeriesAligner:   aligner,
+			CrossSeriesReducer: monitoringpb.Aggregation_REDUCE_SUM,
+		},
+	})
+	if err != nil {
+		return 0, classifyError(err, fmt.Errorf("ListTimeSeries error: %s, name: %v", err, name))
+	}
+
+	var sum float64
+	for _, ts := range series {
+		for _, p := range ts.Points {
+			switch v := p.GetValue().GetValue().(type) {
+			case *monitoringpb.TypedValue_Int64Value:
+				sum += float64(v.Int64Value)
+			case *monitoringpb.TypedValue_DoubleValue:
+				sum += v.DoubleValue
+			}
+		}
+	}
+	return sum, nil
+}
+
+// PartialWriteError is returned by CreateTimeseries when some time series have been written before a failure.
+type PartialWriteError struct {
+	// Written is the number of time series at the start of the slice passed to CreateTimeseries that were written.
+	Written int
+	Err     error
+}
+
+func (e *PartialWriteError) Error() string {
+	return fmt.Sprintf("%v (%d time series written before the failure)", e.Err, e.Written)
+}
+
+func (e *PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// WrittenSeries returns the number of time series written before the failure.
+func (e *PartialWriteError) WrittenSeries() int {
+	return e.Written
+}
+
+// ReadPoints returns time series of a metric with points that have end times between `start` and `end`, as they
+// are stored in Stackdriver. It's used to verify that written points have been stored.
+func (a *Adapter) ReadPoints(ctx context.Context, project, name string, start, end time.Time) ([]*monitoringpb.TimeSeries, error) {
+	ctx = withRequestID(ctx)
+	startTs, err := ptypes.TimestampProto(start)
+	if err != nil {
+		return nil, err
+	}
+	endTs, err := ptypes.TimestampProto(end)
+	if err != nil {
+		return nil, err
+	}
+	series, err := a.c.ListTimeSeries(ctx, &monitoringpb.ListTimeSeriesRequest{
+		Name:     fmt.Sprintf("projects/%s", project),
+		Filter:   fmt.Sprintf(`metric.type = "%s"`, name),
+		Interval: &monitoringpb.TimeInterval{StartTime: startTs, EndTime: endTs},
+	})
+	if err != nil {
+		return nil, classifyError(err, fmt.Errorf("ListTimeSeries error: %s, name: %v", err, name))
+	}
+	return series, nil
+}
+
 // CreateTimeseries writes time series data (new data points) for a given metric into Stackdriver.
-// It also creates a metric descriptor if it does not exist.
+// It also creates a metric descriptor if it does not exist. Time series are written in order; if writing fails after
+// some of them have been written, a *PartialWriteError is returned.
 func (a *Adapter) CreateTimeseries(ctx context.Context, project, name string, desc *metricpb.MetricDescriptor, series []*monitoringpb.TimeSeries) error {
+	ctx = withRequestID(ctx)
 	if err := a.setDescriptor(ctx, project, name, desc); err != nil {
 		return err
 	}
 
-	for _, ts := range series {
-		err := a.c.CreateTimeSeries(ctx, &monitoringpb.CreateTimeSeriesRequest{
+	for i, ts := range series {
+		req := &monitoringpb.CreateTimeSeriesRequest{
 			Name:       fmt.Sprintf("projects/%s", project),
 			TimeSeries: []*monitoringpb.TimeSeries{ts},
+		}
+		err := tserrors.Retry(ctx, writeAttempts, writeRetryBackoff, func() error {
+			err := a.c.CreateTimeSeries(ctx, req)
+			if err != nil {
+				err = classifyError(err, fmt.Errorf("CreateTimeSeries error: %s, timeseries: %v", err, ts))
+			}
+			if a.observer != nil {
+				a.observer(ctx, project, len(ts.Points), proto.Size(req), err)
+			}
+			return err
 		})
 		if err != nil {
-			return fmt.Errorf("CreateTimeSeries error: %s, timeseries: %v", err, ts)
+			// The descriptor might have been changed outside of ts-bridge, so it's checked again next time.
+			a.descriptors.invalidate(project, name)
+			a.timestamps.invalidate(project, name)
+			if i > 0 {
+				return &PartialWriteError{Written: i, Err: err}
+			}
+			return err
 		}
 	}
+	a.timestamps.written(project, name, newestEndTime(series))
 	return nil
 }
+
+// newestEndTime returns the end time of the newest point of time series, or zero if there are none.
+func newestEndTime(series []*monitoringpb.TimeSeries) time.Time {
+	var newest time.Time
+	for _, ts := range series {
+		for _, point := range ts.Points {
+			if t, err := ptypes.Timestamp(point.GetInterval().GetEndTime()); err == nil && t.After(newest) {
+				newest = t
+			}
+		}
+	}
+	return newest
+}
+
+// withRequestID returns a context that sends the request ID carried by `ctx` (if any) as gRPC metadata of API calls.
+func withRequestID(ctx context.Context) context.Context {
+	if id := requestid.FromContext(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, strings.ToLower(requestid.Header), id)
+	}
+	return ctx
+}
+
+// classifyError attaches an error class to `wrapped` based on the gRPC status code of `err`, an error returned by
+// the Stackdriver API.
+func classifyError(err, wrapped error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return tserrors.Wrap(tserrors.ErrDestinationTransient, wrapped)
+	}
+	switch status.Code(err) {
+	case codes.ResourceExhausted:
+		return tserrors.Wrap(tserrors.ErrDestinationQuota, wrapped)
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted, codes.Internal:
+		return tserrors.Wrap(tserrors.ErrDestinationTransient, wrapped)
+	}
+	return tserrors.Wrap(tserrors.ErrDestinationPermanent, wrapped)
+}
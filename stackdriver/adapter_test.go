@@ -16,6 +16,7 @@ package stackdriver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"os"
@@ -27,6 +28,8 @@ import (
 	"github.com/golang/protobuf/proto"
 	"github.com/google/ts-bridge/datastore"
 	"github.com/google/ts-bridge/mocks"
+	"github.com/google/ts-bridge/tserrors"
+	"google.golang.org/genproto/googleapis/api/label"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 	"google.golang.org/grpc/codes"
@@ -78,7 +81,7 @@ func TestGetDescriptor(t *testing.T) {
 			defer mockCtrl.Finish()
 			mock := mocks.NewMockMetricClient(mockCtrl)
 			mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).Return(tt.desc, tt.err)
-			a := &Adapter{mock, time.Hour}
+			a := &Adapter{mock, time.Hour, nil, nil, nil}
 
 			got, err := a.getDescriptor(ctx, "foo", "bar")
 			if !proto.Equal(got, tt.want) {
@@ -109,8 +112,11 @@ func TestSetDescriptor(t *testing.T) {
 			&metricpb.MetricDescriptor{ValueType: metricpb.MetricDescriptor_INT64, Type: "bar", Name: "projects/foo/metricDescriptors/bar", Description: "another metric"},
 			nil, 1, nil, 1, nil, ""},
 		{"similar descriptor exists",
-			&metricpb.MetricDescriptor{ValueType: metricpb.MetricDescriptor_DOUBLE, Type: "bar2", Name: "projects/foo/metricDescriptors/bar", Description: "my metric old"},
+			&metricpb.MetricDescriptor{ValueType: metricpb.MetricDescriptor_DOUBLE, Type: "bar2", Name: "projects/foo/metricDescriptors/bar", Description: "my metric"},
 			nil, 0, nil, 0, nil, ""},
+		{"descriptor with old description exists",
+			&metricpb.MetricDescriptor{ValueType: metricpb.MetricDescriptor_DOUBLE, Type: "bar2", Name: "projects/foo/metricDescriptors/bar", Description: "my metric old"},
+			nil, 0, nil, 1, nil, ""},
 		{"error getting descriptor",
 			&metricpb.MetricDescriptor{}, fmt.Errorf("error1"), 0, nil, 0, nil, "error1"},
 		{"error deleting descriptor", &metricpb.MetricDescriptor{}, nil, 1, fmt.Errorf("error2"), 0, nil, "error2"},
@@ -124,7 +130,7 @@ func TestSetDescriptor(t *testing.T) {
 			mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).Return(tt.desc, tt.descErr)
 			mock.EXPECT().DeleteMetricDescriptor(gomock.Any(), gomock.Any()).Times(tt.deleteCalls).Return(tt.deleteError)
 			mock.EXPECT().CreateMetricDescriptor(gomock.Any(), gomock.Any()).Times(tt.createCalls).Return(&metricpb.MetricDescriptor{}, tt.createError)
-			a := &Adapter{mock, time.Hour}
+			a := &Adapter{mock, time.Hour, nil, nil, nil}
 
 			err := a.setDescriptor(ctx, "foo", "bar", &metricpb.MetricDescriptor{ValueType: metricpb.MetricDescriptor_DOUBLE, Type: "bar", Description: "my metric"})
 			if tt.wantError == "" && err != nil {
@@ -152,7 +158,7 @@ func TestLatestTimestampSimple(t *testing.T) {
 		latest.Unix(), latest.Add(-2*time.Minute).Unix(),
 		latest.Add(-10*time.Minute).Unix(), latest.Add(-12*time.Minute).Unix())
 	mock.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(unmarshalTimeSeries([]string{points}), nil)
-	a := &Adapter{mock, time.Hour}
+	a := &Adapter{mock, time.Hour, nil, nil, nil}
 
 	got, err := a.LatestTimestamp(ctx, "foo", "bar")
 	if err != nil {
@@ -162,6 +168,153 @@ func TestLatestTimestampSimple(t *testing.T) {
 		t.Errorf("LatestTimestamp() expected %v; got %v", latest, got)
 	}
 }
+func TestLatestTimestampLabels(t *testing.T) {
+	ctx := context.Background()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockMetricClient(mockCtrl)
+	mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).Return(&metricpb.MetricDescriptor{
+		Name:   "projects/foo/metricDescriptors/bar",
+		Labels: []*label.LabelDescriptor{{Key: "host"}},
+	}, nil)
+
+	// A point is written to each time series at the same time, but the latest point of one of them might be missing.
+	latest := time.Now().Add(-13 * time.Minute).Truncate(time.Second)
+	mock.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(unmarshalTimeSeries([]string{
+		fmt.Sprintf(`metric: <type: "bar" labels <key: "host" value: "one">> points <interval: <end_time: <seconds: %d>>>`, latest.Add(-time.Minute).Unix()),
+		fmt.Sprintf(`metric: <type: "bar" labels <key: "host" value: "two">> points <interval: <end_time: <seconds: %d>>>`, latest.Unix()),
+	}), nil)
+	a := &Adapter{mock, time.Hour, nil, nil, nil}
+
+	got, err := a.LatestTimestamp(ctx, "foo", "bar")
+	if err != nil {
+		t.Errorf("LatestTimestamp() unexpected error: %v", err)
+	}
+	if !got.Equal(latest) {
+		t.Errorf("LatestTimestamp() expected %v; got %v", latest, got)
+	}
+}
+
+func TestSetDescriptorLabels(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name        string
+		current     []*label.LabelDescriptor
+		desired     []*label.LabelDescriptor
+		createCalls int
+		wantLabels  []*label.LabelDescriptor
+	}{
+		{"same labels", []*label.LabelDescriptor{{Key: "host"}}, []*label.LabelDescriptor{{Key: "host"}}, 0, nil},
+		{"label no longer used", []*label.LabelDescriptor{{Key: "host"}, {Key: "env"}}, []*label.LabelDescriptor{{Key: "host"}}, 0, nil},
+		{"new label", []*label.LabelDescriptor{{Key: "host"}, {Key: "zone"}}, []*label.LabelDescriptor{{Key: "host"}, {Key: "env"}}, 1,
+			[]*label.LabelDescriptor{{Key: "host"}, {Key: "zone"}, {Key: "env"}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			mock := mocks.NewMockMetricClient(mockCtrl)
+			mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).Return(&metricpb.MetricDescriptor{
+				Name: "projects/foo/metricDescriptors/bar", ValueType: metricpb.MetricDescriptor_DOUBLE, Labels: tt.current}, nil)
+			// New labels are added to the existing descriptor, which keeps its points.
+			mock.EXPECT().DeleteMetricDescriptor(gomock.Any(), gomock.Any()).Times(0)
+			mock.EXPECT().CreateMetricDescriptor(gomock.Any(), gomock.Any()).Times(tt.createCalls).DoAndReturn(
+				func(_ context.Context, req *monitoringpb.CreateMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+					if got := req.MetricDescriptor.Labels; !proto.Equal(&metricpb.MetricDescriptor{Labels: got}, &metricpb.MetricDescriptor{Labels: tt.wantLabels}) {
+						t.Errorf("expected labels %v to be created; got %v", tt.wantLabels, got)
+					}
+					return req.MetricDescriptor, nil
+				})
+			a := &Adapter{mock, time.Hour, nil, nil, nil}
+
+			err := a.setDescriptor(ctx, "foo", "bar", &metricpb.MetricDescriptor{ValueType: metricpb.MetricDescriptor_DOUBLE, Type: "bar", Labels: tt.desired})
+			if err != nil {
+				t.Errorf("setDescriptor() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestSetDescriptorMetadata(t *testing.T) {
+	ctx := context.Background()
+	current := &metricpb.MetricDescriptor{Name: "projects/foo/metricDescriptors/bar", ValueType: metricpb.MetricDescriptor_DOUBLE,
+		Description: "old description", DisplayName: "bar", Unit: "s"}
+
+	for _, tt := range []struct {
+		name        string
+		desired     *metricpb.MetricDescriptor
+		createCalls int
+	}{
+		{"same metadata", &metricpb.MetricDescriptor{Description: "old description", DisplayName: "bar", Unit: "s"}, 0},
+		{"new description", &metricpb.MetricDescriptor{Description: "new description", DisplayName: "bar", Unit: "s"}, 1},
+		{"new display name", &metricpb.MetricDescriptor{Description: "old description", DisplayName: "Bar", Unit: "s"}, 1},
+		{"new unit", &metricpb.MetricDescriptor{Description: "old description", DisplayName: "bar", Unit: "ms"}, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			mock := mocks.NewMockMetricClient(mockCtrl)
+			mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).Return(current, nil)
+			// Changed metadata does not require the descriptor to be deleted.
+			mock.EXPECT().DeleteMetricDescriptor(gomock.Any(), gomock.Any()).Times(0)
+			mock.EXPECT().CreateMetricDescriptor(gomock.Any(), gomock.Any()).Times(tt.createCalls).Return(&metricpb.MetricDescriptor{}, nil)
+			a := &Adapter{mock, time.Hour, nil, nil, nil}
+
+			tt.desired.Type = "bar"
+			tt.desired.ValueType = metricpb.MetricDescriptor_DOUBLE
+			if err := a.setDescriptor(ctx, "foo", "bar", tt.desired); err != nil {
+				t.Errorf("setDescriptor() unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestSumOverWindow(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name        string
+		kind        metricpb.MetricDescriptor_MetricKind
+		wantAligner monitoringpb.Aggregation_Aligner
+	}{
+		{"gauge", metricpb.MetricDescriptor_GAUGE, monitoringpb.Aggregation_ALIGN_SUM},
+		{"cumulative", metricpb.MetricDescriptor_CUMULATIVE, monitoringpb.Aggregation_ALIGN_DELTA},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			mock := mocks.NewMockMetricClient(mockCtrl)
+			mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).Return(&metricpb.MetricDescriptor{MetricKind: tt.kind}, nil)
+			mock.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).DoAndReturn(
+				func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+					if got := req.Aggregation.PerSeriesAligner; got != tt.wantAligner {
+						t.Errorf("expected aligner %v; got %v", tt.wantAligner, got)
+					}
+					if got := req.Aggregation.AlignmentPeriod.Seconds; got != 3600 {
+						t.Errorf("expected alignment period of 3600s; got %ds", got)
+					}
+					return unmarshalTimeSeries([]string{
+						"points <value: <double_value: 1.5>> points <value: <double_value: 2>>",
+						"points <value: <int64_value: 3>>",
+					}), nil
+				})
+
+			a := &Adapter{mock, time.Hour, nil, nil, nil}
+			got, err := a.SumOverWindow(ctx, "foo", "bar", time.Hour)
+			if err != nil {
+				t.Fatalf("SumOverWindow() unexpected error: %v", err)
+			}
+			if got != 6.5 {
+				t.Errorf("expected SumOverWindow() to return 6.5; got %v", got)
+			}
+		})
+	}
+}
+
 func TestLatestTimestampBasedOnLookbackInterval(t *testing.T) {
 	ctx := context.Background()
 
@@ -186,7 +339,7 @@ func TestLatestTimestampBasedOnLookbackInterval(t *testing.T) {
 			mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).Return(tt.getDescResponse, nil)
 			mock.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).AnyTimes().Return(unmarshalTimeSeries(tt.listTSResponse), nil)
 
-			a := &Adapter{mock, 30 * time.Minute}
+			a := &Adapter{mock, 30 * time.Minute, nil, nil, nil}
 			got, err := a.LatestTimestamp(ctx, "foo", "bar")
 			if err != nil {
 				t.Errorf("LatestTimestamp() unexpected error: %v", err)
@@ -227,7 +380,7 @@ func TestLatestTimestampErrors(t *testing.T) {
 				&metricpb.MetricDescriptor{Name: "projects/foo/metricDescriptors/bar"}, tt.getDescError)
 			mock.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).AnyTimes().Return(unmarshalTimeSeries(tt.listTSResponse), tt.listTSError)
 
-			a := &Adapter{mock, 30 * time.Minute}
+			a := &Adapter{mock, 30 * time.Minute, nil, nil, nil}
 			_, err := a.LatestTimestamp(ctx, "foo", "bar")
 			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
 				t.Errorf("LatestTimestamp() expected error to contain '%s'; got %v", tt.wantErr, err)
@@ -258,7 +411,7 @@ func TestCreateTimeseriesErrors(t *testing.T) {
 			mock.EXPECT().CreateMetricDescriptor(gomock.Any(), gomock.Any()).AnyTimes().Return(nil, tt.createDescError)
 			mock.EXPECT().CreateTimeSeries(gomock.Any(), gomock.Any()).AnyTimes().Return(tt.createTSError)
 
-			a := &Adapter{mock, time.Hour}
+			a := &Adapter{mock, time.Hour, nil, nil, nil}
 			err := a.CreateTimeseries(ctx, "foo", "bar", &metricpb.MetricDescriptor{ValueType: metricpb.MetricDescriptor_DOUBLE}, []*monitoringpb.TimeSeries{&monitoringpb.TimeSeries{}})
 			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
 				t.Errorf("LatestTimestamp() expected error to contain '%s'; got %v", tt.wantErr, err)
@@ -266,3 +419,343 @@ func TestCreateTimeseriesErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateTimeseriesErrorClasses(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name      string
+		errs      []error // errors returned by consecutive CreateTimeSeries calls.
+		wantClass error
+	}{
+		{"success after a transient error", []error{status.Error(codes.Unavailable, "try again"), nil}, nil},
+		{"transient error", []error{
+			status.Error(codes.Unavailable, "try again"),
+			status.Error(codes.Unavailable, "try again"),
+			status.Error(codes.Unavailable, "try again"),
+		}, tserrors.ErrDestinationTransient},
+		{"quota exceeded", []error{status.Error(codes.ResourceExhausted, "slow down")}, tserrors.ErrDestinationQuota},
+		{"permission denied", []error{status.Error(codes.PermissionDenied, "go away")}, tserrors.ErrDestinationPermanent},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mock := mocks.NewMockMetricClient(mockCtrl)
+			mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).Return(
+				&metricpb.MetricDescriptor{Name: "projects/foo/metricDescriptors/bar", ValueType: metricpb.MetricDescriptor_DOUBLE}, nil)
+			var calls []*gomock.Call
+			for _, err := range tt.errs {
+				calls = append(calls, mock.EXPECT().CreateTimeSeries(gomock.Any(), gomock.Any()).Return(err))
+			}
+			gomock.InOrder(calls...)
+
+			a := &Adapter{mock, time.Hour, nil, nil, nil}
+			err := a.CreateTimeseries(ctx, "foo", "bar", &metricpb.MetricDescriptor{ValueType: metricpb.MetricDescriptor_DOUBLE}, []*monitoringpb.TimeSeries{&monitoringpb.TimeSeries{}})
+			if tt.wantClass == nil {
+				if err != nil {
+					t.Errorf("CreateTimeseries() returned error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantClass) {
+				t.Errorf("CreateTimeseries() expected error of class '%v'; got %v", tt.wantClass, err)
+			}
+		})
+	}
+}
+
+func TestDescriptorCache(t *testing.T) {
+	ctx := context.Background()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockMetricClient(mockCtrl)
+	current := &metricpb.MetricDescriptor{
+		Name:        "projects/foo/metricDescriptors/bar",
+		Type:        "bar",
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: "old",
+	}
+	a := &Adapter{mock, time.Hour, NewDescriptorCache(time.Hour), nil, nil}
+
+	// The descriptor is only fetched once across several updates of the same metric.
+	mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).Return(current, nil).Times(1)
+	mock.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(nil, nil).Times(2)
+	mock.EXPECT().CreateTimeSeries(gomock.Any(), gomock.Any()).Return(nil).Times(2)
+	for i := 0; i < 2; i++ {
+		if _, err := a.LatestTimestamp(ctx, "foo", "bar"); err != nil {
+			t.Fatalf("LatestTimestamp() unexpected error: %v", err)
+		}
+		desc := proto.Clone(current).(*metricpb.MetricDescriptor)
+		if err := a.CreateTimeseries(ctx, "foo", "bar", desc, unmarshalTimeSeries([]string{`points <>`})); err != nil {
+			t.Fatalf("CreateTimeseries() unexpected error: %v", err)
+		}
+	}
+
+	// A changed descriptor is fetched again before being updated, and the updated descriptor is cached.
+	updated := proto.Clone(current).(*metricpb.MetricDescriptor)
+	updated.Description = "new"
+	mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).Return(current, nil).Times(1)
+	mock.EXPECT().CreateMetricDescriptor(gomock.Any(), gomock.Any()).Return(updated, nil).Times(1)
+	for i := 0; i < 2; i++ {
+		desc := proto.Clone(updated).(*metricpb.MetricDescriptor)
+		if err := a.setDescriptor(ctx, "foo", "bar", desc); err != nil {
+			t.Fatalf("setDescriptor() unexpected error: %v", err)
+		}
+	}
+
+	// Write errors invalidate the cache.
+	mock.EXPECT().CreateTimeSeries(gomock.Any(), gomock.Any()).Return(status.Error(codes.NotFound, "no descriptor"))
+	if err := a.CreateTimeseries(ctx, "foo", "bar", updated, unmarshalTimeSeries([]string{`points <>`})); err == nil {
+		t.Errorf("CreateTimeseries() expected error")
+	}
+	if got := a.descriptors.get("foo", "bar"); got != nil {
+		t.Errorf("expected descriptor cache to be invalidated after a write error; got %v", got)
+	}
+}
+
+func TestDescriptorCacheExpiry(t *testing.T) {
+	c := NewDescriptorCache(time.Millisecond)
+	c.set("foo", "bar", &metricpb.MetricDescriptor{Type: "bar"})
+	if c.get("foo", "bar") == nil {
+		t.Errorf("expected descriptor to be cached")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if got := c.get("foo", "bar"); got != nil {
+		t.Errorf("expected cached descriptor to expire; got %v", got)
+	}
+
+	var disabled *DescriptorCache
+	disabled.set("foo", "bar", &metricpb.MetricDescriptor{Type: "bar"})
+	if got := disabled.get("foo", "bar"); got != nil {
+		t.Errorf("expected a nil cache to cache nothing; got %v", got)
+	}
+}
+
+func TestTimestampCache(t *testing.T) {
+	ctx := context.Background()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockMetricClient(mockCtrl)
+	mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *monitoringpb.GetMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+			return &metricpb.MetricDescriptor{
+				Name:       req.Name,
+				Type:       strings.TrimPrefix(req.Name, "projects/foo/metricDescriptors/"),
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			}, nil
+		}).AnyTimes()
+	a := &Adapter{mock, time.Hour, nil, nil, NewTimestampCache(time.Hour)}
+
+	latest := time.Now().Add(-13 * time.Minute).Truncate(time.Second)
+	series := func(name string, ts time.Time) string {
+		return fmt.Sprintf(`metric: <type: "%s"> points <interval: <end_time: <seconds: %d>>>`, name, ts.Unix())
+	}
+	// Sibling metrics are looked up with a single query.
+	mock.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+			if want := `metric.type = starts_with("custom.googleapis.com/src/")`; req.Filter != want {
+				t.Errorf("expected filter %s; got %s", want, req.Filter)
+			}
+			return unmarshalTimeSeries([]string{
+				series("custom.googleapis.com/src/one", latest),
+				series("custom.googleapis.com/src/two", latest.Add(-time.Minute)),
+			}), nil
+		})
+	for name, want := range map[string]time.Time{"one": latest, "two": latest.Add(-time.Minute)} {
+		got, err := a.LatestTimestamp(ctx, "foo", "custom.googleapis.com/src/"+name)
+		if err != nil {
+			t.Fatalf("LatestTimestamp() unexpected error: %v", err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("LatestTimestamp() expected %v for metric %s; got %v", want, name, got)
+		}
+	}
+	got, err := a.LatestTimestamp(ctx, "foo", "custom.googleapis.com/src/new")
+	if err != nil {
+		t.Fatalf("LatestTimestamp() unexpected error: %v", err)
+	}
+	if time.Since(got) < time.Hour || time.Since(got) > time.Hour+time.Minute {
+		t.Errorf("LatestTimestamp() expected lookback interval for a metric without time series; got %v", got)
+	}
+
+	// Written points advance cached timestamps.
+	desc := &metricpb.MetricDescriptor{Type: "custom.googleapis.com/src/one", MetricKind: metricpb.MetricDescriptor_GAUGE, ValueType: metricpb.MetricDescriptor_DOUBLE}
+	mock.EXPECT().CreateTimeSeries(gomock.Any(), gomock.Any()).Return(nil)
+	if err := a.CreateTimeseries(ctx, "foo", desc.Type, desc, unmarshalTimeSeries([]string{series(desc.Type, latest.Add(time.Minute))})); err != nil {
+		t.Fatalf("CreateTimeseries() unexpected error: %v", err)
+	}
+	if got, err := a.LatestTimestamp(ctx, "foo", desc.Type); err != nil || !got.Equal(latest.Add(time.Minute)) {
+		t.Errorf("LatestTimestamp() expected %v after writing a point; got %v, %v", latest.Add(time.Minute), got, err)
+	}
+
+	// A failed write makes the metric be looked up on its own.
+	mock.EXPECT().CreateTimeSeries(gomock.Any(), gomock.Any()).Return(status.Error(codes.InvalidArgument, "bad point"))
+	if err := a.CreateTimeseries(ctx, "foo", desc.Type, desc, unmarshalTimeSeries([]string{series(desc.Type, latest.Add(2*time.Minute))})); err == nil {
+		t.Errorf("CreateTimeseries() expected error")
+	}
+	mock.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+			if want := `metric.type = "custom.googleapis.com/src/one"`; req.Filter != want {
+				t.Errorf("expected filter %s; got %s", want, req.Filter)
+			}
+			return unmarshalTimeSeries([]string{series(desc.Type, latest.Add(time.Minute))}), nil
+		})
+	for i := 0; i < 2; i++ {
+		if got, err := a.LatestTimestamp(ctx, "foo", desc.Type); err != nil || !got.Equal(latest.Add(time.Minute)) {
+			t.Errorf("LatestTimestamp() expected %v after a failed write; got %v, %v", latest.Add(time.Minute), got, err)
+		}
+	}
+
+	// Entries are kept per look-back window.
+	mock.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(nil, nil)
+	a.lookBackInterval = 30 * time.Minute
+	if got, err := a.LatestTimestamp(ctx, "foo", "custom.googleapis.com/src/two"); err != nil || time.Since(got) < 30*time.Minute {
+		t.Errorf("LatestTimestamp() expected the look-back window to be queried again; got %v, %v", got, err)
+	}
+}
+
+func TestLatestTimestamps(t *testing.T) {
+	ctx := context.Background()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockMetricClient(mockCtrl)
+	mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *monitoringpb.GetMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+			if strings.HasSuffix(req.Name, "/new") {
+				return nil, status.Error(codes.NotFound, "Not found")
+			}
+			return &metricpb.MetricDescriptor{Name: req.Name}, nil
+		}).Times(3)
+
+	latest := time.Now().Add(-13 * time.Minute).Truncate(time.Second)
+	mock.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+			if want := `metric.type = one_of("one", "several")`; req.Filter != want {
+				t.Errorf("expected filter %s; got %s", want, req.Filter)
+			}
+			return unmarshalTimeSeries([]string{
+				fmt.Sprintf(`metric: <type: "one"> points <interval: <end_time: <seconds: %d>>>`, latest.Unix()),
+				fmt.Sprintf(`metric: <type: "several"> points <interval: <end_time: <seconds: %d>>>`, latest.Unix()),
+				fmt.Sprintf(`metric: <type: "several"> points <interval: <end_time: <seconds: %d>>>`, latest.Unix()),
+			}), nil
+		})
+	a := &Adapter{mock, time.Hour, nil, nil, nil}
+
+	got, err := a.LatestTimestamps(ctx, "foo", []string{"one", "new", "several"})
+	if err != nil {
+		t.Fatalf("LatestTimestamps() unexpected error: %v", err)
+	}
+	if !got["one"].Equal(latest) {
+		t.Errorf("LatestTimestamps() expected %v for metric 'one'; got %v", latest, got["one"])
+	}
+	if ts, ok := got["new"]; !ok || time.Since(ts) < time.Hour || time.Since(ts) > time.Hour+time.Minute {
+		t.Errorf("LatestTimestamps() expected lookback interval for metric 'new'; got %v", ts)
+	}
+	// A metric without labels that has several time series is left for LatestTimestamp to return an error.
+	if ts, ok := got["several"]; ok {
+		t.Errorf("LatestTimestamps() expected no timestamp for metric 'several'; got %v", ts)
+	}
+}
+
+func TestCreateTimeseriesPartialWrite(t *testing.T) {
+	ctx := context.Background()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockMetricClient(mockCtrl)
+	desc := &metricpb.MetricDescriptor{Type: "bar", MetricKind: metricpb.MetricDescriptor_GAUGE, ValueType: metricpb.MetricDescriptor_DOUBLE}
+	mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).Return(proto.Clone(desc), nil)
+	gomock.InOrder(
+		mock.EXPECT().CreateTimeSeries(gomock.Any(), gomock.Any()).Return(nil),
+		mock.EXPECT().CreateTimeSeries(gomock.Any(), gomock.Any()).Return(status.Error(codes.InvalidArgument, "bad point")),
+	)
+	a := &Adapter{mock, time.Hour, nil, nil, nil}
+
+	err := a.CreateTimeseries(ctx, "foo", "bar", desc, unmarshalTimeSeries([]string{`points <>`, `points <>`, `points <>`}))
+	var pw *PartialWriteError
+	if !errors.As(err, &pw) || pw.Written != 1 {
+		t.Fatalf("CreateTimeseries() expected a partial write error after 1 time series; got %v", err)
+	}
+	if !errors.Is(err, tserrors.ErrDestinationPermanent) {
+		t.Errorf("CreateTimeseries() expected error to keep its class; got %v", tserrors.Class(err))
+	}
+}
+
+func TestCreateTimeseriesWriteObserver(t *testing.T) {
+	ctx := context.Background()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockMetricClient(mockCtrl)
+	desc := &metricpb.MetricDescriptor{Type: "bar", MetricKind: metricpb.MetricDescriptor_GAUGE, ValueType: metricpb.MetricDescriptor_DOUBLE}
+	mock.EXPECT().GetMetricDescriptor(gomock.Any(), gomock.Any()).Return(proto.Clone(desc), nil)
+	gomock.InOrder(
+		mock.EXPECT().CreateTimeSeries(gomock.Any(), gomock.Any()).Return(nil),
+		mock.EXPECT().CreateTimeSeries(gomock.Any(), gomock.Any()).Return(status.Error(codes.ResourceExhausted, "slow down")),
+	)
+	a := &Adapter{mock, time.Hour, nil, nil, nil}
+
+	type write struct {
+		project string
+		points  int
+		err     error
+	}
+	var writes []write
+	a.SetWriteObserver(func(_ context.Context, project string, points, bytes int, err error) {
+		if bytes <= 0 {
+			t.Errorf("expected a positive request size; got %d", bytes)
+		}
+		writes = append(writes, write{project, points, err})
+	})
+
+	a.CreateTimeseries(ctx, "foo", "bar", desc, unmarshalTimeSeries([]string{`points <> points <>`, `points <>`}))
+	if len(writes) != 2 {
+		t.Fatalf("expected 2 observed writes; got %v", writes)
+	}
+	if writes[0].project != "foo" || writes[0].points != 2 || writes[0].err != nil {
+		t.Errorf("expected a successful write of 2 points to 'foo'; got %+v", writes[0])
+	}
+	if writes[1].points != 1 || !errors.Is(writes[1].err, tserrors.ErrDestinationQuota) {
+		t.Errorf("expected a write of 1 point rejected by quota; got %+v", writes[1])
+	}
+}
+
+func TestReadPoints(t *testing.T) {
+	ctx := context.Background()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mock := mocks.NewMockMetricClient(mockCtrl)
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	mock.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+			if req.Name != "projects/foo" || req.Filter != `metric.type = "bar"` {
+				t.Errorf("unexpected request %v", req)
+			}
+			if req.Aggregation != nil {
+				t.Errorf("expected raw points to be requested; got aggregation %v", req.Aggregation)
+			}
+			if req.Interval.StartTime.Seconds != start.Unix() || req.Interval.EndTime.Seconds != start.Add(time.Minute).Unix() {
+				t.Errorf("unexpected interval %v", req.Interval)
+			}
+			return unmarshalTimeSeries([]string{"points <value: <int64_value: 3>>"}), nil
+		})
+	mock.EXPECT().ListTimeSeries(gomock.Any(), gomock.Any()).Return(nil, status.Error(codes.PermissionDenied, "no"))
+
+	a := &Adapter{mock, time.Hour, nil, nil, nil}
+	ts, err := a.ReadPoints(ctx, "foo", "bar", start, start.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("ReadPoints() unexpected error: %v", err)
+	}
+	if len(ts) != 1 {
+		t.Errorf("expected ReadPoints() to return 1 time series; got %v", ts)
+	}
+	if _, err := a.ReadPoints(ctx, "foo", "bar", start, start.Add(time.Minute)); !errors.Is(err, tserrors.ErrDestinationPermanent) {
+		t.Errorf("expected a permanent destination error; got %v", err)
+	}
+}
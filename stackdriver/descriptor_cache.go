@@ -0,0 +1,95 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+// DescriptorCache keeps metric descriptors that are known to exist in Stackdriver, so that metric descriptors of
+// unchanged metrics don't need to be fetched during every update. Entries expire after a TTL, which bounds how long
+// changes made to descriptors outside of ts-bridge go unnoticed. A DescriptorCache is safe for concurrent use and is
+// meant to be shared across adapters. A nil DescriptorCache caches nothing.
+type DescriptorCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*cachedDescriptor
+}
+
+// cachedDescriptor is a single entry of the descriptor cache.
+type cachedDescriptor struct {
+	desc    *metricpb.MetricDescriptor
+	expires time.Time
+}
+
+// NewDescriptorCache returns a new DescriptorCache.
+func NewDescriptorCache(ttl time.Duration) *DescriptorCache {
+	return &DescriptorCache{
+		ttl:     ttl,
+		entries: make(map[string]*cachedDescriptor),
+	}
+}
+
+// get returns a copy of the cached descriptor of a metric, or nil if there is no unexpired entry for it.
+func (c *DescriptorCache) get(project, name string) *metricpb.MetricDescriptor {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[descriptorKey(project, name)]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, descriptorKey(project, name))
+		return nil
+	}
+	return proto.Clone(e.desc).(*metricpb.MetricDescriptor)
+}
+
+// set adds a descriptor of a metric to the cache.
+func (c *DescriptorCache) set(project, name string, desc *metricpb.MetricDescriptor) {
+	if c == nil || desc == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[descriptorKey(project, name)] = &cachedDescriptor{
+		desc:    proto.Clone(desc).(*metricpb.MetricDescriptor),
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+// invalidate removes a metric from the cache.
+func (c *DescriptorCache) invalidate(project, name string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, descriptorKey(project, name))
+}
+
+// descriptorKey returns the cache key of a metric.
+func descriptorKey(project, name string) string {
+	return fmt.Sprintf("%s/%s", project, name)
+}
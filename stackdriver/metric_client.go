@@ -17,20 +17,24 @@ package stackdriver
 import (
 	"context"
 
+	"github.com/google/ts-bridge/usage"
+
 	monitoring "cloud.google.com/go/monitoring/apiv3"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
-// client wraps Stackdriver metric client, implementing MetricClient interface.
+// client wraps Stackdriver metric client, implementing MetricClient interface. API calls are counted by the usage
+// counter of the context, if there is one; a paged ListTimeSeries call counts once.
 type client struct {
 	sd *monitoring.MetricClient
 }
 
-// NewClient returns a new client.
-func newClient(ctx context.Context) (*client, error) {
-	sd, err := monitoring.NewMetricClient(ctx)
+// NewClient returns a new client. Application default credentials are used unless `opts` configure others.
+func newClient(ctx context.Context, opts ...option.ClientOption) (*client, error) {
+	sd, err := monitoring.NewMetricClient(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -43,22 +47,34 @@ func (c *client) Close() error {
 }
 
 func (c *client) CreateMetricDescriptor(ctx context.Context, req *monitoringpb.CreateMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+	usage.AddStackdriverCall(ctx, 0)
 	return c.sd.CreateMetricDescriptor(ctx, req)
 }
 
 func (c *client) GetMetricDescriptor(ctx context.Context, req *monitoringpb.GetMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+	usage.AddStackdriverCall(ctx, 0)
 	return c.sd.GetMetricDescriptor(ctx, req)
 }
 
 func (c *client) DeleteMetricDescriptor(ctx context.Context, req *monitoringpb.DeleteMetricDescriptorRequest) error {
+	usage.AddStackdriverCall(ctx, 0)
 	return c.sd.DeleteMetricDescriptor(ctx, req)
 }
 
 func (c *client) CreateTimeSeries(ctx context.Context, req *monitoringpb.CreateTimeSeriesRequest) error {
-	return c.sd.CreateTimeSeries(ctx, req)
+	err := c.sd.CreateTimeSeries(ctx, req)
+	points := 0
+	if err == nil {
+		for _, ts := range req.TimeSeries {
+			points += len(ts.Points)
+		}
+	}
+	usage.AddStackdriverCall(ctx, points)
+	return err
 }
 
 func (c *client) ListTimeSeries(ctx context.Context, req *monitoringpb.ListTimeSeriesRequest) ([]*monitoringpb.TimeSeries, error) {
+	usage.AddStackdriverCall(ctx, 0)
 	it := c.sd.ListTimeSeries(ctx, req)
 	var series []*monitoringpb.TimeSeries
 	for {
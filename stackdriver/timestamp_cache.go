@@ -0,0 +1,164 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stackdriver
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// TimestampCache keeps the latest points of metrics looked up by LatestTimestamp, so that metrics sharing a metric
+// type prefix (e.g. many metrics imported from the same source) are looked up with a single ListTimeSeries query
+// instead of one query each. Entries are kept per prefix and look-back window, and expire after a TTL. Successful
+// writes advance cached timestamps, and failed writes invalidate them, so the cache only needs to be refreshed to
+// notice points written outside of the adapter. A TimestampCache is safe for concurrent use and is meant to be
+// shared across adapters. A nil TimestampCache caches nothing.
+type TimestampCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[timestampKey]*timestampEntry
+}
+
+// timestampKey identifies an entry of the timestamp cache.
+type timestampKey struct {
+	project string
+	prefix  string
+	window  time.Duration
+}
+
+// timestampEntry has the latest points of all metrics with a prefix, as of the last query of the prefix.
+type timestampEntry struct {
+	// loading is held while the prefix is queried, so that concurrent lookups of sibling metrics wait for the
+	// same query instead of running their own.
+	loading sync.Mutex
+
+	// The following fields are guarded by TimestampCache.mu.
+	expires time.Time
+	metrics map[string]latestSeries
+	// stale has metrics whose cached latest point cannot be trusted, e.g. after a failed write. They are looked up
+	// individually until the entry expires.
+	stale map[string]bool
+}
+
+// latestSeries summarizes the time series of a metric: how many there are, and the end time of their newest point
+// (which is zero if there are none).
+type latestSeries struct {
+	series int
+	latest time.Time
+}
+
+// NewTimestampCache returns a new TimestampCache.
+func NewTimestampCache(ttl time.Duration) *TimestampCache {
+	return &TimestampCache{
+		ttl:     ttl,
+		entries: make(map[timestampKey]*timestampEntry),
+	}
+}
+
+// get returns the cached latest series of a metric. `loadPrefix` is called to query all metrics with the prefix of
+// the metric if there is no unexpired entry for it, and `loadMetric` to query the metric alone if its cached
+// timestamp is stale. Metrics missing from a loaded entry have no time series.
+func (c *TimestampCache) get(project, name string, window time.Duration, loadPrefix func(prefix string) (map[string]latestSeries, error), loadMetric func() (latestSeries, error)) (latestSeries, error) {
+	prefix := metricTypePrefix(name)
+	key := timestampKey{project, prefix, window}
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &timestampEntry{}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+
+	e.loading.Lock()
+	defer e.loading.Unlock()
+	c.mu.Lock()
+	expired := time.Now().After(e.expires)
+	stale := e.stale[name]
+	l := e.metrics[name]
+	c.mu.Unlock()
+
+	switch {
+	case expired:
+		metrics, err := loadPrefix(prefix)
+		if err != nil {
+			return latestSeries{}, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		e.expires = time.Now().Add(c.ttl)
+		e.metrics = metrics
+		e.stale = make(map[string]bool)
+		return metrics[name], nil
+	case stale:
+		l, err := loadMetric()
+		if err != nil {
+			return latestSeries{}, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		e.metrics[name] = l
+		delete(e.stale, name)
+		return l, nil
+	}
+	return l, nil
+}
+
+// written records that points up to `latest` have been written to a metric.
+func (c *TimestampCache) written(project, name string, latest time.Time) {
+	c.update(project, name, func(e *timestampEntry) {
+		l := e.metrics[name]
+		if l.series == 0 {
+			l.series = 1
+		}
+		if latest.After(l.latest) {
+			l.latest = latest
+		}
+		e.metrics[name] = l
+	})
+}
+
+// invalidate marks the cached latest point of a metric as stale.
+func (c *TimestampCache) invalidate(project, name string) {
+	c.update(project, name, func(e *timestampEntry) {
+		e.stale[name] = true
+	})
+}
+
+// update applies `f` to all loaded entries covering a metric, across look-back windows.
+func (c *TimestampCache) update(project, name string, f func(*timestampEntry)) {
+	if c == nil {
+		return
+	}
+	prefix := metricTypePrefix(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if key.project == project && key.prefix == prefix && e.metrics != nil {
+			f(e)
+		}
+	}
+}
+
+// metricTypePrefix returns the prefix shared by sibling metric types, e.g. `custom.googleapis.com/datadog/` for
+// `custom.googleapis.com/datadog/requests`.
+func metricTypePrefix(name string) string {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return name
+	}
+	return name[:i+1]
+}
@@ -18,6 +18,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
@@ -30,6 +31,34 @@ type Manager interface {
 	Close() error
 }
 
+// Batcher is implemented by storage managers that can defer writes of metric records and persist them together,
+// which is much faster than writing each record separately when many metrics are updated.
+type Batcher interface {
+	// StartBatch defers writes of metric records until FlushBatch is called.
+	StartBatch()
+	// FlushBatch writes all metric records changed since StartBatch. Writes are no longer deferred once each
+	// StartBatch call has been followed by a FlushBatch call.
+	FlushBatch(ctx context.Context) error
+}
+
+// ErrClaimed is returned by Claimer.ClaimImport if another instance holds an unexpired claim on a metric.
+var ErrClaimed = errors.New("import is claimed by another instance")
+
+// Claimer is implemented by storage managers that can be shared by several ts-bridge instances importing the same
+// metrics, e.g. in active-active deployments without leader election. Before an instance imports points of a metric,
+// it claims the import for a while; other instances skip the metric until the claim is released or expires. Each
+// metric also has a cursor, the newest point written by any instance, which imports start after. Claims and cursors
+// are kept separately from metric records, so that writes of records by different instances cannot undo them.
+type Claimer interface {
+	// ClaimImport claims importing points of a metric on behalf of `owner` until `expires`, and returns the cursor of
+	// the metric. It returns an error wrapping ErrClaimed if another owner holds a claim that has not expired.
+	ClaimImport(ctx context.Context, name, owner string, expires time.Time) (time.Time, error)
+	// ReleaseImport releases the claim of `owner` on a metric, and advances its cursor to `cursor` if it's later.
+	// It returns an error wrapping ErrClaimed if the claim has expired and has been taken over by another owner; the
+	// cursor is advanced anyway, since the points have been written.
+	ReleaseImport(ctx context.Context, name, owner string, cursor time.Time) error
+}
+
 //go:generate mockgen -destination=../mocks/mock_metric_record.go -package=mocks github.com/google/ts-bridge/storage MetricRecord
 
 // MetricRecord is an interface implemented by StoredMetricRecord.
@@ -37,6 +66,64 @@ type MetricRecord interface {
 	UpdateError(ctx context.Context, e error) error
 	UpdateSuccess(ctx context.Context, points int, msg string) error
 	GetLastUpdate() time.Time
+	GetLastAttempt() time.Time
+	GetLastStatus() string
 	GetCounterStartTime() time.Time
 	SetCounterStartTime(ctx context.Context, start time.Time) error
+	GetMissingPoints() int
+	SetMissingPoints(ctx context.Context, missing int) error
+	GetDetectorState() DetectorState
+	SetDetectorState(ctx context.Context, state DetectorState) error
+	GetThresholdStreaks() []int
+	SetThresholdStreaks(ctx context.Context, streaks []int) error
+	GetResumeTime() time.Time
+	SetResumeTime(ctx context.Context, resume time.Time) error
+	GetPendingWrites() []byte
+	SetPendingWrites(ctx context.Context, pending []byte) error
+	GetDailyPoints() DailyPoints
+	SetDailyPoints(ctx context.Context, points DailyPoints) error
+	GetExpressionState() []byte
+	SetExpressionState(ctx context.Context, state []byte) error
+}
+
+// DetectorState is the state of an anomaly detector that is kept between updates of a metric.
+type DetectorState struct {
+	Mean     float64 // exponentially weighted moving average of point values.
+	Variance float64 // exponentially weighted moving variance of point values.
+	Count    int     // number of points seen so far.
+}
+
+// DailyPoints is the number of points of a metric written to Stackdriver during a day, which is checked against
+// daily budgets.
+type DailyPoints struct {
+	Day    string // date in UTC, e.g. 2020-05-01.
+	Points int64
+	// Notified is set once budget notifications have been sent for the day.
+	Notified bool
+}
+
+// RecordState is the persisted state of a metric record, e.g. as kept in a snapshot of all records.
+type RecordState struct {
+	Name             string
+	Query            string
+	LastUpdate       time.Time
+	LastAttempt      time.Time
+	LastStatus       string
+	CounterStartTime time.Time
+	MissingPoints    int
+	DetectorState    DetectorState
+	ThresholdStreaks []int
+	ResumeTime       time.Time
+	PendingWrites    []byte
+	DailyPoints      DailyPoints
+	ExpressionState  []byte
+}
+
+// Restorer is implemented by metric records whose whole state can be read and replaced, which is used to take
+// snapshots of all records and to restore them, e.g. in another environment.
+type Restorer interface {
+	// State returns the current state of the record.
+	State() RecordState
+	// Restore replaces the state of the record, other than its name.
+	Restore(ctx context.Context, state RecordState) error
 }
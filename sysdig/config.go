@@ -0,0 +1,85 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysdig
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// defaultStep is the interval between evaluations of a query, unless configured.
+const defaultStep = time.Minute
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Sysdig Monitor.
+type MetricConfig struct {
+	// Endpoint is the base URL of Sysdig Monitor, e.g. https://app.sysdigcloud.com or
+	// https://us-south.monitoring.cloud.ibm.com for IBM Cloud Monitoring.
+	Endpoint string `validate:"nonzero"`
+	// Query is a PromQL query, e.g. `sum by (kube_namespace_name) (sysdig_container_cpu_cores_used)`.
+	Query string `validate:"nonzero"`
+	// Step is the interval between evaluations of the query, and thus between imported points.
+	Step time.Duration
+
+	// Token is a Sysdig Monitor API token or, if IBMInstanceID is set, an IBM Cloud IAM access token.
+	Token string
+	// IBMInstanceID is the GUID of an IBM Cloud Monitoring instance. It's sent along with IAM access tokens.
+	IBMInstanceID string `yaml:"ibm_instance_id"`
+	// TeamID optionally selects the Sysdig team whose scope the query is evaluated in.
+	TeamID string `yaml:"team_id"`
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// The token can also be read from a file, e.g. from a mounted Kubernetes secret.
+	TokenFile string `yaml:"token_file"`
+}
+
+// ReadSecretFiles sets the token from the contents of the configured token file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.TokenFile == "" {
+		return nil
+	}
+	if c.Token != "" {
+		return fmt.Errorf("token and token_file cannot both be set")
+	}
+	token, err := env.ReadSecretFile(dir, c.TokenFile)
+	if err != nil {
+		return fmt.Errorf("cannot read token_file: %v", err)
+	}
+	c.Token = token
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if c.Step < 0 || c.Step%time.Second != 0 {
+		return fmt.Errorf("step needs to be a positive number of seconds")
+	}
+	if c.Token == "" {
+		return fmt.Errorf("token or token_file needs to be set")
+	}
+	return nil
+}
+
+// step returns the interval between evaluations of the query.
+func (c *MetricConfig) step() time.Duration {
+	if c.Step > 0 {
+		return c.Step
+	}
+	return defaultStep
+}
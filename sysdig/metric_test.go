@@ -0,0 +1,167 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sysdig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	labels map[string]string
+	offset time.Duration // relative to the start of a test.
+	value  float64
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, testPoint{s.Metric.Labels, end.Sub(start), s.Points[0].Value.GetDoubleValue()})
+	}
+	return points
+}
+
+func TestStackdriverData(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	defer func() { timeNow = time.Now }()
+	// The end of the queried range is aligned to the step.
+	timeNow = func() time.Time { return start.Add(5*time.Minute + 20*time.Second) }
+
+	var params url.Values
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer iam-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/prometheus/api/v1/query_range" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		params, headers = r.URL.Query(), r.Header
+		s := start.Unix()
+		fmt.Fprintf(w, `{"status": "success", "data": {"resultType": "matrix", "result": [
+			{"metric": {"__name__": "cpu", "kube_namespace_name": "web"}, "values": [[%d, "0.5"], [%d, "NaN"]]},
+			{"metric": {"kube_namespace_name": "db"}, "values": [[%d, "2"]]}
+		]}}`, s+60, s+120, s+240)
+	}))
+	defer server.Close()
+
+	query := `sum by (kube_namespace_name) (sysdig_container_cpu_cores_used)`
+	m, err := NewSourceMetric("cpu", &MetricConfig{
+		Endpoint:      server.URL + "/",
+		Query:         query,
+		Token:         "iam-token",
+		IBMInstanceID: "instance-1",
+		TeamID:        "42",
+	}, 20*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, start.Add(10*time.Second), nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	wantParams := url.Values{
+		"query": {query},
+		"start": {strconv.FormatInt(start.Add(time.Minute).Unix(), 10)},
+		"end":   {strconv.FormatInt(start.Add(5*time.Minute).Unix(), 10)},
+		"step":  {"60"},
+	}
+	if !reflect.DeepEqual(params, wantParams) {
+		t.Errorf("expected query parameters %v; got %v", wantParams, params)
+	}
+	if headers.Get("IBMInstanceID") != "instance-1" || headers.Get("SysdigTeamID") != "42" || headers.Get(requestid.Header) != "req-1" {
+		t.Errorf("unexpected request headers %v", headers)
+	}
+	if desc.Type != "custom.googleapis.com/sysdig/cpu" || len(desc.Labels) != 1 || desc.Labels[0].Key != "kube_namespace_name" {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// NaN values and the __name__ label are skipped.
+	want := []testPoint{
+		{map[string]string{"kube_namespace_name": "web"}, time.Minute, 0.5},
+		{map[string]string{"kube_namespace_name": "db"}, 4 * time.Minute, 2},
+	}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		status    int
+		body      string
+		wantClass error
+	}{
+		{"unauthorized", http.StatusUnauthorized, "", tserrors.ErrSourcePermanent},
+		{"invalid query", http.StatusBadRequest, `{"status": "error", "error": "parse error"}`, tserrors.ErrSourcePermanent},
+		{"too many requests", http.StatusTooManyRequests, "", tserrors.ErrSourceTransient},
+		{"unavailable", http.StatusServiceUnavailable, "", tserrors.ErrSourceTransient},
+		{"instant vector", http.StatusOK, `{"status": "success", "data": {"resultType": "vector", "result": []}}`, tserrors.ErrSourcePermanent},
+		{"invalid value", http.StatusOK, `{"status": "success", "data": {"resultType": "matrix", "result": [{"values": [[1, "x"]]}]}}`, nil},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			m, err := NewSourceMetric("errors", &MetricConfig{Endpoint: server.URL, Query: "q", Token: "t"}, 0)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+			if err == nil {
+				t.Fatalf("expected StackdriverData to fail")
+			}
+			if tt.wantClass != nil && !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, config := range []*MetricConfig{
+		{Endpoint: "http://sysdig.invalid", Query: "q"},
+		{Endpoint: "http://sysdig.invalid", Query: "q", Token: "t", Step: 1500 * time.Millisecond},
+	} {
+		if _, err := NewSourceMetric("invalid", config, 0); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package timezone converts naive timestamps, i.e. local wall clock times without a time zone offset, that are
+// returned by some sources into absolute times.
+package timezone
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxTransition is how far after a time the end of daylight saving time is looked for. Clocks are never set back by
+// more than this.
+const maxTransition = 3 * time.Hour
+
+// Load returns the location of an IANA time zone name such as `Europe/Berlin`. Unlike time.LoadLocation, it does
+// not accept `Local`, since the time zone of ts-bridge itself is usually UTC and says nothing about the source.
+func Load(name string) (*time.Location, error) {
+	if name == "Local" {
+		return nil, fmt.Errorf("time zone %q is not supported; please use an IANA time zone name", name)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q: %v", name, err)
+	}
+	return loc, nil
+}
+
+// Converter converts naive timestamps of a single time series in a location. Converting wall clock times is
+// ambiguous while clocks are set back at the end of daylight saving time, since an hour of wall clock times occurs
+// twice. A converter resolves these times using the order of the converted timestamps: a wall clock time is taken
+// as its second occurrence if its first one is not after the latest time converted so far.
+type Converter struct {
+	loc    *time.Location
+	latest time.Time
+}
+
+// NewConverter returns a converter for wall clock times in `loc`, whose timestamps continue after `latest` (e.g. the
+// latest point already written). It can be zero if nothing is known about previous timestamps.
+func NewConverter(loc *time.Location, latest time.Time) *Converter {
+	return &Converter{loc: loc, latest: latest}
+}
+
+// Convert returns the absolute time of a naive timestamp, whose date and clock (regardless of its location) are a
+// wall clock time in the location of the converter. Wall clock times skipped when clocks are set forward are moved
+// forward by the length of the gap, like time.Date does.
+func (c *Converter) Convert(naive time.Time) time.Time {
+	y, mo, d := naive.Date()
+	h, mi, s := naive.Clock()
+	t := time.Date(y, mo, d, h, mi, s, naive.Nanosecond(), c.loc)
+	if first, second, ok := occurrences(t); ok {
+		t = first
+		if !first.After(c.latest) && second.After(c.latest) {
+			t = second
+		}
+	}
+	if t.After(c.latest) {
+		c.latest = t
+	}
+	return t
+}
+
+// occurrences returns both occurrences of the wall clock time of `t`, if clocks are set back around `t` so that it
+// occurs twice.
+func occurrences(t time.Time) (first, second time.Time, ok bool) {
+	_, before := t.Add(-maxTransition).Zone()
+	_, after := t.Add(maxTransition).Zone()
+	if before <= after {
+		return t, t, false
+	}
+	y, mo, d := t.Date()
+	h, mi, s := t.Clock()
+	wall := time.Date(y, mo, d, h, mi, s, t.Nanosecond(), time.UTC)
+	first = wall.Add(-time.Duration(before) * time.Second).In(t.Location())
+	second = wall.Add(-time.Duration(after) * time.Second).In(t.Location())
+	return first, second, sameWallClock(first, t) && sameWallClock(second, t)
+}
+
+// sameWallClock returns true if two times of the same location have the same wall clock time.
+func sameWallClock(a, b time.Time) bool {
+	const layout = "2006-01-02T15:04:05.999999999"
+	return a.Format(layout) == b.Format(layout)
+}
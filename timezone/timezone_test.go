@@ -0,0 +1,73 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package timezone
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConvert(t *testing.T) {
+	berlin, err := Load("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	naive := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	for _, tt := range []struct {
+		name   string
+		latest time.Time
+		naive  []string
+		want   []string
+	}{
+		{"winter", time.Time{}, []string{"2024-01-15 12:00"}, []string{"2024-01-15T11:00:00Z"}},
+		{"summer", time.Time{}, []string{"2024-07-15 12:00"}, []string{"2024-07-15T10:00:00Z"}},
+		{"clocks set forward", time.Time{},
+			[]string{"2024-03-31 01:30", "2024-03-31 02:30", "2024-03-31 03:30"},
+			[]string{"2024-03-31T00:30:00Z", "2024-03-31T01:30:00Z", "2024-03-31T01:30:00Z"}},
+		{"clocks set back", time.Time{},
+			[]string{"2024-10-27 01:30", "2024-10-27 02:00", "2024-10-27 02:30", "2024-10-27 02:00", "2024-10-27 02:30", "2024-10-27 03:00"},
+			[]string{"2024-10-26T23:30:00Z", "2024-10-27T00:00:00Z", "2024-10-27T00:30:00Z", "2024-10-27T01:00:00Z", "2024-10-27T01:30:00Z", "2024-10-27T02:00:00Z"}},
+		{"repeated hour after the latest point", time.Date(2024, 10, 27, 0, 45, 0, 0, time.UTC),
+			[]string{"2024-10-27 02:50", "2024-10-27 02:15"},
+			[]string{"2024-10-27T00:50:00Z", "2024-10-27T01:15:00Z"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewConverter(berlin, tt.latest)
+			for i, n := range tt.naive {
+				if got := c.Convert(naive(n)).UTC().Format(time.RFC3339); got != tt.want[i] {
+					t.Errorf("Convert(%s) = %s; want %s", n, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	for _, name := range []string{"Local", "Mars/Olympus_Mons"} {
+		if _, err := Load(name); err == nil {
+			t.Errorf("Load(%q) expected an error", name)
+		}
+	}
+	if loc, err := Load(""); err != nil || loc != time.UTC {
+		t.Errorf("Load(\"\") = %v, %v; want UTC", loc, err)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to flagging anomalous points of imported metrics.
+package tsbridge
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/google/ts-bridge/storage"
+
+	"github.com/golang/protobuf/proto"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// Default anomaly detection parameters.
+const (
+	defaultAnomalyThreshold = 3
+	defaultAnomalyAlpha     = 0.1
+	defaultAnomalyWarmup    = 10
+)
+
+// AnomalyConfig enables a detector that flags points deviating strongly from recent history. Recent history is
+// tracked as an exponentially weighted moving average (EWMA) and variance of point values, and a point is flagged
+// when its z-score (distance from the average in standard deviations) is above the threshold.
+type AnomalyConfig struct {
+	// Threshold is the z-score above which a point is anomalous. Defaults to 3.
+	Threshold float64 `validate:"min=0"`
+	// Alpha is the EWMA smoothing factor between 0 and 1; higher values give more weight to recent points.
+	// Defaults to 0.1.
+	Alpha float64 `validate:"min=0"`
+	// Warmup is the number of points that need to be seen before any point can be flagged. Defaults to 10.
+	Warmup int `validate:"min=0"`
+}
+
+// validate checks anomaly detection parameters that cannot be verified using struct tags.
+func (ac *AnomalyConfig) validate() error {
+	if ac.Alpha >= 1 {
+		return fmt.Errorf("anomaly detection alpha must be lower than 1; got %v", ac.Alpha)
+	}
+	return nil
+}
+
+// params returns detector parameters, with defaults applied.
+func (ac *AnomalyConfig) params() (threshold, alpha float64, warmup int) {
+	threshold, alpha, warmup = ac.Threshold, ac.Alpha, ac.Warmup
+	if threshold == 0 {
+		threshold = defaultAnomalyThreshold
+	}
+	if alpha == 0 {
+		alpha = defaultAnomalyAlpha
+	}
+	if warmup == 0 {
+		warmup = defaultAnomalyWarmup
+	}
+	return threshold, alpha, warmup
+}
+
+// anomalyName returns the metric type of the companion anomaly metric.
+func anomalyName(name string) string {
+	return name + "_anomaly"
+}
+
+// detectAnomalies returns the companion anomaly time series for points of a metric (sorted by time), with a point
+// set to 1 for each anomalous point and to 0 otherwise, along with the updated detector state. Since a single
+// detector state is kept per metric, only metrics with a single time series are supported.
+func detectAnomalies(ac *AnomalyConfig, state storage.DetectorState, desc *metricpb.MetricDescriptor, series []*monitoringpb.TimeSeries) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, storage.DetectorState, error) {
+	threshold, alpha, warmup := ac.params()
+
+	var key string
+	var output []*monitoringpb.TimeSeries
+	for i, ts := range series {
+		if k := proto.CompactTextString(ts.Metric); i == 0 {
+			key = k
+		} else if k != key {
+			return nil, nil, state, fmt.Errorf("anomaly detection only supports metrics with a single time series")
+		}
+		if ts.MetricKind == metricpb.MetricDescriptor_CUMULATIVE {
+			return nil, nil, state, fmt.Errorf("anomaly detection cannot be used with cumulative metrics")
+		}
+		for _, p := range ts.Points {
+			v := pointValue(p)
+			anomalous := int64(0)
+			if state.Count >= warmup && state.Variance > 0 && math.Abs(v-state.Mean)/math.Sqrt(state.Variance) > threshold {
+				anomalous = 1
+			}
+			state = updateDetectorState(state, v, alpha)
+
+			flag := proto.Clone(ts).(*monitoringpb.TimeSeries)
+			flag.Metric.Type = anomalyName(ts.Metric.Type)
+			flag.ValueType = metricpb.MetricDescriptor_INT64
+			flag.Points = []*monitoringpb.Point{{
+				Interval: p.Interval,
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: anomalous}},
+			}}
+			output = append(output, flag)
+		}
+	}
+
+	flagDesc := &metricpb.MetricDescriptor{
+		Type:        anomalyName(desc.GetType()),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_INT64,
+		Unit:        "1",
+		Description: fmt.Sprintf("Anomalous points (1) of %s", desc.GetType()),
+		DisplayName: fmt.Sprintf("%s anomaly", desc.GetDisplayName()),
+		Labels:      desc.GetLabels(),
+	}
+	return flagDesc, output, state, nil
+}
+
+// updateDetectorState adds a point value to the exponentially weighted moving average and variance.
+func updateDetectorState(state storage.DetectorState, v, alpha float64) storage.DetectorState {
+	if state.Count == 0 {
+		return storage.DetectorState{Mean: v, Count: 1}
+	}
+	diff := v - state.Mean
+	incr := alpha * diff
+	return storage.DetectorState{
+		Mean:     state.Mean + incr,
+		Variance: (1 - alpha) * (state.Variance + diff*incr),
+		Count:    state.Count + 1,
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/datastore"
+	"github.com/google/ts-bridge/mocks"
+	"github.com/google/ts-bridge/storage"
+
+	"github.com/golang/mock/gomock"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// anomalyFlags returns values of all points in anomaly time series.
+func anomalyFlags(series []*monitoringpb.TimeSeries) []int64 {
+	var flags []int64
+	for _, ts := range series {
+		for _, p := range ts.Points {
+			flags = append(flags, p.GetValue().GetInt64Value())
+		}
+	}
+	return flags
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	desc := &metricpb.MetricDescriptor{Type: "custom.googleapis.com/test", DisplayName: "test"}
+	ac := &AnomalyConfig{Threshold: 3, Alpha: 0.2, Warmup: 4}
+
+	values := []float64{10, 11, 9, 10, 11, 10, 50, 10}
+	flagDesc, flags, state, err := detectAnomalies(ac, storage.DetectorState{}, desc, gaugeSeries(start, time.Minute, values...))
+	if err != nil {
+		t.Fatalf("detectAnomalies() returned error: %v", err)
+	}
+	if want := []int64{0, 0, 0, 0, 0, 0, 1, 0}; !reflect.DeepEqual(anomalyFlags(flags), want) {
+		t.Errorf("expected anomaly flags %v; got %v", want, anomalyFlags(flags))
+	}
+	if flagDesc.Type != "custom.googleapis.com/test_anomaly" || flagDesc.ValueType != metricpb.MetricDescriptor_INT64 {
+		t.Errorf("unexpected anomaly descriptor %v", flagDesc)
+	}
+	if flags[0].Metric.Type != "custom.googleapis.com/test_anomaly" {
+		t.Errorf("expected anomaly series to have type custom.googleapis.com/test_anomaly; got %s", flags[0].Metric.Type)
+	}
+	if state.Count != len(values) {
+		t.Errorf("expected detector state to count %d points; got %d", len(values), state.Count)
+	}
+
+	// Detector state is carried over between updates: the warm-up period is over, so the first point can be flagged.
+	_, flags, _, err = detectAnomalies(ac, state, desc, gaugeSeries(start.Add(time.Hour), time.Minute, -100))
+	if err != nil {
+		t.Fatalf("detectAnomalies() returned error: %v", err)
+	}
+	if want := []int64{1}; !reflect.DeepEqual(anomalyFlags(flags), want) {
+		t.Errorf("expected anomaly flags %v; got %v", want, anomalyFlags(flags))
+	}
+}
+
+func TestDetectAnomaliesSeveralSeries(t *testing.T) {
+	series := gaugeSeries(time.Now().Add(-time.Hour), time.Minute, 1, 2)
+	series[1].Metric = &metricpb.Metric{Type: "custom.googleapis.com/test", Labels: map[string]string{"host": "b"}}
+	_, _, _, err := detectAnomalies(&AnomalyConfig{}, storage.DetectorState{}, &metricpb.MetricDescriptor{}, series)
+	if err == nil || !strings.Contains(err.Error(), "only supports metrics with a single time series") {
+		t.Errorf("expected detectAnomalies() to reject several time series; got %v", err)
+	}
+}
+
+func TestMetricUpdateAnomalies(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m, err := NewMetric(ctx, "metricname", mockSource, "sd-project", datastore.New(ctx, &datastore.Options{}))
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+	m.Options.AnomalyDetection = &AnomalyConfig{Warmup: 2}
+
+	latest := time.Now().Add(-time.Hour)
+	desc := &metricpb.MetricDescriptor{Type: "sd-metricname"}
+	ts := gaugeSeries(latest.Add(time.Minute), time.Minute, 1, 2, 1)
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	mockSource.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(desc, ts, nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", desc, ts).Return(nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname_anomaly", gomock.Any(), gomock.Any()).Return(nil)
+
+	collector, _ := fakeStats(t)
+	err = m.Update(ctx, mockSD, collector)
+	collector.Close()
+	if err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	if got := m.Record.GetDetectorState().Count; got != 3 {
+		t.Errorf("expected detector state to be persisted with 3 points; got %d", got)
+	}
+}
+
+func TestMetricUpdateAnomalyFlagsFailed(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m, err := NewMetric(ctx, "anomaly_flags_failed_metric", mockSource, "sd-project", datastore.New(ctx, &datastore.Options{}))
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+	m.Options.AnomalyDetection = &AnomalyConfig{Warmup: 2}
+
+	latest := time.Now().Add(-time.Hour)
+	desc := &metricpb.MetricDescriptor{Type: "sd-metricname"}
+	ts := gaugeSeries(latest.Add(time.Minute), time.Minute, 1, 2, 1)
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	mockSource.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(desc, ts, nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", desc, ts).Return(nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname_anomaly", gomock.Any(), gomock.Any()).Return(errors.New("quota exceeded"))
+
+	collector, _ := fakeStats(t)
+	err = m.Update(ctx, mockSD, collector)
+	collector.Close()
+	if err != nil {
+		t.Fatalf("expected Metric.Update() to succeed after writing points; got %v", err)
+	}
+	if status := m.Record.GetLastStatus(); !strings.Contains(status, "3 new points found") {
+		t.Errorf("expected written points to be recorded; got status %q", status)
+	}
+	if got := m.Record.GetDetectorState().Count; got != 3 {
+		t.Errorf("expected detector state to be persisted with 3 points; got %d", got)
+	}
+}
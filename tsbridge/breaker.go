@@ -0,0 +1,108 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has the circuit breaker used to skip metrics of unavailable source hosts.
+package tsbridge
+
+import (
+	"sync"
+	"time"
+)
+
+// sourceHoster is implemented by source metrics that query a specific host. Metrics of sources that do not
+// implement it are never skipped by the circuit breaker.
+type sourceHoster interface {
+	SourceHost() string
+}
+
+// sourceHost returns the host queried by a source metric, or an empty string if it's not known.
+func sourceHost(s SourceMetric) string {
+	if h, ok := s.(sourceHoster); ok {
+		return h.SourceHost()
+	}
+	return ""
+}
+
+// CircuitBreaker keeps track of consecutive failures of source hosts. Once a host fails `threshold` times in a row,
+// the breaker trips and all metrics querying that host are skipped for the cool-down period. After the cool-down
+// period, metrics are attempted again; a single failure trips the breaker again, while a single success resets it.
+// A CircuitBreaker is safe for concurrent use and is meant to be shared across metric updates. A nil CircuitBreaker
+// never trips.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+}
+
+// hostState keeps circuit breaker state for a single source host.
+type hostState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// NewCircuitBreaker returns a new CircuitBreaker.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		hosts:     make(map[string]*hostState),
+	}
+}
+
+// Allow returns whether metrics querying a given host should be updated. If not, it also returns the time until
+// which the host will be skipped.
+func (b *CircuitBreaker) Allow(host string) (bool, time.Time) {
+	if b == nil || host == "" {
+		return true, time.Time{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if st, ok := b.hosts[host]; ok && time.Now().Before(st.openUntil) {
+		return false, st.openUntil
+	}
+	return true, time.Time{}
+}
+
+// Success resets the failure count of a given host.
+func (b *CircuitBreaker) Success(host string) {
+	if b == nil || host == "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.hosts, host)
+}
+
+// Failure records a failure of a given host, returning true if it has tripped the breaker.
+func (b *CircuitBreaker) Failure(host string) bool {
+	if b == nil || host == "" {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.hosts[host]
+	if !ok {
+		st = &hostState{}
+		b.hosts[host] = st
+	}
+	st.failures++
+	if st.failures < b.threshold {
+		return false
+	}
+	st.openUntil = time.Now().Add(b.cooldown)
+	return true
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/datastore"
+	"github.com/google/ts-bridge/mocks"
+
+	"github.com/golang/mock/gomock"
+	"go.opencensus.io/stats/view"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := NewCircuitBreaker(2, 50*time.Millisecond)
+
+	if b.Failure("host1") {
+		t.Errorf("expected breaker not to trip after a single failure")
+	}
+	if ok, _ := b.Allow("host1"); !ok {
+		t.Errorf("expected host1 to be allowed after a single failure")
+	}
+	if !b.Failure("host1") {
+		t.Errorf("expected breaker to trip after two failures")
+	}
+	if ok, _ := b.Allow("host1"); ok {
+		t.Errorf("expected host1 to be skipped after two failures")
+	}
+	if ok, _ := b.Allow("host2"); !ok {
+		t.Errorf("expected host2 to be allowed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := b.Allow("host1"); !ok {
+		t.Errorf("expected host1 to be allowed after the cool-down period")
+	}
+	// A single failure after cool-down period trips the breaker again.
+	if !b.Failure("host1") {
+		t.Errorf("expected breaker to trip again after cool-down period")
+	}
+	b.Success("host1")
+	if ok, _ := b.Allow("host1"); !ok {
+		t.Errorf("expected host1 to be allowed after a success")
+	}
+
+	var nilBreaker *CircuitBreaker
+	if nilBreaker.Failure("host1") {
+		t.Errorf("expected nil breaker to never trip")
+	}
+	if ok, _ := nilBreaker.Allow("host1"); !ok {
+		t.Errorf("expected nil breaker to allow all hosts")
+	}
+}
+
+// hostedSource is a source metric that reports its host to the circuit breaker.
+type hostedSource struct {
+	*mocks.MockSourceMetric
+}
+
+func (s *hostedSource) SourceHost() string { return "source-host" }
+
+func TestMetricUpdateCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	src := mocks.NewMockSourceMetric(mockCtrl)
+	src.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	// The source is only queried once; the second update is skipped.
+	src.EXPECT().StackdriverData(gomock.Any(), gomock.Any(), gomock.Any()).Times(1).Return(nil, nil, fmt.Errorf("timeout"))
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), gomock.Any(), gomock.Any()).Times(1).Return(time.Now(), nil)
+
+	rec := &datastore.StoredMetricRecord{Name: "metricname", Storage: storage}
+	m := &Metric{Name: "metricname", Source: &hostedSource{src}, SDProject: "sd-project", Record: rec,
+		Breaker: NewCircuitBreaker(1, time.Hour)}
+
+	collector, exporter := fakeStats(t)
+	for i := 0; i < 2; i++ {
+		if err := m.Update(ctx, mockSD, collector); err != nil {
+			t.Errorf("Metric.Update() returned error %v", err)
+		}
+	}
+	collector.Close()
+
+	if !strings.Contains(rec.LastStatus, "source host source-host has been failing") {
+		t.Errorf("expected status to mention the failing source host; got %v", rec.LastStatus)
+	}
+	val, ok := exporter.values["ts_bridge/metric_skips:metricname"]
+	if !ok || val.(*view.CountData).Value != 1 {
+		t.Errorf("expected to see 1 skip reported; got %v", val)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to daily budgets of points written to Stackdriver.
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/ts-bridge/notify"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+	"github.com/google/ts-bridge/usage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// budgetDay returns the day that points written at a given time count towards. Budgets reset at midnight UTC.
+func budgetDay(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+// ProjectBudget limits the number of points written to a destination project per day, across all metrics written
+// to it. Points written before the budget was created are read from metric records, so budgets are kept across
+// syncs even though the configuration is read again for each of them.
+type ProjectBudget struct {
+	Project string
+	Limit   int64
+
+	mu     sync.Mutex
+	day    string
+	points int64
+}
+
+// NewProjectBudget returns the budget of a project, counting points that `metrics` have written on the day of
+// `now`. It needs to be called before any of the metrics are updated.
+func NewProjectBudget(project string, limit int64, metrics []*Metric, now time.Time) *ProjectBudget {
+	b := &ProjectBudget{Project: project, Limit: limit, day: budgetDay(now)}
+	for _, m := range metrics {
+		if d := m.Record.GetDailyPoints(); d.Day == b.day {
+			b.points += d.Points
+		}
+	}
+	return b
+}
+
+// spent returns the number of points written to the project on a given day.
+func (b *ProjectBudget) spent(day string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.day != day {
+		return 0
+	}
+	return b.points
+}
+
+// add counts points written to the project on a given day.
+func (b *ProjectBudget) add(day string, points int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.day != day {
+		b.day = day
+		b.points = 0
+	}
+	b.points += points
+}
+
+// setProjectBudgets creates budgets of all destination projects that have `max_daily_points` configured. If several
+// destinations refer to the same project, the lowest limit applies.
+func (c *Config) setProjectBudgets(sections []*MetricSection, now time.Time) {
+	limits := make(map[string]int64)
+	for _, s := range sections {
+		for _, d := range s.StackdriverDestinations {
+			if l, ok := limits[d.ProjectID]; d.MaxDailyPoints > 0 && (!ok || d.MaxDailyPoints < l) {
+				limits[d.ProjectID] = d.MaxDailyPoints
+			}
+		}
+	}
+	metrics := make(map[string][]*Metric)
+	for _, m := range c.metrics {
+		if _, ok := limits[m.SDProject]; ok {
+			metrics[m.SDProject] = append(metrics[m.SDProject], m)
+		}
+	}
+	for project, limit := range limits {
+		b := NewProjectBudget(project, limit, metrics[project], now)
+		for _, m := range metrics[project] {
+			m.ProjectBudget = b
+		}
+	}
+}
+
+// hasBudget returns true if points written by the metric count towards a budget.
+func (m *Metric) hasBudget() bool {
+	return m.Options.MaxDailyPoints > 0 || m.ProjectBudget != nil
+}
+
+// checkBudget returns an error classified as tserrors.ErrBudgetExceeded if the metric or its destination project
+// have exceeded their daily budget, which pauses imports until the budget resets. The budget notification channels
+// of the metric are notified the first time this happens during a day.
+func (m *Metric) checkBudget(ctx context.Context, now time.Time) error {
+	if !m.hasBudget() {
+		return nil
+	}
+	day := budgetDay(now)
+	daily := m.Record.GetDailyPoints()
+	if daily.Day != day {
+		daily = storage.DailyPoints{Day: day}
+	}
+	var err error
+	var spent int64
+	if limit := m.Options.MaxDailyPoints; limit > 0 && daily.Points >= limit {
+		spent = daily.Points
+		err = fmt.Errorf("imports paused until midnight UTC: %d points written today, max_daily_points is %d", spent, limit)
+	} else if b := m.ProjectBudget; b != nil && b.spent(day) >= b.Limit {
+		spent = b.spent(day)
+		err = fmt.Errorf("imports paused until midnight UTC: %d points written to project %s today, its max_daily_points is %d", spent, b.Project, b.Limit)
+	}
+	if err == nil {
+		return nil
+	}
+	if !daily.Notified {
+		log.WithContext(ctx).Errorf("%s: %v", m.Name, err)
+		m.notifyBudget(ctx, err, spent, now)
+		daily.Notified = true
+		if rerr := m.Record.SetDailyPoints(ctx, daily); rerr != nil {
+			return rerr
+		}
+	}
+	return tserrors.Wrap(tserrors.ErrBudgetExceeded, err)
+}
+
+// notifyBudget notifies the budget notification channels of the metric that imports have been paused. Like import
+// notifications, failures are only logged.
+func (m *Metric) notifyBudget(ctx context.Context, budgetErr error, spent int64, now time.Time) {
+	n := &notify.Notification{
+		Metric:    m.Name,
+		Rule:      "max_daily_points",
+		Value:     float64(spent),
+		Timestamp: now,
+		Text:      fmt.Sprintf("%s: %v", m.Name, budgetErr),
+	}
+	for _, channel := range m.Options.BudgetNotifications {
+		if err := m.Notifiers[channel].Notify(ctx, n); err != nil {
+			log.WithContext(ctx).Warningf("%s: cannot send budget notification to channel %s: %v", m.Name, channel, err)
+		}
+	}
+}
+
+// spendBudget counts points written by the metric towards its budgets.
+func (m *Metric) spendBudget(ctx context.Context, points int64, now time.Time) error {
+	if points == 0 || !m.hasBudget() {
+		return nil
+	}
+	day := budgetDay(now)
+	if m.ProjectBudget != nil {
+		m.ProjectBudget.add(day, points)
+	}
+	daily := m.Record.GetDailyPoints()
+	if daily.Day != day {
+		daily = storage.DailyPoints{Day: day}
+	}
+	daily.Points += points
+	return m.Record.SetDailyPoints(ctx, daily)
+}
+
+// spendWritten counts points written during the current update since it was last called towards the budgets of the
+// metric, using the usage counter of the update. If the points cannot be counted, an error classified as
+// tserrors.ErrBudgetExceeded is returned, since the metric might have exceeded its budget.
+func (m *Metric) spendWritten(ctx context.Context, imported *importedPoints, now time.Time) error {
+	c := usage.FromContext(ctx)
+	if c == nil {
+		return nil
+	}
+	written := c.Counts().PointsWritten
+	n := written - imported.budgeted
+	imported.budgeted = written
+	if err := m.spendBudget(ctx, n, now); err != nil {
+		return tserrors.Wrap(tserrors.ErrBudgetExceeded, fmt.Errorf("imports paused: cannot count %d written points towards the daily budget: %w", n, err))
+	}
+	return nil
+}
+
+// checkWriteBudget is called before each write of an update, so that an update importing many chunks (e.g. the
+// first import of a wildcard metric) stops once the budget is used up instead of only being paused afterwards.
+func (m *Metric) checkWriteBudget(ctx context.Context, imported *importedPoints, now time.Time) error {
+	if !m.hasBudget() {
+		return nil
+	}
+	if err := m.spendWritten(ctx, imported, now); err != nil {
+		return err
+	}
+	return m.checkBudget(ctx, now)
+}
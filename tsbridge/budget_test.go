@@ -0,0 +1,216 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/memory"
+	"github.com/google/ts-bridge/mocks"
+	"github.com/google/ts-bridge/notify"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+	"github.com/google/ts-bridge/usage"
+
+	"github.com/golang/mock/gomock"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func budgetMetric(name, project string, limit int64) (*Metric, *fakeNotifier) {
+	n := &fakeNotifier{}
+	m := &Metric{
+		Name:      name,
+		SDProject: project,
+		Record:    &memory.StoredMetricRecord{Name: name},
+		Options:   MetricOptions{MaxDailyPoints: limit, BudgetNotifications: []string{"finops"}},
+		Notifiers: map[string]notify.Notifier{"finops": n},
+	}
+	return m, n
+}
+
+func TestMetricBudget(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	m, n := budgetMetric("m1", "p1", 100)
+
+	if err := m.spendBudget(ctx, 60, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.checkBudget(ctx, now); err != nil {
+		t.Errorf("checkBudget() below the limit returned %v", err)
+	}
+	if err := m.spendBudget(ctx, 40, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		err := m.checkBudget(ctx, now.Add(2*time.Minute))
+		if !errors.Is(err, tserrors.ErrBudgetExceeded) {
+			t.Errorf("checkBudget() at the limit returned %v; want %v", err, tserrors.ErrBudgetExceeded)
+		}
+	}
+	if len(n.sent) != 1 {
+		t.Fatalf("expected a single budget notification; got %d", len(n.sent))
+	}
+	if got := n.sent[0]; got.Metric != "m1" || got.Value != 100 {
+		t.Errorf("unexpected budget notification %+v", got)
+	}
+
+	// Budgets reset at midnight UTC.
+	if err := m.checkBudget(ctx, now.Add(12*time.Hour)); err != nil {
+		t.Errorf("checkBudget() on the next day returned %v", err)
+	}
+	if err := m.spendBudget(ctx, 5, now.Add(12*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	want := storage.DailyPoints{Day: "2020-05-02", Points: 5}
+	if got := m.Record.GetDailyPoints(); got != want {
+		t.Errorf("GetDailyPoints() = %+v; want %+v", got, want)
+	}
+}
+
+func TestProjectBudget(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	m1, n1 := budgetMetric("m1", "p1", 0)
+	m2, n2 := budgetMetric("m2", "p1", 0)
+	other, _ := budgetMetric("m3", "p2", 0)
+	m1.Record.SetDailyPoints(ctx, storage.DailyPoints{Day: "2020-05-01", Points: 30})
+	m2.Record.SetDailyPoints(ctx, storage.DailyPoints{Day: "2020-04-30", Points: 1000})
+
+	c := &Config{metrics: []*Metric{m1, m2, other}}
+	c.setProjectBudgets([]*MetricSection{
+		{StackdriverDestinations: []*DestinationConfig{{Name: "a", ProjectID: "p1", MaxDailyPoints: 100}, {Name: "c", ProjectID: "p2"}}},
+		{StackdriverDestinations: []*DestinationConfig{{Name: "b", ProjectID: "p1", MaxDailyPoints: 50}}},
+	}, now)
+	if m1.ProjectBudget == nil || m1.ProjectBudget != m2.ProjectBudget {
+		t.Fatalf("expected metrics of the same project to share a budget")
+	}
+	if other.ProjectBudget != nil {
+		t.Errorf("expected no budget for a project without max_daily_points")
+	}
+	if got := m1.ProjectBudget.Limit; got != 50 {
+		t.Errorf("expected the lowest limit to apply; got %d", got)
+	}
+	if got := m1.ProjectBudget.spent("2020-05-01"); got != 30 {
+		t.Errorf("expected points written earlier today to be counted; got %d", got)
+	}
+
+	if err := m2.spendBudget(ctx, 20, now); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*Metric{m1, m2} {
+		if err := m.checkBudget(ctx, now); !errors.Is(err, tserrors.ErrBudgetExceeded) {
+			t.Errorf("checkBudget() of %s returned %v; want %v", m.Name, err, tserrors.ErrBudgetExceeded)
+		}
+	}
+	if len(n1.sent) != 1 || len(n2.sent) != 1 {
+		t.Errorf("expected a budget notification for each metric; got %d and %d", len(n1.sent), len(n2.sent))
+	}
+	if err := other.checkBudget(ctx, now); err != nil {
+		t.Errorf("checkBudget() of another project returned %v", err)
+	}
+}
+
+// brokenBudgetRecord is a metric record that cannot save daily points.
+type brokenBudgetRecord struct {
+	*memory.StoredMetricRecord
+}
+
+func (r *brokenBudgetRecord) SetDailyPoints(context.Context, storage.DailyPoints) error {
+	return errors.New("storage unavailable")
+}
+
+func TestMetricUpdateBudgetNotSaved(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	m, _ := budgetMetric("m1", "sd-project", 100)
+	rec := &brokenBudgetRecord{&memory.StoredMetricRecord{Name: "m1"}}
+	m.Record = rec
+	src := mocks.NewMockSourceMetric(mockCtrl)
+	src.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m.Source = src
+
+	latest := time.Now().Add(-time.Hour).Truncate(time.Second)
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	src.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(&metricpb.MetricDescriptor{}, gaugeSeries(latest.Add(time.Minute), time.Minute, 1, 2), nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _, _ string, _ *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) error {
+			usage.AddStackdriverCall(ctx, len(ts))
+			return nil
+		})
+
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+	res := m.update(ctx, mockSD, collector)
+	if res.RecordErr != nil {
+		t.Fatalf("update() returned record error %v", res.RecordErr)
+	}
+	// Written points are still recorded, while the metric is reported as paused.
+	if res.Points != 2 || rec.GetLastUpdate().IsZero() {
+		t.Errorf("expected the import of 2 points to be recorded; got %d points, last update %v", res.Points, rec.GetLastUpdate())
+	}
+	if !errors.Is(res.Err, tserrors.ErrBudgetExceeded) {
+		t.Errorf("expected a budget error; got %v", res.Err)
+	}
+	if status := rec.GetLastStatus(); !strings.Contains(status, "imports paused") {
+		t.Errorf("expected the metric to be reported as paused; got status %q", status)
+	}
+}
+
+func TestMetricUpdateBudgetExceededByChunks(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	m, source := newChunkedMetric(t, ctx, mockCtrl, "budget_chunks_metric", true)
+	m.Options.MaxDailyPoints = 2
+	latest := time.Now().Add(-15 * time.Hour).Truncate(time.Second)
+	source.data = func(since, until time.Time) ([]*monitoringpb.TimeSeries, error) {
+		return gaugeSeries(since.Add(time.Hour), time.Minute, 1, 2), nil
+	}
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	// Only the first chunk is written, since it uses up the budget.
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _, _ string, _ *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) error {
+			usage.AddStackdriverCall(ctx, len(ts))
+			return nil
+		})
+
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+	res := m.update(ctx, mockSD, collector)
+	if res.RecordErr != nil {
+		t.Fatalf("update() returned record error %v", res.RecordErr)
+	}
+	if !errors.Is(res.Err, tserrors.ErrBudgetExceeded) {
+		t.Errorf("expected the update to stop with a budget error; got %v", res.Err)
+	}
+	if got := m.Record.GetDailyPoints().Points; got != 2 {
+		t.Errorf("expected 2 points to be counted towards the budget; got %d", got)
+	}
+	// The next update continues after the chunk that has been written.
+	if got := m.Record.GetResumeTime(); !got.Equal(latest.Add(6 * time.Hour)) {
+		t.Errorf("expected resume time %v; got %v", latest.Add(6*time.Hour), got)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to splitting long time ranges into several source queries.
+package tsbridge
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/ts-bridge/storage"
+
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// windowedSource is implemented by source metrics that can query points up to a given time, which allows a long
+// time range (e.g. during the first import of a metric, or after downtime) to be imported in several chunks.
+type windowedSource interface {
+	// Windowed returns false if points of the metric cannot be queried in windows, e.g. because cumulative points
+	// are queried from the start time of the counter.
+	Windowed() bool
+	// StackdriverDataUntil works like StackdriverData, but only returns points up to `until`.
+	StackdriverDataUntil(ctx context.Context, since, until time.Time, record storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error)
+}
+
+// chunkEnd returns the end of the chunk of the time range starting at `since` that should be imported next, and
+// whether the time range needs to be split at all. Time ranges are only split for sources that support windowed
+// queries, if a chunk size is configured.
+func (m *Metric) chunkEnd(since time.Time) (time.Time, bool) {
+	if m.QueryChunk <= 0 {
+		return time.Time{}, false
+	}
+	if w, ok := m.Source.(windowedSource); !ok || !w.Windowed() {
+		return time.Time{}, false
+	}
+	until := since.Add(m.QueryChunk)
+	if !until.Before(time.Now()) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// sourceData queries points of the source metric after `since`, up to `until` if the time range is chunked.
+func (m *Metric) sourceData(ctx context.Context, since, until time.Time, chunked bool) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	if chunked {
+		return m.Source.(windowedSource).StackdriverDataUntil(ctx, since, until, m.Record)
+	}
+	return m.Source.StackdriverData(ctx, since, m.Record)
+}
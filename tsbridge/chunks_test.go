@@ -0,0 +1,152 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/datastore"
+	"github.com/google/ts-bridge/mocks"
+	"github.com/google/ts-bridge/storage"
+
+	"github.com/golang/mock/gomock"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// windowedFake adds windowed queries to a mock source metric. Queried windows are recorded, and each of them
+// returns the result of `data`.
+type windowedFake struct {
+	*mocks.MockSourceMetric
+	windowed bool
+	windows  [][2]time.Time
+	data     func(since, until time.Time) ([]*monitoringpb.TimeSeries, error)
+}
+
+func (f *windowedFake) Windowed() bool {
+	return f.windowed
+}
+
+func (f *windowedFake) StackdriverDataUntil(ctx context.Context, since, until time.Time, record storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	f.windows = append(f.windows, [2]time.Time{since, until})
+	ts, err := f.data(since, until)
+	return &metricpb.MetricDescriptor{Type: "sd-metricname"}, ts, err
+}
+
+func newChunkedMetric(t *testing.T, ctx context.Context, mockCtrl *gomock.Controller, name string, windowed bool) (*Metric, *windowedFake) {
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	source := &windowedFake{MockSourceMetric: mockSource, windowed: windowed}
+	m, err := NewMetric(ctx, name, source, "sd-project", datastore.New(ctx, &datastore.Options{}))
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+	m.QueryChunk = 6 * time.Hour
+	return m, source
+}
+
+func TestMetricUpdateChunked(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	m, source := newChunkedMetric(t, ctx, mockCtrl, "chunked_metric", true)
+	latest := time.Now().Add(-15 * time.Hour).Truncate(time.Second)
+	source.data = func(since, until time.Time) ([]*monitoringpb.TimeSeries, error) {
+		if since.Equal(latest) {
+			return gaugeSeries(latest.Add(time.Hour), time.Minute, 1, 2), nil
+		}
+		// The second chunk does not have any points.
+		return nil, nil
+	}
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	// The rest of the time range is shorter than a chunk, so it's queried as usual.
+	source.EXPECT().StackdriverData(gomock.Any(), latest.Add(12*time.Hour), gomock.Any()).Return(
+		&metricpb.MetricDescriptor{Type: "sd-metricname"}, gaugeSeries(latest.Add(13*time.Hour), time.Minute, 3), nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", gomock.Any(), gomock.Any()).Return(nil).Times(2)
+
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+	res := m.update(ctx, mockSD, collector)
+	if res.Err != nil || res.RecordErr != nil {
+		t.Fatalf("Metric.update() returned errors %v, %v", res.Err, res.RecordErr)
+	}
+	want := [][2]time.Time{{latest, latest.Add(6 * time.Hour)}, {latest.Add(6 * time.Hour), latest.Add(12 * time.Hour)}}
+	if !reflect.DeepEqual(source.windows, want) {
+		t.Errorf("expected windows %v to be queried; got %v", want, source.windows)
+	}
+	if res.Points != 3 {
+		t.Errorf("expected 3 points to be written; got %d", res.Points)
+	}
+	if got := m.Record.GetResumeTime(); !got.IsZero() {
+		t.Errorf("expected resume time to be cleared after the last chunk; got %v", got)
+	}
+}
+
+func TestMetricUpdateChunkFailure(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	m, source := newChunkedMetric(t, ctx, mockCtrl, "chunk_failure_metric", true)
+	latest := time.Now().Add(-15 * time.Hour).Truncate(time.Second)
+	source.data = func(since, until time.Time) ([]*monitoringpb.TimeSeries, error) {
+		if since.Equal(latest) {
+			return gaugeSeries(latest.Add(time.Hour), time.Minute, 1), nil
+		}
+		return nil, fmt.Errorf("query timed out")
+	}
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", gomock.Any(), gomock.Any()).Return(nil)
+
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+	res := m.update(ctx, mockSD, collector)
+	if res.Err == nil {
+		t.Fatalf("expected Metric.update() to fail")
+	}
+	// The next update continues after the chunk that has been imported.
+	if got := m.Record.GetResumeTime(); !got.Equal(latest.Add(6 * time.Hour)) {
+		t.Errorf("expected resume time %v to be persisted; got %v", latest.Add(6*time.Hour), got)
+	}
+}
+
+func TestMetricUpdateNotWindowed(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	m, source := newChunkedMetric(t, ctx, mockCtrl, "not_windowed_metric", false)
+	latest := time.Now().Add(-15 * time.Hour).Truncate(time.Second)
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	source.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(nil, nil, nil)
+
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+	if res := m.update(ctx, mockSD, collector); res.Err != nil {
+		t.Fatalf("Metric.update() returned error %v", res.Err)
+	}
+	if len(source.windows) != 0 {
+		t.Errorf("expected no windowed queries; got %v", source.windows)
+	}
+}
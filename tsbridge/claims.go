@@ -0,0 +1,80 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to claiming metric imports, so that redundant instances sharing a storage engine do not
+// write overlapping points.
+package tsbridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/ts-bridge/storage"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ImportClaims are used by each metric update to claim the import of the metric in shared storage. Only one instance
+// can hold the claim on a metric at a time, and imports start after the cursor of the metric, which is the newest
+// point written by any instance, so that instances importing the same metrics never write the same window twice.
+type ImportClaims struct {
+	Claimer storage.Claimer
+	// Owner identifies this instance in claims.
+	Owner string
+	// Lease is how long a claim is held before other instances can take it over, if it's not released. It needs to
+	// be longer than the longest metric update.
+	Lease time.Duration
+}
+
+// releaseTimeout limits the time spent releasing a claim after an update.
+const releaseTimeout = 10 * time.Second
+
+// NewImportClaims returns import claims of an instance, or an error if the storage manager does not support them.
+func NewImportClaims(m storage.Manager, owner string, lease time.Duration) (*ImportClaims, error) {
+	c, ok := m.(storage.Claimer)
+	if !ok {
+		return nil, fmt.Errorf("the storage engine does not support import claims")
+	}
+	return &ImportClaims{Claimer: c, Owner: owner, Lease: lease}, nil
+}
+
+// claimImport claims the import of the metric, and returns the cursor of the metric along with a function that
+// releases the claim, advancing the cursor to the newest imported point. Without import claims, the cursor is zero.
+// The returned error wraps storage.ErrClaimed if another instance is importing the metric.
+func (m *Metric) claimImport(ctx context.Context, imported *importedPoints) (time.Time, func(), error) {
+	if m.Claims == nil {
+		return time.Time{}, func() {}, nil
+	}
+	c := m.Claims
+	cursor, err := c.Claimer.ClaimImport(ctx, m.Name, c.Owner, time.Now().Add(c.Lease))
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	release := func() {
+		// The claim is released even if the update ran out of time, so that other instances don't need to wait.
+		rctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+		defer cancel()
+		if err := c.Claimer.ReleaseImport(rctx, m.Name, c.Owner, imported.newest); err != nil {
+			if errors.Is(err, storage.ErrClaimed) {
+				log.WithContext(ctx).Warningf("%s: the update took longer than the claim lease of %v, points might have been written twice: %v", m.Name, c.Lease, err)
+				return
+			}
+			log.WithContext(ctx).Errorf("%s: %v", m.Name, err)
+		}
+	}
+	return cursor, release, nil
+}
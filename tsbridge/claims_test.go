@@ -0,0 +1,93 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/ts-bridge/datastore"
+	"github.com/google/ts-bridge/mocks"
+	"github.com/google/ts-bridge/storage"
+
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestMetricUpdateImportClaims(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	manager := datastore.New(ctx, &datastore.Options{})
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m, err := NewMetric(ctx, "claimed_metric", mockSource, "sd-project", manager)
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+	if m.Claims, err = NewImportClaims(manager, "instance-a", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+
+	// While another instance holds the claim, the update is skipped without touching the metric record.
+	if _, err := manager.ClaimImport(ctx, "claimed_metric", "instance-b", time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	res := m.update(ctx, mockSD, collector)
+	if !res.Skipped || res.Err != nil || res.RecordErr != nil {
+		t.Errorf("expected update to be skipped; got %+v", res)
+	}
+	if !m.Record.GetLastAttempt().IsZero() {
+		t.Errorf("expected metric record to be left unchanged; got last attempt %v", m.Record.GetLastAttempt())
+	}
+
+	// Once the other instance has released the claim, the import continues after its newest point, even if it's not
+	// visible in Stackdriver yet.
+	latest := time.Now().Add(-time.Hour).Truncate(time.Second)
+	cursor := latest.Add(10 * time.Minute)
+	if err := manager.ReleaseImport(ctx, "claimed_metric", "instance-b", cursor); err != nil {
+		t.Fatal(err)
+	}
+	desc := &metricpb.MetricDescriptor{Type: "sd-metricname"}
+	ts := gaugeSeries(cursor.Add(time.Minute), time.Minute, 1, 2)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	mockSource.EXPECT().StackdriverData(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, since time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+			if !since.Equal(cursor) {
+				t.Errorf("expected source to be queried after the cursor %v; got %v", cursor, since)
+			}
+			return desc, ts, nil
+		})
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", desc, gomock.Len(2)).Return(nil)
+	if res := m.update(ctx, mockSD, collector); res.Skipped || res.Err != nil || res.Points != 2 {
+		t.Errorf("expected update to write 2 points; got %+v", res)
+	}
+
+	// The claim has been released, and the cursor advanced to the newest written point.
+	got, err := manager.ClaimImport(ctx, "claimed_metric", "instance-b", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("expected the claim to be released; got %v", err)
+	}
+	if want := cursor.Add(2 * time.Minute); !got.Equal(want) {
+		t.Errorf("expected cursor %v; got %v", want, got)
+	}
+}
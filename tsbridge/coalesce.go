@@ -0,0 +1,205 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to coalescing points that are too close to each other to be written to Stackdriver.
+package tsbridge
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// sdMinSamplingPeriod is the shortest interval between two points of a single time series that Stackdriver accepts.
+// See https://cloud.google.com/monitoring/quotas#custom_metrics_quotas
+const sdMinSamplingPeriod = 5 * time.Second
+
+// Coalescing strategies that can be configured for a metric.
+const (
+	// CoalesceFirst keeps the earliest point and drops all points that follow it too closely. This is the default.
+	CoalesceFirst = "first"
+	// CoalesceLast keeps the latest point and drops all points that precede it too closely.
+	CoalesceLast = "last"
+	// CoalesceMean, CoalesceSum, CoalesceMin and CoalesceMax merge points that are too close to each other into a
+	// single point that has the timestamp of the latest point and an aggregated value.
+	CoalesceMean = "mean"
+	CoalesceSum  = "sum"
+	CoalesceMin  = "min"
+	CoalesceMax  = "max"
+)
+
+// coalescedPoint is a single point along with the time series it belongs to.
+type coalescedPoint struct {
+	series *monitoringpb.TimeSeries
+	point  *monitoringpb.Point
+	end    time.Time
+}
+
+// coalescePoints makes sure that points of each time series are at least `interval` apart from each other, and are
+// at least `interval` after `latest` (the timestamp of the most recent point already written to Stackdriver).
+// Points that are too close are merged according to the coalescing strategy. It returns the resulting time series
+// (with a single point each, sorted by time) and the number of points that have been removed. If no points need to
+// be removed, the original time series are returned.
+func coalescePoints(series []*monitoringpb.TimeSeries, strategy string, interval time.Duration, latest time.Time) ([]*monitoringpb.TimeSeries, int, error) {
+	if strategy == "" {
+		strategy = CoalesceFirst
+	}
+	if interval == 0 {
+		interval = sdMinSamplingPeriod
+	}
+
+	// Points are grouped by the time series they belong to, since spacing only matters within a single time series.
+	var keys []string
+	groups := make(map[string][]*coalescedPoint)
+	total := 0
+	for _, ts := range series {
+		if ts.MetricKind == metricpb.MetricDescriptor_CUMULATIVE && strategy != CoalesceFirst && strategy != CoalesceLast {
+			return nil, 0, fmt.Errorf("coalescing strategy '%s' cannot be used with cumulative metrics", strategy)
+		}
+		key := proto.CompactTextString(ts.Metric) + proto.CompactTextString(ts.Resource)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		for _, p := range ts.Points {
+			end, err := ptypes.Timestamp(p.GetInterval().GetEndTime())
+			if err != nil {
+				return nil, 0, fmt.Errorf("could not parse point timestamp for %v: %v", p, err)
+			}
+			groups[key] = append(groups[key], &coalescedPoint{series: ts, point: p, end: end})
+			total++
+		}
+	}
+
+	var points []*coalescedPoint
+	for _, key := range keys {
+		group := groups[key]
+		sort.SliceStable(group, func(i, j int) bool { return group[i].end.Before(group[j].end) })
+
+		// Points that are too close to the last point written during a previous update are always dropped.
+		first := 0
+		for first < len(group) && group[first].end.Sub(latest) < interval {
+			first++
+		}
+		group = group[first:]
+
+		if strategy == CoalesceFirst {
+			points = append(points, coalesceForward(group, interval)...)
+		} else {
+			points = append(points, coalesceBackward(group, strategy, interval)...)
+		}
+	}
+	if len(points) == total {
+		// Nothing had to be coalesced, so the original time series can be written as they are.
+		return series, 0, nil
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].end.Before(points[j].end) })
+
+	output := make([]*monitoringpb.TimeSeries, 0, len(points))
+	for _, p := range points {
+		ts := proto.Clone(p.series).(*monitoringpb.TimeSeries)
+		ts.Points = []*monitoringpb.Point{p.point}
+		output = append(output, ts)
+	}
+	return output, total - len(output), nil
+}
+
+// coalesceForward keeps the earliest point of a sorted slice and drops subsequent points that are too close to it.
+func coalesceForward(points []*coalescedPoint, interval time.Duration) []*coalescedPoint {
+	var output []*coalescedPoint
+	for _, p := range points {
+		if len(output) > 0 && p.end.Sub(output[len(output)-1].end) < interval {
+			continue
+		}
+		output = append(output, p)
+	}
+	return output
+}
+
+// coalesceBackward walks a sorted slice from the latest point, merging each point with all preceding points that
+// are too close to it. Merged points keep the timestamp of the latest point in the group.
+func coalesceBackward(points []*coalescedPoint, strategy string, interval time.Duration) []*coalescedPoint {
+	var output []*coalescedPoint
+	for end := len(points) - 1; end >= 0; {
+		start := end
+		for start > 0 && points[end].end.Sub(points[start-1].end) < interval {
+			start--
+		}
+		output = append(output, mergePoints(points[start:end+1], strategy))
+		end = start - 1
+	}
+	// Restore chronological order.
+	for i, j := 0, len(output)-1; i < j; i, j = i+1, j-1 {
+		output[i], output[j] = output[j], output[i]
+	}
+	return output
+}
+
+// mergePoints merges a group of points into a single point according to the coalescing strategy.
+func mergePoints(points []*coalescedPoint, strategy string) *coalescedPoint {
+	latest := points[len(points)-1]
+	if len(points) == 1 || strategy == CoalesceLast {
+		return latest
+	}
+
+	var value float64
+	for i, p := range points {
+		v := pointValue(p.point)
+		switch {
+		case i == 0:
+			value = v
+		case strategy == CoalesceMin:
+			value = math.Min(value, v)
+		case strategy == CoalesceMax:
+			value = math.Max(value, v)
+		default:
+			value += v
+		}
+	}
+	if strategy == CoalesceMean {
+		value /= float64(len(points))
+	}
+
+	merged := proto.Clone(latest.point).(*monitoringpb.Point)
+	switch merged.GetValue().GetValue().(type) {
+	case *monitoringpb.TypedValue_Int64Value:
+		merged.Value.Value = &monitoringpb.TypedValue_Int64Value{Int64Value: int64(math.Round(value))}
+	case *monitoringpb.TypedValue_BoolValue:
+		merged.Value.Value = &monitoringpb.TypedValue_BoolValue{BoolValue: math.Round(value) != 0}
+	default:
+		merged.Value = &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}}
+	}
+	return &coalescedPoint{series: latest.series, point: merged, end: latest.end}
+}
+
+// pointValue returns the numeric value of a point.
+func pointValue(p *monitoringpb.Point) float64 {
+	switch v := p.GetValue().GetValue().(type) {
+	case *monitoringpb.TypedValue_Int64Value:
+		return float64(v.Int64Value)
+	case *monitoringpb.TypedValue_DoubleValue:
+		return v.DoubleValue
+	case *monitoringpb.TypedValue_BoolValue:
+		if v.BoolValue {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// gaugeSeries returns single-point gauge time series with given values, with a point every `step` starting at `start`.
+func gaugeSeries(start time.Time, step time.Duration, values ...float64) []*monitoringpb.TimeSeries {
+	var ts []*monitoringpb.TimeSeries
+	for i, v := range values {
+		end, _ := ptypes.TimestampProto(start.Add(time.Duration(i) * step))
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: "custom.googleapis.com/test"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: end},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: v}},
+			}},
+		})
+	}
+	return ts
+}
+
+// seriesPoints returns offsets (since `start`) and values of all points in a slice of time series.
+func seriesPoints(start time.Time, series []*monitoringpb.TimeSeries) ([]time.Duration, []float64) {
+	var offsets []time.Duration
+	var values []float64
+	for _, ts := range series {
+		for _, p := range ts.Points {
+			end, _ := ptypes.Timestamp(p.Interval.EndTime)
+			offsets = append(offsets, end.Sub(start))
+			values = append(values, pointValue(p))
+		}
+	}
+	return offsets, values
+}
+
+func TestCoalescePoints(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	for _, tt := range []struct {
+		name        string
+		strategy    string
+		interval    time.Duration
+		values      []float64
+		wantOffsets []time.Duration
+		wantValues  []float64
+	}{
+		{"no coalescing needed", "", 2 * time.Second, []float64{1, 2, 3},
+			[]time.Duration{0, 2 * time.Second, 4 * time.Second}, []float64{1, 2, 3}},
+		{"default strategy", "", 0, []float64{1, 2, 3, 4, 5},
+			[]time.Duration{0, 6 * time.Second}, []float64{1, 4}},
+		{"first", "first", 5 * time.Second, []float64{1, 2, 3, 4, 5},
+			[]time.Duration{0, 6 * time.Second}, []float64{1, 4}},
+		{"last", "last", 5 * time.Second, []float64{1, 2, 3, 4, 5},
+			[]time.Duration{2 * time.Second, 8 * time.Second}, []float64{2, 5}},
+		{"mean", "mean", 5 * time.Second, []float64{1, 2, 3, 4, 5},
+			[]time.Duration{2 * time.Second, 8 * time.Second}, []float64{1.5, 4}},
+		{"sum", "sum", 5 * time.Second, []float64{1, 2, 3, 4, 5},
+			[]time.Duration{2 * time.Second, 8 * time.Second}, []float64{3, 12}},
+		{"min", "min", 5 * time.Second, []float64{1, 2, 3, 4, 5},
+			[]time.Duration{2 * time.Second, 8 * time.Second}, []float64{1, 3}},
+		{"max", "max", 5 * time.Second, []float64{1, 2, 3, 4, 5},
+			[]time.Duration{2 * time.Second, 8 * time.Second}, []float64{2, 5}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			series := gaugeSeries(start, 2*time.Second, tt.values...)
+			got, removed, err := coalescePoints(series, tt.strategy, tt.interval, start.Add(-time.Hour))
+			if err != nil {
+				t.Fatalf("coalescePoints() returned error: %v", err)
+			}
+			if removed != len(tt.values)-len(tt.wantValues) {
+				t.Errorf("coalescePoints() expected to remove %d points; removed %d", len(tt.values)-len(tt.wantValues), removed)
+			}
+			offsets, values := seriesPoints(start, got)
+			if !reflect.DeepEqual(offsets, tt.wantOffsets) {
+				t.Errorf("coalescePoints() expected points at %v; got %v", tt.wantOffsets, offsets)
+			}
+			if !reflect.DeepEqual(values, tt.wantValues) {
+				t.Errorf("coalescePoints() expected values %v; got %v", tt.wantValues, values)
+			}
+		})
+	}
+}
+
+func TestCoalescePointsAfterLatest(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	series := gaugeSeries(start, 5*time.Second, 1, 2, 3)
+
+	// The first point is too close to the last point already written to Stackdriver.
+	got, removed, err := coalescePoints(series, "", 0, start.Add(-time.Second))
+	if err != nil {
+		t.Fatalf("coalescePoints() returned error: %v", err)
+	}
+	if removed != 1 {
+		t.Errorf("coalescePoints() expected to remove 1 point; removed %d", removed)
+	}
+	if _, values := seriesPoints(start, got); !reflect.DeepEqual(values, []float64{2, 3}) {
+		t.Errorf("coalescePoints() expected values [2 3]; got %v", values)
+	}
+}
+
+func TestCoalescePointsCumulative(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	series := gaugeSeries(start, time.Second, 1, 2, 3)
+	for _, ts := range series {
+		ts.MetricKind = metricpb.MetricDescriptor_CUMULATIVE
+	}
+
+	if _, _, err := coalescePoints(series, "last", 0, start.Add(-time.Hour)); err != nil {
+		t.Errorf("coalescePoints() returned error for a cumulative metric: %v", err)
+	}
+	_, _, err := coalescePoints(series, "sum", 0, start.Add(-time.Hour))
+	if err == nil || !strings.Contains(err.Error(), "cannot be used with cumulative metrics") {
+		t.Errorf("expected coalescePoints() to reject aggregation of a cumulative metric; got %v", err)
+	}
+}
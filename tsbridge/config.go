@@ -20,27 +20,142 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
-	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/google/ts-bridge/akamai"
+	"github.com/google/ts-bridge/appdynamics"
+	"github.com/google/ts-bridge/cloudflare"
+	"github.com/google/ts-bridge/cloudmonitoring"
 	"github.com/google/ts-bridge/datadog"
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/fastly"
+	"github.com/google/ts-bridge/files"
+	"github.com/google/ts-bridge/graphite"
+	"github.com/google/ts-bridge/icinga"
 	"github.com/google/ts-bridge/influxdb"
+	"github.com/google/ts-bridge/jira"
+	"github.com/google/ts-bridge/kafka"
+	"github.com/google/ts-bridge/lightstep"
+	"github.com/google/ts-bridge/loki"
+	"github.com/google/ts-bridge/mqtt"
+	"github.com/google/ts-bridge/notify"
+	"github.com/google/ts-bridge/oci"
+	"github.com/google/ts-bridge/postgresql"
+	"github.com/google/ts-bridge/probe"
+	"github.com/google/ts-bridge/redfish"
+	"github.com/google/ts-bridge/redis"
+	"github.com/google/ts-bridge/salesforce"
+	"github.com/google/ts-bridge/snowflake"
 	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/sysdig"
+	"github.com/google/ts-bridge/tserrors"
+	"github.com/google/ts-bridge/vsphere"
+	"github.com/google/ts-bridge/webhook"
+	"github.com/google/ts-bridge/zabbix"
 
 	log "github.com/sirupsen/logrus"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	validator "gopkg.in/validator.v2"
 	yaml "gopkg.in/yaml.v2"
 )
 
 // Config is what the YAML configuration file gets deserialized to.
 type Config struct {
+	// Version is the schema version the configuration file was written for. Files of older versions are upgraded
+	// while they are read (see migrate.go).
+	Version int `yaml:"version"`
+
+	MetricSection `yaml:"_,inline"`
+
+	// Tenants have their own metrics and destinations, isolated from the rest of the configuration file.
+	Tenants []*TenantConfig `yaml:"tenants"`
+
+	// internal list of metrics that gets populated when configuration file is read.
+	metrics []*Metric
+	// internal list of derived burn-rate metrics, updated after all other metrics.
+	burnRates []*BurnRate
+	// maximum number of metrics updated in parallel for tenants that have a limit configured.
+	tenantParallelism map[string]int
+	// maximum number of metrics updated in parallel for source types that have their own pool configured.
+	sourceParallelism map[string]int
+	// maximum number of metrics imported for the first time during each update; 0 means no limit.
+	warmStartRamp int
+	// whether unknown keys of metric parameters are ignored instead of rejected.
+	allowUnknownFields bool
+	// tenant the configuration has been scoped to by ForTenant, if any.
+	tenant string
+	// storage keeps metric records. Record writes are batched during each update if it's a storage.Batcher.
+	storage storage.Manager
+}
+
+// MetricSection lists metrics along with Stackdriver destinations they can be written to. The top level of the
+// configuration file is a section, and so is each tenant.
+type MetricSection struct {
 	DatadogMetrics  []*DatadogMetricConfig  `yaml:"datadog_metrics"`
 	InfluxDBMetrics []*InfluxDBMetricConfig `yaml:"influxdb_metrics"`
 
+	// DatadogEvents import Datadog events as a 0/1 series per event type. See datadog/events.go.
+	DatadogEvents []*DatadogEventConfig `yaml:"datadog_events"`
+
+	ZabbixMetrics      []*ZabbixMetricConfig      `yaml:"zabbix_metrics"`
+	AppDynamicsMetrics []*AppDynamicsMetricConfig `yaml:"appdynamics_metrics"`
+	IcingaMetrics      []*IcingaMetricConfig      `yaml:"icinga_metrics"`
+	LightstepMetrics   []*LightstepMetricConfig   `yaml:"lightstep_metrics"`
+	LokiMetrics        []*LokiMetricConfig        `yaml:"loki_metrics"`
+	GraphiteMetrics    []*GraphiteMetricConfig    `yaml:"graphite_metrics"`
+	OCIMetrics         []*OCIMetricConfig         `yaml:"oci_metrics"`
+	SysdigMetrics      []*SysdigMetricConfig      `yaml:"sysdig_metrics"`
+	RedfishMetrics     []*RedfishMetricConfig     `yaml:"redfish_metrics"`
+	MQTTMetrics        []*MQTTMetricConfig        `yaml:"mqtt_metrics"`
+	VSphereMetrics     []*VSphereMetricConfig     `yaml:"vsphere_metrics"`
+	SnowflakeMetrics   []*SnowflakeMetricConfig   `yaml:"snowflake_metrics"`
+	CloudflareMetrics  []*CloudflareMetricConfig  `yaml:"cloudflare_metrics"`
+	FastlyMetrics      []*FastlyMetricConfig      `yaml:"fastly_metrics"`
+	AkamaiMetrics      []*AkamaiMetricConfig      `yaml:"akamai_metrics"`
+	SalesforceMetrics  []*SalesforceMetricConfig  `yaml:"salesforce_metrics"`
+	JIRAMetrics        []*JIRAMetricConfig        `yaml:"jira_metrics"`
+	PostgreSQLMetrics  []*PostgreSQLMetricConfig  `yaml:"postgresql_metrics"`
+	RedisMetrics       []*RedisMetricConfig       `yaml:"redis_metrics"`
+	KafkaMetrics       []*KafkaMetricConfig       `yaml:"kafka_metrics"`
+	ProbeMetrics       []*ProbeMetricConfig       `yaml:"probe_metrics"`
+	FileMetrics        []*FileMetricConfig        `yaml:"file_metrics"`
+	WebhookMetrics     []*WebhookMetricConfig     `yaml:"webhook_metrics"`
+
+	// CloudMonitoringMetrics are read from Cloud Monitoring itself, e.g. to bridge metrics between GCP projects.
+	CloudMonitoringMetrics []*CloudMonitoringMetricConfig `yaml:"cloudmonitoring_metrics"`
+
 	StackdriverDestinations []*DestinationConfig `yaml:"stackdriver_destinations"`
 
-	// internal list of metrics that gets populated when configuration file is read.
-	metrics []*Metric
+	// Sources are named connections to monitoring systems that metrics of the same section can reference. See
+	// sources.go.
+	Sources []*NamedSource `yaml:"sources"`
+
+	// RatioMetrics are computed from queries to two (possibly different) sources. See ratio.go.
+	RatioMetrics []*RatioMetricConfig `yaml:"ratio_metrics"`
+
+	// NotificationChannels receive notifications sent by threshold rules and import notifications of metrics in the
+	// same section.
+	NotificationChannels []*notify.ChannelConfig `yaml:"notification_channels"`
+
+	// SLOBurnRates are derived metrics computed from imported metrics of the same section. See slo.go.
+	SLOBurnRates []*BurnRateConfig `yaml:"slo_burn_rates"`
+
+	// MaintenanceWindows are periods during which metrics of this section are not imported. Windows listed at the
+	// top level of the configuration file apply to tenant metrics as well. See maintenance.go.
+	MaintenanceWindows []*MaintenanceWindow `yaml:"maintenance_windows"`
+}
+
+// TenantConfig defines a tenant: a group of metrics (e.g. owned by a single team) that can only be written to
+// destinations of the same tenant. Metric names are prefixed by the tenant name, so they only need to be unique
+// within a tenant.
+type TenantConfig struct {
+	Name string `validate:"regexp=^[A-Za-z0-9]\\w*$"`
+	// Parallelism limits the number of metrics of this tenant that are updated at the same time, so that a single
+	// tenant cannot use up all of the global update parallelism. 0 means no limit.
+	Parallelism int `validate:"min=0"`
+
+	MetricSection `yaml:"_,inline"`
 }
 
 // DestinationConfig defines configuration for a Stackdriver project metrics are written to.
@@ -48,6 +163,9 @@ type Config struct {
 type DestinationConfig struct {
 	Name      string `validate:"nonzero"`
 	ProjectID string `yaml:"project_id" validate:"regexp=^[A-Za-z0-9:.-]*$"`
+	// MaxDailyPoints pauses imports of all metrics written to the project once they have written this many points
+	// during a day (in UTC). 0 means no limit. See budget.go.
+	MaxDailyPoints int64 `yaml:"max_daily_points" validate:"min=0"`
 }
 
 // SourceMetricConfig defines some common parameters that any imported metric must have, irrespective of the
@@ -55,6 +173,163 @@ type DestinationConfig struct {
 type SourceMetricConfig struct {
 	Name        string `validate:"regexp=^[A-Za-z0-9]\\w*$"`
 	Destination string `validate:"nonzero"`
+	// Profile is the name of a source in the `sources` section, whose parameters are merged into those of the metric.
+	Profile string
+
+	MetricOptions `yaml:"_,inline"`
+}
+
+// MetricOptions defines optional parameters that control how points of an imported metric are processed before
+// being written to Stackdriver, irrespective of the monitoring system data is coming from.
+type MetricOptions struct {
+	// Coalesce defines how points that are closer to each other than MinPointInterval get merged. See coalesce.go
+	// for supported strategies.
+	Coalesce         string        `validate:"regexp=^(|first|last|mean|sum|min|max)$"`
+	MinPointInterval time.Duration `yaml:"min_point_interval"`
+
+	// ExpectedPointInterval enables detection of gaps in imported data. If RepairGaps is set, points following a
+	// gap are held back for up to GapRepairWindow, so that the gap can be filled in by the next update.
+	ExpectedPointInterval time.Duration `yaml:"expected_point_interval"`
+	RepairGaps            bool          `yaml:"repair_gaps"`
+	GapRepairWindow       time.Duration `yaml:"gap_repair_window"`
+
+	// MinPointAge holds back points that are younger than this, since some sources revise recent points for a while.
+	// Unlike the global minimum point age, it's applied to each point returned by the source.
+	MinPointAge time.Duration `yaml:"min_point_age"`
+
+	// MaxClockSkew is how far in the future points can be timestamped, and FuturePoints defines how points beyond it
+	// are handled. See skew.go for supported policies.
+	MaxClockSkew time.Duration `yaml:"max_clock_skew"`
+	FuturePoints string        `yaml:"future_points" validate:"regexp=^(|drop|clamp)$"`
+
+	// Description, DisplayName and Unit override metric descriptor fields set by the source, so that imported
+	// metrics are self-describing in Metrics Explorer.
+	Description string
+	DisplayName string `yaml:"display_name"`
+	Unit        string
+
+	// LabelPolicy defines how label keys and values that Stackdriver would reject are sanitized. See labels.go for
+	// supported policies.
+	LabelPolicy string `yaml:"label_policy" validate:"regexp=^(|truncate|hash|drop)$"`
+	// NewLabelPolicy defines how label keys are handled that the existing metric descriptor does not declare. See
+	// labels.go for supported policies.
+	NewLabelPolicy string `yaml:"new_label_policy" validate:"regexp=^(|add|drop)$"`
+
+	// ValueMapping converts string, boolean or status values into INT64 or BOOL values. See mapping.go.
+	ValueMapping *ValueMapping `yaml:"value_mapping"`
+
+	// SeriesFilters only import time series whose labels match all filters, e.g. `host=~"prod-.*"`. See filter.go.
+	SeriesFilters []string `yaml:"series_filters"`
+
+	// Expression transforms the value of each point before it's written, e.g. `clamp(rate(value) * 8, 0, 1e10)`. See
+	// expression.go.
+	Expression string
+
+	// AnomalyDetection enables writing a companion series that flags anomalous points. See anomaly.go.
+	AnomalyDetection *AnomalyConfig `yaml:"anomaly_detection"`
+
+	// Thresholds are rules evaluated on imported points that send notifications. See threshold.go.
+	Thresholds []*ThresholdRule
+
+	// ImportNotifications are names of notification channels that are notified after each update that imported
+	// new points, e.g. to invalidate downstream caches. See notifications.go.
+	ImportNotifications []string `yaml:"import_notifications"`
+
+	// MaxDailyPoints pauses imports of the metric once it has written this many points during a day (in UTC). 0 means
+	// no limit. See budget.go.
+	MaxDailyPoints int64 `yaml:"max_daily_points" validate:"min=0"`
+
+	// BudgetNotifications are names of notification channels that are notified when imports of the metric are
+	// paused because its budget or the budget of its destination project has been exceeded.
+	BudgetNotifications []string `yaml:"budget_notifications"`
+
+	// VerifyWrites reads written points back from Stackdriver and records missing or different points in stats.
+	// See verify.go.
+	VerifyWrites bool `yaml:"verify_writes"`
+
+	// MaintenanceWindows are periods during which the metric is not imported, in addition to those of its section.
+	// See maintenance.go.
+	MaintenanceWindows []*MaintenanceWindow `yaml:"maintenance_windows"`
+
+	// ExpectedData is the schedule of times the source is expected to produce data at. The age of the metric, e.g. in
+	// oldest_metric_age, only counts time within the schedule. See schedule.go.
+	ExpectedData *DataSchedule `yaml:"expected_data"`
+
+	// LowPriority metrics are updated after all others, and are deferred to the next update when there is not
+	// enough time left before the update timeout.
+	LowPriority bool `yaml:"low_priority"`
+
+	// Canary metrics of a canary configuration get it applied first. See rollout.go.
+	Canary bool
+}
+
+// validate checks metric options that cannot be verified using struct tags.
+func (o *MetricOptions) validate() error {
+	if o.MinPointInterval != 0 && o.MinPointInterval < sdMinSamplingPeriod {
+		return fmt.Errorf("min_point_interval cannot be shorter than %v", sdMinSamplingPeriod)
+	}
+	if o.RepairGaps && o.ExpectedPointInterval <= 0 {
+		return fmt.Errorf("repair_gaps requires expected_point_interval to be set")
+	}
+	if o.GapRepairWindow > sdMaxPointAge {
+		return fmt.Errorf("gap_repair_window cannot be longer than %v", sdMaxPointAge)
+	}
+	if o.MinPointAge < 0 || o.MinPointAge >= sdMaxPointAge {
+		return fmt.Errorf("min_point_age must be between 0 and %v", sdMaxPointAge)
+	}
+	if o.MaxClockSkew < 0 {
+		return fmt.Errorf("max_clock_skew cannot be negative")
+	}
+	if _, err := parseSeriesFilters(o.SeriesFilters); err != nil {
+		return err
+	}
+	if o.Expression != "" {
+		if _, err := ParseExpression(o.Expression); err != nil {
+			return err
+		}
+	}
+	if o.AnomalyDetection != nil {
+		if err := o.AnomalyDetection.validate(); err != nil {
+			return err
+		}
+	}
+	names := make(map[string]bool)
+	for _, r := range o.Thresholds {
+		if names[r.Name] {
+			return fmt.Errorf("several threshold rules are named '%s'", r.Name)
+		}
+		names[r.Name] = true
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	for _, w := range o.MaintenanceWindows {
+		if err := w.validate(); err != nil {
+			return err
+		}
+	}
+	if o.ExpectedData != nil {
+		if err := o.ExpectedData.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describe sets metric descriptor fields that have been configured for a metric.
+func (o *MetricOptions) describe(desc *metricpb.MetricDescriptor) {
+	if desc == nil {
+		return
+	}
+	if o.Description != "" {
+		desc.Description = o.Description
+	}
+	if o.DisplayName != "" {
+		desc.DisplayName = o.DisplayName
+	}
+	if o.Unit != "" {
+		desc.Unit = o.Unit
+	}
 }
 
 // DatadogMetricConfig combines common metric configuration parameters with Datadog-specific ones.
@@ -63,106 +338,1118 @@ type DatadogMetricConfig struct {
 	datadog.MetricConfig `yaml:"_,inline"`
 }
 
+// DatadogEventConfig combines common metric configuration parameters with parameters of imported Datadog events.
+type DatadogEventConfig struct {
+	SourceMetricConfig  `yaml:"_,inline"`
+	datadog.EventConfig `yaml:"_,inline"`
+}
+
 // InfluxDBMetricConfig combines common metric configuration parameters with InfluxDB-specific ones.
 type InfluxDBMetricConfig struct {
 	SourceMetricConfig    `yaml:"_,inline"`
 	influxdb.MetricConfig `yaml:"_,inline"`
 }
 
+// ZabbixMetricConfig combines common metric configuration parameters with Zabbix-specific ones.
+type ZabbixMetricConfig struct {
+	SourceMetricConfig  `yaml:"_,inline"`
+	zabbix.MetricConfig `yaml:"_,inline"`
+}
+
+// AppDynamicsMetricConfig combines common metric configuration parameters with AppDynamics-specific ones.
+type AppDynamicsMetricConfig struct {
+	SourceMetricConfig       `yaml:"_,inline"`
+	appdynamics.MetricConfig `yaml:"_,inline"`
+}
+
+// IcingaMetricConfig combines common metric configuration parameters with parameters of imported Icinga checks.
+type IcingaMetricConfig struct {
+	SourceMetricConfig  `yaml:"_,inline"`
+	icinga.MetricConfig `yaml:"_,inline"`
+}
+
+// LightstepMetricConfig combines common metric configuration parameters with Lightstep-specific ones.
+type LightstepMetricConfig struct {
+	SourceMetricConfig     `yaml:"_,inline"`
+	lightstep.MetricConfig `yaml:"_,inline"`
+}
+
+// CloudMonitoringMetricConfig combines common metric configuration parameters with parameters of time series read
+// from Cloud Monitoring.
+type CloudMonitoringMetricConfig struct {
+	SourceMetricConfig           `yaml:"_,inline"`
+	cloudmonitoring.MetricConfig `yaml:"_,inline"`
+}
+
+// LokiMetricConfig combines common metric configuration parameters with Loki-specific ones.
+type LokiMetricConfig struct {
+	SourceMetricConfig `yaml:"_,inline"`
+	loki.MetricConfig  `yaml:"_,inline"`
+}
+
+// GraphiteMetricConfig combines common metric configuration parameters with Graphite-specific ones.
+type GraphiteMetricConfig struct {
+	SourceMetricConfig    `yaml:"_,inline"`
+	graphite.MetricConfig `yaml:"_,inline"`
+}
+
+// OCIMetricConfig combines common metric configuration parameters with parameters of OCI Monitoring queries.
+type OCIMetricConfig struct {
+	SourceMetricConfig `yaml:"_,inline"`
+	oci.MetricConfig   `yaml:"_,inline"`
+}
+
+// SysdigMetricConfig combines common metric configuration parameters with Sysdig-specific ones.
+type SysdigMetricConfig struct {
+	SourceMetricConfig  `yaml:"_,inline"`
+	sysdig.MetricConfig `yaml:"_,inline"`
+}
+
+// RedfishMetricConfig combines common metric configuration parameters with parameters of Redfish sensor readings.
+type RedfishMetricConfig struct {
+	SourceMetricConfig   `yaml:"_,inline"`
+	redfish.MetricConfig `yaml:"_,inline"`
+}
+
+// MQTTMetricConfig combines common metric configuration parameters with MQTT subscription parameters.
+type MQTTMetricConfig struct {
+	SourceMetricConfig `yaml:"_,inline"`
+	mqtt.MetricConfig  `yaml:"_,inline"`
+}
+
+// VSphereMetricConfig combines common metric configuration parameters with parameters of vSphere performance counters.
+type VSphereMetricConfig struct {
+	SourceMetricConfig   `yaml:"_,inline"`
+	vsphere.MetricConfig `yaml:"_,inline"`
+}
+
+// SnowflakeMetricConfig combines common metric configuration parameters with Snowflake-specific ones.
+type SnowflakeMetricConfig struct {
+	SourceMetricConfig     `yaml:"_,inline"`
+	snowflake.MetricConfig `yaml:"_,inline"`
+}
+
+// CloudflareMetricConfig combines common metric configuration parameters with Cloudflare-specific ones.
+type CloudflareMetricConfig struct {
+	SourceMetricConfig      `yaml:"_,inline"`
+	cloudflare.MetricConfig `yaml:"_,inline"`
+}
+
+// FastlyMetricConfig combines common metric configuration parameters with Fastly-specific ones.
+type FastlyMetricConfig struct {
+	SourceMetricConfig  `yaml:"_,inline"`
+	fastly.MetricConfig `yaml:"_,inline"`
+}
+
+// AkamaiMetricConfig combines common metric configuration parameters with Akamai-specific ones.
+type AkamaiMetricConfig struct {
+	SourceMetricConfig  `yaml:"_,inline"`
+	akamai.MetricConfig `yaml:"_,inline"`
+}
+
+// SalesforceMetricConfig combines common metric configuration parameters with Salesforce-specific ones.
+type SalesforceMetricConfig struct {
+	SourceMetricConfig      `yaml:"_,inline"`
+	salesforce.MetricConfig `yaml:"_,inline"`
+}
+
+// JIRAMetricConfig defines configuration parameters for a metric imported from JIRA.
+type JIRAMetricConfig struct {
+	SourceMetricConfig `yaml:"_,inline"`
+	jira.MetricConfig  `yaml:"_,inline"`
+}
+
+// PostgreSQLMetricConfig defines configuration parameters of a PostgreSQL database, from which a metric is imported
+// for each preset.
+type PostgreSQLMetricConfig struct {
+	SourceMetricConfig      `yaml:"_,inline"`
+	postgresql.MetricConfig `yaml:"_,inline"`
+}
+
+// RedisMetricConfig defines configuration parameters for a metric imported from Redis.
+type RedisMetricConfig struct {
+	SourceMetricConfig `yaml:"_,inline"`
+	redis.MetricConfig `yaml:"_,inline"`
+}
+
+// KafkaMetricConfig defines configuration parameters for a metric with the lag of Kafka consumer groups.
+type KafkaMetricConfig struct {
+	SourceMetricConfig `yaml:"_,inline"`
+	kafka.MetricConfig `yaml:"_,inline"`
+}
+
+// ProbeMetricConfig defines configuration parameters of metrics probing HTTP(S) endpoints or TCP services.
+type ProbeMetricConfig struct {
+	SourceMetricConfig `yaml:"_,inline"`
+	probe.MetricConfig `yaml:"_,inline"`
+}
+
+// FileMetricConfig defines configuration parameters of metrics checking files in buckets or on FTP servers.
+type FileMetricConfig struct {
+	SourceMetricConfig `yaml:"_,inline"`
+	files.MetricConfig `yaml:"_,inline"`
+}
+
+// WebhookMetricConfig combines common metric parameters with parameters of metrics posted to the webhook endpoint.
+type WebhookMetricConfig struct {
+	SourceMetricConfig   `yaml:"_,inline"`
+	webhook.MetricConfig `yaml:"_,inline"`
+}
+
 // Metrics returns a list of metrics defined in the configuration file.
 func (c *Config) Metrics() []*Metric {
 	return c.metrics
 }
 
+// BurnRates returns a list of SLO burn-rate metrics defined in the configuration file.
+func (c *Config) BurnRates() []*BurnRate {
+	return c.burnRates
+}
+
+// ForTenant returns a configuration that only has metrics of a given tenant.
+func (c *Config) ForTenant(tenant string) (*Config, error) {
+	found := false
+	for _, t := range c.Tenants {
+		found = found || t.Name == tenant
+	}
+	if !found {
+		return nil, fmt.Errorf("tenant '%s' not found", tenant)
+	}
+	scoped := &Config{Tenants: c.Tenants, tenantParallelism: c.tenantParallelism, sourceParallelism: c.sourceParallelism, warmStartRamp: c.warmStartRamp, allowUnknownFields: c.allowUnknownFields, tenant: tenant, storage: c.storage}
+	for _, m := range c.metrics {
+		if m.Tenant == tenant {
+			scoped.metrics = append(scoped.metrics, m)
+		}
+	}
+	for _, b := range c.burnRates {
+		if b.Tenant == tenant {
+			scoped.burnRates = append(scoped.burnRates, b)
+		}
+	}
+	return scoped, nil
+}
+
 // ConfigOptions is a set of global options required to initialize configuration.
 type ConfigOptions struct {
-	Filename             string
+	Filename string
+	// Data is the contents of the configuration file, which is read from Filename if nil. Secret files are still
+	// resolved relative to the directory of Filename, e.g. to validate an edited file before writing it.
+	Data                 []byte
 	MinPointAge          time.Duration
 	CounterResetInterval time.Duration
 	Storage              storage.Manager
+	// CircuitBreaker is shared by all metrics to skip source hosts that are failing. Can be nil.
+	CircuitBreaker *CircuitBreaker
+	// ImportClaims are used by all metrics to avoid writing overlapping points when several instances share the
+	// storage engine. Can be nil.
+	ImportClaims *ImportClaims
+	// QueryChunk is the longest time range queried from a source at once. 0 means that time ranges are never split.
+	QueryChunk time.Duration
+	// SourceParallelism is the number of metrics updated in parallel for source types (e.g. "datadog") that are
+	// updated in their own pool, separately from the global parallelism.
+	SourceParallelism map[string]int
+	// WarmStartRamp is the number of metrics imported for the first time during each update, so that the initial
+	// backfill of a large configuration is spread over several syncs. 0 means that all metrics are imported at once.
+	WarmStartRamp int
+	// AllowUnknownFields makes unknown keys of the configuration file and of ExtraMetrics warnings instead of errors.
+	AllowUnknownFields bool
+	// ExtraMetrics are defined outside of the configuration file (e.g. as Kubernetes resources), and are added to
+	// metrics listed in the file.
+	ExtraMetrics []*MetricDefinition
+	// Hooks are added to all metrics, after hooks added using RegisterHook.
+	Hooks []*Hook
+}
+
+// MetricDefinition describes a single metric defined outside of the configuration file.
+type MetricDefinition struct {
+	Name string
+	// Source is the metric source, e.g. "datadog" for metrics that would be listed in `datadog_metrics`.
+	Source string
+	// Params is a YAML (or JSON) document with metric parameters, in the same format as a single metric in the
+	// configuration file, but without the name.
+	Params []byte
+}
+
+// addDefinition adds a metric defined outside of the configuration file to the list of metrics of a given source.
+func (c *Config) addDefinition(d *MetricDefinition) error {
+	var mc *SourceMetricConfig
+	var err error
+	switch d.Source {
+	case "datadog":
+		m := &DatadogMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.DatadogMetrics = append(c.DatadogMetrics, m)
+	case "datadog_events":
+		m := &DatadogEventConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.DatadogEvents = append(c.DatadogEvents, m)
+	case "influxdb":
+		m := &InfluxDBMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.InfluxDBMetrics = append(c.InfluxDBMetrics, m)
+	case "zabbix":
+		m := &ZabbixMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.ZabbixMetrics = append(c.ZabbixMetrics, m)
+	case "appdynamics":
+		m := &AppDynamicsMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.AppDynamicsMetrics = append(c.AppDynamicsMetrics, m)
+	case "icinga":
+		m := &IcingaMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.IcingaMetrics = append(c.IcingaMetrics, m)
+	case "lightstep":
+		m := &LightstepMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.LightstepMetrics = append(c.LightstepMetrics, m)
+	case "cloudmonitoring":
+		m := &CloudMonitoringMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.CloudMonitoringMetrics = append(c.CloudMonitoringMetrics, m)
+	case "loki":
+		m := &LokiMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.LokiMetrics = append(c.LokiMetrics, m)
+	case "graphite":
+		m := &GraphiteMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.GraphiteMetrics = append(c.GraphiteMetrics, m)
+	case "oci":
+		m := &OCIMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.OCIMetrics = append(c.OCIMetrics, m)
+	case "sysdig":
+		m := &SysdigMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.SysdigMetrics = append(c.SysdigMetrics, m)
+	case "redfish":
+		m := &RedfishMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.RedfishMetrics = append(c.RedfishMetrics, m)
+	case "mqtt":
+		m := &MQTTMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.MQTTMetrics = append(c.MQTTMetrics, m)
+	case "vsphere":
+		m := &VSphereMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.VSphereMetrics = append(c.VSphereMetrics, m)
+	case "snowflake":
+		m := &SnowflakeMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.SnowflakeMetrics = append(c.SnowflakeMetrics, m)
+	case "cloudflare":
+		m := &CloudflareMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.CloudflareMetrics = append(c.CloudflareMetrics, m)
+	case "fastly":
+		m := &FastlyMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.FastlyMetrics = append(c.FastlyMetrics, m)
+	case "akamai":
+		m := &AkamaiMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.AkamaiMetrics = append(c.AkamaiMetrics, m)
+	case "salesforce":
+		m := &SalesforceMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.SalesforceMetrics = append(c.SalesforceMetrics, m)
+	case "jira":
+		m := &JIRAMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.JIRAMetrics = append(c.JIRAMetrics, m)
+	case "redis":
+		m := &RedisMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.RedisMetrics = append(c.RedisMetrics, m)
+	case "kafka":
+		m := &KafkaMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.KafkaMetrics = append(c.KafkaMetrics, m)
+	case "probe":
+		m := &ProbeMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.ProbeMetrics = append(c.ProbeMetrics, m)
+	case "files":
+		m := &FileMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.FileMetrics = append(c.FileMetrics, m)
+	case "webhook":
+		m := &WebhookMetricConfig{}
+		err = c.unmarshalParams(d, m)
+		mc = &m.SourceMetricConfig
+		c.WebhookMetrics = append(c.WebhookMetrics, m)
+	default:
+		return fmt.Errorf("unknown source '%s' of metric '%s'", d.Source, d.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot parse parameters of metric '%s': %v", d.Name, err)
+	}
+	if mc.Name != "" {
+		return fmt.Errorf("parameters of metric '%s' cannot override its name", d.Name)
+	}
+	mc.Name = d.Name
+	return nil
+}
+
+// unmarshalParams parses parameters of a metric defined outside of the configuration file. Unknown keys are logged
+// and ignored if the configuration allows unknown fields.
+func (c *Config) unmarshalParams(d *MetricDefinition, m interface{}) error {
+	err := yaml.UnmarshalStrict(d.Params, m)
+	if c.allowUnknownFields {
+		var unknown error
+		if unknown, err = unknownFields(err); unknown != nil {
+			log.Warnf("Ignoring unknown parameters of metric '%s': %v", d.Name, unknown)
+		}
+	}
+	return err
+}
+
+// invalidConfig classifies errors caused by the contents of the configuration file.
+func invalidConfig(err error) error {
+	return tserrors.Wrap(tserrors.ErrConfigInvalid, err)
 }
 
 // NewConfig reads and validates a configuration file, returning the Config struct.
 func NewConfig(ctx context.Context, opts *ConfigOptions) (*Config, error) {
-	data, err := ioutil.ReadFile(opts.Filename)
+	data := opts.Data
+	if data == nil {
+		var err error
+		if data, err = ioutil.ReadFile(opts.Filename); err != nil {
+			return nil, invalidConfig(err)
+		}
+	}
+	migrated, warnings, err := migrateConfig(data)
 	if err != nil {
-		return nil, err
+		return nil, invalidConfig(err)
 	}
-	c := &Config{}
-	if err := yaml.UnmarshalStrict(data, c); err != nil {
-		return nil, err
+	for _, w := range warnings {
+		log.WithContext(ctx).Warnf("Upgraded configuration file %s to version %d (%s); update the file to stop this warning", opts.Filename, latestConfigVersion(), w)
+	}
+	parsed, err := applySources(migrated)
+	if err != nil {
+		return nil, invalidConfig(err)
+	}
+	c := &Config{tenantParallelism: make(map[string]int), sourceParallelism: opts.SourceParallelism, warmStartRamp: opts.WarmStartRamp, allowUnknownFields: opts.AllowUnknownFields, storage: opts.Storage}
+	// yaml.UnmarshalStrict keeps decoding after unknown keys, so the configuration is complete once they are ignored.
+	err = yaml.UnmarshalStrict(parsed, c)
+	if opts.AllowUnknownFields {
+		var unknown error
+		if unknown, err = unknownFields(err); unknown != nil {
+			log.WithContext(ctx).Warn(unmarshalErrors("ignoring unknown keys of the configuration file", opts.Filename, data, parsed, unknown))
+		}
+	}
+	if err != nil {
+		return nil, invalidConfig(unmarshalErrors("configuration file contains invalid entries", opts.Filename, data, parsed, err))
+	}
+	// The file has been upgraded to the latest version, even if it does not set one.
+	c.Version = latestConfigVersion()
+	for _, d := range opts.ExtraMetrics {
+		if d, err = c.withSource(d); err != nil {
+			return nil, invalidConfig(err)
+		}
+		if err := c.addDefinition(d); err != nil {
+			return nil, invalidConfig(err)
+		}
+	}
+
+	// Secrets can be stored in separate files (e.g. in mounted Kubernetes secrets). Since the configuration file is
+	// read during each sync, updated secrets are picked up without a restart.
+	dir := filepath.Dir(opts.Filename)
+	sections := []*MetricSection{&c.MetricSection}
+	for _, t := range c.Tenants {
+		sections = append(sections, &t.MetricSection)
+	}
+	for _, section := range sections {
+		if err := section.readSecretFiles(dir); err != nil {
+			return nil, invalidConfig(err)
+		}
 	}
 
 	if err := validator.Validate(c); err != nil {
-		return nil, fmt.Errorf("configuration file validation error: %s", err)
+		return nil, invalidConfig(validationErrors(opts.Filename, data, err))
 	}
 
+	// Map used to ensure that metric names are unique.
+	metrics := make(map[string]bool)
+	if err := c.addSection(ctx, opts, "", &c.MetricSection, metrics); err != nil {
+		return nil, err
+	}
+	for _, t := range c.Tenants {
+		if _, ok := c.tenantParallelism[t.Name]; ok {
+			return nil, invalidConfig(fmt.Errorf("configuration file contains several tenants named '%s'", t.Name))
+		}
+		c.tenantParallelism[t.Name] = t.Parallelism
+		if err := c.addSection(ctx, opts, t.Name, &t.MetricSection, metrics); err != nil {
+			return nil, fmt.Errorf("tenant '%s': %w", t.Name, err)
+		}
+	}
+
+	if err := c.checkMetricTypes(); err != nil {
+		return nil, invalidConfig(err)
+	}
+	c.setProjectBudgets(sections, time.Now())
+
+	log.WithContext(ctx).Debugf("Read %d metrics and %d tenants from the config file", len(metrics), len(c.Tenants))
+	return c, nil
+}
+
+// readSecretFiles reads secrets of all metrics in a section from files.
+func (s *MetricSection) readSecretFiles(dir string) error {
+	for _, m := range s.DatadogMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Datadog metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.DatadogEvents {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Datadog event metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.InfluxDBMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of InfluxDB metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.ZabbixMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Zabbix metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.AppDynamicsMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of AppDynamics metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.IcingaMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Icinga metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.LightstepMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Lightstep metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.LokiMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Loki metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.GraphiteMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Graphite metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.OCIMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of OCI metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.SysdigMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Sysdig metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.RedfishMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Redfish metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.MQTTMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of MQTT metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.VSphereMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of vSphere metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.SnowflakeMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Snowflake metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.CloudflareMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Cloudflare metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.FastlyMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Fastly metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.AkamaiMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Akamai metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.SalesforceMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Salesforce metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.JIRAMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of JIRA metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.PostgreSQLMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of PostgreSQL metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.RedisMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Redis metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.KafkaMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Kafka metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.FileMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Files metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, m := range s.WebhookMetrics {
+		if err := m.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of Webhook metric '%s': %v", m.Name, err)
+		}
+	}
+	for _, c := range s.NotificationChannels {
+		if err := c.ReadSecretFiles(dir); err != nil {
+			return fmt.Errorf("cannot read secrets of notification channel '%s': %v", c.Name, err)
+		}
+	}
+	for _, m := range s.RatioMetrics {
+		for _, o := range []*RatioOperandConfig{&m.Numerator, &m.Denominator} {
+			if err := o.readSecretFiles(dir); err != nil {
+				return fmt.Errorf("cannot read secrets of ratio metric '%s': %v", m.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// addSection creates metrics listed in a section of the configuration file. Metrics can only be written to
+// destinations listed in the same section. Names of tenant metrics are prefixed with the tenant name.
+func (c *Config) addSection(ctx context.Context, opts *ConfigOptions, tenant string, s *MetricSection, metrics map[string]bool) error {
 	destinations := make(map[string]string)
-	for _, d := range c.StackdriverDestinations {
+	for _, d := range s.StackdriverDestinations {
 		if _, ok := destinations[d.Name]; ok {
-			return nil, fmt.Errorf("configuration file contains several destinations named '%s'", d.Name)
+			return invalidConfig(fmt.Errorf("configuration file contains several destinations named '%s'", d.Name))
 		}
 		if d.ProjectID == "" {
 			d.ProjectID = projectID()
 		}
 		if d.ProjectID == "" {
-			return nil, fmt.Errorf("please provide project_id for destination '%s'", d.Name)
+			return invalidConfig(fmt.Errorf("please provide project_id for destination '%s'", d.Name))
 		}
 		destinations[d.Name] = d.ProjectID
 	}
 
-	// Map used to ensure that metric names are unique.
-	metrics := make(map[string]bool)
+	notifiers := make(map[string]notify.Notifier)
+	for _, nc := range s.NotificationChannels {
+		if _, ok := notifiers[nc.Name]; ok {
+			return invalidConfig(fmt.Errorf("configuration file contains several notification channels named '%s'", nc.Name))
+		}
+		n, err := notify.NewWebhook(nc)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create notification channel '%s': %v", nc.Name, err))
+		}
+		notifiers[nc.Name] = n
+	}
+
+	sources := make(map[string]*NamedSource)
+	for _, ns := range s.Sources {
+		sources[ns.Name] = ns
+	}
+
+	for _, w := range s.MaintenanceWindows {
+		if err := w.validate(); err != nil {
+			return invalidConfig(err)
+		}
+	}
+	windows := s.MaintenanceWindows
+	if tenant != "" {
+		windows = append(c.MaintenanceWindows[:len(c.MaintenanceWindows):len(c.MaintenanceWindows)], windows...)
+	}
+
+	metricName := func(name string) string {
+		if tenant == "" {
+			return name
+		}
+		return tenant + "/" + name
+	}
+
+	// Metrics of this section, keyed by their name in the section, which can be used to derive burn rates.
+	sectionMetrics := make(map[string]*Metric)
+
 	// Function to create a new source metric, and to add it to the current configuration.
-	addSourceMetric := func(name, dest string, sourceMetric SourceMetric) error {
-		project, ok := destinations[dest]
+	addSourceMetric := func(mc *SourceMetricConfig, sourceMetric SourceMetric) error {
+		name := metricName(mc.Name)
+		project, ok := destinations[mc.Destination]
 		if !ok {
-			return fmt.Errorf("destination '%s' not found", dest)
+			return invalidConfig(fmt.Errorf("destination '%s' not found", mc.Destination))
+		}
+		if err := mc.MetricOptions.validate(); err != nil {
+			return invalidConfig(fmt.Errorf("invalid options for metric '%s': %v", name, err))
+		}
+		for _, r := range mc.Thresholds {
+			if _, ok := notifiers[r.Channel]; !ok {
+				return invalidConfig(fmt.Errorf("notification channel '%s' of metric '%s' not found", r.Channel, name))
+			}
+		}
+		for _, channel := range mc.ImportNotifications {
+			if _, ok := notifiers[channel]; !ok {
+				return invalidConfig(fmt.Errorf("import notification channel '%s' of metric '%s' not found", channel, name))
+			}
+		}
+		for _, channel := range mc.BudgetNotifications {
+			if _, ok := notifiers[channel]; !ok {
+				return invalidConfig(fmt.Errorf("budget notification channel '%s' of metric '%s' not found", channel, name))
+			}
 		}
 		metric, err := NewMetric(ctx, name, sourceMetric, project, opts.Storage)
 		if err != nil {
 			return fmt.Errorf("cannot create metric '%s': %v", name, err)
 		}
+		metric.Options = mc.MetricOptions
+		metric.Breaker = opts.CircuitBreaker
+		metric.Claims = opts.ImportClaims
+		metric.Hooks = metricHooks(opts.Hooks)
+		metric.QueryChunk = opts.QueryChunk
+		metric.Tenant = tenant
+		metric.Notifiers = notifiers
+		metric.MaintenanceWindows = append(windows[:len(windows):len(windows)], mc.MaintenanceWindows...)
+		if mc.Profile != "" {
+			if metric.RateLimiter, err = checkSource(tenant, sources[mc.Profile], sourceMetric); err != nil {
+				return invalidConfig(fmt.Errorf("invalid source of metric '%s': %v", name, err))
+			}
+		}
 
 		c.metrics = append(c.metrics, metric)
+		sectionMetrics[mc.Name] = metric
 		if metrics[name] {
-			return fmt.Errorf("duplicate metric name '%s'", name)
+			return invalidConfig(fmt.Errorf("duplicate metric name '%s'", name))
 		}
 		metrics[name] = true
 		return nil
 	}
 
-	for _, m := range c.DatadogMetrics {
-		metric, err := datadog.NewSourceMetric(m.Name, &m.MetricConfig, opts.MinPointAge, opts.CounterResetInterval)
+	for _, m := range s.DatadogMetrics {
+		metric, err := datadog.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge, opts.CounterResetInterval)
 		if err != nil {
-			return nil, fmt.Errorf("cannot create Datadog source metric '%s': %v", m.Name, err)
+			return invalidConfig(fmt.Errorf("cannot create Datadog source metric '%s': %v", m.Name, err))
 		}
 
-		if err = addSourceMetric(m.Name, m.Destination, metric); err != nil {
-			return nil, err
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
 		}
 	}
 
-	for _, m := range c.InfluxDBMetrics {
-		metric, err := influxdb.NewSourceMetric(m.Name, &m.MetricConfig, opts.MinPointAge, opts.CounterResetInterval)
+	for _, m := range s.DatadogEvents {
+		metric, err := datadog.NewEventMetric(metricName(m.Name), &m.EventConfig, opts.MinPointAge)
 		if err != nil {
-			return nil, fmt.Errorf("cannot create InfluxDB source metric '%s': %v", m.Name, err)
+			return invalidConfig(fmt.Errorf("cannot create Datadog event metric '%s': %v", m.Name, err))
 		}
 
-		if err = addSourceMetric(m.Name, m.Destination, metric); err != nil {
-			return nil, err
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
 		}
 	}
 
-	log.WithContext(ctx).Debugf("Read %d metrics and %d destinations from the config file", len(metrics), len(destinations))
-	return c, nil
+	for _, m := range s.InfluxDBMetrics {
+		metric, err := influxdb.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge, opts.CounterResetInterval)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create InfluxDB source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.ZabbixMetrics {
+		metric, err := zabbix.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Zabbix source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.AppDynamicsMetrics {
+		metric, err := appdynamics.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create AppDynamics source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.IcingaMetrics {
+		metric, err := icinga.NewSourceMetric(metricName(m.Name), &m.MetricConfig)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Icinga source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.LightstepMetrics {
+		metric, err := lightstep.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Lightstep source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.CloudMonitoringMetrics {
+		metric, err := cloudmonitoring.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Cloud Monitoring source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.LokiMetrics {
+		metric, err := loki.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Loki source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.GraphiteMetrics {
+		metric, err := graphite.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Graphite source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.OCIMetrics {
+		metric, err := oci.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create OCI source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.SysdigMetrics {
+		metric, err := sysdig.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Sysdig source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.RedfishMetrics {
+		metric, err := redfish.NewSourceMetric(metricName(m.Name), &m.MetricConfig)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Redfish source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.MQTTMetrics {
+		metric, err := mqtt.NewSourceMetric(metricName(m.Name), &m.MetricConfig)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create MQTT source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.VSphereMetrics {
+		metric, err := vsphere.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create vSphere source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.SnowflakeMetrics {
+		metric, err := snowflake.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Snowflake source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.CloudflareMetrics {
+		metric, err := cloudflare.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Cloudflare source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.FastlyMetrics {
+		metric, err := fastly.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Fastly source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.AkamaiMetrics {
+		metric, err := akamai.NewSourceMetric(metricName(m.Name), &m.MetricConfig, opts.MinPointAge)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Akamai source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.SalesforceMetrics {
+		metric, err := salesforce.NewSourceMetric(metricName(m.Name), &m.MetricConfig)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Salesforce source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.JIRAMetrics {
+		metric, err := jira.NewSourceMetric(metricName(m.Name), &m.MetricConfig)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create JIRA source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	// Each PostgreSQL database is imported as a metric per preset, named after the database and the preset.
+	for _, m := range s.PostgreSQLMetrics {
+		for _, preset := range m.EnabledPresets() {
+			mc := m.SourceMetricConfig
+			mc.Name = fmt.Sprintf("%s_%s", m.Name, preset)
+			metric, err := postgresql.NewSourceMetric(metricName(mc.Name), preset, &m.MetricConfig)
+			if err != nil {
+				return invalidConfig(fmt.Errorf("cannot create PostgreSQL source metric '%s': %v", mc.Name, err))
+			}
+
+			if err = addSourceMetric(&mc, metric); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, m := range s.RedisMetrics {
+		metric, err := redis.NewSourceMetric(metricName(m.Name), &m.MetricConfig)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Redis source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.KafkaMetrics {
+		metric, err := kafka.NewSourceMetric(metricName(m.Name), &m.MetricConfig)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Kafka source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.ProbeMetrics {
+		metric, err := probe.NewSourceMetric(metricName(m.Name), &m.MetricConfig)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Probe source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.FileMetrics {
+		metric, err := files.NewSourceMetric(metricName(m.Name), &m.MetricConfig)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Files source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.WebhookMetrics {
+		metric, err := webhook.NewSourceMetric(metricName(m.Name), &m.MetricConfig)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create Webhook source metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range s.RatioMetrics {
+		metric, err := NewRatioMetric(metricName(m.Name), m, opts)
+		if err != nil {
+			return invalidConfig(fmt.Errorf("cannot create ratio metric '%s': %v", m.Name, err))
+		}
+
+		if err = addSourceMetric(&m.SourceMetricConfig, metric); err != nil {
+			return err
+		}
+	}
+
+	burnRates := make(map[string]bool)
+	for _, bc := range s.SLOBurnRates {
+		name := metricName(bc.Name)
+		if burnRates[name] {
+			return invalidConfig(fmt.Errorf("duplicate burn rate name '%s'", name))
+		}
+		burnRates[name] = true
+		if err := bc.validate(); err != nil {
+			return invalidConfig(fmt.Errorf("invalid burn rate '%s': %v", name, err))
+		}
+		project, ok := destinations[bc.Destination]
+		if !ok {
+			return invalidConfig(fmt.Errorf("destination '%s' not found", bc.Destination))
+		}
+		good, ok := sectionMetrics[bc.Good]
+		if !ok {
+			return invalidConfig(fmt.Errorf("good metric '%s' of burn rate '%s' not found", bc.Good, name))
+		}
+		total, ok := sectionMetrics[bc.Total]
+		if !ok {
+			return invalidConfig(fmt.Errorf("total metric '%s' of burn rate '%s' not found", bc.Total, name))
+		}
+		c.burnRates = append(c.burnRates, &BurnRate{
+			Name:      name,
+			Good:      good,
+			Total:     total,
+			Objective: bc.Objective,
+			Windows:   bc.Windows,
+			SDProject: project,
+			Tenant:    tenant,
+		})
+	}
+	return nil
+}
+
+// checkMetricTypes makes sure that no two metrics write to the same Stackdriver metric type in a single project.
+// Metrics sharing a metric type would overwrite each other's points, and fail with out-of-order errors. This covers
+// companion series (such as anomaly flags) and burn rates, since their metric types are derived from other names.
+func (c *Config) checkMetricTypes() error {
+	writers := make(map[string]string)
+	add := func(project, metricType, writer string) error {
+		key := project + "/" + metricType
+		if other, ok := writers[key]; ok {
+			return fmt.Errorf("%s and %s both write to metric type '%s' in project '%s'", other, writer, metricType, project)
+		}
+		writers[key] = writer
+		return nil
+	}
+	for _, m := range c.metrics {
+		name := m.Source.StackdriverName()
+		if err := add(m.SDProject, name, fmt.Sprintf("metric '%s'", m.Name)); err != nil {
+			return err
+		}
+		if m.Options.AnomalyDetection == nil {
+			continue
+		}
+		if err := add(m.SDProject, anomalyName(name), fmt.Sprintf("anomaly series of metric '%s'", m.Name)); err != nil {
+			return err
+		}
+	}
+	for _, b := range c.burnRates {
+		if err := add(b.SDProject, b.StackdriverName(), fmt.Sprintf("burn rate '%s'", b.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // projectID returns the name of the GCP project that code is running in.
 func projectID() string {
-	value, exists := os.LookupEnv("GOOGLE_CLOUD_PROJECT")
-	if !exists {
-		return ""
-	}
-	return value
+	return env.Project()
 }
@@ -16,18 +16,860 @@ package tsbridge
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/ts-bridge/akamai"
+	"github.com/google/ts-bridge/appdynamics"
+	"github.com/google/ts-bridge/cloudflare"
+	"github.com/google/ts-bridge/cloudmonitoring"
+	"github.com/google/ts-bridge/datadog"
 	"github.com/google/ts-bridge/datastore"
+	"github.com/google/ts-bridge/fastly"
+	"github.com/google/ts-bridge/files"
+	"github.com/google/ts-bridge/graphite"
+	"github.com/google/ts-bridge/icinga"
+	"github.com/google/ts-bridge/jira"
+	"github.com/google/ts-bridge/kafka"
+	"github.com/google/ts-bridge/lightstep"
+	"github.com/google/ts-bridge/loki"
+	"github.com/google/ts-bridge/mqtt"
+	"github.com/google/ts-bridge/oci"
+	"github.com/google/ts-bridge/postgresql"
+	"github.com/google/ts-bridge/probe"
+	"github.com/google/ts-bridge/redfish"
+	"github.com/google/ts-bridge/redis"
+	"github.com/google/ts-bridge/salesforce"
+	"github.com/google/ts-bridge/snowflake"
+	"github.com/google/ts-bridge/sysdig"
+	"github.com/google/ts-bridge/tserrors"
+	"github.com/google/ts-bridge/vsphere"
+	"github.com/google/ts-bridge/webhook"
+	"github.com/google/ts-bridge/zabbix"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
 )
 
 func setProjectID(projectID string) {
 	if err := os.Setenv("GOOGLE_CLOUD_PROJECT", projectID); err != nil {
-		fmt.Errorf("couldn't set env GOOGLE_CLOUD_PROJECT: %v", err)
+		panic(fmt.Sprintf("couldn't set env GOOGLE_CLOUD_PROJECT: %v", err))
+	}
+}
+
+func TestNewConfigSecretFiles(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/secret_files.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dd := cfg.DatadogMetrics[0]
+	if dd.APIKey != "dd-api-key" || dd.ApplicationKey != "dd-app-key" {
+		t.Errorf("expected Datadog keys to be read from files; got '%s' and '%s'", dd.APIKey, dd.ApplicationKey)
+	}
+	if got := cfg.InfluxDBMetrics[0].Password; got != "influx-password" {
+		t.Errorf("expected InfluxDB password to be read from a file; got '%s'", got)
+	}
+}
+
+func TestNewConfigData(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	data, err := ioutil.ReadFile("testdata/secret_files.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file does not exist, but secret files are still read from its directory.
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/edited.yaml", Data: data, Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.DatadogMetrics[0].APIKey; got != "dd-api-key" {
+		t.Errorf("expected Datadog API key to be read from a file next to the configuration file; got '%s'", got)
+	}
+
+	_, err = NewConfig(ctx, &ConfigOptions{Filename: "testdata/edited.yaml", Data: []byte("datadog_metrics: {}\n"), Storage: storage})
+	if err == nil || !strings.Contains(err.Error(), "testdata/edited.yaml") {
+		t.Errorf("expected an error mentioning the configuration file; got %v", err)
+	}
+}
+
+func TestNewConfigTenants(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/tenants.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range cfg.Metrics() {
+		got = append(got, fmt.Sprintf("%s %s %s %s", m.Tenant, m.Name, m.Source.StackdriverName(), m.SDProject))
+	}
+	want := []string{
+		" metric1 custom.googleapis.com/datadog/metric1 shared-project",
+		"team_a team_a/metric1 custom.googleapis.com/datadog/team_a/metric1 team-a-project",
+		"team_b team_b/metric2 custom.googleapis.com/influxdb/team_b/metric2 team-b-project",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected metrics %v; got %v", want, got)
+	}
+	if cfg.tenantParallelism["team_a"] != 1 {
+		t.Errorf("expected parallelism of tenant team_a to be 1; got %d", cfg.tenantParallelism["team_a"])
+	}
+
+	scoped, err := cfg.ForTenant("team_b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scoped.Metrics()) != 1 || scoped.Metrics()[0].Name != "team_b/metric2" {
+		t.Errorf("expected ForTenant() to only return metric team_b/metric2; got %v", scoped.Metrics())
+	}
+	if _, err := cfg.ForTenant("team_c"); err == nil {
+		t.Error("expected ForTenant() to return an error for an unknown tenant")
+	}
+}
+
+func TestNewConfigBurnRates(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/burn_rates.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.BurnRates()) != 1 {
+		t.Fatalf("expected 1 burn rate; got %v", cfg.BurnRates())
+	}
+	b := cfg.BurnRates()[0]
+	if b.Good.Name != "requests_good" || b.Total.Name != "requests_total" || b.Objective != 0.999 || b.SDProject != "testapp" {
+		t.Errorf("unexpected burn rate %+v", b)
+	}
+	if !reflect.DeepEqual(b.Windows, []time.Duration{time.Hour, 6 * time.Hour}) {
+		t.Errorf("expected burn rate windows [1h 6h]; got %v", b.Windows)
+	}
+}
+
+func TestNewConfigThresholds(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/thresholds.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := cfg.Metrics()[0]
+	if len(m.Options.Thresholds) != 1 {
+		t.Fatalf("expected 1 threshold rule; got %v", m.Options.Thresholds)
+	}
+	if r := m.Options.Thresholds[0]; *r.Above != 100 || r.For != 3 || r.Channel != "oncall" {
+		t.Errorf("unexpected threshold rule %+v", r)
+	}
+	if _, ok := m.Notifiers["oncall"]; !ok {
+		t.Errorf("expected notification channel 'oncall' to be set for metric; got %v", m.Notifiers)
+	}
+}
+
+func TestNewConfigRatioMetrics(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/ratio.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	r, ok := cfg.Metrics()[0].Source.(*RatioMetric)
+	if !ok {
+		t.Fatalf("expected a ratio metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if r.Tolerance != 30*time.Second || r.StackdriverName() != "custom.googleapis.com/ratio/error_percentage" {
+		t.Errorf("unexpected ratio metric %+v", r)
+	}
+}
+
+func TestNewConfigDatadogEvents(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/datadog_events.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	e, ok := cfg.Metrics()[0].Source.(*datadog.EventMetric)
+	if !ok {
+		t.Fatalf("expected a Datadog event metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := "events with sources=jenkins, tags=env:prod"; e.Query() != want {
+		t.Errorf("expected event metric query '%s'; got '%s'", want, e.Query())
+	}
+}
+
+func TestNewConfigZabbix(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/zabbix.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	z, ok := cfg.Metrics()[0].Source.(*zabbix.Metric)
+	if !ok {
+		t.Fatalf("expected a Zabbix metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := "items with key system.cpu.load[all,avg1] on hosts web-1, web-2"; z.Query() != want {
+		t.Errorf("expected Zabbix metric query '%s'; got '%s'", want, z.Query())
+	}
+
+	if _, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/invalid_zabbix_items.yaml", Storage: storage}); err == nil {
+		t.Errorf("expected a Zabbix metric with both item_ids and key to be rejected")
+	}
+}
+
+func TestNewConfigAppDynamics(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/appdynamics.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	a, ok := cfg.Metrics()[0].Source.(*appdynamics.Metric)
+	if !ok {
+		t.Fatalf("expected an AppDynamics metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := "checkout: Overall Application Performance|web|Average Response Time (ms) (value)"; a.Query() != want {
+		t.Errorf("expected AppDynamics metric query '%s'; got '%s'", want, a.Query())
+	}
+}
+
+func TestNewConfigIcinga(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/icinga.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	i, ok := cfg.Metrics()[0].Source.(*icinga.Metric)
+	if !ok {
+		t.Fatalf("expected an Icinga metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := `service checks matching service.name == "ping4" (rta, pl)`; i.Query() != want {
+		t.Errorf("expected Icinga metric query '%s'; got '%s'", want, i.Query())
+	}
+}
+
+func TestNewConfigLightstep(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/lightstep.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	l, ok := cfg.Metrics()[0].Source.(*lightstep.Metric)
+	if !ok {
+		t.Fatalf("expected a Lightstep metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := `spans latency | delta | filter service == "web" | group_by [], sum | point percentile(value, 99)`; l.Query() != want {
+		t.Errorf("expected Lightstep metric query '%s'; got '%s'", want, l.Query())
+	}
+	if l.StackdriverName() != "custom.googleapis.com/lightstep/web_latency_p99" {
+		t.Errorf("unexpected Stackdriver metric name %s", l.StackdriverName())
+	}
+}
+
+func TestNewConfigCloudMonitoring(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/cloudmonitoring.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	c, ok := cfg.Metrics()[0].Source.(*cloudmonitoring.Metric)
+	if !ok {
+		t.Fatalf("expected a Cloud Monitoring metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := `metric.type = "loadbalancing.googleapis.com/https/request_count" | ALIGN_RATE | REDUCE_SUM by metric.label.response_code_class`; c.Query() != want {
+		t.Errorf("expected Cloud Monitoring metric query '%s'; got '%s'", want, c.Query())
+	}
+}
+
+func TestNewConfigLoki(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/loki.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	l, ok := cfg.Metrics()[0].Source.(*loki.Metric)
+	if !ok {
+		t.Fatalf("expected a Loki metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := `sum by (status) (rate({app="web"} |= "error" [5m]))`; l.Query() != want {
+		t.Errorf("expected Loki metric query '%s'; got '%s'", want, l.Query())
+	}
+}
+
+func TestNewConfigGraphite(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/graphite.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	g, ok := cfg.Metrics()[0].Source.(*graphite.Metric)
+	if !ok {
+		t.Fatalf("expected a Graphite metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := `groupByNode(dc.*.web-*.requests.count,1,'sumSeries')`; g.Query() != want {
+		t.Errorf("expected Graphite metric query '%s'; got '%s'", want, g.Query())
+	}
+}
+
+func TestNewConfigOCI(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/oci.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	o, ok := cfg.Metrics()[0].Source.(*oci.Metric)
+	if !ok {
+		t.Fatalf("expected an OCI metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := "oci_computeagent: CpuUtilization[1m].mean()"; o.Query() != want {
+		t.Errorf("expected OCI metric query '%s'; got '%s'", want, o.Query())
+	}
+	if o.SourceHost() != "telemetry.us-ashburn-1.oraclecloud.com" {
+		t.Errorf("expected the telemetry endpoint to be derived from the region; got %s", o.SourceHost())
+	}
+
+	// The private key is read relative to the configuration file.
+	_, err = NewConfig(ctx, &ConfigOptions{Filename: "testdata/oci_missing_key.yaml", Storage: storage})
+	if err == nil || !strings.Contains(err.Error(), "cannot read key_file") {
+		t.Errorf("expected a missing key file to be reported; got %v", err)
+	}
+}
+
+func TestNewConfigSysdig(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/sysdig.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	m, ok := cfg.Metrics()[0].Source.(*sysdig.Metric)
+	if !ok {
+		t.Fatalf("expected a Sysdig metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := "sum by (kube_namespace_name) (sysdig_container_cpu_cores_used)"; m.Query() != want {
+		t.Errorf("expected Sysdig metric query '%s'; got '%s'", want, m.Query())
+	}
+	if got := cfg.SysdigMetrics[0].Token; got != "sysdig-token" {
+		t.Errorf("expected Sysdig token to be read from a file; got '%s'", got)
+	}
+}
+
+func TestNewConfigRedfish(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/redfish.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 2 {
+		t.Fatalf("expected 2 metrics; got %v", cfg.Metrics())
+	}
+	r, ok := cfg.Metrics()[0].Source.(*redfish.Metric)
+	if !ok {
+		t.Fatalf("expected a Redfish metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := "temperature readings of 2 BMCs (Inlet Temp)"; r.Query() != want {
+		t.Errorf("expected Redfish metric query '%s'; got '%s'", want, r.Query())
+	}
+}
+
+func TestNewConfigMQTT(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/mqtt.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	m, ok := cfg.Metrics()[0].Source.(*mqtt.Metric)
+	if !ok {
+		t.Fatalf("expected an MQTT metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := "sensors/+/+/temperature"; m.Query() != want {
+		t.Errorf("expected MQTT metric query '%s'; got '%s'", want, m.Query())
+	}
+}
+
+func TestNewConfigVSphere(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/vsphere.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 2 {
+		t.Fatalf("expected 2 metrics; got %v", cfg.Metrics())
+	}
+	v, ok := cfg.Metrics()[1].Source.(*vsphere.Metric)
+	if !ok {
+		t.Fatalf("expected a vSphere metric; got %T", cfg.Metrics()[1].Source)
+	}
+	if want := "datastore.totalReadLatency.average of HostSystem (instance *)"; v.Query() != want {
+		t.Errorf("expected vSphere metric query '%s'; got '%s'", want, v.Query())
+	}
+}
+
+func TestNewConfigSnowflake(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/snowflake.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	s, ok := cfg.Metrics()[0].Source.(*snowflake.Metric)
+	if !ok {
+		t.Fatalf("expected a Snowflake metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if s.SourceHost() != "xy12345.us-east-1.snowflakecomputing.com" {
+		t.Errorf("expected the endpoint to be derived from the account; got %s", s.SourceHost())
+	}
+	if !strings.Contains(s.Query(), "warehouse_metering_history") {
+		t.Errorf("unexpected Snowflake metric query '%s'", s.Query())
+	}
+}
+
+func TestNewConfigCloudflare(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/cloudflare.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 2 {
+		t.Fatalf("expected 2 metrics; got %v", cfg.Metrics())
+	}
+	for i, want := range []string{
+		"requests of zones 023e105f4ecef8ad9ca31a8372d0c353",
+		"firewall_events of zones 023e105f4ecef8ad9ca31a8372d0c353",
+	} {
+		c, ok := cfg.Metrics()[i].Source.(*cloudflare.Metric)
+		if !ok {
+			t.Fatalf("expected a Cloudflare metric; got %T", cfg.Metrics()[i].Source)
+		}
+		if c.Query() != want {
+			t.Errorf("expected Cloudflare metric query '%s'; got '%s'", want, c.Query())
+		}
+	}
+	if token := cfg.CloudflareMetrics[0].APIToken; token != "cloudflare-token" {
+		t.Errorf("expected the API token to be read from api_token_file; got %q", token)
+	}
+}
+
+func TestNewConfigFastly(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/fastly.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 2 {
+		t.Fatalf("expected 2 metrics; got %v", cfg.Metrics())
+	}
+	for i, want := range []string{"api.fastly.com", "rt.fastly.com"} {
+		f, ok := cfg.Metrics()[i].Source.(*fastly.Metric)
+		if !ok {
+			t.Fatalf("expected a Fastly metric; got %T", cfg.Metrics()[i].Source)
+		}
+		if f.SourceHost() != want {
+			t.Errorf("expected Fastly metric %s to query %s; got %s", f.Name, want, f.SourceHost())
+		}
+	}
+	if token := cfg.FastlyMetrics[0].APIToken; token != "fastly-token" {
+		t.Errorf("expected the API token to be read from api_token_file; got %q", token)
+	}
+}
+
+func TestNewConfigAkamai(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/akamai.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	a, ok := cfg.Metrics()[0].Source.(*akamai.Metric)
+	if !ok {
+		t.Fatalf("expected an Akamai metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if want := "delivery/traffic/current: edgeHitsSum"; a.Query() != want {
+		t.Errorf("expected Akamai metric query '%s'; got '%s'", want, a.Query())
+	}
+	if a.SourceHost() != "akab-example.luna.akamaiapis.net" {
+		t.Errorf("unexpected source host %s", a.SourceHost())
+	}
+	if secret := cfg.AkamaiMetrics[0].EdgeGrid.ClientSecret; secret != "akamai-client-secret" {
+		t.Errorf("expected the client secret to be read from client_secret_file; got %q", secret)
+	}
+}
+
+func TestNewConfigSalesforce(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/salesforce.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	s, ok := cfg.Metrics()[0].Source.(*salesforce.Metric)
+	if !ok {
+		t.Fatalf("expected a Salesforce metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if s.SourceHost() != "acme.my.salesforce.com" {
+		t.Errorf("unexpected source host %s", s.SourceHost())
+	}
+	if secret := cfg.SalesforceMetrics[0].ClientSecret; secret != "salesforce-client-secret" {
+		t.Errorf("expected the client secret to be read from client_secret_file; got %q", secret)
+	}
+}
+
+func TestNewConfigJIRA(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/jira.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	s, ok := cfg.Metrics()[0].Source.(*jira.Metric)
+	if !ok {
+		t.Fatalf("expected a JIRA metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if s.SourceHost() != "acme.atlassian.net" {
+		t.Errorf("unexpected source host %s", s.SourceHost())
+	}
+	if token := cfg.JIRAMetrics[0].APIToken; token != "jira-api-token" {
+		t.Errorf("expected the API token to be read from api_token_file; got %q", token)
+	}
+}
+
+func TestNewConfigPostgreSQL(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/postgresql.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A metric is created for each preset of the database.
+	var names []string
+	for _, m := range cfg.Metrics() {
+		s, ok := m.Source.(*postgresql.Metric)
+		if !ok {
+			t.Fatalf("expected a PostgreSQL metric; got %T", m.Source)
+		}
+		if s.SourceHost() != "orders-db.corp:5433" {
+			t.Errorf("unexpected source host %s", s.SourceHost())
+		}
+		names = append(names, m.Name)
+	}
+	if want := []string{"orders_db_connections", "orders_db_replication_lag"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("expected metrics %v; got %v", want, names)
+	}
+	if password := cfg.PostgreSQLMetrics[0].Password; password != "postgresql-password" {
+		t.Errorf("expected the password to be read from password_file; got %q", password)
+	}
+}
+
+func TestNewConfigRedis(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/redis.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	s, ok := cfg.Metrics()[0].Source.(*redis.Metric)
+	if !ok {
+		t.Fatalf("expected a Redis metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if s.SourceHost() != "sentinel-1.corp:26379" {
+		t.Errorf("unexpected source host %s", s.SourceHost())
+	}
+	if password := cfg.RedisMetrics[0].Password; password != "redis-password" {
+		t.Errorf("expected the password to be read from password_file; got %q", password)
+	}
+}
+
+func TestNewConfigKafka(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/kafka.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 1 {
+		t.Fatalf("expected 1 metric; got %v", cfg.Metrics())
+	}
+	s, ok := cfg.Metrics()[0].Source.(*kafka.Metric)
+	if !ok {
+		t.Fatalf("expected a Kafka metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if s.SourceHost() != "kafka-1.corp:9093" {
+		t.Errorf("unexpected source host %s", s.SourceHost())
+	}
+	if password := cfg.KafkaMetrics[0].SASLPassword; password != "kafka-sasl-password" {
+		t.Errorf("expected the SASL password to be read from sasl_password_file; got %q", password)
+	}
+}
+
+func TestNewConfigProbe(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/probe.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 5 {
+		t.Fatalf("expected 5 metrics; got %v", cfg.Metrics())
+	}
+	s, ok := cfg.Metrics()[1].Source.(*probe.Metric)
+	if !ok {
+		t.Fatalf("expected a probe metric; got %T", cfg.Metrics()[1].Source)
+	}
+	if s.SourceHost() != "mail.example.com:465" {
+		t.Errorf("unexpected source host %s", s.SourceHost())
+	}
+	if got := cfg.ProbeMetrics[1].Timeout; got != 5*time.Second {
+		t.Errorf("expected a timeout of 5s; got %v", got)
+	}
+	if got := cfg.Metrics()[3].Source.(*probe.Metric).SourceHost(); got != "www.example.com" {
+		t.Errorf("unexpected source host of the DNS probe %s", got)
+	}
+	if got := cfg.ProbeMetrics[4]; got.Count != 10 || got.Interval != 500*time.Millisecond {
+		t.Errorf("expected 10 probes 500ms apart; got %d probes %v apart", got.Count, got.Interval)
+	}
+}
+
+func TestNewConfigFiles(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/files.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 2 {
+		t.Fatalf("expected 2 metrics; got %v", cfg.Metrics())
+	}
+	s, ok := cfg.Metrics()[1].Source.(*files.Metric)
+	if !ok {
+		t.Fatalf("expected a files metric; got %T", cfg.Metrics()[1].Source)
+	}
+	if s.SourceHost() != "ftp.partner.example.com" {
+		t.Errorf("unexpected source host %s", s.SourceHost())
+	}
+	if key := cfg.FileMetrics[0].SecretAccessKey; key != "files-secret-access-key" {
+		t.Errorf("expected the secret access key to be read from secret_access_key_file; got %q", key)
+	}
+	if password := cfg.FileMetrics[1].Password; password != "files-password" {
+		t.Errorf("expected the password to be read from password_file; got %q", password)
+	}
+}
+
+func TestNewConfigWebhook(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/webhook.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 2 {
+		t.Fatalf("expected 2 metrics; got %v", cfg.Metrics())
+	}
+	s, ok := cfg.Metrics()[0].Source.(*webhook.Metric)
+	if !ok {
+		t.Fatalf("expected a webhook metric; got %T", cfg.Metrics()[0].Source)
+	}
+	if s.Query() != "/webhook/nightly_orders" {
+		t.Errorf("unexpected query %s", s.Query())
+	}
+	if token := cfg.WebhookMetrics[0].Token; token != "webhook-token" {
+		t.Errorf("expected the token to be read from token_file; got %q", token)
+	}
+}
+
+func TestNewConfigSources(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	extra := []*MetricDefinition{
+		{Name: "extra_requests", Source: "datadog", Params: []byte(`{"query": "q", "profile": "datadog_eu", "destination": "stackdriver"}`)},
+	}
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/sources.yaml", Storage: storage, ExtraMetrics: extra})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Metrics()) != 4 {
+		t.Fatalf("expected 4 metrics; got %v", cfg.Metrics())
+	}
+	if key := cfg.DatadogMetrics[0].APIKey; key != "dd-api-key" {
+		t.Errorf("expected the API key to be read from api_key_file of the profile; got %q", key)
+	}
+	for _, m := range []*DatadogMetricConfig{cfg.DatadogMetrics[1], cfg.DatadogMetrics[2]} {
+		if m.APIKey != "eu-api-key" || m.Site != "datadoghq.eu" {
+			t.Errorf("expected %s to use the EU profile; got key %q and site %q", m.Name, m.APIKey, m.Site)
+		}
+	}
+	if key := cfg.DatadogEvents[0].ApplicationKey; key != "eu-application-key" {
+		t.Errorf("expected events to use the EU profile; got key %q", key)
+	}
+	if cfg.Metrics()[0].RateLimiter != nil {
+		t.Error("expected no rate limiter for the US source")
+	}
+	if l := cfg.Metrics()[1].RateLimiter; l == nil || l != cfg.Metrics()[2].RateLimiter {
+		t.Error("expected metrics of the EU source to share a rate limiter")
+	}
+
+	extra[0].Params = []byte(`{"query": "q", "profile": "datadog_ap", "destination": "stackdriver"}`)
+	if _, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/sources.yaml", Storage: storage, ExtraMetrics: extra}); err == nil || !strings.Contains(err.Error(), "unknown source 'datadog_ap'") {
+		t.Errorf("expected an error for an unknown profile; got %v", err)
+	}
+}
+
+func TestNewConfigMaintenanceWindows(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/maintenance.yaml", Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	windows := make(map[string][]string)
+	for _, m := range cfg.Metrics() {
+		for _, w := range m.MaintenanceWindows {
+			windows[m.Name] = append(windows[m.Name], w.Schedule)
+		}
+	}
+	want := map[string][]string{
+		"dd_metric":            {"0 2 * * SUN", "30 9 1 * *"},
+		"team_a/influx_metric": {"0 2 * * SUN", "0 22 * * MON-FRI"},
+	}
+	if !reflect.DeepEqual(windows, want) {
+		t.Errorf("expected maintenance windows %v; got %v", want, windows)
+	}
+}
+
+func TestNewConfigExtraMetrics(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	extra := []*MetricDefinition{
+		{Name: "extra1", Source: "datadog", Params: []byte(`{"query": "q", "api_key": "k", "application_key": "k", "destination": "stackdriver"}`)},
+		{Name: "extra2", Source: "influxdb", Params: []byte(`{"query": "q", "database": "db", "endpoint": "localhost:8888", "destination": "stackdriver", "min_point_interval": "1m"}`)},
+	}
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/valid.yaml", Storage: storage, ExtraMetrics: extra})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.metrics) != 6 {
+		t.Fatalf("cfg.metrics expected to have 6 elements; got %v", cfg.metrics)
+	}
+	if got := cfg.metrics[5]; got.Name != "extra2" || got.Options.MinPointInterval != time.Minute {
+		t.Errorf("expected the last metric to be extra2 with min_point_interval of 1m; got %s with %v", got.Name, got.Options.MinPointInterval)
+	}
+
+	for _, tt := range []struct {
+		def     *MetricDefinition
+		wantErr string
+	}{
+		{&MetricDefinition{Name: "foo", Source: "opentsdb", Params: []byte(`{}`)}, "unknown source 'opentsdb'"},
+		{&MetricDefinition{Name: "foo", Source: "datadog", Params: []byte(`{"unknown": 1}`)}, "cannot parse parameters of metric 'foo'"},
+		{&MetricDefinition{Name: "foo", Source: "datadog", Params: []byte(`{"name": "bar"}`)}, "cannot override its name"},
+		{&MetricDefinition{Name: "metric1", Source: "datadog", Params: extra[0].Params}, "duplicate metric name"},
+	} {
+		_, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/valid.yaml", Storage: storage, ExtraMetrics: []*MetricDefinition{tt.def}})
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("expected NewConfig error '%v'; got '%v'", tt.wantErr, err)
+		}
 	}
 }
 
@@ -44,6 +886,12 @@ func TestNewConfigSimple(t *testing.T) {
 		t.Errorf("cfg.metrics expected to have 4 elements; got %v", cfg.metrics)
 	}
 
+	desc := &metricpb.MetricDescriptor{Description: "InfluxDB query: metric3", DisplayName: "query three", Unit: "s"}
+	cfg.metrics[2].Options.describe(desc)
+	if desc.Description != "Number of requests served" || desc.DisplayName != "Requests" || desc.Unit != "1" {
+		t.Errorf("expected configured description, display name and unit to override the descriptor; got %v", desc)
+	}
+
 	// 'testapp' is the default app id used by the emulator
 	if cfg.StackdriverDestinations[0].ProjectID != "testapp" {
 		t.Errorf("expected destination project to be equal to app id; got %v", cfg.StackdriverDestinations[0].ProjectID)
@@ -74,14 +922,46 @@ func TestNewConfigFailedValidation(t *testing.T) {
 	}{
 		{"duplicate_destinations.yaml", "file contains several destinations named"},
 		{"duplicate_metrics.yaml", "duplicate metric name"},
+		{"duplicate_metric_types.yaml", "anomaly series of metric 'errors' and metric 'errors_anomaly' both write to metric type 'custom.googleapis.com/datadog/errors_anomaly'"},
 		{"no_destination.yaml", "destination 'foo' not found"},
 		{"no_datadog_keys.yaml", "configuration file validation error"},
 		{"invalid_name.yaml", "configuration file validation error"},
 		{"no_influxdb_query.yaml", "configuration file validation error"},
+		{"invalid_coalesce.yaml", "configuration file validation error"},
+		{"invalid_label_policy.yaml", "configuration file validation error"},
+		{"invalid_new_label_policy.yaml", "configuration file validation error"},
+		{"invalid_future_points.yaml", "configuration file validation error"},
+		{"invalid_event_grouping.yaml", "configuration file validation error"},
+		{"invalid_graphite_combine.yaml", "configuration file validation error"},
+		{"invalid_redfish_reading.yaml", "configuration file validation error"},
+		{"invalid_mqtt_qos.yaml", "configuration file validation error"},
+		{"invalid_cloudflare_metric.yaml", "configuration file validation error"},
+		{"invalid_postgresql_preset.yaml", `unknown preset "locks"`},
+		{"short_min_point_interval.yaml", "min_point_interval cannot be shorter than"},
+		{"repair_gaps_without_interval.yaml", "repair_gaps requires expected_point_interval"},
+		{"duplicate_secret.yaml", "api_key and api_key_file cannot both be set"},
+		{"missing_secret_file.yaml", "cannot read password_file"},
+		{"invalid_value_mapping.yaml", "configuration file validation error"},
+		{"invalid_min_point_age.yaml", "min_point_age must be between 0 and 24h0m0s"},
+		{"invalid_maintenance_window.yaml", "invalid schedule of maintenance window '0 25 * * *': hour: invalid value '25'"},
+		{"burn_rate_unknown_metric.yaml", "good metric 'requests_good' of burn rate 'availability' not found"},
+		{"burn_rate_objective.yaml", "objective must be between 0 and 1"},
+		{"ratio_two_sources.yaml", "invalid numerator: only one source can be set"},
+		{"tenant_destination.yaml", "tenant 'team_a': destination 'stackdriver' not found"},
+		{"threshold_unknown_channel.yaml", "notification channel 'oncall' of metric 'errors' not found"},
+		{"threshold_no_bound.yaml", "threshold rule 'too_many_errors' must set above or below"},
+		{"import_notification_unknown_channel.yaml", "import notification channel 'cache' of metric 'errors' not found"},
+		{"budget_notification_unknown_channel.yaml", "budget notification channel 'finops' of metric 'errors' not found"},
+		{"invalid_expression.yaml", "invalid options for metric 'errors': invalid expression \"rate(value\": expected ')' at the end of the expression"},
+		{"invalid_series_filter.yaml", "invalid options for metric 'errors': invalid series filter \"host=prod-1\""},
+		{"newer_version.yaml", "configuration file version 99 is newer than version 1 supported by this release"},
 	} {
 		_, err := NewConfig(ctx, &ConfigOptions{Filename: filepath.Join("testdata", tt.filename), Storage: storage})
 		if !strings.Contains(err.Error(), tt.wantErr) {
 			t.Errorf("expected NewConfig error '%v'; got '%v'", tt.wantErr, err)
 		}
+		if !errors.Is(err, tserrors.ErrConfigInvalid) {
+			t.Errorf("expected NewConfig error for %s to be of class '%v'; got %v", tt.filename, tserrors.ErrConfigInvalid, tserrors.Class(err))
+		}
 	}
 }
@@ -0,0 +1,175 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to dumping the effective configuration with secrets redacted.
+package tsbridge
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// redacted replaces values of secrets in the effective configuration.
+const redacted = "[redacted]"
+
+// secretKey matches keys of configuration parameters holding secrets, which are redacted even if the parameter
+// cannot be read from a file, e.g. in parameters of named sources.
+var secretKey = regexp.MustCompile(`(?i)(^|_)(password|passphrase|secret|token|api_key|application_key)$`)
+
+// headersKey is the key of parameters listing HTTP headers, e.g. of probes. Headers often carry credentials (e.g.
+// `Authorization` or `Cookie`), so all of their values are redacted.
+const headersKey = "headers"
+
+// EffectiveConfig is the configuration ts-bridge actually uses: the configuration file after migrations, named
+// sources, metrics defined outside of it (e.g. as Kubernetes resources), secret files and defaults such as project
+// IDs have been applied.
+type EffectiveConfig struct {
+	// File is the resolved configuration file, with secrets redacted. It only has the section of the tenant if the
+	// configuration has been scoped to a tenant.
+	File yaml.MapSlice `yaml:"file"`
+	// Metrics lists all imported metrics in the order they are updated.
+	Metrics []*EffectiveMetric `yaml:"metrics"`
+}
+
+// EffectiveMetric describes how a single metric is imported.
+type EffectiveMetric struct {
+	Name       string        `yaml:"name"`
+	Tenant     string        `yaml:"tenant,omitempty"`
+	Source     string        `yaml:"source"`
+	MetricType string        `yaml:"metric_type"`
+	Project    string        `yaml:"project"`
+	QueryChunk time.Duration `yaml:"query_chunk"`
+	// MaintenanceWindows is the number of maintenance windows that apply to the metric, including windows of its
+	// section.
+	MaintenanceWindows int  `yaml:"maintenance_windows,omitempty"`
+	CircuitBreaker     bool `yaml:"circuit_breaker"`
+	RateLimited        bool `yaml:"rate_limited"`
+}
+
+// Effective returns the effective configuration, with secrets redacted.
+func (c *Config) Effective() (*EffectiveConfig, error) {
+	var section interface{} = c
+	if c.tenant != "" {
+		for _, t := range c.Tenants {
+			if t.Name == c.tenant {
+				section = t
+			}
+		}
+	}
+	data, err := yaml.Marshal(section)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal configuration: %v", err)
+	}
+	e := &EffectiveConfig{Metrics: []*EffectiveMetric{}}
+	if err := yaml.Unmarshal(data, &e.File); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal configuration: %v", err)
+	}
+	e.File = dropEmpty(e.File).(yaml.MapSlice)
+	redactSecrets(e.File)
+	for _, m := range c.metrics {
+		e.Metrics = append(e.Metrics, &EffectiveMetric{
+			Name:               m.Name,
+			Tenant:             m.Tenant,
+			Source:             sourceType(m.Source),
+			MetricType:         m.Source.StackdriverName(),
+			Project:            m.SDProject,
+			QueryChunk:         m.QueryChunk,
+			MaintenanceWindows: len(m.MaintenanceWindows),
+			CircuitBreaker:     m.Breaker != nil,
+			RateLimited:        m.RateLimiter != nil,
+		})
+	}
+	return e, nil
+}
+
+// dropEmpty removes unset sections and parameters (empty lists and nulls) from a YAML document, so that it only
+// lists what is used. Unset scalars are kept, since they show defaults.
+func dropEmpty(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		kept := yaml.MapSlice{}
+		for _, item := range v {
+			if l, ok := item.Value.([]interface{}); item.Value == nil || ok && len(l) == 0 {
+				continue
+			}
+			kept = append(kept, yaml.MapItem{Key: item.Key, Value: dropEmpty(item.Value)})
+		}
+		return kept
+	case []interface{}:
+		for i, item := range v {
+			v[i] = dropEmpty(item)
+		}
+	}
+	return v
+}
+
+// redactSecrets replaces secrets in a YAML document in place. Secrets are values of parameters that can also be read
+// from a file (e.g. `api_key`, if there is an `api_key_file` parameter next to it), parameters with names of secrets,
+// values of HTTP headers and passwords of URLs.
+func redactSecrets(v interface{}) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			key := fmt.Sprint(item.Key)
+			s, ok := item.Value.(string)
+			isSecret := secretKey.MatchString(key) || yamlIndex(v, key+"_file") >= 0
+			headers, isHeaders := item.Value.(yaml.MapSlice)
+			switch {
+			case isHeaders && key == headersKey:
+				for j, h := range headers {
+					if s, ok := h.Value.(string); !ok || s != "" {
+						headers[j].Value = redacted
+					}
+				}
+			case ok && s != "" && isSecret:
+				v[i].Value = redacted
+			case ok:
+				v[i].Value = redactURL(s)
+			default:
+				redactSecrets(item.Value)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			if s, ok := item.(string); ok {
+				v[i] = redactURL(s)
+				continue
+			}
+			redactSecrets(item)
+		}
+	}
+}
+
+// redactURL redacts the password of a URL, e.g. of a proxy or a database connection string.
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); !ok {
+		return s
+	}
+	// The placeholder is inserted after formatting the URL, since brackets would be escaped.
+	u.User = url.UserPassword(u.User.Username(), "x")
+	return strings.Replace(u.String(), ":x@", ":"+redacted+"@", 1)
+}
@@ -0,0 +1,497 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to expressions that transform imported points before they are written.
+package tsbridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// maxMovingAverage is the largest number of points moving_avg can average over, which limits the size of the
+// expression state kept in the metric record.
+const maxMovingAverage = 100
+
+// Expression is a parsed post-transform expression. `value` refers to the value of the current point, and the
+// following functions are supported:
+//   - clamp(e, min, max) limits a value to a range;
+//   - rate(e) is the per-second rate of change of `e` since the previous point of the time series, treating
+//     decreases as counter resets;
+//   - moving_avg(e, n) is the average of `e` over the last n points of the time series.
+type Expression struct {
+	text string
+	root exprNode
+	// stateful is the number of rate and moving_avg calls, each of which keeps recent values of its argument.
+	stateful int
+	rate     bool
+}
+
+// exprSample is a value kept for a stateful call between points.
+type exprSample struct {
+	End   time.Time `json:"end"`
+	Value float64   `json:"value"`
+}
+
+// exprSeriesState is the state of an expression for a single time series.
+type exprSeriesState struct {
+	// Last is the end time of the newest point evaluated; older points have been evaluated before.
+	Last    time.Time      `json:"last"`
+	Samples [][]exprSample `json:"samples"`
+}
+
+// exprState is the state of an expression for all time series of a metric, which is kept in the metric record.
+type exprState struct {
+	Expression string                      `json:"expression"`
+	Series     map[string]*exprSeriesState `json:"series"`
+}
+
+// exprPoint is the point an expression is being evaluated for.
+type exprPoint struct {
+	value float64
+	end   time.Time
+	state *exprSeriesState
+}
+
+// exprNode is a node of a parsed expression. eval returns false if the node has no value for a point, e.g. the
+// rate of the first point of a time series.
+type exprNode interface {
+	eval(p *exprPoint) (float64, bool)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(*exprPoint) (float64, bool) { return float64(n), true }
+
+type valueNode struct{}
+
+func (valueNode) eval(p *exprPoint) (float64, bool) { return p.value, true }
+
+type negNode struct{ x exprNode }
+
+func (n *negNode) eval(p *exprPoint) (float64, bool) {
+	v, ok := n.x.eval(p)
+	return -v, ok
+}
+
+type binaryNode struct {
+	op   byte
+	l, r exprNode
+}
+
+func (n *binaryNode) eval(p *exprPoint) (float64, bool) {
+	// Both operands are evaluated, so that stateful calls see every point.
+	l, lok := n.l.eval(p)
+	r, rok := n.r.eval(p)
+	if !lok || !rok {
+		return 0, false
+	}
+	switch n.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	}
+	return l / r, true
+}
+
+type clampNode struct{ x, min, max exprNode }
+
+func (n *clampNode) eval(p *exprPoint) (float64, bool) {
+	v, ok := n.x.eval(p)
+	lo, lok := n.min.eval(p)
+	hi, hok := n.max.eval(p)
+	if !ok || !lok || !hok {
+		return 0, false
+	}
+	return math.Min(math.Max(v, lo), hi), true
+}
+
+type rateNode struct {
+	id int
+	x  exprNode
+}
+
+func (n *rateNode) eval(p *exprPoint) (float64, bool) {
+	v, ok := n.x.eval(p)
+	if !ok {
+		return 0, false
+	}
+	prev := p.state.Samples[n.id]
+	p.state.Samples[n.id] = []exprSample{{p.end, v}}
+	if len(prev) == 0 {
+		return 0, false
+	}
+	seconds := p.end.Sub(prev[0].End).Seconds()
+	if seconds <= 0 {
+		return 0, false
+	}
+	delta := v - prev[0].Value
+	if delta < 0 {
+		delta = v
+	}
+	return delta / seconds, true
+}
+
+type movingAvgNode struct {
+	id int
+	x  exprNode
+	n  int
+}
+
+func (n *movingAvgNode) eval(p *exprPoint) (float64, bool) {
+	v, ok := n.x.eval(p)
+	if !ok {
+		return 0, false
+	}
+	samples := append(p.state.Samples[n.id], exprSample{p.end, v})
+	if len(samples) > n.n {
+		samples = samples[len(samples)-n.n:]
+	}
+	p.state.Samples[n.id] = samples
+	sum := 0.0
+	for _, s := range samples {
+		sum += s.Value
+	}
+	return sum / float64(len(samples)), true
+}
+
+// ParseExpression parses a post-transform expression.
+func ParseExpression(text string) (*Expression, error) {
+	p := &exprParser{text: text}
+	if err := p.tokenize(); err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", text, err)
+	}
+	e := &Expression{text: text}
+	root, err := p.parseSum(e)
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected '%s'", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", text, err)
+	}
+	e.root = root
+	return e, nil
+}
+
+// exprParser is a recursive descent parser of expressions.
+type exprParser struct {
+	text   string
+	tokens []string
+	pos    int
+}
+
+// tokenize splits the expression into numbers, identifiers and operators.
+func (p *exprParser) tokenize() error {
+	s := p.text
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.IndexByte("+-*/(),", c) >= 0:
+			p.tokens = append(p.tokens, string(c))
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.' || s[j] == 'e' || s[j] == 'E' ||
+				(s[j] == '-' || s[j] == '+') && (s[j-1] == 'e' || s[j-1] == 'E')) {
+				j++
+			}
+			p.tokens = append(p.tokens, s[i:j])
+			i = j
+		case c >= 'a' && c <= 'z' || c == '_':
+			j := i
+			for j < len(s) && (s[j] >= 'a' && s[j] <= 'z' || s[j] >= '0' && s[j] <= '9' || s[j] == '_') {
+				j++
+			}
+			p.tokens = append(p.tokens, s[i:j])
+			i = j
+		default:
+			return fmt.Errorf("unexpected character '%c'", c)
+		}
+	}
+	if len(p.tokens) == 0 {
+		return fmt.Errorf("expression is empty")
+	}
+	return nil
+}
+
+// peek returns the current token, or an empty string at the end of the expression.
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// expect consumes a given token.
+func (p *exprParser) expect(token string) error {
+	if got := p.peek(); got != token {
+		if got == "" {
+			return fmt.Errorf("expected '%s' at the end of the expression", token)
+		}
+		return fmt.Errorf("expected '%s', got '%s'", token, got)
+	}
+	p.pos++
+	return nil
+}
+
+// parseSum parses additions and subtractions.
+func (p *exprParser) parseSum(e *Expression) (exprNode, error) {
+	l, err := p.parseProduct(e)
+	for err == nil && (p.peek() == "+" || p.peek() == "-") {
+		op := p.peek()[0]
+		p.pos++
+		var r exprNode
+		if r, err = p.parseProduct(e); err == nil {
+			l = &binaryNode{op, l, r}
+		}
+	}
+	return l, err
+}
+
+// parseProduct parses multiplications and divisions.
+func (p *exprParser) parseProduct(e *Expression) (exprNode, error) {
+	l, err := p.parseUnary(e)
+	for err == nil && (p.peek() == "*" || p.peek() == "/") {
+		op := p.peek()[0]
+		p.pos++
+		var r exprNode
+		if r, err = p.parseUnary(e); err == nil {
+			l = &binaryNode{op, l, r}
+		}
+	}
+	return l, err
+}
+
+// parseUnary parses negations, numbers, `value`, function calls and parenthesized expressions.
+func (p *exprParser) parseUnary(e *Expression) (exprNode, error) {
+	token := p.peek()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of the expression")
+	case token == "-":
+		p.pos++
+		x, err := p.parseUnary(e)
+		return &negNode{x}, err
+	case token == "(":
+		p.pos++
+		x, err := p.parseSum(e)
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case token[0] >= '0' && token[0] <= '9' || token[0] == '.':
+		v, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", token)
+		}
+		p.pos++
+		return numberNode(v), nil
+	case token == "value":
+		p.pos++
+		return valueNode{}, nil
+	case token == "clamp" || token == "rate" || token == "moving_avg":
+		p.pos++
+		return p.parseCall(e, token)
+	}
+	return nil, fmt.Errorf("unknown identifier '%s'", token)
+}
+
+// parseCall parses the arguments of a function call.
+func (p *exprParser) parseCall(e *Expression, name string) (exprNode, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []exprNode
+	for {
+		arg, err := p.parseSum(e)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.peek() != "," {
+			break
+		}
+		p.pos++
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "clamp":
+		if len(args) != 3 {
+			return nil, fmt.Errorf("clamp() takes 3 arguments, got %d", len(args))
+		}
+		return &clampNode{args[0], args[1], args[2]}, nil
+	case "rate":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("rate() takes 1 argument, got %d", len(args))
+		}
+		e.rate = true
+		e.stateful++
+		return &rateNode{e.stateful - 1, args[0]}, nil
+	}
+	if len(args) != 2 {
+		return nil, fmt.Errorf("moving_avg() takes 2 arguments, got %d", len(args))
+	}
+	n, ok := args[1].(numberNode)
+	if !ok || n != numberNode(math.Trunc(float64(n))) || n < 1 || n > maxMovingAverage {
+		return nil, fmt.Errorf("the second argument of moving_avg() must be a number of points between 1 and %d", maxMovingAverage)
+	}
+	e.stateful++
+	return &movingAvgNode{e.stateful - 1, args[0], int(n)}, nil
+}
+
+// String returns the text of the expression.
+func (e *Expression) String() string {
+	return e.text
+}
+
+// decodeState returns the expression state kept in the metric record. State of a different expression is
+// discarded.
+func (e *Expression) decodeState(data []byte) (*exprState, error) {
+	state := &exprState{Expression: e.text, Series: make(map[string]*exprSeriesState)}
+	if len(data) == 0 {
+		return state, nil
+	}
+	var stored exprState
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("cannot decode expression state: %v", err)
+	}
+	if stored.Expression != e.text || stored.Series == nil {
+		return state, nil
+	}
+	return &stored, nil
+}
+
+// apply evaluates the expression for all points of a metric, in time order within each time series, and returns the
+// resulting DOUBLE time series (with a single point each, sorted by time) along with the new expression state and
+// the number of points that have been dropped because the expression had no finite value for them. Points that are
+// not newer than the last point evaluated for their time series are dropped as well, since they have been evaluated
+// (and written) before.
+//
+// Expressions that use rate() write GAUGE metrics; other expressions keep the metric kind of the source.
+func (e *Expression) apply(data []byte, desc *metricpb.MetricDescriptor, series []*monitoringpb.TimeSeries) ([]*monitoringpb.TimeSeries, []byte, int, error) {
+	state, err := e.decodeState(data)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if desc.GetValueType() == metricpb.MetricDescriptor_DISTRIBUTION {
+		return nil, nil, 0, fmt.Errorf("expressions cannot be used with distribution metrics")
+	}
+
+	type evalPoint struct {
+		key    string
+		series *monitoringpb.TimeSeries
+		point  *monitoringpb.Point
+		end    time.Time
+	}
+	var points []*evalPoint
+	for _, ts := range series {
+		if ts.ValueType == metricpb.MetricDescriptor_DISTRIBUTION {
+			return nil, nil, 0, fmt.Errorf("expressions cannot be used with distribution metrics")
+		}
+		key := proto.CompactTextString(ts.Metric) + proto.CompactTextString(ts.Resource)
+		for _, p := range ts.Points {
+			end, err := ptypes.Timestamp(p.GetInterval().GetEndTime())
+			if err != nil {
+				return nil, nil, 0, fmt.Errorf("could not parse point timestamp for %v: %v", p, err)
+			}
+			points = append(points, &evalPoint{key, ts, p, end})
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].end.Before(points[j].end) })
+
+	var output []*monitoringpb.TimeSeries
+	dropped := 0
+	for _, p := range points {
+		s, ok := state.Series[p.key]
+		if !ok || len(s.Samples) != e.stateful {
+			s = &exprSeriesState{Samples: make([][]exprSample, e.stateful)}
+			state.Series[p.key] = s
+		}
+		if !p.end.After(s.Last) {
+			dropped++
+			continue
+		}
+		s.Last = p.end
+		v, ok := e.root.eval(&exprPoint{value: pointValue(p.point), end: p.end, state: s})
+		if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+			dropped++
+			continue
+		}
+
+		ts := proto.Clone(p.series).(*monitoringpb.TimeSeries)
+		point := proto.Clone(p.point).(*monitoringpb.Point)
+		point.Value = &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: v}}
+		ts.ValueType = metricpb.MetricDescriptor_DOUBLE
+		if e.rate {
+			ts.MetricKind = metricpb.MetricDescriptor_GAUGE
+			point.Interval = &monitoringpb.TimeInterval{EndTime: point.GetInterval().GetEndTime()}
+		}
+		ts.Points = []*monitoringpb.Point{point}
+		output = append(output, ts)
+	}
+
+	if desc != nil {
+		desc.ValueType = metricpb.MetricDescriptor_DOUBLE
+		if e.rate {
+			desc.MetricKind = metricpb.MetricDescriptor_GAUGE
+		}
+	}
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("cannot encode expression state: %v", err)
+	}
+	return output, encoded, dropped, nil
+}
+
+// applyExpression evaluates the expression of the metric for imported points. The returned expression state needs
+// to be kept in the metric record once the points have been written; it's nil if the state has not changed.
+func (m *Metric) applyExpression(ctx context.Context, desc *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) ([]*monitoringpb.TimeSeries, []byte, error) {
+	e, err := ParseExpression(m.Options.Expression)
+	if err != nil {
+		return nil, nil, err
+	}
+	ts, state, dropped, err := e.apply(m.Record.GetExpressionState(), desc, ts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(state, m.Record.GetExpressionState()) {
+		state = nil
+	}
+	if dropped > 0 {
+		log.WithContext(ctx).Debugf("%s: expression had no new value for %d points, which have been dropped", m.Name, dropped)
+	}
+	return ts, state, nil
+}
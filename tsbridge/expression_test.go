@@ -0,0 +1,159 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestParseExpressionErrors(t *testing.T) {
+	for _, tt := range []struct {
+		expr    string
+		wantErr string
+	}{
+		{"", "expression is empty"},
+		{"value +", "unexpected end of the expression"},
+		{"value $ 2", "unexpected character '$'"},
+		{"(value", "expected ')' at the end of the expression"},
+		{"value value", "unexpected 'value'"},
+		{"x * 2", "unknown identifier 'x'"},
+		{"clamp(value, 0)", "clamp() takes 3 arguments, got 2"},
+		{"rate(value, 1)", "rate() takes 1 argument, got 2"},
+		{"moving_avg(value, 2.5)", "must be a number of points between 1 and 100"},
+		{"moving_avg(value, 1000)", "must be a number of points between 1 and 100"},
+		{"1e", "invalid number '1e'"},
+	} {
+		_, err := ParseExpression(tt.expr)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("ParseExpression(%q) returned error %v; want %q", tt.expr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestExpressionApply(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	for _, tt := range []struct {
+		expr       string
+		values     []float64
+		wantValues []float64
+	}{
+		{"value * 8 - 1", []float64{1, 2}, []float64{7, 15}},
+		{"-(value + 1) / 2", []float64{1, 3}, []float64{-1, -2}},
+		{"2 * 3 + value * 1.5e1", []float64{1}, []float64{21}},
+		{"clamp(value, 0, 10)", []float64{-5, 5, 50}, []float64{0, 5, 10}},
+		{"value / 0", []float64{1}, nil},
+		// Points are a minute apart, and the first point has no rate.
+		{"rate(value)", []float64{60, 180, 60}, []float64{2, 1}},
+		{"moving_avg(value, 2)", []float64{1, 3, 7}, []float64{1, 2, 5}},
+		{"rate(value) + moving_avg(value, 3)", []float64{0, 60, 120}, []float64{31, 61}},
+	} {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := ParseExpression(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			desc := &metricpb.MetricDescriptor{MetricKind: metricpb.MetricDescriptor_GAUGE, ValueType: metricpb.MetricDescriptor_INT64}
+			got, _, _, err := e.apply(nil, desc, gaugeSeries(start, time.Minute, tt.values...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, values := seriesPoints(start, got); !reflect.DeepEqual(values, tt.wantValues) {
+				t.Errorf("got values %v; want %v", values, tt.wantValues)
+			}
+			if desc.ValueType != metricpb.MetricDescriptor_DOUBLE {
+				t.Errorf("expected the value type to become DOUBLE; got %v", desc.ValueType)
+			}
+		})
+	}
+}
+
+func TestExpressionState(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	e, err := ParseExpression("rate(value)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cumulative := func(series []*monitoringpb.TimeSeries) []*monitoringpb.TimeSeries {
+		for _, ts := range series {
+			ts.MetricKind = metricpb.MetricDescriptor_CUMULATIVE
+		}
+		return series
+	}
+	desc := &metricpb.MetricDescriptor{MetricKind: metricpb.MetricDescriptor_CUMULATIVE, ValueType: metricpb.MetricDescriptor_INT64}
+
+	// The first update only has a single point, which has no rate but is kept in the state.
+	got, state, dropped, err := e.apply(nil, desc, cumulative(gaugeSeries(start, time.Minute, 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 || dropped != 1 {
+		t.Errorf("expected the first point to be dropped; got %v (%d dropped)", got, dropped)
+	}
+	if desc.MetricKind != metricpb.MetricDescriptor_GAUGE {
+		t.Errorf("expected rates to be written as a GAUGE metric; got %v", desc.MetricKind)
+	}
+
+	// The next update returns the first point again, along with a counter reset.
+	got, state, dropped, err = e.apply(state, desc, cumulative(gaugeSeries(start, time.Minute, 100, 160, 30)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets, values := seriesPoints(start, got)
+	if want := []float64{1, 0.5}; !reflect.DeepEqual(values, want) {
+		t.Errorf("got values %v; want %v", values, want)
+	}
+	if want := []time.Duration{time.Minute, 2 * time.Minute}; !reflect.DeepEqual(offsets, want) {
+		t.Errorf("got offsets %v; want %v", offsets, want)
+	}
+	if dropped != 1 {
+		t.Errorf("expected the point evaluated before to be dropped; got %d dropped", dropped)
+	}
+	for _, ts := range got {
+		if ts.MetricKind != metricpb.MetricDescriptor_GAUGE || ts.Points[0].Interval.StartTime != nil {
+			t.Errorf("expected a GAUGE point without start time; got %v", ts)
+		}
+	}
+
+	// State of a different expression is discarded.
+	other, err := ParseExpression("rate(value) * 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, _, err = other.apply(state, desc, gaugeSeries(start.Add(3*time.Minute), time.Minute, 90))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("expected no rate without the state of the same expression; got %v", got)
+	}
+}
+
+func TestExpressionDistribution(t *testing.T) {
+	e, err := ParseExpression("value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := &metricpb.MetricDescriptor{ValueType: metricpb.MetricDescriptor_DISTRIBUTION}
+	if _, _, _, err := e.apply(nil, desc, nil); err == nil || !strings.Contains(err.Error(), "distribution") {
+		t.Errorf("expected an error for distribution metrics; got %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to exposing the latest imported points in the Prometheus text format.
+package tsbridge
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// maxFederatedSeries limits the number of time series of each metric kept for federation, so that metrics with
+// unbounded label values cannot use up memory. Further series are not exposed.
+const maxFederatedSeries = 10000
+
+// federatedSeries is the latest point written for a time series.
+type federatedSeries struct {
+	labels map[string]string
+	value  float64
+	end    time.Time
+}
+
+// federatedMetric keeps the latest points written for all time series of a metric, keyed by their labels.
+type federatedMetric struct {
+	metricType string
+	counter    bool
+	series     map[string]*federatedSeries
+}
+
+// federation keeps the latest points written by this process, keyed by metric name. Like in-flight updates, it's
+// shared by all syncs running in this process.
+var federation = struct {
+	sync.Mutex
+	metrics map[string]*federatedMetric
+}{metrics: make(map[string]*federatedMetric)}
+
+// federate keeps the latest point of each written time series for WriteFederation. Distribution points are left
+// out, since they have no single value.
+func (m *Metric) federate(desc *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) {
+	federation.Lock()
+	defer federation.Unlock()
+	f, ok := federation.metrics[m.Name]
+	if !ok {
+		f = &federatedMetric{series: make(map[string]*federatedSeries)}
+		federation.metrics[m.Name] = f
+	}
+	f.metricType = m.Source.StackdriverName()
+	f.counter = desc.GetMetricKind() == metricpb.MetricDescriptor_CUMULATIVE
+	for _, t := range ts {
+		for _, p := range t.Points {
+			if p.GetValue().GetDistributionValue() != nil {
+				continue
+			}
+			value := pointValue(p)
+			end, err := ptypes.Timestamp(p.GetInterval().GetEndTime())
+			if err != nil {
+				continue
+			}
+			key := seriesLabelsKey(t.GetMetric().GetLabels())
+			s, ok := f.series[key]
+			if !ok {
+				if len(f.series) >= maxFederatedSeries {
+					continue
+				}
+				s = &federatedSeries{labels: t.GetMetric().GetLabels()}
+				f.series[key] = s
+			}
+			if !end.Before(s.end) {
+				s.value, s.end = value, end
+			}
+		}
+	}
+}
+
+// seriesLabelsKey returns a key identifying a time series of a metric by its labels.
+func seriesLabelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%q=%q,", k, labels[k])
+	}
+	return b.String()
+}
+
+// invalidPromChars matches characters that are not allowed in Prometheus metric names and label names.
+var invalidPromChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// federatedName returns the Prometheus name of a metric type, without its domain, e.g. `datadog_requests` for
+// `custom.googleapis.com/datadog/requests`.
+func federatedName(metricType string) string {
+	if i := strings.Index(metricType, "/"); i >= 0 {
+		metricType = metricType[i+1:]
+	}
+	return promName(metricType)
+}
+
+// promName replaces characters that are not allowed in Prometheus names.
+func promName(name string) string {
+	name = invalidPromChars.ReplaceAllString(name, "_")
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// promLabelValue escapes a label value of the Prometheus text format.
+var promLabelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteFederation writes the latest point of every time series written by this process in the Prometheus text
+// exposition format, so that the imported metrics can be scraped by Prometheus as well. Each series has a
+// `ts_bridge_metric` label with the name of the metric it has been imported by, and the timestamp of the point.
+func WriteFederation(w io.Writer) error {
+	federation.Lock()
+	defer federation.Unlock()
+
+	// Metrics of several tenants or destinations can have the same type, and need to be listed together.
+	type family struct {
+		counter bool
+		lines   []string
+	}
+	families := make(map[string]*family)
+	for name, f := range federation.metrics {
+		metricName := federatedName(f.metricType)
+		fam, ok := families[metricName]
+		if !ok {
+			fam = &family{counter: f.counter}
+			families[metricName] = fam
+		}
+		for _, s := range f.series {
+			labels := make([]string, 0, len(s.labels)+1)
+			for k, v := range s.labels {
+				labels = append(labels, fmt.Sprintf(`%s="%s"`, promName(k), promLabelValue.Replace(v)))
+			}
+			sort.Strings(labels)
+			labels = append(labels, fmt.Sprintf(`ts_bridge_metric="%s"`, promLabelValue.Replace(name)))
+			fam.lines = append(fam.lines, fmt.Sprintf("%s{%s} %s %d", metricName, strings.Join(labels, ","),
+				strconv.FormatFloat(s.value, 'g', -1, 64), s.end.UnixNano()/int64(time.Millisecond)))
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for n := range families {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fam := families[n]
+		if len(fam.lines) == 0 {
+			continue
+		}
+		kind := "gauge"
+		if fam.counter {
+			kind = "counter"
+		}
+		sort.Strings(fam.lines)
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n%s\n", n, kind, strings.Join(fam.lines, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/google/ts-bridge/mocks"
+	"google.golang.org/genproto/googleapis/api/distribution"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestWriteFederation(t *testing.T) {
+	defer func(m map[string]*federatedMetric) { federation.metrics = m }(federation.metrics)
+	federation.metrics = make(map[string]*federatedMetric)
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	newMetric := func(name, metricType string) *Metric {
+		src := mocks.NewMockSourceMetric(mockCtrl)
+		src.EXPECT().StackdriverName().Return(metricType).AnyTimes()
+		return &Metric{Name: name, Source: src}
+	}
+	gauge := &metricpb.MetricDescriptor{MetricKind: metricpb.MetricDescriptor_GAUGE}
+	counter := &metricpb.MetricDescriptor{MetricKind: metricpb.MetricDescriptor_CUMULATIVE}
+	start := time.Unix(1600000000, 0)
+
+	requests := newMetric("requests", "custom.googleapis.com/datadog/requests")
+	ts := gaugeSeries(start, time.Minute, 1, 2, 3)
+	ts[0].Metric.Labels = map[string]string{"host": "a"}
+	ts[1].Metric.Labels = map[string]string{"host": "b", "bad-key": `quote"d`}
+	ts[2].Metric.Labels = map[string]string{"host": "a"}
+	requests.federate(gauge, ts)
+	// Older points don't replace newer ones.
+	old := gaugeSeries(start, time.Minute, 10)
+	old[0].Metric.Labels = map[string]string{"host": "a"}
+	requests.federate(gauge, old)
+
+	// Metrics of different tenants with the same type are listed together.
+	tenant := newMetric("team_a/requests", "custom.googleapis.com/datadog/requests")
+	tenant.federate(gauge, gaugeSeries(start, time.Minute, 4))
+
+	errorCount := newMetric("errors", "custom.googleapis.com/influxdb/errors.total")
+	errs := valueSeries(&monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: 7}},
+		&monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{DistributionValue: &distribution.Distribution{Count: 1}}})
+	errs[1].Metric.Labels = map[string]string{"kind": "distribution"}
+	errorCount.federate(counter, errs)
+
+	var b bytes.Buffer
+	if err := WriteFederation(&b); err != nil {
+		t.Fatal(err)
+	}
+	errEnd := seriesEnd(errs[0]).UnixNano() / int64(time.Millisecond)
+	want := `# TYPE datadog_requests gauge
+datadog_requests{bad_key="quote\"d",host="b",ts_bridge_metric="requests"} 2 1600000060000
+datadog_requests{host="a",ts_bridge_metric="requests"} 3 1600000120000
+datadog_requests{ts_bridge_metric="team_a/requests"} 4 1600000000000
+# TYPE influxdb_errors_total counter
+influxdb_errors_total{ts_bridge_metric="errors"} 7 ` + strconv.FormatInt(errEnd, 10) + `
+`
+	if b.String() != want {
+		t.Errorf("expected federation output:\n%s\ngot:\n%s", want, b.String())
+	}
+}
+
+func TestFederatedName(t *testing.T) {
+	for in, want := range map[string]string{
+		"custom.googleapis.com/datadog/requests":       "datadog_requests",
+		"custom.googleapis.com/team-a/http.latency":    "team_a_http_latency",
+		"workload.googleapis.com/1st/metric":           "_1st_metric",
+		"custom.googleapis.com/datadog/errors_anomaly": "datadog_errors_anomaly",
+	} {
+		if got := federatedName(in); got != want {
+			t.Errorf("federatedName(%s): expected %s; got %s", in, want, got)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to filtering time series returned by sources by their labels.
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// seriesMatcherRE matches series filters like `host=~"prod-.*"`.
+var seriesMatcherRE = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_.]*)\s*(=~|!~|!=|=)\s*("(?:[^"\\]|\\.)*")\s*$`)
+
+// seriesMatcher matches a label of time series, like label matchers of PromQL. Regular expressions are anchored.
+type seriesMatcher struct {
+	label string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+// parseSeriesFilter parses a series filter, which is a label key, an operator (`=`, `!=`, `=~` or `!~`) and a quoted
+// value. Label keys starting with `resource.` refer to labels of the monitored resource.
+func parseSeriesFilter(filter string) (*seriesMatcher, error) {
+	m := seriesMatcherRE.FindStringSubmatch(filter)
+	if m == nil {
+		return nil, fmt.Errorf("invalid series filter %q: filters need to look like label=\"value\", with one of the operators =, !=, =~ and !~", filter)
+	}
+	value, err := strconv.Unquote(m[3])
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of series filter %q: %v", filter, err)
+	}
+	matcher := &seriesMatcher{label: m[1], op: m[2], value: value}
+	if matcher.op == "=~" || matcher.op == "!~" {
+		if matcher.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+			return nil, fmt.Errorf("invalid regular expression of series filter %q: %v", filter, err)
+		}
+	}
+	return matcher, nil
+}
+
+// parseSeriesFilters parses all series filters of a metric.
+func parseSeriesFilters(filters []string) ([]*seriesMatcher, error) {
+	var matchers []*seriesMatcher
+	for _, f := range filters {
+		m, err := parseSeriesFilter(f)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+// matches returns true if a time series matches. Missing labels are matched as empty values.
+func (m *seriesMatcher) matches(ts *monitoringpb.TimeSeries) bool {
+	var v string
+	if key := strings.TrimPrefix(m.label, "resource."); key != m.label {
+		v = ts.GetResource().GetLabels()[key]
+	} else {
+		v = ts.GetMetric().GetLabels()[m.label]
+	}
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	}
+	return !m.re.MatchString(v)
+}
+
+// matchAll returns true if a time series matches all matchers.
+func matchAll(ts *monitoringpb.TimeSeries, matchers []*seriesMatcher) bool {
+	for _, m := range matchers {
+		if !m.matches(ts) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterSeries returns the time series that match all matchers, along with the number of points of other series.
+func filterSeries(series []*monitoringpb.TimeSeries, matchers []*seriesMatcher) ([]*monitoringpb.TimeSeries, int) {
+	if len(matchers) == 0 {
+		return series, 0
+	}
+	var output []*monitoringpb.TimeSeries
+	dropped := 0
+	for _, ts := range series {
+		if !matchAll(ts, matchers) {
+			dropped += len(ts.Points)
+			continue
+		}
+		output = append(output, ts)
+	}
+	return output, dropped
+}
+
+// applySeriesFilters drops time series returned by the source that do not match the series filters of the metric.
+func (m *Metric) applySeriesFilters(ctx context.Context, ts []*monitoringpb.TimeSeries) ([]*monitoringpb.TimeSeries, error) {
+	matchers, err := parseSeriesFilters(m.Options.SeriesFilters)
+	if err != nil {
+		return nil, err
+	}
+	ts, dropped := filterSeries(ts, matchers)
+	if dropped > 0 {
+		log.WithContext(ctx).Debugf("%s: %d points of time series not matching series_filters have been dropped", m.Name, dropped)
+	}
+	return ts, nil
+}
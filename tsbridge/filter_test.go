@@ -0,0 +1,90 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func labeledSeries(host, zone string) *monitoringpb.TimeSeries {
+	labels := map[string]string{}
+	if host != "" {
+		labels["host"] = host
+	}
+	return &monitoringpb.TimeSeries{
+		Metric:   &metricpb.Metric{Type: "custom.googleapis.com/test", Labels: labels},
+		Resource: &monitoredres.MonitoredResource{Type: "global", Labels: map[string]string{"zone": zone}},
+		Points:   []*monitoringpb.Point{{}, {}},
+	}
+}
+
+func TestFilterSeries(t *testing.T) {
+	series := []*monitoringpb.TimeSeries{
+		labeledSeries("prod-1", "us-east1"),
+		labeledSeries("prod-2", "europe-west1"),
+		labeledSeries("staging-1", "us-east1"),
+		labeledSeries("", "us-east1"),
+	}
+	for _, tt := range []struct {
+		filters     []string
+		wantHosts   []string
+		wantDropped int
+	}{
+		{nil, []string{"prod-1", "prod-2", "staging-1", ""}, 0},
+		{[]string{`host=~"prod-.*"`}, []string{"prod-1", "prod-2"}, 4},
+		// Regular expressions are anchored, and missing labels are matched as empty values.
+		{[]string{`host!~"prod"`}, []string{"prod-1", "prod-2", "staging-1", ""}, 0},
+		{[]string{`host=""`}, []string{""}, 6},
+		{[]string{`host!="staging-1"`, `resource.zone="us-east1"`}, []string{"prod-1", ""}, 4},
+		{[]string{` host =~ "prod-\\d" `}, []string{"prod-1", "prod-2"}, 4},
+	} {
+		matchers, err := parseSeriesFilters(tt.filters)
+		if err != nil {
+			t.Fatalf("parseSeriesFilters(%q) returned error: %v", tt.filters, err)
+		}
+		got, dropped := filterSeries(series, matchers)
+		var hosts []string
+		for _, ts := range got {
+			hosts = append(hosts, ts.Metric.Labels["host"])
+		}
+		if !reflect.DeepEqual(hosts, tt.wantHosts) || dropped != tt.wantDropped {
+			t.Errorf("filterSeries(%q) kept hosts %q and dropped %d points; want %q and %d", tt.filters, hosts, dropped, tt.wantHosts, tt.wantDropped)
+		}
+	}
+}
+
+func TestParseSeriesFilterErrors(t *testing.T) {
+	for _, tt := range []struct {
+		filter  string
+		wantErr string
+	}{
+		{`host`, "filters need to look like"},
+		{`host=prod`, "filters need to look like"},
+		{`host=="prod"`, "filters need to look like"},
+		{`host=~"prod-("`, "invalid regular expression"},
+		{`host="\q"`, "invalid value"},
+	} {
+		_, err := parseSeriesFilter(tt.filter)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("parseSeriesFilter(%q) returned error %v; want %q", tt.filter, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to detecting and repairing gaps in imported time series.
+package tsbridge
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// sdMaxPointAge is the maximum age of a point that Stackdriver accepts.
+// See https://cloud.google.com/monitoring/custom-metrics/creating-metrics#writing-ts
+const sdMaxPointAge = 24 * time.Hour
+
+// defaultGapRepairWindow is how long points following a gap are held back while waiting for the gap to be filled.
+const defaultGapRepairWindow = time.Hour
+
+// gap is a period of time during which the source did not return any points for a time series.
+type gap struct {
+	start   time.Time // timestamp of the last point before the gap.
+	end     time.Time // timestamp of the first point after the gap.
+	missing int       // number of points expected within the gap.
+}
+
+// findGaps returns gaps between consecutive points of each time series, sorted by start time. A gap is detected
+// when two consecutive points are more than twice the `expected` point interval apart.
+func findGaps(series []*monitoringpb.TimeSeries, expected time.Duration) ([]gap, error) {
+	if expected <= 0 {
+		return nil, nil
+	}
+
+	timestamps := make(map[string][]time.Time)
+	for _, ts := range series {
+		key := proto.CompactTextString(ts.Metric) + proto.CompactTextString(ts.Resource)
+		for _, p := range ts.Points {
+			end, err := ptypes.Timestamp(p.GetInterval().GetEndTime())
+			if err != nil {
+				return nil, fmt.Errorf("could not parse point timestamp for %v: %v", p, err)
+			}
+			timestamps[key] = append(timestamps[key], end)
+		}
+	}
+
+	var gaps []gap
+	for _, times := range timestamps {
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		for i := 1; i < len(times); i++ {
+			if d := times[i].Sub(times[i-1]); d > 2*expected {
+				gaps = append(gaps, gap{start: times[i-1], end: times[i], missing: int(d/expected) - 1})
+			}
+		}
+	}
+	sort.Slice(gaps, func(i, j int) bool { return gaps[i].start.Before(gaps[j].start) })
+	return gaps, nil
+}
+
+// missingPoints returns the total number of points expected within a list of gaps.
+func missingPoints(gaps []gap) int {
+	missing := 0
+	for _, g := range gaps {
+		missing += g.missing
+	}
+	return missing
+}
+
+// pointsUntil returns time series that only contain points with timestamps not later than `until`.
+func pointsUntil(series []*monitoringpb.TimeSeries, until time.Time) ([]*monitoringpb.TimeSeries, error) {
+	var output []*monitoringpb.TimeSeries
+	for _, ts := range series {
+		var points []*monitoringpb.Point
+		for _, p := range ts.Points {
+			end, err := ptypes.Timestamp(p.GetInterval().GetEndTime())
+			if err != nil {
+				return nil, fmt.Errorf("could not parse point timestamp for %v: %v", p, err)
+			}
+			if !end.After(until) {
+				points = append(points, p)
+			}
+		}
+		if len(points) == 0 {
+			continue
+		}
+		if len(points) < len(ts.Points) {
+			ts = proto.Clone(ts).(*monitoringpb.TimeSeries)
+			ts.Points = points
+		}
+		output = append(output, ts)
+	}
+	return output, nil
+}
+
+// countPoints returns the total number of points in a slice of time series.
+func countPoints(series []*monitoringpb.TimeSeries) int {
+	n := 0
+	for _, ts := range series {
+		n += len(ts.Points)
+	}
+	return n
+}
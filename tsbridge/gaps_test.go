@@ -0,0 +1,112 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/datastore"
+	"github.com/google/ts-bridge/mocks"
+
+	"github.com/golang/mock/gomock"
+	"go.opencensus.io/stats/view"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+func TestFindGaps(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	series := gaugeSeries(start, time.Minute, 1, 2, 3)
+	// Move the last point 5 minutes forward, leaving a gap of 4 missing points.
+	series = append(series[:2], gaugeSeries(start.Add(6*time.Minute), time.Minute, 4)...)
+
+	gaps, err := findGaps(series, time.Minute)
+	if err != nil {
+		t.Fatalf("findGaps() returned error: %v", err)
+	}
+	if len(gaps) != 1 || !gaps[0].start.Equal(start.Add(time.Minute)) || !gaps[0].end.Equal(start.Add(6*time.Minute)) || gaps[0].missing != 4 {
+		t.Errorf("findGaps() expected a single gap with 4 missing points after the second point; got %v", gaps)
+	}
+
+	// Points that are less than twice the expected interval apart are not considered gaps.
+	if gaps, _ := findGaps(gaugeSeries(start, 90*time.Second, 1, 2, 3), time.Minute); len(gaps) > 0 {
+		t.Errorf("findGaps() expected no gaps; got %v", gaps)
+	}
+}
+
+func TestPointsUntil(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	got, err := pointsUntil(gaugeSeries(start, time.Minute, 1, 2, 3, 4), start.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("pointsUntil() returned error: %v", err)
+	}
+	if _, values := seriesPoints(start, got); !reflect.DeepEqual(values, []float64{1, 2}) {
+		t.Errorf("pointsUntil() expected values [1 2]; got %v", values)
+	}
+}
+
+var metricGapsTests = []struct {
+	name        string
+	options     MetricOptions
+	gapAge      time.Duration
+	wantWritten int
+}{
+	{"detection only", MetricOptions{ExpectedPointInterval: time.Minute}, 30 * time.Minute, 3},
+	{"repair", MetricOptions{ExpectedPointInterval: time.Minute, RepairGaps: true}, 30 * time.Minute, 2},
+	{"repair window expired", MetricOptions{ExpectedPointInterval: time.Minute, RepairGaps: true}, 2 * time.Hour, 3},
+}
+
+func TestMetricUpdateGaps(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	for _, tt := range metricGapsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			gapStart := time.Now().Add(-tt.gapAge).Truncate(time.Second)
+			ts := append(gaugeSeries(gapStart.Add(-time.Minute), time.Minute, 1, 2),
+				gaugeSeries(gapStart.Add(5*time.Minute), time.Minute, 3)...)
+
+			src := mocks.NewMockSourceMetric(mockCtrl)
+			src.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+			src.EXPECT().StackdriverData(gomock.Any(), gomock.Any(), gomock.Any()).Return(&metricpb.MetricDescriptor{}, ts, nil)
+
+			mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+			mockSD.EXPECT().LatestTimestamp(gomock.Any(), gomock.Any(), gomock.Any()).Return(gapStart.Add(-time.Hour), nil)
+			mockSD.EXPECT().CreateTimeseries(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Len(tt.wantWritten)).Return(nil)
+
+			rec := &datastore.StoredMetricRecord{Name: "metricname", Storage: storage}
+			m := &Metric{Name: "metricname", Source: src, SDProject: "sd-project", Record: rec, Options: tt.options}
+
+			collector, exporter := fakeStats(t)
+			if err := m.Update(ctx, mockSD, collector); err != nil {
+				t.Errorf("Metric.Update() returned error %v", err)
+			}
+			collector.Close()
+
+			if rec.MissingPoints != 4 {
+				t.Errorf("expected 4 missing points to be recorded; got %v", rec.MissingPoints)
+			}
+			val, ok := exporter.values["ts_bridge/metric_missing_points:metricname"]
+			if !ok || val.(*view.LastValueData).Value != 4 {
+				t.Errorf("expected to see 4 missing points reported; got %v", val)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to hooks that embedders and plugins can add to the import pipeline of metrics.
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// Hook is a set of functions called at stages of each metric update, e.g. to validate or enrich points, or to export
+// them elsewhere, without changing the import pipeline itself. Any of the functions can be nil.
+//
+// The hooks of a metric form a chain: they are called in the order they were added, and time series returned by a
+// hook are passed to the next one. Errors returned by BeforeQuery, AfterQuery and BeforeWrite fail the update like
+// other errors of the pipeline, and can be classified using the tserrors package.
+type Hook struct {
+	// Name identifies the hook in errors and logs.
+	Name string
+	// BeforeQuery is called before the source is queried for points after `since`, up to `until` if the time range is
+	// chunked (until is zero otherwise).
+	BeforeQuery func(ctx context.Context, m *Metric, since, until time.Time) error
+	// AfterQuery is called with the data returned by the source, before it's filtered and processed according to the
+	// metric options. The descriptor can be changed in place, and the returned time series are processed further.
+	AfterQuery func(ctx context.Context, m *Metric, desc *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) ([]*monitoringpb.TimeSeries, error)
+	// BeforeWrite is called with the points that are about to be written to Stackdriver, once all processing is
+	// done. The returned time series are written instead; nothing is written if none are returned.
+	BeforeWrite func(ctx context.Context, m *Metric, desc *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) ([]*monitoringpb.TimeSeries, error)
+	// AfterWrite is called with the points that have been written to Stackdriver. Since the points have been written
+	// already, errors are only logged. The time series must not be changed.
+	AfterWrite func(ctx context.Context, m *Metric, desc *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) error
+}
+
+// registeredHooks are added to all metrics of configurations created after they were registered.
+var registeredHooks = struct {
+	sync.Mutex
+	hooks []*Hook
+}{}
+
+// RegisterHook adds a hook to all metrics of configurations created afterwards, e.g. from the init function of a
+// plugin package. Registered hooks are called before hooks listed in ConfigOptions.
+func RegisterHook(h *Hook) {
+	registeredHooks.Lock()
+	defer registeredHooks.Unlock()
+	registeredHooks.hooks = append(registeredHooks.hooks, h)
+}
+
+// metricHooks returns registered hooks followed by hooks of a configuration.
+func metricHooks(hooks []*Hook) []*Hook {
+	registeredHooks.Lock()
+	defer registeredHooks.Unlock()
+	if len(registeredHooks.hooks) == 0 {
+		return hooks
+	}
+	return append(registeredHooks.hooks[:len(registeredHooks.hooks):len(registeredHooks.hooks)], hooks...)
+}
+
+// beforeQuery calls BeforeQuery hooks of the metric.
+func (m *Metric) beforeQuery(ctx context.Context, since, until time.Time) error {
+	for _, h := range m.Hooks {
+		if h.BeforeQuery == nil {
+			continue
+		}
+		if err := h.BeforeQuery(ctx, m, since, until); err != nil {
+			return fmt.Errorf("hook %s: %w", h.Name, err)
+		}
+	}
+	return nil
+}
+
+// afterQuery passes data returned by the source through AfterQuery hooks of the metric.
+func (m *Metric) afterQuery(ctx context.Context, desc *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) ([]*monitoringpb.TimeSeries, error) {
+	for _, h := range m.Hooks {
+		if h.AfterQuery == nil {
+			continue
+		}
+		var err error
+		if ts, err = h.AfterQuery(ctx, m, desc, ts); err != nil {
+			return nil, fmt.Errorf("hook %s: %w", h.Name, err)
+		}
+	}
+	return ts, nil
+}
+
+// beforeWrite passes points that are about to be written through BeforeWrite hooks of the metric.
+func (m *Metric) beforeWrite(ctx context.Context, desc *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) ([]*monitoringpb.TimeSeries, error) {
+	for _, h := range m.Hooks {
+		if h.BeforeWrite == nil {
+			continue
+		}
+		var err error
+		if ts, err = h.BeforeWrite(ctx, m, desc, ts); err != nil {
+			return nil, fmt.Errorf("hook %s: %w", h.Name, err)
+		}
+	}
+	return ts, nil
+}
+
+// afterWrite calls AfterWrite hooks of the metric with written points, logging their errors.
+func (m *Metric) afterWrite(ctx context.Context, desc *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) {
+	for _, h := range m.Hooks {
+		if h.AfterWrite == nil {
+			continue
+		}
+		if err := h.AfterWrite(ctx, m, desc, ts); err != nil {
+			log.WithContext(ctx).Warningf("%s: hook %s failed after writing %d time series: %v", m.Name, h.Name, len(ts), err)
+		}
+	}
+}
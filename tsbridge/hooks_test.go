@@ -0,0 +1,165 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/datastore"
+	"github.com/google/ts-bridge/mocks"
+
+	"github.com/golang/mock/gomock"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestMetricUpdateHooks(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m, err := NewMetric(ctx, "hook_metric", mockSource, "sd-project", datastore.New(ctx, &datastore.Options{}))
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+
+	var calls []string
+	latest := time.Now().Add(-time.Hour).Truncate(time.Second)
+	m.Hooks = []*Hook{
+		{
+			Name: "validate",
+			BeforeQuery: func(_ context.Context, hm *Metric, since, until time.Time) error {
+				if hm != m || !since.Equal(latest) || !until.IsZero() {
+					t.Errorf("expected BeforeQuery to be called for the metric after %v; got %s after %v until %v", latest, hm.Name, since, until)
+				}
+				calls = append(calls, "validate:before_query")
+				return nil
+			},
+			AfterQuery: func(_ context.Context, _ *Metric, _ *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) ([]*monitoringpb.TimeSeries, error) {
+				calls = append(calls, "validate:after_query")
+				// The first series is dropped before any other processing.
+				return ts[1:], nil
+			},
+		},
+		{
+			Name: "enrich",
+			AfterQuery: func(_ context.Context, _ *Metric, _ *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) ([]*monitoringpb.TimeSeries, error) {
+				calls = append(calls, "enrich:after_query")
+				if len(ts) != 2 {
+					t.Errorf("expected to see time series returned by the previous hook; got %d", len(ts))
+				}
+				return ts, nil
+			},
+			BeforeWrite: func(_ context.Context, _ *Metric, _ *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) ([]*monitoringpb.TimeSeries, error) {
+				calls = append(calls, "enrich:before_write")
+				for _, series := range ts {
+					series.Metric.Labels = map[string]string{"team": "sre"}
+				}
+				return ts, nil
+			},
+			AfterWrite: func(_ context.Context, _ *Metric, _ *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) error {
+				calls = append(calls, "enrich:after_write")
+				return errors.New("export failed")
+			},
+		},
+	}
+
+	desc := &metricpb.MetricDescriptor{Type: "sd-metricname"}
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	mockSource.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(desc, gaugeSeries(latest.Add(time.Minute), time.Minute, 1, 2, 3), nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", desc, gomock.Any()).DoAndReturn(
+		func(_ context.Context, _, _ string, _ *metricpb.MetricDescriptor, series []*monitoringpb.TimeSeries) error {
+			calls = append(calls, "write")
+			if _, values := seriesPoints(latest, series); !reflect.DeepEqual(values, []float64{2, 3}) {
+				t.Errorf("expected points returned by hooks to be written; got %v", values)
+			}
+			if got := series[0].Metric.Labels; !reflect.DeepEqual(got, map[string]string{"team": "sre"}) {
+				t.Errorf("expected labels added by a hook to be written; got %v", got)
+			}
+			return nil
+		})
+
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+	if err := m.Update(ctx, mockSD, collector); err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	want := []string{"validate:before_query", "validate:after_query", "enrich:after_query", "enrich:before_write", "write", "enrich:after_write"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected hooks to be called in order %v; got %v", want, calls)
+	}
+	// Errors of AfterWrite hooks don't fail the update, since points have been written.
+	if status := m.Record.GetLastStatus(); !strings.Contains(status, "2 new points found") {
+		t.Errorf("expected the update to succeed; got status %q", status)
+	}
+}
+
+func TestMetricUpdateHookError(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m, err := NewMetric(ctx, "hook_metric", mockSource, "sd-project", datastore.New(ctx, &datastore.Options{}))
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+	m.Hooks = []*Hook{{
+		Name: "quota",
+		BeforeQuery: func(context.Context, *Metric, time.Time, time.Time) error {
+			return errors.New("quota exhausted")
+		},
+	}}
+
+	// The source is not queried if a hook fails.
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(time.Now().Add(-time.Hour), nil)
+
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+	if err := m.Update(ctx, mockSD, collector); err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	if status, want := m.Record.GetLastStatus(), "hook quota: quota exhausted"; !strings.Contains(status, want) {
+		t.Errorf("expected status to contain %q; got %q", want, status)
+	}
+}
+
+func TestRegisterHook(t *testing.T) {
+	registered := &Hook{Name: "registered"}
+	configured := &Hook{Name: "configured"}
+	defer func(hooks []*Hook) { registeredHooks.hooks = hooks }(registeredHooks.hooks)
+
+	RegisterHook(registered)
+	if got := metricHooks([]*Hook{configured}); !reflect.DeepEqual(got, []*Hook{registered, configured}) {
+		t.Errorf("expected registered hooks to be called before configured ones; got %v", got)
+	}
+	// Adding hooks of a configuration does not change registered hooks.
+	metricHooks([]*Hook{configured})
+	if got := registeredHooks.hooks; len(got) != 1 {
+		t.Errorf("expected a single registered hook; got %v", got)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to keeping track of metric updates that are in progress.
+package tsbridge
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// InFlightUpdate describes a metric update that is in progress.
+type InFlightUpdate struct {
+	Metric  string    `json:"metric"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+// inFlight keeps track of metric updates of all syncs running in this process, which helps diagnosing stuck syncs.
+var inFlight = struct {
+	sync.Mutex
+	next    int
+	updates map[int]*InFlightUpdate
+}{updates: make(map[int]*InFlightUpdate)}
+
+// trackUpdate records that an update of a metric has started, and returns a function that needs to be called once
+// it's finished.
+func trackUpdate(m *Metric) func() {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	id := inFlight.next
+	inFlight.next++
+	inFlight.updates[id] = &InFlightUpdate{Metric: m.Name, Tenant: m.Tenant, Started: time.Now()}
+	return func() {
+		inFlight.Lock()
+		defer inFlight.Unlock()
+		delete(inFlight.updates, id)
+	}
+}
+
+// InFlightUpdates returns metric updates that are in progress, oldest first.
+func InFlightUpdates() []InFlightUpdate {
+	inFlight.Lock()
+	defer inFlight.Unlock()
+	updates := make([]InFlightUpdate, 0, len(inFlight.updates))
+	for _, u := range inFlight.updates {
+		updates = append(updates, *u)
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].Started.Before(updates[j].Started) })
+	return updates
+}
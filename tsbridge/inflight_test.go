@@ -0,0 +1,38 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"testing"
+)
+
+func TestInFlightUpdates(t *testing.T) {
+	first := trackUpdate(&Metric{Name: "first"})
+	second := trackUpdate(&Metric{Name: "second", Tenant: "team_a"})
+
+	updates := InFlightUpdates()
+	if len(updates) != 2 || updates[0].Metric != "first" || updates[1].Metric != "second" || updates[1].Tenant != "team_a" {
+		t.Errorf("expected updates of 'first' and 'second' to be in flight; got %v", updates)
+	}
+
+	first()
+	if updates := InFlightUpdates(); len(updates) != 1 || updates[0].Metric != "second" {
+		t.Errorf("expected only the update of 'second' to be in flight; got %v", updates)
+	}
+	second()
+	if updates := InFlightUpdates(); len(updates) != 0 {
+		t.Errorf("expected no updates to be in flight; got %v", updates)
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to sanitizing label keys and values that Stackdriver would reject.
+package tsbridge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// Limits of label keys and values accepted by Stackdriver.
+// See https://cloud.google.com/monitoring/quotas#custom_metrics_quotas
+const (
+	sdMaxLabelKeyLength   = 100
+	sdMaxLabelValueLength = 1024
+)
+
+// Policies for label keys and values that Stackdriver does not accept.
+const (
+	// LabelPolicyTruncate replaces invalid characters of label keys with underscores, and truncates keys and values
+	// that are too long. This is the default.
+	LabelPolicyTruncate = "truncate"
+	// LabelPolicyHash is similar to LabelPolicyTruncate, but replaces the end of keys and values that are too long
+	// with a hash of the original, so that distinct long values remain distinct.
+	LabelPolicyHash = "hash"
+	// LabelPolicyDrop removes labels with invalid keys or values that are too long.
+	LabelPolicyDrop = "drop"
+)
+
+// Policies for label keys that the existing metric descriptor of a metric does not declare yet.
+const (
+	// NewLabelPolicyAdd adds new label keys to the metric descriptor. This is the default.
+	NewLabelPolicyAdd = "add"
+	// NewLabelPolicyDrop removes new label keys from points, so that the metric descriptor stays unchanged.
+	NewLabelPolicyDrop = "drop"
+)
+
+// labelHashLength is the number of hex digits of the hash appended to keys and values by LabelPolicyHash.
+const labelHashLength = 16
+
+var (
+	validLabelKey        = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+	invalidLabelKeyChars = regexp.MustCompile(`[^a-z0-9_]`)
+)
+
+// sanitizeLabels rewrites label keys and values of a metric descriptor and its time series according to the label
+// policy, and returns the number of labels that have been changed or removed. Since sources can share label maps
+// across time series, labels are never modified in place.
+func sanitizeLabels(desc *metricpb.MetricDescriptor, series []*monitoringpb.TimeSeries, policy string) int {
+	if policy == "" {
+		policy = LabelPolicyTruncate
+	}
+
+	sanitized := 0
+	var labels []*label.LabelDescriptor
+	for _, l := range desc.GetLabels() {
+		key, ok := sanitizeLabelKey(l.Key, policy)
+		if key == l.Key {
+			labels = append(labels, l)
+			continue
+		}
+		sanitized++
+		if !ok {
+			continue
+		}
+		l = proto.Clone(l).(*label.LabelDescriptor)
+		l.Key = key
+		labels = append(labels, l)
+	}
+	if sanitized > 0 {
+		desc.Labels = labels
+	}
+
+	for _, ts := range series {
+		var output map[string]string
+		for k, v := range ts.GetMetric().GetLabels() {
+			key, keyOK := sanitizeLabelKey(k, policy)
+			value, valueOK := sanitizeLabelValue(v, policy)
+			if key == k && value == v {
+				continue
+			}
+			sanitized++
+			if output == nil {
+				output = make(map[string]string, len(ts.Metric.Labels))
+				for k, v := range ts.Metric.Labels {
+					output[k] = v
+				}
+			}
+			delete(output, k)
+			if keyOK && valueOK {
+				output[key] = value
+			}
+		}
+		if output != nil {
+			ts.Metric = proto.Clone(ts.Metric).(*metricpb.Metric)
+			ts.Metric.Labels = output
+		}
+	}
+	return sanitized
+}
+
+// sanitizeLabelKey returns a label key accepted by Stackdriver, or false if the label needs to be dropped.
+func sanitizeLabelKey(key, policy string) (string, bool) {
+	if validLabelKey.MatchString(key) && len(key) <= sdMaxLabelKeyLength {
+		return key, true
+	}
+	if policy == LabelPolicyDrop {
+		return "", false
+	}
+	sanitized := invalidLabelKeyChars.ReplaceAllString(strings.ToLower(key), "_")
+	if sanitized == "" || sanitized[0] < 'a' || sanitized[0] > 'z' {
+		sanitized = "label_" + sanitized
+	}
+	return shorten(sanitized, key, sdMaxLabelKeyLength, policy), true
+}
+
+// sanitizeLabelValue returns a label value accepted by Stackdriver, or false if the label needs to be dropped.
+func sanitizeLabelValue(value, policy string) (string, bool) {
+	if len(value) <= sdMaxLabelValueLength {
+		return value, true
+	}
+	if policy == LabelPolicyDrop {
+		return "", false
+	}
+	return shorten(value, value, sdMaxLabelValueLength, policy), true
+}
+
+// shorten truncates `s` to at most `max` bytes without splitting UTF-8 characters. With LabelPolicyHash, the end of
+// the result is replaced by a hash of `original`.
+func shorten(s, original string, max int, policy string) string {
+	if len(s) <= max {
+		return s
+	}
+	if policy == LabelPolicyHash {
+		sum := sha256.Sum256([]byte(original))
+		return truncateUTF8(s, max-labelHashLength-1) + "_" + hex.EncodeToString(sum[:])[:labelHashLength]
+	}
+	return truncateUTF8(s, max)
+}
+
+// truncateUTF8 returns the longest prefix of `s` that is at most `max` bytes long and ends at a character boundary.
+func truncateUTF8(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// descriptorReader is implemented by Stackdriver adapters that can return the current metric descriptor of a metric.
+type descriptorReader interface {
+	MetricDescriptor(ctx context.Context, project, name string) (*metricpb.MetricDescriptor, error)
+}
+
+// dropNewLabels removes labels that the current metric descriptor of the metric does not declare from a descriptor
+// and its time series, and returns the number of labels removed. Nothing is removed if the metric does not exist yet
+// or if the adapter cannot read metric descriptors.
+func (m *Metric) dropNewLabels(ctx context.Context, sd StackdriverAdapter, desc *metricpb.MetricDescriptor, series []*monitoringpb.TimeSeries) (int, error) {
+	if p, ok := sd.(*prefetchedAdapter); ok {
+		sd = p.StackdriverAdapter
+	}
+	reader, ok := sd.(descriptorReader)
+	if !ok {
+		return 0, nil
+	}
+	current, err := reader.MetricDescriptor(ctx, m.SDProject, m.Source.StackdriverName())
+	if err != nil || current == nil {
+		return 0, err
+	}
+	declared := make(map[string]bool)
+	for _, l := range current.GetLabels() {
+		declared[l.Key] = true
+	}
+
+	dropped := 0
+	var labels []*label.LabelDescriptor
+	for _, l := range desc.GetLabels() {
+		if declared[l.Key] {
+			labels = append(labels, l)
+			continue
+		}
+		dropped++
+	}
+	if dropped > 0 {
+		desc.Labels = labels
+	}
+	for _, ts := range series {
+		var output map[string]string
+		for k := range ts.GetMetric().GetLabels() {
+			if declared[k] {
+				continue
+			}
+			dropped++
+			if output == nil {
+				output = make(map[string]string, len(ts.Metric.Labels))
+				for k, v := range ts.Metric.Labels {
+					output[k] = v
+				}
+			}
+			delete(output, k)
+		}
+		if output != nil {
+			ts.Metric = proto.Clone(ts.Metric).(*metricpb.Metric)
+			ts.Metric.Labels = output
+		}
+	}
+	return dropped, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/mocks"
+
+	"github.com/golang/mock/gomock"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+func TestSanitizeLabels(t *testing.T) {
+	longValue := strings.Repeat("é", 600)
+	otherLongValue := strings.Repeat("é", 599) + "e"
+
+	for _, tt := range []struct {
+		name       string
+		policy     string
+		labels     map[string]string
+		wantLabels map[string]string
+		wantKeys   []string
+		wantCount  int
+	}{
+		{"valid labels", "", map[string]string{"host": "web-1"}, map[string]string{"host": "web-1"}, []string{"host"}, 0},
+		{"invalid key", "", map[string]string{"Host.Name": "web-1"}, map[string]string{"host_name": "web-1"}, []string{"host_name"}, 2},
+		{"key starting with a digit", "truncate", map[string]string{"1st": "a"}, map[string]string{"label_1st": "a"}, []string{"label_1st"}, 2},
+		{"long value truncated", "truncate", map[string]string{"path": longValue}, map[string]string{"path": strings.Repeat("é", 512)}, []string{"path"}, 1},
+		{"invalid key dropped", "drop", map[string]string{"Host": "web-1", "env": "prod"}, map[string]string{"env": "prod"}, []string{"env"}, 2},
+		{"long value dropped", "drop", map[string]string{"path": longValue, "env": "prod"}, map[string]string{"env": "prod"}, []string{"path", "env"}, 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			desc := &metricpb.MetricDescriptor{}
+			for k := range tt.labels {
+				desc.Labels = append(desc.Labels, &label.LabelDescriptor{Key: k})
+			}
+			series := gaugeSeries(time.Now(), time.Second, 1)
+			series[0].Metric.Labels = tt.labels
+
+			if got := sanitizeLabels(desc, series, tt.policy); got != tt.wantCount {
+				t.Errorf("sanitizeLabels() expected to sanitize %d labels; got %d", tt.wantCount, got)
+			}
+			if got := series[0].Metric.Labels; !reflect.DeepEqual(got, tt.wantLabels) {
+				t.Errorf("sanitizeLabels() expected labels %v; got %v", tt.wantLabels, got)
+			}
+			keys := make(map[string]bool)
+			for _, l := range desc.Labels {
+				keys[l.Key] = true
+			}
+			for _, k := range tt.wantKeys {
+				if !keys[k] || len(keys) != len(tt.wantKeys) {
+					t.Errorf("sanitizeLabels() expected descriptor labels %v; got %v", tt.wantKeys, keys)
+				}
+			}
+		})
+	}
+
+	// Hashing keeps long values that share a prefix distinct, and within the Stackdriver limit.
+	series := gaugeSeries(time.Now(), time.Second, 1, 2)
+	series[0].Metric.Labels = map[string]string{"path": longValue}
+	series[1].Metric.Labels = map[string]string{"path": otherLongValue}
+	sanitizeLabels(&metricpb.MetricDescriptor{}, series, LabelPolicyHash)
+	first, second := series[0].Metric.Labels["path"], series[1].Metric.Labels["path"]
+	if len(first) > sdMaxLabelValueLength || len(second) > sdMaxLabelValueLength || first == second {
+		t.Errorf("sanitizeLabels() expected distinct hashed values within %d bytes; got %q and %q", sdMaxLabelValueLength, first, second)
+	}
+}
+
+func TestSanitizeLabelsSharedMap(t *testing.T) {
+	// Sources can share a single label map across time series, so it should not be modified in place.
+	labels := map[string]string{"Host": "web-1"}
+	series := gaugeSeries(time.Now(), time.Second, 1, 2)
+	for _, ts := range series {
+		ts.Metric.Labels = labels
+	}
+	if got := sanitizeLabels(&metricpb.MetricDescriptor{}, series, ""); got != 2 {
+		t.Errorf("sanitizeLabels() expected to sanitize 2 labels; got %d", got)
+	}
+	if _, ok := labels["Host"]; !ok || len(labels) != 1 {
+		t.Errorf("sanitizeLabels() modified the original label map: %v", labels)
+	}
+	for _, ts := range series {
+		if ts.Metric.Labels["host"] != "web-1" {
+			t.Errorf("sanitizeLabels() expected label 'host' to be set; got %v", ts.Metric.Labels)
+		}
+	}
+}
+
+// describingAdapter returns a fixed metric descriptor as the current descriptor of all metrics.
+type describingAdapter struct {
+	StackdriverAdapter
+	desc *metricpb.MetricDescriptor
+}
+
+func (a *describingAdapter) MetricDescriptor(ctx context.Context, project, name string) (*metricpb.MetricDescriptor, error) {
+	return a.desc, nil
+}
+
+func TestDropNewLabels(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	src := mocks.NewMockSourceMetric(mockCtrl)
+	src.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m := &Metric{Name: "metricname", SDProject: "sd-project", Source: src}
+
+	labels := map[string]string{"host": "web-1", "env": "prod"}
+	series := gaugeSeries(time.Now(), time.Second, 1, 2)
+	for _, ts := range series {
+		ts.Metric.Labels = labels
+	}
+	desc := &metricpb.MetricDescriptor{Labels: []*label.LabelDescriptor{{Key: "host"}, {Key: "env"}}}
+	sd := &prefetchedAdapter{StackdriverAdapter: &describingAdapter{desc: &metricpb.MetricDescriptor{Labels: []*label.LabelDescriptor{{Key: "host"}}}}}
+	got, err := m.dropNewLabels(ctx, sd, desc, series)
+	if err != nil {
+		t.Fatalf("dropNewLabels() unexpected error: %v", err)
+	}
+	if got != 3 {
+		t.Errorf("dropNewLabels() expected to drop 3 labels; got %d", got)
+	}
+	if len(desc.Labels) != 1 || desc.Labels[0].Key != "host" {
+		t.Errorf("dropNewLabels() expected the new label to be removed from the descriptor; got %v", desc.Labels)
+	}
+	for _, ts := range series {
+		if want := map[string]string{"host": "web-1"}; !reflect.DeepEqual(ts.Metric.Labels, want) {
+			t.Errorf("dropNewLabels() expected labels %v; got %v", want, ts.Metric.Labels)
+		}
+	}
+	if len(labels) != 2 {
+		t.Errorf("dropNewLabels() modified the original label map: %v", labels)
+	}
+
+	// Labels of metrics that do not exist yet are kept.
+	desc = &metricpb.MetricDescriptor{Labels: []*label.LabelDescriptor{{Key: "env"}}}
+	if got, err := m.dropNewLabels(ctx, &describingAdapter{}, desc, nil); got != 0 || err != nil || len(desc.Labels) != 1 {
+		t.Errorf("dropNewLabels() expected labels of a new metric to be kept; got %d, %v, %v", got, err, desc.Labels)
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to reporting configuration errors along with their position in the configuration file.
+package tsbridge
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	validator "gopkg.in/validator.v2"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ConfigError is a problem with a single entry of a configuration file, such as an unknown key, a value of the wrong
+// type or a missing required field.
+type ConfigError struct {
+	// Line and Column are 1-based, and are 0 if the position of the entry is unknown.
+	Line, Column int
+	// Entry describes the configuration entry, e.g. `datadog_metrics[2] (name: errors)`.
+	Entry string
+	// Field is the name of the YAML key, if the error is about a single field.
+	Field   string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.describe())
+	}
+	return e.describe()
+}
+
+// describe returns the error without its position.
+func (e *ConfigError) describe() string {
+	var parts []string
+	if e.Entry != "" {
+		parts = append(parts, e.Entry)
+	}
+	if e.Field != "" {
+		parts = append(parts, e.Field)
+	}
+	return strings.Join(append(parts, e.Message), ": ")
+}
+
+// ConfigErrors lists all problems found in a configuration file, ordered by position.
+type ConfigErrors struct {
+	// Summary is a short description of the kind of problems, e.g. `configuration file validation error`.
+	Summary  string
+	Filename string
+	Errors   []*ConfigError
+}
+
+// Error returns all problems on separate lines, prefixed with `file:line:column` like compiler errors.
+func (e *ConfigErrors) Error() string {
+	lines := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		if err.Line > 0 {
+			lines[i] = fmt.Sprintf("%s:%d:%d: %s", e.Filename, err.Line, err.Column, err.describe())
+		} else {
+			lines[i] = fmt.Sprintf("%s: %s", e.Filename, err.describe())
+		}
+	}
+	return fmt.Sprintf("%s:\n  %s", e.Summary, strings.Join(lines, "\n  "))
+}
+
+// yamlErrorLine matches the line number of errors returned by yaml.Unmarshal, e.g. `line 12: field foo not found`.
+var yamlErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// unknownField matches errors of yaml.UnmarshalStrict caused by an unknown key.
+var unknownField = regexp.MustCompile(`^field \S+ not found in type `)
+
+// unmarshalErrors converts errors of unknown keys and wrong types returned by yaml.UnmarshalStrict into ConfigErrors.
+// Line numbers of the errors refer to `parsed`, which can differ from `original` if named sources have been applied.
+// The summary describes the errors, e.g. `configuration file contains invalid entries`. Other errors, such as syntax
+// errors, are returned as they are.
+func unmarshalErrors(summary, filename string, original, parsed []byte, err error) error {
+	te, ok := err.(*yaml.TypeError)
+	if !ok {
+		return err
+	}
+	orig, prsd := indexYAML(original), indexYAML(parsed)
+	result := &ConfigErrors{Summary: summary, Filename: filename}
+	for _, msg := range te.Errors {
+		m := yamlErrorLine.FindStringSubmatch(msg)
+		if m == nil {
+			result.Errors = append(result.Errors, &ConfigError{Message: msg})
+			continue
+		}
+		line, _ := strconv.Atoi(m[1])
+		result.Errors = append(result.Errors, orig.describe(prsd.pathAt(line), m[2]))
+	}
+	result.sort()
+	return result
+}
+
+// unknownFields splits errors returned by yaml.UnmarshalStrict into errors of unknown keys and all other errors.
+// Either of them is nil if there are no such errors.
+func unknownFields(err error) (unknown, rest error) {
+	te, ok := err.(*yaml.TypeError)
+	if !ok {
+		return nil, err
+	}
+	var u, r []string
+	for _, msg := range te.Errors {
+		if m := yamlErrorLine.FindStringSubmatch(msg); m != nil && unknownField.MatchString(m[2]) {
+			u = append(u, msg)
+		} else {
+			r = append(r, msg)
+		}
+	}
+	if len(u) > 0 {
+		unknown = &yaml.TypeError{Errors: u}
+	}
+	if len(r) > 0 {
+		rest = &yaml.TypeError{Errors: r}
+	}
+	return unknown, rest
+}
+
+// validationErrors converts errors returned by validator.Validate for a Config into ConfigErrors, using YAML keys and
+// positions in the configuration file instead of Go field names.
+func validationErrors(filename string, data []byte, err error) error {
+	em, ok := err.(validator.ErrorMap)
+	if !ok {
+		return fmt.Errorf("configuration file validation error: %s", err)
+	}
+	idx := indexYAML(data)
+	result := &ConfigErrors{Summary: "configuration file validation error", Filename: filename}
+	for field, errs := range em {
+		for _, e := range errs {
+			result.Errors = append(result.Errors, idx.describe(yamlPath(reflect.TypeOf(Config{}), field), e.Error()))
+		}
+	}
+	result.sort()
+	return result
+}
+
+func (e *ConfigErrors) sort() {
+	sort.SliceStable(e.Errors, func(i, j int) bool {
+		a, b := e.Errors[i], e.Errors[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		return a.Error() < b.Error()
+	})
+}
+
+// yamlPath converts a path of Go struct fields reported by the validator, e.g. `DatadogMetrics[0].APIKey`, into a
+// path of YAML keys, e.g. `datadog_metrics[0].api_key`. Fields that cannot be found are kept as they are.
+func yamlPath(t reflect.Type, path string) string {
+	var keys []string
+	for _, part := range strings.Split(path, ".") {
+		name, index := part, ""
+		if i := strings.Index(part, "["); i >= 0 {
+			name, index = part[:i], part[i:]
+		}
+		for t != nil && (t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Map) {
+			t = t.Elem()
+		}
+		if t == nil || t.Kind() != reflect.Struct {
+			keys = append(keys, part)
+			t = nil
+			continue
+		}
+		f, ok := t.FieldByName(name)
+		if !ok {
+			keys = append(keys, part)
+			t = nil
+			continue
+		}
+		t = f.Type
+		key, inline := yamlKey(f)
+		if inline {
+			continue
+		}
+		keys = append(keys, key+index)
+	}
+	return strings.Join(keys, ".")
+}
+
+// yamlKey returns the YAML key of a struct field, using the same defaults as the yaml package, and whether the field
+// is inlined into its parent.
+func yamlKey(f reflect.StructField) (string, bool) {
+	tag := strings.Split(f.Tag.Get("yaml"), ",")
+	for _, flag := range tag[1:] {
+		if flag == "inline" {
+			return "", true
+		}
+	}
+	if f.Anonymous && tag[0] == "" {
+		return "", true
+	}
+	if tag[0] != "" {
+		return tag[0], false
+	}
+	return strings.ToLower(f.Name), false
+}
+
+// positionIndex keeps positions of keys and sequence items of a YAML document, keyed by their path, e.g.
+// `datadog_metrics[2].query`. It understands block-style YAML, which configuration files are written in; entries
+// nested in flow-style collections are not indexed.
+type positionIndex struct {
+	positions map[string][2]int
+	values    map[string]string
+	// lines keeps the path of the innermost key or item starting on each line.
+	lines map[int]string
+}
+
+type yamlFrame struct {
+	indent int
+	path   string
+	seq    bool
+	items  int
+}
+
+// indexYAML builds an index of a YAML document. It never fails; positions of entries it cannot parse are unknown.
+func indexYAML(data []byte) *positionIndex {
+	idx := &positionIndex{positions: make(map[string][2]int), values: make(map[string]string), lines: make(map[int]string)}
+	var stack []*yamlFrame
+	// lastKey is the most recent key, which sequences and mappings on the following lines are nested in.
+	lastKey, lastIndent := "", -1
+	// blockIndent is the indentation of the key of a block scalar whose lines are being skipped, or -1.
+	blockIndent := -1
+	for n, raw := range strings.Split(string(data), "\n") {
+		line := n + 1
+		text := strings.TrimRight(raw, " \t\r")
+		content := strings.TrimLeft(text, " ")
+		indent := len(text) - len(content)
+		if blockIndent >= 0 {
+			if content == "" || indent > blockIndent {
+				continue
+			}
+			blockIndent = -1
+		}
+		if content == "" || strings.HasPrefix(content, "#") || content == "---" {
+			continue
+		}
+		for len(stack) > 0 && stack[len(stack)-1].indent > indent {
+			stack = stack[:len(stack)-1]
+		}
+		for content != "" {
+			top := (*yamlFrame)(nil)
+			if len(stack) > 0 {
+				top = stack[len(stack)-1]
+			}
+			if content == "-" || strings.HasPrefix(content, "- ") {
+				if top == nil || !top.seq || top.indent != indent {
+					stack = append(stack, &yamlFrame{indent: indent, path: lastKey, seq: true})
+					top = stack[len(stack)-1]
+				}
+				item := fmt.Sprintf("%s[%d]", top.path, top.items)
+				top.items++
+				idx.add(item, line, indent+1, "")
+				rest := strings.TrimLeft(strings.TrimPrefix(content, "-"), " ")
+				if rest == "" {
+					lastKey, lastIndent = item, indent
+					break
+				}
+				itemIndent := indent + len(content) - len(rest)
+				stack = append(stack, &yamlFrame{indent: itemIndent, path: item})
+				lastKey, lastIndent = item, indent
+				content, indent = rest, itemIndent
+				continue
+			}
+			key, value, ok := splitYAMLKey(content)
+			if !ok {
+				break
+			}
+			// A key at the indentation of a sequence ends the sequence, which is nested in a key at the same level.
+			for top != nil && top.seq && top.indent >= indent {
+				stack = stack[:len(stack)-1]
+				top = nil
+				if len(stack) > 0 {
+					top = stack[len(stack)-1]
+				}
+			}
+			if top == nil && indent > 0 && lastIndent < indent || top != nil && top.indent < indent {
+				stack = append(stack, &yamlFrame{indent: indent, path: lastKey})
+				top = stack[len(stack)-1]
+			}
+			path := key
+			if top != nil && top.path != "" {
+				path = top.path + "." + key
+			}
+			idx.add(path, line, indent+1, value)
+			lastKey, lastIndent = path, indent
+			if strings.HasPrefix(value, "|") || strings.HasPrefix(value, ">") {
+				blockIndent = indent
+			}
+			break
+		}
+	}
+	return idx
+}
+
+// splitYAMLKey splits a line of a block mapping into its key and value.
+func splitYAMLKey(content string) (string, string, bool) {
+	if strings.HasPrefix(content, "{") || strings.HasPrefix(content, "[") {
+		return "", "", false
+	}
+	var key, rest string
+	if q := content[0]; q == '"' || q == '\'' {
+		end := strings.IndexByte(content[1:], q)
+		if end < 0 {
+			return "", "", false
+		}
+		key, rest = content[1:end+1], content[end+2:]
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", false
+		}
+		rest = rest[1:]
+	} else {
+		i := strings.Index(content, ": ")
+		if i < 0 {
+			if !strings.HasSuffix(content, ":") {
+				return "", "", false
+			}
+			i = len(content) - 1
+		}
+		key, rest = content[:i], content[i+1:]
+	}
+	value := strings.TrimSpace(rest)
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return key, strings.Trim(value, `"'`), true
+}
+
+func (idx *positionIndex) add(path string, line, column int, value string) {
+	idx.positions[path] = [2]int{line, column}
+	idx.values[path] = value
+	idx.lines[line] = path
+}
+
+// pathAt returns the path of the innermost key or item starting on a line, or the closest line before it.
+func (idx *positionIndex) pathAt(line int) string {
+	for ; line > 0; line-- {
+		if p, ok := idx.lines[line]; ok {
+			return p
+		}
+	}
+	return ""
+}
+
+// describe returns a ConfigError for a path, with the position of the path (or of its closest ancestor that is in
+// the document, e.g. the metric entry if a required field is missing) and the entry it belongs to.
+func (idx *positionIndex) describe(path, message string) *ConfigError {
+	e := &ConfigError{Message: message}
+	entry := path
+	if i := strings.LastIndex(path, "]"); i >= 0 {
+		entry = path[:i+1]
+		e.Field = strings.TrimPrefix(path[i+1:], ".")
+	} else {
+		entry, e.Field = "", path
+	}
+	if entry != "" {
+		e.Entry = entry
+		if name := idx.values[entry+".name"]; name != "" {
+			e.Entry = fmt.Sprintf("%s (name: %s)", entry, name)
+		}
+	}
+	for p := path; p != ""; p = parentPath(p) {
+		if pos, ok := idx.positions[p]; ok {
+			e.Line, e.Column = pos[0], pos[1]
+			break
+		}
+	}
+	return e
+}
+
+// parentPath returns the path of the key or sequence containing an entry.
+func parentPath(path string) string {
+	i := strings.LastIndexAny(path, ".[")
+	if i < 0 {
+		return ""
+	}
+	return path[:i]
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/ts-bridge/datastore"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestNewConfigErrorPositions(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	for _, tt := range []struct {
+		filename string
+		want     []*ConfigError
+	}{
+		{"unknown_key.yaml", []*ConfigError{
+			{Line: 12, Column: 5, Entry: "datadog_metrics[1] (name: metric2)", Field: "min_piont_age", Message: "field min_piont_age not found in type tsbridge.DatadogMetricConfig"},
+		}},
+		{"wrong_type.yaml", []*ConfigError{
+			{Line: 7, Column: 5, Entry: "datadog_metrics[0] (name: metric1)", Field: "min_point_age", Message: "cannot unmarshal !!seq into time.Duration"},
+		}},
+		{"no_influxdb_query.yaml", []*ConfigError{
+			{Line: 2, Column: 3, Entry: "influxdb_metrics[0] (name: metric)", Field: "query", Message: "zero value"},
+		}},
+		{"no_datadog_keys.yaml", []*ConfigError{
+			{Line: 2, Column: 3, Entry: "datadog_metrics[0] (name: metric1)", Field: "api_key", Message: "zero value"},
+			{Line: 2, Column: 3, Entry: "datadog_metrics[0] (name: metric1)", Field: "application_key", Message: "zero value"},
+		}},
+		{"invalid_value_mapping.yaml", []*ConfigError{
+			{Line: 8, Column: 7, Entry: "influxdb_metrics[0] (name: metric1)", Field: "value_mapping.type", Message: "regular expression mismatch"},
+		}},
+	} {
+		t.Run(tt.filename, func(t *testing.T) {
+			filename := filepath.Join("testdata", tt.filename)
+			_, err := NewConfig(ctx, &ConfigOptions{Filename: filename, Storage: storage})
+			var ce *ConfigErrors
+			if !errors.As(err, &ce) {
+				t.Fatalf("expected NewConfig to return ConfigErrors; got %v", err)
+			}
+			if ce.Filename != filename {
+				t.Errorf("expected errors of file %s; got %s", filename, ce.Filename)
+			}
+			if !reflect.DeepEqual(ce.Errors, tt.want) {
+				t.Errorf("unexpected errors:\n%v\nwant:\n%v", ce.Errors, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigErrorsError(t *testing.T) {
+	err := &ConfigErrors{Summary: "configuration file validation error", Filename: "metrics.yaml", Errors: []*ConfigError{
+		{Line: 3, Column: 5, Entry: "datadog_metrics[0] (name: foo)", Field: "query", Message: "zero value"},
+		{Message: "something else"},
+	}}
+	want := "configuration file validation error:\n" +
+		"  metrics.yaml:3:5: datadog_metrics[0] (name: foo): query: zero value\n" +
+		"  metrics.yaml: something else"
+	if err.Error() != want {
+		t.Errorf("expected error %q; got %q", want, err.Error())
+	}
+	if got := err.Errors[0].Error(); got != "line 3, column 5: datadog_metrics[0] (name: foo): query: zero value" {
+		t.Errorf("unexpected error of a single entry: %q", got)
+	}
+}
+
+func TestIndexYAML(t *testing.T) {
+	data := []byte(`# comment
+datadog_metrics:
+  - name: first
+    query: |
+      avg:foo{*}
+      name: not a key
+    http:
+      timeout: 10s
+- name: not indexed
+stackdriver_destinations:
+- name: stackdriver
+  project_id: "proj"  # comment
+- name: other
+tenants:
+  - name: team_a
+    influxdb_metrics:
+      - name: nested
+`)
+	idx := indexYAML(data)
+	for path, want := range map[string][2]int{
+		"datadog_metrics":                     {2, 1},
+		"datadog_metrics[0]":                  {3, 3},
+		"datadog_metrics[0].name":             {3, 5},
+		"datadog_metrics[0].query":            {4, 5},
+		"datadog_metrics[0].http.timeout":     {8, 7},
+		"stackdriver_destinations[0]":         {11, 1},
+		"stackdriver_destinations[1].name":    {13, 3},
+		"tenants[0].influxdb_metrics[0]":      {17, 7},
+		"tenants[0].influxdb_metrics[0].name": {17, 9},
+	} {
+		if got, ok := idx.positions[path]; !ok || got != want {
+			t.Errorf("expected %s at %v; got %v", path, want, got)
+		}
+	}
+	if _, ok := idx.positions["datadog_metrics[0].name.name"]; ok {
+		t.Errorf("lines of block scalars should not be indexed")
+	}
+	if got := idx.values["stackdriver_destinations[0].project_id"]; got != "proj" {
+		t.Errorf("expected value 'proj'; got '%s'", got)
+	}
+	if got := idx.pathAt(6); got != "datadog_metrics[0].query" {
+		t.Errorf("expected line 6 to belong to datadog_metrics[0].query; got %s", got)
+	}
+}
+
+func TestYAMLPath(t *testing.T) {
+	for _, tt := range []struct {
+		field string
+		want  string
+	}{
+		{"DatadogMetrics[0].APIKey", "datadog_metrics[0].api_key"},
+		{"InfluxDBMetrics[2].ValueMapping.Type", "influxdb_metrics[2].value_mapping.type"},
+		{"Unknown[0].Field", "Unknown[0].Field"},
+	} {
+		if got := yamlPath(reflect.TypeOf(Config{}), tt.field); got != tt.want {
+			t.Errorf("yamlPath(%s): expected %s; got %s", tt.field, tt.want, got)
+		}
+	}
+}
+
+func TestNewConfigAllowUnknownFields(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	if _, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/unknown_key.yaml", Storage: storage}); err == nil || !strings.Contains(err.Error(), "field min_piont_age not found") {
+		t.Errorf("expected unknown keys to be rejected by default; got %v", err)
+	}
+
+	extra := []*MetricDefinition{
+		{Name: "extra", Source: "datadog", Params: []byte(`{"query": "q", "api_key": "k", "application_key": "k", "destination": "stackdriver", "unknown": 1}`)},
+	}
+	cfg, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/unknown_key.yaml", Storage: storage, AllowUnknownFields: true, ExtraMetrics: extra})
+	if err != nil {
+		t.Fatalf("expected unknown keys to be ignored; got %v", err)
+	}
+	if len(cfg.metrics) != 3 {
+		t.Fatalf("expected 3 metrics; got %v", cfg.metrics)
+	}
+	if got := cfg.DatadogMetrics[1]; got.Name != "metric2" || got.Destination != "stackdriver" {
+		t.Errorf("expected metric2 to be fully parsed; got %s with destination '%s'", got.Name, got.Destination)
+	}
+
+	if _, err := NewConfig(ctx, &ConfigOptions{Filename: "testdata/wrong_type.yaml", Storage: storage, AllowUnknownFields: true}); err == nil || !strings.Contains(err.Error(), "cannot unmarshal !!seq") {
+		t.Errorf("expected values of the wrong type to be rejected; got %v", err)
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	err := &yaml.TypeError{Errors: []string{
+		"line 3: field foo not found in type tsbridge.DatadogMetricConfig",
+		"line 4: cannot unmarshal !!str `x` into int",
+	}}
+	unknown, rest := unknownFields(err)
+	if want := (&yaml.TypeError{Errors: err.Errors[:1]}); !reflect.DeepEqual(unknown, want) {
+		t.Errorf("expected unknown keys %v; got %v", want, unknown)
+	}
+	if want := (&yaml.TypeError{Errors: err.Errors[1:]}); !reflect.DeepEqual(rest, want) {
+		t.Errorf("expected other errors %v; got %v", want, rest)
+	}
+
+	syntax := errors.New("yaml: line 2: mapping values are not allowed in this context")
+	if unknown, rest := unknownFields(syntax); unknown != nil || rest != syntax {
+		t.Errorf("expected syntax errors to be kept; got %v and %v", unknown, rest)
+	}
+	if unknown, rest := unknownFields(nil); unknown != nil || rest != nil {
+		t.Errorf("expected no errors; got %v and %v", unknown, rest)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has maintenance windows, during which metric updates are skipped.
+package tsbridge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxMaintenanceDuration limits the duration of maintenance windows, which also bounds the time it takes to check
+// whether a window is active.
+const maxMaintenanceDuration = 7 * 24 * time.Hour
+
+// MaintenanceWindow is a recurring period of time during which a metric is not imported, e.g. while its source
+// system is down for weekly maintenance. Windows start at times matching a cron expression, and last for Duration.
+type MaintenanceWindow struct {
+	// Schedule is a cron expression with five fields (minute, hour, day of month, month and day of week), e.g.
+	// `0 2 * * SUN` for windows starting every Sunday at 02:00.
+	Schedule string        `validate:"nonzero"`
+	Duration time.Duration `validate:"nonzero"`
+	// TimeZone is the IANA time zone the schedule is evaluated in, UTC by default.
+	TimeZone string `yaml:"time_zone"`
+
+	cron     *cronSchedule
+	location *time.Location
+}
+
+// validate parses the schedule and time zone of a maintenance window.
+func (w *MaintenanceWindow) validate() error {
+	if w.Duration < time.Minute || w.Duration > maxMaintenanceDuration {
+		return fmt.Errorf("duration of maintenance window '%s' must be between 1m and %v", w.Schedule, maxMaintenanceDuration)
+	}
+	cron, err := parseCron(w.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid schedule of maintenance window '%s': %v", w.Schedule, err)
+	}
+	location, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return fmt.Errorf("invalid time zone of maintenance window '%s': %v", w.Schedule, err)
+	}
+	w.cron, w.location = cron, location
+	return nil
+}
+
+// end returns the end of the window that a given time falls into, or the zero time if it is outside of the window.
+func (w *MaintenanceWindow) end(t time.Time) time.Time {
+	t = t.In(w.location)
+	for start := t.Truncate(time.Minute); t.Sub(start) < w.Duration; start = start.Add(-time.Minute) {
+		if w.cron.matches(start) {
+			return start.Add(w.Duration)
+		}
+	}
+	return time.Time{}
+}
+
+// maintenanceEnd returns the latest end of the maintenance windows a given time falls into, or the zero time if none
+// of them is active.
+func maintenanceEnd(windows []*MaintenanceWindow, t time.Time) time.Time {
+	var end time.Time
+	for _, w := range windows {
+		if e := w.end(t); e.After(end) {
+			end = e
+		}
+	}
+	return end
+}
+
+// cronSchedule is a parsed cron expression. Each field is a bit set of the values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Following cron, a time matches if either the day of month or the day of week matches when both are restricted.
+	domAny, dowAny bool
+}
+
+var (
+	monthNames = map[string]int{"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6, "JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12}
+	dowNames   = map[string]int{"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6}
+)
+
+// parseCron parses a cron expression with five fields. Fields can be `*`, values, ranges (`1-5`) and lists of them,
+// optionally followed by a step (`*/15`). Months and days of week can also be given by their names (`JAN`, `MON`),
+// and both 0 and 7 are Sunday.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	s := &cronSchedule{domAny: strings.HasPrefix(fields[2], "*"), dowAny: strings.HasPrefix(fields[4], "*")}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7, dowNames); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parseCronField parses a single field of a cron expression into a bit set of values between min and max.
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	value := func(v string) (int, error) {
+		if n, ok := names[strings.ToUpper(v)]; ok {
+			return n, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("invalid value '%s', expected %d-%d", v, min, max)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in '%s'", part)
+			}
+			step, part = n, part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = value(bounds[0]); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// A single value with a step, e.g. `5/15`, covers the range up to the maximum.
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range '%s'", part)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// matches reports whether a time matches the schedule, to the minute.
+func (s *cronSchedule) matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 || s.hour&(1<<uint(t.Hour())) == 0 || s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/datastore"
+	"github.com/google/ts-bridge/mocks"
+
+	"github.com/golang/mock/gomock"
+	"go.opencensus.io/stats/view"
+)
+
+func TestParseCron(t *testing.T) {
+	// 2020-03-02 is a Monday.
+	monday := time.Date(2020, 3, 2, 2, 30, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		expr    string
+		matches []time.Time
+		misses  []time.Time
+		wantErr string
+	}{
+		{expr: "30 2 * * *", matches: []time.Time{monday, monday.AddDate(0, 0, 1)}, misses: []time.Time{monday.Add(time.Minute), monday.Add(time.Hour)}},
+		{expr: "*/15 * * * *", matches: []time.Time{monday, monday.Add(15 * time.Minute)}, misses: []time.Time{monday.Add(5 * time.Minute)}},
+		{expr: "30 2 * * MON-FRI", matches: []time.Time{monday, monday.AddDate(0, 0, 4)}, misses: []time.Time{monday.AddDate(0, 0, 5), monday.AddDate(0, 0, 6)}},
+		{expr: "30 2 * * 7", matches: []time.Time{monday.AddDate(0, 0, 6)}, misses: []time.Time{monday}},
+		{expr: "30 2 * * sun,1", matches: []time.Time{monday, monday.AddDate(0, 0, 6)}, misses: []time.Time{monday.AddDate(0, 0, 1)}},
+		{expr: "30 2 1 MAR *", matches: []time.Time{monday.AddDate(0, 0, -1)}, misses: []time.Time{monday, monday.AddDate(0, 1, -1)}},
+		// When both the day of month and the day of week are restricted, either of them matches.
+		{expr: "30 2 15 * MON", matches: []time.Time{monday, monday.AddDate(0, 0, 13)}, misses: []time.Time{monday.AddDate(0, 0, 1)}},
+		{expr: "0 2 * *", wantErr: "expected 5 fields"},
+		{expr: "60 * * * *", wantErr: "minute: invalid value '60'"},
+		{expr: "* * 0 * *", wantErr: "day of month: invalid value '0'"},
+		{expr: "* * * * FOO", wantErr: "day of week: invalid value 'FOO'"},
+		{expr: "*/0 * * * *", wantErr: "invalid step"},
+		{expr: "5-1 * * * *", wantErr: "invalid range"},
+	} {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseCron(%q) returned error %v; want %q", tt.expr, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCron(%q) returned error: %v", tt.expr, err)
+			}
+			for _, tm := range tt.matches {
+				if !s.matches(tm) {
+					t.Errorf("expected %q to match %v", tt.expr, tm)
+				}
+			}
+			for _, tm := range tt.misses {
+				if s.matches(tm) {
+					t.Errorf("expected %q not to match %v", tt.expr, tm)
+				}
+			}
+		})
+	}
+}
+
+func TestMaintenanceEnd(t *testing.T) {
+	sunday := &MaintenanceWindow{Schedule: "0 2 * * SUN", Duration: 2 * time.Hour}
+	berlin := &MaintenanceWindow{Schedule: "0 3 * * *", Duration: 30 * time.Minute, TimeZone: "Europe/Berlin"}
+	for _, w := range []*MaintenanceWindow{sunday, berlin} {
+		if err := w.validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	windows := []*MaintenanceWindow{sunday, berlin}
+
+	// 2020-03-08 is a Sunday, when Berlin is at UTC+1.
+	start := time.Date(2020, 3, 8, 2, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		t    time.Time
+		want time.Time
+	}{
+		{t: start.Add(-time.Second)},
+		{t: start, want: start.Add(2 * time.Hour)},
+		{t: start.Add(119 * time.Minute), want: start.Add(2 * time.Hour)},
+		{t: start.Add(2 * time.Hour)},
+		{t: time.Date(2020, 3, 9, 2, 10, 0, 0, time.UTC), want: time.Date(2020, 3, 9, 2, 30, 0, 0, time.UTC)},
+		{t: time.Date(2020, 3, 9, 3, 10, 0, 0, time.UTC)},
+	} {
+		if got := maintenanceEnd(windows, tt.t); !got.Equal(tt.want) {
+			t.Errorf("maintenanceEnd(%v) = %v; want %v", tt.t, got, tt.want)
+		}
+	}
+
+	for _, w := range []*MaintenanceWindow{
+		{Schedule: "0 2 * * *", Duration: 8 * 24 * time.Hour},
+		{Schedule: "0 2 * * *", Duration: time.Hour, TimeZone: "Mars/Olympus"},
+	} {
+		if err := w.validate(); err == nil {
+			t.Errorf("expected an error for %+v", w)
+		}
+	}
+}
+
+func TestMetricUpdateMaintenance(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	// Neither the source nor Stackdriver are queried during the window.
+	src := mocks.NewMockSourceMetric(mockCtrl)
+	src.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+
+	w := &MaintenanceWindow{Schedule: "* * * * *", Duration: time.Hour}
+	if err := w.validate(); err != nil {
+		t.Fatal(err)
+	}
+	rec := &datastore.StoredMetricRecord{Name: "metricname", Storage: storage}
+	m := &Metric{Name: "metricname", Source: src, SDProject: "sd-project", Record: rec, MaintenanceWindows: []*MaintenanceWindow{w}}
+
+	collector, exporter := fakeStats(t)
+	res := m.update(ctx, mockSD, collector)
+	collector.Close()
+
+	if res.Err != nil || res.RecordErr != nil || !res.Skipped {
+		t.Errorf("expected update to be skipped without error; got %+v", res)
+	}
+	if !strings.Contains(rec.LastStatus, "maintenance window") {
+		t.Errorf("expected status to mention the maintenance window; got %v", rec.LastStatus)
+	}
+	val, ok := exporter.values["ts_bridge/metric_maintenance_skips:metricname"]
+	if !ok || val.(*view.CountData).Value != 1 {
+		t.Errorf("expected to see 1 maintenance skip reported; got %v", val)
+	}
+}
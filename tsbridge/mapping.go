@@ -0,0 +1,119 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to mapping string, boolean and status values returned by sources to integers.
+package tsbridge
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/google/ts-bridge/tserrors"
+
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// Value types that mapped values can be written as.
+const (
+	MappingInt64 = "int64"
+	MappingBool  = "bool"
+)
+
+// ValueMapping converts values returned by the source (e.g. check statuses like "ok" and "critical") into INT64 or
+// BOOL values written to Stackdriver.
+type ValueMapping struct {
+	// Values maps source values to integers. Numeric values are matched using their shortest decimal representation
+	// (e.g. "2" or "0.5"), and booleans as "true" and "false".
+	Values map[string]int64 `validate:"nonzero"`
+	// Default is used for values that are not listed in Values. If not set, such values cause the update to fail.
+	Default *int64
+	// Type is the value type of the written metric. For BOOL metrics, mapped values other than 0 are written as true.
+	Type string `validate:"regexp=^(|int64|bool)$"`
+}
+
+// valueType returns the Stackdriver value type of mapped values.
+func (vm *ValueMapping) valueType() metricpb.MetricDescriptor_ValueType {
+	if vm.Type == MappingBool {
+		return metricpb.MetricDescriptor_BOOL
+	}
+	return metricpb.MetricDescriptor_INT64
+}
+
+// mapValue returns the mapped value of a point.
+func (vm *ValueMapping) mapValue(v *monitoringpb.TypedValue) (*monitoringpb.TypedValue, error) {
+	key := valueKey(v)
+	mapped, ok := vm.Values[key]
+	if !ok {
+		if vm.Default == nil {
+			return nil, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("value '%s' is not listed in value_mapping, and no default is set", key))
+		}
+		mapped = *vm.Default
+	}
+	if vm.Type == MappingBool {
+		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_BoolValue{BoolValue: mapped != 0}}, nil
+	}
+	return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: mapped}}, nil
+}
+
+// valueKey returns the string representation of a value that is used to look it up in a value mapping.
+func valueKey(v *monitoringpb.TypedValue) string {
+	switch v := v.GetValue().(type) {
+	case *monitoringpb.TypedValue_StringValue:
+		return v.StringValue
+	case *monitoringpb.TypedValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *monitoringpb.TypedValue_Int64Value:
+		return strconv.FormatInt(v.Int64Value, 10)
+	case *monitoringpb.TypedValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'f', -1, 64)
+	}
+	return ""
+}
+
+// mapValues converts values of all points according to the value mapping, changing the value type of the metric
+// descriptor and time series accordingly. Without a value mapping, only numeric values can be written to
+// Stackdriver, so an error is returned if the source returned any other values.
+func mapValues(desc *metricpb.MetricDescriptor, series []*monitoringpb.TimeSeries, vm *ValueMapping) error {
+	if vm == nil {
+		for _, ts := range series {
+			for _, p := range ts.Points {
+				switch p.GetValue().GetValue().(type) {
+				case *monitoringpb.TypedValue_StringValue, *monitoringpb.TypedValue_BoolValue:
+					return tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("source returned a non-numeric value '%s'; please configure value_mapping", valueKey(p.Value)))
+				}
+			}
+		}
+		return nil
+	}
+
+	if desc.GetMetricKind() == metricpb.MetricDescriptor_CUMULATIVE {
+		return tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("value_mapping cannot be used with cumulative metrics"))
+	}
+	if desc != nil {
+		desc.ValueType = vm.valueType()
+	}
+	for _, ts := range series {
+		ts.ValueType = vm.valueType()
+		for _, p := range ts.Points {
+			v, err := vm.mapValue(p.Value)
+			if err != nil {
+				return err
+			}
+			p.Value = v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/tserrors"
+
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// valueSeries returns single-point gauge time series with given values.
+func valueSeries(values ...*monitoringpb.TypedValue) []*monitoringpb.TimeSeries {
+	series := gaugeSeries(time.Now().Add(-time.Hour), time.Minute, make([]float64, len(values))...)
+	for i, ts := range series {
+		ts.Points[0].Value = values[i]
+	}
+	return series
+}
+
+func doubleValue(v float64) *monitoringpb.TypedValue {
+	return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: v}}
+}
+
+func stringValue(s string) *monitoringpb.TypedValue {
+	return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_StringValue{StringValue: s}}
+}
+
+func boolValue(b bool) *monitoringpb.TypedValue {
+	return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_BoolValue{BoolValue: b}}
+}
+
+func TestMapValues(t *testing.T) {
+	unknown := int64(-1)
+
+	for _, tt := range []struct {
+		name     string
+		mapping  *ValueMapping
+		values   []*monitoringpb.TypedValue
+		wantType metricpb.MetricDescriptor_ValueType
+		want     []string
+		wantErr  string
+	}{
+		{"strings to int64", &ValueMapping{Values: map[string]int64{"ok": 0, "warning": 1, "critical": 2}},
+			[]*monitoringpb.TypedValue{stringValue("ok"), stringValue("critical")},
+			metricpb.MetricDescriptor_INT64, []string{"0", "2"}, ""},
+		{"numbers to bool", &ValueMapping{Values: map[string]int64{"0": 1, "1": 0, "2": 0}, Type: MappingBool},
+			[]*monitoringpb.TypedValue{doubleValue(0), doubleValue(2)},
+			metricpb.MetricDescriptor_BOOL, []string{"true", "false"}, ""},
+		{"booleans", &ValueMapping{Values: map[string]int64{"true": 1, "false": 0}},
+			[]*monitoringpb.TypedValue{boolValue(false), boolValue(true)},
+			metricpb.MetricDescriptor_INT64, []string{"0", "1"}, ""},
+		{"default", &ValueMapping{Values: map[string]int64{"up": 1}, Default: &unknown},
+			[]*monitoringpb.TypedValue{stringValue("up"), stringValue("unreachable")},
+			metricpb.MetricDescriptor_INT64, []string{"1", "-1"}, ""},
+		{"unmapped value", &ValueMapping{Values: map[string]int64{"up": 1}},
+			[]*monitoringpb.TypedValue{stringValue("up"), stringValue("unreachable")},
+			0, nil, "value 'unreachable' is not listed in value_mapping"},
+		{"no mapping", nil, []*monitoringpb.TypedValue{doubleValue(1), doubleValue(2.5)},
+			metricpb.MetricDescriptor_DOUBLE, []string{"1", "2.5"}, ""},
+		{"string without mapping", nil, []*monitoringpb.TypedValue{stringValue("ok")},
+			0, nil, "please configure value_mapping"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			desc := &metricpb.MetricDescriptor{MetricKind: metricpb.MetricDescriptor_GAUGE, ValueType: metricpb.MetricDescriptor_DOUBLE}
+			series := valueSeries(tt.values...)
+			err := mapValues(desc, series, tt.mapping)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected mapValues() error '%s'; got %v", tt.wantErr, err)
+				}
+				if !errors.Is(err, tserrors.ErrConfigInvalid) {
+					t.Errorf("expected mapValues() error to be of class '%v'; got %v", tserrors.ErrConfigInvalid, tserrors.Class(err))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mapValues() returned error: %v", err)
+			}
+			if desc.ValueType != tt.wantType {
+				t.Errorf("expected descriptor value type %v; got %v", tt.wantType, desc.ValueType)
+			}
+			var got []string
+			for _, ts := range series {
+				if ts.ValueType != tt.wantType {
+					t.Errorf("expected time series value type %v; got %v", tt.wantType, ts.ValueType)
+				}
+				got = append(got, valueKey(ts.Points[0].Value))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected values %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMapValuesCumulative(t *testing.T) {
+	desc := &metricpb.MetricDescriptor{MetricKind: metricpb.MetricDescriptor_CUMULATIVE}
+	err := mapValues(desc, valueSeries(doubleValue(1)), &ValueMapping{Values: map[string]int64{"1": 1}})
+	if err == nil || !strings.Contains(err.Error(), "cannot be used with cumulative metrics") {
+		t.Errorf("expected mapValues() to reject a cumulative metric; got %v", err)
+	}
+}
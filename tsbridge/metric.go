@@ -18,24 +18,63 @@ package tsbridge
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/google/ts-bridge/notify"
+	"github.com/google/ts-bridge/requestid"
 	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+	"github.com/google/ts-bridge/usage"
+	"math"
 	"net/url"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
+	"golang.org/x/sync/errgroup"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
+// Source queries that fail with a transient error are retried a few times before the update is considered failed.
+const (
+	sourceAttempts     = 3
+	sourceRetryBackoff = time.Second
+)
+
 // Metric defines a specific metric that will be regularly imported.
 type Metric struct {
 	Name      string
 	Source    SourceMetric
 	SDProject string
 	Record    storage.MetricRecord
+
+	// Options control how points are processed before being written to Stackdriver.
+	Options MetricOptions
+	// Breaker is used to skip the metric while its source host is unavailable. Can be nil.
+	Breaker *CircuitBreaker
+	// RateLimiter limits the rate of queries sent to the named source referenced by the metric. Can be nil.
+	RateLimiter *RateLimiter
+	// Tenant is the name of the tenant the metric belongs to, if any.
+	Tenant string
+	// Notifiers are notification channels threshold rules of the metric can send notifications to, by name.
+	Notifiers map[string]notify.Notifier
+	// QueryChunk is the longest time range queried from the source at once. Longer time ranges are imported in
+	// several chunks, with points written after each of them. 0 means that time ranges are never split.
+	QueryChunk time.Duration
+	// MaintenanceWindows are periods during which updates of the metric are skipped.
+	MaintenanceWindows []*MaintenanceWindow
+	// Claims are used to claim imports of the metric when several instances share its storage. Can be nil.
+	Claims *ImportClaims
+	// ProjectBudget is the daily budget of points written to the destination project, shared by all metrics written
+	// to it. Can be nil.
+	ProjectBudget *ProjectBudget
+	// Hooks are called at stages of each update, in order.
+	Hooks []*Hook
 }
 
 //go:generate mockgen -destination=../mocks/mock_source_metric.go -package=mocks github.com/google/ts-bridge/tsbridge SourceMetric
@@ -53,47 +92,299 @@ type SourceMetric interface {
 type StackdriverAdapter interface {
 	LatestTimestamp(context.Context, string, string) (time.Time, error)
 	CreateTimeseries(context.Context, string, string, *metricpb.MetricDescriptor, []*monitoringpb.TimeSeries) error
+	SumOverWindow(context.Context, string, string, time.Duration) (float64, error)
 	Close() error
 }
 
-// UpdateAllMetrics updates all metrics listed in a given config.
-func UpdateAllMetrics(ctx context.Context, c *Config, sd StackdriverAdapter, parallelism int, s *StatsCollector) (errors []string) {
+// maxParallelismFactor limits how much UpdateAllMetrics can raise the configured parallelism to fit all metric
+// updates before the context deadline.
+const maxParallelismFactor = 4
+
+// UpdateResult describes the outcome of a single metric update.
+type UpdateResult struct {
+	Name     string
+	Duration time.Duration
+	// RequestID identifies the update in logs, in the metric status and in requests sent to the source.
+	RequestID string
+	// Points is the number of points written to Stackdriver.
+	Points int
+	// Skipped is set when the update was skipped intentionally, e.g. during a maintenance window, or because another
+	// instance is importing the metric (in which case the metric record is left unchanged).
+	Skipped bool
+	// Deferred is set when the update was left for a later sync, either because it's the first import of a metric
+	// beyond the warm start ramp, or to leave time for other updates before the context deadline. The metric record
+	// is left unchanged.
+	Deferred bool
+	// Err is the reason the update failed. It is also reflected in the status of the metric record.
+	Err error
+	// RecordErr is set when the metric record could not be updated, e.g. because of a storage failure, or because
+	// the update was not started before the context was done.
+	RecordErr error
+}
+
+// UpdateAllMetrics updates all metrics listed in a given config, and returns a result for each of them in the
+// order they are listed. Updates run in parallel, up to `parallelism` at a time; if the context has a deadline,
+// more updates are run in parallel when needed to import all metrics in time. Metrics of source types that have
+// their own parallelism configured are updated in a separate pool instead. No further updates are started after
+// the context is done or once a metric record could not be updated.
+//
+// Low-priority metrics are started after all others, in order of their last attempt, and are deferred instead of
+// being started when an average update would not finish before the context deadline. First imports of metrics
+// beyond the warm start ramp of the config are deferred as well.
+//
+// If the storage of metric records supports it, records are written in a batch once all metrics are updated.
+func UpdateAllMetrics(ctx context.Context, c *Config, sd StackdriverAdapter, parallelism int, s *StatsCollector) []*UpdateResult {
 	oldestWrite := time.Now()
 	defer func(start time.Time) {
 		stats.Record(ctx, s.TotalImportLatency.M(int64(time.Since(start)/time.Millisecond)))
 		stats.Record(ctx, s.OldestMetricAge.M(int64(time.Since(oldestWrite)/time.Millisecond)))
 	}(time.Now())
 
-	errchan := make(chan string, len(c.Metrics()))
-	sem := make(chan bool, parallelism)
-	var wg sync.WaitGroup
+	metrics := c.Metrics()
+	defer s.RecordHeartbeats(ctx, metrics)
+	results := make([]*UpdateResult, len(metrics))
+	order := updateOrder(metrics)
+	if b, ok := c.storage.(storage.Batcher); ok {
+		b.StartBatch()
+	}
+	ramp := warmStart(metrics, c.warmStartRamp)
+	done := make(chan time.Duration, len(metrics))
+	g, gctx := errgroup.WithContext(ctx)
+
+	// Tenants that have a parallelism limit get their own semaphore, acquired in addition to the global limit.
+	tenants := make(map[string]chan struct{})
+	for name, limit := range c.tenantParallelism {
+		if limit > 0 {
+			tenants[name] = make(chan struct{}, limit)
+		}
+	}
+
+	// Source types that have a parallelism limit get their own pool, which doesn't count towards the global limit, so
+	// that slow sources cannot hold up updates of metrics of other sources.
+	pools := make(map[string]chan struct{})
+	for name, limit := range c.sourceParallelism {
+		if limit > 0 {
+			pools[name] = make(chan struct{}, limit)
+		}
+	}
+	unpooled := 0
+	for _, m := range metrics {
+		if _, ok := pools[sourceType(m.Source)]; !ok {
+			unpooled++
+		}
+	}
+
+	// Latest timestamps are looked up for all metrics at once, which is much faster than a lookup per metric.
+	metricsSD := prefetchLatestTimestamps(gctx, sd, metrics)
 
-	for _, m := range c.Metrics() {
-		sem <- true
-		wg.Add(1)
-		go func(metric *Metric) {
-			defer wg.Done()
+	update := func(i int, metric *Metric) error {
+		if sem, ok := tenants[metric.Tenant]; ok {
+			sem <- struct{}{}
 			defer func() { <-sem }()
+		}
+		results[i] = metric.update(gctx, metricsSD, s)
+		return results[i].RecordErr
+	}
+	notUpdated := func(m *Metric, err error) *UpdateResult {
+		return &UpdateResult{Name: m.Name, RecordErr: fmt.Errorf("metric %s was not updated: %w", m.Name, err)}
+	}
 
-			err := metric.Update(ctx, sd, s)
-			if err != nil {
-				errchan <- err.Error()
+	// Durations of finished updates, including those of source pools, are used to estimate how long an update takes.
+	var mu sync.Mutex
+	var finished int
+	var elapsed time.Duration
+	finish := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		finished++
+		elapsed += d
+	}
+	progress := func() (int, time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		return finished, elapsed
+	}
+	deferred := func(i int, metric *Metric) bool {
+		if !ramp[i] {
+			if !metric.Options.LowPriority {
+				return false
+			}
+			if f, e := progress(); !deferUpdate(ctx, f, e) {
+				return false
 			}
-		}(m)
+		}
+		results[i] = &UpdateResult{Name: metric.Name, Deferred: true}
+		if tagCtx, err := tag.New(ctx, tag.Insert(s.MetricKey, metric.Name)); err == nil {
+			stats.Record(tagCtx, s.MetricDeferrals.M(1))
+		}
+		return true
 	}
-	wg.Wait()
-	close(errchan)
 
-	// After all metrics are updated, find the oldest write timestamp.
-	for _, m := range c.Metrics() {
-		if m.Record.GetLastUpdate().Before(oldestWrite) {
-			oldestWrite = m.Record.GetLastUpdate()
+	var started, running int
+	for _, i := range order {
+		i, metric := i, metrics[i]
+		if pool, ok := pools[sourceType(metric.Source)]; ok {
+			g.Go(func() error {
+				select {
+				case pool <- struct{}{}:
+					defer func() { <-pool }()
+				case <-gctx.Done():
+				}
+				if err := gctx.Err(); err != nil {
+					results[i] = notUpdated(metric, err)
+					return nil
+				}
+				if deferred(i, metric) {
+					return nil
+				}
+				err := update(i, metric)
+				finish(results[i].Duration)
+				return err
+			})
+			continue
+		}
+
+		for running > 0 {
+			f, e := progress()
+			if running < adaptiveParallelism(ctx, parallelism, unpooled-started, f, e) {
+				break
+			}
+			finish(<-done)
+			running--
 		}
+		started++
+		if err := gctx.Err(); err != nil {
+			results[i] = notUpdated(metric, err)
+			continue
+		}
+		if deferred(i, metric) {
+			continue
+		}
+		running++
+		g.Go(func() error {
+			err := update(i, metric)
+			done <- results[i].Duration
+			return err
+		})
 	}
-	for err := range errchan {
-		errors = append(errors, err)
+	g.Wait()
+	flushRecords(ctx, c, results)
+
+	// Burn rates are derived from metrics written above, so they are only computed once all updates are done.
+	for _, b := range c.BurnRates() {
+		if err := ctx.Err(); err != nil {
+			results = append(results, &UpdateResult{Name: b.Name, RecordErr: fmt.Errorf("burn rate %s was not updated: %w", b.Name, err)})
+			continue
+		}
+		results = append(results, b.update(ctx, sd))
 	}
-	return errors
+
+	// After all metrics are updated, find the oldest write timestamp, ignoring time when no data was expected.
+	now := time.Now()
+	for _, m := range metrics {
+		if t := now.Add(-m.DataAge(now)); t.Before(oldestWrite) {
+			oldestWrite = t
+		}
+	}
+	s.RecordMetricAges(ctx, metrics, now)
+	return results
+}
+
+// DataAge returns how long the metric has not been imported for, only counting time when its source was expected to
+// produce data.
+func (m *Metric) DataAge(now time.Time) time.Duration {
+	return m.Options.ExpectedData.age(m.Record.GetLastUpdate(), now)
+}
+
+// flushRecords writes metric records changed during an update in a batch, if the storage manager supports batching.
+// If the batch cannot be written, the error is set on results of all
+// updated metrics, since their records have not been updated.
+func flushRecords(ctx context.Context, c *Config, results []*UpdateResult) {
+	b, ok := c.storage.(storage.Batcher)
+	if !ok {
+		return
+	}
+	err := b.FlushBatch(ctx)
+	if err == nil {
+		return
+	}
+	for _, r := range results {
+		if r != nil && !r.Deferred && r.RecordErr == nil {
+			r.RecordErr = fmt.Errorf("metric record of %s was not written: %w", r.Name, err)
+		}
+	}
+}
+
+// updateOrder returns the indices of metrics in the order their updates are started. Low-priority metrics are started
+// after all others, and those that have not been attempted for the longest time (e.g. because they were deferred
+// during the previous update) go first among them.
+func updateOrder(metrics []*Metric) []int {
+	order := make([]int, len(metrics))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		ma, mb := metrics[order[a]], metrics[order[b]]
+		if ma.Options.LowPriority != mb.Options.LowPriority {
+			return mb.Options.LowPriority
+		}
+		return ma.Options.LowPriority && ma.Record.GetLastAttempt().Before(mb.Record.GetLastAttempt())
+	})
+	return order
+}
+
+// warmStart returns the indices of metrics whose first import is deferred, because `limit` other metrics that have
+// never been attempted before are listed earlier. Since deferred metrics are not attempted, the next ones are
+// imported for the first time during each update until all metrics have been imported.
+func warmStart(metrics []*Metric, limit int) map[int]bool {
+	deferred := make(map[int]bool)
+	if limit <= 0 {
+		return deferred
+	}
+	first := 0
+	for i, m := range metrics {
+		if !m.Record.GetLastAttempt().IsZero() {
+			continue
+		}
+		if first++; first > limit {
+			deferred[i] = true
+		}
+	}
+	return deferred
+}
+
+// deferUpdate returns true if an update that takes as long as the average of `finished` updates, which have taken
+// `elapsed` time in total, would not finish before the context deadline.
+func deferUpdate(ctx context.Context, finished int, elapsed time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok || finished == 0 {
+		return false
+	}
+	return time.Until(deadline) < elapsed/time.Duration(finished)
+}
+
+// adaptiveParallelism returns the number of metric updates that should be running in parallel, given that
+// `remaining` updates have not been started yet, and that `finished` updates have taken `elapsed` time in total.
+// If the average update would not allow remaining updates to finish before the context deadline with the
+// configured parallelism, a higher parallelism is returned.
+func adaptiveParallelism(ctx context.Context, parallelism, remaining, finished int, elapsed time.Duration) int {
+	deadline, ok := ctx.Deadline()
+	if !ok || finished == 0 {
+		return parallelism
+	}
+	left := time.Until(deadline)
+	if left <= 0 {
+		return parallelism
+	}
+	average := elapsed / time.Duration(finished)
+	needed := int(math.Ceil(float64(remaining) * float64(average) / float64(left)))
+	if needed <= parallelism {
+		return parallelism
+	}
+	if max := parallelism * maxParallelismFactor; needed > max {
+		return max
+	}
+	return needed
 }
 
 // NewMetric creates a Metric based on a SourceMetric and the destination Stackdriver project.
@@ -110,42 +401,445 @@ func NewMetric(ctx context.Context, name string, s SourceMetric, sdProject strin
 	}, nil
 }
 
-// Update issues a configured query and imports new points to Stackdriver.
+// Update issues a configured query and imports new points to Stackdriver. Update errors are recorded in the metric
+// record; the returned error is only set if the metric record could not be updated.
 func (m *Metric) Update(ctx context.Context, sd StackdriverAdapter, s *StatsCollector) error {
-	ctx, err := tag.New(ctx, tag.Insert(s.MetricKey, m.Name))
+	return m.update(ctx, sd, s).RecordErr
+}
+
+// update runs a metric update and returns its result.
+func (m *Metric) update(ctx context.Context, sd StackdriverAdapter, s *StatsCollector) *UpdateResult {
+	ctx = requestid.NewChildContext(ctx)
+	res := &UpdateResult{Name: m.Name, RequestID: requestid.FromContext(ctx)}
+	ctx, err := tag.New(ctx,
+		tag.Insert(s.MetricKey, m.Name),
+		tag.Insert(s.SourceTypeKey, sourceType(m.Source)),
+		tag.Insert(s.DestinationKey, m.SDProject))
 	if err != nil {
-		return err
+		res.RecordErr = err
+		return res
+	}
+	ctx, counter := usage.NewContext(ctx)
+	defer func() { m.recordUsage(ctx, s, counter.Counts(), time.Now()) }()
+
+	// Updates during maintenance windows are skipped without recording an error, since the source is expected to
+	// be unavailable. Points of the window are imported by the first update after it.
+	if end := maintenanceEnd(m.MaintenanceWindows, time.Now()); !end.IsZero() {
+		stats.Record(ctx, s.MaintenanceSkips.M(1))
+		res.Skipped = true
+		res.RecordErr = m.Record.UpdateSuccess(ctx, 0, fmt.Sprintf("skipped during maintenance window until %v [request %s]", end, res.RequestID))
+		return res
+	}
+
+	if err := m.checkBudget(ctx, time.Now()); err != nil {
+		res.Err = err
+		res.RecordErr = m.updateError(ctx, s, err)
+		return res
 	}
 
+	defer trackUpdate(m)()
 	start := time.Now()
 	defer func(start time.Time) {
 		stats.Record(ctx, s.MetricImportLatency.M(int64(time.Since(start)/time.Millisecond)))
 	}(start)
 
-	latest, err := sd.LatestTimestamp(ctx, m.SDProject, m.Source.StackdriverName())
+	imported := &importedPoints{}
+	cursor, release, err := m.claimImport(ctx, imported)
+	if errors.Is(err, storage.ErrClaimed) {
+		log.WithContext(ctx).Infof("%s: skipping update: %v", m.Name, err)
+		res.Skipped = true
+		return res
+	}
 	if err != nil {
-		if err = m.Record.UpdateError(ctx, fmt.Errorf("failed to get latest timestamp: %v", err)); err != nil {
-			return err
+		res.Err = err
+		res.RecordErr = m.updateError(ctx, s, err)
+		return res
+	}
+	defer release()
+
+	points, latest, err := m.importPoints(ctx, sd, s, cursor, imported)
+	res.Duration = time.Since(start)
+	if err != nil {
+		res.Err = err
+		res.RecordErr = m.updateError(ctx, s, err)
+	} else {
+		res.Points = points
+		res.RecordErr = m.Record.UpdateSuccess(ctx, points, fmt.Sprintf("%d new points found since %v [took %s] [request %s]", points, latest, res.Duration, res.RequestID))
+		m.notifyImport(ctx, imported)
+	}
+	// Points written by a failed update count towards budgets as well. If they cannot be counted, the metric is
+	// reported as paused, since it might have exceeded its budget.
+	if berr := m.spendWritten(ctx, imported, time.Now()); berr != nil {
+		if res.Err != nil {
+			res.Err = fmt.Errorf("%w; %v", res.Err, berr)
+		} else {
+			res.Err = berr
+			if rerr := m.updateError(ctx, s, berr); res.RecordErr == nil {
+				res.RecordErr = rerr
+			}
 		}
-		return nil
+	}
+	return res
+}
+
+// importPoints imports new points to Stackdriver after the later of the newest point in Stackdriver and `cursor`, and
+// returns the number of points written along with the timestamp of the latest point that had been written before.
+// Written points are tracked in `imported`.
+func (m *Metric) importPoints(ctx context.Context, sd StackdriverAdapter, s *StatsCollector, cursor time.Time, imported *importedPoints) (int, time.Time, error) {
+	host := sourceHost(m.Source)
+	if ok, until := m.Breaker.Allow(host); !ok {
+		stats.Record(ctx, s.MetricSkips.M(1))
+		return 0, time.Time{}, tserrors.Wrap(tserrors.ErrSourceTransient, fmt.Errorf("skipped until %v: source host %s has been failing", until, host))
 	}
 
-	desc, ts, err := m.Source.StackdriverData(ctx, latest, m.Record)
+	latest, err := sd.LatestTimestamp(ctx, m.SDProject, m.Source.StackdriverName())
 	if err != nil {
-		if err = m.Record.UpdateError(ctx, fmt.Errorf("failed to get data: %v", err)); err != nil {
+		return 0, latest, fmt.Errorf("failed to get latest timestamp: %w", err)
+	}
+	// A previous update that failed part way might have written points that are not visible in Stackdriver yet.
+	if resume := m.Record.GetResumeTime(); resume.After(latest) {
+		log.WithContext(ctx).Infof("%s: resuming after %v, where the previous update stopped", m.Name, resume)
+		latest = resume
+	}
+	// Another instance might have written points that are not visible in Stackdriver yet.
+	if cursor.After(latest) {
+		log.WithContext(ctx).Infof("%s: continuing after %v, the newest point written by any instance", m.Name, cursor)
+		latest = cursor
+	}
+
+	lag := &importLag{written: latest}
+	defer lag.record(ctx, s)
+
+	// Points that the previous update failed to write are written first, and the source is queried after them.
+	written, latest, err := m.writePending(ctx, sd, s, imported, latest)
+	if err != nil {
+		return written, latest, err
+	}
+	lag.written = latest
+
+	for since := latest; ; {
+		until, chunked := m.chunkEnd(since)
+		if chunked {
+			log.WithContext(ctx).Infof("%s: importing points between %v and %v", m.Name, since, until)
+		}
+		n, err := m.importWindow(ctx, sd, s, lag, imported, since, until, chunked)
+		written += n
+		if err != nil || !chunked {
+			return written, latest, err
+		}
+		// Progress is kept after each chunk, so that the next update continues from here if this one runs out of
+		// time. This also skips chunks without any points.
+		if err := m.Record.SetResumeTime(ctx, until); err != nil {
+			return written, latest, err
+		}
+		if err := ctx.Err(); err != nil {
+			return written, latest, fmt.Errorf("stopped after importing points up to %v: %w", until, err)
+		}
+		since = until
+	}
+}
+
+// importWindow imports points after `latest` to Stackdriver, up to `until` if the time range is chunked, and
+// returns the number of points written. Newest points returned by the source and written are tracked in `lag`, and
+// written points in `imported`.
+func (m *Metric) importWindow(ctx context.Context, sd StackdriverAdapter, s *StatsCollector, lag *importLag, imported *importedPoints, latest, until time.Time, chunked bool) (int, error) {
+	host := sourceHost(m.Source)
+	if err := m.beforeQuery(ctx, latest, until); err != nil {
+		return 0, err
+	}
+	var desc *metricpb.MetricDescriptor
+	var ts []*monitoringpb.TimeSeries
+	err := tserrors.Retry(ctx, sourceAttempts, sourceRetryBackoff, func() error {
+		if err := m.RateLimiter.Wait(ctx); err != nil {
 			return err
 		}
-		return nil
+		start := time.Now()
+		var err error
+		desc, ts, err = m.sourceData(ctx, latest, until, chunked)
+		recordLatency(ctx, s.SourceLatency, start)
+		return tserrors.ClassifySource(err)
+	})
+	s.recordDroppedPoints(ctx, m.Source)
+	if errors.Is(err, errRateLimited) {
+		// The source has not been queried, so this says nothing about the availability of the source host.
+		return 0, fmt.Errorf("failed to get data: %w", tserrors.Wrap(tserrors.ErrSourceTransient, err))
 	}
-	if len(ts) > 0 {
-		if err = sd.CreateTimeseries(ctx, m.SDProject, m.Source.StackdriverName(), desc, ts); err != nil {
-			if err = m.Record.UpdateError(ctx, fmt.Errorf("failed to write to Stackdriver: %v", err)); err != nil {
-				return err
+	if err != nil {
+		// Permanent errors (e.g. an invalid query) don't mean that the source host is unavailable.
+		if errors.Is(err, tserrors.ErrSourcePermanent) {
+			m.Breaker.Success(host)
+		} else if m.Breaker.Failure(host) {
+			log.WithContext(ctx).Warningf("Circuit breaker tripped for source host %s after error: %v", host, err)
+		}
+		return 0, fmt.Errorf("failed to get data: %w", err)
+	}
+	m.Breaker.Success(host)
+	if ts, err = m.afterQuery(ctx, desc, ts); err != nil {
+		return 0, err
+	}
+	if ts, err = m.applySeriesFilters(ctx, ts); err != nil {
+		return 0, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("failed to filter time series: %w", err))
+	}
+	if ts, err = m.handleFuturePoints(ctx, ts, s); err != nil {
+		return 0, fmt.Errorf("failed to check for future points: %w", err)
+	}
+	lag.source = later(lag.source, newestPoint(ts))
+	if ts, err = m.holdBackFreshPoints(ctx, ts); err != nil {
+		return 0, fmt.Errorf("failed to filter fresh points: %w", err)
+	}
+	m.Options.describe(desc)
+	if err := mapValues(desc, ts, m.Options.ValueMapping); err != nil {
+		return 0, fmt.Errorf("failed to map values: %w", err)
+	}
+	if n := sanitizeLabels(desc, ts, m.Options.LabelPolicy); n > 0 {
+		log.WithContext(ctx).Infof("%s: %d labels were rejected by Stackdriver limits and have been sanitized", m.Name, n)
+		stats.Record(ctx, s.LabelSanitizations.M(int64(n)))
+	}
+	if m.Options.NewLabelPolicy == NewLabelPolicyDrop {
+		n, err := m.dropNewLabels(ctx, sd, desc, ts)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get metric descriptor: %w", err)
+		}
+		if n > 0 {
+			log.WithContext(ctx).Infof("%s: %d labels were not declared by the metric descriptor and have been dropped", m.Name, n)
+			stats.Record(ctx, s.LabelSanitizations.M(int64(n)))
+		}
+	}
+	ts, coalesced, err := coalescePoints(ts, m.Options.Coalesce, m.Options.MinPointInterval, latest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to coalesce points: %w", err)
+	}
+	if coalesced > 0 {
+		log.WithContext(ctx).Infof("%s: %d points were too close to each other and have been coalesced", m.Name, coalesced)
+	}
+	if ts, err = m.handleGaps(ctx, ts, s); err != nil {
+		return 0, fmt.Errorf("failed to check for gaps: %w", err)
+	}
+	// Expressions are evaluated last, so that their state only covers points that are about to be written.
+	var exprState []byte
+	if m.Options.Expression != "" {
+		if ts, exprState, err = m.applyExpression(ctx, desc, ts); err != nil {
+			return 0, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("failed to evaluate expression: %w", err))
+		}
+	}
+	if ts, err = m.beforeWrite(ctx, desc, ts); err != nil {
+		return 0, err
+	}
+	if len(ts) == 0 {
+		// Points without an expression value (e.g. the first point for rate()) still change the expression state.
+		if exprState != nil {
+			return 0, m.Record.SetExpressionState(ctx, exprState)
+		}
+		return 0, nil
+	}
+	// Anomalies are detected before writing any points, so that unsupported metrics are rejected upfront.
+	var flagDesc *metricpb.MetricDescriptor
+	var flags []*monitoringpb.TimeSeries
+	var state storage.DetectorState
+	if m.Options.AnomalyDetection != nil {
+		flagDesc, flags, state, err = detectAnomalies(m.Options.AnomalyDetection, m.Record.GetDetectorState(), desc, ts)
+		if err != nil {
+			return 0, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("failed to detect anomalies: %w", err))
+		}
+	}
+	// Points written by earlier chunks count towards budgets, which might be used up by now.
+	if err := m.checkWriteBudget(ctx, imported, time.Now()); err != nil {
+		return 0, err
+	}
+	// Points are written in time order, so that the progress of an update that fails part way can be kept.
+	ts = sortByTime(ts)
+	start := time.Now()
+	err = sd.CreateTimeseries(ctx, m.SDProject, m.Source.StackdriverName(), desc, ts)
+	recordLatency(ctx, s.WriteLatency, start)
+	if err != nil {
+		if resume, ok := resumeTime(ts, err); ok {
+			if rerr := m.Record.SetResumeTime(ctx, resume); rerr != nil {
+				return 0, rerr
 			}
-			return nil
+			err = fmt.Errorf("%w; points up to %v have been written", err, resume)
+		}
+		if n, qerr := m.queueWrite(ctx, s, desc, ts, err); qerr != nil {
+			return 0, qerr
+		} else if n > 0 {
+			err = fmt.Errorf("%w; %d points have been kept for the next update", err, n)
+		}
+		return 0, fmt.Errorf("failed to write to Stackdriver: %w", err)
+	}
+	lag.written = later(lag.written, newestPoint(ts))
+	imported.add(ts)
+	m.federate(desc, ts)
+	m.afterWrite(ctx, desc, ts)
+	if exprState != nil {
+		if err = m.Record.SetExpressionState(ctx, exprState); err != nil {
+			return 0, err
+		}
+	}
+	if !m.Record.GetResumeTime().IsZero() {
+		if err = m.Record.SetResumeTime(ctx, time.Time{}); err != nil {
+			return 0, err
+		}
+	}
+	if m.Options.VerifyWrites {
+		m.verifyWrites(ctx, sd, s, ts)
+	}
+	// The points have already been written, so failing to flag anomalies does not fail the import.
+	if flags != nil {
+		if err = sd.CreateTimeseries(ctx, m.SDProject, anomalyName(m.Source.StackdriverName()), flagDesc, flags); err != nil {
+			log.WithContext(ctx).Warningf("%s: failed to write anomaly flags to Stackdriver: %v", m.Name, err)
+		}
+		if err = m.Record.SetDetectorState(ctx, state); err != nil {
+			log.WithContext(ctx).Warningf("%s: failed to save anomaly detector state: %v", m.Name, err)
+		}
+	}
+	// Streaks are only saved once notifications have been sent, so failed notifications are retried next time.
+	if err = m.evaluateThresholds(ctx, ts); err != nil {
+		log.WithContext(ctx).Warningf("%s: failed to evaluate thresholds: %v", m.Name, err)
+	}
+	return len(ts), nil
+}
+
+// updateError records a failed update in stats and in the metric record. The class of the error is added to the
+// status message.
+func (m *Metric) updateError(ctx context.Context, s *StatsCollector, updateErr error) error {
+	if ctx, err := tag.New(ctx, tag.Upsert(s.ErrorClassKey, tserrors.Label(updateErr))); err == nil {
+		stats.Record(ctx, s.MetricUpdateErrors.M(1))
+	}
+	if class := tserrors.Class(updateErr); class != nil {
+		updateErr = fmt.Errorf("%w [%v]", updateErr, class)
+	}
+	if id := requestid.FromContext(ctx); id != "" {
+		updateErr = fmt.Errorf("%w [request %s]", updateErr, id)
+	}
+	return m.Record.UpdateError(ctx, updateErr)
+}
+
+// holdBackFreshPoints removes points that are younger than the configured minimum point age. They will be queried
+// again during a later update, since the latest point written to Stackdriver is older than them.
+func (m *Metric) holdBackFreshPoints(ctx context.Context, ts []*monitoringpb.TimeSeries) ([]*monitoringpb.TimeSeries, error) {
+	if m.Options.MinPointAge <= 0 {
+		return ts, nil
+	}
+	stable, err := pointsUntil(ts, time.Now().Add(-m.Options.MinPointAge))
+	if err != nil {
+		return nil, err
+	}
+	if held := countPoints(ts) - countPoints(stable); held > 0 {
+		log.WithContext(ctx).Infof("%s: holding back %d points younger than %v", m.Name, held, m.Options.MinPointAge)
+	}
+	return stable, nil
+}
+
+// partialWriter is implemented by errors returned by StackdriverAdapter.CreateTimeseries when some of the time
+// series have been written before the failure.
+type partialWriter interface {
+	WrittenSeries() int
+}
+
+// resumeTime returns the timestamp up to which all points have been written by a failed write of time-ordered,
+// single-point time series. It returns false if no progress has been made.
+func resumeTime(ts []*monitoringpb.TimeSeries, err error) (time.Time, bool) {
+	var pw partialWriter
+	if !errors.As(err, &pw) || pw.WrittenSeries() <= 0 || pw.WrittenSeries() >= len(ts) {
+		return time.Time{}, false
+	}
+	// Time series with labels can have several points with the same timestamp, and they all need to be written for
+	// the update to resume after it.
+	next := seriesEnd(ts[pw.WrittenSeries()])
+	var resume time.Time
+	for _, t := range ts[:pw.WrittenSeries()] {
+		if end := seriesEnd(t); end.Before(next) && end.After(resume) {
+			resume = end
+		}
+	}
+	return resume, !resume.IsZero()
+}
+
+// sortByTime returns single-point time series sorted by point timestamp, keeping the original order of time series
+// with the same timestamp.
+func sortByTime(ts []*monitoringpb.TimeSeries) []*monitoringpb.TimeSeries {
+	sorted := make([]*monitoringpb.TimeSeries, len(ts))
+	copy(sorted, ts)
+	sort.SliceStable(sorted, func(i, j int) bool { return seriesEnd(sorted[i]).Before(seriesEnd(sorted[j])) })
+	return sorted
+}
+
+// seriesEnd returns the latest point timestamp of a time series.
+func seriesEnd(ts *monitoringpb.TimeSeries) time.Time {
+	var latest time.Time
+	for _, p := range ts.Points {
+		if end, err := ptypes.Timestamp(p.GetInterval().GetEndTime()); err == nil && end.After(latest) {
+			latest = end
+		}
+	}
+	return latest
+}
+
+// newestPoint returns the latest point timestamp across several time series.
+func newestPoint(ts []*monitoringpb.TimeSeries) time.Time {
+	var newest time.Time
+	for _, t := range ts {
+		newest = later(newest, seriesEnd(t))
+	}
+	return newest
+}
+
+// later returns the later of two timestamps.
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// importLag tracks the newest point returned by the source and the newest point in Stackdriver during an update.
+type importLag struct {
+	source, written time.Time
+}
+
+// record reports how far the newest point written to Stackdriver lags behind the newest point returned by the source.
+// Nothing is recorded if the source has not returned any points, since the lag is unknown then.
+func (l *importLag) record(ctx context.Context, s *StatsCollector) {
+	if l.source.IsZero() {
+		return
+	}
+	lag := l.source.Sub(l.written)
+	if lag < 0 {
+		lag = 0
+	}
+	stats.Record(ctx, s.ImportLag.M(int64(lag/time.Millisecond)))
+}
+
+// handleGaps detects gaps in new points and records the number of missing points. If gap repair is enabled, points
+// following the earliest gap are held back, which makes the next update query the source for the gap window again.
+func (m *Metric) handleGaps(ctx context.Context, ts []*monitoringpb.TimeSeries, s *StatsCollector) ([]*monitoringpb.TimeSeries, error) {
+	if m.Options.ExpectedPointInterval <= 0 {
+		return ts, nil
+	}
+	gaps, err := findGaps(ts, m.Options.ExpectedPointInterval)
+	if err != nil {
+		return nil, err
+	}
+	missing := missingPoints(gaps)
+	stats.Record(ctx, s.MetricMissingPoints.M(int64(missing)))
+	if missing != m.Record.GetMissingPoints() {
+		if err := m.Record.SetMissingPoints(ctx, missing); err != nil {
+			return nil, err
 		}
 	}
-	return m.Record.UpdateSuccess(ctx, len(ts), fmt.Sprintf("%d new points found since %v [took %s]", len(ts), latest, time.Since(start)))
+	if len(gaps) == 0 || !m.Options.RepairGaps {
+		return ts, nil
+	}
+
+	window := m.Options.GapRepairWindow
+	if window == 0 {
+		window = defaultGapRepairWindow
+	}
+	if time.Since(gaps[0].start) >= window {
+		log.WithContext(ctx).Infof("%s: gap between %v and %v has not been filled in %v, writing points after it", m.Name, gaps[0].start, gaps[0].end, window)
+		return ts, nil
+	}
+	log.WithContext(ctx).Infof("%s: holding back points after the gap between %v and %v until it's filled", m.Name, gaps[0].start, gaps[0].end)
+	return pointsUntil(ts, gaps[0].start)
 }
 
 // StackdriverURL returns a Metric Explorer URL for a given metric.
@@ -17,17 +17,23 @@ package tsbridge
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"math"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/ts-bridge/datastore"
 	"github.com/google/ts-bridge/mocks"
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
 
 	"github.com/golang/mock/gomock"
 	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
@@ -148,13 +154,68 @@ func TestMetricUpdate(t *testing.T) {
 				t.Errorf("expected to see LastStatus contain '%s'; got %s", tt.wantStatus, rec.LastStatus)
 			}
 			collector.Close()
-			if got, ok := exporter.values["ts_bridge/metric_import_latencies:metricname"]; !ok {
+			if got, ok := exporter.values["ts_bridge/metric_import_latencies:sd-project:metricname:unknown"]; !ok {
 				t.Errorf("expected to see import latency recorded; got %v", got)
 			}
 		})
 	}
 }
 
+func TestMetricUpdateErrorClasses(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	for _, tt := range []struct {
+		name       string
+		errs       []error // errors returned by consecutive StackdriverData calls.
+		wantStatus string
+		wantStat   string
+	}{
+		{"transient error is retried", []error{tserrors.Wrap(tserrors.ErrSourceTransient, fmt.Errorf("timeout")), nil},
+			"0 new points found", ""},
+		{"permanent error is not retried", []error{tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("bad query"))},
+			"failed to get data: bad query [permanent source error]", "ts_bridge/metric_update_errors:sd-project:source_permanent:metricname:unknown"},
+		{"unclassified error", []error{fmt.Errorf("oops")},
+			"failed to get data: oops", "ts_bridge/metric_update_errors:sd-project:unknown:metricname:unknown"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			mockSource := mocks.NewMockSourceMetric(mockCtrl)
+			mockSource.EXPECT().Query()
+			mockSource.EXPECT().StackdriverName().MaxTimes(100).Return("sd-metricname")
+			var calls []*gomock.Call
+			for _, err := range tt.errs {
+				calls = append(calls, mockSource.EXPECT().StackdriverData(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, nil, err))
+			}
+			gomock.InOrder(calls...)
+
+			m, err := NewMetric(ctx, "metricname", mockSource, "sd-project", storage)
+			if err != nil {
+				t.Fatalf("error while creating metric: %v", err)
+			}
+			mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+			mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(time.Now().Add(-time.Minute), nil)
+
+			collector, exporter := fakeStats(t)
+			if err := m.Update(ctx, mockSD, collector); err != nil {
+				t.Errorf("Metric.Update() returned error %v", err)
+			}
+			rec := m.Record.(*datastore.StoredMetricRecord)
+			if !strings.Contains(rec.LastStatus, tt.wantStatus) {
+				t.Errorf("expected to see LastStatus contain '%s'; got %s", tt.wantStatus, rec.LastStatus)
+			}
+			collector.Close()
+			if tt.wantStat != "" {
+				if _, ok := exporter.values[tt.wantStat]; !ok {
+					t.Errorf("expected to see %s recorded; got %v", tt.wantStat, exporter.values)
+				}
+			}
+		})
+	}
+}
+
 func TestMetricImportLatencyMetric(t *testing.T) {
 	ctx := context.Background()
 	storage := datastore.New(ctx, &datastore.Options{})
@@ -184,13 +245,69 @@ func TestMetricImportLatencyMetric(t *testing.T) {
 	}
 	collector.Close()
 
-	val, ok := exporter.values["ts_bridge/metric_import_latencies:metricname"]
+	val, ok := exporter.values["ts_bridge/metric_import_latencies:sd-project:metricname:unknown"]
 	got := time.Duration(val.(*view.DistributionData).Mean) * time.Millisecond
 	if !ok || !durationWithin(got, 100*time.Millisecond, 40*time.Millisecond) {
 		t.Errorf("expected to see import latency around 100ms; got %v", got)
 	}
 }
 
+func TestMetricSourceAndWriteLatencyMetrics(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().MaxTimes(100).Return("sd-metricname")
+
+	m, err := NewMetric(ctx, "metricname", mockSource, "sd-project", storage)
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+	latest := time.Now().Add(-time.Hour)
+	desc := &metricpb.MetricDescriptor{Type: "sd-metricname"}
+	ts := gaugeSeries(latest.Add(time.Minute), time.Minute, 1)
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	mockSource.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).DoAndReturn(
+		func(context.Context, time.Time, interface{}) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+			time.Sleep(100 * time.Millisecond)
+			return desc, ts, nil
+		})
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", desc, ts).DoAndReturn(
+		func(context.Context, string, string, *metricpb.MetricDescriptor, []*monitoringpb.TimeSeries) error {
+			time.Sleep(200 * time.Millisecond)
+			return nil
+		})
+
+	collector, exporter := fakeStats(t)
+	if err := m.Update(ctx, mockSD, collector); err != nil {
+		t.Errorf("Metric.Update() returned error %v", err)
+	}
+	collector.Close()
+
+	for _, tt := range []struct {
+		stat string
+		want time.Duration
+	}{
+		{"ts_bridge/source_latencies:sd-project:metricname:unknown", 100 * time.Millisecond},
+		{"ts_bridge/write_latencies:sd-project:metricname:unknown", 200 * time.Millisecond},
+	} {
+		val, ok := exporter.values[tt.stat]
+		if !ok {
+			t.Errorf("expected to see %s recorded; got %v", tt.stat, exporter.values)
+			continue
+		}
+		got := time.Duration(val.(*view.DistributionData).Mean) * time.Millisecond
+		if !durationWithin(got, tt.want, 40*time.Millisecond) {
+			t.Errorf("expected %s to be around %v; got %v", tt.stat, tt.want, got)
+		}
+	}
+}
+
 var updateAllMetricsTests = []struct {
 	name             string
 	parallelism      int
@@ -247,8 +364,20 @@ func TestUpdateAllMetrics(t *testing.T) {
 
 			collector, exporter := fakeStats(t)
 
-			if errs := UpdateAllMetrics(ctx, config, mockSD, tt.parallelism, collector); len(errs) > 0 {
-				t.Errorf("UpdateAllMetrics() returned errors: %v", errs)
+			results := UpdateAllMetrics(ctx, config, mockSD, tt.parallelism, collector)
+			if len(results) != tt.numMetrics {
+				t.Fatalf("UpdateAllMetrics() returned %d results; want %d", len(results), tt.numMetrics)
+			}
+			for i, r := range results {
+				if r.Err != nil || r.RecordErr != nil {
+					t.Errorf("UpdateAllMetrics() returned errors for %s: %v, %v", r.Name, r.Err, r.RecordErr)
+				}
+				if r.Name != config.metrics[i].Name || r.Points != tt.numPoints {
+					t.Errorf("UpdateAllMetrics() returned result %+v; want %d points for %s", r, tt.numPoints, config.metrics[i].Name)
+				}
+				if !durationWithin(r.Duration, 100*time.Millisecond, 75*time.Millisecond) {
+					t.Errorf("expected update of %s to take around 100ms; got %v", r.Name, r.Duration)
+				}
 			}
 			collector.Close()
 
@@ -267,6 +396,58 @@ func TestUpdateAllMetrics(t *testing.T) {
 	}
 }
 
+func TestRecordHeartbeats(t *testing.T) {
+	collector, exporter := fakeStats(t)
+	metrics := []*Metric{{Name: "m1", SDProject: "p1"}, {Name: "m2", SDProject: "p2"}, {Name: "m3", SDProject: "p1"}}
+	collector.RecordHeartbeats(context.Background(), metrics)
+	collector.RecordHeartbeats(context.Background(), metrics[:1])
+	collector.Close()
+
+	for project, want := range map[string]int64{"p1": 2, "p2": 1} {
+		val, ok := exporter.values["ts_bridge/heartbeats:"+project]
+		if !ok {
+			t.Errorf("no heartbeats recorded for %s", project)
+			continue
+		}
+		if got := val.(*view.CountData).Value; got != want {
+			t.Errorf("expected %d heartbeats for %s; got %d", want, project, got)
+		}
+	}
+}
+
+// overflowingSource is a push source reporting points dropped by its buffer.
+type overflowingSource struct {
+	SourceMetric
+	dropped int
+}
+
+func (s *overflowingSource) DroppedPoints() (int, string) {
+	dropped := s.dropped
+	s.dropped = 0
+	return dropped, "downsample"
+}
+
+func TestRecordDroppedPoints(t *testing.T) {
+	collector, exporter := fakeStats(t)
+	ctx, err := tag.New(context.Background(), tag.Insert(collector.MetricKey, "m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := &overflowingSource{dropped: 3}
+	collector.recordDroppedPoints(ctx, src)
+	collector.recordDroppedPoints(ctx, src)
+	collector.recordDroppedPoints(ctx, mocks.NewMockSourceMetric(gomock.NewController(t)))
+	collector.Close()
+
+	val, ok := exporter.values["ts_bridge/dropped_points:m1:downsample"]
+	if !ok {
+		t.Fatalf("no dropped points recorded; got %v", exporter.values)
+	}
+	if got := val.(*view.SumData).Value; got != 3 {
+		t.Errorf("expected 3 dropped points; got %v", got)
+	}
+}
+
 func TestUpdateAllMetricsErrors(t *testing.T) {
 	ctx := context.Background()
 	storage := datastore.New(ctx, &datastore.Options{})
@@ -291,8 +472,507 @@ func TestUpdateAllMetricsErrors(t *testing.T) {
 	collector, _ := fakeStats(t)
 	defer collector.Close()
 
-	errs := UpdateAllMetrics(ctx, config, mockSD, 1, collector)
-	if len(errs) != 1 {
-		t.Errorf("expected UpdateAllMetrics to return an error")
+	results := UpdateAllMetrics(ctx, config, mockSD, 1, collector)
+	if len(results) != 1 || results[0].RecordErr == nil {
+		t.Errorf("expected UpdateAllMetrics to return an error; got %+v", results)
+	}
+}
+
+func TestUpdateAllMetricsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	storage := datastore.New(context.Background(), &datastore.Options{})
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	config := &Config{}
+	for i := 0; i < 3; i++ {
+		config.metrics = append(config.metrics, &Metric{
+			Name:   fmt.Sprintf("metric-%d", i),
+			Record: &datastore.StoredMetricRecord{LastUpdate: time.Now().Add(-time.Hour), Storage: storage},
+			Source: mocks.NewMockSourceMetric(mockCtrl),
+		})
+	}
+
+	// No updates should be started once the context is done.
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+
+	for _, r := range UpdateAllMetrics(ctx, config, mockSD, 1, collector) {
+		if r.RecordErr == nil || !strings.Contains(r.RecordErr.Error(), "was not updated") {
+			t.Errorf("expected %s to not be updated; got %v", r.Name, r.RecordErr)
+		}
+	}
+}
+
+func TestUpdateAllMetricsSourceParallelism(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	// Mock sources have the "unknown" source type, which gets a pool of 2 metrics updated in parallel.
+	config := &Config{sourceParallelism: map[string]int{"unknown": 2}}
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("metric-%d", i)
+		src := mocks.NewMockSourceMetric(mockCtrl)
+		src.EXPECT().StackdriverData(gomock.Any(), gomock.Any(), gomock.Any()).Return(
+			&metricpb.MetricDescriptor{}, nil, nil)
+		src.EXPECT().StackdriverName().MaxTimes(100).Return(name)
+		config.metrics = append(config.metrics, &Metric{
+			Name:   name,
+			Record: &datastore.StoredMetricRecord{LastUpdate: time.Now().Add(-time.Hour), Storage: storage},
+			Source: src,
+		})
+	}
+
+	var mu sync.Mutex
+	var running, maxRunning int
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), gomock.Any(), gomock.Any()).Times(4).DoAndReturn(
+		func(ctx context.Context, project, name string) (time.Time, error) {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(100 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return time.Now(), nil
+		})
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+
+	// The global parallelism does not apply to metrics updated in a source pool.
+	start := time.Now()
+	results := UpdateAllMetrics(ctx, config, mockSD, 1, collector)
+	for _, r := range results {
+		if r.Err != nil || r.RecordErr != nil {
+			t.Errorf("UpdateAllMetrics() returned errors for %s: %v, %v", r.Name, r.Err, r.RecordErr)
+		}
+	}
+	if maxRunning != 2 {
+		t.Errorf("expected 2 metrics to be updated in parallel; got %d", maxRunning)
+	}
+	if elapsed := time.Since(start); !durationWithin(elapsed, 200*time.Millisecond, 75*time.Millisecond) {
+		t.Errorf("expected all updates to take around 200ms; got %v", elapsed)
+	}
+}
+
+func TestUpdateAllMetricsDeferred(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	// The low-priority metric is listed first, but only started after the other one, which takes 200ms.
+	low := mocks.NewMockSourceMetric(mockCtrl)
+	low.EXPECT().StackdriverName().AnyTimes().Return("low")
+	src := mocks.NewMockSourceMetric(mockCtrl)
+	src.EXPECT().StackdriverData(gomock.Any(), gomock.Any(), gomock.Any()).Return(&metricpb.MetricDescriptor{}, nil, nil)
+	src.EXPECT().StackdriverName().AnyTimes().Return("normal")
+	config := &Config{metrics: []*Metric{
+		&Metric{
+			Name:    "low",
+			Record:  &datastore.StoredMetricRecord{LastUpdate: time.Now().Add(-time.Hour), Storage: storage},
+			Source:  low,
+			Options: MetricOptions{LowPriority: true},
+		},
+		&Metric{
+			Name:   "normal",
+			Record: &datastore.StoredMetricRecord{LastUpdate: time.Now().Add(-time.Hour), Storage: storage},
+			Source: src,
+		},
+	}}
+
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), gomock.Any(), "normal").DoAndReturn(
+		func(ctx context.Context, project, name string) (time.Time, error) {
+			time.Sleep(200 * time.Millisecond)
+			return time.Now(), nil
+		})
+	collector, exporter := fakeStats(t)
+
+	results := UpdateAllMetrics(ctx, config, mockSD, 1, collector)
+	if !results[0].Deferred || results[0].Err != nil || results[0].RecordErr != nil {
+		t.Errorf("expected update of the low-priority metric to be deferred; got %+v", results[0])
+	}
+	if results[1].Deferred || results[1].Err != nil || results[1].RecordErr != nil {
+		t.Errorf("expected metric to be updated; got %+v", results[1])
+	}
+	collector.Close()
+	if val, ok := exporter.values["ts_bridge/metric_deferrals:low"]; !ok || val.(*view.CountData).Value != 1 {
+		t.Errorf("expected 1 deferred update to be recorded; got %v", val)
+	}
+}
+
+// fakeBatcher is a storage manager that counts batches and fails to flush them.
+type fakeBatcher struct {
+	storage.Manager
+	started, flushed int
+}
+
+func (b *fakeBatcher) StartBatch() { b.started++ }
+func (b *fakeBatcher) FlushBatch(ctx context.Context) error {
+	b.flushed++
+	return errors.New("datastore unavailable")
+}
+
+func TestUpdateAllMetricsBatchesRecords(t *testing.T) {
+	ctx := context.Background()
+	store := datastore.New(ctx, &datastore.Options{})
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	src := mocks.NewMockSourceMetric(mockCtrl)
+	src.EXPECT().StackdriverData(gomock.Any(), gomock.Any(), gomock.Any()).Return(&metricpb.MetricDescriptor{}, nil, nil)
+	src.EXPECT().StackdriverName().AnyTimes().Return("metric")
+	batcher := &fakeBatcher{}
+	config := &Config{storage: batcher, metrics: []*Metric{
+		&Metric{
+			Name:   "metric",
+			Record: &datastore.StoredMetricRecord{LastUpdate: time.Now().Add(-time.Hour), Storage: store},
+			Source: src,
+		},
+	}}
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), gomock.Any(), gomock.Any()).Return(time.Now(), nil)
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+
+	// Records of updated metrics are reported as not written if the batch fails.
+	results := UpdateAllMetrics(ctx, config, mockSD, 1, collector)
+	if batcher.started != 1 || batcher.flushed != 1 {
+		t.Errorf("expected a single batch to be started and flushed; got %d and %d", batcher.started, batcher.flushed)
+	}
+	if len(results) != 1 || results[0].RecordErr == nil || !strings.Contains(results[0].RecordErr.Error(), "datastore unavailable") {
+		t.Errorf("expected the failed batch to be reported; got %+v", results)
+	}
+}
+
+func TestUpdateOrder(t *testing.T) {
+	now := time.Now()
+	metric := func(low bool, lastAttempt time.Time) *Metric {
+		return &Metric{
+			Record:  &datastore.StoredMetricRecord{LastAttempt: lastAttempt},
+			Options: MetricOptions{LowPriority: low},
+		}
+	}
+	metrics := []*Metric{
+		metric(true, now),
+		metric(false, now),
+		metric(true, now.Add(-time.Hour)),
+		metric(false, now.Add(-time.Hour)),
+		metric(true, now.Add(-time.Minute)),
+	}
+	if got, want := updateOrder(metrics), []int{1, 3, 2, 4, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("updateOrder() returned %v; want %v", got, want)
+	}
+}
+
+func TestWarmStart(t *testing.T) {
+	metric := func(lastAttempt time.Time) *Metric {
+		return &Metric{Record: &datastore.StoredMetricRecord{LastAttempt: lastAttempt}}
+	}
+	metrics := []*Metric{
+		metric(time.Time{}),
+		metric(time.Now()),
+		metric(time.Time{}),
+		metric(time.Time{}),
+		metric(time.Now()),
+		metric(time.Time{}),
+	}
+	for _, tt := range []struct {
+		limit int
+		want  map[int]bool
+	}{
+		{0, map[int]bool{}},
+		{2, map[int]bool{3: true, 5: true}},
+		{4, map[int]bool{}},
+	} {
+		if got := warmStart(metrics, tt.limit); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("warmStart(%d) returned %v; want %v", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateAllMetricsWarmStart(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	// Only one of the two metrics that have never been imported is imported during each update, so metric-0 is
+	// imported twice and metric-1 once.
+	config := &Config{warmStartRamp: 1}
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("metric-%d", i)
+		src := mocks.NewMockSourceMetric(mockCtrl)
+		src.EXPECT().StackdriverData(gomock.Any(), gomock.Any(), gomock.Any()).Times(2-i).Return(&metricpb.MetricDescriptor{}, nil, nil)
+		src.EXPECT().StackdriverName().AnyTimes().Return(name)
+		config.metrics = append(config.metrics, &Metric{
+			Name:   name,
+			Record: &datastore.StoredMetricRecord{Name: name, Storage: storage},
+			Source: src,
+		})
+	}
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), gomock.Any(), gomock.Any()).Times(3).Return(time.Now().Add(-time.Hour), nil)
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+
+	results := UpdateAllMetrics(ctx, config, mockSD, 1, collector)
+	if results[0].Deferred || !results[1].Deferred {
+		t.Errorf("expected the first import of metric-1 to be deferred; got %+v, %+v", results[0], results[1])
+	}
+	results = UpdateAllMetrics(ctx, config, mockSD, 1, collector)
+	if results[0].Deferred || results[1].Deferred {
+		t.Errorf("expected both metrics to be imported; got %+v, %+v", results[0], results[1])
+	}
+}
+
+func TestDeferUpdate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, tt := range []struct {
+		name     string
+		ctx      context.Context
+		finished int
+		elapsed  time.Duration
+		want     bool
+	}{
+		{"no deadline", context.Background(), 1, time.Hour, false},
+		{"nothing finished yet", ctx, 0, 0, false},
+		{"enough time left", ctx, 2, time.Minute, false},
+		{"not enough time left", ctx, 2, 3 * time.Minute, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deferUpdate(tt.ctx, tt.finished, tt.elapsed); got != tt.want {
+				t.Errorf("deferUpdate() returned %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveParallelism(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		timeout   time.Duration
+		remaining int
+		finished  int
+		elapsed   time.Duration
+		want      int
+	}{
+		{"no deadline", 0, 10, 1, time.Minute, 2},
+		{"nothing finished yet", time.Minute, 10, 0, 0, 2},
+		{"enough time left", time.Minute, 10, 1, time.Second, 2},
+		{"not enough time left", time.Minute, 10, 1, 20 * time.Second, 4},
+		{"capped", time.Minute, 100, 1, time.Minute, 8},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			if got := adaptiveParallelism(ctx, 2, tt.remaining, tt.finished, tt.elapsed); got != tt.want {
+				t.Errorf("adaptiveParallelism() returned %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricUpdateMinPointAge(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m, err := NewMetric(ctx, "metricname", mockSource, "sd-project", datastore.New(ctx, &datastore.Options{}))
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+	m.Options.MinPointAge = 5 * time.Minute
+
+	now := time.Now().Truncate(time.Second)
+	latest := now.Add(-time.Hour)
+	desc := &metricpb.MetricDescriptor{Type: "sd-metricname"}
+	ts := gaugeSeries(now.Add(-10*time.Minute), 8*time.Minute, 1, 2)
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	mockSource.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(desc, ts, nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", desc, gomock.Any()).DoAndReturn(
+		func(_ context.Context, _, _ string, _ *metricpb.MetricDescriptor, series []*monitoringpb.TimeSeries) error {
+			// Only the point that is older than min_point_age is written.
+			if _, values := seriesPoints(now, series); len(values) != 1 || values[0] != 1 {
+				t.Errorf("expected only the point with value 1 to be written; got %v", values)
+			}
+			return nil
+		})
+
+	collector, exporter := fakeStats(t)
+	err = m.Update(ctx, mockSD, collector)
+	collector.Close()
+	if err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	// The point that has been held back is newer than the written one.
+	val, ok := exporter.values["ts_bridge/import_lag:metricname"]
+	if !ok || val.(*view.LastValueData).Value != float64(8*time.Minute/time.Millisecond) {
+		t.Errorf("expected an import lag of 8 minutes; got %v", val)
+	}
+}
+
+// partialWriteError is returned by the mock adapter to simulate a write that failed part way.
+type partialWriteError struct{ written int }
+
+func (e *partialWriteError) Error() string      { return context.DeadlineExceeded.Error() }
+func (e *partialWriteError) Unwrap() error      { return context.DeadlineExceeded }
+func (e *partialWriteError) WrittenSeries() int { return e.written }
+
+func TestMetricUpdatePartialWrite(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m, err := NewMetric(ctx, "partial_metric", mockSource, "sd-project", datastore.New(ctx, &datastore.Options{}))
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+
+	latest := time.Now().Add(-time.Hour).Truncate(time.Second)
+	desc := &metricpb.MetricDescriptor{Type: "sd-metricname"}
+	// Points are returned out of order, and are written in time order.
+	ts := gaugeSeries(latest.Add(time.Minute), time.Minute, 1, 2, 3)
+	ts[0], ts[2] = ts[2], ts[0]
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil).Times(2)
+	mockSource.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(desc, ts, nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", desc, gomock.Any()).Return(&partialWriteError{2})
+
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+	err = m.Update(ctx, mockSD, collector)
+	if err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	resume := latest.Add(2 * time.Minute)
+	if got := m.Record.GetResumeTime(); !got.Equal(resume) {
+		t.Errorf("expected resume time %v to be persisted; got %v", resume, got)
+	}
+
+	if len(m.Record.GetPendingWrites()) == 0 {
+		t.Errorf("expected the point that was not written to be kept for the next update")
+	}
+
+	// The next update writes the point that was kept, resumes after it, and clears the resume time once it succeeds.
+	gomock.InOrder(
+		mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", gomock.Any(), gomock.Len(1)).Return(nil),
+		mockSource.EXPECT().StackdriverData(gomock.Any(), latest.Add(3*time.Minute).UTC(), gomock.Any()).Return(desc, nil, nil),
+	)
+	err = m.Update(ctx, mockSD, collector)
+	if err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	if got := m.Record.GetResumeTime(); !got.IsZero() {
+		t.Errorf("expected resume time to be cleared after a successful update; got %v", got)
+	}
+	if got := m.Record.GetPendingWrites(); len(got) != 0 {
+		t.Errorf("expected pending points to be cleared once they are written; got %d bytes", len(got))
+	}
+}
+
+func TestMetricUpdateSanitizesLabels(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m, err := NewMetric(ctx, "label_metric", mockSource, "sd-project", datastore.New(ctx, &datastore.Options{}))
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+	m.Options.LabelPolicy = LabelPolicyDrop
+
+	latest := time.Now().Add(-time.Hour).Truncate(time.Second)
+	desc := &metricpb.MetricDescriptor{Type: "sd-metricname"}
+	ts := gaugeSeries(latest.Add(time.Minute), time.Minute, 1)
+	ts[0].Metric.Labels = map[string]string{"env": "prod", "Host": "web-1"}
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	mockSource.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(desc, ts, nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", desc, gomock.Any()).DoAndReturn(
+		func(_ context.Context, _, _ string, _ *metricpb.MetricDescriptor, series []*monitoringpb.TimeSeries) error {
+			if got := series[0].Metric.Labels; !reflect.DeepEqual(got, map[string]string{"env": "prod"}) {
+				t.Errorf("expected the invalid label to be dropped; got %v", got)
+			}
+			return nil
+		})
+
+	collector, exporter := fakeStats(t)
+	err = m.Update(ctx, mockSD, collector)
+	collector.Close()
+	if err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	val, ok := exporter.values["ts_bridge/label_sanitizations:sd-project:label_metric:unknown"]
+	if !ok || val.(*view.SumData).Value != 1 {
+		t.Errorf("expected to see 1 label sanitization recorded; got %v", exporter.values)
+	}
+}
+
+func TestRecordWrite(t *testing.T) {
+	ctx := context.Background()
+	collector, exporter := fakeStats(t)
+	defer collector.Close()
+
+	collector.RecordWrite(ctx, "sd-project", 3, 1000, nil)
+	collector.RecordWrite(ctx, "sd-project", 1, 300, tserrors.Wrap(tserrors.ErrDestinationQuota, fmt.Errorf("slow down")))
+	collector.RecordWrite(ctx, "other-project", 1, 300, tserrors.Wrap(tserrors.ErrDestinationPermanent, fmt.Errorf("denied")))
+	view.Unregister(collector.views...)
+
+	for _, tt := range []struct {
+		stat string
+		want int64
+	}{
+		{"ts_bridge/sd_write_calls:sd-project", 2},
+		{"ts_bridge/sd_write_calls:other-project", 1},
+		{"ts_bridge/sd_write_quota_errors:sd-project", 1},
+	} {
+		val, ok := exporter.values[tt.stat]
+		if !ok {
+			t.Errorf("expected to see %s recorded; got %v", tt.stat, exporter.values)
+			continue
+		}
+		if got := val.(*view.CountData).Value; got != tt.want {
+			t.Errorf("expected %s to be %d; got %d", tt.stat, tt.want, got)
+		}
+	}
+	if _, ok := exporter.values["ts_bridge/sd_write_quota_errors:other-project"]; ok {
+		t.Errorf("expected no quota errors recorded for other-project")
+	}
+	if val, ok := exporter.values["ts_bridge/sd_write_points:sd-project"]; !ok || val.(*view.DistributionData).Sum() != 4 {
+		t.Errorf("expected 4 points recorded for sd-project; got %v", val)
+	}
+	if val, ok := exporter.values["ts_bridge/sd_write_request_bytes:sd-project"]; !ok || val.(*view.DistributionData).Sum() != 1300 {
+		t.Errorf("expected 1300 bytes recorded for sd-project; got %v", val)
 	}
 }
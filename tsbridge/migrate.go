@@ -0,0 +1,112 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to versions of the configuration file schema and migrations between them.
+package tsbridge
+
+import (
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configMigration upgrades a configuration file from one schema version to the next. It returns the upgraded
+// document along with a warning for each change, so that users know how to update their file.
+type configMigration func(doc yaml.MapSlice) (yaml.MapSlice, []string, error)
+
+// configMigrations[i] upgrades version i+1 to version i+2. Changes to the configuration format that would break
+// existing files are added here along with a new schema version, instead of rejecting older files.
+var configMigrations []configMigration
+
+// latestConfigVersion returns the schema version of configuration files written for this release. Files without a
+// `version` key were written before the schema was versioned, and have version 1.
+func latestConfigVersion() int {
+	return len(configMigrations) + 1
+}
+
+// migrateConfig upgrades a configuration file written for an older schema version to the latest version, returning
+// warnings of all changes. The file is returned unchanged if it already has the latest version, so that errors
+// reported while unmarshaling it refer to the right lines.
+func migrateConfig(data []byte) ([]byte, []string, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		// Syntax errors are reported while the file is unmarshaled strictly.
+		return data, nil, nil
+	}
+	version := 1
+	if v := yamlValue(doc, "version"); v != nil {
+		n, ok := v.(int)
+		if !ok || n < 1 {
+			return nil, nil, fmt.Errorf("invalid configuration file version '%v'", v)
+		}
+		version = n
+	}
+	latest := latestConfigVersion()
+	if version > latest {
+		return nil, nil, fmt.Errorf("configuration file version %d is newer than version %d supported by this release of ts-bridge", version, latest)
+	}
+	if version == latest {
+		return data, nil, nil
+	}
+
+	var warnings []string
+	for ; version < latest; version++ {
+		upgraded, changes, err := configMigrations[version-1](doc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot upgrade configuration file from version %d to %d: %v", version, version+1, err)
+		}
+		doc = upgraded
+		for _, c := range changes {
+			warnings = append(warnings, fmt.Sprintf("version %d to %d: %s", version, version+1, c))
+		}
+	}
+	if i := yamlIndex(doc, "version"); i >= 0 {
+		doc[i].Value = latest
+	} else {
+		doc = append(yaml.MapSlice{{Key: "version", Value: latest}}, doc...)
+	}
+	upgraded, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return upgraded, warnings, nil
+}
+
+// configSections returns the top level of a configuration file and the sections of all its tenants, so that
+// migrations can change metrics wherever they are defined.
+func configSections(doc yaml.MapSlice) []yaml.MapSlice {
+	sections := []yaml.MapSlice{doc}
+	tenants, _ := yamlValue(doc, "tenants").([]interface{})
+	for _, t := range tenants {
+		if section, ok := t.(yaml.MapSlice); ok {
+			sections = append(sections, section)
+		}
+	}
+	return sections
+}
+
+// renameKey renames a key of a YAML mapping in place, keeping its position. It returns false if the mapping does
+// not have the key, and fails if it has both keys.
+func renameKey(m yaml.MapSlice, from, to string) (bool, error) {
+	i := yamlIndex(m, from)
+	if i < 0 {
+		return false, nil
+	}
+	if yamlIndex(m, to) >= 0 {
+		return false, fmt.Errorf("'%s' has been renamed to '%s', and cannot be set along with it", from, to)
+	}
+	m[i].Key = to
+	return true, nil
+}
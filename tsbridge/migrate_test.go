@@ -0,0 +1,103 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestMigrateConfig(t *testing.T) {
+	defer func(m []configMigration) { configMigrations = m }(configMigrations)
+	// Version 2 renames `dd_metrics` to `datadog_metrics` in all sections.
+	configMigrations = []configMigration{func(doc yaml.MapSlice) (yaml.MapSlice, []string, error) {
+		var warnings []string
+		for _, section := range configSections(doc) {
+			renamed, err := renameKey(section, "dd_metrics", "datadog_metrics")
+			if err != nil {
+				return nil, nil, err
+			}
+			if renamed {
+				warnings = append(warnings, "'dd_metrics' has been renamed to 'datadog_metrics'")
+			}
+		}
+		return doc, warnings, nil
+	}}
+
+	data := []byte(`dd_metrics:
+  - name: foo
+tenants:
+  - name: team_a
+    dd_metrics:
+      - name: bar
+`)
+	migrated, warnings, err := migrateConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `version: 2
+datadog_metrics:
+- name: foo
+tenants:
+- name: team_a
+  datadog_metrics:
+  - name: bar
+`
+	if string(migrated) != want {
+		t.Errorf("expected migrated configuration:\n%s\ngot:\n%s", want, migrated)
+	}
+	wantWarnings := []string{
+		"version 1 to 2: 'dd_metrics' has been renamed to 'datadog_metrics'",
+		"version 1 to 2: 'dd_metrics' has been renamed to 'datadog_metrics'",
+	}
+	if !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Errorf("expected warnings %v; got %v", wantWarnings, warnings)
+	}
+
+	current := []byte("version: 2\ndatadog_metrics: []\n")
+	if migrated, warnings, err := migrateConfig(current); err != nil || string(migrated) != string(current) || warnings != nil {
+		t.Errorf("expected files of the latest version to be unchanged; got %q, %v, %v", migrated, warnings, err)
+	}
+
+	if _, _, err := migrateConfig([]byte("version: 1\ndatadog_metrics: []\ndd_metrics: []\n")); err == nil || !strings.Contains(err.Error(), "cannot upgrade configuration file from version 1 to 2: 'dd_metrics' has been renamed") {
+		t.Errorf("expected an error for conflicting keys; got %v", err)
+	}
+}
+
+func TestMigrateConfigVersions(t *testing.T) {
+	for _, tt := range []struct {
+		data    string
+		wantErr string
+	}{
+		{"datadog_metrics: []\n", ""},
+		{"version: 1\n", ""},
+		{"version: 2\n", "configuration file version 2 is newer than version 1"},
+		{"version: 0\n", "invalid configuration file version '0'"},
+		{"version: latest\n", "invalid configuration file version 'latest'"},
+		{"version: [\n", ""},
+	} {
+		migrated, warnings, err := migrateConfig([]byte(tt.data))
+		if tt.wantErr == "" {
+			if err != nil || string(migrated) != tt.data || warnings != nil {
+				t.Errorf("expected %q to be unchanged; got %q, %v, %v", tt.data, migrated, warnings, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("expected error '%s' for %q; got %v", tt.wantErr, tt.data, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to notifying downstream systems of points imported by a metric update.
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/ts-bridge/notify"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// importedPoints tracks the number and time range of points written to Stackdriver during a metric update.
+type importedPoints struct {
+	points         int
+	oldest, newest time.Time
+	// budgeted is the number of points written during the update (as counted by its usage counter) that have been
+	// counted towards budgets.
+	budgeted int64
+}
+
+// add tracks points of time series that have been written.
+func (p *importedPoints) add(ts []*monitoringpb.TimeSeries) {
+	for _, t := range ts {
+		for _, point := range t.Points {
+			end, err := ptypes.Timestamp(point.GetInterval().GetEndTime())
+			if err != nil {
+				continue
+			}
+			p.points++
+			if p.oldest.IsZero() || end.Before(p.oldest) {
+				p.oldest = end
+			}
+			p.newest = later(p.newest, end)
+		}
+	}
+}
+
+// notifyImport notifies the import notification channels of the metric after an update that has written new
+// points. Notifications are not retried, since the points have been written already; failures are only logged.
+func (m *Metric) notifyImport(ctx context.Context, p *importedPoints) {
+	if len(m.Options.ImportNotifications) == 0 || p.points == 0 {
+		return
+	}
+	n := &notify.ImportNotification{
+		Metric:       m.Name,
+		Points:       p.points,
+		MinTimestamp: p.oldest,
+		MaxTimestamp: p.newest,
+		Text:         fmt.Sprintf("%s: imported %d new points between %v and %v", m.Name, p.points, p.oldest, p.newest),
+	}
+	for _, channel := range m.Options.ImportNotifications {
+		if err := m.Notifiers[channel].NotifyImport(ctx, n); err != nil {
+			log.WithContext(ctx).Warningf("%s: cannot send import notification to channel %s: %v", m.Name, channel, err)
+		}
+	}
+}
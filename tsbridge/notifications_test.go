@@ -0,0 +1,63 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestImportedPoints(t *testing.T) {
+	start := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	p := &importedPoints{}
+	p.add(gaugeSeries(start.Add(time.Minute), time.Minute, 1, 2, 3))
+	p.add(gaugeSeries(start, time.Minute, 4))
+	if p.points != 4 || !p.oldest.Equal(start) || !p.newest.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("unexpected imported points %+v", p)
+	}
+}
+
+func TestNotifyImport(t *testing.T) {
+	ctx := context.Background()
+	m, n := thresholdMetric(t, ctx, "metric")
+	start := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	p := &importedPoints{}
+	p.add(gaugeSeries(start, time.Minute, 1, 2))
+
+	// Metrics without import notifications don't notify channels.
+	m.notifyImport(ctx, p)
+	if len(n.imports) != 0 {
+		t.Errorf("expected no import notifications; got %v", n.imports)
+	}
+
+	m.Options.ImportNotifications = []string{"oncall"}
+	m.notifyImport(ctx, &importedPoints{})
+	m.notifyImport(ctx, p)
+	if len(n.imports) != 1 {
+		t.Fatalf("expected a single import notification for new points; got %v", n.imports)
+	}
+	if got := n.imports[0]; got.Metric != "metric" || got.Points != 2 || !got.MinTimestamp.Equal(start) || !got.MaxTimestamp.Equal(start.Add(time.Minute)) {
+		t.Errorf("unexpected import notification %+v", got)
+	}
+
+	// Failed notifications are not retried.
+	n.err = errors.New("webhook down")
+	m.notifyImport(ctx, p)
+	if len(n.imports) != 1 {
+		t.Errorf("expected failed notification not to be recorded; got %v", n.imports)
+	}
+}
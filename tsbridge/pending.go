@@ -0,0 +1,199 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to keeping points that could not be written to Stackdriver for the next update.
+package tsbridge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+const (
+	// maxPendingBytes limits the size of encoded pending points kept per metric record, which needs to stay well
+	// below the 1MB limit of Datastore entities.
+	maxPendingBytes = 512 << 10
+	// pendingTTL is how long pending points are kept. It's shorter than sdMaxPointAge, since older points would be
+	// rejected by Stackdriver anyway.
+	pendingTTL = sdMaxPointAge - time.Hour
+)
+
+// pendingWrite is the encoded form of points that are kept in the metric record after a failed write.
+type pendingWrite struct {
+	Descriptor []byte
+	TimeSeries [][]byte
+}
+
+// queueWrite keeps points of a failed write in the metric record, so that they are retried by the next update rather
+// than being lost if the source cannot return them again. Points that have been written by a partial write are
+// skipped, and nothing is kept if Stackdriver rejected the points permanently. It returns the number of queued points.
+func (m *Metric) queueWrite(ctx context.Context, s *StatsCollector, desc *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries, err error) (int, error) {
+	if errors.Is(err, tserrors.ErrDestinationPermanent) {
+		return 0, nil
+	}
+	var pw partialWriter
+	if errors.As(err, &pw) && pw.WrittenSeries() > 0 && pw.WrittenSeries() <= len(ts) {
+		ts = ts[pw.WrittenSeries():]
+	}
+	data, n, err := encodePending(desc, ts)
+	if err != nil {
+		return 0, err
+	}
+	if n < len(ts) {
+		log.WithContext(ctx).Warningf("%s: only %d of %d points that could not be written are kept for the next update", m.Name, n, len(ts))
+	}
+	if err := m.Record.SetPendingWrites(ctx, data); err != nil {
+		return 0, err
+	}
+	stats.Record(ctx, s.PendingPoints.M(int64(n)))
+	return n, nil
+}
+
+// writePending writes points kept by a previous update that failed to write them, before any new points are
+// imported. It returns the number of points written, and the timestamp of the newest point in Stackdriver, so that
+// the source is only queried for later points. Pending points are dropped once they are written, expire or are
+// rejected permanently by Stackdriver.
+func (m *Metric) writePending(ctx context.Context, sd StackdriverAdapter, s *StatsCollector, imported *importedPoints, latest time.Time) (int, time.Time, error) {
+	data := m.Record.GetPendingWrites()
+	if len(data) == 0 {
+		return 0, latest, nil
+	}
+	desc, ts, err := decodePending(data)
+	if err != nil {
+		log.WithContext(ctx).Warningf("%s: dropping pending points that cannot be decoded: %v", m.Name, err)
+		return 0, latest, m.clearPending(ctx, s)
+	}
+	// Points that are already in Stackdriver or too old to be written are dropped.
+	expiry := time.Now().Add(-pendingTTL)
+	var keep []*monitoringpb.TimeSeries
+	for _, t := range ts {
+		if end := seriesEnd(t); end.After(latest) && end.After(expiry) {
+			keep = append(keep, t)
+		}
+	}
+	if dropped := len(ts) - len(keep); dropped > 0 {
+		log.WithContext(ctx).Warningf("%s: dropping %d pending points that are expired or have been written", m.Name, dropped)
+	}
+	if len(keep) == 0 {
+		return 0, latest, m.clearPending(ctx, s)
+	}
+
+	if err := m.checkWriteBudget(ctx, imported, time.Now()); err != nil {
+		return 0, latest, err
+	}
+	log.WithContext(ctx).Infof("%s: writing %d points kept by the previous update", m.Name, len(keep))
+	start := time.Now()
+	err = sd.CreateTimeseries(ctx, m.SDProject, m.Source.StackdriverName(), desc, keep)
+	recordLatency(ctx, s.WriteLatency, start)
+	if err != nil {
+		if errors.Is(err, tserrors.ErrDestinationPermanent) {
+			if cerr := m.clearPending(ctx, s); cerr != nil {
+				return 0, latest, cerr
+			}
+			return 0, latest, fmt.Errorf("failed to write pending points to Stackdriver, dropping them: %w", err)
+		}
+		if _, qerr := m.queueWrite(ctx, s, desc, keep, err); qerr != nil {
+			return 0, latest, qerr
+		}
+		return 0, latest, fmt.Errorf("failed to write pending points to Stackdriver: %w", err)
+	}
+	imported.add(keep)
+	m.federate(desc, keep)
+	m.afterWrite(ctx, desc, keep)
+	if err := m.clearPending(ctx, s); err != nil {
+		return 0, latest, err
+	}
+	// All points up to the newest pending point are in Stackdriver now, so the resume time is no longer needed.
+	if !m.Record.GetResumeTime().IsZero() {
+		if err := m.Record.SetResumeTime(ctx, time.Time{}); err != nil {
+			return 0, latest, err
+		}
+	}
+	return len(keep), later(latest, newestPoint(keep)), nil
+}
+
+// clearPending removes pending points from the metric record.
+func (m *Metric) clearPending(ctx context.Context, s *StatsCollector) error {
+	stats.Record(ctx, s.PendingPoints.M(0))
+	return m.Record.SetPendingWrites(ctx, nil)
+}
+
+// encodePending encodes a metric descriptor and time-ordered time series, skipping the newest ones if they don't
+// fit in maxPendingBytes. Encoded points are compressed, since time series of a metric share most of their labels.
+// It returns the encoded points and the number of time series that have been kept.
+func encodePending(desc *metricpb.MetricDescriptor, ts []*monitoringpb.TimeSeries) ([]byte, int, error) {
+	var p pendingWrite
+	var err error
+	if p.Descriptor, err = proto.Marshal(desc); err != nil {
+		return nil, 0, fmt.Errorf("cannot encode metric descriptor: %v", err)
+	}
+	size := len(p.Descriptor)
+	for _, t := range ts {
+		b, err := proto.Marshal(t)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot encode time series: %v", err)
+		}
+		if size += len(b); size > maxPendingBytes {
+			break
+		}
+		p.TimeSeries = append(p.TimeSeries, b)
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(zw).Encode(&p); err != nil {
+		return nil, 0, fmt.Errorf("cannot encode pending points: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, 0, fmt.Errorf("cannot compress pending points: %v", err)
+	}
+	return buf.Bytes(), len(p.TimeSeries), nil
+}
+
+// decodePending decodes points encoded by encodePending.
+func decodePending(data []byte) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	var p pendingWrite
+	if err := gob.NewDecoder(zr).Decode(&p); err != nil {
+		return nil, nil, err
+	}
+	desc := &metricpb.MetricDescriptor{}
+	if err := proto.Unmarshal(p.Descriptor, desc); err != nil {
+		return nil, nil, err
+	}
+	ts := make([]*monitoringpb.TimeSeries, len(p.TimeSeries))
+	for i, b := range p.TimeSeries {
+		ts[i] = &monitoringpb.TimeSeries{}
+		if err := proto.Unmarshal(b, ts[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return desc, ts, nil
+}
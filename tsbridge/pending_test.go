@@ -0,0 +1,172 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/datastore"
+	"github.com/google/ts-bridge/mocks"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/proto"
+	"go.opencensus.io/stats/view"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+func TestEncodePending(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	desc := &metricpb.MetricDescriptor{Type: "custom.googleapis.com/test", MetricKind: metricpb.MetricDescriptor_GAUGE}
+	ts := gaugeSeries(start, time.Minute, 1, 2, 3)
+	data, n, err := encodePending(desc, ts)
+	if err != nil || n != 3 {
+		t.Fatalf("encodePending() returned %d, %v; want 3 time series", n, err)
+	}
+	gotDesc, gotTS, err := decodePending(data)
+	if err != nil {
+		t.Fatalf("decodePending() returned error: %v", err)
+	}
+	if !proto.Equal(gotDesc, desc) {
+		t.Errorf("decodePending() returned descriptor %v; want %v", gotDesc, desc)
+	}
+	if len(gotTS) != len(ts) {
+		t.Fatalf("decodePending() returned %d time series; want %d", len(gotTS), len(ts))
+	}
+	for i := range ts {
+		if !proto.Equal(gotTS[i], ts[i]) {
+			t.Errorf("decodePending() returned time series %v; want %v", gotTS[i], ts[i])
+		}
+	}
+
+	// The newest time series are dropped if they don't fit.
+	values := make([]float64, maxPendingBytes/10)
+	if _, n, err = encodePending(desc, gaugeSeries(start, time.Second, values...)); err != nil || n == 0 || n >= len(values) {
+		t.Errorf("expected encodePending() to keep some of %d time series; got %d, %v", len(values), n, err)
+	}
+}
+
+func TestMetricUpdatePendingWrites(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m, err := NewMetric(ctx, "pending_metric", mockSource, "sd-project", datastore.New(ctx, &datastore.Options{}))
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+
+	latest := time.Now().Add(-time.Hour).Truncate(time.Second)
+	desc := &metricpb.MetricDescriptor{Type: "sd-metricname"}
+	ts := gaugeSeries(latest.Add(time.Minute), time.Minute, 1, 2)
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil).Times(3)
+	writeErr := tserrors.Wrap(tserrors.ErrDestinationTransient, errors.New("unavailable"))
+	collector, exporter := fakeStats(t)
+
+	// Points of a failed write are kept.
+	gomock.InOrder(
+		mockSource.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(desc, ts, nil),
+		mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", desc, gomock.Len(2)).Return(writeErr),
+	)
+	if err := m.Update(ctx, mockSD, collector); err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	if len(m.Record.GetPendingWrites()) == 0 || !strings.Contains(m.Record.GetLastStatus(), "2 points have been kept") {
+		t.Fatalf("expected points to be kept after a failed write; got status %q", m.Record.GetLastStatus())
+	}
+
+	// The next update retries them first, without querying the source if the write fails again.
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", gomock.Any(), gomock.Len(2)).Return(writeErr)
+	if err := m.Update(ctx, mockSD, collector); err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	if len(m.Record.GetPendingWrites()) == 0 {
+		t.Fatalf("expected points to be kept after a failed retry")
+	}
+
+	// Once written, the source is queried after the newest point that was kept.
+	gomock.InOrder(
+		mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", gomock.Any(), gomock.Len(2)).Return(nil),
+		mockSource.EXPECT().StackdriverData(gomock.Any(), latest.Add(2*time.Minute).UTC(), gomock.Any()).Return(desc, nil, nil),
+	)
+	if err := m.Update(ctx, mockSD, collector); err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	if got := m.Record.GetPendingWrites(); len(got) != 0 {
+		t.Errorf("expected pending points to be cleared once they are written; got %d bytes", len(got))
+	}
+	collector.Close()
+	if val, ok := exporter.values["ts_bridge/pending_points:pending_metric"]; !ok || val.(*view.LastValueData).Value != 0 {
+		t.Errorf("expected no pending points to be reported; got %v", val)
+	}
+}
+
+func TestMetricUpdatePendingWritesDropped(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m, err := NewMetric(ctx, "dropped_metric", mockSource, "sd-project", datastore.New(ctx, &datastore.Options{}))
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+
+	latest := time.Now().Add(-2 * sdMaxPointAge)
+	desc := &metricpb.MetricDescriptor{Type: "sd-metricname"}
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil).Times(2)
+
+	// Points rejected permanently are not kept.
+	gomock.InOrder(
+		mockSource.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(desc, gaugeSeries(time.Now().Add(-time.Hour), time.Minute, 1), nil),
+		mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", desc, gomock.Any()).Return(
+			tserrors.Wrap(tserrors.ErrDestinationPermanent, errors.New("invalid argument"))),
+	)
+	if err := m.Update(ctx, mockSD, collector); err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	if got := m.Record.GetPendingWrites(); len(got) != 0 {
+		t.Errorf("expected points rejected permanently not to be kept; got %d bytes", len(got))
+	}
+
+	// Expired points are dropped without being written.
+	data, _, err := encodePending(desc, gaugeSeries(time.Now().Add(-sdMaxPointAge), time.Minute, 1))
+	if err != nil {
+		t.Fatalf("encodePending() returned error: %v", err)
+	}
+	if err := m.Record.SetPendingWrites(ctx, data); err != nil {
+		t.Fatalf("SetPendingWrites() returned error: %v", err)
+	}
+	mockSource.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(desc, nil, nil)
+	if err := m.Update(ctx, mockSD, collector); err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	if got := m.Record.GetPendingWrites(); len(got) != 0 {
+		t.Errorf("expected expired points to be dropped; got %d bytes", len(got))
+	}
+}
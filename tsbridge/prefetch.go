@@ -0,0 +1,76 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to looking up latest timestamps of many metrics at once before updating them.
+package tsbridge
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// latestTimestampBatcher is implemented by Stackdriver adapters that can look up latest timestamps of many metrics
+// with fewer queries than LatestTimestamp would need.
+type latestTimestampBatcher interface {
+	LatestTimestamps(ctx context.Context, project string, names []string) (map[string]time.Time, error)
+}
+
+// prefetchedAdapter serves LatestTimestamp from timestamps that have been looked up before metric updates started.
+// Other calls, and lookups of timestamps that have not been prefetched, are passed to the wrapped adapter.
+type prefetchedAdapter struct {
+	StackdriverAdapter
+	latest map[string]map[string]time.Time // project -> metric type -> timestamp
+}
+
+// LatestTimestamp returns the prefetched latest timestamp of a metric if it's known.
+func (a *prefetchedAdapter) LatestTimestamp(ctx context.Context, project, name string) (time.Time, error) {
+	if ts, ok := a.latest[project][name]; ok {
+		return ts, nil
+	}
+	return a.StackdriverAdapter.LatestTimestamp(ctx, project, name)
+}
+
+// prefetchLatestTimestamps looks up latest timestamps of all metrics in batches if the adapter supports it, and
+// returns an adapter that serves them. Failed lookups are only logged, since each metric falls back to looking up
+// its latest timestamp during its own update.
+func prefetchLatestTimestamps(ctx context.Context, sd StackdriverAdapter, metrics []*Metric) StackdriverAdapter {
+	batcher, ok := sd.(latestTimestampBatcher)
+	if !ok || len(metrics) < 2 {
+		return sd
+	}
+	names := make(map[string][]string)
+	for _, m := range metrics {
+		names[m.SDProject] = append(names[m.SDProject], m.Source.StackdriverName())
+	}
+	projects := make([]string, 0, len(names))
+	for project := range names {
+		projects = append(projects, project)
+	}
+	sort.Strings(projects)
+
+	a := &prefetchedAdapter{StackdriverAdapter: sd, latest: make(map[string]map[string]time.Time)}
+	for _, project := range projects {
+		latest, err := batcher.LatestTimestamps(ctx, project, names[project])
+		if err != nil {
+			log.WithContext(ctx).Warningf("Could not look up latest timestamps of metrics in project %s, looking them up one by one: %v", project, err)
+			continue
+		}
+		a.latest[project] = latest
+	}
+	return a
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/mocks"
+
+	"github.com/golang/mock/gomock"
+)
+
+// batchingAdapter adds batched latest timestamp lookups to a mock adapter.
+type batchingAdapter struct {
+	*mocks.MockStackdriverAdapter
+	latest map[string]time.Time
+	err    error
+	calls  int
+}
+
+func (a *batchingAdapter) LatestTimestamps(_ context.Context, _ string, names []string) (map[string]time.Time, error) {
+	a.calls++
+	if a.err != nil {
+		return nil, a.err
+	}
+	result := make(map[string]time.Time)
+	for _, name := range names {
+		if ts, ok := a.latest[name]; ok {
+			result[name] = ts
+		}
+	}
+	return result, nil
+}
+
+func TestPrefetchLatestTimestamps(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	var metrics []*Metric
+	for _, name := range []string{"one", "two"} {
+		src := mocks.NewMockSourceMetric(mockCtrl)
+		src.EXPECT().StackdriverName().AnyTimes().Return(name)
+		metrics = append(metrics, &Metric{Name: name, Source: src, SDProject: "sd-project"})
+	}
+	latest := time.Now().Add(-time.Minute)
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	batcher := &batchingAdapter{MockStackdriverAdapter: mockSD, latest: map[string]time.Time{"one": latest}}
+
+	sd := prefetchLatestTimestamps(ctx, batcher, metrics)
+	if batcher.calls != 1 {
+		t.Errorf("expected a single batched lookup; got %d", batcher.calls)
+	}
+	if got, err := sd.LatestTimestamp(ctx, "sd-project", "one"); err != nil || !got.Equal(latest) {
+		t.Errorf("expected prefetched timestamp %v; got %v, %v", latest, got, err)
+	}
+	// Metrics left out of the batched lookup are looked up by the wrapped adapter.
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "two").Return(latest.Add(time.Second), nil)
+	if got, err := sd.LatestTimestamp(ctx, "sd-project", "two"); err != nil || !got.Equal(latest.Add(time.Second)) {
+		t.Errorf("expected timestamp from the wrapped adapter; got %v, %v", got, err)
+	}
+
+	// Failed batched lookups fall back to the wrapped adapter.
+	batcher.err = errors.New("quota exceeded")
+	sd = prefetchLatestTimestamps(ctx, batcher, metrics)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "one").Return(latest, nil)
+	if got, err := sd.LatestTimestamp(ctx, "sd-project", "one"); err != nil || !got.Equal(latest) {
+		t.Errorf("expected timestamp from the wrapped adapter; got %v, %v", got, err)
+	}
+
+	// Adapters that don't support batched lookups are used as they are.
+	if got := prefetchLatestTimestamps(ctx, mockSD, metrics); got != mockSD {
+		t.Errorf("expected adapter without batched lookups to be returned unchanged; got %v", got)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to ratio metrics, which combine points queried from two sources.
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/ts-bridge/datadog"
+	"github.com/google/ts-bridge/influxdb"
+	"github.com/google/ts-bridge/storage"
+
+	"github.com/golang/protobuf/ptypes"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// RatioMetricConfig defines a metric computed as a percentage ratio between points of two source queries, which can
+// come from different monitoring systems.
+type RatioMetricConfig struct {
+	SourceMetricConfig `yaml:"_,inline"`
+
+	Numerator   RatioOperandConfig
+	Denominator RatioOperandConfig
+	// Tolerance is the maximum difference between timestamps of numerator and denominator points that are
+	// combined. By default, timestamps need to be equal.
+	Tolerance time.Duration `validate:"min=0"`
+}
+
+// RatioOperandConfig defines the source query of a numerator or a denominator. Exactly one source must be set.
+type RatioOperandConfig struct {
+	Datadog  *datadog.MetricConfig  `yaml:"datadog"`
+	InfluxDB *influxdb.MetricConfig `yaml:"influxdb"`
+}
+
+// readSecretFiles reads secrets of the configured source from files.
+func (o *RatioOperandConfig) readSecretFiles(dir string) error {
+	if o.Datadog != nil {
+		return o.Datadog.ReadSecretFiles(dir)
+	}
+	if o.InfluxDB != nil {
+		return o.InfluxDB.ReadSecretFiles(dir)
+	}
+	return nil
+}
+
+// newSourceMetric creates a source metric for the configured source.
+func (o *RatioOperandConfig) newSourceMetric(name string, opts *ConfigOptions) (SourceMetric, error) {
+	switch {
+	case o.Datadog != nil && o.InfluxDB != nil:
+		return nil, fmt.Errorf("only one source can be set")
+	case o.Datadog != nil:
+		if o.Datadog.Cumulative {
+			return nil, fmt.Errorf("cumulative queries are not supported")
+		}
+		return datadog.NewSourceMetric(name, o.Datadog, opts.MinPointAge, opts.CounterResetInterval)
+	case o.InfluxDB != nil:
+		if o.InfluxDB.Cumulative {
+			return nil, fmt.Errorf("cumulative queries are not supported")
+		}
+		return influxdb.NewSourceMetric(name, o.InfluxDB, opts.MinPointAge, opts.CounterResetInterval)
+	}
+	return nil, fmt.Errorf("a source (datadog or influxdb) must be set")
+}
+
+// RatioMetric is a source metric that divides points of the numerator by points of the denominator that have the
+// closest timestamp within the tolerance, writing the result as a percentage.
+type RatioMetric struct {
+	Name        string
+	Numerator   SourceMetric
+	Denominator SourceMetric
+	Tolerance   time.Duration
+}
+
+// NewRatioMetric creates a ratio metric from its configuration.
+func NewRatioMetric(name string, config *RatioMetricConfig, opts *ConfigOptions) (*RatioMetric, error) {
+	numerator, err := config.Numerator.newSourceMetric(name+"_numerator", opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid numerator: %v", err)
+	}
+	denominator, err := config.Denominator.newSourceMetric(name+"_denominator", opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid denominator: %v", err)
+	}
+	return &RatioMetric{Name: name, Numerator: numerator, Denominator: denominator, Tolerance: config.Tolerance}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric type of the ratio metric.
+func (r *RatioMetric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/ratio/%s", r.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (r *RatioMetric) SourceType() string {
+	return "ratio"
+}
+
+// Query returns both queries the metric is computed from.
+func (r *RatioMetric) Query() string {
+	return fmt.Sprintf("(%s) / (%s)", r.Numerator.Query(), r.Denominator.Query())
+}
+
+// StackdriverData queries both sources, returning a metric descriptor and time series with ratio points for each
+// numerator point that has a matching denominator point. Numerator points without a match are left for the next
+// update, since the denominator source might not have caught up yet.
+func (r *RatioMetric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	_, numSeries, err := r.Numerator.StackdriverData(ctx, lastPoint, rec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot query numerator: %w", err)
+	}
+	// The denominator is queried from slightly earlier, so that the first numerator points can be matched.
+	_, denSeries, err := r.Denominator.StackdriverData(ctx, lastPoint.Add(-r.Tolerance), rec)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot query denominator: %w", err)
+	}
+	numerator, err := ratioOperandPoints(numSeries)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid numerator: %v", err)
+	}
+	denominator, err := ratioOperandPoints(denSeries)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid denominator: %v", err)
+	}
+
+	var ts []*monitoringpb.TimeSeries
+	for _, p := range numerator {
+		d, ok := closestPoint(denominator, p.end, r.Tolerance)
+		if !ok || d.value == 0 {
+			continue
+		}
+		end, err := ptypes.TimestampProto(p.end)
+		if err != nil {
+			return nil, nil, err
+		}
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: r.StackdriverName()},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: end},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: 100 * p.value / d.value}},
+			}},
+		})
+	}
+	return r.descriptor(), ts, nil
+}
+
+// descriptor returns the metric descriptor of the ratio metric.
+func (r *RatioMetric) descriptor() *metricpb.MetricDescriptor {
+	return &metricpb.MetricDescriptor{
+		Type:        r.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Unit:        "%",
+		Description: fmt.Sprintf("Ratio: %s", r.Query()),
+		DisplayName: r.Name,
+	}
+}
+
+// valuePoint is the timestamp and numeric value of a single point.
+type valuePoint struct {
+	end   time.Time
+	value float64
+}
+
+// ratioOperandPoints returns points of a ratio operand, sorted by time. Since labels of two different sources
+// cannot be matched, operands must return a single time series.
+func ratioOperandPoints(series []*monitoringpb.TimeSeries) ([]valuePoint, error) {
+	var points []valuePoint
+	var labels map[string]string
+	for i, ts := range series {
+		if i > 0 && fmt.Sprint(ts.GetMetric().GetLabels()) != fmt.Sprint(labels) {
+			return nil, fmt.Errorf("query returned several time series; only a single time series is supported")
+		}
+		labels = ts.GetMetric().GetLabels()
+		for _, p := range ts.Points {
+			end, err := ptypes.Timestamp(p.GetInterval().GetEndTime())
+			if err != nil {
+				return nil, fmt.Errorf("could not parse point timestamp for %v: %v", p, err)
+			}
+			points = append(points, valuePoint{end: end, value: pointValue(p)})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].end.Before(points[j].end) })
+	return points, nil
+}
+
+// closestPoint returns the point of a sorted slice with the timestamp closest to `t`, if it's within `tolerance`.
+func closestPoint(points []valuePoint, t time.Time, tolerance time.Duration) (valuePoint, bool) {
+	i := sort.Search(len(points), func(i int) bool { return !points[i].end.Before(t) })
+	var best valuePoint
+	found := false
+	for _, j := range []int{i - 1, i} {
+		if j < 0 || j >= len(points) {
+			continue
+		}
+		d := absDuration(points[j].end.Sub(t))
+		if d <= tolerance && (!found || d < absDuration(best.end.Sub(t))) {
+			best, found = points[j], true
+		}
+	}
+	return best, found
+}
+
+// absDuration returns the absolute value of a duration.
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/mocks"
+
+	"github.com/golang/mock/gomock"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+func TestRatioMetricStackdriverData(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now().Add(-time.Hour).Truncate(time.Minute)
+	latest := start.Add(-time.Minute)
+
+	for _, tt := range []struct {
+		name        string
+		tolerance   time.Duration
+		denStart    time.Time
+		denValues   []float64
+		wantOffsets []time.Duration
+		wantValues  []float64
+	}{
+		{"equal timestamps", 0, start, []float64{100, 200, 400},
+			[]time.Duration{0, time.Minute, 2 * time.Minute}, []float64{1, 1, 0.75}},
+		{"within tolerance", 10 * time.Second, start.Add(5 * time.Second), []float64{100, 200, 400},
+			[]time.Duration{0, time.Minute, 2 * time.Minute}, []float64{1, 1, 0.75}},
+		{"outside tolerance", 0, start.Add(5 * time.Second), []float64{100, 200, 400}, nil, nil},
+		{"denominator lagging", 0, start, []float64{100, 200},
+			[]time.Duration{0, time.Minute}, []float64{1, 1}},
+		{"zero denominator", 0, start, []float64{100, 0, 400},
+			[]time.Duration{0, 2 * time.Minute}, []float64{1, 0.75}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			num := mocks.NewMockSourceMetric(mockCtrl)
+			num.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(nil, gaugeSeries(start, time.Minute, 1, 2, 3), nil)
+			den := mocks.NewMockSourceMetric(mockCtrl)
+			den.EXPECT().StackdriverData(gomock.Any(), latest.Add(-tt.tolerance), gomock.Any()).Return(nil, gaugeSeries(tt.denStart, time.Minute, tt.denValues...), nil)
+			num.EXPECT().Query().AnyTimes().Return("errors")
+			den.EXPECT().Query().AnyTimes().Return("requests")
+
+			r := &RatioMetric{Name: "error_rate", Numerator: num, Denominator: den, Tolerance: tt.tolerance}
+			desc, ts, err := r.StackdriverData(ctx, latest, nil)
+			if err != nil {
+				t.Fatalf("StackdriverData() returned error: %v", err)
+			}
+			if desc.Unit != "%" || desc.ValueType != metricpb.MetricDescriptor_DOUBLE || desc.Type != "custom.googleapis.com/ratio/error_rate" {
+				t.Errorf("unexpected descriptor %v", desc)
+			}
+			offsets, values := seriesPoints(start, ts)
+			if !reflect.DeepEqual(offsets, tt.wantOffsets) {
+				t.Errorf("expected points at %v; got %v", tt.wantOffsets, offsets)
+			}
+			if !reflect.DeepEqual(values, tt.wantValues) {
+				t.Errorf("expected values %v; got %v", tt.wantValues, values)
+			}
+		})
+	}
+}
+
+func TestRatioMetricSeveralSeries(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	start := time.Now().Add(-time.Hour)
+	series := gaugeSeries(start, time.Minute, 1, 2)
+	series[1].Metric = &metricpb.Metric{Type: "custom.googleapis.com/test", Labels: map[string]string{"host": "b"}}
+	num := mocks.NewMockSourceMetric(mockCtrl)
+	num.EXPECT().StackdriverData(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, series, nil)
+	den := mocks.NewMockSourceMetric(mockCtrl)
+	den.EXPECT().StackdriverData(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, gaugeSeries(start, time.Minute, 1, 2), nil)
+
+	r := &RatioMetric{Name: "error_rate", Numerator: num, Denominator: den}
+	_, _, err := r.StackdriverData(ctx, start.Add(-time.Minute), nil)
+	if err == nil || !strings.Contains(err.Error(), "invalid numerator: query returned several time series") {
+		t.Errorf("expected StackdriverData() to reject several numerator time series; got %v", err)
+	}
+}
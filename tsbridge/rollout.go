@@ -0,0 +1,196 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has the canary rollout of new versions of the configuration file.
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// States of a configuration rollout.
+const (
+	// RolloutCanary applies the new configuration to canary metrics only, while other metrics keep the current one.
+	RolloutCanary = "canary"
+	// RolloutPromoted applies the new configuration to all metrics, once canary metrics have been updated for enough
+	// syncs without failing more often than other metrics.
+	RolloutPromoted = "promoted"
+	// RolloutRolledBack applies the current configuration to all metrics, after canary metrics failed more often
+	// than other metrics. A rolled back version is not attempted again; a changed file starts a new rollout.
+	RolloutRolledBack = "rolled-back"
+)
+
+// Rollout rolls out a new version of the configuration file (the canary configuration) gradually: it's first applied
+// to a subset of metrics for a number of syncs, and then promoted to all metrics, unless the failure rate of canary
+// metrics is higher than that of other metrics by more than a given margin, in which case it's rolled back. Canary
+// metrics are those tagged with `canary: true` in the canary configuration or, if none are tagged, a percentage of
+// metrics selected by name. A Rollout is safe for concurrent use and is meant to be shared across syncs; its state is
+// kept in memory, so a restarted process starts the rollout from the beginning.
+type Rollout struct {
+	percent            int
+	cycles             int
+	maxFailureIncrease float64
+
+	mu      sync.Mutex
+	version string
+	state   string
+	synced  int             // number of syncs that updated canary metrics so far.
+	canary  map[string]bool // names of canary metrics of the current version.
+}
+
+// NewRollout returns a Rollout applying canary configurations to `percent` of metrics for `cycles` syncs, rolling
+// them back if their failure rate exceeds that of other metrics by more than `maxFailureIncrease` (between 0 and 1).
+func NewRollout(percent, cycles int, maxFailureIncrease float64) *Rollout {
+	return &Rollout{percent: percent, cycles: cycles, maxFailureIncrease: maxFailureIncrease}
+}
+
+// Apply returns the configuration that metrics are updated with, given the current and the canary configuration.
+// `version` identifies the canary configuration (e.g. a hash of the file); a new version starts a new rollout.
+func (r *Rollout) Apply(ctx context.Context, current, canary *Config, version string) *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if version != r.version {
+		r.version = version
+		r.state = RolloutCanary
+		r.synced = 0
+		r.canary = selectCanaryMetrics(current.metrics, canary.metrics, r.percent)
+		log.WithContext(ctx).Infof("Starting rollout of configuration version %s to %d canary metrics", version, len(r.canary))
+	}
+	switch r.state {
+	case RolloutPromoted:
+		return canary
+	case RolloutRolledBack:
+		return current
+	}
+
+	byName := make(map[string]*Metric)
+	for _, m := range canary.metrics {
+		byName[m.Name] = m
+	}
+	merged := *current
+	merged.metrics = nil
+	for _, m := range current.metrics {
+		if !r.canary[m.Name] {
+			merged.metrics = append(merged.metrics, m)
+		} else if c, ok := byName[m.Name]; ok {
+			merged.metrics = append(merged.metrics, c)
+		}
+		// Canary metrics removed by the new configuration are no longer updated.
+		delete(byName, m.Name)
+	}
+	for _, m := range canary.metrics {
+		if _, added := byName[m.Name]; added && r.canary[m.Name] {
+			merged.metrics = append(merged.metrics, m)
+		}
+	}
+	return &merged
+}
+
+// selectCanaryMetrics returns the names of metrics tagged as canaries in the canary configuration or, if none are, of
+// `percent` of metrics of either configuration. Metrics are selected by a hash of their name, so that the same
+// metrics are selected by all instances.
+func selectCanaryMetrics(current, canary []*Metric, percent int) map[string]bool {
+	selected := make(map[string]bool)
+	for _, m := range canary {
+		if m.Options.Canary {
+			selected[m.Name] = true
+		}
+	}
+	if len(selected) > 0 {
+		return selected
+	}
+	for _, m := range append(current[:len(current):len(current)], canary...) {
+		h := fnv.New32a()
+		h.Write([]byte(m.Name))
+		if int(h.Sum32()%100) < percent {
+			selected[m.Name] = true
+		}
+	}
+	return selected
+}
+
+// Record evaluates the results of a sync of a configuration returned by Apply. The rollout is rolled back if the
+// failure rate of canary metrics exceeds that of other metrics by more than the allowed margin, and promoted once
+// canary metrics have been updated during enough syncs. Syncs that did not update any canary metrics are not counted.
+func (r *Rollout) Record(ctx context.Context, results []*UpdateResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != RolloutCanary {
+		return
+	}
+	var canary, other failureRate
+	for _, res := range results {
+		if res.Skipped || res.Deferred {
+			continue
+		}
+		if r.canary[res.Name] {
+			canary.add(res.Err != nil)
+		} else {
+			other.add(res.Err != nil)
+		}
+	}
+	if canary.updates == 0 {
+		return
+	}
+	if canary.rate() > other.rate()+r.maxFailureIncrease {
+		r.state = RolloutRolledBack
+		log.WithContext(ctx).Errorf("Rolled back configuration version %s: %d of %d canary metrics failed, compared to %d of %d other metrics", r.version, canary.failures, canary.updates, other.failures, other.updates)
+		return
+	}
+	r.synced++
+	if r.synced >= r.cycles {
+		r.state = RolloutPromoted
+		log.WithContext(ctx).Infof("Promoted configuration version %s to all metrics after %d syncs", r.version, r.synced)
+	}
+}
+
+// Status describes the state of the rollout, e.g. for sync summaries. It's empty until a canary configuration has
+// been applied.
+func (r *Rollout) Status() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.version == "" {
+		return ""
+	}
+	if r.state == RolloutCanary {
+		return fmt.Sprintf("version %s: %s (%d of %d syncs)", r.version, r.state, r.synced, r.cycles)
+	}
+	return fmt.Sprintf("version %s: %s", r.version, r.state)
+}
+
+// failureRate counts failed metric updates.
+type failureRate struct {
+	updates, failures int
+}
+
+func (f *failureRate) add(failed bool) {
+	f.updates++
+	if failed {
+		f.failures++
+	}
+}
+
+// rate returns the share of failed updates, or 0 if there have been none.
+func (f *failureRate) rate() float64 {
+	if f.updates == 0 {
+		return 0
+	}
+	return float64(f.failures) / float64(f.updates)
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// metricNames returns names of metrics of a configuration.
+func metricNames(c *Config) []string {
+	var names []string
+	for _, m := range c.metrics {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+func TestRolloutApply(t *testing.T) {
+	ctx := context.Background()
+	a, b, c := &Metric{Name: "a"}, &Metric{Name: "b"}, &Metric{Name: "c"}
+	current := &Config{metrics: []*Metric{a, b, c}}
+	// The new configuration changes a, removes b and c, and adds d and e; a and d are canaries.
+	newA := &Metric{Name: "a", Options: MetricOptions{Canary: true}}
+	newD := &Metric{Name: "d", Options: MetricOptions{Canary: true}}
+	newE := &Metric{Name: "e"}
+	canary := &Config{metrics: []*Metric{newA, newD, newE}}
+
+	r := NewRollout(10, 2, 0.2)
+	got := r.Apply(ctx, current, canary, "v1")
+	if want := []*Metric{newA, b, c, newD}; !reflect.DeepEqual(got.metrics, want) {
+		t.Errorf("expected canary metrics to use the new configuration; got %v", metricNames(got))
+	}
+	if len(current.metrics) != 3 {
+		t.Errorf("expected the current configuration to be left unchanged; got %v", metricNames(current))
+	}
+
+	r.Record(ctx, []*UpdateResult{{Name: "a"}, {Name: "b"}, {Name: "d"}})
+	if got := r.Apply(ctx, current, canary, "v1"); got == canary {
+		t.Error("expected the new configuration not to be promoted after a single sync")
+	}
+	r.Record(ctx, []*UpdateResult{{Name: "a"}, {Name: "b"}, {Name: "d", Err: fmt.Errorf("failed")}, {Name: "e", Skipped: true}})
+	// Half of the canary metrics failed, while none of the other metrics did.
+	if got := r.Apply(ctx, current, canary, "v1"); got != current {
+		t.Errorf("expected the new configuration to be rolled back; got %v (%s)", metricNames(got), r.Status())
+	}
+	if got, want := r.Status(), "version v1: rolled-back"; got != want {
+		t.Errorf("expected status %q; got %q", want, got)
+	}
+
+	// A new version starts a new rollout.
+	r.Apply(ctx, current, canary, "v2")
+	r.Record(ctx, []*UpdateResult{{Name: "a"}, {Name: "b"}})
+	r.Record(ctx, []*UpdateResult{{Name: "b"}})
+	r.Record(ctx, []*UpdateResult{{Name: "a"}, {Name: "b", Err: fmt.Errorf("failed")}})
+	if got := r.Apply(ctx, current, canary, "v2"); got != canary {
+		t.Errorf("expected the new configuration to be promoted; got %v (%s)", metricNames(got), r.Status())
+	}
+
+	// Without tagged metrics, canaries are selected by percentage, and selected metrics can be removed.
+	r = NewRollout(100, 1, 0)
+	untagged := &Config{metrics: []*Metric{newE}}
+	if got := r.Apply(ctx, current, untagged, "v3"); !reflect.DeepEqual(got.metrics, []*Metric{newE}) {
+		t.Errorf("expected all metrics to use the new configuration; got %v", metricNames(got))
+	}
+}
+
+func TestSelectCanaryMetrics(t *testing.T) {
+	var metrics []*Metric
+	for i := 0; i < 1000; i++ {
+		metrics = append(metrics, &Metric{Name: fmt.Sprintf("metric%d", i)})
+	}
+	selected := selectCanaryMetrics(metrics, nil, 10)
+	if len(selected) < 50 || len(selected) > 150 {
+		t.Errorf("expected about 10%% of metrics to be selected; got %d", len(selected))
+	}
+	if again := selectCanaryMetrics(metrics, nil, 10); !reflect.DeepEqual(again, selected) {
+		t.Error("expected the same metrics to be selected again")
+	}
+	if n := len(selectCanaryMetrics(nil, metrics, 0)); n != 0 {
+		t.Errorf("expected no metrics to be selected; got %d", n)
+	}
+}
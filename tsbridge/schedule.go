@@ -0,0 +1,126 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has expected-data schedules, which define when a metric is considered stale.
+package tsbridge
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// maxScheduleLookback limits how far back an expected-data schedule is evaluated. Older periods without imports are
+// counted in full, since such a metric is stale whatever its schedule.
+const maxScheduleLookback = 31 * 24 * time.Hour
+
+// DataSchedule describes when a metric source is expected to produce data, e.g. only on business days for metrics
+// of batch jobs that don't run on weekends. Time outside of the schedule doesn't count towards the age of a metric.
+type DataSchedule struct {
+	// Days are days of week with data, as names (`MON`) or numbers, including ranges like `MON-FRI`. All days by
+	// default.
+	Days []string
+	// Hours are hours of the day with data in cron syntax, e.g. `8-18`. All hours by default.
+	Hours string
+	// Holidays are dates (`2006-01-02`) without data.
+	Holidays []string
+	// TimeZone is the IANA time zone days and hours are evaluated in, UTC by default.
+	TimeZone string `yaml:"time_zone"`
+
+	days     uint64
+	hours    uint64
+	holidays map[string]bool
+	location *time.Location
+}
+
+// validate parses the fields of a schedule.
+func (s *DataSchedule) validate() error {
+	s.days = 0
+	if len(s.Days) == 0 {
+		s.days = 1<<7 - 1
+	}
+	for _, d := range s.Days {
+		bits, err := parseCronField(d, 0, 7, dowNames)
+		if err != nil {
+			return fmt.Errorf("invalid days of expected_data: %v", err)
+		}
+		s.days |= bits
+	}
+	if s.days&(1<<7) != 0 {
+		s.days |= 1
+	}
+
+	hours := s.Hours
+	if hours == "" {
+		hours = "*"
+	}
+	var err error
+	if s.hours, err = parseCronField(hours, 0, 23, nil); err != nil {
+		return fmt.Errorf("invalid hours of expected_data: %v", err)
+	}
+
+	s.holidays = make(map[string]bool)
+	for _, h := range s.Holidays {
+		d, err := time.Parse("2006-01-02", strings.TrimSpace(h))
+		if err != nil {
+			return fmt.Errorf("invalid holiday of expected_data '%s', expected YYYY-MM-DD", h)
+		}
+		s.holidays[d.Format("2006-01-02")] = true
+	}
+
+	if s.location, err = time.LoadLocation(s.TimeZone); err != nil {
+		return fmt.Errorf("invalid time zone of expected_data: %v", err)
+	}
+	return nil
+}
+
+// Expected reports whether data is expected at a given time. A nil schedule always expects data.
+func (s *DataSchedule) Expected(t time.Time) bool {
+	if s == nil {
+		return true
+	}
+	t = t.In(s.location)
+	return s.days&(1<<uint(t.Weekday())) != 0 && s.hours&(1<<uint(t.Hour())) != 0 && !s.holidays[t.Format("2006-01-02")]
+}
+
+// age returns how much time during which data was expected has passed between `last` and `now`. For a nil schedule,
+// or for metrics that have never been imported, that's all of the time in between.
+func (s *DataSchedule) age(last, now time.Time) time.Duration {
+	if s == nil || last.IsZero() || !last.Before(now) {
+		return now.Sub(last)
+	}
+	var age time.Duration
+	if cutoff := now.Add(-maxScheduleLookback); last.Before(cutoff) {
+		age, last = cutoff.Sub(last), cutoff
+	}
+	// The schedule is evaluated hour by hour, using hour boundaries of the time zone so that zones with offsets of
+	// half an hour are handled correctly.
+	for t := last; t.Before(now); {
+		local := t.In(s.location)
+		next := time.Date(local.Year(), local.Month(), local.Day(), local.Hour()+1, 0, 0, 0, s.location)
+		if !next.After(t) {
+			// Hours repeated at the end of daylight saving time.
+			next = t.Truncate(time.Hour).Add(time.Hour)
+		}
+		if next.After(now) {
+			next = now
+		}
+		if s.Expected(t) {
+			age += next.Sub(t)
+		}
+		t = next
+	}
+	return age
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/datastore"
+)
+
+func TestDataScheduleAge(t *testing.T) {
+	weekdays := &DataSchedule{Days: []string{"MON-FRI"}, Holidays: []string{"2020-03-13"}}
+	office := &DataSchedule{Days: []string{"1", "2", "3", "4", "5"}, Hours: "9-16", TimeZone: "Asia/Kolkata"}
+	for _, s := range []*DataSchedule{weekdays, office} {
+		if err := s.validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 2020-03-06 is a Friday.
+	friday := time.Date(2020, 3, 6, 18, 0, 0, 0, time.UTC)
+	monday := friday.AddDate(0, 0, 3)
+	for _, tt := range []struct {
+		name      string
+		s         *DataSchedule
+		last, now time.Time
+		want      time.Duration
+	}{
+		{name: "no schedule", last: friday, now: monday, want: 72 * time.Hour},
+		{name: "over the weekend", s: weekdays, last: friday, now: monday.Add(time.Hour), want: 25 * time.Hour},
+		{name: "during the weekend", s: weekdays, last: friday, now: monday.Add(-time.Hour), want: 23 * time.Hour},
+		{name: "holiday", s: weekdays, last: friday.AddDate(0, 0, 6), now: friday.AddDate(0, 0, 10), want: 24 * time.Hour},
+		// Office hours in India are 03:30 to 11:30 UTC.
+		{name: "office hours", s: office, last: friday.Add(-9 * time.Hour), now: monday.Add(-14 * time.Hour), want: 3 * time.Hour},
+		{name: "never imported", s: weekdays, now: monday, want: monday.Sub(time.Time{})},
+		{name: "long ago", s: weekdays, last: friday.AddDate(0, -2, 0), now: monday, want: 53 * 24 * time.Hour},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.s.age(tt.last, tt.now); got != tt.want {
+				t.Errorf("age(%v, %v) = %v; want %v", tt.last, tt.now, got, tt.want)
+			}
+		})
+	}
+
+	if !office.Expected(friday.Add(-9*time.Hour)) || office.Expected(friday) {
+		t.Error("expected data during office hours only")
+	}
+	var nilSchedule *DataSchedule
+	if !nilSchedule.Expected(friday) {
+		t.Error("expected a nil schedule to always expect data")
+	}
+
+	for _, s := range []*DataSchedule{
+		{Days: []string{"MON-FOO"}},
+		{Hours: "9-24"},
+		{Holidays: []string{"25.12.2020"}},
+		{TimeZone: "Mars/Olympus"},
+	} {
+		if err := s.validate(); err == nil {
+			t.Errorf("expected an error for %+v", s)
+		}
+	}
+}
+
+func TestMetricDataAge(t *testing.T) {
+	friday := time.Date(2020, 3, 6, 18, 0, 0, 0, time.UTC)
+	s := &DataSchedule{Days: []string{"MON-FRI"}}
+	if err := s.validate(); err != nil {
+		t.Fatal(err)
+	}
+	m := &Metric{Record: &datastore.StoredMetricRecord{LastUpdate: friday}, Options: MetricOptions{ExpectedData: s}}
+	if got := m.DataAge(friday.AddDate(0, 0, 2)); got != 6*time.Hour {
+		t.Errorf("expected the weekend not to count towards the age; got %v", got)
+	}
+}
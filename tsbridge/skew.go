@@ -0,0 +1,163 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to points that are timestamped in the future, e.g. by source hosts with a broken clock.
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// defaultMaxClockSkew is how far in the future points can be timestamped by default. Stackdriver rejects points
+// that are more than a few minutes in the future, which fails the whole write.
+const defaultMaxClockSkew = 5 * time.Minute
+
+// Supported policies for points timestamped further in the future than the maximum clock skew.
+const (
+	// FuturePointsDrop drops future points. They are queried again during later updates, and imported once their
+	// timestamp is no longer too far in the future.
+	FuturePointsDrop = "drop"
+	// FuturePointsClamp moves the newest future point of each time series back to the latest accepted time, and drops
+	// all other future points of the series, since Stackdriver only accepts one point per timestamp.
+	FuturePointsClamp = "clamp"
+)
+
+// futurePolicy returns the configured policy for future points.
+func (o *MetricOptions) futurePolicy() string {
+	if o.FuturePoints == "" {
+		return FuturePointsDrop
+	}
+	return o.FuturePoints
+}
+
+// maxClockSkew returns how far in the future points can be timestamped.
+func (o *MetricOptions) maxClockSkew() time.Duration {
+	if o.MaxClockSkew == 0 {
+		return defaultMaxClockSkew
+	}
+	return o.MaxClockSkew
+}
+
+// guardFuturePoints handles points with timestamps after `limit` according to `policy`. It returns the resulting
+// time series and the number of future points found. Points of the same time series can be spread over several
+// elements of `series`.
+func guardFuturePoints(series []*monitoringpb.TimeSeries, limit time.Time, policy string) ([]*monitoringpb.TimeSeries, int, error) {
+	type newestPoint struct {
+		point *monitoringpb.Point
+		end   time.Time
+	}
+	// The newest future point and the newest accepted timestamp of each time series.
+	future := make(map[string]newestPoint)
+	accepted := make(map[string]time.Time)
+	for _, ts := range series {
+		key := proto.CompactTextString(ts.Metric) + proto.CompactTextString(ts.Resource)
+		for _, p := range ts.Points {
+			end, err := ptypes.Timestamp(p.GetInterval().GetEndTime())
+			if err != nil {
+				return nil, 0, fmt.Errorf("could not parse point timestamp for %v: %v", p, err)
+			}
+			if !end.After(limit) {
+				accepted[key] = later(accepted[key], end)
+			} else if n, ok := future[key]; !ok || end.After(n.end) {
+				future[key] = newestPoint{p, end}
+			}
+		}
+	}
+	if len(future) == 0 {
+		return series, 0, nil
+	}
+
+	var output []*monitoringpb.TimeSeries
+	found := 0
+	for _, ts := range series {
+		key := proto.CompactTextString(ts.Metric) + proto.CompactTextString(ts.Resource)
+		var points []*monitoringpb.Point
+		changed := false
+		for _, p := range ts.Points {
+			end, _ := ptypes.Timestamp(p.GetInterval().GetEndTime())
+			if !end.After(limit) {
+				points = append(points, p)
+				continue
+			}
+			found++
+			changed = true
+			// A point at the limit would have the same timestamp as the clamped point.
+			if policy == FuturePointsClamp && p == future[key].point && !accepted[key].Equal(limit) {
+				clamped, err := clampPoint(p, limit)
+				if err != nil {
+					return nil, 0, err
+				}
+				points = append(points, clamped)
+			}
+		}
+		if len(points) == 0 {
+			continue
+		}
+		if changed {
+			ts = proto.Clone(ts).(*monitoringpb.TimeSeries)
+			ts.Points = points
+		}
+		output = append(output, ts)
+	}
+	return output, found, nil
+}
+
+// clampPoint returns a copy of a point with its end time (and its start time, if it's not earlier) moved back to
+// `limit`.
+func clampPoint(p *monitoringpb.Point, limit time.Time) (*monitoringpb.Point, error) {
+	t, err := ptypes.TimestampProto(limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert timestamp %v: %v", limit, err)
+	}
+	p = proto.Clone(p).(*monitoringpb.Point)
+	if start := p.Interval.StartTime; start != nil {
+		if s, err := ptypes.Timestamp(start); err != nil || !s.Before(limit) {
+			p.Interval.StartTime = t
+		}
+	}
+	p.Interval.EndTime = t
+	return p, nil
+}
+
+// handleFuturePoints applies the future point policy of a metric to points returned by its source, logging and
+// recording the number of points that are timestamped too far in the future.
+func (m *Metric) handleFuturePoints(ctx context.Context, ts []*monitoringpb.TimeSeries, s *StatsCollector) ([]*monitoringpb.TimeSeries, error) {
+	policy := m.Options.futurePolicy()
+	skew := m.Options.maxClockSkew()
+	ts, found, err := guardFuturePoints(ts, time.Now().Add(skew), policy)
+	if err != nil {
+		return nil, err
+	}
+	if found == 0 {
+		return ts, nil
+	}
+	log.WithContext(ctx).Warningf("%s: %d points are timestamped more than %v in the future (policy: %s); the clock of the source host may be wrong", m.Name, found, skew, policy)
+	ctx, terr := tag.New(ctx, tag.Upsert(s.FuturePointPolicyKey, policy))
+	if terr != nil {
+		log.WithContext(ctx).Errorf("StatsCollector: cannot tag future points: %v", terr)
+		return ts, nil
+	}
+	stats.Record(ctx, s.FuturePoints.M(int64(found)))
+	return ts, nil
+}
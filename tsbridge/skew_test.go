@@ -0,0 +1,130 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestGuardFuturePoints(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	limit := start.Add(2 * time.Minute)
+
+	for _, tt := range []struct {
+		name        string
+		policy      string
+		series      []float64 // values of points a minute apart, starting at `start`.
+		wantFound   int
+		wantOffsets []time.Duration
+		wantValues  []float64
+	}{
+		{
+			name:        "no future points",
+			policy:      FuturePointsDrop,
+			series:      []float64{1, 2},
+			wantOffsets: []time.Duration{0, time.Minute},
+			wantValues:  []float64{1, 2},
+		},
+		{
+			name:        "drop",
+			policy:      FuturePointsDrop,
+			series:      []float64{1, 2, 3, 4, 5},
+			wantFound:   2,
+			wantOffsets: []time.Duration{0, time.Minute, 2 * time.Minute},
+			wantValues:  []float64{1, 2, 3},
+		},
+		{
+			name:        "clamp without future points",
+			policy:      FuturePointsClamp,
+			series:      []float64{1, 2},
+			wantOffsets: []time.Duration{0, time.Minute},
+			wantValues:  []float64{1, 2},
+		},
+		{
+			name:        "clamp with a point at the limit",
+			policy:      FuturePointsClamp,
+			series:      []float64{1, 2, 3, 4, 5},
+			wantFound:   2,
+			wantOffsets: []time.Duration{0, time.Minute, 2 * time.Minute},
+			wantValues:  []float64{1, 2, 3},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found, err := guardFuturePoints(gaugeSeries(start, time.Minute, tt.series...), limit, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != tt.wantFound {
+				t.Errorf("expected %d future points; got %d", tt.wantFound, found)
+			}
+			offsets, values := seriesPoints(start, got)
+			if !reflect.DeepEqual(offsets, tt.wantOffsets) || !reflect.DeepEqual(values, tt.wantValues) {
+				t.Errorf("expected points %v %v; got %v %v", tt.wantOffsets, tt.wantValues, offsets, values)
+			}
+		})
+	}
+}
+
+func TestGuardFuturePointsClampToLimit(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	limit := start.Add(90 * time.Second)
+
+	got, found, err := guardFuturePoints(gaugeSeries(start, time.Minute, 1, 2, 3, 4), limit, FuturePointsClamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found != 2 {
+		t.Errorf("expected 2 future points; got %d", found)
+	}
+	// Only the newest future point is kept, at the latest accepted time.
+	offsets, values := seriesPoints(start, got)
+	wantOffsets := []time.Duration{0, time.Minute, 90 * time.Second}
+	wantValues := []float64{1, 2, 4}
+	if !reflect.DeepEqual(offsets, wantOffsets) || !reflect.DeepEqual(values, wantValues) {
+		t.Errorf("expected points %v %v; got %v %v", wantOffsets, wantValues, offsets, values)
+	}
+}
+
+func TestHandleFuturePoints(t *testing.T) {
+	collector, exporter := fakeStats(t)
+	ctx, err := tag.New(context.Background(), tag.Insert(collector.MetricKey, "m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Metric{Name: "m1", Options: MetricOptions{MaxClockSkew: time.Minute}}
+
+	ts, err := m.handleFuturePoints(ctx, gaugeSeries(time.Now(), time.Hour, 1, 2, 3), collector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 1 {
+		t.Errorf("expected a single point to be kept; got %v", ts)
+	}
+	collector.Close()
+
+	val, ok := exporter.values["ts_bridge/future_points:drop:m1"]
+	if !ok {
+		t.Fatalf("no future points recorded; got %v", exporter.values)
+	}
+	if got := val.(*view.SumData).Value; got != 2 {
+		t.Errorf("expected 2 future points; got %v", got)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to SLO burn-rate metrics derived from imported metrics.
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// burnRateWindowLabel is the metric label that holds the window a burn rate is computed over.
+const burnRateWindowLabel = "window"
+
+// BurnRateConfig defines an SLO burn-rate metric computed from a pair of imported metrics that count good and total
+// events.
+type BurnRateConfig struct {
+	Name string `validate:"regexp=^[A-Za-z0-9]\\w*$"`
+	// Good and Total are names of imported metrics in the same section of the configuration file.
+	Good  string `validate:"nonzero"`
+	Total string `validate:"nonzero"`
+	// Objective is the SLO target, e.g. 0.999 for 99.9% of good events.
+	Objective   float64
+	Windows     []time.Duration `validate:"nonzero"`
+	Destination string          `validate:"nonzero"`
+}
+
+// validate checks burn-rate parameters that cannot be verified using struct tags.
+func (bc *BurnRateConfig) validate() error {
+	if bc.Objective <= 0 || bc.Objective >= 1 {
+		return fmt.Errorf("objective must be between 0 and 1; got %v", bc.Objective)
+	}
+	for _, w := range bc.Windows {
+		if w < time.Minute {
+			return fmt.Errorf("burn rate windows cannot be shorter than %v; got %v", time.Minute, w)
+		}
+	}
+	return nil
+}
+
+// BurnRate is a derived metric that reports how fast the error budget of an SLO is consumed: a burn rate of 1
+// means that the error budget will be exhausted exactly at the end of the SLO period. It is computed for several
+// windows from the good and total metrics already written to Stackdriver, and written as one time series per window.
+type BurnRate struct {
+	Name        string
+	Good, Total *Metric
+	Objective   float64
+	Windows     []time.Duration
+	SDProject   string
+	// Tenant is the name of the tenant the burn rate belongs to, if any.
+	Tenant string
+}
+
+// StackdriverName returns the full Stackdriver metric type of the burn-rate metric.
+func (b *BurnRate) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/slo/%s/burn_rate", b.Name)
+}
+
+// update computes burn rates for all windows and writes them to Stackdriver. Since burn rates have no metric record,
+// errors are returned as both Err and RecordErr of the result.
+func (b *BurnRate) update(ctx context.Context, sd StackdriverAdapter) *UpdateResult {
+	start := time.Now()
+	res := &UpdateResult{Name: b.Name}
+	defer func() { res.Duration = time.Since(start) }()
+
+	series, err := b.timeSeries(ctx, sd, start)
+	if err == nil {
+		err = sd.CreateTimeseries(ctx, b.SDProject, b.StackdriverName(), b.descriptor(), series)
+	}
+	if err != nil {
+		log.WithContext(ctx).Errorf("failed to update burn rate %s: %v", b.Name, err)
+		res.Err = fmt.Errorf("failed to update burn rate %s: %w", b.Name, err)
+		res.RecordErr = res.Err
+		return res
+	}
+	res.Points = len(series)
+	return res
+}
+
+// timeSeries returns a single-point time series with the burn rate for each window.
+func (b *BurnRate) timeSeries(ctx context.Context, sd StackdriverAdapter, now time.Time) ([]*monitoringpb.TimeSeries, error) {
+	end, err := ptypes.TimestampProto(now)
+	if err != nil {
+		return nil, err
+	}
+	var series []*monitoringpb.TimeSeries
+	for _, w := range b.Windows {
+		good, err := sd.SumOverWindow(ctx, b.Good.SDProject, b.Good.Source.StackdriverName(), w)
+		if err != nil {
+			return nil, fmt.Errorf("cannot sum good events of %s: %w", b.Good.Name, err)
+		}
+		total, err := sd.SumOverWindow(ctx, b.Total.SDProject, b.Total.Source.StackdriverName(), w)
+		if err != nil {
+			return nil, fmt.Errorf("cannot sum total events of %s: %w", b.Total.Name, err)
+		}
+		series = append(series, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: b.StackdriverName(), Labels: map[string]string{burnRateWindowLabel: windowLabel(w)}},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: end},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: burnRate(good, total, b.Objective)}},
+			}},
+		})
+	}
+	return series, nil
+}
+
+// descriptor returns the metric descriptor of the burn-rate metric.
+func (b *BurnRate) descriptor() *metricpb.MetricDescriptor {
+	return &metricpb.MetricDescriptor{
+		Type:        b.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Unit:        "1",
+		Description: fmt.Sprintf("Burn rate of SLO %v based on %s (good) and %s (total)", b.Objective, b.Good.Name, b.Total.Name),
+		DisplayName: fmt.Sprintf("%s burn rate", b.Name),
+		Labels: []*label.LabelDescriptor{{
+			Key:         burnRateWindowLabel,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "Window the burn rate is computed over",
+		}},
+	}
+}
+
+// burnRate returns the ratio between the observed error rate and the error rate allowed by the objective. If there
+// were no events, nothing was burned.
+func burnRate(good, total, objective float64) float64 {
+	if total <= 0 {
+		return 0
+	}
+	return (1 - good/total) / (1 - objective)
+}
+
+// windowLabel formats a window duration without trailing zero units, e.g. "1h" instead of "1h0m0s".
+func windowLabel(w time.Duration) string {
+	s := w.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
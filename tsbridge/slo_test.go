@@ -0,0 +1,108 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/mocks"
+
+	"github.com/golang/mock/gomock"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestBurnRate(t *testing.T) {
+	for _, tt := range []struct {
+		good, total, objective, want float64
+	}{
+		{999, 1000, 0.999, 1},
+		{990, 1000, 0.999, 10},
+		{1000, 1000, 0.999, 0},
+		{0, 0, 0.999, 0},
+	} {
+		if got := burnRate(tt.good, tt.total, tt.objective); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("burnRate(%v, %v, %v) = %v; want %v", tt.good, tt.total, tt.objective, got, tt.want)
+		}
+	}
+}
+
+func TestWindowLabel(t *testing.T) {
+	for _, tt := range []struct {
+		window time.Duration
+		want   string
+	}{
+		{time.Hour, "1h"},
+		{6 * time.Hour, "6h"},
+		{90 * time.Minute, "1h30m"},
+		{5 * time.Minute, "5m"},
+		{90 * time.Second, "1m30s"},
+	} {
+		if got := windowLabel(tt.window); got != tt.want {
+			t.Errorf("windowLabel(%v) = %s; want %s", tt.window, got, tt.want)
+		}
+	}
+}
+
+func TestBurnRateUpdate(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	good := mocks.NewMockSourceMetric(mockCtrl)
+	good.EXPECT().StackdriverName().AnyTimes().Return("custom.googleapis.com/good")
+	total := mocks.NewMockSourceMetric(mockCtrl)
+	total.EXPECT().StackdriverName().AnyTimes().Return("custom.googleapis.com/total")
+	b := &BurnRate{
+		Name:      "availability",
+		Good:      &Metric{Name: "good", Source: good, SDProject: "source-project"},
+		Total:     &Metric{Name: "total", Source: total, SDProject: "source-project"},
+		Objective: 0.99,
+		Windows:   []time.Duration{time.Hour, 6 * time.Hour},
+		SDProject: "slo-project",
+	}
+
+	sd := mocks.NewMockStackdriverAdapter(mockCtrl)
+	sd.EXPECT().SumOverWindow(gomock.Any(), "source-project", "custom.googleapis.com/good", time.Hour).Return(95.0, nil)
+	sd.EXPECT().SumOverWindow(gomock.Any(), "source-project", "custom.googleapis.com/total", time.Hour).Return(100.0, nil)
+	sd.EXPECT().SumOverWindow(gomock.Any(), "source-project", "custom.googleapis.com/good", 6*time.Hour).Return(599.0, nil)
+	sd.EXPECT().SumOverWindow(gomock.Any(), "source-project", "custom.googleapis.com/total", 6*time.Hour).Return(600.0, nil)
+	sd.EXPECT().CreateTimeseries(gomock.Any(), "slo-project", "custom.googleapis.com/slo/availability/burn_rate", gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_ context.Context, _, _ string, desc *metricpb.MetricDescriptor, series []*monitoringpb.TimeSeries) error {
+			var got []string
+			for _, ts := range series {
+				got = append(got, fmt.Sprintf("%s=%.3f", ts.Metric.Labels[burnRateWindowLabel], pointValue(ts.Points[0])))
+			}
+			if want := "1h=5.000 6h=0.167"; strings.Join(got, " ") != want {
+				t.Errorf("expected burn rates %s; got %s", want, strings.Join(got, " "))
+			}
+			return nil
+		})
+
+	if res := b.update(ctx, sd); res.Err != nil || res.Points != 2 {
+		t.Errorf("expected burn rate update to write 2 points; got %d points and error %v", res.Points, res.Err)
+	}
+
+	sd.EXPECT().SumOverWindow(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(0.0, fmt.Errorf("some-error"))
+	res := b.update(ctx, sd)
+	if res.RecordErr == nil || !strings.Contains(res.RecordErr.Error(), "cannot sum good events of good: some-error") {
+		t.Errorf("expected burn rate update to fail; got %v", res.RecordErr)
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to named sources, which metrics reference to share connection parameters.
+package tsbridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// NamedSource is a reusable connection to a monitoring system, such as the endpoint, credentials and TLS settings
+// of a Datadog org, that metrics of the same section can reference using `profile` instead of repeating them. This
+// allows a single deployment to import metrics from several accounts of the same monitoring system.
+type NamedSource struct {
+	Name string `validate:"regexp=^[A-Za-z0-9]\\w*$"`
+	// Type restricts the source to metrics of a given source type (e.g. datadog), as reported by SourceType. Any
+	// metric can reference the source if it's empty.
+	Type string
+	// RateLimit limits the rate of queries sent by all metrics referencing the source. Can be nil.
+	RateLimit *RateLimitConfig `yaml:"rate_limit"`
+	// Params are merged into the parameters of each metric referencing the source. Parameters set by the metric
+	// take precedence, and nested settings (e.g. `http`) are merged key by key.
+	Params yaml.MapSlice
+}
+
+// RateLimitConfig allows up to Queries source queries per period. Queries up to the limit can be sent in a burst.
+type RateLimitConfig struct {
+	Queries int           `validate:"min=1"`
+	Per     time.Duration `validate:"nonzero"`
+}
+
+// applySources merges parameters of named sources into metrics of the configuration file that reference them.
+// Named sources are scoped to the section they are defined in, so tenants can only use their own sources. The file
+// is returned unchanged if no metric references a named source, so that errors reported while unmarshaling it refer
+// to the right lines.
+func applySources(data []byte) ([]byte, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		// Syntax errors are reported while the file is unmarshaled strictly.
+		return data, nil
+	}
+	used, err := applySectionSources(doc)
+	if err != nil {
+		return nil, err
+	}
+	tenants, _ := yamlValue(doc, "tenants").([]interface{})
+	for _, t := range tenants {
+		section, ok := t.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+		u, err := applySectionSources(section)
+		if err != nil {
+			return nil, fmt.Errorf("tenant '%v': %v", yamlValue(section, "name"), err)
+		}
+		used = used || u
+	}
+	if !used {
+		return data, nil
+	}
+	return yaml.Marshal(doc)
+}
+
+// withSource merges parameters of the top-level named source referenced by a metric defined outside of the
+// configuration file into its parameters, so that e.g. BridgedMetric resources can use credentials kept in the
+// configuration file.
+func (c *Config) withSource(d *MetricDefinition) (*MetricDefinition, error) {
+	var params yaml.MapSlice
+	if err := yaml.Unmarshal(d.Params, &params); err != nil || yamlValue(params, "profile") == nil {
+		// Invalid parameters are reported while they are unmarshaled strictly.
+		return d, nil
+	}
+	sources := make(map[string]yaml.MapSlice)
+	for _, s := range c.Sources {
+		sources[s.Name] = s.Params
+	}
+	merged, err := mergeSource(d.Name, params, sources)
+	if err != nil {
+		return nil, err
+	}
+	data, err := yaml.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	return &MetricDefinition{Name: d.Name, Source: d.Source, Params: data}, nil
+}
+
+// applySectionSources merges parameters of named sources into metrics of a section, and returns whether any metric
+// references a named source.
+func applySectionSources(section yaml.MapSlice) (bool, error) {
+	sources, err := sectionSources(yamlValue(section, "sources"))
+	if err != nil {
+		return false, err
+	}
+	used := false
+	for _, item := range section {
+		if item.Key == "sources" || item.Key == "tenants" {
+			continue
+		}
+		metrics, _ := item.Value.([]interface{})
+		for i, m := range metrics {
+			params, ok := m.(yaml.MapSlice)
+			if !ok || yamlValue(params, "profile") == nil {
+				continue
+			}
+			merged, err := mergeSource(yamlValue(params, "name"), params, sources)
+			if err != nil {
+				return false, err
+			}
+			metrics[i] = merged
+			used = true
+		}
+	}
+	return used, nil
+}
+
+// sectionSources returns parameters of the named sources listed in a section, keyed by name. Sources that are not
+// well-formed are skipped, since they are reported while the file is unmarshaled strictly.
+func sectionSources(list interface{}) (map[string]yaml.MapSlice, error) {
+	sources := make(map[string]yaml.MapSlice)
+	items, _ := list.([]interface{})
+	for _, item := range items {
+		s, ok := item.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+		name := fmt.Sprint(yamlValue(s, "name"))
+		if _, ok := sources[name]; ok {
+			return nil, fmt.Errorf("configuration file contains several sources named '%s'", name)
+		}
+		params, _ := yamlValue(s, "params").(yaml.MapSlice)
+		if yamlValue(params, "name") != nil || yamlValue(params, "profile") != nil {
+			return nil, fmt.Errorf("source '%s' cannot set the name or profile of metrics", name)
+		}
+		sources[name] = params
+	}
+	return sources, nil
+}
+
+// mergeSource merges parameters of the named source referenced by a metric into its parameters.
+func mergeSource(metric interface{}, params yaml.MapSlice, sources map[string]yaml.MapSlice) (yaml.MapSlice, error) {
+	name := fmt.Sprint(yamlValue(params, "profile"))
+	source, ok := sources[name]
+	if !ok {
+		return nil, fmt.Errorf("metric '%v' references unknown source '%s'", metric, name)
+	}
+	return mergeParams(params, source), nil
+}
+
+// mergeParams returns parameters with defaults added for keys that are not set. Nested mappings are merged
+// recursively.
+func mergeParams(params, defaults yaml.MapSlice) yaml.MapSlice {
+	merged := append(yaml.MapSlice(nil), params...)
+	for _, d := range defaults {
+		i := yamlIndex(merged, d.Key)
+		if i < 0 {
+			merged = append(merged, d)
+			continue
+		}
+		nested, ok := merged[i].Value.(yaml.MapSlice)
+		if dn, dok := d.Value.(yaml.MapSlice); ok && dok {
+			merged[i].Value = mergeParams(nested, dn)
+		}
+	}
+	return merged
+}
+
+// yamlValue returns the value of a key of a YAML mapping, or nil if it's not set.
+func yamlValue(m yaml.MapSlice, key string) interface{} {
+	if i := yamlIndex(m, key); i >= 0 {
+		return m[i].Value
+	}
+	return nil
+}
+
+// yamlIndex returns the index of a key of a YAML mapping, or -1 if it's not set.
+func yamlIndex(m yaml.MapSlice, key interface{}) int {
+	for i, item := range m {
+		if item.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkSource checks that a source metric can reference a named source, and returns the rate limiter of the named
+// source, which is nil unless a rate limit is configured.
+func checkSource(tenant string, s *NamedSource, sourceMetric SourceMetric) (*RateLimiter, error) {
+	if s.Type != "" {
+		if sourceType(sourceMetric) != s.Type {
+			return nil, fmt.Errorf("source '%s' can only be used by %s metrics", s.Name, s.Type)
+		}
+	}
+	if s.RateLimit == nil {
+		return nil, nil
+	}
+	return sourceRateLimiter(tenant+"/"+s.Name, s.RateLimit), nil
+}
+
+// Rate limiters are shared by all configurations loaded during the lifetime of the process, so that the limit
+// applies across syncs even though the configuration file is reloaded for each of them.
+var (
+	rateLimitersMu sync.Mutex
+	rateLimiters   = make(map[string]*RateLimiter)
+)
+
+// sourceRateLimiter returns the rate limiter of a named source, replacing it if the limit has changed.
+func sourceRateLimiter(key string, c *RateLimitConfig) *RateLimiter {
+	rateLimitersMu.Lock()
+	defer rateLimitersMu.Unlock()
+	l, ok := rateLimiters[key]
+	if !ok || l.queries != c.Queries || l.per != c.Per {
+		l = NewRateLimiter(c.Queries, c.Per)
+		rateLimiters[key] = l
+	}
+	return l
+}
+
+// errRateLimited is returned when a query cannot be sent before the context is done because of a rate limit.
+var errRateLimited = errors.New("source rate limit exceeded")
+
+// RateLimiter is a token bucket allowing bursts of up to `queries` queries, refilled at a rate of `queries` per
+// `per`. A RateLimiter is safe for concurrent use. A nil RateLimiter never waits.
+type RateLimiter struct {
+	queries int
+	per     time.Duration
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a new RateLimiter with a full bucket.
+func NewRateLimiter(queries int, per time.Duration) *RateLimiter {
+	return &RateLimiter{queries: queries, per: per, tokens: float64(queries), last: time.Now()}
+}
+
+// Wait blocks until a query can be sent. It returns an error wrapping errRateLimited without waiting if the query
+// could not be sent before the deadline of the context.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	delay := l.take(now)
+	if delay <= 0 {
+		return nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && now.Add(delay).After(deadline) {
+		l.cancel()
+		return fmt.Errorf("%w: %d queries per %v", errRateLimited, l.queries, l.per)
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		return fmt.Errorf("%w: %d queries per %v: %v", errRateLimited, l.queries, l.per, ctx.Err())
+	}
+}
+
+// Allow takes a token if one is available without waiting, and reports whether it did.
+func (l *RateLimiter) Allow() bool {
+	if l == nil {
+		return true
+	}
+	if l.take(time.Now()) > 0 {
+		l.cancel()
+		return false
+	}
+	return true
+}
+
+// take refills the bucket and takes a token, returning how long it takes until the token is available.
+func (l *RateLimiter) take(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	perToken := l.per / time.Duration(l.queries)
+	l.tokens += float64(now.Sub(l.last)) / float64(perToken)
+	if l.tokens > float64(l.queries) {
+		l.tokens = float64(l.queries)
+	}
+	l.last = now
+	l.tokens--
+	return time.Duration(-l.tokens * float64(perToken))
+}
+
+// cancel returns the token of a query that has not been sent.
+func (l *RateLimiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
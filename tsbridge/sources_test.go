@@ -0,0 +1,289 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/datadog"
+	"github.com/google/ts-bridge/datastore"
+	"github.com/google/ts-bridge/mocks"
+
+	"github.com/golang/mock/gomock"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestApplySources(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		config  string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "merged",
+			config: `
+sources:
+  - name: eu
+    params:
+      api_key: eu-key
+      site: datadoghq.eu
+      http: {timeout: 10s, ca_file: eu.pem}
+datadog_metrics:
+  - name: m1
+    profile: eu
+    site: datadoghq.com
+    http: {timeout: 5s}
+  - name: m2
+`,
+			want: `
+sources:
+  - name: eu
+    params:
+      api_key: eu-key
+      site: datadoghq.eu
+      http: {timeout: 10s, ca_file: eu.pem}
+datadog_metrics:
+  - name: m1
+    profile: eu
+    site: datadoghq.com
+    http: {timeout: 5s, ca_file: eu.pem}
+    api_key: eu-key
+  - name: m2
+`,
+		},
+		{
+			name: "tenant",
+			config: `
+tenants:
+  - name: team
+    sources:
+      - name: us
+        params: {api_key: us-key}
+    datadog_events:
+      - name: e1
+        profile: us
+`,
+			want: `
+tenants:
+  - name: team
+    sources:
+      - name: us
+        params: {api_key: us-key}
+    datadog_events:
+      - name: e1
+        profile: us
+        api_key: us-key
+`,
+		},
+		{
+			name: "unknown source",
+			config: `
+datadog_metrics:
+  - name: m1
+    profile: eu
+`,
+			wantErr: "metric 'm1' references unknown source 'eu'",
+		},
+		{
+			name: "source of another section",
+			config: `
+sources:
+  - name: eu
+    params: {api_key: eu-key}
+tenants:
+  - name: team
+    datadog_metrics:
+      - name: m1
+        profile: eu
+`,
+			wantErr: "tenant 'team': metric 'm1' references unknown source 'eu'",
+		},
+		{
+			name: "duplicate sources",
+			config: `
+sources:
+  - name: eu
+    params: {api_key: eu-key}
+  - name: eu
+    params: {api_key: other-key}
+`,
+			wantErr: "several sources named 'eu'",
+		},
+		{
+			name: "source setting the name",
+			config: `
+sources:
+  - name: eu
+    params: {name: m2}
+`,
+			wantErr: "cannot set the name or profile of metrics",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applySources([]byte(tt.config))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotDoc, wantDoc yaml.MapSlice
+			if err := yaml.Unmarshal(got, &gotDoc); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal([]byte(tt.want), &wantDoc); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotDoc, wantDoc) {
+				t.Errorf("expected:\n%s\ngot:\n%s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestApplySourcesUnused(t *testing.T) {
+	config := "# Comments and formatting are kept.\ndatadog_metrics:\n  - {name: m1, api_key: k}\n"
+	got, err := applySources([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != config {
+		t.Errorf("expected the file to be unchanged; got %s", got)
+	}
+}
+
+func TestCheckSource(t *testing.T) {
+	source, err := datadog.NewSourceMetric("m1", &datadog.MetricConfig{Query: "q"}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkSource("", &NamedSource{Name: "s", Type: "influxdb"}, source); err == nil {
+		t.Error("expected an error for a source of another type")
+	}
+	l, err := checkSource("", &NamedSource{Name: "s", Type: "datadog"}, source)
+	if err != nil || l != nil {
+		t.Errorf("expected no rate limiter and no error; got %v, %v", l, err)
+	}
+
+	limit := &RateLimitConfig{Queries: 10, Per: time.Minute}
+	l1, _ := checkSource("", &NamedSource{Name: "s", RateLimit: limit}, source)
+	l2, _ := checkSource("", &NamedSource{Name: "s", RateLimit: limit}, source)
+	l3, _ := checkSource("team", &NamedSource{Name: "s", RateLimit: limit}, source)
+	l4, _ := checkSource("", &NamedSource{Name: "s", RateLimit: &RateLimitConfig{Queries: 5, Per: time.Minute}}, source)
+	if l1 == nil || l1 != l2 {
+		t.Error("expected metrics referencing the same source to share a rate limiter")
+	}
+	if l3 == l1 || l4 == l1 {
+		t.Error("expected separate rate limiters for sources of other tenants and changed limits")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(2, 200*time.Millisecond)
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := l.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("expected a burst of queries up to the limit to be allowed; waited %v", d)
+	}
+
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(short); !errors.Is(err, errRateLimited) {
+		t.Errorf("expected a rate limit error before the deadline; got %v", err)
+	}
+	if err := l.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("expected to wait for a token to be refilled; waited %v", d)
+	}
+
+	var nilLimiter *RateLimiter
+	if err := nilLimiter.Wait(short); err != nil {
+		t.Errorf("expected a nil rate limiter to never wait; got %v", err)
+	}
+	if !nilLimiter.Allow() {
+		t.Error("expected a nil rate limiter to allow all queries")
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := NewRateLimiter(2, time.Hour)
+	for i := 0; i < 2; i++ {
+		if !l.Allow() {
+			t.Fatalf("expected query %d of a burst up to the limit to be allowed", i+1)
+		}
+	}
+	// Rejected queries don't take a token, so they don't delay later ones.
+	for i := 0; i < 3; i++ {
+		if l.Allow() {
+			t.Errorf("expected query %d over the limit to be rejected", i+3)
+		}
+	}
+	if d := l.take(time.Now()); d > time.Hour/2 {
+		t.Errorf("expected the next token to be available within %v; got %v", time.Hour/2, d)
+	}
+}
+
+func TestMetricUpdateRateLimit(t *testing.T) {
+	ctx := context.Background()
+	storage := datastore.New(ctx, &datastore.Options{})
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	src := mocks.NewMockSourceMetric(mockCtrl)
+	src.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	// The source is only queried once; the second update runs into the rate limit.
+	src.EXPECT().StackdriverData(gomock.Any(), gomock.Any(), gomock.Any()).Times(1).Return(nil, nil, nil)
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), gomock.Any(), gomock.Any()).Times(2).Return(time.Now(), nil)
+
+	rec := &datastore.StoredMetricRecord{Name: "metricname", Storage: storage}
+	breaker := NewCircuitBreaker(1, time.Hour)
+	m := &Metric{Name: "metricname", Source: &hostedSource{src}, SDProject: "sd-project", Record: rec,
+		Breaker: breaker, RateLimiter: NewRateLimiter(1, time.Hour)}
+
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		if err := m.Update(ctx, mockSD, collector); err != nil {
+			t.Errorf("Metric.Update() returned error %v", err)
+		}
+		cancel()
+	}
+	if !strings.Contains(rec.LastStatus, "source rate limit exceeded: 1 queries per 1h0m0s") {
+		t.Errorf("expected status to mention the rate limit; got %v", rec.LastStatus)
+	}
+	if ok, _ := breaker.Allow("source-host"); !ok {
+		t.Error("expected the rate limit not to trip the circuit breaker")
+	}
+}
@@ -18,12 +18,13 @@ package tsbridge
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
 	"sync"
 	"time"
 
 	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/tserrors"
 
 	sdexporter "contrib.go.opencensus.io/exporter/stackdriver"
 	log "github.com/sirupsen/logrus"
@@ -35,6 +36,32 @@ import (
 // Manually configured buckets for a distribution metric measuring latency in milliseconds.
 var latencyDistribution = view.Distribution(100, 250, 500, 1000, 2000, 3000, 4000, 5000, 7500, 10000, 15000, 20000, 40000, 60000, 90000, 120000, 300000, 600000)
 
+// MetricImportLatencyBuckets and TotalImportLatencyBuckets override the bucket boundaries (in milliseconds) of the
+// metric_import_latencies and import_latencies distributions, e.g. to tell apart sub-second imports or long backfills.
+// The default latency buckets are used if they are empty. They are used by collectors created after they are set.
+var (
+	MetricImportLatencyBuckets []float64
+	TotalImportLatencyBuckets  []float64
+)
+
+// StaleMetricThresholds are the ages after which metrics are counted as stale in the metrics_stale_total metric, with
+// a separate count for each threshold.
+var StaleMetricThresholds = []time.Duration{5 * time.Minute, 15 * time.Minute, time.Hour}
+
+// latencyAggregation returns a distribution with the given bucket boundaries, or the default latency distribution.
+func latencyAggregation(buckets []float64) *view.Aggregation {
+	if len(buckets) == 0 {
+		return latencyDistribution
+	}
+	return view.Distribution(buckets...)
+}
+
+// Manually configured buckets for distribution metrics measuring sizes of Stackdriver write requests.
+var (
+	writeBytesDistribution  = view.Distribution(256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536, 131072, 262144, 524288, 1048576)
+	writePointsDistribution = view.Distribution(1, 2, 5, 10, 20, 50, 100, 200, 500, 1000)
+)
+
 // statsMu makes sure there's only a single active StatsCollector, since OpenCensus metrics need to be globally defined for the whole process.
 // This lock is taken when a new collector is created, and released when it's closed.
 var statsMu = &sync.Mutex{}
@@ -47,29 +74,52 @@ type statsExporter interface {
 
 // StatsCollector has all metrics, tags, and the exporter used to publish them.
 type StatsCollector struct {
-	Exporter            statsExporter
-	MetricImportLatency *stats.Int64Measure
-	TotalImportLatency  *stats.Int64Measure
-	OldestMetricAge     *stats.Int64Measure
-	MetricKey           tag.Key
-	views               []*view.View
-	ctx                 context.Context
+	Exporter             statsExporter
+	MetricImportLatency  *stats.Int64Measure
+	TotalImportLatency   *stats.Int64Measure
+	OldestMetricAge      *stats.Int64Measure
+	MetricAge            *stats.Int64Measure
+	StaleMetrics         *stats.Int64Measure
+	Heartbeats           *stats.Int64Measure
+	MetricMissingPoints  *stats.Int64Measure
+	ImportLag            *stats.Int64Measure
+	MetricSkips          *stats.Int64Measure
+	MaintenanceSkips     *stats.Int64Measure
+	MetricDeferrals      *stats.Int64Measure
+	PendingPoints        *stats.Int64Measure
+	MetricUpdateErrors   *stats.Int64Measure
+	SourceLatency        *stats.Int64Measure
+	WriteLatency         *stats.Int64Measure
+	LabelSanitizations   *stats.Int64Measure
+	WriteCalls           *stats.Int64Measure
+	WriteBytes           *stats.Int64Measure
+	WritePoints          *stats.Int64Measure
+	WriteQuotaErrors     *stats.Int64Measure
+	WriteDiscrepancies   *stats.Int64Measure
+	DroppedPoints        *stats.Int64Measure
+	FuturePoints         *stats.Int64Measure
+	SourceAPICalls       *stats.Int64Measure
+	StackdriverAPICalls  *stats.Int64Measure
+	MetricPointsWritten  *stats.Int64Measure
+	MetricKey            tag.Key
+	ErrorClassKey        tag.Key
+	SourceTypeKey        tag.Key
+	DestinationKey       tag.Key
+	DiscrepancyKey       tag.Key
+	OverflowPolicyKey    tag.Key
+	FuturePointPolicyKey tag.Key
+	ThresholdKey         tag.Key
+	views                []*view.View
+	ctx                  context.Context
 }
 
 // NewCollector creates a new StatsCollector.
 // Users need to call StatsCollector.Close() when it's no longer needed. Only a single collector can be active per process.
 func NewCollector(ctx context.Context, project string) (*StatsCollector, error) {
-	var err error
 	c := &StatsCollector{ctx: ctx}
-
-	if project == "" {
-		if env.IsAppEngine() {
-			project = os.Getenv("GOOGLE_CLOUD_PROJECT")
-			log.Infof("Cannot determine project to store stats in, defaulting to GAE project: %v", project)
-		} else {
-			return nil, fmt.Errorf("error initializing stats collector - project empty: set SD_PROJECT_FOR_INTERNAL_METRICS or --stats-sd-project if not running on App Engine")
-		}
-
+	project, err := statsProject(project)
+	if err != nil {
+		return nil, err
 	}
 
 	c.Exporter, err = sdexporter.NewExporter(sdexporter.Options{
@@ -80,7 +130,39 @@ func NewCollector(ctx context.Context, project string) (*StatsCollector, error)
 	if err != nil {
 		return nil, err
 	}
-	if err = c.registerAndCreateMetrics(); err != nil {
+	return c.register()
+}
+
+// NewAdapterCollector creates a new StatsCollector that writes stats using a StackdriverAdapter instead of the
+// OpenCensus Stackdriver exporter, so that they are written with the same credentials as imported metrics.
+// Stats are written when the collector is closed, so the adapter needs to stay open until then.
+func NewAdapterCollector(ctx context.Context, project string, sd StackdriverAdapter) (*StatsCollector, error) {
+	c := &StatsCollector{ctx: ctx}
+	project, err := statsProject(project)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Exporter = newAdapterExporter(ctx, project, sd, c.logError)
+	return c.register()
+}
+
+// statsProject returns the project to store stats in, defaulting to the App Engine project.
+func statsProject(project string) (string, error) {
+	if project != "" {
+		return project, nil
+	}
+	if !env.IsAppEngine() && !env.IsCloudRun() {
+		return "", fmt.Errorf("error initializing stats collector - project empty: set SD_PROJECT_FOR_INTERNAL_METRICS or --stats-sd-project if not running on App Engine or Cloud Run")
+	}
+	project = env.Project()
+	log.Infof("Cannot determine project to store stats in, defaulting to the project of the app: %v", project)
+	return project, nil
+}
+
+// register registers metrics of a collector that has its exporter set.
+func (c *StatsCollector) register() (*StatsCollector, error) {
+	if err := c.registerAndCreateMetrics(); err != nil {
 		// Clean up after registerAndCreateMetrics. Don't delete this!
 		c.Close()
 		return nil, err
@@ -117,23 +199,76 @@ func (c *StatsCollector) registerAndCreateMetrics() error {
 	if err != nil {
 		return err
 	}
+	c.ErrorClassKey, err = tag.NewKey("error_class")
+	if err != nil {
+		return err
+	}
+	c.SourceTypeKey, err = tag.NewKey("source_type")
+	if err != nil {
+		return err
+	}
+	c.DestinationKey, err = tag.NewKey("destination_project")
+	if err != nil {
+		return err
+	}
+	c.DiscrepancyKey, err = tag.NewKey("discrepancy")
+	if err != nil {
+		return err
+	}
+	c.OverflowPolicyKey, err = tag.NewKey("overflow_policy")
+	if err != nil {
+		return err
+	}
+	c.FuturePointPolicyKey, err = tag.NewKey("future_point_policy")
+	if err != nil {
+		return err
+	}
+	c.ThresholdKey, err = tag.NewKey("threshold")
+	if err != nil {
+		return err
+	}
 
 	c.MetricImportLatency = stats.Int64("ts_bridge/metric_import_latencies", "time since last successful import for a metric", stats.UnitMilliseconds)
 	c.TotalImportLatency = stats.Int64("ts_bridge/import_latencies", "total time it took to import all metrics", stats.UnitMilliseconds)
 	c.OldestMetricAge = stats.Int64("ts_bridge/oldest_metric_age", "oldest time since last successful import across all metrics", stats.UnitMilliseconds)
+	c.MetricAge = stats.Int64("ts_bridge/metric_age", "time since last successful import of a metric", stats.UnitMilliseconds)
+	c.StaleMetrics = stats.Int64("ts_bridge/metrics_stale_total", "number of metrics that have not been imported for longer than a threshold", stats.UnitDimensionless)
+	c.Heartbeats = stats.Int64("ts_bridge/heartbeats", "number of syncs of metrics written to a destination project", stats.UnitDimensionless)
+	c.MetricMissingPoints = stats.Int64("ts_bridge/metric_missing_points", "number of points missing in gaps of the last import for a metric", stats.UnitDimensionless)
+	c.ImportLag = stats.Int64("ts_bridge/import_lag", "how far the newest point written for a metric lags behind the newest point returned by its source", stats.UnitMilliseconds)
+	c.MetricSkips = stats.Int64("ts_bridge/metric_skips", "number of metric updates skipped because the source host was failing", stats.UnitDimensionless)
+	c.MaintenanceSkips = stats.Int64("ts_bridge/metric_maintenance_skips", "number of metric updates skipped during maintenance windows", stats.UnitDimensionless)
+	c.PendingPoints = stats.Int64("ts_bridge/pending_points", "number of points kept for the next update after failing to write them to Stackdriver", stats.UnitDimensionless)
+	c.MetricDeferrals = stats.Int64("ts_bridge/metric_deferrals", "number of metric updates deferred to a later sync", stats.UnitDimensionless)
+	c.MetricUpdateErrors = stats.Int64("ts_bridge/metric_update_errors", "number of failed metric updates by error class", stats.UnitDimensionless)
+	c.SourceLatency = stats.Int64("ts_bridge/source_latencies", "time it took to query the source of a metric", stats.UnitMilliseconds)
+	c.WriteLatency = stats.Int64("ts_bridge/write_latencies", "time it took to write points of a metric to Stackdriver", stats.UnitMilliseconds)
+	c.LabelSanitizations = stats.Int64("ts_bridge/label_sanitizations", "number of labels sanitized to fit Stackdriver limits", stats.UnitDimensionless)
+	c.WriteCalls = stats.Int64("ts_bridge/sd_write_calls", "number of CreateTimeSeries calls made to Stackdriver", stats.UnitDimensionless)
+	c.WriteBytes = stats.Int64("ts_bridge/sd_write_request_bytes", "size of CreateTimeSeries requests made to Stackdriver", stats.UnitBytes)
+	c.WritePoints = stats.Int64("ts_bridge/sd_write_points", "number of points in CreateTimeSeries requests made to Stackdriver", stats.UnitDimensionless)
+	c.WriteQuotaErrors = stats.Int64("ts_bridge/sd_write_quota_errors", "number of CreateTimeSeries calls rejected because a Stackdriver quota was exceeded", stats.UnitDimensionless)
+	c.WriteDiscrepancies = stats.Int64("ts_bridge/write_discrepancies", "number of written points that were missing or had a different value when read back from Stackdriver", stats.UnitDimensionless)
+	c.DroppedPoints = stats.Int64("ts_bridge/dropped_points", "number of points dropped or downsampled by push sources because their buffer was full", stats.UnitDimensionless)
+	c.FuturePoints = stats.Int64("ts_bridge/future_points", "number of points timestamped further in the future than the allowed clock skew", stats.UnitDimensionless)
+	c.SourceAPICalls = stats.Int64("ts_bridge/source_api_calls", "number of API calls made to the source of a metric", stats.UnitDimensionless)
+	c.StackdriverAPICalls = stats.Int64("ts_bridge/metric_sd_api_calls", "number of Stackdriver API calls made by updates of a metric", stats.UnitDimensionless)
+	c.MetricPointsWritten = stats.Int64("ts_bridge/metric_points_written", "number of points of a metric written to Stackdriver", stats.UnitDimensionless)
+	metricKeys := []tag.Key{c.MetricKey, c.SourceTypeKey, c.DestinationKey}
+	destinationKeys := []tag.Key{c.DestinationKey}
 	c.views = []*view.View{
 		&view.View{
 			Name:        c.MetricImportLatency.Name(),
 			Description: c.MetricImportLatency.Description(),
 			Measure:     c.MetricImportLatency,
-			Aggregation: latencyDistribution,
-			TagKeys:     []tag.Key{c.MetricKey},
+			Aggregation: latencyAggregation(MetricImportLatencyBuckets),
+			TagKeys:     metricKeys,
 		},
 		&view.View{
 			Name:        c.TotalImportLatency.Name(),
 			Description: c.TotalImportLatency.Description(),
 			Measure:     c.TotalImportLatency,
-			Aggregation: latencyDistribution,
+			Aggregation: latencyAggregation(TotalImportLatencyBuckets),
 		},
 		&view.View{
 			Name:        c.OldestMetricAge.Name(),
@@ -141,9 +276,277 @@ func (c *StatsCollector) registerAndCreateMetrics() error {
 			Measure:     c.OldestMetricAge,
 			Aggregation: view.LastValue(),
 		},
+		&view.View{
+			Name:        c.MetricAge.Name(),
+			Description: c.MetricAge.Description(),
+			Measure:     c.MetricAge,
+			Aggregation: view.LastValue(),
+			TagKeys:     metricKeys,
+		},
+		&view.View{
+			Name:        c.StaleMetrics.Name(),
+			Description: c.StaleMetrics.Description(),
+			Measure:     c.StaleMetrics,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{c.ThresholdKey},
+		},
+		&view.View{
+			Name:        c.Heartbeats.Name(),
+			Description: c.Heartbeats.Description(),
+			Measure:     c.Heartbeats,
+			Aggregation: view.Count(),
+			TagKeys:     destinationKeys,
+		},
+		&view.View{
+			Name:        c.MetricMissingPoints.Name(),
+			Description: c.MetricMissingPoints.Description(),
+			Measure:     c.MetricMissingPoints,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{c.MetricKey},
+		},
+		&view.View{
+			Name:        c.ImportLag.Name(),
+			Description: c.ImportLag.Description(),
+			Measure:     c.ImportLag,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{c.MetricKey},
+		},
+		&view.View{
+			Name:        c.MetricSkips.Name(),
+			Description: c.MetricSkips.Description(),
+			Measure:     c.MetricSkips,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{c.MetricKey},
+		},
+		&view.View{
+			Name:        c.MaintenanceSkips.Name(),
+			Description: c.MaintenanceSkips.Description(),
+			Measure:     c.MaintenanceSkips,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{c.MetricKey},
+		},
+		&view.View{
+			Name:        c.PendingPoints.Name(),
+			Description: c.PendingPoints.Description(),
+			Measure:     c.PendingPoints,
+			Aggregation: view.LastValue(),
+			TagKeys:     []tag.Key{c.MetricKey},
+		},
+		&view.View{
+			Name:        c.MetricDeferrals.Name(),
+			Description: c.MetricDeferrals.Description(),
+			Measure:     c.MetricDeferrals,
+			Aggregation: view.Count(),
+			TagKeys:     []tag.Key{c.MetricKey},
+		},
+		&view.View{
+			Name:        c.MetricUpdateErrors.Name(),
+			Description: c.MetricUpdateErrors.Description(),
+			Measure:     c.MetricUpdateErrors,
+			Aggregation: view.Count(),
+			TagKeys:     append(metricKeys, c.ErrorClassKey),
+		},
+		&view.View{
+			Name:        c.SourceLatency.Name(),
+			Description: c.SourceLatency.Description(),
+			Measure:     c.SourceLatency,
+			Aggregation: latencyDistribution,
+			TagKeys:     metricKeys,
+		},
+		&view.View{
+			Name:        c.WriteLatency.Name(),
+			Description: c.WriteLatency.Description(),
+			Measure:     c.WriteLatency,
+			Aggregation: latencyDistribution,
+			TagKeys:     metricKeys,
+		},
+		&view.View{
+			Name:        c.LabelSanitizations.Name(),
+			Description: c.LabelSanitizations.Description(),
+			Measure:     c.LabelSanitizations,
+			Aggregation: view.Sum(),
+			TagKeys:     metricKeys,
+		},
+		&view.View{
+			Name:        c.WriteCalls.Name(),
+			Description: c.WriteCalls.Description(),
+			Measure:     c.WriteCalls,
+			Aggregation: view.Count(),
+			TagKeys:     destinationKeys,
+		},
+		&view.View{
+			Name:        c.WriteBytes.Name(),
+			Description: c.WriteBytes.Description(),
+			Measure:     c.WriteBytes,
+			Aggregation: writeBytesDistribution,
+			TagKeys:     destinationKeys,
+		},
+		&view.View{
+			Name:        c.WritePoints.Name(),
+			Description: c.WritePoints.Description(),
+			Measure:     c.WritePoints,
+			Aggregation: writePointsDistribution,
+			TagKeys:     destinationKeys,
+		},
+		&view.View{
+			Name:        c.WriteQuotaErrors.Name(),
+			Description: c.WriteQuotaErrors.Description(),
+			Measure:     c.WriteQuotaErrors,
+			Aggregation: view.Count(),
+			TagKeys:     destinationKeys,
+		},
+		&view.View{
+			Name:        c.WriteDiscrepancies.Name(),
+			Description: c.WriteDiscrepancies.Description(),
+			Measure:     c.WriteDiscrepancies,
+			Aggregation: view.Sum(),
+			TagKeys:     append(metricKeys, c.DiscrepancyKey),
+		},
+		&view.View{
+			Name:        c.DroppedPoints.Name(),
+			Description: c.DroppedPoints.Description(),
+			Measure:     c.DroppedPoints,
+			Aggregation: view.Sum(),
+			TagKeys:     append(metricKeys, c.OverflowPolicyKey),
+		},
+		&view.View{
+			Name:        c.FuturePoints.Name(),
+			Description: c.FuturePoints.Description(),
+			Measure:     c.FuturePoints,
+			Aggregation: view.Sum(),
+			TagKeys:     append(metricKeys, c.FuturePointPolicyKey),
+		},
+		&view.View{
+			Name:        c.SourceAPICalls.Name(),
+			Description: c.SourceAPICalls.Description(),
+			Measure:     c.SourceAPICalls,
+			Aggregation: view.Sum(),
+			TagKeys:     metricKeys,
+		},
+		&view.View{
+			Name:        c.StackdriverAPICalls.Name(),
+			Description: c.StackdriverAPICalls.Description(),
+			Measure:     c.StackdriverAPICalls,
+			Aggregation: view.Sum(),
+			TagKeys:     metricKeys,
+		},
+		&view.View{
+			Name:        c.MetricPointsWritten.Name(),
+			Description: c.MetricPointsWritten.Description(),
+			Measure:     c.MetricPointsWritten,
+			Aggregation: view.Sum(),
+			TagKeys:     metricKeys,
+		},
 	}
 	if err := view.Register(c.views...); err != nil {
 		return err
 	}
 	return nil
 }
+
+// RecordWrite records stats about a single CreateTimeSeries call made to a given destination project. It can be
+// configured as the write observer of the Stackdriver adapter.
+func (c *StatsCollector) RecordWrite(ctx context.Context, project string, points, bytes int, err error) {
+	ctx, terr := tag.New(ctx, tag.Upsert(c.DestinationKey, project))
+	if terr != nil {
+		log.WithContext(ctx).Errorf("StatsCollector: cannot tag write stats: %v", terr)
+		return
+	}
+	stats.Record(ctx, c.WriteCalls.M(1), c.WriteBytes.M(int64(bytes)), c.WritePoints.M(int64(points)))
+	if errors.Is(err, tserrors.ErrDestinationQuota) {
+		stats.Record(ctx, c.WriteQuotaErrors.M(1))
+	}
+}
+
+// RecordHeartbeats records a heartbeat for each destination project that metrics of a sync are written to, even if
+// none of them had new points. The absence of heartbeats shows that syncs are no longer running.
+func (c *StatsCollector) RecordHeartbeats(ctx context.Context, metrics []*Metric) {
+	seen := make(map[string]bool)
+	for _, m := range metrics {
+		if seen[m.SDProject] {
+			continue
+		}
+		seen[m.SDProject] = true
+		ctx, err := tag.New(ctx, tag.Upsert(c.DestinationKey, m.SDProject))
+		if err != nil {
+			log.WithContext(ctx).Errorf("StatsCollector: cannot tag heartbeat: %v", err)
+			continue
+		}
+		stats.Record(ctx, c.Heartbeats.M(1))
+	}
+}
+
+// RecordMetricAges records the age of each metric (not counting time when no data was expected), along with the
+// number of metrics older than each of StaleMetricThresholds, so that alerts can fire once several metrics are stale
+// rather than only looking at the oldest one. Counts are recorded for all thresholds, even if no metric is stale.
+func (c *StatsCollector) RecordMetricAges(ctx context.Context, metrics []*Metric, now time.Time) {
+	stale := make([]int64, len(StaleMetricThresholds))
+	for _, m := range metrics {
+		age := m.DataAge(now)
+		for i, threshold := range StaleMetricThresholds {
+			if age > threshold {
+				stale[i]++
+			}
+		}
+		ctx, err := tag.New(ctx,
+			tag.Upsert(c.MetricKey, m.Name),
+			tag.Upsert(c.SourceTypeKey, sourceType(m.Source)),
+			tag.Upsert(c.DestinationKey, m.SDProject))
+		if err != nil {
+			log.WithContext(ctx).Errorf("StatsCollector: cannot tag metric age: %v", err)
+			continue
+		}
+		stats.Record(ctx, c.MetricAge.M(int64(age/time.Millisecond)))
+	}
+	for i, threshold := range StaleMetricThresholds {
+		ctx, err := tag.New(ctx, tag.Upsert(c.ThresholdKey, windowLabel(threshold)))
+		if err != nil {
+			log.WithContext(ctx).Errorf("StatsCollector: cannot tag stale metrics: %v", err)
+			continue
+		}
+		stats.Record(ctx, c.StaleMetrics.M(stale[i]))
+	}
+}
+
+// sourceTyper is implemented by source metrics to report the type of their source (e.g. "datadog") in stats.
+type sourceTyper interface {
+	SourceType() string
+}
+
+// sourceType returns the type of the source of a metric, or "unknown" if the source does not report it.
+func sourceType(s SourceMetric) string {
+	if t, ok := s.(sourceTyper); ok {
+		return t.SourceType()
+	}
+	return "unknown"
+}
+
+// overflowReporter is implemented by push sources, which buffer points between syncs, to report points dropped
+// because their buffer was full.
+type overflowReporter interface {
+	// DroppedPoints returns the number of points dropped since the last call, and the overflow policy of the buffer.
+	DroppedPoints() (int, string)
+}
+
+// recordDroppedPoints records points dropped by the buffer of a push source, tagged with its overflow policy.
+func (c *StatsCollector) recordDroppedPoints(ctx context.Context, s SourceMetric) {
+	r, ok := s.(overflowReporter)
+	if !ok {
+		return
+	}
+	dropped, policy := r.DroppedPoints()
+	if dropped == 0 {
+		return
+	}
+	ctx, err := tag.New(ctx, tag.Upsert(c.OverflowPolicyKey, policy))
+	if err != nil {
+		log.WithContext(ctx).Errorf("StatsCollector: cannot tag dropped points: %v", err)
+		return
+	}
+	stats.Record(ctx, c.DroppedPoints.M(int64(dropped)))
+}
+
+// recordLatency records time elapsed since `start` in milliseconds.
+func recordLatency(ctx context.Context, m *stats.Int64Measure, start time.Time) {
+	stats.Record(ctx, m.M(int64(time.Since(start)/time.Millisecond)))
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to writing internal stats to Stackdriver using StackdriverAdapter.
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/genproto/googleapis/api/distribution"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// statsMetricPrefix is the prefix of metric types of internal stats. It matches the prefix used by the OpenCensus
+// Stackdriver exporter, so that switching between exporters keeps writing the same metrics.
+const statsMetricPrefix = "custom.googleapis.com/opencensus/"
+
+// statsTaskLabel identifies the process that wrote a stats time series, like the default label of the OpenCensus
+// Stackdriver exporter. Stackdriver requires each time series to be written by a single process.
+const statsTaskLabel = "opencensus_task"
+
+// adapterExporter is a stats exporter that writes views using StackdriverAdapter. Views are exported by OpenCensus
+// when they are unregistered, and are written to Stackdriver in a single batch when the exporter is flushed.
+type adapterExporter struct {
+	ctx     context.Context
+	project string
+	sd      StackdriverAdapter
+	task    string
+	onError func(error)
+
+	mu     sync.Mutex
+	names  []string
+	views  map[string]*view.Data
+	series map[string][]*monitoringpb.TimeSeries
+}
+
+// newAdapterExporter returns a new exporter that writes stats to a given project. Write errors are reported using
+// `onError`.
+func newAdapterExporter(ctx context.Context, project string, sd StackdriverAdapter, onError func(error)) *adapterExporter {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return &adapterExporter{
+		ctx:     ctx,
+		project: project,
+		sd:      sd,
+		task:    fmt.Sprintf("go-%d@%s", os.Getpid(), hostname),
+		onError: onError,
+		views:   make(map[string]*view.Data),
+		series:  make(map[string][]*monitoringpb.TimeSeries),
+	}
+}
+
+// ExportView converts view data into time series, replacing data previously exported for the same view.
+func (e *adapterExporter) ExportView(d *view.Data) {
+	var series []*monitoringpb.TimeSeries
+	for _, r := range d.Rows {
+		ts, err := e.timeSeries(d, r)
+		if err != nil {
+			e.onError(fmt.Errorf("cannot convert stats of view %s: %v", d.View.Name, err))
+			return
+		}
+		series = append(series, ts)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.views[d.View.Name]; !ok {
+		e.names = append(e.names, d.View.Name)
+	}
+	e.views[d.View.Name] = d
+	e.series[d.View.Name] = series
+}
+
+// Flush writes all exported views to Stackdriver.
+func (e *adapterExporter) Flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, name := range e.names {
+		series := e.series[name]
+		if len(series) == 0 {
+			continue
+		}
+		desc := e.descriptor(e.views[name].View)
+		if err := e.sd.CreateTimeseries(e.ctx, e.project, desc.Type, desc, series); err != nil {
+			e.onError(fmt.Errorf("cannot write stats of view %s: %v", name, err))
+		}
+	}
+	e.names = nil
+	e.views = make(map[string]*view.Data)
+	e.series = make(map[string][]*monitoringpb.TimeSeries)
+}
+
+// descriptor returns the metric descriptor of a view.
+func (e *adapterExporter) descriptor(v *view.View) *metricpb.MetricDescriptor {
+	kind, valueType := statsKind(v)
+	desc := &metricpb.MetricDescriptor{
+		Type:        statsMetricPrefix + v.Name,
+		MetricKind:  kind,
+		ValueType:   valueType,
+		Description: v.Description,
+		DisplayName: "OpenCensus/" + v.Name,
+		Unit:        v.Measure.Unit(),
+		Labels:      []*label.LabelDescriptor{{Key: statsTaskLabel, ValueType: label.LabelDescriptor_STRING}},
+	}
+	for _, k := range v.TagKeys {
+		desc.Labels = append(desc.Labels, &label.LabelDescriptor{Key: k.Name(), ValueType: label.LabelDescriptor_STRING})
+	}
+	return desc
+}
+
+// timeSeries converts a single row of view data into a time series with a single point.
+func (e *adapterExporter) timeSeries(d *view.Data, r *view.Row) (*monitoringpb.TimeSeries, error) {
+	kind, valueType := statsKind(d.View)
+	labels := map[string]string{statsTaskLabel: e.task}
+	for _, t := range r.Tags {
+		labels[t.Key.Name()] = t.Value
+	}
+
+	interval := &monitoringpb.TimeInterval{}
+	var err error
+	if interval.EndTime, err = ptypes.TimestampProto(d.End); err != nil {
+		return nil, err
+	}
+	if kind == metricpb.MetricDescriptor_CUMULATIVE {
+		if interval.StartTime, err = ptypes.TimestampProto(statsStart(d)); err != nil {
+			return nil, err
+		}
+	}
+
+	value, err := statsValue(d.View, r.Data, valueType)
+	if err != nil {
+		return nil, err
+	}
+	return &monitoringpb.TimeSeries{
+		Metric:     &metricpb.Metric{Type: statsMetricPrefix + d.View.Name, Labels: labels},
+		Resource:   &monitoredres.MonitoredResource{Type: "global"},
+		MetricKind: kind,
+		ValueType:  valueType,
+		Points:     []*monitoringpb.Point{{Interval: interval, Value: value}},
+	}, nil
+}
+
+// statsStart returns the start time of cumulative view data. Stackdriver requires start times to be earlier than
+// end times for cumulative points.
+func statsStart(d *view.Data) time.Time {
+	if d.Start.Before(d.End) {
+		return d.Start
+	}
+	return d.End.Add(-time.Millisecond)
+}
+
+// statsKind returns the metric kind and value type of a view, matching what the OpenCensus Stackdriver exporter uses.
+func statsKind(v *view.View) (metricpb.MetricDescriptor_MetricKind, metricpb.MetricDescriptor_ValueType) {
+	valueType := metricpb.MetricDescriptor_DOUBLE
+	if _, ok := v.Measure.(*stats.Int64Measure); ok {
+		valueType = metricpb.MetricDescriptor_INT64
+	}
+	switch v.Aggregation.Type {
+	case view.AggTypeCount:
+		return metricpb.MetricDescriptor_CUMULATIVE, metricpb.MetricDescriptor_INT64
+	case view.AggTypeDistribution:
+		return metricpb.MetricDescriptor_CUMULATIVE, metricpb.MetricDescriptor_DISTRIBUTION
+	case view.AggTypeLastValue:
+		return metricpb.MetricDescriptor_GAUGE, valueType
+	}
+	return metricpb.MetricDescriptor_CUMULATIVE, valueType
+}
+
+// statsValue converts aggregated view data into a Stackdriver value of a given type.
+func statsValue(v *view.View, data view.AggregationData, valueType metricpb.MetricDescriptor_ValueType) (*monitoringpb.TypedValue, error) {
+	var value float64
+	switch d := data.(type) {
+	case *view.CountData:
+		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: d.Value}}, nil
+	case *view.DistributionData:
+		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{DistributionValue: &distribution.Distribution{
+			Count:                 d.Count,
+			Mean:                  d.Mean,
+			SumOfSquaredDeviation: d.SumOfSquaredDev,
+			BucketOptions: &distribution.Distribution_BucketOptions{
+				Options: &distribution.Distribution_BucketOptions_ExplicitBuckets{
+					ExplicitBuckets: &distribution.Distribution_BucketOptions_Explicit{Bounds: v.Aggregation.Buckets},
+				},
+			},
+			BucketCounts: d.CountPerBucket,
+		}}}, nil
+	case *view.SumData:
+		value = d.Value
+	case *view.LastValueData:
+		value = d.Value
+	default:
+		return nil, fmt.Errorf("unsupported aggregation %T", data)
+	}
+	if valueType == metricpb.MetricDescriptor_INT64 {
+		return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: int64(value)}}, nil
+	}
+	return &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}}, nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/mocks"
+
+	"github.com/golang/mock/gomock"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestAdapterCollector(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	written := make(map[string]*monitoringpb.TimeSeries)
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "stats-project", gomock.Any(), gomock.Any(), gomock.Any()).Times(3).DoAndReturn(
+		func(_ context.Context, _, name string, desc *metricpb.MetricDescriptor, series []*monitoringpb.TimeSeries) error {
+			if desc.Type != name {
+				t.Errorf("expected descriptor of %s; got %s", name, desc.Type)
+			}
+			if len(series) != 1 {
+				t.Errorf("expected a single time series for %s; got %v", name, series)
+			}
+			written[name] = series[0]
+			return nil
+		})
+
+	c, err := NewAdapterCollector(ctx, "stats-project", mockSD)
+	if err != nil {
+		t.Fatalf("NewAdapterCollector() returned error: %v", err)
+	}
+	tagCtx, err := tag.New(ctx, tag.Insert(c.MetricKey, "metric1"), tag.Insert(c.SourceTypeKey, "datadog"), tag.Insert(c.DestinationKey, "sd-project"))
+	if err != nil {
+		c.Close()
+		t.Fatalf("cannot create tags: %v", err)
+	}
+	stats.Record(tagCtx, c.MetricSkips.M(1))
+	stats.Record(tagCtx, c.MetricSkips.M(1))
+	stats.Record(tagCtx, c.SourceLatency.M(300))
+	stats.Record(ctx, c.OldestMetricAge.M(5000))
+	c.Close()
+
+	for _, tt := range []struct {
+		name   string
+		kind   metricpb.MetricDescriptor_MetricKind
+		labels map[string]string
+		check  func(*monitoringpb.TypedValue) bool
+	}{
+		{"ts_bridge/metric_skips", metricpb.MetricDescriptor_CUMULATIVE, map[string]string{"metric_name": "metric1"},
+			func(v *monitoringpb.TypedValue) bool { return v.GetInt64Value() == 2 }},
+		{"ts_bridge/source_latencies", metricpb.MetricDescriptor_CUMULATIVE, map[string]string{"metric_name": "metric1", "source_type": "datadog", "destination_project": "sd-project"},
+			func(v *monitoringpb.TypedValue) bool {
+				d := v.GetDistributionValue()
+				return d.GetCount() == 1 && d.GetMean() == 300 && d.GetBucketCounts()[2] == 1
+			}},
+		{"ts_bridge/oldest_metric_age", metricpb.MetricDescriptor_GAUGE, map[string]string{},
+			func(v *monitoringpb.TypedValue) bool { return v.GetInt64Value() == 5000 }},
+	} {
+		ts, ok := written[statsMetricPrefix+tt.name]
+		if !ok {
+			t.Errorf("expected %s to be written; got %v", tt.name, written)
+			continue
+		}
+		if ts.MetricKind != tt.kind {
+			t.Errorf("expected %s to be %v; got %v", tt.name, tt.kind, ts.MetricKind)
+		}
+		for k, v := range tt.labels {
+			if ts.Metric.Labels[k] != v {
+				t.Errorf("expected %s to have label %s=%s; got %v", tt.name, k, v, ts.Metric.Labels)
+			}
+		}
+		if ts.Metric.Labels[statsTaskLabel] == "" {
+			t.Errorf("expected %s to have label %s; got %v", tt.name, statsTaskLabel, ts.Metric.Labels)
+		}
+		p := ts.Points[0]
+		if tt.kind == metricpb.MetricDescriptor_CUMULATIVE && !p.Interval.StartTime.AsTime().Before(p.Interval.EndTime.AsTime()) {
+			t.Errorf("expected %s to have a start time before its end time; got %v", tt.name, p.Interval)
+		}
+		if p.Interval.EndTime.AsTime().After(time.Now()) || !tt.check(p.Value) {
+			t.Errorf("unexpected point of %s: %v", tt.name, p)
+		}
+	}
+}
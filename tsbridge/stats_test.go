@@ -0,0 +1,83 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/datastore"
+
+	"go.opencensus.io/stats/view"
+)
+
+func TestLatencyBuckets(t *testing.T) {
+	defer func() { MetricImportLatencyBuckets, TotalImportLatencyBuckets = nil, nil }()
+	MetricImportLatencyBuckets = []float64{10, 50, 100}
+
+	collector, _ := fakeStats(t)
+	defer collector.Close()
+	for _, tt := range []struct {
+		view string
+		want []float64
+	}{
+		{"ts_bridge/metric_import_latencies", []float64{10, 50, 100}},
+		{"ts_bridge/import_latencies", latencyDistribution.Buckets},
+		{"ts_bridge/source_latencies", latencyDistribution.Buckets},
+	} {
+		v := view.Find(tt.view)
+		if v == nil {
+			t.Errorf("expected view %s to be registered", tt.view)
+			continue
+		}
+		if got := v.Aggregation.Buckets; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expected buckets of %s to be %v; got %v", tt.view, tt.want, got)
+		}
+	}
+}
+
+func TestRecordMetricAges(t *testing.T) {
+	collector, exporter := fakeStats(t)
+	now := time.Now()
+	var metrics []*Metric
+	for name, age := range map[string]time.Duration{"fresh": time.Minute, "late": 10 * time.Minute, "stale": 2 * time.Hour} {
+		metrics = append(metrics, &Metric{
+			Name:      name,
+			SDProject: "sd-project",
+			Record:    &datastore.StoredMetricRecord{LastUpdate: now.Add(-age)},
+		})
+	}
+	collector.RecordMetricAges(context.Background(), metrics, now)
+	collector.Close()
+
+	for name, want := range map[string]int64{
+		"ts_bridge/metric_age:sd-project:fresh:unknown": int64(time.Minute / time.Millisecond),
+		"ts_bridge/metric_age:sd-project:stale:unknown": int64(2 * time.Hour / time.Millisecond),
+		"ts_bridge/metrics_stale_total:5m":              2,
+		"ts_bridge/metrics_stale_total:15m":             1,
+		"ts_bridge/metrics_stale_total:1h":              1,
+	} {
+		val, ok := exporter.values[name]
+		if !ok {
+			t.Errorf("expected to see %s recorded; got %v", name, exporter.values)
+			continue
+		}
+		if got := int64(val.(*view.LastValueData).Value); got != want {
+			t.Errorf("expected %s to be %d; got %d", name, want, got)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to evaluating threshold rules on imported points and sending notifications.
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/google/ts-bridge/notify"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// ThresholdRule sends a notification when imported points of a metric breach a threshold for a number of
+// consecutive points, and another one when the threshold is no longer breached. Rules are evaluated at import time,
+// which is useful while alerting is not configured in Stackdriver yet (e.g. during migrations).
+type ThresholdRule struct {
+	Name  string `validate:"regexp=^[A-Za-z0-9]\\w*$"`
+	Above *float64
+	Below *float64
+	// For is the number of consecutive points that need to breach the threshold. Defaults to 1.
+	For     int    `validate:"min=0"`
+	Channel string `validate:"nonzero"`
+}
+
+// validate checks rule parameters that cannot be verified using struct tags.
+func (r *ThresholdRule) validate() error {
+	if r.Above == nil && r.Below == nil {
+		return fmt.Errorf("threshold rule '%s' must set above or below", r.Name)
+	}
+	return nil
+}
+
+// breached returns true if a value breaches the threshold.
+func (r *ThresholdRule) breached(v float64) bool {
+	return (r.Above != nil && v > *r.Above) || (r.Below != nil && v < *r.Below)
+}
+
+// points returns the number of consecutive points that need to breach the threshold for the rule to fire.
+func (r *ThresholdRule) points() int {
+	if r.For <= 0 {
+		return 1
+	}
+	return r.For
+}
+
+// describe returns a human-readable description of the threshold.
+func (r *ThresholdRule) describe() string {
+	var conds []string
+	if r.Above != nil {
+		conds = append(conds, fmt.Sprintf("above %v", *r.Above))
+	}
+	if r.Below != nil {
+		conds = append(conds, fmt.Sprintf("below %v", *r.Below))
+	}
+	return fmt.Sprintf("%s for %d points", strings.Join(conds, " or "), r.points())
+}
+
+// evaluateThresholds evaluates threshold rules of the metric on new points in time order, notifying the configured
+// channels of rules that started or stopped firing. For metrics with several time series, points of all time series
+// are evaluated together. The number of consecutive breaching points is kept in the metric record, and is only
+// updated if all notifications have been sent, so that failed notifications are retried during the next update.
+func (m *Metric) evaluateThresholds(ctx context.Context, series []*monitoringpb.TimeSeries) error {
+	rules := m.Options.Thresholds
+	if len(rules) == 0 {
+		return nil
+	}
+	var points []valuePoint
+	for _, ts := range series {
+		for _, p := range ts.Points {
+			end, err := ptypes.Timestamp(p.GetInterval().GetEndTime())
+			if err != nil {
+				return fmt.Errorf("could not parse point timestamp for %v: %v", p, err)
+			}
+			points = append(points, valuePoint{end: end, value: pointValue(p)})
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].end.Before(points[j].end) })
+
+	old := m.Record.GetThresholdStreaks()
+	streaks := make([]int, len(rules))
+	copy(streaks, old)
+	var errs []string
+	for i, r := range rules {
+		for _, p := range points {
+			wasFiring := streaks[i] >= r.points()
+			if r.breached(p.value) {
+				streaks[i]++
+			} else {
+				streaks[i] = 0
+			}
+			firing := streaks[i] >= r.points()
+			if firing == wasFiring {
+				continue
+			}
+			n := &notify.Notification{Metric: m.Name, Rule: r.Name, Value: p.value, Timestamp: p.end, Resolved: !firing}
+			if firing {
+				n.Text = fmt.Sprintf("%s: rule %s is firing, value %v is %s", m.Name, r.Name, p.value, r.describe())
+			} else {
+				n.Text = fmt.Sprintf("%s: rule %s is resolved, value is %v", m.Name, r.Name, p.value)
+			}
+			log.WithContext(ctx).Infof("Sending notification to channel %s: %s", r.Channel, n.Text)
+			if err := m.Notifiers[r.Channel].Notify(ctx, n); err != nil {
+				errs = append(errs, fmt.Sprintf("channel %s: %v", r.Channel, err))
+			}
+		}
+	}
+	if errs != nil {
+		return fmt.Errorf("failed to send notifications: %s", strings.Join(errs, "; "))
+	}
+	if reflect.DeepEqual(streaks, old) {
+		return nil
+	}
+	return m.Record.SetThresholdStreaks(ctx, streaks)
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/datastore"
+	"github.com/google/ts-bridge/mocks"
+	"github.com/google/ts-bridge/notify"
+
+	"github.com/golang/mock/gomock"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+// fakeNotifier records notifications, optionally failing to send them.
+type fakeNotifier struct {
+	sent    []*notify.Notification
+	imports []*notify.ImportNotification
+	err     error
+}
+
+func (n *fakeNotifier) Notify(_ context.Context, notification *notify.Notification) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.sent = append(n.sent, notification)
+	return nil
+}
+
+func (n *fakeNotifier) NotifyImport(_ context.Context, notification *notify.ImportNotification) error {
+	if n.err != nil {
+		return n.err
+	}
+	n.imports = append(n.imports, notification)
+	return nil
+}
+
+func thresholdMetric(t *testing.T, ctx context.Context, name string, rules ...*ThresholdRule) (*Metric, *fakeNotifier) {
+	mockCtrl := gomock.NewController(t)
+	mockSource := mocks.NewMockSourceMetric(mockCtrl)
+	mockSource.EXPECT().Query()
+	mockSource.EXPECT().StackdriverName().AnyTimes().Return("sd-metricname")
+	m, err := NewMetric(ctx, name, mockSource, "sd-project", datastore.New(ctx, &datastore.Options{}))
+	if err != nil {
+		t.Fatalf("error while creating metric: %v", err)
+	}
+	n := &fakeNotifier{}
+	m.Options.Thresholds = rules
+	m.Notifiers = map[string]notify.Notifier{"oncall": n}
+	return m, n
+}
+
+func TestEvaluateThresholds(t *testing.T) {
+	ctx := context.Background()
+	above := 10.0
+	m, n := thresholdMetric(t, ctx, "threshold_metric", &ThresholdRule{Name: "high", Above: &above, For: 2, Channel: "oncall"})
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	// A single breaching point is not enough to fire.
+	if err := m.evaluateThresholds(ctx, gaugeSeries(start, time.Minute, 5, 11)); err != nil {
+		t.Fatalf("evaluateThresholds() returned error: %v", err)
+	}
+	if len(n.sent) != 0 {
+		t.Errorf("expected no notifications; got %v", n.sent)
+	}
+	if got := m.Record.GetThresholdStreaks(); !reflect.DeepEqual(got, []int{1}) {
+		t.Errorf("expected streaks [1] to be persisted; got %v", got)
+	}
+
+	// The streak continues across updates; the rule fires once and then resolves.
+	if err := m.evaluateThresholds(ctx, gaugeSeries(start.Add(2*time.Minute), time.Minute, 12, 13, 3)); err != nil {
+		t.Fatalf("evaluateThresholds() returned error: %v", err)
+	}
+	if len(n.sent) != 2 {
+		t.Fatalf("expected 2 notifications; got %v", n.sent)
+	}
+	if n.sent[0].Resolved || n.sent[0].Value != 12 || n.sent[0].Rule != "high" || n.sent[0].Metric != "threshold_metric" {
+		t.Errorf("unexpected firing notification %+v", n.sent[0])
+	}
+	if !n.sent[1].Resolved || n.sent[1].Value != 3 {
+		t.Errorf("unexpected resolved notification %+v", n.sent[1])
+	}
+	if got := m.Record.GetThresholdStreaks(); !reflect.DeepEqual(got, []int{0}) {
+		t.Errorf("expected streaks [0] to be persisted; got %v", got)
+	}
+}
+
+func TestEvaluateThresholdsNotificationError(t *testing.T) {
+	ctx := context.Background()
+	below := 1.0
+	m, n := thresholdMetric(t, ctx, "threshold_error_metric", &ThresholdRule{Name: "low", Below: &below, Channel: "oncall"})
+	n.err = errors.New("webhook is down")
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	err := m.evaluateThresholds(ctx, gaugeSeries(start, time.Minute, 0))
+	if err == nil || !strings.Contains(err.Error(), "webhook is down") {
+		t.Errorf("expected evaluateThresholds() to return notification error; got %v", err)
+	}
+	if got := m.Record.GetThresholdStreaks(); len(got) != 0 {
+		t.Errorf("expected streaks not to be persisted after a failed notification; got %v", got)
+	}
+
+	// The notification is sent during the next evaluation.
+	n.err = nil
+	if err := m.evaluateThresholds(ctx, gaugeSeries(start.Add(time.Minute), time.Minute, 0)); err != nil {
+		t.Fatalf("evaluateThresholds() returned error: %v", err)
+	}
+	if len(n.sent) != 1 || n.sent[0].Resolved {
+		t.Errorf("expected a single firing notification; got %v", n.sent)
+	}
+}
+
+func TestMetricUpdateThresholds(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	above := 1.0
+	m, n := thresholdMetric(t, ctx, "threshold_update_metric", &ThresholdRule{Name: "high", Above: &above, Channel: "oncall"})
+	mockSource := m.Source.(*mocks.MockSourceMetric)
+
+	latest := time.Now().Add(-time.Hour)
+	desc := &metricpb.MetricDescriptor{Type: "sd-metricname"}
+	ts := gaugeSeries(latest.Add(time.Minute), time.Minute, 1, 2)
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	mockSource.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(desc, ts, nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", desc, ts).Return(nil)
+
+	collector, _ := fakeStats(t)
+	err := m.Update(ctx, mockSD, collector)
+	collector.Close()
+	if err != nil {
+		t.Fatalf("Metric.Update() returned error %v", err)
+	}
+	if len(n.sent) != 1 || n.sent[0].Value != 2 {
+		t.Errorf("expected a single notification for value 2; got %v", n.sent)
+	}
+}
+
+func TestMetricUpdateThresholdsNotificationError(t *testing.T) {
+	ctx := context.Background()
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	above := 1.0
+	m, n := thresholdMetric(t, ctx, "threshold_update_error_metric", &ThresholdRule{Name: "high", Above: &above, Channel: "oncall"})
+	n.err = errors.New("webhook is down")
+	mockSource := m.Source.(*mocks.MockSourceMetric)
+
+	latest := time.Now().Add(-time.Hour)
+	desc := &metricpb.MetricDescriptor{Type: "sd-metricname"}
+	ts := gaugeSeries(latest.Add(time.Minute), time.Minute, 1, 2)
+	mockSD := mocks.NewMockStackdriverAdapter(mockCtrl)
+	mockSD.EXPECT().LatestTimestamp(gomock.Any(), "sd-project", "sd-metricname").Return(latest, nil)
+	mockSource.EXPECT().StackdriverData(gomock.Any(), latest, gomock.Any()).Return(desc, ts, nil)
+	mockSD.EXPECT().CreateTimeseries(gomock.Any(), "sd-project", "sd-metricname", desc, ts).Return(nil)
+
+	collector, _ := fakeStats(t)
+	err := m.Update(ctx, mockSD, collector)
+	collector.Close()
+	if err != nil {
+		t.Fatalf("expected Metric.Update() to succeed after writing points; got %v", err)
+	}
+	if status := m.Record.GetLastStatus(); !strings.Contains(status, "2 new points found") {
+		t.Errorf("expected written points to be recorded; got status %q", status)
+	}
+	if got := m.Record.GetThresholdStreaks(); len(got) != 0 {
+		t.Errorf("expected streaks not to be persisted after a failed notification; got %v", got)
+	}
+}
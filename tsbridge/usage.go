@@ -0,0 +1,74 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to attributing API calls and written points to metrics.
+package tsbridge
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/ts-bridge/usage"
+
+	"go.opencensus.io/stats"
+)
+
+// dailyUsage keeps API usage of each metric since the start of the current day (in UTC) for the status page. Like
+// in-flight updates, it only covers updates run by this process.
+var dailyUsage = struct {
+	sync.Mutex
+	day    string
+	counts map[string]usage.Counts
+}{counts: make(map[string]usage.Counts)}
+
+// usageKey identifies a metric in dailyUsage, since metrics of different tenants can have the same name.
+func usageKey(m *Metric) string {
+	return m.Tenant + "/" + m.Name
+}
+
+// recordUsage records API usage of a metric update in stats and adds it to daily usage of the metric.
+func (m *Metric) recordUsage(ctx context.Context, s *StatsCollector, c usage.Counts, now time.Time) {
+	if c == (usage.Counts{}) {
+		return
+	}
+	stats.Record(ctx, s.SourceAPICalls.M(c.SourceCalls), s.StackdriverAPICalls.M(c.StackdriverCalls), s.MetricPointsWritten.M(c.PointsWritten))
+
+	day := now.UTC().Format("2006-01-02")
+	dailyUsage.Lock()
+	defer dailyUsage.Unlock()
+	if dailyUsage.day != day {
+		dailyUsage.day = day
+		dailyUsage.counts = make(map[string]usage.Counts)
+	}
+	key := usageKey(m)
+	dailyUsage.counts[key] = dailyUsage.counts[key].Add(c)
+}
+
+// UsageToday returns the source API calls, Stackdriver API calls and points written by updates of a metric since
+// the start of the current day in UTC.
+func (m *Metric) UsageToday() usage.Counts {
+	return m.usageOn(time.Now())
+}
+
+// usageOn returns daily usage of a metric if `now` is on the day that is being tracked.
+func (m *Metric) usageOn(now time.Time) usage.Counts {
+	dailyUsage.Lock()
+	defer dailyUsage.Unlock()
+	if dailyUsage.day != now.UTC().Format("2006-01-02") {
+		return usage.Counts{}
+	}
+	return dailyUsage.counts[usageKey(m)]
+}
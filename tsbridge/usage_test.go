@@ -0,0 +1,71 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/usage"
+
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+func TestRecordUsage(t *testing.T) {
+	dailyUsage.Lock()
+	dailyUsage.day = ""
+	dailyUsage.Unlock()
+
+	collector, exporter := fakeStats(t)
+	ctx, err := tag.New(context.Background(), tag.Insert(collector.MetricKey, "m1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Metric{Name: "m1", Tenant: "team-a"}
+	other := &Metric{Name: "m1", Tenant: "team-b"}
+	day := time.Date(2020, 5, 1, 23, 0, 0, 0, time.UTC)
+	m.recordUsage(ctx, collector, usage.Counts{SourceCalls: 2, StackdriverCalls: 1, PointsWritten: 10}, day)
+	m.recordUsage(ctx, collector, usage.Counts{SourceCalls: 1, StackdriverCalls: 2, PointsWritten: 5}, day.Add(90*time.Minute))
+	collector.Close()
+
+	for name, want := range map[string]float64{
+		"ts_bridge/source_api_calls:m1":      3,
+		"ts_bridge/metric_sd_api_calls:m1":   3,
+		"ts_bridge/metric_points_written:m1": 15,
+	} {
+		val, ok := exporter.values[name]
+		if !ok {
+			t.Errorf("%s not recorded; got %v", name, exporter.values)
+			continue
+		}
+		if got := val.(*view.SumData).Value; got != want {
+			t.Errorf("%s = %v; want %v", name, got, want)
+		}
+	}
+
+	// The second update happened on the next day in UTC, so only its usage is kept.
+	want := usage.Counts{SourceCalls: 1, StackdriverCalls: 2, PointsWritten: 5}
+	if got := m.usageOn(day.Add(2 * time.Hour)); got != want {
+		t.Errorf("usageOn() = %+v; want %+v", got, want)
+	}
+	if got := other.usageOn(day.Add(2 * time.Hour)); got != (usage.Counts{}) {
+		t.Errorf("usageOn() of another tenant = %+v; want no usage", got)
+	}
+	if got := m.usageOn(day.Add(25 * time.Hour)); got != (usage.Counts{}) {
+		t.Errorf("usageOn() of a later day = %+v; want no usage", got)
+	}
+}
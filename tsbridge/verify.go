@@ -0,0 +1,166 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tsbridge deals with Time Series Bridge configuration files and metric representations.
+// This file has code related to verifying written points by reading them back from Stackdriver.
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/tag"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// Kinds of discrepancies between written points and points read back from Stackdriver.
+const (
+	discrepancyMissing  = "missing"
+	discrepancyMismatch = "mismatch"
+)
+
+// Written points might not be visible to reads right away, so read-backs are retried while points are missing.
+// These are variables to allow tests to override them.
+var (
+	verifyAttempts = 3
+	verifyBackoff  = 2 * time.Second
+)
+
+// pointReader is implemented by Stackdriver adapters that can read points back after writing them.
+type pointReader interface {
+	ReadPoints(ctx context.Context, project, name string, start, end time.Time) ([]*monitoringpb.TimeSeries, error)
+}
+
+// writtenPoint identifies a single point of a time series.
+type writtenPoint struct {
+	series string
+	end    int64 // in milliseconds, since Stackdriver does not keep more precision.
+}
+
+// verifyWrites reads points of the interval that has just been written back from Stackdriver, and records points
+// that are missing or have a different value in stats. Verification is best effort: failed reads are logged, but
+// do not fail the update.
+func (m *Metric) verifyWrites(ctx context.Context, sd StackdriverAdapter, s *StatsCollector, written []*monitoringpb.TimeSeries) {
+	if p, ok := sd.(*prefetchedAdapter); ok {
+		sd = p.StackdriverAdapter
+	}
+	reader, ok := sd.(pointReader)
+	if !ok {
+		log.WithContext(ctx).Debugf("%s: Stackdriver adapter cannot read points back, skipping verification", m.Name)
+		return
+	}
+	want, start, end, err := pointsByKey(written)
+	if err != nil {
+		log.WithContext(ctx).Warningf("%s: cannot verify written points: %v", m.Name, err)
+		return
+	}
+
+	var missing, mismatched int
+	for attempt := 1; ; attempt++ {
+		// The interval is widened slightly, since Stackdriver only matches points that end within it.
+		read, err := reader.ReadPoints(ctx, m.SDProject, m.Source.StackdriverName(), start.Add(-time.Second), end.Add(time.Second))
+		if err != nil {
+			log.WithContext(ctx).Warningf("%s: cannot read written points back from Stackdriver: %v", m.Name, err)
+			return
+		}
+		got, _, _, err := pointsByKey(read)
+		if err != nil {
+			log.WithContext(ctx).Warningf("%s: cannot verify written points: %v", m.Name, err)
+			return
+		}
+		missing, mismatched = comparePoints(want, got)
+		if missing == 0 || attempt >= verifyAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(verifyBackoff):
+		}
+	}
+	if missing == 0 && mismatched == 0 {
+		log.WithContext(ctx).Debugf("%s: verified %d written points", m.Name, len(want))
+		return
+	}
+	log.WithContext(ctx).Warningf("%s: %d of %d written points are missing in Stackdriver and %d have a different value",
+		m.Name, missing, len(want), mismatched)
+	for kind, n := range map[string]int{discrepancyMissing: missing, discrepancyMismatch: mismatched} {
+		if n == 0 {
+			continue
+		}
+		tctx, err := tag.New(ctx, tag.Upsert(s.DiscrepancyKey, kind))
+		if err != nil {
+			log.WithContext(ctx).Errorf("StatsCollector: cannot tag discrepancy stats: %v", err)
+			return
+		}
+		stats.Record(tctx, s.WriteDiscrepancies.M(int64(n)))
+	}
+}
+
+// pointsByKey indexes points of time series by the series they belong to and their end time. It also returns the
+// earliest and latest end time of all points.
+func pointsByKey(series []*monitoringpb.TimeSeries) (map[writtenPoint]*monitoringpb.Point, time.Time, time.Time, error) {
+	points := make(map[writtenPoint]*monitoringpb.Point)
+	var start, end time.Time
+	for _, ts := range series {
+		// Stackdriver adds labels to monitored resources (e.g. the project), so series are only identified by metric
+		// labels.
+		key := proto.CompactTextString(ts.Metric)
+		for _, p := range ts.Points {
+			t, err := ptypes.Timestamp(p.GetInterval().GetEndTime())
+			if err != nil {
+				return nil, start, end, fmt.Errorf("could not parse point timestamp for %v: %v", p, err)
+			}
+			points[writtenPoint{key, t.UnixNano() / int64(time.Millisecond)}] = p
+			if start.IsZero() || t.Before(start) {
+				start = t
+			}
+			if t.After(end) {
+				end = t
+			}
+		}
+	}
+	return points, start, end, nil
+}
+
+// comparePoints returns the number of points in `want` that are missing in `got`, and the number of points that
+// have a different value.
+func comparePoints(want, got map[writtenPoint]*monitoringpb.Point) (missing, mismatched int) {
+	for key, w := range want {
+		g, ok := got[key]
+		if !ok {
+			missing++
+		} else if !sameValue(w, g) {
+			mismatched++
+		}
+	}
+	return missing, mismatched
+}
+
+// sameValue checks whether two points have the same value. Distributions are only compared by their count, and
+// double values are allowed to differ by rounding errors.
+func sameValue(a, b *monitoringpb.Point) bool {
+	if da := a.GetValue().GetDistributionValue(); da != nil {
+		db := b.GetValue().GetDistributionValue()
+		return db != nil && da.Count == db.Count
+	}
+	va, vb := pointValue(a), pointValue(b)
+	return va == vb || math.Abs(va-vb) <= 1e-9*math.Max(math.Abs(va), math.Abs(vb))
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsbridge
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/mocks"
+
+	"github.com/golang/mock/gomock"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	monitoredres "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// readingAdapter adds read-backs to a mock Stackdriver adapter. Each call returns the next element of `reads`.
+type readingAdapter struct {
+	*mocks.MockStackdriverAdapter
+	reads [][]*monitoringpb.TimeSeries
+	err   error
+	calls int
+}
+
+func (a *readingAdapter) ReadPoints(ctx context.Context, project, name string, start, end time.Time) ([]*monitoringpb.TimeSeries, error) {
+	a.calls++
+	if a.err != nil {
+		return nil, a.err
+	}
+	read := a.reads[0]
+	if len(a.reads) > 1 {
+		a.reads = a.reads[1:]
+	}
+	// Stackdriver adds labels to monitored resources.
+	for _, ts := range read {
+		ts.Resource = &monitoredres.MonitoredResource{Type: "global", Labels: map[string]string{"project_id": project}}
+	}
+	return read, nil
+}
+
+func TestVerifyWrites(t *testing.T) {
+	defer func(backoff time.Duration) { verifyBackoff = backoff }(verifyBackoff)
+	verifyBackoff = time.Millisecond
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	written := gaugeSeries(start, time.Minute, 1, 2, 3)
+
+	for _, tt := range []struct {
+		desc      string
+		reads     [][]*monitoringpb.TimeSeries
+		err       error
+		wantCalls int
+		want      map[string]int64
+	}{
+		{"all points are found", [][]*monitoringpb.TimeSeries{gaugeSeries(start, time.Minute, 1, 2, 3)}, nil, 1, nil},
+		{"missing points are read again", [][]*monitoringpb.TimeSeries{
+			gaugeSeries(start, time.Minute, 1), gaugeSeries(start, time.Minute, 1, 2, 3),
+		}, nil, 2, nil},
+		{"points are still missing", [][]*monitoringpb.TimeSeries{gaugeSeries(start, time.Minute, 1)}, nil, verifyAttempts,
+			map[string]int64{discrepancyMissing: 2}},
+		{"values are different", [][]*monitoringpb.TimeSeries{gaugeSeries(start, time.Minute, 1, 2.5, 3)}, nil, 1,
+			map[string]int64{discrepancyMismatch: 1}},
+		{"read errors are ignored", nil, fmt.Errorf("permission denied"), 1, nil},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mockSource := mocks.NewMockSourceMetric(mockCtrl)
+			mockSource.EXPECT().StackdriverName().AnyTimes().Return("custom.googleapis.com/test")
+			m := &Metric{Name: "verified_metric", Source: mockSource, SDProject: "sd-project"}
+			sd := &readingAdapter{MockStackdriverAdapter: mocks.NewMockStackdriverAdapter(mockCtrl), reads: tt.reads, err: tt.err}
+
+			collector, exporter := fakeStats(t)
+			defer collector.Close()
+			ctx, err := tag.New(context.Background(), tag.Insert(collector.MetricKey, m.Name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Verification also works for metrics with prefetched latest timestamps.
+			m.verifyWrites(ctx, &prefetchedAdapter{StackdriverAdapter: sd}, collector, written)
+			view.Unregister(collector.views...)
+
+			if sd.calls != tt.wantCalls {
+				t.Errorf("expected %d read-backs; got %d", tt.wantCalls, sd.calls)
+			}
+			for _, kind := range []string{discrepancyMissing, discrepancyMismatch} {
+				key := fmt.Sprintf("ts_bridge/write_discrepancies:%s:verified_metric", kind)
+				val, ok := exporter.values[key]
+				if want, wantOK := tt.want[kind]; wantOK != ok {
+					t.Errorf("expected %s to be recorded: %v; got %v", key, wantOK, exporter.values)
+				} else if ok && val.(*view.SumData).Value != float64(want) {
+					t.Errorf("expected %s to be %d; got %v", key, want, val)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tserrors defines error classes used across the import pipeline. Errors are classified where they
+// originate (in metric sources, in the Stackdriver adapter, while reading configuration), and the class is then
+// used to decide whether an operation is retried, how the failure is reported in stats, and how it's described in
+// the metric status.
+package tserrors
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Error classes. Classified errors can be checked using errors.Is, e.g. errors.Is(err, ErrSourceTransient).
+var (
+	// ErrSourceTransient is a source failure that is likely to go away on its own (timeouts, 5xx, rate limits).
+	ErrSourceTransient = errors.New("transient source error")
+	// ErrSourcePermanent is a source failure that requires intervention (invalid query, bad credentials).
+	ErrSourcePermanent = errors.New("permanent source error")
+	// ErrDestinationTransient is a Stackdriver failure that is likely to go away on its own.
+	ErrDestinationTransient = errors.New("transient destination error")
+	// ErrDestinationQuota means that a Stackdriver quota has been exceeded.
+	ErrDestinationQuota = errors.New("destination quota exceeded")
+	// ErrDestinationPermanent is a Stackdriver failure that requires intervention (permission denied, bad data).
+	ErrDestinationPermanent = errors.New("permanent destination error")
+	// ErrConfigInvalid means that the configuration file could not be loaded.
+	ErrConfigInvalid = errors.New("invalid configuration")
+	// ErrBudgetExceeded means that imports have been paused because a daily budget of written points was exceeded.
+	ErrBudgetExceeded = errors.New("daily points budget exceeded")
+)
+
+// classes lists all error classes along with labels used to report them in stats.
+var classes = []struct {
+	class error
+	label string
+}{
+	{ErrSourceTransient, "source_transient"},
+	{ErrSourcePermanent, "source_permanent"},
+	{ErrDestinationTransient, "destination_transient"},
+	{ErrDestinationQuota, "destination_quota"},
+	{ErrDestinationPermanent, "destination_permanent"},
+	{ErrConfigInvalid, "config_invalid"},
+	{ErrBudgetExceeded, "budget_exceeded"},
+}
+
+// classifiedError attaches an error class to an error without changing its message.
+type classifiedError struct {
+	class error
+	err   error
+}
+
+func (e *classifiedError) Error() string        { return e.err.Error() }
+func (e *classifiedError) Unwrap() error        { return e.err }
+func (e *classifiedError) Is(target error) bool { return target == e.class }
+
+// Wrap attaches a given class to an error. Errors that are already classified keep their original class.
+func Wrap(class, err error) error {
+	if err == nil || class == nil || Class(err) != nil {
+		return err
+	}
+	return &classifiedError{class: class, err: err}
+}
+
+// Class returns the class of an error, or nil if the error has not been classified.
+func Class(err error) error {
+	for _, c := range classes {
+		if errors.Is(err, c.class) {
+			return c.class
+		}
+	}
+	return nil
+}
+
+// Label returns a short label describing the class of an error, suitable for use in stats.
+func Label(err error) string {
+	for _, c := range classes {
+		if errors.Is(err, c.class) {
+			return c.label
+		}
+	}
+	return "unknown"
+}
+
+// Transient returns true for errors that are worth retrying shortly.
+func Transient(err error) bool {
+	return errors.Is(err, ErrSourceTransient) || errors.Is(err, ErrDestinationTransient)
+}
+
+// ClassifySource classifies errors that happened while querying a metric source and have not been classified by
+// the source itself: timeouts and network errors are transient, and other errors are left unclassified.
+func ClassifySource(err error) error {
+	if err == nil || Class(err) != nil {
+		return err
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return Wrap(ErrSourceTransient, err)
+	}
+	return err
+}
+
+// FromHTTPStatus classifies a source error given the HTTP status code of the response: rate limiting and server
+// errors are transient, and other client errors are permanent.
+func FromHTTPStatus(code int, err error) error {
+	switch {
+	case code == http.StatusTooManyRequests || code >= http.StatusInternalServerError:
+		return Wrap(ErrSourceTransient, err)
+	case code >= http.StatusBadRequest:
+		return Wrap(ErrSourcePermanent, err)
+	}
+	return err
+}
+
+// Retry calls `fn` up to `attempts` times for as long as it returns transient errors, doubling the delay between
+// attempts starting from `backoff`. It returns the last error.
+func Retry(ctx context.Context, attempts int, backoff time.Duration, fn func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = fn(); err == nil || !Transient(err) || i == attempts-1 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
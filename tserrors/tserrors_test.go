@@ -0,0 +1,85 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tserrors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWrap(t *testing.T) {
+	err := Wrap(ErrSourcePermanent, errors.New("bad query"))
+	if err.Error() != "bad query" {
+		t.Errorf("Wrap() changed error message to '%s'", err)
+	}
+	wrapped := fmt.Errorf("failed to get data: %w", err)
+	if !errors.Is(wrapped, ErrSourcePermanent) || errors.Is(wrapped, ErrSourceTransient) {
+		t.Errorf("expected error to only be of class '%v'; got %v", ErrSourcePermanent, Class(wrapped))
+	}
+	if got := Label(wrapped); got != "source_permanent" {
+		t.Errorf("Label() returned '%s'; want 'source_permanent'", got)
+	}
+	if !errors.Is(Wrap(ErrSourceTransient, wrapped), ErrSourcePermanent) {
+		t.Errorf("Wrap() should not change the class of a classified error")
+	}
+	if got := Label(errors.New("foo")); got != "unknown" {
+		t.Errorf("Label() returned '%s' for an unclassified error; want 'unknown'", got)
+	}
+	if Wrap(ErrSourceTransient, nil) != nil {
+		t.Errorf("Wrap() returned non-nil error for a nil error")
+	}
+}
+
+func TestClassifySource(t *testing.T) {
+	if err := ClassifySource(fmt.Errorf("query: %w", context.DeadlineExceeded)); !errors.Is(err, ErrSourceTransient) {
+		t.Errorf("expected a timeout to be a transient error; got %v", Class(err))
+	}
+	if err := ClassifySource(errors.New("foo")); Class(err) != nil {
+		t.Errorf("expected an unknown error to stay unclassified; got %v", Class(err))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name      string
+		err       error
+		wantCalls int
+	}{
+		{"success", nil, 1},
+		{"transient error", Wrap(ErrSourceTransient, errors.New("timeout")), 3},
+		{"permanent error", Wrap(ErrSourcePermanent, errors.New("bad query")), 1},
+		{"quota exceeded", Wrap(ErrDestinationQuota, errors.New("slow down")), 1},
+		{"unclassified error", errors.New("foo"), 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := Retry(ctx, 3, time.Millisecond, func() error {
+				calls++
+				return tt.err
+			})
+			if err != tt.err {
+				t.Errorf("Retry() returned %v; want %v", err, tt.err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("Retry() called function %d times; want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package usage counts the API calls and points attributable to a single metric update, so that the cost of source
+// APIs and of Cloud Monitoring ingestion can be attributed to metrics. Counters are carried in the context, like
+// request IDs.
+package usage
+
+import (
+	"context"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// Counts are the API calls and points counted during a metric update.
+type Counts struct {
+	SourceCalls      int64 `json:"source_calls"`
+	StackdriverCalls int64 `json:"stackdriver_calls"`
+	PointsWritten    int64 `json:"points_written"`
+}
+
+// Add returns the sum of two counts.
+func (c Counts) Add(o Counts) Counts {
+	return Counts{
+		SourceCalls:      c.SourceCalls + o.SourceCalls,
+		StackdriverCalls: c.StackdriverCalls + o.StackdriverCalls,
+		PointsWritten:    c.PointsWritten + o.PointsWritten,
+	}
+}
+
+// Counter collects counts of concurrent API calls.
+type Counter struct {
+	sourceCalls      int64
+	stackdriverCalls int64
+	pointsWritten    int64
+}
+
+// Counts returns the counts collected so far.
+func (c *Counter) Counts() Counts {
+	return Counts{
+		SourceCalls:      atomic.LoadInt64(&c.sourceCalls),
+		StackdriverCalls: atomic.LoadInt64(&c.stackdriverCalls),
+		PointsWritten:    atomic.LoadInt64(&c.pointsWritten),
+	}
+}
+
+type contextKey struct{}
+
+// NewContext returns a context that carries a new counter. HTTP requests sent with the context (or one derived from
+// it) are counted as source API calls, including retries and redirects.
+func NewContext(ctx context.Context) (context.Context, *Counter) {
+	c := &Counter{}
+	ctx = context.WithValue(ctx, contextKey{}, c)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { atomic.AddInt64(&c.sourceCalls, 1) },
+	})
+	return ctx, c
+}
+
+// FromContext returns the counter carried by a context, or nil if there is none.
+func FromContext(ctx context.Context) *Counter {
+	c, _ := ctx.Value(contextKey{}).(*Counter)
+	return c
+}
+
+// AddSourceCalls counts API calls made to a source by a client that does not send requests with the context, e.g.
+// the Datadog client.
+func AddSourceCalls(ctx context.Context, n int) {
+	if c := FromContext(ctx); c != nil {
+		atomic.AddInt64(&c.sourceCalls, int64(n))
+	}
+}
+
+// AddStackdriverCall counts a Stackdriver API call that wrote `points` points.
+func AddStackdriverCall(ctx context.Context, points int) {
+	if c := FromContext(ctx); c != nil {
+		atomic.AddInt64(&c.stackdriverCalls, 1)
+		atomic.AddInt64(&c.pointsWritten, int64(points))
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package usage
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	ctx, c := NewContext(context.Background())
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	AddSourceCalls(ctx, 3)
+	AddStackdriverCall(ctx, 10)
+	AddStackdriverCall(ctx, 0)
+
+	want := Counts{SourceCalls: 5, StackdriverCalls: 2, PointsWritten: 10}
+	if got := c.Counts(); got != want {
+		t.Errorf("Counts() = %+v; want %+v", got, want)
+	}
+	if FromContext(ctx) != c {
+		t.Errorf("FromContext() did not return the counter of the context")
+	}
+}
+
+func TestWithoutCounter(t *testing.T) {
+	ctx := context.Background()
+	AddSourceCalls(ctx, 1)
+	AddStackdriverCall(ctx, 1)
+	if c := FromContext(ctx); c != nil {
+		t.Errorf("FromContext() = %v; want nil", c)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vsphere
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// retention of performance statistics of each interval with default vCenter settings. Only points within the
+// retention period are queried.
+var retention = map[time.Duration]time.Duration{
+	20 * time.Second: time.Hour, // real-time statistics.
+	5 * time.Minute:  24 * time.Hour,
+	30 * time.Minute: 7 * 24 * time.Hour,
+	2 * time.Hour:    30 * 24 * time.Hour,
+	24 * time.Hour:   365 * 24 * time.Hour,
+}
+
+// counterName matches counter names in the format used by vSphere clients, e.g. cpu.ready.summation.
+var counterName = regexp.MustCompile(`^[A-Za-z0-9]+\.[A-Za-z0-9]+\.[a-z]+$`)
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from vSphere performance
+// counters.
+type MetricConfig struct {
+	// Endpoint is the URL of vCenter or an ESXi host, e.g. https://vcenter.corp.
+	Endpoint string `validate:"nonzero"`
+	Username string `validate:"nonzero"`
+	Password string
+
+	// Counter is the name of the performance counter in the format group.name.rollup, e.g. cpu.ready.summation.
+	Counter string `validate:"nonzero"`
+	// EntityType is the type of the queried inventory objects: "vm" (the default) or "host".
+	EntityType string `yaml:"entity_type" validate:"regexp=^(|vm|host)$"`
+	// Instance selects the instance of the counter, e.g. a datastore UUID or "*" for all instances. The aggregated
+	// value over all instances is imported if it's empty.
+	Instance string
+	// Interval is the sampling interval of the queried statistics: 20s for real-time statistics (the default), or
+	// the interval of a historical statistics level, e.g. 5m.
+	Interval time.Duration
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// The password can also be read from a file, e.g. from a mounted Kubernetes secret.
+	PasswordFile string `yaml:"password_file"`
+}
+
+// ReadSecretFiles sets the password from the contents of the configured password file. Relative paths are resolved
+// relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	if c.PasswordFile == "" {
+		return nil
+	}
+	if c.Password != "" {
+		return fmt.Errorf("password and password_file cannot both be set")
+	}
+	password, err := env.ReadSecretFile(dir, c.PasswordFile)
+	if err != nil {
+		return fmt.Errorf("cannot read password_file: %v", err)
+	}
+	c.Password = password
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if !counterName.MatchString(c.Counter) {
+		return fmt.Errorf("counter %q needs to be in the format group.name.rollup, e.g. cpu.ready.summation", c.Counter)
+	}
+	if _, ok := retention[c.interval()]; !ok || c.Interval < 0 {
+		return fmt.Errorf("interval needs to be 20s or the interval of a historical statistics level (5m, 30m, 2h or 24h)")
+	}
+	return nil
+}
+
+// entityType returns the vSphere managed object type of queried inventory objects.
+func (c *MetricConfig) entityType() string {
+	if c.EntityType == "host" {
+		return "HostSystem"
+	}
+	return "VirtualMachine"
+}
+
+// interval returns the sampling interval of queried statistics.
+func (c *MetricConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return 20 * time.Second
+}
@@ -0,0 +1,295 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vsphere imports performance counters of virtual machines and hosts from VMware vSphere, with inventory
+// paths as labels.
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// Labels of imported time series.
+const (
+	nameLabel       = "name"
+	pathLabel       = "path"
+	datacenterLabel = "datacenter"
+	instanceLabel   = "instance"
+)
+
+// perfBatchSize is the maximum number of entities queried by a single QueryPerf request.
+const perfBatchSize = 100
+
+// maxPathDepth limits the length of inventory paths, in case parents of entities form a cycle.
+const maxPathDepth = 64
+
+// units maps vSphere units to Stackdriver units.
+var units = map[string]string{
+	"percent":            "%",
+	"millisecond":        "ms",
+	"microsecond":        "us",
+	"second":             "s",
+	"kiloBytes":          "kBy",
+	"megaBytes":          "MBy",
+	"kiloBytesPerSecond": "kBy/s",
+	"megaHertz":          "MHz",
+	"watt":               "W",
+	"celsius":            "Cel",
+}
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a metric based on a vSphere performance counter. It implements the SourceMetric interface.
+type Metric struct {
+	Name        string
+	config      *MetricConfig
+	httpClient  *http.Client
+	minPointAge time.Duration
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig, minPointAge time.Duration) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:        name,
+		config:      config,
+		httpClient:  httpClient,
+		minPointAge: minPointAge,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/vsphere/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "vsphere"
+}
+
+// SourceHost returns the host of the vSphere endpoint. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.Endpoint)
+	if err != nil || u.Host == "" {
+		return m.config.Endpoint
+	}
+	return u.Host
+}
+
+// Query returns the queried counter and entity type.
+func (m *Metric) Query() string {
+	q := fmt.Sprintf("%s of %s", m.config.Counter, m.config.entityType())
+	if m.config.Instance != "" {
+		q += fmt.Sprintf(" (instance %s)", m.config.Instance)
+	}
+	return q
+}
+
+// StackdriverData queries vSphere, returning metric descriptor and time series with samples after the given
+// lastPoint timestamp. Statistics are only kept for a limited time, so older samples cannot be imported.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	interval := m.config.interval()
+	now := timeNow()
+	end := now.Add(-m.minPointAge)
+	start := lastPoint
+	if earliest := now.Add(-retention[interval]).Add(interval); start.Before(earliest) {
+		start = earliest
+	}
+	if !end.After(start) {
+		return nil, nil, nil
+	}
+
+	c, err := newClient(ctx, m.config.Endpoint, m.httpClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := c.login(ctx, m.config.Username, m.config.Password); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err := c.logout(ctx); err != nil {
+			log.WithContext(ctx).Warningf("Could not log out of vSphere API: %v", err)
+		}
+	}()
+
+	counter, err := m.counter(ctx, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	entities, err := c.entities(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	paths := inventoryPaths(entities)
+
+	var specs []perfQuerySpec
+	for _, e := range entities {
+		if e.ref.Type == m.config.entityType() {
+			specs = append(specs, perfQuerySpec{
+				Entity:     e.ref,
+				StartTime:  start.UTC(),
+				EndTime:    end.UTC(),
+				MetricID:   perfMetricID{CounterID: counter.Key, Instance: m.config.Instance},
+				IntervalID: int32(interval / time.Second),
+			})
+		}
+	}
+	log.WithContext(ctx).Debugf("Querying %s of %d vSphere entities", m.config.Counter, len(specs))
+
+	var ts []*monitoringpb.TimeSeries
+	for i := 0; i < len(specs); i += perfBatchSize {
+		batch := specs[i:]
+		if len(batch) > perfBatchSize {
+			batch = batch[:perfBatchSize]
+		}
+		metrics, err := c.queryPerf(ctx, batch)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, em := range metrics {
+			converted, err := m.convertMetric(em, paths[em.Entity.Value], counter, lastPoint, end)
+			if err != nil {
+				return nil, nil, err
+			}
+			ts = append(ts, converted...)
+		}
+	}
+	return m.metricDescriptor(counter), ts, nil
+}
+
+// counter looks up the configured performance counter.
+func (m *Metric) counter(ctx context.Context, c *client) (*perfCounter, error) {
+	counters, err := c.counters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, pc := range counters {
+		if fmt.Sprintf("%s.%s.%s", pc.Group, pc.Name, pc.Rollup) == m.config.Counter {
+			return &pc, nil
+		}
+	}
+	return nil, tserrors.Wrap(tserrors.ErrConfigInvalid, fmt.Errorf("performance counter %s is not available", m.config.Counter))
+}
+
+// convertMetric converts samples of an entity taken after `lastPoint` into time series with a single point each.
+func (m *Metric) convertMetric(em perfEntityMetric, path []string, counter *perfCounter, lastPoint, end time.Time) ([]*monitoringpb.TimeSeries, error) {
+	labels := map[string]string{pathLabel: "/" + strings.Join(path, "/")}
+	if len(path) > 0 {
+		labels[nameLabel], labels[datacenterLabel] = path[len(path)-1], path[0]
+	}
+
+	var ts []*monitoringpb.TimeSeries
+	for _, series := range em.Value {
+		seriesLabels := labels
+		if m.config.Instance != "" {
+			seriesLabels = make(map[string]string)
+			for k, v := range labels {
+				seriesLabels[k] = v
+			}
+			seriesLabels[instanceLabel] = series.ID.Instance
+		}
+		for i, v := range series.Value {
+			// Missing samples are reported as -1.
+			if i >= len(em.SampleInfo) || v < 0 {
+				continue
+			}
+			t := em.SampleInfo[i].Timestamp
+			if !t.After(lastPoint) || t.After(end) {
+				continue
+			}
+			value := float64(v)
+			// Percentages are reported in hundredths of a percent.
+			if counter.Unit == "percent" {
+				value /= 100
+			}
+			et, err := ptypes.TimestampProto(t)
+			if err != nil {
+				return nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", t, err)
+			}
+			ts = append(ts, &monitoringpb.TimeSeries{
+				Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: seriesLabels},
+				Resource:   &monitoredres.MonitoredResource{Type: "global"},
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+				Points: []*monitoringpb.Point{{
+					Interval: &monitoringpb.TimeInterval{EndTime: et},
+					Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+				}},
+			})
+		}
+	}
+	return ts, nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for a performance counter.
+func (m *Metric) metricDescriptor(counter *perfCounter) *metricpb.MetricDescriptor {
+	labels := []*label.LabelDescriptor{
+		{Key: nameLabel, ValueType: label.LabelDescriptor_STRING, Description: "Name of the VM or host"},
+		{Key: pathLabel, ValueType: label.LabelDescriptor_STRING, Description: "Inventory path of the VM or host"},
+		{Key: datacenterLabel, ValueType: label.LabelDescriptor_STRING, Description: "vSphere datacenter"},
+	}
+	if m.config.Instance != "" {
+		labels = append(labels, &label.LabelDescriptor{Key: instanceLabel, ValueType: label.LabelDescriptor_STRING, Description: "Counter instance"})
+	}
+	return &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Unit:        units[counter.Unit],
+		Description: fmt.Sprintf("vSphere performance counter %s", m.Query()),
+		DisplayName: m.Name,
+		Labels:      labels,
+	}
+}
+
+// inventoryPaths returns the inventory path of each entity (e.g. ["DC1", "vm", "web", "web-1"]), keyed by managed
+// object ID. The root folder is not part of paths.
+func inventoryPaths(entities []entity) map[string][]string {
+	byID := make(map[string]entity)
+	for _, e := range entities {
+		byID[e.ref.Value] = e
+	}
+	paths := make(map[string][]string)
+	for _, e := range entities {
+		var path []string
+		for p, ok := e, true; ok && len(path) < maxPathDepth; p, ok = byID[p.parent] {
+			path = append([]string{p.name}, path...)
+		}
+		paths[e.ref.Value] = path
+	}
+	return paths
+}
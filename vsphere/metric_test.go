@@ -0,0 +1,398 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vsphere
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	labels map[string]string
+	offset time.Duration // relative to the start of a test.
+	value  float64
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		points = append(points, testPoint{s.Metric.Labels, end.Sub(start), s.Points[0].Value.GetDoubleValue()})
+	}
+	return points
+}
+
+const envelope = `<?xml version="1.0" encoding="UTF-8"?>
+<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+<soapenv:Body>%s</soapenv:Body></soapenv:Envelope>`
+
+const fault = `<soapenv:Fault><faultcode>ServerFaultCode</faultcode><faultstring>%s</faultstring>
+<detail><%sFault xmlns="urn:vim25" xsi:type="%s"/></detail></soapenv:Fault>`
+
+// inventory of the test server: two VMs in a folder of datacenter DC1, and a standalone host.
+const inventory = `<RetrievePropertiesExResponse xmlns="urn:vim25"><returnval>
+<token>page-2</token>
+<objects><obj type="Datacenter">datacenter-2</obj>
+  <propSet><name>name</name><val xsi:type="xsd:string">DC1</val></propSet>
+  <propSet><name>parent</name><val type="Folder" xsi:type="ManagedObjectReference">group-d1</val></propSet></objects>
+<objects><obj type="Folder">group-v3</obj>
+  <propSet><name>name</name><val xsi:type="xsd:string">vm</val></propSet>
+  <propSet><name>parent</name><val type="Datacenter" xsi:type="ManagedObjectReference">datacenter-2</val></propSet></objects>
+<objects><obj type="Folder">group-v4</obj>
+  <propSet><name>name</name><val xsi:type="xsd:string">web</val></propSet>
+  <propSet><name>parent</name><val type="Folder" xsi:type="ManagedObjectReference">group-v3</val></propSet></objects>
+</returnval></RetrievePropertiesExResponse>`
+
+const inventoryPage2 = `<ContinueRetrievePropertiesExResponse xmlns="urn:vim25"><returnval>
+<objects><obj type="VirtualMachine">vm-10</obj>
+  <propSet><name>name</name><val xsi:type="xsd:string">web-1</val></propSet>
+  <propSet><name>parent</name><val type="Folder" xsi:type="ManagedObjectReference">group-v4</val></propSet></objects>
+<objects><obj type="VirtualMachine">vm-11</obj>
+  <propSet><name>name</name><val xsi:type="xsd:string">web-2</val></propSet>
+  <propSet><name>parent</name><val type="Folder" xsi:type="ManagedObjectReference">group-v4</val></propSet></objects>
+<objects><obj type="Folder">group-h5</obj>
+  <propSet><name>name</name><val xsi:type="xsd:string">host</val></propSet>
+  <propSet><name>parent</name><val type="Datacenter" xsi:type="ManagedObjectReference">datacenter-2</val></propSet></objects>
+<objects><obj type="ComputeResource">domain-s19</obj>
+  <propSet><name>name</name><val xsi:type="xsd:string">esx-1</val></propSet>
+  <propSet><name>parent</name><val type="Folder" xsi:type="ManagedObjectReference">group-h5</val></propSet></objects>
+<objects><obj type="HostSystem">host-20</obj>
+  <propSet><name>name</name><val xsi:type="xsd:string">esx-1</val></propSet>
+  <propSet><name>parent</name><val type="ComputeResource" xsi:type="ManagedObjectReference">domain-s19</val></propSet></objects>
+</returnval></ContinueRetrievePropertiesExResponse>`
+
+const counters = `<RetrievePropertiesExResponse xmlns="urn:vim25"><returnval><objects>
+<obj type="PerformanceManager">PerfMgr</obj>
+<propSet><name>perfCounter</name><val xsi:type="ArrayOfPerfCounterInfo">
+  <PerfCounterInfo><key>2</key><nameInfo><key>usage</key></nameInfo><groupInfo><key>cpu</key></groupInfo>
+    <unitInfo><key>percent</key></unitInfo><rollupType>average</rollupType></PerfCounterInfo>
+  <PerfCounterInfo><key>12</key><nameInfo><key>ready</key></nameInfo><groupInfo><key>cpu</key></groupInfo>
+    <unitInfo><key>millisecond</key></unitInfo><rollupType>summation</rollupType></PerfCounterInfo>
+</val></propSet></objects></returnval></RetrievePropertiesExResponse>`
+
+// querySpec is a PerfQuerySpec received by the test server.
+type querySpec struct {
+	Entity     string    `xml:"entity"`
+	StartTime  time.Time `xml:"startTime"`
+	EndTime    time.Time `xml:"endTime"`
+	CounterID  int32     `xml:"metricId>counterId"`
+	Instance   string    `xml:"metricId>instance"`
+	IntervalID int32     `xml:"intervalId"`
+}
+
+// testUsers are the users of the test server and their passwords.
+var testUsers = map[string]string{"monitor@vsphere.local": "secret", "admin@vsphere.local": `p<a&s"s'>`}
+
+// newTestServer returns a vSphere API with the test inventory, which responds to QueryPerf requests with `perf`
+// and records received query specs and, unless `methods` is nil, the names of called methods.
+func newTestServer(t *testing.T, perf string, specs *[]querySpec, methods *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/sdk" || r.Header.Get("SOAPAction") != soapAction {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var req struct {
+			Body struct {
+				Method struct {
+					XMLName   xml.Name
+					UserName  string      `xml:"userName"`
+					Password  string      `xml:"password"`
+					Type      []string    `xml:"specSet>propSet>type"`
+					QuerySpec []querySpec `xml:"querySpec"`
+				} `xml:",any"`
+			} `xml:"Body"`
+		}
+		if err := xml.Unmarshal(body, &req); err != nil {
+			t.Errorf("invalid request %s: %v", body, err)
+		}
+		method := req.Body.Method
+		if methods != nil {
+			*methods = append(*methods, method.XMLName.Local)
+		}
+		_, err := r.Cookie("vmware_soap_session")
+		if authenticated := err == nil; !authenticated && method.XMLName.Local != "RetrieveServiceContent" && method.XMLName.Local != "Login" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, envelope, fmt.Sprintf(fault, "The session is not authenticated.", "NotAuthenticated", "NotAuthenticated"))
+			return
+		}
+		var resp string
+		switch method.XMLName.Local {
+		case "RetrieveServiceContent":
+			resp = `<RetrieveServiceContentResponse xmlns="urn:vim25"><returnval>
+				<rootFolder type="Folder">group-d1</rootFolder><propertyCollector type="PropertyCollector">propertyCollector</propertyCollector>
+				<viewManager type="ViewManager">ViewManager</viewManager><sessionManager type="SessionManager">SessionManager</sessionManager>
+				<perfManager type="PerformanceManager">PerfMgr</perfManager></returnval></RetrieveServiceContentResponse>`
+		case "Login":
+			if password, ok := testUsers[method.UserName]; !ok || method.Password != password {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, envelope, fmt.Sprintf(fault, "Cannot complete login due to an incorrect user name or password.", "InvalidLogin", "InvalidLogin"))
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "vmware_soap_session", Value: "s1"})
+			resp = `<LoginResponse xmlns="urn:vim25"><returnval><key>s1</key></returnval></LoginResponse>`
+		case "CreateContainerView":
+			resp = `<CreateContainerViewResponse xmlns="urn:vim25"><returnval type="ContainerView">session[1]view</returnval></CreateContainerViewResponse>`
+		case "RetrievePropertiesEx":
+			resp = inventory
+			if reflect.DeepEqual(method.Type, []string{"PerformanceManager"}) {
+				resp = counters
+			}
+		case "ContinueRetrievePropertiesEx":
+			resp = inventoryPage2
+		case "QueryPerf":
+			*specs = append(*specs, method.QuerySpec...)
+			resp = perf
+		case "DestroyView", "Logout":
+			resp = fmt.Sprintf(`<%sResponse xmlns="urn:vim25"></%sResponse>`, method.XMLName.Local, method.XMLName.Local)
+		default:
+			t.Errorf("unexpected method %s", method.XMLName.Local)
+		}
+		fmt.Fprintf(w, envelope, resp)
+	}))
+}
+
+func TestStackdriverData(t *testing.T) {
+	start := time.Now().Add(-20 * time.Minute).Truncate(time.Minute).UTC()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(90 * time.Second) }
+	ts := func(d time.Duration) string { return start.Add(d).Format(time.RFC3339) }
+
+	var specs []querySpec
+	server := newTestServer(t, fmt.Sprintf(`<QueryPerfResponse xmlns="urn:vim25">
+		<returnval xsi:type="PerfEntityMetric"><entity type="VirtualMachine">vm-10</entity>
+			<sampleInfo><timestamp>%s</timestamp><interval>20</interval></sampleInfo>
+			<sampleInfo><timestamp>%s</timestamp><interval>20</interval></sampleInfo>
+			<sampleInfo><timestamp>%s</timestamp><interval>20</interval></sampleInfo>
+			<value xsi:type="PerfMetricIntSeries"><id><counterId>12</counterId><instance></instance></id>
+				<value>150</value><value>-1</value><value>210</value></value></returnval>
+		<returnval xsi:type="PerfEntityMetric"><entity type="VirtualMachine">vm-11</entity>
+			<sampleInfo><timestamp>%s</timestamp><interval>20</interval></sampleInfo>
+			<value xsi:type="PerfMetricIntSeries"><id><counterId>12</counterId><instance></instance></id>
+				<value>40</value></value></returnval>
+	</QueryPerfResponse>`, ts(20*time.Second), ts(40*time.Second), ts(80*time.Second), ts(20*time.Second)), &specs, nil)
+	defer server.Close()
+
+	m, err := NewSourceMetric("cpu_ready", &MetricConfig{
+		Endpoint: server.URL,
+		Username: "monitor@vsphere.local",
+		Password: "secret",
+		Counter:  "cpu.ready.summation",
+	}, 20*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, got, err := m.StackdriverData(ctx, start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	// Only VMs are queried.
+	wantSpecs := []querySpec{
+		{"vm-10", start, start.Add(70 * time.Second), 12, "", 20},
+		{"vm-11", start, start.Add(70 * time.Second), 12, "", 20},
+	}
+	if !reflect.DeepEqual(specs, wantSpecs) {
+		t.Errorf("expected query specs %v; got %v", wantSpecs, specs)
+	}
+	if desc.Type != "custom.googleapis.com/vsphere/cpu_ready" || desc.Unit != "ms" || len(desc.Labels) != 3 {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// Missing samples and samples newer than the minimum point age are skipped.
+	web1 := map[string]string{"name": "web-1", "path": "/DC1/vm/web/web-1", "datacenter": "DC1"}
+	web2 := map[string]string{"name": "web-2", "path": "/DC1/vm/web/web-2", "datacenter": "DC1"}
+	want := []testPoint{{web1, 20 * time.Second, 150}, {web2, 20 * time.Second, 40}}
+	if points := testPoints(t, start, got); !reflect.DeepEqual(points, want) {
+		t.Errorf("expected points %v; got %v", want, points)
+	}
+}
+
+func TestStackdriverDataInstancesAndRetention(t *testing.T) {
+	now := time.Now().Truncate(time.Minute).UTC()
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+
+	var specs []querySpec
+	server := newTestServer(t, fmt.Sprintf(`<QueryPerfResponse xmlns="urn:vim25">
+		<returnval xsi:type="PerfEntityMetric"><entity type="HostSystem">host-20</entity>
+			<sampleInfo><timestamp>%s</timestamp><interval>300</interval></sampleInfo>
+			<value xsi:type="PerfMetricIntSeries"><id><counterId>2</counterId><instance>0</instance></id><value>4250</value></value>
+			<value xsi:type="PerfMetricIntSeries"><id><counterId>2</counterId><instance>1</instance></id><value>1000</value></value>
+		</returnval></QueryPerfResponse>`, now.Add(-5*time.Minute).Format(time.RFC3339)), &specs, nil)
+	defer server.Close()
+
+	m, err := NewSourceMetric("host_cpu", &MetricConfig{
+		Endpoint:   server.URL,
+		Username:   "monitor@vsphere.local",
+		Password:   "secret",
+		Counter:    "cpu.usage.average",
+		EntityType: "host",
+		Instance:   "*",
+		Interval:   5 * time.Minute,
+	}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	desc, got, err := m.StackdriverData(context.Background(), time.Time{}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	// Statistics of 5 minute intervals are kept for a day.
+	if len(specs) != 1 || specs[0].Entity != "host-20" || !specs[0].StartTime.Equal(now.Add(-24*time.Hour+5*time.Minute)) || specs[0].Instance != "*" || specs[0].IntervalID != 300 {
+		t.Errorf("unexpected query specs %v", specs)
+	}
+	if desc.Unit != "%" || len(desc.Labels) != 4 {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	// Percentages are converted from hundredths of a percent.
+	want := []testPoint{
+		{map[string]string{"name": "esx-1", "path": "/DC1/host/esx-1/esx-1", "datacenter": "DC1", "instance": "0"}, -5 * time.Minute, 42.5},
+		{map[string]string{"name": "esx-1", "path": "/DC1/host/esx-1/esx-1", "datacenter": "DC1", "instance": "1"}, -5 * time.Minute, 10},
+	}
+	if points := testPoints(t, now, got); !reflect.DeepEqual(points, want) {
+		t.Errorf("expected points %v; got %v", want, points)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	var specs []querySpec
+	server := newTestServer(t, "", &specs, nil)
+	defer server.Close()
+
+	for _, tt := range []struct {
+		desc      string
+		config    MetricConfig
+		wantClass error
+		wantErr   string
+	}{
+		{"invalid login", MetricConfig{Username: "monitor@vsphere.local", Password: "wrong", Counter: "cpu.ready.summation"}, tserrors.ErrSourcePermanent, "InvalidLogin"},
+		{"unknown counter", MetricConfig{Username: "monitor@vsphere.local", Password: "secret", Counter: "disk.read.average"}, tserrors.ErrConfigInvalid, "disk.read.average is not available"},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			tt.config.Endpoint = server.URL
+			m, err := NewSourceMetric("errors", &tt.config, 0)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+			if !errors.Is(err, tt.wantClass) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q classified as %v; got %v", tt.wantErr, tt.wantClass, err)
+			}
+		})
+	}
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	m, err := NewSourceMetric("errors", &MetricConfig{Endpoint: unavailable.URL, Username: "u", Counter: "cpu.ready.summation"}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	if _, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil); !errors.Is(err, tserrors.ErrSourceTransient) {
+		t.Errorf("expected error %v to be classified as %v", err, tserrors.ErrSourceTransient)
+	}
+}
+
+func TestStackdriverDataSession(t *testing.T) {
+	var specs []querySpec
+	var methods []string
+	server := newTestServer(t, `<QueryPerfResponse xmlns="urn:vim25"></QueryPerfResponse>`, &specs, &methods)
+	defer server.Close()
+
+	// The password is escaped in the Login request.
+	m, err := NewSourceMetric("session", &MetricConfig{Endpoint: server.URL, Username: "admin@vsphere.local", Password: testUsers["admin@vsphere.local"], Counter: "cpu.ready.summation"}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	if _, _, err := m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil); err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	// The container view is destroyed once the inventory has been read, and the session is closed at the end.
+	want := []string{"RetrieveServiceContent", "Login", "RetrievePropertiesEx", "CreateContainerView", "RetrievePropertiesEx", "ContinueRetrievePropertiesEx", "DestroyView", "QueryPerf", "Logout"}
+	if !reflect.DeepEqual(methods, want) {
+		t.Errorf("expected calls %v; got %v", want, methods)
+	}
+}
+
+func TestClientCallErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		status    int
+		body      string
+		wantClass error
+		wantErr   string
+	}{
+		{"permission fault", http.StatusInternalServerError, fmt.Sprintf(envelope, fmt.Sprintf(fault, "Permission to perform this operation was denied.", "NoPermission", "NoPermission")), tserrors.ErrSourcePermanent, "fault NoPermission"},
+		{"server fault", http.StatusInternalServerError, fmt.Sprintf(envelope, fmt.Sprintf(fault, "A general system error occurred.", "SystemError", "SystemError")), tserrors.ErrSourceTransient, "fault SystemError: A general system error occurred."},
+		{"proxy error", http.StatusBadGateway, "<html>Bad Gateway</html>", tserrors.ErrSourceTransient, "HTTP status code 502"},
+		{"wrong endpoint", http.StatusNotFound, "Not Found", tserrors.ErrSourcePermanent, "HTTP status code 404"},
+		{"invalid response", http.StatusOK, "not XML", nil, "cannot parse vSphere API response"},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get(requestid.Header); got != "req-1" {
+					t.Errorf("expected request ID req-1; got %q", got)
+				}
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer s.Close()
+			c := &client{url: s.URL + "/sdk", httpClient: s.Client()}
+			req := struct {
+				XMLName xml.Name `xml:"urn:vim25 Logout"`
+				This    moref    `xml:"_this"`
+			}{This: moref{"SessionManager", "SessionManager"}}
+			err := c.call(requestid.NewContext(context.Background(), "req-1"), req, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q; got %v", tt.wantErr, err)
+			}
+			if tt.wantClass != nil && !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestNewSourceMetricInvalidConfig(t *testing.T) {
+	for _, config := range []*MetricConfig{
+		{Counter: "cpu.ready"},
+		{Counter: "cpu.ready.summation", Interval: time.Minute},
+		{Counter: "cpu.ready.summation", Interval: -20 * time.Second},
+	} {
+		if _, err := NewSourceMetric("invalid", config, 0); err == nil {
+			t.Errorf("expected NewSourceMetric to reject configuration %+v", config)
+		}
+	}
+}
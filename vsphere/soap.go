@@ -0,0 +1,393 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vsphere
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+)
+
+// Only the few methods of the vSphere Web Services API needed to query performance counters are implemented, rather
+// than using govmomi (github.com/vmware/govmomi), which is not a dependency of ts-bridge: RetrieveServiceContent,
+// Login and Logout, CreateContainerView and DestroyView, RetrievePropertiesEx and ContinueRetrievePropertiesEx, and
+// QueryPerf. They correspond to the session, view and performance managers of govmomi, which this client can be
+// replaced by if it becomes a dependency. See https://developer.vmware.com/apis/1355/vsphere for the API reference.
+
+// soapAction selects the API version. vSphere 6.5 and later support it.
+const soapAction = "urn:vim25/6.5"
+
+// Faults caused by configuration or permissions, which are not resolved by retrying.
+var permanentFaults = map[string]bool{
+	"InvalidLogin":     true,
+	"NoPermission":     true,
+	"NotAuthenticated": true,
+	"InvalidArgument":  true,
+	"InvalidProperty":  true,
+	"InvalidType":      true,
+}
+
+// moref is a reference to a managed object.
+type moref struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// serviceContent holds references to the managed objects used by the source.
+type serviceContent struct {
+	RootFolder        moref `xml:"rootFolder"`
+	PropertyCollector moref `xml:"propertyCollector"`
+	ViewManager       moref `xml:"viewManager"`
+	SessionManager    moref `xml:"sessionManager"`
+	PerfManager       moref `xml:"perfManager"`
+}
+
+// client sends requests to the vSphere Web Services API, keeping the session cookie of a login.
+type client struct {
+	url        string
+	httpClient *http.Client
+	content    serviceContent
+}
+
+// soapRequest is the envelope of a request. Namespaces are written as literal attributes, as encoding/xml does not
+// support prefixes.
+type soapRequest struct {
+	XMLName xml.Name `xml:"soapenv:Envelope"`
+	Soapenv string   `xml:"xmlns:soapenv,attr"`
+	XSI     string   `xml:"xmlns:xsi,attr"`
+	Body    struct {
+		// Method is named by the XMLName field of the method's request struct.
+		Method interface{}
+	} `xml:"soapenv:Body"`
+}
+
+// soapResponse is the envelope of a response, with either a fault or the response of the called method.
+type soapResponse struct {
+	Body struct {
+		Fault *struct {
+			String string `xml:"faultstring"`
+			Detail struct {
+				Fault struct {
+					XMLName xml.Name
+				} `xml:",any"`
+			} `xml:"detail"`
+		} `xml:"Fault"`
+		Response struct {
+			Inner []byte `xml:",innerxml"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+// newClient connects to the vSphere API of `endpoint`, retrieving the service content.
+func newClient(ctx context.Context, endpoint string, httpClient *http.Client) (*client, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	// The HTTP client is shared by all syncs of a metric, but each sync logs in with its own session.
+	hc := *httpClient
+	hc.Jar = jar
+	c := &client{url: strings.TrimSuffix(endpoint, "/") + "/sdk", httpClient: &hc}
+	var resp struct {
+		Returnval serviceContent `xml:"returnval"`
+	}
+	req := struct {
+		XMLName xml.Name `xml:"urn:vim25 RetrieveServiceContent"`
+		This    moref    `xml:"_this"`
+	}{This: moref{"ServiceInstance", "ServiceInstance"}}
+	if err := c.call(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	c.content = resp.Returnval
+	return c, nil
+}
+
+// login creates a session, which is kept in a cookie.
+func (c *client) login(ctx context.Context, username, password string) error {
+	req := struct {
+		XMLName  xml.Name `xml:"urn:vim25 Login"`
+		This     moref    `xml:"_this"`
+		UserName string   `xml:"userName"`
+		Password string   `xml:"password"`
+	}{This: c.content.SessionManager, UserName: username, Password: password}
+	return c.call(ctx, req, nil)
+}
+
+// logout ends the session.
+func (c *client) logout(ctx context.Context) error {
+	req := struct {
+		XMLName xml.Name `xml:"urn:vim25 Logout"`
+		This    moref    `xml:"_this"`
+	}{This: c.content.SessionManager}
+	return c.call(ctx, req, nil)
+}
+
+// entity is an inventory object.
+type entity struct {
+	ref    moref
+	name   string
+	parent string
+}
+
+// entities returns all inventory objects below the root folder, with their names and parents.
+func (c *client) entities(ctx context.Context) ([]entity, error) {
+	var view struct {
+		Returnval moref `xml:"returnval"`
+	}
+	createView := struct {
+		XMLName   xml.Name `xml:"urn:vim25 CreateContainerView"`
+		This      moref    `xml:"_this"`
+		Container moref    `xml:"container"`
+		Type      []string `xml:"type"`
+		Recursive bool     `xml:"recursive"`
+	}{This: c.content.ViewManager, Container: c.content.RootFolder, Type: []string{"ManagedEntity"}, Recursive: true}
+	if err := c.call(ctx, createView, &view); err != nil {
+		return nil, err
+	}
+	defer func() {
+		destroyView := struct {
+			XMLName xml.Name `xml:"urn:vim25 DestroyView"`
+			This    moref    `xml:"_this"`
+		}{This: view.Returnval}
+		c.call(ctx, destroyView, nil)
+	}()
+
+	type selectionSpec struct {
+		XSIType string `xml:"xsi:type,attr"`
+		Name    string `xml:"name"`
+		Type    string `xml:"type"`
+		Path    string `xml:"path"`
+		Skip    bool   `xml:"skip"`
+	}
+	type objectSpec struct {
+		Obj       moref         `xml:"obj"`
+		Skip      bool          `xml:"skip"`
+		SelectSet selectionSpec `xml:"selectSet"`
+	}
+	type propertySpec struct {
+		Type    string   `xml:"type"`
+		PathSet []string `xml:"pathSet"`
+	}
+	spec := struct {
+		PropSet   propertySpec `xml:"propSet"`
+		ObjectSet objectSpec   `xml:"objectSet"`
+	}{
+		PropSet: propertySpec{Type: "ManagedEntity", PathSet: []string{"name", "parent"}},
+		ObjectSet: objectSpec{
+			Obj:       view.Returnval,
+			Skip:      true,
+			SelectSet: selectionSpec{XSIType: "TraversalSpec", Name: "view", Type: "ContainerView", Path: "view"},
+		},
+	}
+
+	var entities []entity
+	var token string
+	for {
+		var resp struct {
+			Returnval struct {
+				Token   string `xml:"token"`
+				Objects []struct {
+					Obj     moref `xml:"obj"`
+					PropSet []struct {
+						Name string `xml:"name"`
+						Val  string `xml:"val"`
+					} `xml:"propSet"`
+				} `xml:"objects"`
+			} `xml:"returnval"`
+		}
+		var err error
+		if token == "" {
+			err = c.call(ctx, struct {
+				XMLName xml.Name    `xml:"urn:vim25 RetrievePropertiesEx"`
+				This    moref       `xml:"_this"`
+				SpecSet interface{} `xml:"specSet"`
+				Options struct{}    `xml:"options"`
+			}{This: c.content.PropertyCollector, SpecSet: spec}, &resp)
+		} else {
+			err = c.call(ctx, struct {
+				XMLName xml.Name `xml:"urn:vim25 ContinueRetrievePropertiesEx"`
+				This    moref    `xml:"_this"`
+				Token   string   `xml:"token"`
+			}{This: c.content.PropertyCollector, Token: token}, &resp)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range resp.Returnval.Objects {
+			e := entity{ref: o.Obj}
+			for _, p := range o.PropSet {
+				switch p.Name {
+				case "name":
+					e.name = p.Val
+				case "parent":
+					e.parent = p.Val
+				}
+			}
+			entities = append(entities, e)
+		}
+		if token = resp.Returnval.Token; token == "" {
+			return entities, nil
+		}
+	}
+}
+
+// perfCounter describes a performance counter.
+type perfCounter struct {
+	Key       int32  `xml:"key"`
+	Name      string `xml:"nameInfo>key"`
+	Group     string `xml:"groupInfo>key"`
+	Unit      string `xml:"unitInfo>key"`
+	Rollup    string `xml:"rollupType"`
+	StatsType string `xml:"statsType"`
+}
+
+// counters returns all performance counters supported by the server.
+func (c *client) counters(ctx context.Context) ([]perfCounter, error) {
+	req := struct {
+		XMLName xml.Name `xml:"urn:vim25 RetrievePropertiesEx"`
+		This    moref    `xml:"_this"`
+		SpecSet struct {
+			PropSet struct {
+				Type    string `xml:"type"`
+				PathSet string `xml:"pathSet"`
+			} `xml:"propSet"`
+			ObjectSet struct {
+				Obj moref `xml:"obj"`
+			} `xml:"objectSet"`
+		} `xml:"specSet"`
+		Options struct{} `xml:"options"`
+	}{This: c.content.PropertyCollector}
+	req.SpecSet.PropSet.Type = "PerformanceManager"
+	req.SpecSet.PropSet.PathSet = "perfCounter"
+	req.SpecSet.ObjectSet.Obj = c.content.PerfManager
+	var resp struct {
+		Returnval struct {
+			Counters []perfCounter `xml:"objects>propSet>val>PerfCounterInfo"`
+		} `xml:"returnval"`
+	}
+	if err := c.call(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Returnval.Counters, nil
+}
+
+// perfMetricID identifies a counter and instance.
+type perfMetricID struct {
+	CounterID int32  `xml:"counterId"`
+	Instance  string `xml:"instance"`
+}
+
+// perfQuerySpec defines a query of performance statistics of an entity.
+type perfQuerySpec struct {
+	Entity     moref        `xml:"entity"`
+	StartTime  time.Time    `xml:"startTime"`
+	EndTime    time.Time    `xml:"endTime"`
+	MetricID   perfMetricID `xml:"metricId"`
+	IntervalID int32        `xml:"intervalId"`
+}
+
+// perfEntityMetric holds performance statistics of an entity, with values of each counter instance at the times of
+// the samples.
+type perfEntityMetric struct {
+	Entity     moref `xml:"entity"`
+	SampleInfo []struct {
+		Timestamp time.Time `xml:"timestamp"`
+	} `xml:"sampleInfo"`
+	Value []struct {
+		ID    perfMetricID `xml:"id"`
+		Value []int64      `xml:"value"`
+	} `xml:"value"`
+}
+
+// queryPerf queries performance statistics.
+func (c *client) queryPerf(ctx context.Context, specs []perfQuerySpec) ([]perfEntityMetric, error) {
+	req := struct {
+		XMLName   xml.Name        `xml:"urn:vim25 QueryPerf"`
+		This      moref           `xml:"_this"`
+		QuerySpec []perfQuerySpec `xml:"querySpec"`
+	}{This: c.content.PerfManager, QuerySpec: specs}
+	var resp struct {
+		Returnval []perfEntityMetric `xml:"returnval"`
+	}
+	if err := c.call(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Returnval, nil
+}
+
+// call sends a request, decoding the response of the method into `resp` unless it's nil.
+func (c *client) call(ctx context.Context, method interface{}, resp interface{}) error {
+	envelope := soapRequest{Soapenv: "http://schemas.xmlsoap.org/soap/envelope/", XSI: "http://www.w3.org/2001/XMLSchema-instance"}
+	envelope.Body.Method = method
+	body, err := xml.Marshal(envelope)
+	if err != nil {
+		return tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(append([]byte(xml.Header), body...)))
+	if err != nil {
+		return tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", soapAction)
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+
+	r, err := c.httpClient.Do(req)
+	if err != nil {
+		return tserrors.ClassifySource(fmt.Errorf("vSphere API request failed: %w", err))
+	}
+	defer r.Body.Close()
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return tserrors.ClassifySource(fmt.Errorf("cannot read vSphere API response: %w", err))
+	}
+	var result soapResponse
+	if err := xml.Unmarshal(data, &result); err != nil {
+		if r.StatusCode != http.StatusOK {
+			return tserrors.FromHTTPStatus(r.StatusCode, fmt.Errorf("vSphere API returned HTTP status code %d: %s", r.StatusCode, data))
+		}
+		return fmt.Errorf("cannot parse vSphere API response: %v", err)
+	}
+	if f := result.Body.Fault; f != nil {
+		fault := strings.TrimSuffix(f.Detail.Fault.XMLName.Local, "Fault")
+		err := fmt.Errorf("vSphere API returned fault %s: %s", fault, f.String)
+		if permanentFaults[fault] {
+			return tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+		}
+		return tserrors.Wrap(tserrors.ErrSourceTransient, err)
+	}
+	if r.StatusCode != http.StatusOK {
+		return tserrors.FromHTTPStatus(r.StatusCode, fmt.Errorf("vSphere API returned HTTP status code %d: %s", r.StatusCode, data))
+	}
+	if resp == nil {
+		return nil
+	}
+	// The return values are decoded as children of the response element.
+	inner := append(append([]byte("<response>"), result.Body.Response.Inner...), "</response>"...)
+	if err := xml.Unmarshal(inner, resp); err != nil {
+		return fmt.Errorf("cannot parse vSphere API response: %v", err)
+	}
+	return nil
+}
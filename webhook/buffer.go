@@ -0,0 +1,167 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Buffers are shared by all configurations loaded during the lifetime of the process, so that posted points are
+// kept until the next sync even though the configuration file is reloaded for each request.
+var (
+	buffersMu sync.Mutex
+	buffers   = make(map[string]*buffer)
+)
+
+// idleTimeout is the time after which buffers of metrics that are no longer synced or posted to (e.g. because they
+// have been removed from the configuration file) are discarded.
+var idleTimeout = time.Hour
+
+// point is a buffered point.
+type point struct {
+	t     time.Time
+	value float64
+	// synced is set once the point has been returned by buffered, i.e. it has been passed on to be written.
+	synced bool
+}
+
+// buffer keeps posted points of a metric, ordered by time, until they are written to Stackdriver.
+type buffer struct {
+	mu       sync.Mutex
+	points   []point
+	dropped  int // points dropped or removed by downsampling because the buffer was full.
+	stale    int
+	lastUsed time.Time
+}
+
+// getBuffer returns the buffer of a metric, creating it if necessary. Buffers that have not been used for a while
+// are discarded.
+func getBuffer(name string) *buffer {
+	buffersMu.Lock()
+	defer buffersMu.Unlock()
+	for n, b := range buffers {
+		b.mu.Lock()
+		idle := timeNow().Sub(b.lastUsed) > idleTimeout
+		b.mu.Unlock()
+		if idle {
+			delete(buffers, n)
+		}
+	}
+	b, ok := buffers[name]
+	if !ok {
+		b = &buffer{lastUsed: timeNow()}
+		buffers[name] = b
+	}
+	return b
+}
+
+// add merges points into the buffer. A posted point replaces a buffered point with the same timestamp that has not
+// been synced yet, so that a batch can be posted again to correct it; points with the timestamp of a synced point
+// are discarded as stale. Once more than `size` points are buffered, the overflow policy is applied: the oldest
+// points are dropped, or buffered points are downsampled, or (with the block policy) the whole batch is rejected and
+// add returns false.
+func (b *buffer) add(points []point, size int, overflow string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastUsed = timeNow()
+	byTime := make(map[time.Time]int, len(b.points))
+	for i, p := range b.points {
+		byTime[p.t] = i
+	}
+	if overflow == overflowBlock {
+		added := make(map[time.Time]bool)
+		for _, p := range points {
+			if _, ok := byTime[p.t]; !ok {
+				added[p.t] = true
+			}
+		}
+		if len(b.points)+len(added) > size {
+			return false
+		}
+	}
+	for _, p := range points {
+		if i, ok := byTime[p.t]; ok {
+			if b.points[i].synced {
+				b.stale++
+			} else {
+				b.points[i] = p
+			}
+			continue
+		}
+		byTime[p.t] = len(b.points)
+		b.points = append(b.points, p)
+	}
+	sort.SliceStable(b.points, func(i, j int) bool { return b.points[i].t.Before(b.points[j].t) })
+	if overflow == overflowDownsample {
+		for len(b.points) > size && len(b.points) > 1 {
+			n := len(b.points)
+			b.points = downsample(b.points)
+			b.dropped += n - len(b.points)
+		}
+	}
+	if n := len(b.points) - size; n > 0 {
+		b.points = b.points[n:]
+		b.dropped += n
+	}
+	return true
+}
+
+// downsample removes every other point of time-ordered points, keeping the newest one.
+func downsample(points []point) []point {
+	var kept []point
+	for i, p := range points {
+		if (len(points)-1-i)%2 == 0 {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// newest returns the timestamp of the newest buffered point, or zero if there is none.
+func (b *buffer) newest() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.points) == 0 {
+		return time.Time{}
+	}
+	return b.points[len(b.points)-1].t
+}
+
+// buffered returns points posted after `lastPoint`, and discards older points, which have already been written.
+// Points are kept until they are older than `lastPoint`, so that they are not lost if writing them fails. It also
+// returns the number of points dropped because the buffer was full, and the number of stale points that were not
+// newer than the latest point written when they were posted, since the last call.
+func (b *buffer) buffered(lastPoint time.Time) (points []point, dropped, stale int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastUsed = timeNow()
+	i := 0
+	for i < len(b.points) && !b.points[i].t.After(lastPoint) {
+		if !b.points[i].synced {
+			b.stale++
+		}
+		i++
+	}
+	b.points = b.points[i:]
+	for i := range b.points {
+		b.points[i].synced = true
+	}
+	points = append(points, b.points...)
+	dropped, stale = b.dropped, b.stale
+	b.dropped, b.stale = 0, 0
+	return points, dropped, stale
+}
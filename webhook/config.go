@@ -0,0 +1,121 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/timezone"
+)
+
+// defaultBufferSize is the maximum number of points buffered between syncs, unless configured.
+const defaultBufferSize = 10000
+
+// Overflow policies, which define what happens to posted points once the buffer is full.
+const (
+	// overflowDropOldest drops the oldest buffered points.
+	overflowDropOldest = "drop-oldest"
+	// overflowDownsample removes every other buffered point, halving their resolution, until posted points fit.
+	overflowDownsample = "downsample"
+	// overflowBlock rejects batches that do not fit, so that the sender retries them after the next sync.
+	overflowBlock = "block"
+)
+
+// defaultReplayWindow is how far the timestamp of a signed request can be from the current time, unless configured.
+const defaultReplayWindow = 5 * time.Minute
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from batches of points
+// posted to the webhook endpoint.
+type MetricConfig struct {
+	// Token is the bearer token that requests posting points of the metric need to be authenticated with.
+	Token string
+	// BufferSize is the maximum number of points buffered between syncs, beyond which the overflow policy applies.
+	BufferSize int `yaml:"buffer_size" validate:"min=0"`
+	// Overflow is the overflow policy applied once the buffer is full, drop-oldest by default.
+	Overflow string `yaml:"overflow" validate:"regexp=^(|drop-oldest|downsample|block)$"`
+	// TimeZone is the IANA time zone of posted timestamps without offset, which are rejected unless it's set.
+	TimeZone string `yaml:"time_zone"`
+	// SigningSecret is the key of HMAC signatures that requests need to have, in addition to the token (if set).
+	SigningSecret string `yaml:"signing_secret"`
+	// ReplayWindow is how far the signed timestamp of a request can be from the current time.
+	ReplayWindow time.Duration `yaml:"replay_window" validate:"min=0"`
+
+	// The token and signing secret can also be read from files, e.g. from a mounted Kubernetes secret.
+	TokenFile         string `yaml:"token_file"`
+	SigningSecretFile string `yaml:"signing_secret_file"`
+}
+
+// ReadSecretFiles sets the token and signing secret from the contents of the configured files. Relative paths are
+// resolved relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	for _, s := range []struct {
+		name, file string
+		value      *string
+	}{
+		{"token", c.TokenFile, &c.Token},
+		{"signing_secret", c.SigningSecretFile, &c.SigningSecret},
+	} {
+		if s.file == "" {
+			continue
+		}
+		if *s.value != "" {
+			return fmt.Errorf("%s and %s_file cannot both be set", s.name, s.name)
+		}
+		v, err := env.ReadSecretFile(dir, s.file)
+		if err != nil {
+			return fmt.Errorf("cannot read %s_file: %v", s.name, err)
+		}
+		*s.value = v
+	}
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	// Anyone who can reach the endpoint could otherwise write points of the metric.
+	if c.Token == "" && c.SigningSecret == "" {
+		return fmt.Errorf("token (or token_file) or signing_secret (or signing_secret_file) is required")
+	}
+	if _, err := timezone.Load(c.TimeZone); err != nil {
+		return fmt.Errorf("invalid time_zone: %v", err)
+	}
+	return nil
+}
+
+// bufferSize returns the maximum number of points buffered between syncs.
+func (c *MetricConfig) bufferSize() int {
+	if c.BufferSize > 0 {
+		return c.BufferSize
+	}
+	return defaultBufferSize
+}
+
+// replayWindow returns how far the signed timestamp of a request can be from the current time.
+func (c *MetricConfig) replayWindow() time.Duration {
+	if c.ReplayWindow > 0 {
+		return c.ReplayWindow
+	}
+	return defaultReplayWindow
+}
+
+// overflow returns the overflow policy of the buffer.
+func (c *MetricConfig) overflow() string {
+	if c.Overflow != "" {
+		return c.Overflow
+	}
+	return overflowDropOldest
+}
@@ -0,0 +1,266 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/timezone"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxBodySize is the maximum size of a posted batch in bytes.
+const maxBodySize = 1 << 20
+
+// maxPointAge is the maximum age of a point that Stackdriver accepts.
+const maxPointAge = 24 * time.Hour
+
+// errUnsupportedType is returned for batches that are neither CSV nor JSON.
+var errUnsupportedType = errors.New("unsupported content type; please post text/csv or application/json")
+
+// ServeHTTP buffers a batch of points posted to the webhook endpoint of the metric, until they are written during
+// the next sync. Requests need to be authenticated with the configured bearer token, and signed with the signing
+// secret if one is configured. The whole batch is rejected if any of its rows is invalid, so that it can be fixed and
+// posted again.
+func (m *Metric) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	accepted := false
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST requests are allowed here", http.StatusMethodNotAllowed)
+		return
+	}
+	if m.config.Token != "" && !m.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "A valid bearer token is required", http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("cannot read batch: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxBodySize {
+		http.Error(w, fmt.Sprintf("Batches can have at most %d bytes", maxBodySize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if m.config.SigningSecret != "" {
+		sig, expiry, err := m.checkSignature(r.Header, body)
+		if err != nil {
+			log.WithContext(ctx).Warningf("Rejected batch of webhook metric %s: %v", m.Name, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err := m.reserveSignature(sig, expiry); err != nil {
+			log.WithContext(ctx).Warningf("Rejected batch of webhook metric %s: %v", m.Name, err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		// Rejected requests can be posted again, e.g. once the buffer has space.
+		defer func() {
+			if !accepted {
+				m.releaseSignature(sig)
+			}
+		}()
+	}
+	var tz *timezone.Converter
+	if m.location != nil {
+		// Points of a metric are expected to be posted in order, continuing after those already buffered.
+		tz = timezone.NewConverter(m.location, getBuffer(m.Name).newest())
+	}
+	points, err := parseBatch(body, r.Header.Get("Content-Type"), timeNow(), tz)
+	if err == errUnsupportedType {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err == nil && len(points) > m.config.bufferSize() {
+		err = fmt.Errorf("batch has %d points, but at most %d points can be buffered", len(points), m.config.bufferSize())
+	}
+	if err != nil {
+		log.WithContext(ctx).Warningf("Rejected batch of webhook metric %s: %v", m.Name, err)
+		http.Error(w, fmt.Sprintf("invalid batch: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !getBuffer(m.Name).add(points, m.config.bufferSize(), m.config.overflow()) {
+		log.WithContext(ctx).Warningf("Rejected batch of webhook metric %s: the buffer of %d points is full", m.Name, m.config.bufferSize())
+		// Buffered points are written during the next sync, which runs every minute by default.
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "The buffer is full; please retry after the next sync", http.StatusTooManyRequests)
+		return
+	}
+	accepted = true
+	log.WithContext(ctx).Debugf("Buffered %d posted points of webhook metric %s", len(points), m.Name)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Accepted %d points\n", len(points))
+}
+
+// authorized checks the bearer token of a request in constant time.
+func (m *Metric) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(m.config.Token)) == 1
+}
+
+// parseBatch returns the points of a CSV or JSON batch, ordered as posted. The format is detected from the body if
+// no content type is set. Points need to be at most `maxPointAge` older than `now`, and not later than it.
+// Timestamps without offset are converted using `tz`, and rejected if it's nil.
+func parseBatch(body []byte, contentType string, now time.Time, tz *timezone.Converter) ([]point, error) {
+	format := "text/csv"
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		format = "application/json"
+	}
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, errUnsupportedType
+		}
+		format = mediaType
+	}
+	var points []point
+	var err error
+	switch format {
+	case "text/csv", "text/plain":
+		points, err = parseCSV(body, tz)
+	case "application/json":
+		points, err = parseJSON(body, tz)
+	default:
+		return nil, errUnsupportedType
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range points {
+		switch {
+		case p.t.After(now):
+			return nil, fmt.Errorf("point %d: timestamp %s is in the future", i+1, p.t.Format(time.RFC3339))
+		case now.Sub(p.t) > maxPointAge:
+			return nil, fmt.Errorf("point %d: timestamp %s is older than %v", i+1, p.t.Format(time.RFC3339), maxPointAge)
+		}
+	}
+	return points, nil
+}
+
+// parseCSV parses rows of timestamp and value columns. The first row is skipped if it's a header.
+func parseCSV(body []byte, tz *timezone.Converter) ([]point, error) {
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	var points []point
+	for row := 1; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return points, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if row == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "timestamp") {
+			continue
+		}
+		t, err := parseTimestamp(strings.TrimSpace(record[0]), tz)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %v", row, err)
+		}
+		v, err := parseValue(strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %v", row, err)
+		}
+		points = append(points, point{t: t, value: v})
+	}
+}
+
+// parseJSON parses an array of objects with `timestamp` and `value` fields. Both can be numbers or strings.
+func parseJSON(body []byte, tz *timezone.Converter) ([]point, error) {
+	var rows []struct {
+		Timestamp json.RawMessage `json:"timestamp"`
+		Value     json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(body, &rows); err != nil {
+		return nil, err
+	}
+	var points []point
+	for i, row := range rows {
+		if row.Timestamp == nil || row.Value == nil {
+			return nil, fmt.Errorf("point %d: timestamp and value are required", i+1)
+		}
+		t, err := parseTimestamp(unquote(row.Timestamp), tz)
+		if err != nil {
+			return nil, fmt.Errorf("point %d: %v", i+1, err)
+		}
+		v, err := parseValue(unquote(row.Value))
+		if err != nil {
+			return nil, fmt.Errorf("point %d: %v", i+1, err)
+		}
+		points = append(points, point{t: t, value: v})
+	}
+	return points, nil
+}
+
+// unquote returns the contents of a JSON string, or the literal of any other JSON value.
+func unquote(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// Layouts of timestamps without offset, which are accepted if a time zone is configured.
+var naiveLayouts = []string{"2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999"}
+
+// parseTimestamp parses an RFC 3339 timestamp or a number of seconds since the Unix epoch, or a timestamp without
+// offset if `tz` is set. Timestamps are truncated to milliseconds.
+func parseTimestamp(s string, tz *timezone.Converter) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.Truncate(time.Millisecond), nil
+	}
+	if tz != nil {
+		for _, layout := range naiveLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return tz.Convert(t).Truncate(time.Millisecond), nil
+			}
+		}
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q; please use RFC 3339 or seconds since the Unix epoch", s)
+	}
+	return time.Unix(0, int64(secs*1e3)*int64(time.Millisecond)), nil
+}
+
+// parseValue parses a finite numeric value.
+func parseValue(s string) (float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
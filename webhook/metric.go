@@ -0,0 +1,130 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhook imports batches of points that external jobs post to the webhook endpoint of ts-bridge, e.g. as
+// the last step of a batch pipeline. Posted points are buffered until the next sync.
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/ts-bridge/storage"
+	"github.com/google/ts-bridge/timezone"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// Metric defines a metric based on posted batches of points. It implements the SourceMetric interface, and
+// http.Handler to receive batches.
+type Metric struct {
+	Name   string
+	config *MetricConfig
+	// location is the time zone of naive timestamps, or nil if they are not accepted.
+	location *time.Location
+	// dropped is the number of points dropped because the buffer was full, until they are reported.
+	dropped int
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	m := &Metric{Name: name, config: config}
+	if config.TimeZone != "" {
+		location, err := timezone.Load(config.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+		}
+		m.location = location
+	}
+	return m, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/webhook/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "webhook"
+}
+
+// Query returns the path that batches of the metric are posted to.
+func (m *Metric) Query() string {
+	return "/webhook/" + m.Name
+}
+
+// StackdriverData returns metric descriptor and time series with points posted after the given lastPoint
+// timestamp, in order.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	points, dropped, stale := getBuffer(m.Name).buffered(lastPoint)
+	if dropped > 0 {
+		m.dropped += dropped
+		log.WithContext(ctx).Warningf("Dropped %d points of webhook metric %s (overflow policy %s), as more than %d points were buffered; please sync more often or increase buffer_size", dropped, m.Name, m.config.overflow(), m.config.bufferSize())
+	}
+	if stale > 0 {
+		log.WithContext(ctx).Warningf("Skipped %d posted points of webhook metric %s that were not newer than the latest point already written", stale, m.Name)
+	}
+	log.WithContext(ctx).Debugf("Got %d buffered webhook points for %s", len(points), m.Name)
+
+	var ts []*monitoringpb.TimeSeries
+	for _, p := range points {
+		et, err := ptypes.TimestampProto(p.t)
+		if err != nil {
+			return nil, nil, tserrors.Wrap(tserrors.ErrSourcePermanent, fmt.Errorf("Could not convert timestamp %v to proto: %v", p.t, err))
+		}
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: m.StackdriverName()},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: et},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: p.value}},
+			}},
+		})
+	}
+	return m.metricDescriptor(), ts, nil
+}
+
+// DroppedPoints returns the number of points dropped since the last call because the buffer was full, along with the
+// overflow policy that dropped them. It's used to record stats.
+func (m *Metric) DroppedPoints() (int, string) {
+	dropped := m.dropped
+	m.dropped = 0
+	return dropped, m.config.overflow()
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for this metric.
+func (m *Metric) metricDescriptor() *metricpb.MetricDescriptor {
+	return &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   metricpb.MetricDescriptor_DOUBLE,
+		Description: fmt.Sprintf("Points posted to %s", m.Query()),
+		DisplayName: m.Name,
+	}
+}
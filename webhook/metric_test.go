@@ -0,0 +1,425 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/timezone"
+
+	"github.com/golang/protobuf/ptypes"
+)
+
+var now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// useFakeClock stubs timeNow and discards all buffers and signatures, returning a function restoring them.
+func useFakeClock() func() {
+	timeNow = func() time.Time { return now }
+	return func() {
+		timeNow = time.Now
+		buffersMu.Lock()
+		buffers = make(map[string]*buffer)
+		buffersMu.Unlock()
+		signaturesMu.Lock()
+		signatures = make(map[string]map[string]time.Time)
+		signaturesMu.Unlock()
+	}
+}
+
+func newMetric(t *testing.T, config *MetricConfig) *Metric {
+	m, err := NewSourceMetric("orders", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// post posts a batch to the metric, returning the response status code.
+func post(m *Metric, token, contentType, body string) int {
+	r := httptest.NewRequest(http.MethodPost, "/webhook/orders", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, r)
+	return w.Code
+}
+
+// syncedValues returns the timestamps and values of points returned by StackdriverData.
+func syncedValues(t *testing.T, m *Metric, lastPoint time.Time) []string {
+	_, ts, err := m.StackdriverData(context.Background(), lastPoint, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range ts {
+		et, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s=%v", et.UTC().Format("15:04:05"), s.Points[0].Value.GetDoubleValue()))
+	}
+	return got
+}
+
+func TestNewSourceMetric(t *testing.T) {
+	if _, err := NewSourceMetric("orders", &MetricConfig{}); err == nil {
+		t.Error("expected an error without a token")
+	}
+	m, err := NewSourceMetric("orders", &MetricConfig{Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.StackdriverName() != "custom.googleapis.com/webhook/orders" {
+		t.Errorf("unexpected metric name %s", m.StackdriverName())
+	}
+	if m.Query() != "/webhook/orders" {
+		t.Errorf("unexpected query %s", m.Query())
+	}
+}
+
+func TestReadSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &MetricConfig{TokenFile: "token"}
+	if err := c.ReadSecretFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+	if c.Token != "secret" {
+		t.Errorf("expected the token to be read from the file; got %q", c.Token)
+	}
+	c = &MetricConfig{Token: "other", TokenFile: "token"}
+	if err := c.ReadSecretFiles(dir); err == nil {
+		t.Error("expected an error when both token and token_file are set")
+	}
+}
+
+func TestParseBatch(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+		want        []point
+		wantErr     string
+	}{
+		{
+			name:        "csv with header",
+			contentType: "text/csv; charset=utf-8",
+			body:        "timestamp,value\n2024-05-01T11:00:00Z,1.5\n1714561200, 2\n",
+			want:        []point{{t: now.Add(-time.Hour), value: 1.5}, {t: now.Add(-time.Hour), value: 2}},
+		},
+		{
+			name: "csv without content type",
+			body: "2024-05-01T11:00:00.1234Z,-3\n",
+			want: []point{{t: now.Add(-time.Hour + 123*time.Millisecond), value: -3}},
+		},
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        `[{"timestamp": "2024-05-01T11:00:00+01:00", "value": 1}, {"timestamp": 1714561200.5, "value": "2.5"}]`,
+			want:        []point{{t: now.Add(-2 * time.Hour), value: 1}, {t: now.Add(-time.Hour + 500*time.Millisecond), value: 2.5}},
+		},
+		{
+			name: "json without content type",
+			body: ` [{"timestamp": 1714561200, "value": 7}]`,
+			want: []point{{t: now.Add(-time.Hour), value: 7}},
+		},
+		{
+			name:        "unsupported content type",
+			contentType: "application/xml",
+			body:        "<points/>",
+			wantErr:     "unsupported content type",
+		},
+		{
+			name:    "wrong number of columns",
+			body:    "2024-05-01T11:00:00Z,1,extra\n",
+			wantErr: "wrong number of fields",
+		},
+		{
+			name:    "invalid timestamp",
+			body:    "2024-05-01T11:00:00Z,1\nyesterday,2\n",
+			wantErr: `row 2: invalid timestamp "yesterday"`,
+		},
+		{
+			name:    "invalid value",
+			body:    "2024-05-01T11:00:00Z,NaN\n",
+			wantErr: `row 1: invalid value "NaN"`,
+		},
+		{
+			name:        "missing json value",
+			contentType: "application/json",
+			body:        `[{"timestamp": 1714561200}]`,
+			wantErr:     "point 1: timestamp and value are required",
+		},
+		{
+			name:    "future timestamp",
+			body:    "2024-05-01T12:00:01Z,1\n",
+			wantErr: "point 1: timestamp 2024-05-01T12:00:01Z is in the future",
+		},
+		{
+			name:    "old timestamp",
+			body:    "2024-05-01T11:00:00Z,1\n2024-04-30T11:00:00Z,1\n",
+			wantErr: "point 2: timestamp 2024-04-30T11:00:00Z is older than 24h0m0s",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseBatch([]byte(tt.body), tt.contentType, now, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q; got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %v; got %v", tt.want, got)
+			}
+			for i := range got {
+				if !got[i].t.Equal(tt.want[i].t) || got[i].value != tt.want[i].value {
+					t.Errorf("expected point %d to be %v; got %v", i, tt.want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseBatchTimeZone(t *testing.T) {
+	body := []byte("2024-05-01 13:30:00,1\n2024-05-01T13:45:00.5,2\n2024-05-01T11:50:00Z,3\n")
+	if _, err := parseBatch(body, "text/csv", now, nil); err == nil {
+		t.Error("expected timestamps without offset to be rejected without a time zone")
+	}
+
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseBatch(body, "text/csv", now, timezone.NewConverter(loc, time.Time{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Time{
+		now.Add(-30 * time.Minute),
+		now.Add(-15*time.Minute + 500*time.Millisecond),
+		now.Add(-10 * time.Minute),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d points; got %v", len(want), got)
+	}
+	for i := range got {
+		if !got[i].t.Equal(want[i]) {
+			t.Errorf("expected point %d at %v; got %v", i, want[i], got[i].t)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	defer useFakeClock()()
+	m := newMetric(t, &MetricConfig{Token: "secret", BufferSize: 2})
+
+	for _, tt := range []struct {
+		name        string
+		method      string
+		token       string
+		contentType string
+		body        string
+		want        int
+	}{
+		{name: "get", method: http.MethodGet, token: "secret", want: http.StatusMethodNotAllowed},
+		{name: "no token", method: http.MethodPost, body: "1714561200,1", want: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodPost, token: "secre", body: "1714561200,1", want: http.StatusUnauthorized},
+		{name: "invalid batch", method: http.MethodPost, token: "secret", body: "1714561200,x", want: http.StatusBadRequest},
+		{name: "unsupported type", method: http.MethodPost, token: "secret", contentType: "application/xml", body: "<x/>", want: http.StatusUnsupportedMediaType},
+		{name: "too many points", method: http.MethodPost, token: "secret", body: "1714561200,1\n1714561201,1\n1714561202,1", want: http.StatusBadRequest},
+		{name: "too large", method: http.MethodPost, token: "secret", body: strings.Repeat(" ", maxBodySize+1), want: http.StatusRequestEntityTooLarge},
+		{name: "accepted", method: http.MethodPost, token: "secret", body: "1714561200,1", want: http.StatusAccepted},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/webhook/orders", strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("expected status %d; got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+	if got := syncedValues(t, m, time.Time{}); !reflect.DeepEqual(got, []string{"11:00:00=1"}) {
+		t.Errorf("expected only the accepted point to be buffered; got %v", got)
+	}
+}
+
+func TestSignedRequests(t *testing.T) {
+	defer useFakeClock()()
+	m := newMetric(t, &MetricConfig{SigningSecret: "key", BufferSize: 1, Overflow: overflowBlock})
+
+	postSigned := func(timestamp int64, signature, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/webhook/orders", strings.NewReader(body))
+		r.Header.Set(TimestampHeader, fmt.Sprint(timestamp))
+		r.Header.Set(SignatureHeader, signature)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r)
+		return w.Code
+	}
+	body := "1714561200,1"
+	ts := now.Unix()
+	for _, tt := range []struct {
+		name      string
+		timestamp int64
+		signature string
+		want      int
+	}{
+		{"unsigned", ts, "", http.StatusUnauthorized},
+		{"wrong secret", ts, sign("other", ts, []byte(body)), http.StatusUnauthorized},
+		{"wrong timestamp", ts + 1, sign("key", ts, []byte(body)), http.StatusUnauthorized},
+		{"expired", ts - 301, sign("key", ts-301, []byte(body)), http.StatusUnauthorized},
+		{"accepted", ts - 60, sign("key", ts-60, []byte(body)), http.StatusAccepted},
+		{"replayed", ts - 60, sign("key", ts-60, []byte(body)), http.StatusConflict},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postSigned(tt.timestamp, tt.signature, body); got != tt.want {
+				t.Errorf("expected status %d; got %d", tt.want, got)
+			}
+		})
+	}
+
+	// A rejected request can be posted again.
+	full := "1714561260,2"
+	sig := sign("key", ts, []byte(full))
+	if got := postSigned(ts, sig, full); got != http.StatusTooManyRequests {
+		t.Fatalf("expected the batch to be rejected while the buffer is full; got %d", got)
+	}
+	syncedValues(t, m, time.Time{})
+	syncedValues(t, m, now)
+	if got := postSigned(ts, sig, full); got != http.StatusAccepted {
+		t.Errorf("expected the rejected batch to be accepted after a sync; got %d", got)
+	}
+}
+
+func TestStackdriverData(t *testing.T) {
+	defer useFakeClock()()
+	m := newMetric(t, &MetricConfig{Token: "secret"})
+
+	// Batches are merged in time order, and unsynced points can be corrected by posting them again.
+	if code := post(m, "secret", "", "11:30,x"); code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid batch to be rejected; got %d", code)
+	}
+	post(m, "secret", "", "2024-05-01T11:30:00Z,3\n2024-05-01T11:00:00Z,1\n")
+	post(m, "secret", "application/json", `[{"timestamp": "2024-05-01T11:15:00Z", "value": 2}, {"timestamp": "2024-05-01T11:30:00Z", "value": 4}]`)
+	want := []string{"11:00:00=1", "11:15:00=2", "11:30:00=4"}
+	if got := syncedValues(t, m, now.Add(-2*time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v; got %v", want, got)
+	}
+
+	// Points are returned again until they have been written.
+	if got := syncedValues(t, m, now.Add(-2*time.Hour)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points to be returned until written; got %v", got)
+	}
+
+	// Points that are not newer than written points are discarded.
+	post(m, "secret", "", "2024-05-01T11:30:00Z,5\n2024-05-01T11:10:00Z,6\n2024-05-01T11:45:00Z,7\n")
+	want = []string{"11:45:00=7"}
+	if got := syncedValues(t, m, now.Add(-30*time.Minute)); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v; got %v", want, got)
+	}
+	b := getBuffer(m.Name)
+	if _, _, stale := b.buffered(now.Add(-30 * time.Minute)); stale != 0 {
+		t.Errorf("expected stale points to be counted once; got %d", stale)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	defer useFakeClock()()
+	m := newMetric(t, &MetricConfig{Token: "secret", BufferSize: 2})
+
+	post(m, "secret", "", "2024-05-01T11:00:00Z,1\n2024-05-01T11:01:00Z,2\n")
+	post(m, "secret", "", "2024-05-01T11:02:00Z,3\n")
+	points, dropped, _ := getBuffer(m.Name).buffered(time.Time{})
+	if len(points) != 2 || points[0].value != 2 || dropped != 1 {
+		t.Errorf("expected the oldest point to be dropped; got %v with %d dropped", points, dropped)
+	}
+}
+
+func TestBufferOverflow(t *testing.T) {
+	defer useFakeClock()()
+	first := "2024-05-01T11:00:00Z,1\n2024-05-01T11:01:00Z,2\n"
+	second := "2024-05-01T11:02:00Z,3\n2024-05-01T11:03:00Z,4\n"
+
+	m := newMetric(t, &MetricConfig{Token: "secret", BufferSize: 3, Overflow: "downsample"})
+	post(m, "secret", "", first)
+	post(m, "secret", "", second)
+	if got, want := syncedValues(t, m, time.Time{}), []string{"11:01:00=2", "11:03:00=4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected every other point to be removed; got %v", got)
+	}
+	if dropped, policy := m.DroppedPoints(); dropped != 2 || policy != "downsample" {
+		t.Errorf("expected 2 downsampled points; got %d (%s)", dropped, policy)
+	}
+	if dropped, _ := m.DroppedPoints(); dropped != 0 {
+		t.Errorf("expected dropped points to be reset once reported; got %d", dropped)
+	}
+
+	m = newMetric(t, &MetricConfig{Token: "secret", BufferSize: 3, Overflow: "block"})
+	m.Name = "blocked"
+	if code := post(m, "secret", "", first); code != http.StatusAccepted {
+		t.Errorf("expected a batch that fits to be accepted; got status %d", code)
+	}
+	if code := post(m, "secret", "", second); code != http.StatusTooManyRequests {
+		t.Errorf("expected a batch that does not fit to be rejected; got status %d", code)
+	}
+	// Replacing buffered points doesn't need room in the buffer.
+	if code := post(m, "secret", "", "2024-05-01T11:01:00Z,5\n2024-05-01T11:02:00Z,3\n"); code != http.StatusAccepted {
+		t.Errorf("expected a batch that fits to be accepted; got status %d", code)
+	}
+	if got, want := syncedValues(t, m, time.Time{}), []string{"11:00:00=1", "11:01:00=5", "11:02:00=3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected no points to be dropped; got %v", got)
+	}
+}
+
+func TestIdleBuffers(t *testing.T) {
+	defer useFakeClock()()
+	m := newMetric(t, &MetricConfig{Token: "secret"})
+
+	post(m, "secret", "", "2024-05-01T11:00:00Z,1\n")
+	timeNow = func() time.Time { return now.Add(idleTimeout + time.Second) }
+	if points, _, _ := getBuffer(m.Name).buffered(time.Time{}); len(points) != 0 {
+		t.Errorf("expected the idle buffer to be discarded; got %v", points)
+	}
+}
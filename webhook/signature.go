@@ -0,0 +1,110 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers of signed requests. The signature is `sha256=` followed by the hex-encoded HMAC-SHA256 of the timestamp
+// (in seconds since the Unix epoch), a dot and the body, so that neither the batch nor its timestamp can be changed.
+const (
+	TimestampHeader = "X-TS-Bridge-Timestamp"
+	SignatureHeader = "X-TS-Bridge-Signature"
+)
+
+const signaturePrefix = "sha256="
+
+// errReplayed is returned for signed requests that have already been accepted.
+var errReplayed = errors.New("this signed request has already been accepted")
+
+// Signatures of accepted requests are remembered until their timestamp leaves the replay window, so that a captured
+// request cannot be posted again. Like buffers, they are kept across configuration reloads.
+var (
+	signaturesMu sync.Mutex
+	signatures   = make(map[string]map[string]time.Time) // expiry of signatures by metric name.
+)
+
+// sign returns the signature of a body posted at a given time.
+func sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignature verifies the signature of a request posting points of the metric, and that its timestamp is within
+// the replay window. It returns the signature and the time it expires at, since it needs to be reserved before the
+// batch is accepted.
+func (m *Metric) checkSignature(h http.Header, body []byte) (string, time.Time, error) {
+	ts, sig := h.Get(TimestampHeader), h.Get(SignatureHeader)
+	if ts == "" || sig == "" {
+		return "", time.Time{}, fmt.Errorf("the %s and %s headers are required", TimestampHeader, SignatureHeader)
+	}
+	timestamp, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid %s header %q", TimestampHeader, ts)
+	}
+	if !strings.HasPrefix(sig, signaturePrefix) {
+		return "", time.Time{}, fmt.Errorf("unsupported signature; expected %s<hex-encoded HMAC-SHA256>", signaturePrefix)
+	}
+	if !hmac.Equal([]byte(sig), []byte(sign(m.config.SigningSecret, timestamp, body))) {
+		return "", time.Time{}, errors.New("invalid signature")
+	}
+	// Points of signed requests are accepted for as long as their signature is remembered, but not longer.
+	if d := timeNow().Sub(time.Unix(timestamp, 0)); d > m.config.replayWindow() || d < -m.config.replayWindow() {
+		return "", time.Time{}, fmt.Errorf("the signed timestamp is more than %v from the current time", m.config.replayWindow())
+	}
+	return sig, time.Unix(timestamp, 0).Add(m.config.replayWindow()), nil
+}
+
+// reserveSignature remembers the signature of a request until it expires. It returns errReplayed if the signature
+// has already been reserved.
+func (m *Metric) reserveSignature(sig string, expiry time.Time) error {
+	now := timeNow()
+	signaturesMu.Lock()
+	defer signaturesMu.Unlock()
+	seen := signatures[m.Name]
+	if seen == nil {
+		seen = make(map[string]time.Time)
+		signatures[m.Name] = seen
+	}
+	for s, expiry := range seen {
+		if now.After(expiry) {
+			delete(seen, s)
+		}
+	}
+	if _, ok := seen[sig]; ok {
+		return errReplayed
+	}
+	seen[sig] = expiry
+	return nil
+}
+
+// releaseSignature forgets a reserved signature, so that a rejected request can be posted again.
+func (m *Metric) releaseSignature(sig string) {
+	signaturesMu.Lock()
+	defer signaturesMu.Unlock()
+	delete(signatures[m.Name], sig)
+}
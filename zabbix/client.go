@@ -0,0 +1,128 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zabbix
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+)
+
+// Error code that Zabbix returns for internal errors, which are worth retrying.
+const rpcInternalError = -32603
+
+// client sends requests to the Zabbix JSON-RPC API.
+type client struct {
+	endpoint string
+	http     *http.Client
+	// auth is the API token or session ID sent with authenticated requests.
+	auth   string
+	nextID int
+}
+
+type rpcRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+	Auth    string      `json:"auth,omitempty"`
+	ID      int         `json:"id"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+}
+
+// rpcError is an error reported by the Zabbix API.
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    string `json:"data"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("Zabbix API error %d: %s %s", e.Code, e.Message, e.Data)
+}
+
+// call runs an API method, and decodes its result into `result`. Requests are authenticated once the client has
+// logged in or has an API token.
+func (c *client) call(ctx context.Context, method string, params, result interface{}) error {
+	c.nextID++
+	body, err := json.Marshal(&rpcRequest{JSONRPC: "2.0", Method: method, Params: params, Auth: c.auth, ID: c.nextID})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return tserrors.Wrap(tserrors.ErrSourcePermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json-rpc")
+	if id := requestid.FromContext(ctx); id != "" {
+		req.Header.Set(requestid.Header, id)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return tserrors.ClassifySource(fmt.Errorf("Zabbix API request %s failed: %w", method, err))
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return tserrors.ClassifySource(fmt.Errorf("cannot read response to Zabbix API request %s: %w", method, err))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return tserrors.FromHTTPStatus(resp.StatusCode, fmt.Errorf("Zabbix API request %s returned HTTP status code %d", method, resp.StatusCode))
+	}
+
+	var r rpcResponse
+	if err := json.Unmarshal(data, &r); err != nil {
+		return fmt.Errorf("cannot parse response to Zabbix API request %s: %v", method, err)
+	}
+	if r.Error != nil {
+		if r.Error.Code == rpcInternalError {
+			return tserrors.Wrap(tserrors.ErrSourceTransient, r.Error)
+		}
+		// Other errors (e.g. invalid parameters or failed authentication) won't go away when retried.
+		return tserrors.Wrap(tserrors.ErrSourcePermanent, r.Error)
+	}
+	if err := json.Unmarshal(r.Result, result); err != nil {
+		return fmt.Errorf("cannot parse result of Zabbix API request %s: %v", method, err)
+	}
+	return nil
+}
+
+// login starts an API session, unless the client authenticates with an API token.
+func (c *client) login(ctx context.Context, username, password string) error {
+	if c.auth != "" {
+		return nil
+	}
+	var session string
+	if err := c.call(ctx, "user.login", map[string]string{"username": username, "password": password}, &session); err != nil {
+		return fmt.Errorf("cannot log in to Zabbix: %w", err)
+	}
+	c.auth = session
+	return nil
+}
+
+// logout ends an API session started by login, so that sessions don't pile up on the Zabbix server.
+func (c *client) logout(ctx context.Context) error {
+	var ok bool
+	return c.call(ctx, "user.logout", []string{}, &ok)
+}
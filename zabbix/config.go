@@ -0,0 +1,115 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zabbix
+
+import (
+	"fmt"
+
+	"github.com/google/ts-bridge/env"
+	"github.com/google/ts-bridge/httpclient"
+)
+
+// defaultHostLabel is the name of the Stackdriver label that has the host of an item, unless configured.
+const defaultHostLabel = "host"
+
+// MetricConfig defines the configuration file parameters for a specific metric imported from Zabbix.
+type MetricConfig struct {
+	// Endpoint is the URL of the Zabbix API, e.g. https://zabbix.corp/api_jsonrpc.php.
+	Endpoint string `validate:"nonzero"`
+
+	// Either an API token or a username and password are used to authenticate.
+	APIToken string `yaml:"api_token"`
+	Username string
+	Password string
+
+	// Items are selected either by their IDs, or by their key (optionally limited to some hosts).
+	ItemIDs []string `yaml:"item_ids"`
+	Key     string
+	Hosts   []string
+
+	// HostLabel is the name of the label that has the host of an item.
+	HostLabel string `yaml:"host_label" validate:"regexp=^([a-z][a-z0-9_]*)?$"`
+	// HostLabels sets additional labels for items of some hosts, keyed by the host name.
+	HostLabels map[string]map[string]string `yaml:"host_labels"`
+
+	// Trends imports hourly trends instead of item history. TrendValue selects the value (avg, min or max) that is
+	// imported for each hour.
+	Trends     bool
+	TrendValue string `yaml:"trend_value" validate:"regexp=^(|avg|min|max)$"`
+
+	HTTP httpclient.Config `yaml:"http"`
+
+	// Secrets can also be read from files, e.g. from a mounted Kubernetes secret.
+	APITokenFile string `yaml:"api_token_file"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// ReadSecretFiles sets the API token and password from the contents of the configured files. Relative paths are
+// resolved relative to `dir`.
+func (c *MetricConfig) ReadSecretFiles(dir string) error {
+	for _, s := range []struct {
+		name, file string
+		value      *string
+	}{
+		{"api_token", c.APITokenFile, &c.APIToken},
+		{"password", c.PasswordFile, &c.Password},
+	} {
+		if s.file == "" {
+			continue
+		}
+		if *s.value != "" {
+			return fmt.Errorf("%s and %s_file cannot both be set", s.name, s.name)
+		}
+		v, err := env.ReadSecretFile(dir, s.file)
+		if err != nil {
+			return fmt.Errorf("cannot read %s_file: %v", s.name, err)
+		}
+		*s.value = v
+	}
+	return nil
+}
+
+// validate checks parameters that cannot be verified using struct tags.
+func (c *MetricConfig) validate() error {
+	if (c.APIToken == "") == (c.Username == "") {
+		return fmt.Errorf("either api_token or username needs to be set")
+	}
+	if (len(c.ItemIDs) == 0) == (c.Key == "") {
+		return fmt.Errorf("either item_ids or key needs to be set")
+	}
+	if len(c.Hosts) > 0 && c.Key == "" {
+		return fmt.Errorf("hosts can only be set along with key")
+	}
+	if c.TrendValue != "" && !c.Trends {
+		return fmt.Errorf("trend_value requires trends to be set")
+	}
+	return nil
+}
+
+// hostLabel returns the name of the label that has the host of an item.
+func (c *MetricConfig) hostLabel() string {
+	if c.HostLabel != "" {
+		return c.HostLabel
+	}
+	return defaultHostLabel
+}
+
+// trendValue returns the name of the trend field that is imported.
+func (c *MetricConfig) trendValue() string {
+	if c.TrendValue != "" {
+		return "value_" + c.TrendValue
+	}
+	return "value_avg"
+}
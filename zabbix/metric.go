@@ -0,0 +1,450 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package zabbix imports item history and trends from the Zabbix JSON-RPC API.
+package zabbix
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/ts-bridge/storage"
+
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// By passing around a time function, we can easily stub time in tests.
+var timeNow = time.Now
+
+// trendPeriod is the period Zabbix aggregates trends over.
+const trendPeriod = time.Hour
+
+// itemKeyLabel is the label that has the item key, for metrics importing items by ID.
+const itemKeyLabel = "item_key"
+
+// Zabbix item value types, as returned by the API. Log items cannot be imported.
+const (
+	valueFloat    = "0"
+	valueChar     = "1"
+	valueLog      = "2"
+	valueUnsigned = "3"
+	valueText     = "4"
+)
+
+// units maps common Zabbix item units to Stackdriver units.
+var units = map[string]string{"B": "By", "%": "%", "s": "s", "bps": "bit/s", "Bps": "By/s"}
+
+// Metric defines a Zabbix-based metric. It implements the SourceMetric interface.
+type Metric struct {
+	Name        string
+	config      *MetricConfig
+	httpClient  *http.Client
+	minPointAge time.Duration
+}
+
+// NewSourceMetric creates a new SourceMetric from a metric name and configuration parameters.
+func NewSourceMetric(name string, config *MetricConfig, minPointAge time.Duration) (*Metric, error) {
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration of metric %s: %v", name, err)
+	}
+	httpClient, err := config.HTTP.Client()
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP settings for metric %s: %v", name, err)
+	}
+	return &Metric{
+		Name:        name,
+		config:      config,
+		httpClient:  httpClient,
+		minPointAge: minPointAge,
+	}, nil
+}
+
+// StackdriverName returns the full Stackdriver metric name (also called "metric type") for this metric.
+func (m *Metric) StackdriverName() string {
+	return fmt.Sprintf("custom.googleapis.com/zabbix/%s", m.Name)
+}
+
+// SourceType returns the type of the source. It's used to tag stats.
+func (m *Metric) SourceType() string {
+	return "zabbix"
+}
+
+// SourceHost returns the host of the Zabbix API endpoint. It's used by the circuit breaker.
+func (m *Metric) SourceHost() string {
+	u, err := url.Parse(m.config.Endpoint)
+	if err != nil || u.Host == "" {
+		return m.config.Endpoint
+	}
+	return u.Host
+}
+
+// Query returns a description of the Zabbix items imported by this metric.
+func (m *Metric) Query() string {
+	var q string
+	if m.config.Key != "" {
+		q = fmt.Sprintf("items with key %s", m.config.Key)
+		if len(m.config.Hosts) > 0 {
+			q += fmt.Sprintf(" on hosts %s", strings.Join(m.config.Hosts, ", "))
+		}
+	} else {
+		q = fmt.Sprintf("items %s", strings.Join(m.config.ItemIDs, ", "))
+	}
+	if m.config.Trends {
+		q += fmt.Sprintf(" (hourly %s trends)", strings.TrimPrefix(m.config.trendValue(), "value_"))
+	}
+	return q
+}
+
+// StackdriverData queries Zabbix, returning metric descriptor and time series data with points after the given
+// lastPoint timestamp.
+func (m *Metric) StackdriverData(ctx context.Context, lastPoint time.Time, rec storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	return m.StackdriverDataUntil(ctx, lastPoint, time.Time{}, rec)
+}
+
+// Windowed returns whether the metric can be queried in windows, which is always the case for Zabbix metrics.
+func (m *Metric) Windowed() bool {
+	return true
+}
+
+// StackdriverDataUntil works like StackdriverData, but only queries points up to `until`, unless it's zero.
+func (m *Metric) StackdriverDataUntil(ctx context.Context, lastPoint, until time.Time, _ storage.MetricRecord) (*metricpb.MetricDescriptor, []*monitoringpb.TimeSeries, error) {
+	// Points that are too fresh are ignored, since Zabbix proxies might not have sent them yet.
+	end := timeNow().Add(-m.minPointAge)
+	if !until.IsZero() && until.Before(end) {
+		end = until
+	}
+	if !end.After(lastPoint) {
+		return nil, nil, nil
+	}
+
+	c := &client{endpoint: m.config.Endpoint, http: m.httpClient, auth: m.config.APIToken}
+	if err := c.login(ctx, m.config.Username, m.config.Password); err != nil {
+		return nil, nil, err
+	}
+	if m.config.APIToken == "" {
+		defer func() {
+			if err := c.logout(ctx); err != nil {
+				log.WithContext(ctx).Warningf("Cannot log out of Zabbix: %v", err)
+			}
+		}()
+	}
+
+	items, err := m.items(ctx, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(items) == 0 {
+		log.WithContext(ctx).Infof("Zabbix metric %s does not match any items (%s)", m.Name, m.Query())
+		return nil, nil, nil
+	}
+	desc, err := m.metricDescriptor(items)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var points []point
+	if m.config.Trends {
+		points, err = m.trends(ctx, c, items, lastPoint, end)
+	} else {
+		points, err = m.history(ctx, c, items, lastPoint, end)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	log.WithContext(ctx).Debugf("Got %d points from %d Zabbix items (%s)", len(points), len(items), m.Query())
+
+	ts, err := m.convertPoints(items, points, desc.ValueType)
+	if err != nil {
+		return nil, nil, err
+	}
+	return desc, ts, nil
+}
+
+// item is a Zabbix item, as returned by item.get.
+type item struct {
+	ItemID    string `json:"itemid"`
+	Key       string `json:"key_"`
+	Name      string `json:"name"`
+	ValueType string `json:"value_type"`
+	Units     string `json:"units"`
+	Hosts     []struct {
+		Host string `json:"host"`
+	} `json:"hosts"`
+}
+
+// host returns the technical name of the host of an item.
+func (i *item) host() string {
+	if len(i.Hosts) == 0 {
+		return ""
+	}
+	return i.Hosts[0].Host
+}
+
+// numeric returns whether values of an item are numbers.
+func (i *item) numeric() bool {
+	return i.ValueType == valueFloat || i.ValueType == valueUnsigned
+}
+
+// items returns items imported by this metric, looking them up either by ID or by key.
+func (m *Metric) items(ctx context.Context, c *client) ([]*item, error) {
+	params := map[string]interface{}{
+		"output":      []string{"itemid", "key_", "name", "value_type", "units"},
+		"selectHosts": []string{"host"},
+	}
+	if len(m.config.ItemIDs) > 0 {
+		params["itemids"] = m.config.ItemIDs
+	} else {
+		params["filter"] = map[string]string{"key_": m.config.Key}
+	}
+	var items []*item
+	if err := c.call(ctx, "item.get", params, &items); err != nil {
+		return nil, fmt.Errorf("cannot get Zabbix items: %w", err)
+	}
+	if len(m.config.Hosts) == 0 {
+		return items, nil
+	}
+	hosts := make(map[string]bool)
+	for _, h := range m.config.Hosts {
+		hosts[h] = true
+	}
+	var filtered []*item
+	for _, i := range items {
+		if hosts[i.host()] {
+			filtered = append(filtered, i)
+		}
+	}
+	return filtered, nil
+}
+
+// point is a single value of a Zabbix item.
+type point struct {
+	itemID string
+	end    time.Time
+	value  string
+}
+
+// history returns item values after `lastPoint` and up to `end`. Items are queried by value type, since history.get
+// only returns values of a single type.
+func (m *Metric) history(ctx context.Context, c *client, items []*item, lastPoint, end time.Time) ([]point, error) {
+	byType := make(map[string][]string)
+	for _, i := range items {
+		byType[i.ValueType] = append(byType[i.ValueType], i.ItemID)
+	}
+	var points []point
+	for valueType, ids := range byType {
+		var values []struct {
+			ItemID string `json:"itemid"`
+			Clock  string `json:"clock"`
+			NS     string `json:"ns"`
+			Value  string `json:"value"`
+		}
+		err := c.call(ctx, "history.get", map[string]interface{}{
+			"output":    "extend",
+			"history":   valueType,
+			"itemids":   ids,
+			"time_from": lastPoint.Unix(),
+			"time_till": end.Unix(),
+			"sortfield": "clock",
+			"sortorder": "ASC",
+		}, &values)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get history of Zabbix items: %w", err)
+		}
+		for _, v := range values {
+			t, err := parseClock(v.Clock, v.NS)
+			if err != nil {
+				return nil, err
+			}
+			// Time ranges of Zabbix queries have a granularity of seconds.
+			if t.After(lastPoint) && !t.After(end) {
+				points = append(points, point{v.ItemID, t, v.Value})
+			}
+		}
+	}
+	return points, nil
+}
+
+// trends returns hourly trends of items that end after `lastPoint` and up to `end`. Trends are written with the end
+// time of the hour they aggregate, so that only complete hours are imported.
+func (m *Metric) trends(ctx context.Context, c *client, items []*item, lastPoint, end time.Time) ([]point, error) {
+	ids := make([]string, 0, len(items))
+	for _, i := range items {
+		ids = append(ids, i.ItemID)
+	}
+	var values []map[string]string
+	err := c.call(ctx, "trend.get", map[string]interface{}{
+		"output":    []string{"itemid", "clock", m.config.trendValue()},
+		"itemids":   ids,
+		"time_from": lastPoint.Add(-trendPeriod).Unix(),
+		"time_till": end.Unix(),
+	}, &values)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get trends of Zabbix items: %w", err)
+	}
+	var points []point
+	for _, v := range values {
+		t, err := parseClock(v["clock"], "")
+		if err != nil {
+			return nil, err
+		}
+		t = t.Add(trendPeriod)
+		if t.After(lastPoint) && !t.After(end) {
+			points = append(points, point{v["itemid"], t, v[m.config.trendValue()]})
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].end.Before(points[j].end) })
+	return points, nil
+}
+
+// parseClock parses Zabbix timestamps, which are given as seconds and nanoseconds.
+func parseClock(clock, ns string) (time.Time, error) {
+	sec, err := strconv.ParseInt(clock, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid Zabbix timestamp '%s': %v", clock, err)
+	}
+	var nsec int64
+	if ns != "" {
+		if nsec, err = strconv.ParseInt(ns, 10, 64); err != nil {
+			return time.Time{}, fmt.Errorf("invalid Zabbix timestamp nanoseconds '%s': %v", ns, err)
+		}
+	}
+	return time.Unix(sec, nsec), nil
+}
+
+// metricDescriptor creates a Stackdriver MetricDescriptor for the given items. All items need to have values of the
+// same kind (numbers or strings).
+func (m *Metric) metricDescriptor(items []*item) (*metricpb.MetricDescriptor, error) {
+	valueType := metricpb.MetricDescriptor_DOUBLE
+	unit := units[items[0].Units]
+	for n, i := range items {
+		if i.ValueType == valueLog {
+			return nil, fmt.Errorf("Zabbix item %s (%s) is a log item, which cannot be imported", i.ItemID, i.Key)
+		}
+		if n > 0 && i.numeric() != items[0].numeric() {
+			return nil, fmt.Errorf("Zabbix items of metric %s need to be either all numeric or all text", m.Name)
+		}
+		if units[i.Units] != unit {
+			unit = ""
+		}
+	}
+	if !items[0].numeric() {
+		if m.config.Trends {
+			return nil, fmt.Errorf("trends are only available for numeric Zabbix items")
+		}
+		valueType = metricpb.MetricDescriptor_STRING
+	}
+
+	labels := []*label.LabelDescriptor{{
+		Key:         m.config.hostLabel(),
+		ValueType:   label.LabelDescriptor_STRING,
+		Description: "Zabbix host",
+	}}
+	if len(m.config.ItemIDs) > 0 {
+		labels = append(labels, &label.LabelDescriptor{
+			Key:         itemKeyLabel,
+			ValueType:   label.LabelDescriptor_STRING,
+			Description: "Zabbix item key",
+		})
+	}
+	for _, key := range m.hostLabelKeys() {
+		labels = append(labels, &label.LabelDescriptor{Key: key, ValueType: label.LabelDescriptor_STRING})
+	}
+
+	return &metricpb.MetricDescriptor{
+		Type:        m.StackdriverName(),
+		MetricKind:  metricpb.MetricDescriptor_GAUGE,
+		ValueType:   valueType,
+		Unit:        unit,
+		Description: fmt.Sprintf("Zabbix %s", m.Query()),
+		DisplayName: m.Name,
+		Labels:      labels,
+	}, nil
+}
+
+// hostLabelKeys returns the sorted keys of additional labels configured for hosts.
+func (m *Metric) hostLabelKeys() []string {
+	keys := make(map[string]bool)
+	for _, labels := range m.config.HostLabels {
+		for k := range labels {
+			keys[k] = true
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// metricLabels returns Stackdriver metric labels of an item.
+func (m *Metric) metricLabels(i *item) map[string]string {
+	labels := map[string]string{m.config.hostLabel(): i.host()}
+	if len(m.config.ItemIDs) > 0 {
+		labels[itemKeyLabel] = i.Key
+	}
+	for k, v := range m.config.HostLabels[i.host()] {
+		labels[k] = v
+	}
+	return labels
+}
+
+// convertPoints converts Zabbix item values into Stackdriver time series with a single point each.
+func (m *Metric) convertPoints(items []*item, points []point, valueType metricpb.MetricDescriptor_ValueType) ([]*monitoringpb.TimeSeries, error) {
+	byID := make(map[string]*item)
+	for _, i := range items {
+		byID[i.ItemID] = i
+	}
+	ts := make([]*monitoringpb.TimeSeries, 0, len(points))
+	for _, p := range points {
+		i, ok := byID[p.itemID]
+		if !ok {
+			return nil, fmt.Errorf("Zabbix returned a value of unexpected item %s", p.itemID)
+		}
+		end, err := ptypes.TimestampProto(p.end)
+		if err != nil {
+			return nil, fmt.Errorf("Could not convert timestamp %v to proto: %v", p.end, err)
+		}
+		value := &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_StringValue{StringValue: p.value}}
+		if valueType == metricpb.MetricDescriptor_DOUBLE {
+			f, err := strconv.ParseFloat(p.value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value '%s' of Zabbix item %s: %v", p.value, p.itemID, err)
+			}
+			value = &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: f}}
+		}
+		ts = append(ts, &monitoringpb.TimeSeries{
+			Metric:     &metricpb.Metric{Type: m.StackdriverName(), Labels: m.metricLabels(i)},
+			Resource:   &monitoredres.MonitoredResource{Type: "global"},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  valueType,
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: end},
+				Value:    value,
+			}},
+		})
+	}
+	return ts, nil
+}
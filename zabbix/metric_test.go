@@ -0,0 +1,334 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zabbix
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/ts-bridge/requestid"
+	"github.com/google/ts-bridge/tserrors"
+
+	"github.com/golang/protobuf/ptypes"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// fakeZabbix implements the Zabbix JSON-RPC API, answering each method with a fixed result.
+type fakeZabbix struct {
+	t       *testing.T
+	results map[string]interface{}
+	errors  map[string]*rpcError
+	// requests has parameters of received requests by method, and auth has the auth field of the last request.
+	requests   map[string]map[string]interface{}
+	auth       string
+	requestIDs []string
+}
+
+func newFakeZabbix(t *testing.T) *fakeZabbix {
+	return &fakeZabbix{
+		t:        t,
+		results:  make(map[string]interface{}),
+		errors:   make(map[string]*rpcError),
+		requests: make(map[string]map[string]interface{}),
+	}
+}
+
+func (f *fakeZabbix) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+		Auth   string          `json:"auth"`
+		ID     int             `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		f.t.Errorf("cannot decode request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	params := make(map[string]interface{})
+	json.Unmarshal(req.Params, &params)
+	f.requests[req.Method] = params
+	f.auth = req.Auth
+	f.requestIDs = append(f.requestIDs, r.Header.Get(requestid.Header))
+
+	resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+	if err, ok := f.errors[req.Method]; ok {
+		resp["error"] = err
+	} else if result, ok := f.results[req.Method]; ok {
+		resp["result"] = result
+	} else {
+		f.t.Errorf("unexpected request %s", req.Method)
+		resp["error"] = &rpcError{Code: -32601, Message: "Method not found."}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// testPoint is a simplified representation of a point written to Stackdriver.
+type testPoint struct {
+	labels map[string]string
+	offset time.Duration // relative to the start of a test.
+	value  interface{}
+}
+
+func testPoints(t *testing.T, start time.Time, ts []*monitoringpb.TimeSeries) []testPoint {
+	var points []testPoint
+	for _, s := range ts {
+		end, err := ptypes.Timestamp(s.Points[0].Interval.EndTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v interface{} = s.Points[0].Value.GetDoubleValue()
+		if s.ValueType == metricpb.MetricDescriptor_STRING {
+			v = s.Points[0].Value.GetStringValue()
+		}
+		points = append(points, testPoint{s.Metric.Labels, end.Sub(start), v})
+	}
+	return points
+}
+
+func clock(t time.Time) string {
+	return fmt.Sprintf("%d", t.Unix())
+}
+
+func TestStackdriverDataHistory(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(10 * time.Minute) }
+
+	f := newFakeZabbix(t)
+	f.results["user.login"] = "session-id"
+	f.results["user.logout"] = true
+	f.results["item.get"] = []map[string]interface{}{
+		{"itemid": "1", "key_": "system.cpu.load", "value_type": "0", "hosts": []map[string]string{{"host": "web-1"}}},
+		{"itemid": "2", "key_": "system.cpu.load", "value_type": "0", "hosts": []map[string]string{{"host": "web-2"}}},
+		{"itemid": "3", "key_": "system.cpu.load", "value_type": "0", "hosts": []map[string]string{{"host": "db-1"}}},
+	}
+	f.results["history.get"] = []map[string]string{
+		// Values in the same second as the last point are returned by Zabbix, but have already been imported.
+		{"itemid": "1", "clock": clock(start), "ns": "0", "value": "0.5"},
+		{"itemid": "1", "clock": clock(start.Add(time.Minute)), "ns": "0", "value": "1.5"},
+		{"itemid": "2", "clock": clock(start.Add(time.Minute)), "ns": "500", "value": "2"},
+	}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	m, err := NewSourceMetric("cpu_load", &MetricConfig{
+		Endpoint:   server.URL,
+		Username:   "bridge",
+		Password:   "secret",
+		Key:        "system.cpu.load",
+		Hosts:      []string{"web-1", "web-2"},
+		HostLabels: map[string]map[string]string{"web-1": {"zone": "a"}},
+	}, 5*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	ctx := requestid.NewContext(context.Background(), "req-1")
+	desc, ts, err := m.StackdriverData(ctx, start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+
+	if got := f.requests["user.login"]; got["username"] != "bridge" || got["password"] != "secret" {
+		t.Errorf("unexpected login parameters %v", got)
+	}
+	if f.auth != "session-id" {
+		t.Errorf("expected requests to be authenticated with the session ID; got %s", f.auth)
+	}
+	if _, ok := f.requests["user.logout"]; !ok {
+		t.Errorf("expected the session to be ended")
+	}
+	if got := f.requests["item.get"]["filter"]; !reflect.DeepEqual(got, map[string]interface{}{"key_": "system.cpu.load"}) {
+		t.Errorf("expected items to be looked up by key; got filter %v", got)
+	}
+	history := f.requests["history.get"]
+	if history["history"] != "0" || history["time_from"] != float64(start.Unix()) || history["time_till"] != float64(start.Add(5*time.Minute).Unix()) {
+		t.Errorf("unexpected history parameters %v", history)
+	}
+	if got := history["itemids"]; !reflect.DeepEqual(got, []interface{}{"1", "2"}) {
+		t.Errorf("expected items of configured hosts to be queried; got %v", got)
+	}
+	for _, id := range f.requestIDs {
+		if id != "req-1" {
+			t.Errorf("expected request ID req-1 to be sent; got %v", f.requestIDs)
+			break
+		}
+	}
+
+	if desc.Type != "custom.googleapis.com/zabbix/cpu_load" || desc.ValueType != metricpb.MetricDescriptor_DOUBLE || len(desc.Labels) != 2 {
+		t.Errorf("unexpected metric descriptor %v", desc)
+	}
+	want := []testPoint{
+		{map[string]string{"host": "web-1", "zone": "a"}, time.Minute, 1.5},
+		{map[string]string{"host": "web-2"}, time.Minute + 500*time.Nanosecond, 2.0},
+	}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataTrends(t *testing.T) {
+	start := time.Now().Add(-24 * time.Hour).Truncate(time.Hour)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return start.Add(150 * time.Minute) }
+
+	f := newFakeZabbix(t)
+	f.results["item.get"] = []map[string]interface{}{
+		{"itemid": "7", "key_": "net.if.in[eth0]", "value_type": "3", "units": "bps", "hosts": []map[string]string{{"host": "gw"}}},
+	}
+	f.results["trend.get"] = []map[string]string{
+		{"itemid": "7", "clock": clock(start.Add(-time.Hour)), "value_max": "10"},
+		{"itemid": "7", "clock": clock(start), "value_max": "20"},
+		{"itemid": "7", "clock": clock(start.Add(time.Hour)), "value_max": "30"},
+		// This hour is not complete yet.
+		{"itemid": "7", "clock": clock(start.Add(2 * time.Hour)), "value_max": "40"},
+	}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	m, err := NewSourceMetric("traffic", &MetricConfig{
+		Endpoint:   server.URL,
+		APIToken:   "token",
+		ItemIDs:    []string{"7"},
+		Trends:     true,
+		TrendValue: "max",
+	}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	desc, ts, err := m.StackdriverData(context.Background(), start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if f.auth != "token" {
+		t.Errorf("expected requests to be authenticated with the API token; got %s", f.auth)
+	}
+	if _, ok := f.requests["user.login"]; ok {
+		t.Errorf("expected no session to be started when using an API token")
+	}
+	if got := f.requests["trend.get"]["output"]; !reflect.DeepEqual(got, []interface{}{"itemid", "clock", "value_max"}) {
+		t.Errorf("expected maximum trend values to be queried; got %v", got)
+	}
+	if desc.Unit != "bit/s" {
+		t.Errorf("expected unit bit/s; got %s", desc.Unit)
+	}
+	labels := map[string]string{"host": "gw", "item_key": "net.if.in[eth0]"}
+	want := []testPoint{{labels, time.Hour, 20.0}, {labels, 2 * time.Hour, 30.0}}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataText(t *testing.T) {
+	start := time.Now().Add(-time.Hour).Truncate(time.Second)
+	f := newFakeZabbix(t)
+	f.results["item.get"] = []map[string]interface{}{
+		{"itemid": "5", "key_": "service.status", "value_type": "1", "hosts": []map[string]string{{"host": "api"}}},
+	}
+	f.results["history.get"] = []map[string]string{{"itemid": "5", "clock": clock(start.Add(time.Minute)), "value": "ok"}}
+	server := httptest.NewServer(f)
+	defer server.Close()
+
+	m, err := NewSourceMetric("status", &MetricConfig{Endpoint: server.URL, APIToken: "token", Key: "service.status", HostLabel: "service"}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+	}
+	desc, ts, err := m.StackdriverData(context.Background(), start, nil)
+	if err != nil {
+		t.Fatalf("unexpected error from StackdriverData: %v", err)
+	}
+	if desc.ValueType != metricpb.MetricDescriptor_STRING {
+		t.Errorf("expected string values, which can be converted by value mapping; got %v", desc.ValueType)
+	}
+	want := []testPoint{{map[string]string{"service": "api"}, time.Minute, "ok"}}
+	if got := testPoints(t, start, ts); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected points %v; got %v", want, got)
+	}
+}
+
+func TestStackdriverDataErrors(t *testing.T) {
+	for _, tt := range []struct {
+		desc      string
+		items     []map[string]interface{}
+		rpcErr    *rpcError
+		status    int
+		wantClass error
+	}{
+		{"invalid parameters", nil, &rpcError{Code: -32602, Message: "Invalid params."}, 0, tserrors.ErrSourcePermanent},
+		{"internal error", nil, &rpcError{Code: -32603, Message: "Internal error."}, 0, tserrors.ErrSourceTransient},
+		{"server unavailable", nil, nil, http.StatusServiceUnavailable, tserrors.ErrSourceTransient},
+		{"log items", []map[string]interface{}{{"itemid": "1", "value_type": "2"}}, nil, 0, nil},
+		{"mixed value types", []map[string]interface{}{{"itemid": "1", "value_type": "0"}, {"itemid": "2", "value_type": "4"}}, nil, 0, nil},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			f := newFakeZabbix(t)
+			f.results["item.get"] = tt.items
+			if tt.rpcErr != nil {
+				f.errors["item.get"] = tt.rpcErr
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				f.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+
+			m, err := NewSourceMetric("errors", &MetricConfig{Endpoint: server.URL, APIToken: "token", ItemIDs: []string{"1"}}, 0)
+			if err != nil {
+				t.Fatalf("unexpected error from NewSourceMetric: %v", err)
+			}
+			_, _, err = m.StackdriverData(context.Background(), time.Now().Add(-time.Hour), nil)
+			if err == nil {
+				t.Fatalf("expected StackdriverData to fail")
+			}
+			if tt.wantClass != nil && !errors.Is(err, tt.wantClass) {
+				t.Errorf("expected error %v to be classified as %v", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestMetricConfig(t *testing.T) {
+	for _, tt := range []struct {
+		desc    string
+		config  MetricConfig
+		wantErr bool
+	}{
+		{"item IDs with token", MetricConfig{APIToken: "t", ItemIDs: []string{"1"}}, false},
+		{"key with password", MetricConfig{Username: "u", Password: "p", Key: "k", Hosts: []string{"h"}}, false},
+		{"no credentials", MetricConfig{ItemIDs: []string{"1"}}, true},
+		{"token and username", MetricConfig{APIToken: "t", Username: "u", ItemIDs: []string{"1"}}, true},
+		{"no items", MetricConfig{APIToken: "t"}, true},
+		{"item IDs and key", MetricConfig{APIToken: "t", ItemIDs: []string{"1"}, Key: "k"}, true},
+		{"hosts without key", MetricConfig{APIToken: "t", ItemIDs: []string{"1"}, Hosts: []string{"h"}}, true},
+		{"trend value without trends", MetricConfig{APIToken: "t", Key: "k", TrendValue: "max"}, true},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			if err := tt.config.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() returned %v; want error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}